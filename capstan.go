@@ -10,7 +10,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mikelangelo-project/capstan/cmd"
 	"github.com/mikelangelo-project/capstan/core"
@@ -42,10 +46,16 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "capstan"
 	app.Version = VERSION
+	util.CapstanVersion = VERSION
 	app.Usage = "pack, ship, and run applications in light-weight VMs"
 	app.Flags = []cli.Flag{
 		cli.StringFlag{Name: "u", Usage: fmt.Sprintf("remote repository URL (default: \"%s\")", util.DefaultRepositoryUrl)},
 	}
+	app.Before = func(c *cli.Context) error {
+		// Proxy from the configuration file applies to all remote operations.
+		util.LoadCapstanSettings(util.CapstanRoot()).Proxy.Apply()
+		return nil
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:  "config",
@@ -59,6 +69,36 @@ func main() {
 						return nil
 					},
 				},
+				{
+					Name:      "ls",
+					Usage:     "list config sets of the package or image",
+					ArgsUsage: "[image-name|package-dir]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "json", Usage: "print config sets in JSON format"},
+						cli.StringFlag{Name: "p", Value: hypervisor.Default(), Usage: "hypervisor of the image: qemu|vbox|vmw|gce"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) > 1 {
+							return cli.NewExitError("usage: capstan config ls [image-name|package-dir]", EX_USAGE)
+						}
+						hypervisor := c.String("p")
+						if !isValidHypervisor(hypervisor) {
+							return cli.NewExitError(fmt.Sprintf("error: '%s' is not a supported hypervisor\n", hypervisor), EX_DATAERR)
+						}
+
+						// The current directory is listed unless told otherwise.
+						target := "."
+						if len(c.Args()) == 1 {
+							target = c.Args().First()
+						}
+
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.ConfigList(repo, hypervisor, target, c.Bool("json")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
 			},
 		},
 		{
@@ -77,7 +117,7 @@ func main() {
 		},
 		{
 			Name:  "import",
-			Usage: "import an image to the local repository",
+			Usage: "import an image (possibly compressed with xz or zstd) to the local repository",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "v", Value: "", Usage: "image version"},
 				cli.StringFlag{Name: "c", Value: "", Usage: "image creation date"},
@@ -96,6 +136,25 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:      "export",
+			Usage:     "export an image from the local repository into a (compressed) file",
+			ArgsUsage: "image-name [target-file]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "qcow2", Usage: "format of the exported image: qcow2|raw"},
+				compressFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) < 1 || len(c.Args()) > 2 {
+					return cli.NewExitError("usage: capstan export [image-name] [target-file]", EX_USAGE)
+				}
+				repo := util.NewRepo(c.GlobalString("u"))
+				if err := cmd.ExportImage(repo, c.Args()[0], c.Args().Get(1), c.String("format"), c.String("compress")); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
 		{
 			Name:  "pull",
 			Usage: "pull an image from a repository",
@@ -118,6 +177,49 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "bundle",
+			Usage: "offline bundles of packages and images",
+			Subcommands: []cli.Command{
+				{
+					Name:      "export",
+					Usage:     "packs the package or image with all its dependencies and the loader into a single archive",
+					ArgsUsage: "[package-name|package-dir|image-name] [target-file]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "pull-missing, p", Usage: "attempt to pull packages missing from a local repository"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) < 1 || len(c.Args()) > 2 {
+							return cli.NewExitError("usage: capstan bundle export [package-name|package-dir|image-name] [target-file]", EX_USAGE)
+						}
+
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.ExportBundle(repo, c.Args()[0], c.Args().Get(1), c.Bool("pull-missing")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:      "import",
+					Usage:     "imports packages and images of the bundle into the local repository",
+					ArgsUsage: "bundle-file",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan bundle import [bundle-file]", EX_USAGE)
+						}
+
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.ImportBundle(repo, c.Args()[0]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
+			},
+		},
 		{
 			Name:  "rmi",
 			Usage: "delete an image from a repository",
@@ -136,23 +238,54 @@ func main() {
 		{
 			Name:      "run",
 			Usage:     "launch a VM. You may pass the image name as the first argument.",
-			ArgsUsage: "instance-name",
-			Flags: []cli.Flag{
+			ArgsUsage: "instance-name [-- application-args...]",
+			Flags: append([]cli.Flag{
 				cli.StringFlag{Name: "i", Value: "", Usage: "image_name"},
 				cli.StringFlag{Name: "p", Value: hypervisor.Default(), Usage: "hypervisor: qemu|vbox|vmw|gce"},
-				cli.StringFlag{Name: "m", Value: "1G", Usage: "memory size"},
-				cli.IntFlag{Name: "c", Value: 2, Usage: "number of CPUs"},
-				cli.StringFlag{Name: "n", Value: "nat", Usage: "networking: nat|bridge|tap|vhost"},
+				cli.StringSliceFlag{Name: "publish", Value: new(cli.StringSlice), Usage: "port to publish [host-ip:]host-port:guest-port[/udp], a free host port is published if it is omitted (repeatable)"},
+				cli.StringFlag{Name: "m", Value: runtime.DefaultMemory, Usage: "memory size (defaults to memory declared in meta/run.yaml)"},
+				cli.IntFlag{Name: "c", Value: runtime.DefaultCpus, Usage: "number of CPUs (defaults to cpus declared in meta/run.yaml)"},
+				cli.StringFlag{Name: "n", Value: "nat", Usage: "networking: nat|bridge|tap|vhost|private"},
 				cli.BoolFlag{Name: "v", Usage: "verbose mode"},
-				cli.StringFlag{Name: "b", Value: "", Usage: "networking device (bridge or tap): e.g., virbr0, vboxnet0, tap0"},
-				cli.StringSliceFlag{Name: "f", Value: new(cli.StringSlice), Usage: "port forwarding rules"},
+				cli.StringFlag{Name: "b", Value: "", Usage: "networking device (bridge or tap): e.g., virbr0, vboxnet0, tap0, or name of private network"},
+				cli.StringSliceFlag{Name: "f", Value: new(cli.StringSlice), Usage: "port to publish, same as --publish (deprecated)"},
+				cli.BoolFlag{Name: "auto-ports", Usage: "forward free host ports instead of those that are in use (qemu only)"},
+				cli.StringFlag{Name: "ipv6-net", Usage: "IPv6 prefix of nat networking e.g. fd00::/64 (qemu only)"},
+				cli.StringFlag{Name: "ipv6-host", Usage: "IPv6 address of the host within --ipv6-net e.g. fd00::2 (qemu only)"},
+				cli.BoolFlag{Name: "create-tap", Usage: "create the tap device given with -b before launch and delete it on stop (implies --persist, needs privileges to configure network devices)"},
+				cli.StringFlag{Name: "tap-bridge", Usage: "bridge that the tap device created with --create-tap is attached to"},
+				cli.StringFlag{Name: "ingress-rate", Usage: "limit of traffic towards the instance e.g. 10mbit or 1mbps (tap, qemu only, needs privileges to configure network devices)"},
+				cli.StringFlag{Name: "egress-rate", Usage: "limit of traffic sent by the instance e.g. 10mbit or 1mbps (tap, qemu only, needs privileges to configure network devices)"},
+				cli.StringFlag{Name: "hostname", Usage: "hostname given to the guest via DHCP (nat, qemu only)"},
+				cli.StringSliceFlag{Name: "dns-search", Value: new(cli.StringSlice), Usage: "DNS search domain given to the guest via DHCP (repeatable, nat, qemu only)"},
+				cli.StringFlag{Name: "nat-dns", Usage: "address of the DNS server within " + nat.UserNetwork + " (nat, qemu only)"},
+				cli.StringFlag{Name: "tftp", Usage: "directory served to the guest over TFTP (nat, qemu only)"},
+				cli.StringFlag{Name: "bootfile", Usage: "file in --tftp directory offered to the guest for network boot"},
+				cli.StringFlag{Name: "ip", Usage: "static IP of the guest instead of DHCP e.g. 192.168.122.10/24 (bridge, tap and private, qemu only)"},
+				cli.StringFlag{Name: "netmask", Usage: "netmask of the static IP unless it is given in CIDR notation"},
+				cli.StringFlag{Name: "gateway", Usage: "default gateway of the guest with static IP"},
+				cli.StringFlag{Name: "dns", Usage: "DNS server of the guest with static IP"},
+				cli.StringFlag{Name: "data-disk", Usage: "size of the writable data disk of the instance e.g. 1G, kept until the instance is deleted (qemu only)"},
+				cli.StringFlag{Name: "data-path", Value: "/data", Usage: "path that the data disk is mounted at"},
+				cli.StringSliceFlag{Name: "tmpfs", Value: new(cli.StringSlice), Usage: "path kept in memory of the instance e.g. /tmp (repeatable, qemu only)"},
+				cli.StringFlag{Name: "cpu", Usage: "CPU model of the instance e.g. Haswell or host,+aes (qemu only, host CPU with KVM unless given)"},
+				cli.BoolFlag{Name: "cloud-init", Usage: "attach a cloud-init seed ISO with instance ID and hostname of the instance (qemu only)"},
+				cli.StringFlag{Name: "user-data", Usage: "file with cloud-init user-data given to the guest (implies --cloud-init)"},
+				cli.StringSliceFlag{Name: "ssh-key", Value: new(cli.StringSlice), Usage: "file with SSH public key given to the guest via cloud-init (repeatable, implies --cloud-init)"},
 				cli.StringFlag{Name: "gce-upload-dir", Value: "", Usage: "Directory to upload local image to: e.g., gs://osvimg"},
 				cli.StringFlag{Name: "mac", Value: "", Usage: "MAC address. If not specified, the MAC address will be generated automatically."},
 				cli.StringFlag{Name: "execute,e", Usage: "set the command line to execute"},
 				cli.StringFlag{Name: "boot", Usage: "specify config_set name to boot unikernel with"},
 				cli.BoolFlag{Name: "persist", Usage: "persist instance parameters (only relevant for qemu instances)"},
-				cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of environment variable e.g. PORT=8000 (repeatable)"},
-			},
+				cli.BoolFlag{Name: "autostart", Usage: "launch the instance with 'capstan up --all-autostart' (implies --persist, qemu only)"},
+				cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "override value of environment variable e.g. PORT=8000 (repeatable)"},
+				bootOptsFlag(),
+				cli.StringFlag{Name: "size, s", Usage: "grow instance disk to given size (use M or G suffix, qemu only)"},
+				cli.StringFlag{Name: "key-file", Usage: "file with the key of encrypted image (prompted for when not given)"},
+				cli.StringSliceFlag{Name: "label", Value: new(cli.StringSlice), Usage: "label the instance e.g. env=test (repeatable, implies --persist for qemu)"},
+				cli.IntFlag{Name: "scale", Usage: "launch given number of instances of the image named <instance-name>-<n> or with %d in the name replaced (qemu only)"},
+				profileFlag(),
+			}, qcow2Flags()...),
 			Action: func(c *cli.Context) error {
 				// Check for orphaned instances (those with osv.monitor and disk.qcow2, but
 				// without osv.config) and remove them.
@@ -161,35 +294,189 @@ func main() {
 				}
 
 				bootOpts := cmd.BootOptions{
-					Cmd:     c.String("execute"),
-					Boot:    c.String("boot"),
-					EnvList: c.StringSlice("env"),
+					Cmd:  c.String("execute"),
+					Boot: c.String("boot"),
 				}
 				bootCmd, err := bootOpts.GetCmd()
 				if err != nil {
 					return cli.NewExitError(err, EX_DATAERR)
 				}
 
+				// Environment variables override those of the config set the image boots.
+				env, err := util.ParseEnvironmentList(c.StringSlice("env"))
+				if err != nil {
+					return cli.NewExitError(err, EX_USAGE)
+				}
+				kernelOpts, err := bootOptsFlags(c)
+				if err != nil {
+					return cli.NewExitError(err, EX_USAGE)
+				}
+
+				labels, err := util.ParseLabels(c.StringSlice("label"))
+				if err != nil {
+					return cli.NewExitError(err, EX_USAGE)
+				}
+
+				// Arguments after -- are appended to the arguments of the application.
+				positional, appArgs := splitAppArgs(c.Args())
+
+				var diskSize int64
+				if c.String("size") != "" {
+					if diskSize, err = util.ParseMemSize(c.String("size")); err != nil {
+						return cli.NewExitError(fmt.Sprintf("Incorrect disk size format: %s\n", err), EX_USAGE)
+					}
+				}
+
+				hypervisorName := c.String("p")
+				if !isValidHypervisor(hypervisorName) {
+					return cli.NewExitError(fmt.Sprintf("error: '%s' is not a supported hypervisor\n", hypervisorName), EX_DATAERR)
+				}
+				natRules, err := nat.Parse(append(c.StringSlice("publish"), c.StringSlice("f")...))
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_USAGE)
+				}
+
 				config := &runtime.RunConfig{
-					InstanceName: c.Args().First(),
+					InstanceName: positional.First(),
 					ImageName:    c.String("i"),
-					Hypervisor:   c.String("p"),
+					Hypervisor:   hypervisorName,
 					Verbose:      c.Bool("v"),
-					Memory:       c.String("m"),
-					Cpus:         c.Int("c"),
 					Networking:   c.String("n"),
 					Bridge:       c.String("b"),
-					NatRules:     nat.Parse(c.StringSlice("f")),
+					NatRules:     natRules,
 					GCEUploadDir: c.String("gce-upload-dir"),
 					MAC:          c.String("mac"),
 					Cmd:          bootCmd,
 					Persist:      c.Bool("persist"),
+					DiskSize:     diskSize,
+					KeyFile:      c.String("key-file"),
+					Env:          env,
+					Args:         appArgs,
+					Labels:       labels,
+					Autostart:    c.Bool("autostart"),
+					AutoPorts:    c.Bool("auto-ports"),
+					Profile:      selectedProfile(c),
+					IPv6Net:      c.String("ipv6-net"),
+					IPv6Host:     c.String("ipv6-host"),
+					CreateTap:    c.Bool("create-tap"),
+					TapBridge:    c.String("tap-bridge"),
+					IngressRate:  c.String("ingress-rate"),
+					EgressRate:   c.String("egress-rate"),
+					DataDisk:     c.String("data-disk"),
+					DataPath:     c.String("data-path"),
+					Tmpfs:        c.StringSlice("tmpfs"),
+					CPUModel:     c.String("cpu"),
+					BootOpts:     kernelOpts,
+					NatOptions: nat.Options{
+						Hostname:  c.String("hostname"),
+						DNSSearch: c.StringSlice("dns-search"),
+						DNS:       c.String("nat-dns"),
+						TFTP:      c.String("tftp"),
+						Bootfile:  c.String("bootfile"),
+					},
+					GuestNetwork: util.GuestNetwork{
+						IP:      c.String("ip"),
+						Netmask: c.String("netmask"),
+						Gateway: c.String("gateway"),
+						DNS:     c.String("dns"),
+					},
+				}
+				// Resources not given explicitly are taken from meta/run.yaml.
+				if c.IsSet("m") {
+					config.Memory = c.String("m")
+				}
+				if c.IsSet("c") {
+					config.Cpus = c.Int("c")
 				}
 
 				if !isValidHypervisor(config.Hypervisor) {
 					return cli.NewExitError(fmt.Sprintf("error: '%s' is not a supported hypervisor\n", config.Hypervisor), EX_DATAERR)
 				}
+				if config.Autostart && config.Hypervisor != "qemu" {
+					return cli.NewExitError("--autostart is only supported for qemu", EX_USAGE)
+				}
+				if config.IPv6Host != "" && config.IPv6Net == "" {
+					return cli.NewExitError("--ipv6-host requires --ipv6-net", EX_USAGE)
+				}
+				if config.IPv6Net != "" {
+					if config.Hypervisor != "qemu" || config.Networking != "nat" {
+						return cli.NewExitError("--ipv6-net is only supported for qemu with nat networking", EX_USAGE)
+					}
+					if err := nat.ValidateIPv6(config.IPv6Net, config.IPv6Host); err != nil {
+						return cli.NewExitError(err.Error(), EX_USAGE)
+					}
+				}
+				if !config.NatOptions.IsEmpty() {
+					if config.Hypervisor != "qemu" || config.Networking != "nat" {
+						return cli.NewExitError("--hostname, --dns-search, --nat-dns and --tftp are only supported for qemu with nat networking", EX_USAGE)
+					}
+					if err := config.NatOptions.Validate(); err != nil {
+						return cli.NewExitError(err.Error(), EX_USAGE)
+					}
+					// The instance may be launched from another directory later on.
+					if config.NatOptions.TFTP != "" {
+						config.NatOptions.TFTP, _ = filepath.Abs(config.NatOptions.TFTP)
+					}
+				}
+				if config.TapBridge != "" && !config.CreateTap {
+					return cli.NewExitError("--tap-bridge requires --create-tap", EX_USAGE)
+				}
+				if config.CreateTap && (config.Hypervisor != "qemu" || config.Networking != "tap" || config.Bridge == "") {
+					return cli.NewExitError("--create-tap is only supported for qemu with tap networking and device name given with -b", EX_USAGE)
+				}
+				if config.IngressRate != "" || config.EgressRate != "" {
+					if config.Hypervisor != "qemu" || config.Networking != "tap" {
+						return cli.NewExitError("--ingress-rate and --egress-rate are only supported for qemu with tap networking", EX_USAGE)
+					}
+					for _, rate := range []string{config.IngressRate, config.EgressRate} {
+						if _, err := util.ParseRate(rate); rate != "" && err != nil {
+							return cli.NewExitError(err.Error(), EX_USAGE)
+						}
+					}
+				}
+				if config.DataDisk != "" || len(config.Tmpfs) > 0 {
+					if config.Hypervisor != "qemu" {
+						return cli.NewExitError("--data-disk and --tmpfs are only supported for qemu", EX_USAGE)
+					}
+					if err := validateDataVolumes(config); err != nil {
+						return cli.NewExitError(err.Error(), EX_USAGE)
+					}
+				}
+				if config.CPUModel != "" && config.Hypervisor != "qemu" {
+					return cli.NewExitError("--cpu is only supported for qemu", EX_USAGE)
+				}
+				if c.Bool("cloud-init") || c.IsSet("user-data") || len(c.StringSlice("ssh-key")) > 0 {
+					if config.Hypervisor != "qemu" {
+						return cli.NewExitError("--cloud-init, --user-data and --ssh-key are only supported for qemu", EX_USAGE)
+					}
+					if config.CloudInit, err = cloudInitFlags(c); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+				}
+				if config.Networking == "private" && config.Hypervisor != "qemu" {
+					return cli.NewExitError("private networking is only supported for qemu", EX_USAGE)
+				}
+				if !config.GuestNetwork.IsEmpty() {
+					if config.Hypervisor != "qemu" || !util.StaticNetworking(config.Networking) {
+						return cli.NewExitError("--ip is only supported for qemu with bridge, tap or private networking", EX_USAGE)
+					}
+					if err := config.GuestNetwork.Validate(); err != nil {
+						return cli.NewExitError(err.Error(), EX_USAGE)
+					}
+				}
 				repo := util.NewRepo(c.GlobalString("u"))
+				if err := applyQcow2Flags(repo, c); err != nil {
+					return cli.NewExitError(err.Error(), EX_USAGE)
+				}
+				if c.IsSet("scale") {
+					if c.Int("scale") < 1 {
+						return cli.NewExitError("--scale must be at least 1", EX_USAGE)
+					}
+					if err := cmd.RunReplicas(repo, config, c.Int("scale")); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+					return nil
+				}
 				if err := cmd.RunInstance(repo, config); err != nil {
 					return cli.NewExitError(err.Error(), EX_DATAERR)
 				}
@@ -203,6 +490,10 @@ func main() {
 				cli.StringFlag{Name: "p", Value: hypervisor.Default(), Usage: "hypervisor: qemu|vbox|vmw|gce"},
 				cli.StringFlag{Name: "m", Value: "512M", Usage: "memory size"},
 				cli.BoolFlag{Name: "v", Usage: "verbose mode"},
+				cli.StringFlag{Name: "size, s", Usage: "grow the image to given size (use M or G suffix, qemu only)"},
+				cli.StringFlag{Name: "osv-src", Usage: "build OSv from the source tree in the directory and use it as the base image (qemu only)"},
+				cli.StringFlag{Name: "osv-mode", Value: "release", Usage: "mode of the OSv build: release|debug (with --osv-src)"},
+				cli.BoolFlag{Name: "osv-prebuilt", Usage: "use artifacts of a previous OSv build instead of building it (with --osv-src)"},
 			},
 			Action: func(c *cli.Context) error {
 				imageName := c.Args().First()
@@ -221,108 +512,688 @@ func main() {
 					Name:       imageName,
 					Hypervisor: hypervisor,
 				}
+				var size int64
+				if c.String("size") != "" {
+					var err error
+					if size, err = util.ParseMemSize(c.String("size")); err != nil {
+						return cli.NewExitError(fmt.Sprintf("Incorrect image size format: %s\n", err), EX_USAGE)
+					}
+				}
 				template, err := core.ReadTemplateFile("Capstanfile")
 				if err != nil {
 					return cli.NewExitError(err.Error(), EX_DATAERR)
 				}
-				if err := cmd.Build(repo, image, template, c.Bool("v"), c.String("m")); err != nil {
+				if dir := c.String("osv-src"); dir != "" {
+					if hypervisor != "qemu" {
+						return cli.NewExitError("--osv-src is only supported for qemu", EX_USAGE)
+					}
+					if err := cmd.ValidateOSvMode(c.String("osv-mode")); err != nil {
+						return cli.NewExitError(err.Error(), EX_USAGE)
+					}
+					src := cmd.OSvSource{Dir: dir, Mode: c.String("osv-mode"), Prebuilt: c.Bool("osv-prebuilt")}
+					if err := cmd.BuildOSvSource(repo, src); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+					template.Base = cmd.OSvSourceBaseImage
+				} else if c.IsSet("osv-mode") || c.Bool("osv-prebuilt") {
+					return cli.NewExitError("--osv-mode and --osv-prebuilt require --osv-src", EX_USAGE)
+				}
+				if err := cmd.Build(repo, image, template, c.Bool("v"), c.String("m"), size); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "compose",
+			Usage: "compose the image from a folder or a file",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{Name: "loader_image, l", Usage: "the base loader image (" + util.DefaultLoaderImage(util.FilesystemZFS) + " or " + util.DefaultLoaderImage(util.FilesystemROFS) + " unless given)"},
+				cli.StringFlag{Name: "loader-version", Usage: "version of the OSv loader to compose with e.g. 0.24 (instead of --loader_image)"},
+				cli.StringFlag{Name: "size, s", Value: "10G", Usage: "size of the target user partition (use M or G suffix)"},
+				cli.BoolFlag{Name: "all", Usage: "compose all members of the workspace in the current directory in dependency order"},
+				cli.BoolFlag{Name: "pull-missing, p", Usage: "attempt to pull packages missing from a local repository (with --all)"},
+				cli.BoolFlag{Name: "verbose, v", Usage: "verbose mode (with --all)"},
+				filesystemFlag(),
+				immutableFlag(),
+				profileFlag(),
+			}, append(qcow2Flags(), encryptionFlags()...)...),
+			Action: func(c *cli.Context) error {
+				fs, err := composeFilesystem(c)
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_USAGE)
+				}
+
+				if c.Bool("all") {
+					if len(c.Args()) != 0 {
+						return cli.NewExitError("Usage: capstan compose --all", EX_USAGE)
+					}
+					repo := util.NewRepo(c.GlobalString("u"))
+					if err := applyQcow2Flags(repo, c); err != nil {
+						return cli.NewExitError(err.Error(), EX_USAGE)
+					}
+					imageSize, err := util.ParseMemSize(c.String("size"))
+					if err != nil {
+						return cli.NewExitError(fmt.Sprintf("Incorrect image size format: %s\n", err), EX_DATAERR)
+					}
+					keyFile, cleanup, err := encryptionKeyFile(c)
+					if err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+					defer cleanup()
+
+					workspaceDir, _ := os.Getwd()
+					images, err := cmd.ComposeWorkspace(repo, workspaceDir, imageSize, c.Bool("verbose"), c.Bool("pull-missing"), fs, selectedProfile(c))
+					if err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+					if keyFile != "" {
+						for _, image := range images {
+							if err := cmd.EncryptImage(repo, image, keyFile); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+						}
+					}
+					return nil
+				}
+
+				if len(c.Args()) != 2 {
+					return cli.NewExitError("Usage: capstan compose [image-name] [path-to-upload]", EX_USAGE)
+				}
+
+				// Name of the application (or image) that will be used in the internal repository.
+				appName := c.Args()[0]
+				// File or directory path that needs to be uploaded
+				uploadPath := c.Args()[1]
+
+				repo := util.NewRepo(c.GlobalString("u"))
+				if err := applyQcow2Flags(repo, c); err != nil {
+					return cli.NewExitError(err.Error(), EX_USAGE)
+				}
+
+				loaderImage := c.String("l")
+				if version := c.String("loader-version"); version != "" {
+					if loaderImage != "" {
+						return cli.NewExitError("--loader_image and --loader-version are mutually exclusive", EX_USAGE)
+					}
+					if loaderImage, err = cmd.ResolveLoader(repo, fs, version, c.Bool("pull-missing")); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+				}
+
+				imageSize, err := util.ParseMemSize(c.String("size"))
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Incorrect image size format: %s\n", err), EX_DATAERR)
+				}
+
+				keyFile, cleanup, err := encryptionKeyFile(c)
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				defer cleanup()
+
+				if err := cmd.Compose(repo, loaderImage, imageSize, uploadPath, appName, fs); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				if keyFile != "" {
+					if err := cmd.EncryptImage(repo, appName, keyFile); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "images",
+			ShortName: "i",
+			Usage:     "list images",
+			Action: func(c *cli.Context) error {
+				repo := util.NewRepo(c.GlobalString("u"))
+				repo.ListImages()
+
+				return nil
+			},
+		},
+		{
+			Name:  "image",
+			Usage: "image manipulation tools",
+			Subcommands: []cli.Command{
+				{
+					Name:      "inspect",
+					Usage:     "shows the boot command embedded into the image",
+					ArgsUsage: "image-name|image-file",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan image inspect [image-name|image-file]", EX_USAGE)
+						}
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.InspectImage(repo, c.Args()[0]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "search",
+			Usage: "search a remote images",
+			Action: func(c *cli.Context) error {
+				image := ""
+				if len(c.Args()) > 0 {
+					image = c.Args()[0]
+				}
+				repo := util.NewRepo(c.GlobalString("u"))
+				for _, url := range repo.RemoteURLs() {
+					if len(repo.RemoteURLs()) > 1 {
+						fmt.Printf("\nRepository %s\n", url)
+					}
+					if err := util.ListImagesRemote(url, image); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "instances",
+			ShortName: "I",
+			Usage:     "list instances",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "table", Usage: "output format (table|json|yaml)"},
+				selectorFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				format := c.String("format")
+				if format != "table" && format != "json" && format != "yaml" {
+					return cli.NewExitError(fmt.Sprintf("unsupported format '%s', use one of table|json|yaml", format), EX_USAGE)
+				}
+				repo := util.NewRepo(c.GlobalString("u"))
+				if err := cmd.Instances(repo, format, c.String("selector"), os.Stdout); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:      "exec",
+			Usage:     "runs a command in a running instance using OSv httpserver",
+			ArgsUsage: "instance-name command [args...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "address", Usage: "host:port of the httpserver (default: the host port forwarding to guest port 8000)"},
+				cli.BoolFlag{Name: "no-wait", Usage: "do not wait for the command to finish"},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) < 2 {
+					return cli.NewExitError("usage: capstan exec [instance-name] [command]", EX_USAGE)
+				}
+				command := strings.Join(c.Args()[1:], " ")
+				if err := cmd.ExecInstance(c.Args()[0], c.String("address"), command, !c.Bool("no-wait"), os.Stdout); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "stats",
+			Usage:     "shows resource usage of a running instance",
+			ArgsUsage: "instance-name",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "address", Usage: "host:port of the httpserver (default: the host port forwarding to guest port 8000)"},
+				cli.StringFlag{Name: "format", Value: "table", Usage: "output format (table|json)"},
+				cli.DurationFlag{Name: "interval", Value: 2 * time.Second, Usage: "time between statistics"},
+				cli.IntFlag{Name: "count", Usage: "number of statistics to show (default: until interrupted)"},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 1 {
+					return cli.NewExitError("usage: capstan stats [instance-name]", EX_USAGE)
+				}
+				format := c.String("format")
+				if format != "table" && format != "json" {
+					return cli.NewExitError(fmt.Sprintf("unsupported format '%s', use one of table|json", format), EX_USAGE)
+				}
+				if err := cmd.Stats(c.Args().First(), c.String("address"), format, c.Duration("interval"), c.Int("count"), os.Stdout); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "cp",
+			Usage:     "copies a file from or to a running instance using OSv httpserver",
+			ArgsUsage: "instance-name:path local-path | local-path instance-name:path",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "address", Usage: "host:port of the httpserver (default: the host port forwarding to guest port 8000)"},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 2 {
+					return cli.NewExitError("usage: capstan cp [instance-name:path] [local-path] or capstan cp [local-path] [instance-name:path]", EX_USAGE)
+				}
+				if err := cmd.CopyInstanceFile(c.Args()[0], c.Args()[1], c.String("address")); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "port",
+			Usage: "manages port forwarding of qemu instances using NAT networking",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "forwards a host port to the instance, without restarting it when it is running",
+					ArgsUsage: "instance-name [host-ip:]host-port:guest-port[/udp]",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							return cli.NewExitError("usage: capstan port add [instance-name] [host-port:guest-port]", EX_USAGE)
+						}
+						if err := cmd.AddPort(c.Args()[0], c.Args()[1]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "stops forwarding a host port to the instance",
+					ArgsUsage: "instance-name host-port[:guest-port][/udp]",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							return cli.NewExitError("usage: capstan port remove [instance-name] [host-port]", EX_USAGE)
+						}
+						if err := cmd.RemovePort(c.Args()[0], c.Args()[1]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "loader",
+			Usage: "manages versions of the OSv loader that images are composed from",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "lists loader images with their versions",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "remote", Usage: "also list loader images available in remote repositories"},
+					},
+					Action: func(c *cli.Context) error {
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.ListLoaders(repo, c.Bool("remote")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "network",
+			Usage: "manages bridges that hand out addresses and hostnames to instances",
+			Subcommands: []cli.Command{
+				{
+					Name:      "create",
+					Usage:     "creates a bridge with dnsmasq serving DHCP and DNS to instances attached to it",
+					ArgsUsage: "bridge-name",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "address", Value: util.DefaultManagedNetworkAddress, Usage: "address of the host on the bridge along with the subnet of instances"},
+						cli.StringFlag{Name: "domain", Usage: "domain appended to hostnames of instances"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan network create [bridge-name]", EX_USAGE)
+						}
+						if err := cmd.CreateNetwork(c.Args().First(), c.String("address"), c.String("domain")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "delete",
+					Usage:     "stops dnsmasq of the bridge and deletes the bridge",
+					ArgsUsage: "bridge-name",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan network delete [bridge-name]", EX_USAGE)
+						}
+						if err := cmd.DeleteNetwork(c.Args().First()); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "lists bridges managed by capstan along with addresses of instances",
+					Action: func(c *cli.Context) error {
+						if err := cmd.ListNetworks(); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "instance",
+			Usage: "instance manipulation tools",
+			Subcommands: []cli.Command{
+				{
+					Name:      "inspect",
+					Usage:     "shows details of an instance, including when and from which image it was created",
+					ArgsUsage: "instance-name",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "format", Value: "table", Usage: "output format (table|json|yaml)"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan instance inspect [instance-name]", EX_USAGE)
+						}
+						format := c.String("format")
+						if format != "table" && format != "json" && format != "yaml" {
+							return cli.NewExitError(fmt.Sprintf("unsupported format '%s', use one of table|json|yaml", format), EX_USAGE)
+						}
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.InspectInstance(repo, c.Args()[0], format, os.Stdout); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "rebase",
+					Usage:     "points instance disk to a new base image (omit base image to flatten the disk)",
+					ArgsUsage: "instance-name [image-name|image-file]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "unsafe", Usage: "only rewrite the reference, use when the old base image is gone"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) < 1 || len(c.Args()) > 2 {
+							return cli.NewExitError("usage: capstan instance rebase [instance-name] [image-name|image-file]", EX_USAGE)
+						}
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.RebaseInstance(repo, c.Args()[0], c.Args().Get(1), c.Bool("unsafe")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "commit",
+					Usage:     "writes changes of instance disk into its base image",
+					ArgsUsage: "instance-name",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "force, f", Usage: "commit even if base image is used by other instances"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan instance commit [instance-name]", EX_USAGE)
+						}
+						if err := cmd.CommitInstance(c.Args()[0], c.Bool("force")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "rename",
+					Usage:     "renames a stopped instance",
+					ArgsUsage: "instance-name new-name",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							return cli.NewExitError("usage: capstan instance rename [instance-name] [new-name]", EX_USAGE)
+						}
+						if err := cmd.RenameInstance(c.Args()[0], c.Args()[1]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "clone",
+					Usage:     "copies a stopped instance, including its disk, into a new instance with a new MAC address",
+					ArgsUsage: "instance-name new-name",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							return cli.NewExitError("usage: capstan instance clone [instance-name] [new-name]", EX_USAGE)
+						}
+						if err := cmd.CloneInstance(c.Args()[0], c.Args()[1]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "export",
+					Usage:     "writes a stopped instance, including its flattened disk, into an archive",
+					ArgsUsage: "instance-name",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "output, o", Usage: "archive to write (default: <instance-name>.instance.tar.gz)"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan instance export [instance-name]", EX_USAGE)
+						}
+						if err := cmd.ExportInstance(c.Args().First(), c.String("output")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "import",
+					Usage:     "creates an instance of an archive written by 'capstan instance export'",
+					ArgsUsage: "archive [instance-name]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "new-mac", Usage: "give the instance a new MAC address"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) < 1 || len(c.Args()) > 2 {
+							return cli.NewExitError("usage: capstan instance import [archive] [instance-name]", EX_USAGE)
+						}
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.ImportInstance(repo, c.Args().First(), c.Args().Get(1), c.Bool("new-mac")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "autostart",
+					Usage:     "marks a persisted instance to be launched by 'capstan up --all-autostart'",
+					ArgsUsage: "instance-name",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "off", Usage: "remove the mark instead"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan instance autostart [instance-name]", EX_USAGE)
+						}
+						if err := cmd.SetAutostart(c.Args().First(), !c.Bool("off")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "changes memory and number of CPUs of a persisted instance without recreating it",
+					ArgsUsage: "instance-name",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "memory, m", Usage: "memory size e.g. 2G"},
+						cli.IntFlag{Name: "cpus, c", Usage: "number of CPUs"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan instance set [instance-name] [--memory size] [--cpus number]", EX_USAGE)
+						}
+						if c.IsSet("cpus") && c.Int("cpus") < 1 {
+							return cli.NewExitError("--cpus must be at least 1", EX_USAGE)
+						}
+						if err := cmd.SetResources(c.Args().First(), c.String("memory"), c.Int("cpus")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "stop",
+			Usage: "stop an instance",
+			Flags: []cli.Flag{
+				selectorFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				instances, err := selectedInstances(c, "usage: capstan stop [instance_name]")
+				if err != nil {
+					return err
+				}
+				for _, instance := range instances {
+					if err := cmd.Stop(instance); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "removes leftovers of instances and, optionally, unused images",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "images", Usage: "also remove images composed locally that no instance is based on"},
+				cli.BoolFlag{Name: "all", Usage: "with --images, also remove unused loader images and images pulled from remote repositories"},
+				cli.BoolFlag{Name: "force, f", Usage: "do not ask for confirmation"},
+			},
+			Action: func(c *cli.Context) error {
+				repo := util.NewRepo(c.GlobalString("u"))
+				if err := cmd.Prune(repo, c.Bool("images"), c.Bool("all"), c.Bool("force"), os.Stdin, os.Stdout); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "up",
+			Usage:     "launches existing instances in the background and waits for them to exit",
+			ArgsUsage: "[instance-name...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "all-autostart", Usage: "launch all instances marked for autostart, e.g. at host boot"},
+			},
+			Action: func(c *cli.Context) error {
+				repo := util.NewRepo(c.GlobalString("u"))
+				names := []string(c.Args())
+				if c.Bool("all-autostart") {
+					if len(names) != 0 {
+						return cli.NewExitError("instance names can not be combined with --all-autostart", EX_USAGE)
+					}
+					var err error
+					if names, err = cmd.AutostartInstances(repo); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+					if len(names) == 0 {
+						fmt.Println("No instances are marked for autostart")
+						return nil
+					}
+				} else if len(names) == 0 {
+					return cli.NewExitError("usage: capstan up [instance-name...] | --all-autostart", EX_USAGE)
+				}
+				if err := cmd.Up(repo, names); err != nil {
 					return cli.NewExitError(err.Error(), EX_DATAERR)
 				}
 				return nil
 			},
 		},
 		{
-			Name:  "compose",
-			Usage: "compose the image from a folder or a file",
+			Name:      "restart",
+			Usage:     "stop an instance and launch it again with the same settings",
+			ArgsUsage: "instance-name",
 			Flags: []cli.Flag{
-				cli.StringFlag{Name: "loader_image, l", Value: "mike/osv-loader", Usage: "the base loader image"},
-				cli.StringFlag{Name: "size, s", Value: "10G", Usage: "size of the target user partition (use M or G suffix)"},
+				cli.DurationFlag{Name: "timeout", Value: 30 * time.Second, Usage: "how long to wait for the instance to stop"},
+				cli.StringFlag{Name: "key-file", Usage: "file with the key of encrypted image (prompted for when not given)"},
 			},
 			Action: func(c *cli.Context) error {
-				if len(c.Args()) != 2 {
-					return cli.NewExitError("Usage: capstan compose [image-name] [path-to-upload]", EX_USAGE)
+				if len(c.Args()) != 1 {
+					return cli.NewExitError("usage: capstan restart [instance_name]", EX_USAGE)
 				}
-
-				// Name of the application (or image) that will be used in the internal repository.
-				appName := c.Args()[0]
-				// File or directory path that needs to be uploaded
-				uploadPath := c.Args()[1]
-
 				repo := util.NewRepo(c.GlobalString("u"))
-
-				loaderImage := c.String("l")
-
-				imageSize, err := util.ParseMemSize(c.String("size"))
-				if err != nil {
-					return cli.NewExitError(fmt.Sprintf("Incorrect image size format: %s\n", err), EX_DATAERR)
-				}
-
-				if err := cmd.Compose(repo, loaderImage, imageSize, uploadPath, appName); err != nil {
+				if err := cmd.Restart(repo, c.Args().First(), c.Duration("timeout"), c.String("key-file")); err != nil {
 					return cli.NewExitError(err.Error(), EX_DATAERR)
 				}
 				return nil
 			},
 		},
 		{
-			Name:      "images",
-			ShortName: "i",
-			Usage:     "list images",
+			Name:  "delete",
+			Usage: "delete an instance",
+			Flags: []cli.Flag{
+				selectorFlag(),
+			},
 			Action: func(c *cli.Context) error {
-				repo := util.NewRepo(c.GlobalString("u"))
-				repo.ListImages()
-
+				instances, err := selectedInstances(c, "usage: capstan delete [instance_name]")
+				if err != nil {
+					return err
+				}
+				for _, instance := range instances {
+					if err := cmd.Delete(instance); err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+				}
 				return nil
 			},
 		},
 		{
-			Name:  "search",
-			Usage: "search a remote images",
+			Name:  "compose-up",
+			Usage: "brings up all services of a topology file, each in its own instance",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file, f", Value: core.TopologyFileName, Usage: "topology file describing the services"},
+				cli.StringFlag{Name: "size, s", Value: "10G", Usage: "size of images composed of packages"},
+				cli.BoolFlag{Name: "verbose, v", Usage: "verbose mode"},
+			},
 			Action: func(c *cli.Context) error {
-				image := ""
-				if len(c.Args()) > 0 {
-					image = c.Args()[0]
+				size, err := util.ParseMemSize(c.String("size"))
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Incorrect image size format: %s\n", err), EX_USAGE)
 				}
 				repo := util.NewRepo(c.GlobalString("u"))
-				err := util.ListImagesRemote(repo.URL, image)
-				if err != nil {
+				if err := cmd.ComposeUp(repo, c.String("file"), size, c.Bool("verbose")); err != nil {
 					return cli.NewExitError(err.Error(), EX_DATAERR)
 				}
 				return nil
 			},
 		},
 		{
-			Name:      "instances",
-			ShortName: "I",
-			Usage:     "list instances",
-			Action: func(c *cli.Context) error {
-				cmd.Instances()
-
-				return nil
+			Name:  "compose-down",
+			Usage: "stops all instances of a topology file",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file, f", Value: core.TopologyFileName, Usage: "topology file describing the services"},
+				cli.BoolFlag{Name: "rm", Usage: "delete the instances as well"},
 			},
-		},
-		{
-			Name:  "stop",
-			Usage: "stop an instance",
 			Action: func(c *cli.Context) error {
-				if len(c.Args()) != 1 {
-					return cli.NewExitError("usage: capstan stop [instance_name]", EX_USAGE)
-				}
-				instance := c.Args()[0]
-				if err := cmd.Stop(instance); err != nil {
+				repo := util.NewRepo(c.GlobalString("u"))
+				if err := cmd.ComposeDown(repo, c.String("file"), c.Bool("rm")); err != nil {
 					return cli.NewExitError(err.Error(), EX_DATAERR)
 				}
 				return nil
 			},
 		},
 		{
-			Name:  "delete",
-			Usage: "delete an instance",
+			Name:      "validate",
+			Usage:     "validate meta/package.yaml and meta/run.yaml of the package",
+			ArgsUsage: "[package-dir]",
 			Action: func(c *cli.Context) error {
-				if len(c.Args()) != 1 {
-					return cli.NewExitError("usage: capstan delete [instance_name]", EX_USAGE)
+				if len(c.Args()) > 1 {
+					return cli.NewExitError("usage: capstan validate [package-dir]", EX_USAGE)
+				}
+				packageDir, _ := os.Getwd()
+				if len(c.Args()) == 1 {
+					packageDir = c.Args()[0]
 				}
-				instance := c.Args()[0]
-				if err := cmd.Delete(instance); err != nil {
+				if err := cmd.ValidatePackage(packageDir); err != nil {
 					return cli.NewExitError(err.Error(), EX_DATAERR)
 				}
 				return nil
@@ -343,6 +1214,7 @@ func main() {
 						cli.StringFlag{Name: "version,v", Usage: "package version"},
 						cli.StringSliceFlag{Name: "require", Usage: "specify package dependency"},
 						cli.StringFlag{Name: "runtime", Usage: "runtime to stub package for. Use 'capstan runtime list' to list all"},
+						cli.BoolFlag{Name: "interactive, i", Usage: "ask for package details, runtime, entrypoint and resources"},
 					},
 					Action: func(c *cli.Context) error {
 						if len(c.Args()) > 1 {
@@ -356,6 +1228,21 @@ func main() {
 							packagePath = c.Args()[0]
 						}
 
+						// Values provided with flags are offered as defaults.
+						if c.Bool("interactive") {
+							p := &core.Package{
+								Name:    c.String("name"),
+								Title:   c.String("title"),
+								Author:  c.String("author"),
+								Version: c.String("version"),
+								Require: c.StringSlice("require"),
+							}
+							if err := cmd.InitPackageInteractive(packagePath, p, c.String("runtime"), os.Stdin, os.Stdout); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+							return nil
+						}
+
 						// Author is a mandatory field.
 						if c.String("name") == "" {
 							return cli.NewExitError("You must provide the name of the package (--name or -n)", EX_USAGE)
@@ -413,22 +1300,37 @@ func main() {
 					Name:      "compose",
 					Usage:     "composes the package and all its dependencies into OSv image",
 					ArgsUsage: "image-name",
-					Flags: []cli.Flag{
+					Flags: append([]cli.Flag{
 						cli.StringFlag{Name: "size, s", Value: "10G", Usage: "total size of the target image (use M or G suffix)"},
 						cli.BoolFlag{Name: "update", Usage: "updates the existing target VM by uploading only modified files"},
 						cli.BoolFlag{Name: "verbose, v", Usage: "verbose mode"},
 						cli.StringFlag{Name: "run", Usage: "the command line to be executed in the VM"},
 						cli.BoolFlag{Name: "pull-missing, p", Usage: "attempt to pull packages missing from a local repository"},
+						cli.BoolFlag{Name: "locked", Usage: "refuse to compose if required packages differ from capstan.lock"},
+						cli.BoolFlag{Name: "vendored", Usage: "resolve required packages exclusively from the vendor directory"},
 						cli.StringFlag{Name: "boot", Usage: "specify default config_set name to boot unikernel with"},
+						cli.StringSliceFlag{Name: "target", Value: new(cli.StringSlice), Usage: "compose for the target (e.g. gce or x86_64) to upload its files listed in package.yaml (repeatable)"},
 						cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of environment variable e.g. PORT=8000 (repeatable)"},
-					},
+						bootOptsFlag(),
+						filesystemFlag(),
+						immutableFlag(),
+						cli.StringFlag{Name: "loader-version", Usage: "version of the OSv loader to compose with e.g. 0.24 or '>=0.24 <0.25' (overrides loader in package.yaml)"},
+						profileFlag(),
+					}, append(qcow2Flags(), encryptionFlags()...)...),
 					Action: func(c *cli.Context) error {
 						if len(c.Args()) != 1 {
 							return cli.NewExitError("Usage: capstan package compose [image-name]", EX_USAGE)
 						}
+						fs, err := composeFilesystem(c)
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_USAGE)
+						}
 
 						// Use the provided repository.
 						repo := util.NewRepo(c.GlobalString("u"))
+						if err := applyQcow2Flags(repo, c); err != nil {
+							return cli.NewExitError(err.Error(), EX_USAGE)
+						}
 
 						// Get the name of the application to be imported into Capstan's repository.
 						appName := c.Args().First()
@@ -446,17 +1348,43 @@ func main() {
 						// Always use the current directory for the package to compose.
 						packageDir, _ := os.Getwd()
 
+						if c.Bool("vendored") {
+							if pullMissing {
+								return cli.NewExitError("--vendored and --pull-missing are mutually exclusive", EX_USAGE)
+							}
+							if err := cmd.UseVendoredPackages(repo, packageDir); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+						}
+
+						kernelOpts, err := bootOptsFlags(c)
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_USAGE)
+						}
 						bootOpts := cmd.BootOptions{
 							Cmd:        c.String("run"),
 							Boot:       c.String("boot"),
 							EnvList:    c.StringSlice("env"),
 							PackageDir: packageDir,
+							BootOpts:   kernelOpts,
+							Platform:   targetPlatform(c),
+						}
+
+						keyFile, cleanup, err := encryptionKeyFile(c)
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
 						}
+						defer cleanup()
 
-						if err := cmd.ComposePackage(repo, imageSize, updatePackage, verbose, pullMissing,
-							packageDir, appName, &bootOpts); err != nil {
+						if err := cmd.ComposePackage(repo, imageSize, updatePackage, verbose, pullMissing, c.Bool("locked"),
+							packageDir, appName, fs, c.String("loader-version"), &bootOpts); err != nil {
 							return cli.NewExitError(err.Error(), EX_DATAERR)
 						}
+						if keyFile != "" {
+							if err := cmd.EncryptImage(repo, appName, keyFile); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+						}
 
 						return nil
 					},
@@ -466,8 +1394,12 @@ func main() {
 					Usage: "collects contents of this package and all required packages",
 					Flags: []cli.Flag{
 						cli.BoolFlag{Name: "pull-missing, p", Usage: "attempt to pull packages missing from a local repository"},
+						cli.BoolFlag{Name: "locked", Usage: "refuse to collect if required packages differ from capstan.lock"},
+						cli.BoolFlag{Name: "vendored", Usage: "resolve required packages exclusively from the vendor directory"},
 						cli.StringFlag{Name: "boot", Usage: "specify config_set name to boot unikernel with"},
+						cli.StringSliceFlag{Name: "target", Value: new(cli.StringSlice), Usage: "collect for the target (e.g. gce or x86_64) to include its files listed in package.yaml (repeatable)"},
 						cli.BoolFlag{Name: "verbose, v", Usage: "verbose mode"},
+						profileFlag(),
 					},
 					Action: func(c *cli.Context) error {
 						repo := util.NewRepo(c.GlobalString("u"))
@@ -475,7 +1407,33 @@ func main() {
 
 						pullMissing := c.Bool("pull-missing")
 
-						if err := cmd.CollectPackage(repo, packageDir, pullMissing, c.String("boot"), c.Bool("verbose")); err != nil {
+						if c.Bool("vendored") {
+							if pullMissing {
+								return cli.NewExitError("--vendored and --pull-missing are mutually exclusive", EX_USAGE)
+							}
+							if err := cmd.UseVendoredPackages(repo, packageDir); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+						}
+
+						if err := cmd.CollectPackage(repo, packageDir, pullMissing, c.Bool("locked"), c.String("boot"), targetPlatform(c), c.Bool("verbose")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:  "vendor",
+					Usage: "copies all required packages into the vendor directory of this package",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "pull-missing, p", Usage: "attempt to pull packages missing from a local repository"},
+					},
+					Action: func(c *cli.Context) error {
+						repo := util.NewRepo(c.GlobalString("u"))
+						packageDir, _ := os.Getwd()
+
+						if err := cmd.VendorPackages(repo, packageDir, c.Bool("pull-missing")); err != nil {
 							return cli.NewExitError(err.Error(), EX_DATAERR)
 						}
 
@@ -494,12 +1452,24 @@ func main() {
 					},
 				},
 				{
-					Name:  "import",
-					Usage: "builds the package at the given path and imports it into a chosen repository",
+					Name:      "import",
+					Usage:     "builds the package at the given path and imports it into a chosen repository",
+					ArgsUsage: "[package-file]",
+					Description: "Without arguments, package in the current directory is built and imported.\n   " +
+						"When package file (possibly compressed with xz or zstd) is given, it is imported as is.",
 					Action: func(c *cli.Context) error {
 						// Use the provided repository.
 						repo := util.NewRepo(c.GlobalString("u"))
 
+						if len(c.Args()) > 1 {
+							return cli.NewExitError("usage: capstan package import [package-file]", EX_USAGE)
+						} else if len(c.Args()) == 1 {
+							if err := cmd.ImportPackageFile(repo, c.Args().First()); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+							return nil
+						}
+
 						packageDir, err := os.Getwd()
 						if err != nil {
 							return cli.NewExitError(err.Error(), EX_DATAERR)
@@ -512,14 +1482,91 @@ func main() {
 						return nil
 					},
 				},
+				{
+					Name:      "export",
+					Usage:     "exports the package from the local repository into a (compressed) file",
+					ArgsUsage: "package-name [target-file]",
+					Flags: []cli.Flag{
+						compressFlag(),
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) < 1 || len(c.Args()) > 2 {
+							return cli.NewExitError("usage: capstan package export [package-name] [target-file]", EX_USAGE)
+						}
+
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.ExportPackage(repo, c.Args()[0], c.Args().Get(1), c.String("compress")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
 				{
 					Name:      "search",
-					Usage:     "searches for packages in the remote repository (partial name matches are also supported)",
+					Usage:     "searches for packages in the remote repositories (partial name matches are also supported)",
 					ArgsUsage: "[package-name]",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "runtime", Usage: "only packages of the given runtime (e.g. node, java)"},
+						cli.StringFlag{Name: "platform", Usage: "only packages built for the given architecture (e.g. x86_64) or independent of it"},
+						cli.StringFlag{Name: "version", Usage: "only versions satisfying the constraint (e.g. '>=1.2', '^2')"},
+						cli.StringFlag{Name: "format", Value: "table", Usage: "output format (table|json)"},
+					},
 					Action: func(c *cli.Context) error {
 						packageName := c.Args().First()
 						repo := util.NewRepo(c.GlobalString("u"))
-						if err := util.ListPackagesRemote(repo.URL, packageName); err != nil {
+						filter := cmd.PackageFilter{
+							Runtime:  c.String("runtime"),
+							Platform: c.String("platform"),
+							Version:  c.String("version"),
+						}
+						if err := cmd.SearchPackages(repo, packageName, filter, c.String("format"), os.Stdout); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:  "outdated",
+					Usage: "lists required packages of this package with newer versions available",
+					Action: func(c *cli.Context) error {
+						repo := util.NewRepo(c.GlobalString("u"))
+						packageDir, _ := os.Getwd()
+
+						outdated, err := cmd.OutdatedPackages(repo, packageDir)
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						cmd.PrintOutdatedPackages(outdated, os.Stdout)
+
+						return nil
+					},
+				},
+				{
+					Name:      "graph",
+					Usage:     "shows the transitive require graph of this package or the given package",
+					ArgsUsage: "[package-name]",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "format", Value: "dot", Usage: "output format (dot|json)"},
+						cli.BoolFlag{Name: "pull-missing, p", Usage: "attempt to pull packages missing from a local repository"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) > 1 {
+							return cli.NewExitError("usage: capstan package graph [package-name]", EX_USAGE)
+						}
+						if format := c.String("format"); format != "dot" && format != "json" {
+							return cli.NewExitError(fmt.Sprintf("unsupported format '%s', use one of dot|json", format), EX_USAGE)
+						}
+
+						repo := util.NewRepo(c.GlobalString("u"))
+						packageDir, _ := os.Getwd()
+
+						graph, err := cmd.PackageGraph(repo, packageDir, c.Args().First(), c.Bool("pull-missing"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						if err := cmd.PrintPackageGraph(graph, c.String("format"), os.Stdout); err != nil {
 							return cli.NewExitError(err.Error(), EX_DATAERR)
 						}
 
@@ -545,6 +1592,64 @@ func main() {
 						return nil
 					},
 				},
+				{
+					Name:      "contents",
+					Usage:     "lists files that were uploaded onto the composed image or that the package consists of",
+					ArgsUsage: "image-name|package-name|package-file",
+					Description: "Packages take precedence over composed images of the same name, use\n   " +
+						"--image or --package to choose explicitly. Package files may be\n   " +
+						"compressed with xz or zstd.",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "image", Usage: "list files uploaded onto the composed image"},
+						cli.BoolFlag{Name: "package", Usage: "list files of the package or package file"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan package contents [image-name|package-name|package-file]", EX_USAGE)
+						}
+						if c.Bool("image") && c.Bool("package") {
+							return cli.NewExitError("--image and --package are mutually exclusive", EX_USAGE)
+						}
+
+						repo := util.NewRepo(c.GlobalString("u"))
+						name := c.Args().First()
+						isPackage := repo.PackageExists(name)
+						if !isPackage {
+							_, err := os.Stat(name)
+							isPackage = err == nil
+						}
+						if c.Bool("image") || (!c.Bool("package") && !isPackage && repo.ImageExists("qemu", name)) {
+							if err := cmd.ImageContents(repo, name); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+							return nil
+						}
+						if err := cmd.PackageContents(repo, name, os.Stdout); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:      "diff",
+					Usage:     "shows files added, removed or changed between two packages",
+					ArgsUsage: "package-a package-b",
+					Description: "Packages are either packages from the local repository or package files\n   " +
+						"(possibly compressed with xz or zstd), e.g. exported releases.",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							return cli.NewExitError("usage: capstan package diff [package-a] [package-b]", EX_USAGE)
+						}
+
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.PackageDiff(repo, c.Args()[0], c.Args()[1], os.Stdout); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
 				{
 					Name:      "describe",
 					Usage:     "describes the package from local repository",
@@ -689,6 +1794,30 @@ func main() {
 	app.Run(os.Args)
 }
 
+// splitAppArgs splits command arguments into positional arguments and those
+// given after --, which are meant for the application.
+func splitAppArgs(args cli.Args) (cli.Args, []string) {
+	dash := -1
+	for i, arg := range os.Args {
+		if arg == "--" {
+			dash = i
+			break
+		}
+	}
+	if dash < 0 {
+		return args, nil
+	}
+
+	appArgs := os.Args[dash+1:]
+	positional := cli.Args{}
+	for _, arg := range args[:len(args)-len(appArgs)] {
+		if arg != "--" {
+			positional = append(positional, arg)
+		}
+	}
+	return positional, appArgs
+}
+
 func isValidHypervisor(hypervisor string) bool {
 	switch hypervisor {
 	case "qemu", "vbox", "vmw", "gce":
@@ -697,3 +1826,184 @@ func isValidHypervisor(hypervisor string) bool {
 		return false
 	}
 }
+
+// qcow2Flags returns flags that control how new QCOW2 images are created.
+func qcow2Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "preallocation", Usage: "qcow2 preallocation mode: off|metadata|falloc|full"},
+		cli.StringFlag{Name: "cluster-size", Usage: "qcow2 cluster size (use K or M suffix) e.g. 2M"},
+		cli.BoolFlag{Name: "compress", Usage: "compress qcow2 base image"},
+		cli.BoolFlag{Name: "no-compress", Usage: "do not compress qcow2 base image, even when config.yaml does"},
+	}
+}
+
+// applyQcow2Flags overrides the QCOW2 options from config.yaml with values given
+// on the command line.
+func applyQcow2Flags(repo *util.Repo, c *cli.Context) error {
+	if c.String("preallocation") != "" {
+		repo.Qcow2.Preallocation = c.String("preallocation")
+	}
+	if c.String("cluster-size") != "" {
+		repo.Qcow2.ClusterSize = c.String("cluster-size")
+	}
+	if c.Bool("compress") && c.Bool("no-compress") {
+		return fmt.Errorf("--compress and --no-compress can not be used together")
+	}
+	if c.Bool("compress") {
+		repo.Qcow2.Compress = true
+	}
+	if c.Bool("no-compress") {
+		repo.Qcow2.Compress = false
+	}
+	return repo.Qcow2.Validate()
+}
+
+// targetPlatform returns the platform that the package is composed or
+// collected for, with targets given with --target and the selected profile.
+func targetPlatform(c *cli.Context) runtime.Platform {
+	platform := runtime.DefaultPlatform()
+	platform.Targets = c.StringSlice("target")
+	platform.Profile = selectedProfile(c)
+	return platform
+}
+
+func profileFlag() cli.Flag {
+	return cli.StringFlag{Name: "profile", Usage: "build profile of meta/package.yaml and meta/run.yaml to apply, e.g. dev or prod"}
+}
+
+// selectedProfile returns the build profile given with --profile, otherwise
+// the one in CAPSTAN_PROFILE environment variable, empty if none.
+func selectedProfile(c *cli.Context) string {
+	if profile := c.String("profile"); profile != "" {
+		return profile
+	}
+	return os.Getenv(core.ProfileEnv)
+}
+
+func selectorFlag() cli.Flag {
+	return cli.StringFlag{Name: "selector, l", Usage: "select instances by labels, e.g. env=test,team!=db"}
+}
+
+// selectedInstances returns names of the instances matching --selector, or
+// the single instance given as argument.
+func selectedInstances(c *cli.Context, usage string) ([]string, error) {
+	selector := c.String("selector")
+	if selector == "" {
+		if len(c.Args()) != 1 {
+			return nil, cli.NewExitError(usage, EX_USAGE)
+		}
+		return []string{c.Args().First()}, nil
+	}
+	if len(c.Args()) != 0 {
+		return nil, cli.NewExitError("instance name can not be combined with --selector", EX_USAGE)
+	}
+
+	repo := util.NewRepo(c.GlobalString("u"))
+	instances, err := cmd.SelectInstances(repo, selector)
+	if err != nil {
+		return nil, cli.NewExitError(err.Error(), EX_USAGE)
+	}
+	if len(instances) == 0 {
+		fmt.Printf("No instances match selector '%s'\n", selector)
+	}
+	var names []string
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+	}
+	return names, nil
+}
+
+func encryptionFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{Name: "encrypt", Usage: "encrypt the image with LUKS (qemu only)"},
+		cli.StringFlag{Name: "key-file", Usage: "file with the encryption key (prompted for when not given)"},
+	}
+}
+
+// encryptionKeyFile returns the file with the encryption key when --encrypt
+// flag is set. The key that was prompted for is stored in a temporary file that
+// is removed by the returned cleanup function.
+func encryptionKeyFile(c *cli.Context) (string, func(), error) {
+	if !c.Bool("encrypt") {
+		return "", func() {}, nil
+	}
+	return util.EncryptionKeyFile(c.String("key-file"), util.ConfigDir(), true)
+}
+
+func filesystemFlag() cli.Flag {
+	return cli.StringFlag{Name: "fs", Value: util.FilesystemZFS, Usage: "root filesystem of the image: zfs (writable) or rofs (read-only, composed without a VM)"}
+}
+
+func bootOptsFlag() cli.Flag {
+	return cli.StringSliceFlag{Name: "boot-opts", Value: new(cli.StringSlice), Usage: "OSv kernel option given by preset: " +
+		strings.Join(runtime.BootPresetNames(), "|") + " (trace, sampler and redirect take a value e.g. trace=vfs*) or as is e.g. --maxnic=2 (repeatable)"}
+}
+
+// bootOptsFlags returns presets of OSv kernel options given with --boot-opts.
+func bootOptsFlags(c *cli.Context) (runtime.BootOpts, error) {
+	bootOpts := runtime.BootOpts(c.StringSlice("boot-opts"))
+	return bootOpts, bootOpts.Validate()
+}
+
+func immutableFlag() cli.Flag {
+	return cli.BoolFlag{Name: "immutable", Usage: "compose a read-only image (implies --fs rofs), run it with --data-disk or --tmpfs for writable data"}
+}
+
+// composeFilesystem returns the root filesystem that the image is composed
+// with.
+func composeFilesystem(c *cli.Context) (string, error) {
+	if !c.Bool("immutable") {
+		return c.String("fs"), nil
+	}
+	if c.IsSet("fs") && c.String("fs") != util.FilesystemROFS {
+		return "", fmt.Errorf("--immutable images have %s root filesystem, not %s", util.FilesystemROFS, c.String("fs"))
+	}
+	return util.FilesystemROFS, nil
+}
+
+func compressFlag() cli.Flag {
+	return cli.StringFlag{Name: "compress", Value: util.CompressionNone, Usage: "compression of the exported file: none|xz|zstd"}
+}
+
+// validateDataVolumes checks the data disk and tmpfs mounts of the instance.
+func validateDataVolumes(config *runtime.RunConfig) error {
+	var volumes []util.Volume
+	if config.DataDisk != "" {
+		volumes = append(volumes, util.Volume{Type: "disk", Source: "data.img", Path: config.DataPath, FS: "ext", Size: config.DataDisk})
+	}
+	for _, path := range config.Tmpfs {
+		volumes = append(volumes, util.Volume{Type: "tmpfs", Path: path})
+	}
+	paths := make(map[string]bool)
+	for _, volume := range volumes {
+		if err := volume.Validate(); err != nil {
+			return err
+		}
+		if paths[volume.Path] {
+			return fmt.Errorf("more than one volume is mounted at %s", volume.Path)
+		}
+		paths[volume.Path] = true
+	}
+	return nil
+}
+
+// cloudInitFlags returns cloud-init configuration with user-data and SSH
+// keys read from files given on command line.
+func cloudInitFlags(c *cli.Context) (*util.CloudInit, error) {
+	ci := &util.CloudInit{}
+	if file := c.String("user-data"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read user-data: %s", err)
+		}
+		ci.UserData = string(data)
+	}
+	for _, file := range c.StringSlice("ssh-key") {
+		key, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %s", err)
+		}
+		ci.SSHKeys = append(ci.SSHKeys, strings.TrimSpace(string(key)))
+	}
+	return ci, nil
+}
@@ -27,7 +27,9 @@ import (
 	"strings"
 )
 
-func Build(r *util.Repo, image *core.Image, template *core.Template, verbose bool, mem string) error {
+// Build builds the image as described by the template. When size (in MB) is
+// positive, the base image is enlarged to that size before files are uploaded.
+func Build(r *util.Repo, image *core.Image, template *core.Template, verbose bool, mem string, size int64) error {
 	if err := os.MkdirAll(filepath.Dir(r.ImagePath(image.Hypervisor, image.Name)), 0777); err != nil {
 		return err
 	}
@@ -44,6 +46,9 @@ func Build(r *util.Repo, image *core.Image, template *core.Template, verbose boo
 	if err := checkConfig(template, r, image.Hypervisor); err != nil {
 		return err
 	}
+	if r.ImageFilesystem(template.Base) == util.FilesystemROFS {
+		return fmt.Errorf("%s: files can not be uploaded onto base image with ROFS", template.Base)
+	}
 	if template.RpmBase != nil {
 		template.RpmBase.Download()
 	}
@@ -52,11 +57,25 @@ func Build(r *util.Repo, image *core.Image, template *core.Template, verbose boo
 	if err != nil {
 		return err
 	}
+	cpiodCmdline := "/tools/cpiod.so"
+	if size > 0 {
+		if image.Hypervisor != "qemu" {
+			return fmt.Errorf("%s: resizing images is only supported for qemu", image.Hypervisor)
+		}
+		grown, err := util.GrowImage(r.ImagePath(image.Hypervisor, image.Name), size, r.Qcow2)
+		if err != nil {
+			return err
+		}
+		// Let OSv expand the filesystem while files are being uploaded.
+		if grown {
+			cpiodCmdline = util.ExpandFilesystemCmd(cpiodCmdline)
+		}
+	}
 	cmdline := "/tools/cpiod.so"
 	if verbose {
 		cmdline = "--verbose" + cmdline
 	}
-	if err := SetArgs(r, image.Hypervisor, image.Name, "/tools/cpiod.so"); err != nil {
+	if err := SetArgs(r, image.Hypervisor, image.Name, cpiodCmdline); err != nil {
 		return err
 	}
 	if template.RpmBase != nil {
@@ -130,6 +149,13 @@ func IsReg(m os.FileMode) bool {
 }
 
 func CopyFile(conn net.Conn, src string, dst string) error {
+	return CopyFileProgress(conn, src, dst, nil)
+}
+
+// CopyFileProgress uploads the file to cpiod like CopyFile, streaming its
+// content so that files of any size can be uploaded. Content of regular files
+// is also written to progress, if given.
+func CopyFileProgress(conn io.Writer, src string, dst string, progress io.Writer) error {
 	fi, err := os.Lstat(src)
 	if err != nil {
 		return err
@@ -137,16 +163,9 @@ func CopyFile(conn net.Conn, src string, dst string) error {
 
 	switch {
 	case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
-		linkTarget, _ := os.Readlink(src)
-
-		if strings.HasPrefix(linkTarget, "/") || strings.HasPrefix(linkTarget, "..") {
-			srcDir := filepath.Dir(src)
-
-			if linkTarget, err = filepath.Abs(filepath.Join(srcDir, linkTarget)); err != nil {
-				return err
-			}
-
-			linkTarget = strings.TrimPrefix(linkTarget, strings.TrimSuffix(src, dst))
+		linkTarget, err := guestLinkTarget(src, dst)
+		if err != nil {
+			return err
 		}
 
 		perm := uint64(fi.Mode()) & 0777
@@ -165,17 +184,24 @@ func CopyFile(conn net.Conn, src string, dst string) error {
 		return nil
 
 	case fi.Mode().IsRegular():
-		contents, err := ioutil.ReadFile(src)
+		file, err := os.Open(src)
 		if err != nil {
-			return nil
+			return err
 		}
-		fi, err := os.Stat(src)
+		defer file.Close()
+		fi, err := file.Stat()
 		if err != nil {
 			return err
 		}
+		var reader io.Reader = file
+		if progress != nil {
+			reader = io.TeeReader(file, progress)
+		}
 		perm := uint64(fi.Mode()) & 0777
 		cpio.WritePadded(conn, cpio.ToWireFormat(dst, cpio.C_ISREG|perm, fi.Size()))
-		cpio.WritePadded(conn, contents)
+		if err := cpio.CopyPadded(conn, reader, fi.Size()); err != nil {
+			return fmt.Errorf("failed to upload %s: %s", src, err)
+		}
 
 	default:
 		fmt.Println("skipping non-file path " + src)
@@ -185,6 +211,26 @@ func CopyFile(conn net.Conn, src string, dst string) error {
 	return nil
 }
 
+// guestLinkTarget returns the target of the symlink as seen from the guest,
+// where the symlink at src on the host is uploaded to dst. Targets that are
+// absolute or point to parent directories are made relative to the root of
+// the uploaded content.
+func guestLinkTarget(src, dst string) (string, error) {
+	linkTarget, _ := os.Readlink(src)
+
+	if strings.HasPrefix(linkTarget, "/") || strings.HasPrefix(linkTarget, "..") {
+		srcDir := filepath.Dir(src)
+
+		var err error
+		if linkTarget, err = filepath.Abs(filepath.Join(srcDir, linkTarget)); err != nil {
+			return "", err
+		}
+
+		linkTarget = strings.TrimPrefix(linkTarget, strings.TrimSuffix(src, dst))
+	}
+	return linkTarget, nil
+}
+
 func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template, verbose bool, mem string) error {
 	file := r.ImagePath(hypervisor, image)
 	size, err := util.ParseMemSize(mem)
@@ -292,23 +338,5 @@ func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template
 }
 
 func SetArgs(r *util.Repo, hypervisor, image string, args string) error {
-	file := r.ImagePath(hypervisor, image)
-	nbdFile, err := util.NewNbdFile(file)
-	if err != nil {
-		return err
-	}
-
-	padding := 512 - (len(args) % 512)
-
-	data := append([]byte(args), make([]byte, padding)...)
-	if err := nbdFile.Write(512, data); err != nil {
-		return err
-	}
-
-	// Close the image file.
-	if err := nbdFile.Close(); err != nil {
-		return err
-	}
-
-	return nil
+	return util.SetCmdLine(r.ImagePath(hypervisor, image), args)
 }
@@ -0,0 +1,339 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// bundleManifestName is the name of the manifest that is the first entry of
+// every bundle.
+const bundleManifestName = "bundle.yaml"
+
+// BundleManifest lists files of the bundle with paths relative to the Capstan
+// root, e.g. packages/osv.bootstrap.mpm or repository/mike/osv-loader/index.yaml.
+type BundleManifest struct {
+	Name    string       `yaml:"name"`
+	Created string       `yaml:"created"`
+	Files   []BundleFile `yaml:"files"`
+}
+
+type BundleFile struct {
+	Path     string `yaml:"path"`
+	Checksum string `yaml:"checksum"`
+}
+
+// ExportBundle packs the package (either a package directory or a package in
+// the local repository) with all its transitive dependencies and the loader
+// image, or the image from the local repository, into a single archive that
+// can be imported on a host without access to remote repositories.
+func ExportBundle(repo *util.Repo, name, target string, pullMissing bool) error {
+	files, err := bundleFiles(repo, name, pullMissing)
+	if err != nil {
+		return err
+	}
+
+	if target == "" {
+		base := strings.Replace(name, "/", "-", -1)
+		if isPackageDir(name) {
+			abs, err := filepath.Abs(name)
+			if err != nil {
+				return err
+			}
+			base = filepath.Base(abs)
+		}
+		target = base + ".bundle.tar.gz"
+	}
+
+	manifest := BundleManifest{Name: name, Created: time.Now().Format(time.RFC3339)}
+	for _, file := range files {
+		checksum, err := util.FileChecksum(filepath.Join(repo.Path, file))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BundleFile{Path: file, Checksum: checksum})
+	}
+
+	fmt.Printf("Exporting bundle of %s into %s...\n", name, target)
+	if err := writeBundle(repo, manifest, target); err != nil {
+		os.Remove(target)
+		return err
+	}
+
+	fmt.Printf("Bundle %s with %d files successfully exported\n", target, len(manifest.Files))
+	return nil
+}
+
+// bundleFiles returns sorted paths of files relative to the Capstan root that
+// the bundle of the given package or image consists of.
+func bundleFiles(repo *util.Repo, name string, pullMissing bool) ([]string, error) {
+	var images []string
+	var pkg core.Package
+	var err error
+
+	switch {
+	case isPackageDir(name):
+		if pkg, err = core.ParsePackageManifest(filepath.Join(name, "meta", "package.yaml")); err != nil {
+			return nil, err
+		}
+		if err := pkg.ResolveLocalRequirements(name); err != nil {
+			return nil, err
+		}
+		cmdConf, err := runtime.ParsePackageRunManifest(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if cmdConf != nil {
+			pkg.Require = append(cmdConf.GetDependencies(), pkg.Require...)
+		}
+	case repo.PackageExists(name):
+		if pkg, err = core.ParsePackageManifest(repo.PackageManifest(name)); err != nil {
+			return nil, err
+		}
+	default:
+		if _, err := os.Stat(filepath.Join(repo.RepoPath(), name)); err != nil {
+			return nil, fmt.Errorf("%s: no such package, package directory or image", name)
+		}
+		images = append(images, name)
+	}
+
+	var packages []string
+	if pkg.Name != "" {
+		pkg.Require = append(pkg.Require, "osv.bootstrap")
+		required, err := repo.GetPackageDependencies(pkg, pullMissing)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range required {
+			packages = append(packages, p.Name)
+		}
+		if repo.PackageExists(pkg.Name) {
+			packages = append(packages, pkg.Name)
+		}
+
+		// The loader that the package is pinned to is bundled instead of the
+		// default one.
+		loader, err := ResolveLoader(repo, util.FilesystemZFS, pkg.Loader, pullMissing)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(repo.RepoPath(), loader)); err != nil {
+			return nil, fmt.Errorf("loader image %s is not available, pull it with 'capstan pull %s'", loader, loader)
+		}
+		images = append(images, loader)
+	}
+
+	files := []string{}
+	for _, p := range packages {
+		for _, path := range []string{repo.PackageManifest(p), repo.PackagePath(p)} {
+			rel, err := filepath.Rel(repo.Path, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, rel)
+		}
+	}
+	for _, image := range images {
+		entries, err := ioutil.ReadDir(filepath.Join(repo.RepoPath(), image))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !strings.HasSuffix(entry.Name(), util.PartialDownloadSuffix) {
+				files = append(files, filepath.Join("repository", image, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func isPackageDir(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "meta", "package.yaml"))
+	return err == nil
+}
+
+func writeBundle(repo *util.Repo, manifest BundleManifest, target string) error {
+	output, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	gzWriter := gzip.NewWriter(output)
+	defer gzWriter.Close()
+	tarball := tar.NewWriter(gzWriter)
+	defer tarball.Close()
+
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: bundleManifestName, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tarball.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tarball.Write(data); err != nil {
+		return err
+	}
+
+	for _, f := range manifest.Files {
+		if err := addBundleFile(tarball, filepath.Join(repo.Path, f.Path), f.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addBundleFile(tarball *tar.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if err := tarball.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tarball, file)
+	return err
+}
+
+// ImportBundle imports packages and images of the bundle into the local
+// repository. Files are verified against checksums in the bundle manifest
+// before any of them is imported.
+func ImportBundle(repo *util.Repo, bundleFile string) error {
+	input, err := os.Open(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	gzReader, err := gzip.NewReader(input)
+	if err != nil {
+		return fmt.Errorf("%s: not a bundle: %s", bundleFile, err)
+	}
+	tarReader := tar.NewReader(gzReader)
+
+	if err := os.MkdirAll(repo.Path, 0775); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(repo.Path, "bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var manifest *BundleManifest
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if manifest == nil {
+			if hdr.Name != bundleManifestName {
+				return fmt.Errorf("%s: not a bundle, %s must come first", bundleFile, bundleManifestName)
+			}
+			data, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return err
+			}
+			manifest = &BundleManifest{}
+			if err := yaml.Unmarshal(data, manifest); err != nil {
+				return fmt.Errorf("%s: invalid %s: %s", bundleFile, bundleManifestName, err)
+			}
+			continue
+		}
+
+		if err := checkBundlePath(hdr.Name); err != nil {
+			return err
+		}
+		dest := filepath.Join(tmp, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0775); err != nil {
+			return err
+		}
+		output, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(output, tarReader)
+		output.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if manifest == nil {
+		return fmt.Errorf("%s: empty bundle", bundleFile)
+	}
+
+	fmt.Printf("Importing bundle of %s...\n", manifest.Name)
+	for _, f := range manifest.Files {
+		if err := checkBundlePath(f.Path); err != nil {
+			return err
+		}
+		checksum, err := util.FileChecksum(filepath.Join(tmp, filepath.FromSlash(f.Path)))
+		if err != nil {
+			return fmt.Errorf("%s: %s is missing from the bundle", bundleFile, f.Path)
+		}
+		if err := util.VerifyChecksum(f.Path, f.Checksum, checksum); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range manifest.Files {
+		dest := filepath.Join(repo.Path, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(dest), 0775); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(tmp, filepath.FromSlash(f.Path)), dest); err != nil {
+			return err
+		}
+		fmt.Printf("Imported %s\n", f.Path)
+	}
+
+	fmt.Printf("Bundle %s successfully imported into %s\n", bundleFile, repo.Path)
+	return nil
+}
+
+// checkBundlePath makes sure that files of the bundle only end up in the
+// package or image repository.
+func checkBundlePath(path string) error {
+	clean := filepath.ToSlash(filepath.Clean(filepath.FromSlash(path)))
+	if filepath.IsAbs(path) || strings.HasPrefix(clean, "../") ||
+		!(strings.HasPrefix(clean, "packages/") || strings.HasPrefix(clean, "repository/")) {
+		return fmt.Errorf("invalid path '%s' in bundle", path)
+	}
+	return nil
+}
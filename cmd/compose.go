@@ -16,6 +16,7 @@ import (
 	"github.com/mikelangelo-project/capstan/cpio"
 	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
 	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/rofs"
 	"github.com/mikelangelo-project/capstan/util"
 	"io"
 	"io/ioutil"
@@ -24,10 +25,33 @@ import (
 	"strings"
 )
 
-func Compose(r *util.Repo, loaderImage string, imageSize int64, uploadPath string, appName string) error {
+// Compose composes the image of the given root filesystem from the folder or
+// file. The size of images with ROFS follows from their content.
+func Compose(r *util.Repo, loaderImage string, imageSize int64, uploadPath string, appName string, fs string) error {
+	if err := util.ValidateFilesystem(fs); err != nil {
+		return err
+	}
+
+	lock, err := r.LockImage(appName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if fs == util.FilesystemROFS {
+		paths, err := CollectPathContents(uploadPath)
+		if err != nil {
+			return err
+		}
+		if err := initializeROFSImage(r, loaderImage, appName, paths); err != nil {
+			return err
+		}
+		return storeImageContents(r, appName, paths, false)
+	}
+
 	// Initialize an empty image based on the provided loader image. imageSize is used to
 	// determine the size of the user partition.
-	err := r.InitializeImage(loaderImage, appName, imageSize)
+	err = r.InitializeImage(loaderImage, appName, imageSize)
 	if err != nil {
 		return err
 	}
@@ -45,11 +69,101 @@ func Compose(r *util.Repo, loaderImage string, imageSize int64, uploadPath strin
 		return err
 	}
 
-	return nil
+	return storeImageContents(r, appName, paths, false)
+}
+
+// storeImageContents stores the list of files uploaded onto the image. When the
+// image is updated, previously uploaded files are kept in the list since files
+// are never deleted from the image.
+func storeImageContents(r *util.Repo, appName string, paths map[string]string, update bool) error {
+	contents, err := core.CollectImageContents(paths)
+	if err != nil {
+		return err
+	}
+
+	contentsPath := r.ImageContentsPath("qemu", appName)
+	if update {
+		if previous, err := core.ParseImageContents(contentsPath); err == nil {
+			for p, size := range contents {
+				previous[p] = size
+			}
+			contents = previous
+		}
+	}
+
+	return contents.WriteToFile(contentsPath)
+}
+
+// initializeROFSImage creates the image with ROFS holding the paths, which
+// map files on the host to their paths in the guest.
+func initializeROFSImage(r *util.Repo, loaderImage, appName string, paths map[string]string) error {
+	fmt.Printf("Writing files to ROFS of %s...\n", appName)
+	fs := rofs.New()
+	for _, src := range sortedUploadPaths(paths) {
+		dst := paths[src]
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+			target, err := guestLinkTarget(src, dst)
+			if err != nil {
+				return err
+			}
+			err = fs.AddSymlink(dst, target)
+		case fi.Mode().IsDir():
+			err = fs.AddDir(dst)
+		case fi.Mode().IsRegular():
+			err = fs.AddFile(dst, src)
+		default:
+			fmt.Println("skipping non-file path " + src)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The image is complete as it is, hence it has no cache of uploaded files.
+	os.Remove(r.ImageCachePath("qemu", appName))
+	return r.InitializeROFSImage(loaderImage, appName, fs)
 }
 
 func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string]string, imageCache core.HashCache, verbose bool) (core.HashCache, error) {
 
+	// Hash all paths first to find out which have to be uploaded and how
+	// much content that is. Paths are hashed by a pool of workers.
+	srcs := sortedUploadPaths(uploadPaths)
+	hashes := make([]string, len(srcs))
+	jobs := newFileJobs()
+	for i, src := range srcs {
+		i, src := i, src
+		jobs.Go(func() error {
+			hashes[i], _ = hashPath(src, uploadPaths[src])
+			return nil
+		})
+	}
+	jobs.Wait()
+
+	newHashes := core.NewHashCache()
+	upload := make(map[string]bool)
+	var uploadSize int64
+	for i, src := range srcs {
+		dest, hash := uploadPaths[src], hashes[i]
+		newHashes[dest] = hash
+
+		// By default it should upload all files, except those whose cached
+		// hash value hasn't changed since the last upload.
+		if cachedHash, ok := imageCache[dest]; ok && hash == cachedHash {
+			continue
+		}
+		upload[src] = true
+		if info, err := os.Lstat(src); err == nil && info.Mode().IsRegular() {
+			uploadSize += info.Size()
+		}
+	}
+
 	var osvCmdline string
 
 	if len(imageCache) == 0 {
@@ -57,7 +171,8 @@ func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string
 		// It is asumed that the UploadPath is the first command executed by
 		// this virtual image.  Thus we also create the filesystem and start
 		// the 'cpiod' daemon responsible for copying files to target VM.
-		osvCmdline = "--norandom --nomount --noinit /tools/mkfs.so; /tools/cpiod.so --prefix /zfs/zfs; /zfs.so set compression=off osv"
+		// Pool is created with autoexpand so that it grows together with the disk.
+		osvCmdline = "--norandom --nomount --noinit /tools/mkfs.so; /tools/cpiod.so --prefix /zfs/zfs; /zfs.so set compression=off osv; /zpool.so set autoexpand=on osv"
 	} else {
 		fmt.Printf("Updating image %s...\n", appImage)
 		// If we are updating an existing image, we should only start cpiod
@@ -125,33 +240,27 @@ func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string
 	}
 	defer conn.Close()
 
-	// Initialise a progress bar for uploading files. Only start it in case
-	// silent mode is activated.
+	// Initialise a progress bar showing the amount of uploaded content. Only
+	// start it in case silent mode is activated.
 	var bar *pb.ProgressBar
+	var progress io.Writer
 	if !verbose {
-		bar = pb.StartNew(len(uploadPaths)).Prefix("Uploading files ")
+		bar = pb.New64(uploadSize).SetUnits(pb.U_BYTES).Prefix("Uploading files ")
+		bar.Start()
+		progress = bar
 	}
 
-	// Initialise a dictionary for the up-to-date file hashes.
-	newHashes := core.NewHashCache()
-
 	// Loop over collected paths and upload them to the image if necessary.
-	for src, dest := range uploadPaths {
-		// Get the hash of this path.
-		hash, _ := hashPath(src, dest)
-
-		// By default it should upload all files, except those whose cached
-		// hash value hasn't changed since the last upload.
-		uploadFile := true
-		if cachedHash, ok := imageCache[dest]; ok {
-			// If hashes are the same, we should not upload.
-			uploadFile = hash != cachedHash
-		}
+	// Upload in a stable order so that composing the same content twice
+	// results in the same image.
+	for _, src := range srcs {
+		dest := uploadPaths[src]
 
-		if uploadFile {
+		if upload[src] {
 			// Upload the file from host to guest. This will access cpiod
-			// running in OSv.
-			err = CopyFile(conn, src, dest)
+			// running in OSv. Content is streamed, so files larger than
+			// the available memory can be uploaded as well.
+			err = CopyFileProgress(conn, src, dest, progress)
 			if err != nil {
 				return nil, err
 			}
@@ -162,13 +271,6 @@ func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string
 		} else if verbose {
 			fmt.Printf("Skipping %s  --> %s\n", src, dest)
 		}
-
-		if !verbose {
-			bar.Increment()
-		}
-
-		// Store the new hash whenever a file is successfully uploaded to the VM.
-		newHashes[dest] = hash
 	}
 
 	if !verbose {
@@ -223,16 +325,21 @@ func hashPath(hostPath, vmPath string) (string, error) {
 		return "", fmt.Errorf("Unable to hash unexistent path: %s", hostPath)
 	}
 
-	var data []byte
+	hash := md5.New()
 	switch {
 	case info.IsDir():
-		data = []byte(vmPath)
+		hash.Write([]byte(vmPath))
 	default:
-		data, err = ioutil.ReadFile(hostPath)
+		// Stream the content, files may be larger than the available memory.
+		file, err := os.Open(hostPath)
 		if err != nil {
 			return "", err
 		}
+		defer file.Close()
+		if _, err := io.Copy(hash, file); err != nil {
+			return "", err
+		}
 	}
 
-	return fmt.Sprintf("%x", md5.Sum(data)), nil
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
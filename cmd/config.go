@@ -8,10 +8,13 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
 	"github.com/mikelangelo-project/capstan/util"
 	"github.com/urfave/cli"
 )
@@ -36,5 +39,72 @@ func ConfigPrint(c *cli.Context) error {
 		fmt.Println(err)
 	}
 
+	// Read .capstaninclude if exists.
+	capstanincludePath := "./" + core.CapstanincludeFileName
+	if _, err := os.Stat(capstanincludePath); err == nil {
+		fmt.Println("CAPSTANINCLUDE:")
+		capstanignore, _ := core.CapstanignoreInit("")
+		if err := capstanignore.LoadIncludeFile(capstanincludePath); err == nil {
+			capstanignore.PrintIncludePatterns()
+		} else {
+			fmt.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// ConfigList prints config sets of the package in the given directory or of
+// the image with the given name, either as a table or as JSON. Config sets of
+// images are only known for images composed from packages and are looked up
+// for the given hypervisor.
+func ConfigList(repo *util.Repo, hypervisor, target string, asJSON bool) error {
+	configSets, err := loadConfigSets(repo, hypervisor, target)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(configSets, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("%-20s %-8s %-10s %s\n", "NAME", "DEFAULT", "RUNTIME", "BOOTCMD")
+	for _, c := range configSets {
+		isDefault := ""
+		if c.Default {
+			isDefault = "yes"
+		}
+		fmt.Printf("%-20s %-8s %-10s %s\n", c.Name, isDefault, c.Runtime, c.BootCmd)
+	}
 	return nil
 }
+
+// loadConfigSets returns config sets from meta/run.yaml of the package
+// directory or from the list stored when the image was composed for the
+// hypervisor.
+func loadConfigSets(repo *util.Repo, hypervisor, target string) (runtime.ConfigSetList, error) {
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		if _, err := os.Stat(filepath.Join(target, "meta", "run.yaml")); os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: package has no meta/run.yaml", target)
+		}
+		cmdConf, err := runtime.ParsePackageRunManifest(target)
+		if err != nil {
+			return nil, err
+		}
+		return cmdConf.ListConfigSets(cmdConf.ConfigSetDefault)
+	}
+
+	if !repo.ImageExists(hypervisor, target) {
+		return nil, fmt.Errorf("%s: no such package directory or image", target)
+	}
+	configSets, err := runtime.ParseConfigSetList(repo.ImageConfigSetsPath(hypervisor, target))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: list of config sets is not available, compose the image from a package to create it", target)
+	}
+	return configSets, err
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/osv/api"
+)
+
+// InstancePath is a path in the instance, given as <instance>:<path>.
+type InstancePath struct {
+	Instance string
+	Path     string
+}
+
+// ParseInstancePath parses the argument of 'capstan cp'. The second value is
+// false if the argument is a local path. Windows drive letters (C:\...) are
+// not mistaken for instance names, while one-letter instance names are still
+// recognized since paths in the instance start with a slash.
+func ParseInstancePath(arg string) (InstancePath, bool) {
+	i := strings.Index(arg, ":")
+	if i < 1 || strings.ContainsAny(arg[:i], `/\`) || filepath.VolumeName(arg) != "" {
+		return InstancePath{}, false
+	}
+	if i == 1 && strings.HasPrefix(arg[i+1:], `\`) {
+		return InstancePath{}, false
+	}
+	return InstancePath{Instance: arg[:i], Path: arg[i+1:]}, true
+}
+
+// CopyInstanceFile copies a file from or to a running instance using the file
+// API of OSv httpserver. Exactly one of src and dst must be in form of
+// <instance>:<path>. Unless address is given, the httpserver is reached
+// through the host port that forwards to HttpServerPort.
+func CopyInstanceFile(src, dst, address string) error {
+	remoteSrc, srcOk := ParseInstancePath(src)
+	remoteDst, dstOk := ParseInstancePath(dst)
+	switch {
+	case srcOk == dstOk:
+		return fmt.Errorf("exactly one of the paths must be in form of <instance>:<path>")
+	case srcOk:
+		baseURL, err := httpServerURL(remoteSrc.Instance, address)
+		if err != nil {
+			return err
+		}
+		return downloadInstanceFile(baseURL, remoteSrc.Path, dst)
+	default:
+		baseURL, err := httpServerURL(remoteDst.Instance, address)
+		if err != nil {
+			return err
+		}
+		return uploadInstanceFile(baseURL, src, remoteDst.Path)
+	}
+}
+
+// downloadInstanceFile writes the file of the instance to the local path. If
+// the local path is a directory, the file keeps its name.
+func downloadInstanceFile(baseURL, remotePath, localPath string) error {
+	if !strings.HasPrefix(remotePath, "/") {
+		return fmt.Errorf("path in the instance must be absolute: %s", remotePath)
+	}
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(remotePath))
+	}
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	n, err := transferClient(baseURL).Download(remotePath, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(localPath)
+		return fmt.Errorf("failed to copy %s: %s", remotePath, err)
+	}
+	fmt.Printf("Copied %s (%d bytes) to %s\n", remotePath, n, localPath)
+	return nil
+}
+
+// uploadInstanceFile writes the local file into the instance. If the path in
+// the instance ends with a slash, the file keeps its name.
+func uploadInstanceFile(baseURL, localPath, remotePath string) error {
+	if !strings.HasPrefix(remotePath, "/") {
+		return fmt.Errorf("path in the instance must be absolute: %s", remotePath)
+	}
+	if strings.HasSuffix(remotePath, "/") {
+		remotePath += filepath.Base(localPath)
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	n, err := transferClient(baseURL).Upload(remotePath, file)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %s", localPath, err)
+	}
+	fmt.Printf("Copied %s (%d bytes) to %s\n", localPath, n, remotePath)
+	return nil
+}
+
+// transferClient returns a client of httpserver that allows for transfers
+// of large files.
+func transferClient(baseURL string) *api.Client {
+	client := api.NewClient(baseURL)
+	client.HTTP.Timeout = 5 * time.Minute
+	return client
+}
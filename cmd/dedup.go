@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// fileDigests remembers the first file with the given content, so that
+// identical files that follow can reference it instead of storing the
+// content again. Empty files are never deduplicated.
+type fileDigests map[string]string
+
+// original returns the path of the first file with the same content as the
+// given file, or an empty string if the file is the first one.
+func (d fileDigests) original(path string, info os.FileInfo) (string, error) {
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return "", nil
+	}
+
+	digest, err := util.FileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+	if original, ok := d[digest]; ok {
+		return original, nil
+	}
+	d[digest] = path
+	return "", nil
+}
+
+// deduplicateFiles replaces files in the directory that are identical to
+// another file in the directory with symbolic links to it, so that their
+// content is uploaded onto the image only once. The file that comes first
+// in lexical order keeps the content. It returns the number of replaced
+// files and the number of bytes saved.
+func deduplicateFiles(dir string) (int, int64, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	sort.Strings(paths)
+
+	digests := fileDigests{}
+	var count int
+	var saved int64
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		original, err := digests.original(path, info)
+		if err != nil {
+			return 0, 0, err
+		}
+		if original == "" {
+			continue
+		}
+
+		// Relative link, so that it is valid inside the image as well.
+		link, err := filepath.Rel(filepath.Dir(path), original)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := os.Remove(path); err != nil {
+			return 0, 0, err
+		}
+		if err := os.Symlink(link, path); err != nil {
+			return 0, 0, err
+		}
+		count++
+		saved += info.Size()
+	}
+	return count, saved, nil
+}
+
+func reportDeduplication(count int, saved int64) {
+	if count > 0 {
+		fmt.Printf("Deduplicated %d identical files, saving %d bytes\n", count, saved)
+	}
+}
@@ -18,16 +18,23 @@ import (
 )
 
 func Delete(name string) error {
-	var err error
 	instanceName, instancePlatform := util.SearchInstance(name)
 	if instanceName == "" {
 		fmt.Printf("Instance: %s not found\n", name)
 		return nil
 	}
+	lock, err := util.LockInstance(instancePlatform, instanceName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 
 	switch instancePlatform {
 	case "qemu":
+		c, _ := qemu.LoadConfig(name)
 		qemu.StopVM(name)
+		releaseTap(name, c)
+		unregisterManagedHost(c)
 		err = qemu.DeleteVM(name)
 	case "vbox":
 		vbox.StopVM(name)
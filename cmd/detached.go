@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// detachedRuns are qemu instances running in the background, each writing its
+// output into the console file of its directory instead of the terminal.
+type detachedRuns struct {
+	repo   *util.Repo
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	errs   []error
+	exited map[string]bool
+}
+
+func newDetachedRuns(repo *util.Repo) *detachedRuns {
+	return &detachedRuns{repo: repo, exited: make(map[string]bool)}
+}
+
+// start launches the instance of the config in the background.
+func (r *detachedRuns) start(config *runtime.RunConfig) error {
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", config.InstanceName)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	console, err := os.Create(filepath.Join(dir, qemu.ConsoleFileName))
+	if err != nil {
+		return err
+	}
+	config.Console = console
+
+	if len(config.NatRules) > 0 {
+		fmt.Printf("Instance %s forwards ports %s, console: %s\n", config.InstanceName,
+			strings.Join(natPorts(config.NatRules), ","), console.Name())
+	} else {
+		fmt.Printf("Instance %s console: %s\n", config.InstanceName, console.Name())
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer console.Close()
+		err := RunInstance(r.repo, config)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.exited[config.InstanceName] = true
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("instance %s: %s", config.InstanceName, err))
+		}
+	}()
+	return nil
+}
+
+// hasExited reports whether the instance started by r is no longer running.
+func (r *detachedRuns) hasExited(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.exited[name]
+}
+
+// fail records an error that occurred while starting the instances.
+func (r *detachedRuns) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+// wait waits for all instances to exit and returns the first error recorded.
+func (r *detachedRuns) wait() error {
+	r.wg.Wait()
+	if len(r.errs) > 0 {
+		return r.errs[0]
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
+	"github.com/mikelangelo-project/capstan/hypervisor/vmw"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/osv/api"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// HttpServerPort is the guest port that the OSv httpserver listens on.
+const HttpServerPort = "8000"
+
+// execPollInterval is how often a running command is checked for completion.
+var execPollInterval = 500 * time.Millisecond
+
+// ExecInstance starts the command in the running instance using the REST API
+// of OSv httpserver, which must be included in the image. Unless address is
+// given, the httpserver is reached through the host port that forwards to
+// HttpServerPort. When wait is set, ExecInstance waits for the command to
+// finish. Output of the command is written to the console of the instance,
+// so for detached qemu instances whatever is written to their console log
+// meanwhile is streamed to out.
+func ExecInstance(name, address, command string, wait bool, out io.Writer) error {
+	baseURL, err := httpServerURL(name, address)
+	if err != nil {
+		return err
+	}
+	return execCommand(baseURL, instanceConsoleLog(name), command, wait, out)
+}
+
+// instanceConsoleLog returns path to the console log of the detached qemu
+// instance or an empty string when its console is not logged.
+func instanceConsoleLog(name string) string {
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" || platform != "qemu" {
+		return ""
+	}
+	path := filepath.Join(util.ConfigDir(), "instances", "qemu", instanceName, qemu.ConsoleFileName)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// httpServerURL returns URL of the httpserver of the instance, either at the
+// given address or at the host port that forwards to HttpServerPort.
+func httpServerURL(name, address string) (string, error) {
+	if address == "" {
+		instanceName, platform := util.SearchInstance(name)
+		if instanceName == "" {
+			return "", fmt.Errorf("Instance %s does not exist", name)
+		}
+		port, err := forwardedPort(instanceName, platform, HttpServerPort)
+		if err != nil {
+			return "", err
+		}
+		address = "127.0.0.1:" + port
+	}
+	return "http://" + address, nil
+}
+
+// forwardedPort returns the host port that forwards to the guest port of the
+// instance.
+func forwardedPort(name, platform, guestPort string) (string, error) {
+	var rules []nat.Rule
+	switch platform {
+	case "qemu":
+		if status, _ := qemu.GetVMStatus(name, filepath.Join(util.ConfigDir(), "instances/qemu", name)); status != "Running" {
+			return "", fmt.Errorf("Instance %s is not running", name)
+		}
+		c, err := qemu.LoadConfig(name)
+		if err != nil {
+			return "", err
+		}
+		rules = c.NatRules
+	case "vbox":
+		c, err := vbox.LoadConfig(name)
+		if err != nil {
+			return "", err
+		}
+		rules = c.NatRules
+	case "vmw":
+		c, err := vmw.LoadConfig(name)
+		if err != nil {
+			return "", err
+		}
+		rules = c.NatRules
+	}
+
+	for _, rule := range rules {
+		if rule.GuestPort == guestPort && rule.Proto() == "tcp" {
+			return rule.HostPort, nil
+		}
+	}
+	return "", fmt.Errorf("Instance %s does not forward port %s of httpserver, run it with '--publish <port>:%s' or use --address",
+		name, guestPort, guestPort)
+}
+
+// execCommand starts the command using httpserver at the given URL. While
+// waiting for the command to finish, whatever is appended to the console log
+// (if any) is copied to out.
+func execCommand(baseURL, consoleLog, command string, wait bool, out io.Writer) error {
+	client := api.NewClient(baseURL)
+
+	// Only output written after the command is started is streamed.
+	var console *os.File
+	if wait && consoleLog != "" {
+		f, err := os.Open(consoleLog)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+		console = f
+	}
+
+	tid, err := client.StartApp(command, true)
+	if err != nil {
+		return fmt.Errorf("failed to run '%s': %s", command, err)
+	}
+	fmt.Fprintf(out, "Started '%s' as thread %s\n", command, tid)
+
+	if !wait {
+		return nil
+	}
+	for {
+		finished, err := client.AppFinished(tid)
+		if err != nil {
+			return err
+		}
+		if console != nil {
+			if _, err := io.Copy(out, console); err != nil {
+				return err
+			}
+		}
+		if finished {
+			fmt.Fprintf(out, "Command '%s' finished\n", command)
+			return nil
+		}
+		time.Sleep(execPollInterval)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// DependencyGraph is the transitive require graph of a package. Every package
+// appears once with its resolved version, while each requirement is an edge
+// with the version constraint as given by the requiring package, so that
+// packages required several times with different constraints can be spotted.
+type DependencyGraph struct {
+	Root         string          `json:"root"`
+	Packages     []GraphPackage  `json:"packages"`
+	Dependencies []GraphRequires `json:"dependencies"`
+}
+
+type GraphPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type GraphRequires struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Constraint string `json:"constraint"`
+}
+
+// PackageGraph resolves packages required by the package in packageDir or,
+// when packageName is given, by the package in the local repository and
+// returns their require graph.
+func PackageGraph(repo *util.Repo, packageDir, packageName string, pullMissing bool) (DependencyGraph, error) {
+	var graph DependencyGraph
+
+	var pkg core.Package
+	var err error
+	if packageName != "" {
+		if !repo.PackageExists(packageName) {
+			return graph, fmt.Errorf("Package %s does not exist in your local repository", packageName)
+		}
+		pkg, err = core.ParsePackageManifest(repo.PackageManifest(packageName))
+	} else {
+		pkg, err = packageWithImplicitRequirements(packageDir)
+	}
+	if err != nil {
+		return graph, err
+	}
+
+	resolved, err := repo.ResolvePackageVersions(pkg, pullMissing)
+	if err != nil {
+		return graph, err
+	}
+
+	graph.Root = pkg.Name
+	resolved[pkg.Name] = pkg
+	var names []string
+	for name := range resolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	graph.Packages = []GraphPackage{}
+	graph.Dependencies = []GraphRequires{}
+	for _, name := range names {
+		p := resolved[name]
+		graph.Packages = append(graph.Packages, GraphPackage{Name: name, Version: p.Version})
+		for _, require := range p.Require {
+			req, err := core.ParseRequirement(require)
+			if err != nil {
+				return graph, err
+			}
+			graph.Dependencies = append(graph.Dependencies, GraphRequires{From: name, To: req.Name, Constraint: req.Constraint})
+		}
+	}
+	return graph, nil
+}
+
+// Duplicates returns names of packages that are required several times with
+// different version constraints.
+func (g DependencyGraph) Duplicates() []string {
+	constraints := make(map[string]map[string]bool)
+	for _, d := range g.Dependencies {
+		if constraints[d.To] == nil {
+			constraints[d.To] = make(map[string]bool)
+		}
+		constraints[d.To][d.Constraint] = true
+	}
+
+	duplicates := []string{}
+	for _, p := range g.Packages {
+		if len(constraints[p.Name]) > 1 {
+			duplicates = append(duplicates, p.Name)
+		}
+	}
+	return duplicates
+}
+
+// PrintPackageGraph prints the graph in the given format, either dot or json.
+func PrintPackageGraph(graph DependencyGraph, format string, out io.Writer) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(graph, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(data))
+	case "dot":
+		duplicates := make(map[string]bool)
+		for _, name := range graph.Duplicates() {
+			duplicates[name] = true
+		}
+
+		fmt.Fprintf(out, "digraph %q {\n", graph.Root)
+		for _, p := range graph.Packages {
+			attrs := fmt.Sprintf("label=%q", p.Name+"\n"+describeGraphVersion(p.Version))
+			if duplicates[p.Name] {
+				// Required with different constraints.
+				attrs += " color=red"
+			}
+			fmt.Fprintf(out, "  %q [%s];\n", p.Name, attrs)
+		}
+		for _, d := range graph.Dependencies {
+			if d.Constraint != "" {
+				fmt.Fprintf(out, "  %q -> %q [label=%q];\n", d.From, d.To, d.Constraint)
+			} else {
+				fmt.Fprintf(out, "  %q -> %q;\n", d.From, d.To)
+			}
+		}
+		fmt.Fprintln(out, "}")
+	default:
+		return fmt.Errorf("unsupported format '%s', use one of dot|json", format)
+	}
+	return nil
+}
+
+func describeGraphVersion(version string) string {
+	if version == "" {
+		return "(no version)"
+	}
+	return version
+}
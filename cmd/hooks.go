@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// composeHookEnv returns environment variables exposed to compose hooks: the
+// package directory, the directory of the composed image, the name and path
+// of the image, and the selected build profile, if any.
+func composeHookEnv(repo *util.Repo, packageDir, appName, profile string) map[string]string {
+	imagePath := repo.ImagePath("qemu", appName)
+	env := map[string]string{
+		"CAPSTAN_PACKAGE_DIR": packageDir,
+		"CAPSTAN_OUTPUT_DIR":  filepath.Dir(imagePath),
+		"CAPSTAN_IMAGE_NAME":  appName,
+		"CAPSTAN_IMAGE_PATH":  imagePath,
+	}
+	if profile != "" {
+		env[core.ProfileEnv] = profile
+	}
+	return env
+}
+
+// runHooks runs the hook commands of the given stage (e.g. pre_compose) one
+// after another in the shell, with the package directory as the working
+// directory and the given environment variables added to the environment of
+// capstan. The first failing command stops the compose.
+func runHooks(stage string, commands []string, packageDir string, env map[string]string) error {
+	for _, command := range commands {
+		fmt.Printf("Running %s hook: %s\n", stage, command)
+
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd.exe", "/c", command)
+		} else {
+			cmd = exec.Command("/bin/sh", "-c", command)
+		}
+		cmd.Dir = packageDir
+		cmd.Env = os.Environ()
+		for name, value := range env {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", name, value))
+		}
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook '%s' failed: %s", stage, command, err)
+		}
+	}
+	return nil
+}
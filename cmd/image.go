@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// InspectImage prints the boot command line embedded into the image. The image
+// may either be the name of a qemu image in the local repository or a path to
+// an image file.
+func InspectImage(repo *util.Repo, image string) error {
+	path := image
+	if repo.ImageExists("qemu", image) {
+		path = repo.ImagePath("qemu", image)
+	} else if _, err := os.Stat(image); os.IsNotExist(err) {
+		return fmt.Errorf("%s: no such image or file", image)
+	}
+
+	cmdLine, err := util.GetCmdLine(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-10s %s\n", "Image:", path)
+	fmt.Printf("%-10s %s\n", "Bootcmd:", cmdLine)
+	return nil
+}
+
+// EncryptImage encrypts the qemu image from the local repository with LUKS
+// using the key stored in keyFile.
+func EncryptImage(repo *util.Repo, image, keyFile string) error {
+	path := repo.ImagePath("qemu", image)
+	if util.IsEncryptedImage(path) {
+		return fmt.Errorf("%s: image is already encrypted", image)
+	}
+
+	fmt.Printf("Encrypting image %s...\n", image)
+	return util.EncryptImage(path, keyFile, repo.Qcow2)
+}
+
+// ImageContents prints the tree of files that were uploaded onto the image
+// when it was composed.
+func ImageContents(repo *util.Repo, image string) error {
+	if !repo.ImageExists("qemu", image) {
+		return fmt.Errorf("%s: no such image", image)
+	}
+
+	contents, err := core.ParseImageContents(repo.ImageContentsPath("qemu", image))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: list of files is not available, compose the image again to create it", image)
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Print(contents.Tree())
+	return nil
+}
+
+// Image formats that ExportImage is able to produce.
+var exportFormats = map[string]string{
+	"qcow2": ".qcow2",
+	"raw":   ".img",
+}
+
+// ExportImage writes the qemu image from the local repository into target
+// file in the given format (qcow2 or raw), optionally compressed
+// with xz or zstd. Empty target means the image is exported into the current
+// directory.
+func ExportImage(repo *util.Repo, image, target, format, compression string) error {
+	if !repo.ImageExists("qemu", image) {
+		return fmt.Errorf("%s: no such image", image)
+	}
+
+	formatExt, ok := exportFormats[format]
+	if !ok {
+		return fmt.Errorf("%s: unsupported format, use one of qcow2|raw", format)
+	}
+	ext, err := util.CompressionExtension(compression)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		target = filepath.Base(image) + formatExt + ext
+	}
+
+	fmt.Printf("Exporting image %s into %s...\n", image, target)
+
+	source := repo.ImagePath("qemu", image)
+	if format != "qcow2" {
+		tmp, err := ioutil.TempDir("", "capstan-export")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		converted := filepath.Join(tmp, "image"+formatExt)
+		if err := util.ConvertImageToRaw(source, converted); err != nil {
+			return err
+		}
+		source = converted
+	}
+
+	return util.CompressFile(source, target, compression)
+}
@@ -9,27 +9,97 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/mikelangelo-project/capstan/hypervisor/gce"
 	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
 	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
 	"github.com/mikelangelo-project/capstan/hypervisor/vmw"
+	"github.com/mikelangelo-project/capstan/nat"
 	"github.com/mikelangelo-project/capstan/util"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"gopkg.in/yaml.v2"
 )
 
-func Instances() error {
-	header := fmt.Sprintf("%-35s %-10s %-10s %-15s", "Name", "Platform", "Status", "Image")
-	fmt.Println(header)
+// InstanceInfo describes an instance listed by 'capstan instances'. Memory is
+// in MB and Uptime in seconds, both are zero when unknown. Ports are NAT
+// forwarding rules in form of <host port>:<guest port>.
+type InstanceInfo struct {
+	Name       string            `json:"name" yaml:"name"`
+	Hypervisor string            `json:"hypervisor" yaml:"hypervisor"`
+	Status     string            `json:"status" yaml:"status"`
+	Image      string            `json:"image" yaml:"image"`
+	Memory     int64             `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Cpus       int               `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	Ports      []string          `json:"ports,omitempty" yaml:"ports,omitempty"`
+	Uptime     int64             `json:"uptime,omitempty" yaml:"uptime,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// Created is in RFC 3339 format. It is empty for instances created by
+	// older versions of capstan, as is the rest of their metadata.
+	Created        string `json:"created,omitempty" yaml:"created,omitempty"`
+	ImageChecksum  string `json:"image_checksum,omitempty" yaml:"image_checksum,omitempty"`
+	CapstanVersion string `json:"capstan_version,omitempty" yaml:"capstan_version,omitempty"`
+	Autostart      bool   `json:"autostart,omitempty" yaml:"autostart,omitempty"`
+}
+
+func (info *InstanceInfo) setMetadata(metadata util.InstanceMetadata) {
+	info.Created = metadata.Created
+	info.ImageChecksum = metadata.ImageChecksum
+	info.CapstanVersion = metadata.CapstanVersion
+	// Image of the instance may not be known otherwise, e.g. on gce.
+	if info.Image == "" {
+		info.Image = metadata.Image
+	}
+}
+
+// Instances prints instances matching the label selector in the given
+// format. Empty selector matches all instances.
+func Instances(repo *util.Repo, format, selector string, out io.Writer) error {
+	instances, err := SelectInstances(repo, selector)
+	if err != nil {
+		return err
+	}
+	return PrintInstances(instances, format, out)
+}
+
+// SelectInstances returns instances with labels matching the label selector.
+// Empty selector matches all instances.
+func SelectInstances(repo *util.Repo, selector string) ([]InstanceInfo, error) {
+	instances, err := ListInstances(repo)
+	if err != nil || selector == "" {
+		return instances, err
+	}
+	s, err := util.ParseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []InstanceInfo
+	for _, instance := range instances {
+		if s.Matches(instance.Labels) {
+			selected = append(selected, instance)
+		}
+	}
+	return selected, nil
+}
+
+// ListInstances returns all instances sorted by hypervisor and name.
+func ListInstances(repo *util.Repo) ([]InstanceInfo, error) {
+	var instances []InstanceInfo
 	rootDir := filepath.Join(util.ConfigDir(), "instances")
 	platforms, _ := ioutil.ReadDir(rootDir)
 	for _, platform := range platforms {
 		if platform.IsDir() {
 			platformDir := filepath.Join(rootDir, platform.Name())
-			instances, _ := ioutil.ReadDir(platformDir)
-			for _, instance := range instances {
+			entries, _ := ioutil.ReadDir(platformDir)
+			for _, instance := range entries {
 				if instance.IsDir() {
 					instanceDir := filepath.Join(platformDir, instance.Name())
 
@@ -38,28 +108,459 @@ func Instances() error {
 						continue
 					}
 
-					printInstance(instance.Name(), platform.Name(), instanceDir)
+					instances = append(instances, describeInstance(repo, instance.Name(), platform.Name(), instanceDir))
 				}
 			}
 		}
 	}
-
-	return nil
+	return instances, nil
 }
 
-func printInstance(name, platform, dir string) error {
-	var status string
+// describeInstance returns status of the instance together with the settings
+// it was last run with. Settings that can not be read are left empty.
+func describeInstance(repo *util.Repo, name, platform, dir string) InstanceInfo {
+	info := InstanceInfo{Name: name, Hypervisor: platform}
 
 	switch platform {
 	case "qemu":
-		status, _ = qemu.GetVMStatus(name, dir)
+		info.Status, _ = qemu.GetVMStatus(name, dir)
+		if c, err := qemu.LoadConfig(name); err == nil {
+			// Instance disk is based on the image it was created from. The
+			// header is read directly since qemu-img can not open the disk of
+			// a running instance.
+			image := c.Image
+			if backing, err := util.QcowBackingFile(filepath.Join(dir, "disk.qcow2")); err == nil && backing != "" {
+				image = backing
+			}
+			info.Image = instanceImageName(repo, image)
+			info.Memory, info.Cpus, info.Ports = c.Memory, c.Cpus, natPorts(c.NatRules)
+			info.Labels = c.Labels
+			info.Autostart = c.Autostart
+			info.setMetadata(c.Metadata)
+		}
+		// The monitor socket is created when the instance starts.
+		if monitor, err := os.Stat(filepath.Join(dir, "osv.monitor")); err == nil && info.Status == "Running" {
+			info.Uptime = int64(time.Since(monitor.ModTime()).Seconds())
+		}
 	case "vbox":
-		status, _ = vbox.GetVMStatus(name, dir)
+		info.Status, _ = vbox.GetVMStatus(name, dir)
+		if c, err := vbox.LoadConfig(name); err == nil {
+			info.Image = instanceImageName(repo, c.Image)
+			info.Memory, info.Cpus, info.Ports = c.Memory, c.Cpus, natPorts(c.NatRules)
+			info.Labels = c.Labels
+			info.setMetadata(c.Metadata)
+		}
 	case "vmw":
-		status, _ = vmw.GetVMStatus(name, dir)
+		info.Status, _ = vmw.GetVMStatus(name, dir)
+		if c, err := vmw.LoadConfig(name); err == nil {
+			info.Image = instanceImageName(repo, c.OriginalVMDK)
+			info.Memory, info.Cpus, info.Ports = c.Memory, c.Cpus, natPorts(c.NatRules)
+			info.Labels = c.Labels
+			info.setMetadata(c.Metadata)
+		}
 	case "gce":
-		status, _ = gce.GetVMStatus(name, dir)
+		info.Status, _ = gce.GetVMStatus(name, dir)
+		if c, err := gce.LoadConfig(name); err == nil {
+			info.Image = c.Image
+			info.Labels = c.Labels
+			info.setMetadata(c.Metadata)
+		}
+	}
+	return info
+}
+
+// instanceImageName returns the name of the image in the local repository
+// that the instance was created from, or the path of the image file if it is
+// not in the repository.
+func instanceImageName(repo *util.Repo, path string) string {
+	rel, err := filepath.Rel(repo.RepoPath(), path)
+	if err != nil || path == "" || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.ToSlash(filepath.Dir(rel))
+}
+
+func natPorts(rules []nat.Rule) []string {
+	var ports []string
+	for _, rule := range rules {
+		ports = append(ports, rule.String())
+	}
+	return ports
+}
+
+// PrintInstances writes the instances as a table, JSON or YAML.
+func PrintInstances(instances []InstanceInfo, format string, out io.Writer) error {
+	switch format {
+	case "json":
+		if instances == nil {
+			instances = []InstanceInfo{}
+		}
+		data, err := json.MarshalIndent(instances, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(data))
+		return nil
+	case "yaml":
+		data, err := yaml.Marshal(instances)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out, string(data))
+		return nil
+	}
+
+	fmt.Fprintf(out, "%-35s %-10s %-10s %-25s %-8s %-5s %-10s %-17s %-15s %s\n", "Name", "Platform", "Status", "Image", "Memory",
+		"Cpus", "Uptime", "Created", "Ports", "Labels")
+	for _, i := range instances {
+		memory, cpus, uptime := i.formatResources()
+		fmt.Fprintf(out, "%-35s %-10s %-10s %-25s %-8s %-5s %-10s %-17s %-15s %s\n", i.Name, i.Hypervisor, i.Status, i.Image,
+			memory, cpus, uptime, i.formatCreated(), strings.Join(i.Ports, ","), i.formatLabels())
+	}
+	return nil
+}
+
+// InspectInstance prints all details of the instance in the given format.
+func InspectInstance(repo *util.Repo, name, format string, out io.Writer) error {
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" {
+		return fmt.Errorf("Instance %s does not exist", name)
+	}
+	info := describeInstance(repo, instanceName, platform, filepath.Join(util.ConfigDir(), "instances", platform, instanceName))
+
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(data))
+		return nil
+	case "yaml":
+		data, err := yaml.Marshal(info)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out, string(data))
+		return nil
+	}
+
+	memory, cpus, uptime := info.formatResources()
+	for _, field := range [][2]string{
+		{"Name", info.Name},
+		{"Platform", info.Hypervisor},
+		{"Status", info.Status},
+		{"Image", info.Image},
+		{"Image checksum", info.ImageChecksum},
+		{"Created", info.formatCreated()},
+		{"Capstan version", info.CapstanVersion},
+		{"Memory", memory},
+		{"Cpus", cpus},
+		{"Uptime", uptime},
+		{"Ports", strings.Join(info.Ports, ",")},
+		{"Labels", info.formatLabels()},
+		{"Autostart", fmt.Sprint(info.Autostart)},
+	} {
+		fmt.Fprintf(out, "%-17s %s\n", field[0]+":", field[1])
 	}
-	fmt.Printf("%-35s %-10s %-10s %-15s\n", name, platform, status, "")
 	return nil
 }
+
+// formatResources returns memory, number of CPUs and uptime for printing,
+// values that are not known are empty.
+func (info *InstanceInfo) formatResources() (memory, cpus, uptime string) {
+	if info.Memory > 0 {
+		memory = fmt.Sprintf("%dM", info.Memory)
+	}
+	if info.Cpus > 0 {
+		cpus = fmt.Sprintf("%d", info.Cpus)
+	}
+	if info.Uptime > 0 {
+		uptime = (time.Duration(info.Uptime) * time.Second).String()
+	}
+	return
+}
+
+// formatCreated returns the creation time in local time zone.
+func (info *InstanceInfo) formatCreated() string {
+	created, err := time.Parse(time.RFC3339, info.Created)
+	if err != nil {
+		return info.Created
+	}
+	return created.Local().Format("2006-01-02 15:04")
+}
+
+func (info *InstanceInfo) formatLabels() string {
+	var labels []string
+	for key, value := range info.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// RebaseInstance points the disk of the stopped qemu instance to a new base image.
+// The base may either be the name of an image in the local repository or a path
+// to an image file. Empty base flattens the instance disk so that it does not
+// depend on any base image anymore.
+func RebaseInstance(repo *util.Repo, name, base string, unsafe bool) error {
+	disk, err := stoppedQemuInstanceDisk(name)
+	if err != nil {
+		return err
+	}
+
+	if base != "" {
+		if repo.ImageExists("qemu", base) {
+			base = repo.ImagePath("qemu", base)
+		} else if _, err := os.Stat(base); os.IsNotExist(err) {
+			return fmt.Errorf("%s: no such image", base)
+		}
+		if base, err = filepath.Abs(base); err != nil {
+			return err
+		}
+	}
+
+	if err := util.RebaseImage(disk, base, unsafe); err != nil {
+		return err
+	}
+
+	if base == "" {
+		fmt.Printf("Instance %s flattened, it no longer depends on a base image\n", name)
+	} else {
+		fmt.Printf("Instance %s rebased onto %s\n", name, base)
+	}
+	return nil
+}
+
+// CommitInstance writes the changes of the stopped qemu instance into its base
+// image. Since the base image may be shared by other instances, the operation
+// is refused in such case unless force is set.
+func CommitInstance(name string, force bool) error {
+	disk, err := stoppedQemuInstanceDisk(name)
+	if err != nil {
+		return err
+	}
+
+	backing, err := util.QcowBackingFile(disk)
+	if err != nil {
+		return err
+	}
+	if backing == "" {
+		return fmt.Errorf("Instance %s has no base image to commit to", name)
+	}
+
+	if !force {
+		qemuDir := filepath.Join(util.ConfigDir(), "instances", "qemu")
+		instances, _ := ioutil.ReadDir(qemuDir)
+		for _, instance := range instances {
+			if !instance.IsDir() || instance.Name() == name {
+				continue
+			}
+			other, err := util.QcowBackingFile(filepath.Join(qemuDir, instance.Name(), "disk.qcow2"))
+			if err == nil && other == backing {
+				return fmt.Errorf("Base image %s is also used by instance %s, use --force to commit anyway",
+					backing, instance.Name())
+			}
+		}
+	}
+
+	if err := util.CommitImage(disk); err != nil {
+		return err
+	}
+
+	fmt.Printf("Changes of instance %s committed into %s\n", name, backing)
+	return nil
+}
+
+// stoppedQemuInstanceDisk returns path to the disk of the named qemu instance
+// and makes sure the instance is not running.
+func stoppedQemuInstanceDisk(name string) (string, error) {
+	instanceName, instancePlatform := util.SearchInstance(name)
+	if instanceName == "" {
+		return "", fmt.Errorf("Instance: %s not found", name)
+	}
+	if instancePlatform != "qemu" {
+		return "", fmt.Errorf("%s: operation is only supported for qemu instances", instancePlatform)
+	}
+
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+	if status, _ := qemu.GetVMStatus(name, dir); status == "Running" {
+		return "", fmt.Errorf("Instance %s is running, stop it first with 'capstan stop %s'", name, name)
+	}
+
+	return filepath.Join(dir, "disk.qcow2"), nil
+}
+
+// RenameInstance renames the stopped qemu instance. Paths in its
+// configuration are updated to the new instance directory.
+func RenameInstance(name, newName string) error {
+	unlock, err := lockQemuInstances(name, newName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir, newDir, err := prepareInstanceCopy(name, newName)
+	if err != nil {
+		return err
+	}
+
+	// The monitor socket of the last run is stale, it is recreated on launch.
+	os.Remove(filepath.Join(dir, "osv.monitor"))
+	if err := os.Rename(dir, newDir); err != nil {
+		return err
+	}
+	if err := relocateQemuConfig(newName, dir, newDir, false); err != nil {
+		return err
+	}
+	if err := util.RenameMAC(name, newName); err != nil {
+		return err
+	}
+
+	fmt.Printf("Instance %s renamed to %s\n", name, newName)
+	return nil
+}
+
+// CloneInstance copies the stopped qemu instance, including changes written
+// to its disk, into a new instance. The clone is given a new MAC address so
+// that both instances can run on the same network.
+func CloneInstance(name, newName string) error {
+	unlock, err := lockQemuInstances(name, newName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir, newDir, err := prepareInstanceCopy(name, newName)
+	if err != nil {
+		return err
+	}
+
+	c, err := qemu.LoadConfig(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(newDir, 0775); err != nil {
+		return err
+	}
+	// Runtime state of the instance is not cloned, disks of its volumes are.
+	files := []string{"disk.qcow2", "osv.config"}
+	for _, volume := range c.Volumes {
+		if rel, ok := pathInDir(dir, volume.Source); ok {
+			if _, err := os.Stat(volume.Source); err == nil {
+				files = append(files, rel)
+			}
+		}
+	}
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(newDir, file)), 0775); err != nil {
+			os.RemoveAll(newDir)
+			return err
+		}
+		if err := util.CopyLocalFile(filepath.Join(newDir, file), filepath.Join(dir, file)); err != nil {
+			os.RemoveAll(newDir)
+			return err
+		}
+	}
+	if err := relocateQemuConfig(newName, dir, newDir, true); err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+
+	fmt.Printf("Instance %s cloned into %s\n", name, newName)
+	return nil
+}
+
+// lockQemuInstances locks the qemu instances in order of their names, so that
+// concurrent invocations locking the same instances do not deadlock. The
+// returned function releases the locks.
+func lockQemuInstances(names ...string) (func(), error) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	var locks []*util.FileLock
+	unlock := func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}
+	for _, name := range sorted {
+		lock, err := util.LockInstance("qemu", name)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return unlock, nil
+}
+
+// prepareInstanceCopy returns directories of the stopped qemu instance and of
+// the new instance, which must not exist yet.
+func prepareInstanceCopy(name, newName string) (string, string, error) {
+	if newName == "" || strings.ContainsAny(newName, `/\`) {
+		return "", "", fmt.Errorf("invalid instance name: '%s'", newName)
+	}
+	if _, err := stoppedQemuInstanceDisk(name); err != nil {
+		return "", "", err
+	}
+	if other, platform := util.SearchInstance(newName); other != "" {
+		return "", "", fmt.Errorf("Instance %s already exists on %s", newName, platform)
+	}
+
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+	newDir := filepath.Join(util.ConfigDir(), "instances", "qemu", newName)
+	if _, err := os.Stat(newDir); err == nil {
+		return "", "", fmt.Errorf("%s already exists", newDir)
+	}
+	return dir, newDir, nil
+}
+
+// pathInDir returns the path relative to dir, or false when the path is not
+// within dir, e.g. a volume shared from elsewhere on the host or an NFS URL.
+func pathInDir(dir, path string) (string, bool) {
+	if path == "" || !filepath.IsAbs(path) {
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return rel, true
+}
+
+// relocateQemuConfig rewrites the configuration of the instance that was
+// moved or copied from dir to newDir so that it refers to files of newDir.
+func relocateQemuConfig(name, dir, newDir string, newMAC bool) error {
+	c, err := qemu.LoadConfig(name)
+	if err != nil {
+		return err
+	}
+
+	relocate := func(path string) string {
+		if rel, ok := pathInDir(dir, path); ok {
+			return filepath.Join(newDir, rel)
+		}
+		return path
+	}
+	c.Name = name
+	c.Image = relocate(c.Image)
+	for i := range c.Volumes {
+		c.Volumes[i].Source = relocate(c.Volumes[i].Source)
+	}
+	c.InstanceDir = newDir
+	c.Monitor = filepath.Join(newDir, "osv.monitor")
+	c.ConfigFile = filepath.Join(newDir, "osv.config")
+
+	if newMAC {
+		mac, err := util.AllocateMAC(name)
+		if err != nil {
+			return err
+		}
+		c.MAC = mac.String()
+		c.Metadata.Created = time.Now().Format(time.RFC3339)
+		// Clones forward the same host ports, so only the original is autostarted.
+		c.Autostart = false
+	}
+	return qemu.StoreConfig(c)
+}
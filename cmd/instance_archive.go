@@ -0,0 +1,358 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// instanceManifestName is the name of the manifest that is the first entry of
+// every instance archive, followed by the disk of the instance and the disks
+// of its volumes.
+const instanceManifestName = "instance.yaml"
+
+const instanceDiskName = "disk.qcow2"
+
+// InstanceManifest describes an exported instance. It holds only settings
+// that do not depend on the host, paths of the instance are recreated on
+// import. Cmd is the boot command embedded into the disk. Sources of volumes
+// kept in the instance directory are relative to it and their files are part
+// of the archive, other volumes refer to the host the instance is imported on.
+type InstanceManifest struct {
+	Name         string                `yaml:"name"`
+	Exported     string                `yaml:"exported"`
+	Memory       int64                 `yaml:"memory"`
+	Cpus         int                   `yaml:"cpus"`
+	Networking   string                `yaml:"networking"`
+	Bridge       string                `yaml:"bridge,omitempty"`
+	Ports        []string              `yaml:"ports,omitempty"`
+	IPv6Net      string                `yaml:"ipv6_net,omitempty"`
+	IPv6Host     string                `yaml:"ipv6_host,omitempty"`
+	GuestNetwork util.GuestNetwork     `yaml:"guest_network,omitempty"`
+	MAC          string                `yaml:"mac,omitempty"`
+	Cmd          string                `yaml:"cmd,omitempty"`
+	Labels       map[string]string     `yaml:"labels,omitempty"`
+	Metadata     util.InstanceMetadata `yaml:"metadata"`
+	DiskChecksum string                `yaml:"disk_checksum"`
+
+	Volumes         []util.Volume     `yaml:"volumes,omitempty"`
+	VolumeChecksums map[string]string `yaml:"volume_checksums,omitempty"`
+}
+
+// ExportInstance writes the stopped qemu instance into an archive that can be
+// imported on another host. The disk is flattened, i.e. merged with the image
+// it is based on, so the image does not have to exist there.
+func ExportInstance(name, target string) error {
+	lock, err := util.LockInstance("qemu", name)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	disk, err := stoppedQemuInstanceDisk(name)
+	if err != nil {
+		return err
+	}
+	if util.IsEncryptedImage(disk) {
+		return fmt.Errorf("Instance %s is encrypted and can not be exported", name)
+	}
+	c, err := qemu.LoadConfig(name)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(disk), "export")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	flat := filepath.Join(tmp, instanceDiskName)
+	fmt.Printf("Flattening disk of instance %s...\n", name)
+	if err := util.FlattenImage(disk, flat); err != nil {
+		return err
+	}
+
+	manifest := InstanceManifest{
+		Name:         name,
+		Exported:     time.Now().Format(time.RFC3339),
+		Memory:       c.Memory,
+		Cpus:         c.Cpus,
+		Networking:   c.Networking,
+		Bridge:       c.Bridge,
+		Ports:        natPorts(c.NatRules),
+		IPv6Net:      c.IPv6Net,
+		IPv6Host:     c.IPv6Host,
+		GuestNetwork: c.GuestNetwork,
+		MAC:          c.MAC,
+		Labels:       c.Labels,
+		Metadata:     c.Metadata,
+	}
+	if manifest.Cmd, err = util.GetCmdLine(flat); err != nil {
+		return err
+	}
+	if manifest.DiskChecksum, err = util.FileChecksum(flat); err != nil {
+		return err
+	}
+	files := map[string]string{}
+	for _, volume := range c.Volumes {
+		if rel, ok := pathInDir(filepath.Dir(disk), volume.Source); ok {
+			rel = filepath.ToSlash(rel)
+			if manifest.VolumeChecksums == nil {
+				manifest.VolumeChecksums = map[string]string{}
+			}
+			if manifest.VolumeChecksums[rel], err = util.FileChecksum(volume.Source); err != nil {
+				return err
+			}
+			files[rel] = volume.Source
+			volume.Source = rel
+		}
+		manifest.Volumes = append(manifest.Volumes, volume)
+	}
+
+	if target == "" {
+		target = name + ".instance.tar.gz"
+	}
+	if err := writeInstanceArchive(manifest, flat, files, target); err != nil {
+		os.Remove(target)
+		return err
+	}
+	fmt.Printf("Instance %s exported into %s\n", name, target)
+	return nil
+}
+
+func writeInstanceArchive(manifest InstanceManifest, disk string, files map[string]string, target string) error {
+	output, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	gzWriter := gzip.NewWriter(output)
+	defer gzWriter.Close()
+	tarball := tar.NewWriter(gzWriter)
+	defer tarball.Close()
+
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: instanceManifestName, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tarball.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tarball.Write(data); err != nil {
+		return err
+	}
+	if err := addBundleFile(tarball, disk, instanceDiskName); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := addBundleFile(tarball, files[name], name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportInstance creates a qemu instance of the archive written by
+// ExportInstance. The instance keeps its name unless one is given, and its
+// MAC address unless newMAC is set.
+func ImportInstance(repo *util.Repo, archive, name string, newMAC bool) error {
+	input, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	gzReader, err := gzip.NewReader(input)
+	if err != nil {
+		return fmt.Errorf("%s: not an instance archive: %s", archive, err)
+	}
+	tarReader := tar.NewReader(gzReader)
+
+	hdr, err := tarReader.Next()
+	if err != nil || hdr.Name != instanceManifestName {
+		return fmt.Errorf("%s: not an instance archive, %s must come first", archive, instanceManifestName)
+	}
+	data, err := ioutil.ReadAll(tarReader)
+	if err != nil {
+		return err
+	}
+	var manifest InstanceManifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("%s: invalid %s: %s", archive, instanceManifestName, err)
+	}
+	rules, err := nat.Parse(manifest.Ports)
+	if err != nil {
+		return fmt.Errorf("%s: %s in %s", archive, err, instanceManifestName)
+	}
+
+	if name == "" {
+		name = manifest.Name
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid instance name: '%s'", name)
+	}
+	lock, err := util.LockInstance("qemu", name)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if other, platform := util.SearchInstance(name); other != "" {
+		return fmt.Errorf("Instance %s already exists on %s", name, platform)
+	}
+
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	imported := false
+	defer func() {
+		if !imported {
+			os.RemoveAll(dir)
+			util.ReleaseMAC(name)
+		}
+	}()
+
+	disk := filepath.Join(dir, instanceDiskName)
+	if hdr, err = tarReader.Next(); err != nil || hdr.Name != instanceDiskName {
+		return fmt.Errorf("%s: %s is missing from the archive", archive, instanceDiskName)
+	}
+	if err := extractInstanceFile(tarReader, disk, instanceDiskName, manifest.DiskChecksum); err != nil {
+		return err
+	}
+	extracted := map[string]bool{}
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		checksum, ok := manifest.VolumeChecksums[hdr.Name]
+		if !ok || extracted[hdr.Name] || !isArchivedVolumeName(hdr.Name) {
+			return fmt.Errorf("%s: unexpected %s in the archive", archive, hdr.Name)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			return err
+		}
+		if err := extractInstanceFile(tarReader, path, hdr.Name, checksum); err != nil {
+			return err
+		}
+		extracted[hdr.Name] = true
+	}
+	volumes := make([]util.Volume, len(manifest.Volumes))
+	for i, volume := range manifest.Volumes {
+		if _, ok := manifest.VolumeChecksums[volume.Source]; ok {
+			if !extracted[volume.Source] {
+				return fmt.Errorf("%s: %s is missing from the archive", archive, volume.Source)
+			}
+			volume.Source = filepath.Join(dir, filepath.FromSlash(volume.Source))
+		}
+		volumes[i] = volume
+	}
+
+	c := &qemu.VMConfig{
+		Name:         name,
+		Image:        disk,
+		Verbose:      true,
+		Memory:       manifest.Memory,
+		Cpus:         manifest.Cpus,
+		Networking:   manifest.Networking,
+		Bridge:       manifest.Bridge,
+		NatRules:     rules,
+		IPv6Net:      manifest.IPv6Net,
+		IPv6Host:     manifest.IPv6Host,
+		GuestNetwork: manifest.GuestNetwork,
+		BackingFile:  true,
+		InstanceDir:  dir,
+		Monitor:      filepath.Join(dir, "osv.monitor"),
+		ConfigFile:   filepath.Join(dir, "osv.config"),
+		MAC:          manifest.MAC,
+		Cmd:          manifest.Cmd,
+		DisableKvm:   repo.DisableKvm,
+		Persist:      true,
+		Qcow2:        repo.Qcow2,
+		Labels:       manifest.Labels,
+		Metadata:     manifest.Metadata,
+		Volumes:      volumes,
+	}
+	if newMAC || c.MAC == "" {
+		mac, err := util.AllocateMAC(name)
+		if err != nil {
+			return err
+		}
+		c.MAC = mac.String()
+	} else if err := util.ReserveMAC(name, c.MAC); err != nil {
+		return fmt.Errorf("%s, import it with --new-mac", err)
+	}
+	if err := qemu.StoreConfig(c); err != nil {
+		return err
+	}
+	imported = true
+
+	fmt.Printf("Instance %s imported from %s\n", name, archive)
+	return nil
+}
+
+// extractInstanceFile writes the current entry of the archive into path and
+// verifies its checksum.
+func extractInstanceFile(tarReader *tar.Reader, path, name, expected string) error {
+	output, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, tarReader)
+	output.Close()
+	if err != nil {
+		return err
+	}
+	checksum, err := util.FileChecksum(path)
+	if err != nil {
+		return err
+	}
+	return util.VerifyChecksum(name, expected, checksum)
+}
+
+// isArchivedVolumeName reports whether the name of a volume disk in the archive
+// stays within the instance directory.
+func isArchivedVolumeName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, `\`) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return name != instanceDiskName && name != instanceManifestName
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// ResolveLoader returns the loader image that images with the root
+// filesystem are composed from. Without constraint it is the default loader
+// image, otherwise the newest versioned loader image satisfying the version
+// constraint, which is pulled from remote repositories if pullMissing is set
+// and no local one satisfies it.
+func ResolveLoader(repo *util.Repo, fs, constraint string, pullMissing bool) (string, error) {
+	if constraint == "" {
+		return util.DefaultLoaderImage(fs), nil
+	}
+	req, err := core.ParseLoaderConstraint(constraint)
+	if err != nil {
+		return "", err
+	}
+
+	if version := newestMatching(repo.LoaderVersions(fs), req); version != "" {
+		return util.LoaderImage(fs, version), nil
+	}
+
+	if pullMissing {
+		for _, url := range repo.RemoteURLs() {
+			versions, err := util.RemoteLoaderVersions(url, fs)
+			if err != nil {
+				return "", err
+			}
+			if version := newestMatching(versions, req); version != "" {
+				image := util.LoaderImage(fs, version)
+				if err := Pull(repo, "qemu", image); err != nil {
+					return "", err
+				}
+				return image, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no loader image of version %s is available, see 'capstan loader list'", constraint)
+}
+
+// newestMatching returns the newest of the versions satisfying the
+// requirement, or an empty string if none does.
+func newestMatching(versions []string, req core.Requirement) string {
+	newest := ""
+	for _, version := range versions {
+		if req.Matches(version) && (newest == "" || core.CompareVersions(version, newest) > 0) {
+			newest = version
+		}
+	}
+	return newest
+}
+
+// composeLoader resolves the loader image of the package and records it in
+// capstan.lock if the package has one, which is rewritten only when the loader
+// changed. When locked is set, the locked loader image is used unless a
+// version is given and the resolved one must match the locked one.
+func composeLoader(repo *util.Repo, packageDir, fs, constraint string, pullMissing, locked bool) (string, error) {
+	lockPath := filepath.Join(packageDir, core.LockFileName)
+	lock, err := core.ParseLockFile(lockPath)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var image string
+	if locked && constraint == "" && lock.Loader != nil {
+		image = lock.Loader.Name
+	} else if image, err = ResolveLoader(repo, fs, constraint, pullMissing); err != nil {
+		return "", err
+	}
+
+	hash, err := util.FileChecksum(repo.ImagePath("qemu", image))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("loader image %s is not available, pull it with 'capstan pull %s'", image, image)
+	} else if err != nil {
+		return "", err
+	}
+	loader := &core.LockedPackage{Name: image, Version: repo.LoaderVersion(image), Hash: hash}
+
+	if !locked {
+		if !exists || (lock.Loader != nil && *lock.Loader == *loader) {
+			return image, nil
+		}
+		lock.Loader = loader
+		return image, lock.WriteToFile(lockPath)
+	}
+	if lock.Loader == nil {
+		return "", fmt.Errorf("loader is not recorded in %s, compose the package without --locked to record it", core.LockFileName)
+	}
+	if *lock.Loader != *loader {
+		return "", fmt.Errorf("Resolved loader differs from %s: locked %s %s, resolved %s %s", core.LockFileName,
+			lock.Loader.Name, describeLoaderVersion(lock.Loader.Version), loader.Name, describeLoaderVersion(loader.Version))
+	}
+	return image, nil
+}
+
+func describeLoaderVersion(version string) string {
+	if version == "" {
+		return "(no version)"
+	}
+	return version
+}
+
+// ListLoaders prints versioned loader images of both root filesystems that
+// are available locally and, if remote is set, in remote repositories.
+func ListLoaders(repo *util.Repo, remote bool) error {
+	fmt.Printf("%-35s %-15s %-6s %s\n", "Loader", "Version", "FS", "Location")
+	for _, fs := range []string{util.FilesystemZFS, util.FilesystemROFS} {
+		if image := util.DefaultLoaderImage(fs); repo.ImageExists("qemu", image) {
+			fmt.Printf("%-35s %-15s %-6s %s\n", image, describeLoaderVersion(repo.LoaderVersion(image)), fs, "local (default)")
+		}
+
+		local := repo.LoaderVersions(fs)
+		sortVersions(local)
+		for _, version := range local {
+			fmt.Printf("%-35s %-15s %-6s %s\n", util.LoaderImage(fs, version), version, fs, "local")
+		}
+		if !remote {
+			continue
+		}
+
+		isLocal := make(map[string]bool)
+		for _, version := range local {
+			isLocal[version] = true
+		}
+		for _, url := range repo.RemoteURLs() {
+			versions, err := util.RemoteLoaderVersions(url, fs)
+			if err != nil {
+				return err
+			}
+			sortVersions(versions)
+			for _, version := range versions {
+				if !isLocal[version] {
+					fmt.Printf("%-35s %-15s %-6s %s\n", util.LoaderImage(fs, version), version, fs, url)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		return core.CompareVersions(versions[i], versions[j]) < 0
+	})
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// CreateNetwork creates the bridge along with dnsmasq that hands out
+// addresses to instances attached to it and resolves their hostnames.
+func CreateNetwork(bridge, address, domain string) error {
+	if address == "" {
+		address = util.DefaultManagedNetworkAddress
+	}
+	n := &util.ManagedNetwork{Bridge: bridge, Address: address, Domain: domain}
+	if err := n.Create(); err != nil {
+		return err
+	}
+	fmt.Printf("Created network %s with address %s\n", bridge, address)
+	return nil
+}
+
+// DeleteNetwork stops dnsmasq of the managed bridge and deletes the bridge.
+func DeleteNetwork(bridge string) error {
+	n, err := util.LoadManagedNetwork(bridge)
+	if err != nil {
+		return err
+	}
+	if err := n.Delete(); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted network %s\n", bridge)
+	return nil
+}
+
+// ListNetworks prints the managed bridges along with leases of instances.
+func ListNetworks() error {
+	networks, err := util.ListManagedNetworks()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-15s %-18s %-10s %-16s %s\n", "Bridge", "Address", "Dnsmasq", "Instance", "IP")
+	for _, n := range networks {
+		status := "Stopped"
+		if n.DnsmasqPid() != 0 {
+			status = "Running"
+		}
+		fmt.Printf("%-15s %-18s %-10s\n", n.Bridge, n.Address, status)
+		leases, err := n.Leases()
+		if err != nil {
+			return err
+		}
+		for _, lease := range leases {
+			fmt.Printf("%-15s %-18s %-10s %-16s %s\n", "", "", "", lease.Hostname, lease.IP)
+		}
+	}
+	return nil
+}
+
+// registerManagedHost registers the hostname of the qemu instance with
+// dnsmasq of the managed bridge it is attached to, if any. The instance is
+// given its MAC address up front so that the hostname is bound to it.
+func registerManagedHost(c *qemu.VMConfig) error {
+	n := managedNetworkOf(c)
+	if n == nil {
+		return nil
+	}
+	if c.MAC == "" {
+		mac, err := util.AllocateMAC(c.Name)
+		if err != nil {
+			return err
+		}
+		c.MAC = mac.String()
+	}
+	return n.RegisterHost(c.MAC, c.Name)
+}
+
+// unregisterManagedHost removes the hostname of the qemu instance from
+// dnsmasq of its managed bridge. Failures are only reported.
+func unregisterManagedHost(c *qemu.VMConfig) {
+	n := managedNetworkOf(c)
+	if n == nil || c.MAC == "" {
+		return
+	}
+	if err := n.UnregisterHost(c.MAC); err != nil {
+		fmt.Printf("Failed to remove instance %s from network %s: %s\n", c.Name, n.Bridge, err)
+	}
+}
+
+func managedNetworkOf(c *qemu.VMConfig) *util.ManagedNetwork {
+	if c == nil {
+		return nil
+	}
+	bridge := ""
+	switch c.Networking {
+	case "bridge":
+		bridge = c.Bridge
+	case "tap":
+		bridge = c.TapBridge
+	}
+	if !util.IsManagedNetwork(bridge) {
+		return nil
+	}
+	n, err := util.LoadManagedNetwork(bridge)
+	if err != nil {
+		return nil
+	}
+	return n
+}
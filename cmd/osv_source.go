@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// Images imported from the OSv source tree: the base image that Capstanfiles
+// are built upon and the loader image that packages can be composed from.
+const (
+	OSvSourceBaseImage   = "osv-src/osv-base"
+	OSvSourceLoaderImage = "osv-src/osv-loader"
+)
+
+// OSvSource is a local OSv source tree that images are based on, for kernel
+// developers who iterate on OSv along with their applications.
+type OSvSource struct {
+	Dir string
+	// Mode of the build, release or debug. Artifacts are taken from
+	// build/<mode> of the source tree.
+	Mode string
+	// Prebuilt takes artifacts of a previous build instead of building OSv.
+	Prebuilt bool
+}
+
+// ValidateOSvMode checks the mode of the OSv build.
+func ValidateOSvMode(mode string) error {
+	switch mode {
+	case "release", "debug":
+		return nil
+	}
+	return fmt.Errorf("unknown OSv build mode '%s', use one of release|debug", mode)
+}
+
+// buildArgs returns arguments of scripts/build of OSv. The empty image still
+// holds the tools that files are uploaded with.
+func (s OSvSource) buildArgs() []string {
+	return []string{"image=empty", "fs=zfs", "mode=" + s.Mode, fmt.Sprintf("-j%d", runtime.NumCPU())}
+}
+
+// BuildOSvSource builds OSv in the source tree, unless prebuilt, and imports
+// the resulting usr.img and loader.img into the repository as
+// OSvSourceBaseImage and OSvSourceLoaderImage.
+func BuildOSvSource(repo *util.Repo, src OSvSource) error {
+	if err := ValidateOSvMode(src.Mode); err != nil {
+		return err
+	}
+	script := filepath.Join(src.Dir, "scripts", "build")
+	if _, err := os.Stat(script); err != nil {
+		return fmt.Errorf("%s is not an OSv source tree: scripts/build is missing", src.Dir)
+	}
+
+	build := "scripts/build " + strings.Join(src.buildArgs(), " ")
+	if !src.Prebuilt {
+		fmt.Printf("Building OSv in %s...\n", src.Dir)
+		cmd := exec.Command(script, src.buildArgs()...)
+		cmd.Dir = src.Dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("OSv build '%s' failed: %s", build, err)
+		}
+	}
+
+	buildDir := filepath.Join(src.Dir, "build", src.Mode)
+	usrImage := filepath.Join(buildDir, "usr.img")
+	loaderImage := filepath.Join(buildDir, "loader.img")
+	for _, artifact := range []string{usrImage, loaderImage} {
+		if _, err := os.Stat(artifact); err != nil {
+			return fmt.Errorf("%s: OSv build artifact is missing, build OSv in %s mode first", artifact, src.Mode)
+		}
+	}
+
+	info := util.ImageInfo{
+		FormatVersion: "1",
+		Version:       osvSourceVersion(src.Dir),
+		Created:       time.Now().Format(time.RFC3339),
+		Description:   fmt.Sprintf("OSv built from %s (%s)", src.Dir, src.Mode),
+		Build:         build,
+	}
+	if err := repo.ImportImage(OSvSourceBaseImage, usrImage, info.Version, info.Created, info.Description, info.Build); err != nil {
+		return err
+	}
+	return repo.ImportLoaderImage(OSvSourceLoaderImage, loaderImage, info)
+}
+
+// osvSourceVersion describes the commit that the source tree is at, or
+// returns an empty string if it is not a git repository.
+func osvSourceVersion(dir string) string {
+	cmd := exec.Command("git", "describe", "--tags", "--always", "--dirty")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
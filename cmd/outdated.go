@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// OutdatedPackage is a required package with a newer version available.
+// Current is the locked version, or the version in the local repository when
+// the package is not locked. Wanted is the newest version satisfying the
+// requirement of package.yaml and Latest the newest version available at all.
+type OutdatedPackage struct {
+	Name       string
+	Constraint string
+	Current    string
+	Wanted     string
+	Latest     string
+	Repository string
+}
+
+// OutdatedPackages compares versions of packages required by the package in
+// packageDir, both the ones listed in package.yaml and the ones recorded in
+// capstan.lock, with versions available in the local and remote repositories.
+// Packages with newer versions available are returned sorted by name.
+func OutdatedPackages(repo *util.Repo, packageDir string) ([]OutdatedPackage, error) {
+	pkg, err := core.ParsePackageManifest(filepath.Join(packageDir, "meta", "package.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if err := pkg.ResolveLocalRequirements(packageDir); err != nil {
+		return nil, err
+	}
+
+	requirements := make(map[string]core.Requirement)
+	current := make(map[string]string)
+	for _, require := range pkg.Require {
+		req, err := core.ParseRequirement(require)
+		if err != nil {
+			return nil, err
+		}
+		requirements[req.Name] = req
+		if repo.PackageExists(req.Name) {
+			local, err := core.ParsePackageManifest(repo.PackageManifest(req.Name))
+			if err != nil {
+				return nil, err
+			}
+			current[req.Name] = local.Version
+		}
+	}
+
+	lock, err := core.ParseLockFile(filepath.Join(packageDir, core.LockFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, p := range lock.Packages {
+		if _, ok := requirements[p.Name]; !ok {
+			requirements[p.Name] = core.Requirement{Name: p.Name}
+		}
+		current[p.Name] = p.Version
+	}
+
+	var names []string
+	for name := range requirements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	outdated := []OutdatedPackage{}
+	for _, name := range names {
+		req := requirements[name]
+		available, err := availableVersions(repo, name)
+		if err != nil {
+			return nil, err
+		}
+
+		o := OutdatedPackage{Name: name, Constraint: req.Constraint, Current: current[name]}
+		for _, a := range available {
+			if a.version == "" {
+				continue
+			}
+			if o.Latest == "" || core.CompareVersions(a.version, o.Latest) > 0 {
+				o.Latest = a.version
+				o.Repository = a.repository
+			}
+			if req.Matches(a.version) && (o.Wanted == "" || core.CompareVersions(a.version, o.Wanted) > 0) {
+				o.Wanted = a.version
+			}
+		}
+		if o.Latest != "" && (o.Current == "" || core.CompareVersions(o.Latest, o.Current) > 0) {
+			outdated = append(outdated, o)
+		}
+	}
+	return outdated, nil
+}
+
+// availableVersion is a version of a package available in the repository,
+// the local one has an empty repository URL.
+type availableVersion struct {
+	version    string
+	repository string
+}
+
+func availableVersions(repo *util.Repo, name string) ([]availableVersion, error) {
+	var available []availableVersion
+	if repo.PackageExists(name) {
+		local, err := core.ParsePackageManifest(repo.PackageManifest(name))
+		if err != nil {
+			return nil, err
+		}
+		available = append(available, availableVersion{version: local.Version})
+	}
+
+	err := repo.SearchRemotes(func(url string) (bool, error) {
+		remote, err := util.IsRemotePackage(url, name)
+		if err != nil || !remote {
+			return false, err
+		}
+		if pkg := util.RemotePackageInfo(url, fmt.Sprintf("packages/%s.yaml", name)); pkg != nil {
+			available = append(available, availableVersion{version: pkg.Version, repository: url})
+		}
+		return false, nil
+	})
+	return available, err
+}
+
+// PrintOutdatedPackages prints the table of outdated packages.
+func PrintOutdatedPackages(packages []OutdatedPackage, out io.Writer) {
+	if len(packages) == 0 {
+		fmt.Fprintln(out, "All required packages are up to date")
+		return
+	}
+
+	fmt.Fprintf(out, "%-35s %-15s %-15s %-15s %-15s %s\n", "Name", "Constraint", "Current", "Wanted", "Latest", "Repository")
+	for _, p := range packages {
+		repository := p.Repository
+		if repository == "" {
+			repository = "local"
+		}
+		fmt.Fprintf(out, "%-35s %-15s %-15s %-15s %-15s %s\n",
+			p.Name, orDash(p.Constraint), orDash(p.Current), orDash(p.Wanted), p.Latest, repository)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -16,6 +16,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/mikelangelo-project/capstan/core"
@@ -72,6 +73,10 @@ func BuildPackage(packageDir string) (string, error) {
 	tarball := tar.NewWriter(gzWriter)
 	defer tarball.Close()
 
+	digests := fileDigests{}
+	var dedupCount int
+	var dedupSaved int64
+
 	err = filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -82,7 +87,12 @@ func BuildPackage(packageDir string) (string, error) {
 		// TODO(miha-plesko): respect .capstanignore instead hard-coding
 
 		// Skip the MPM package file or the collected package content..
-		if filepath.Base(path) == mpmname || strings.HasPrefix(relPath, "/mpm-pkg") {
+		if filepath.Base(path) == mpmname || strings.HasPrefix(relPath, "/mpm-pkg") || relPath == "/"+core.LockFileName {
+			return nil
+		}
+
+		// Skip vendored packages.
+		if isVendoredFile(relPath) {
 			return nil
 		}
 
@@ -101,6 +111,7 @@ func BuildPackage(packageDir string) (string, error) {
 		if err != nil {
 			return err
 		}
+		normalizeTarHeader(header)
 
 		// Since the default initialisation uses only the basename for the name
 		// we have to use a path relative to the package in order to presserve
@@ -111,6 +122,22 @@ func BuildPackage(packageDir string) (string, error) {
 			header.Name = relPath
 		}
 
+		// Identical files are stored as hard links to the first one.
+		if pkg.Dedup {
+			original, err := digests.original(path, info)
+			if err != nil {
+				return err
+			}
+			if original != "" {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = strings.TrimPrefix(original, packageDir)
+				header.Size = 0
+				dedupCount++
+				dedupSaved += info.Size()
+				return tarball.WriteHeader(header)
+			}
+		}
+
 		if err := tarball.WriteHeader(header); err != nil {
 			return err
 		}
@@ -142,7 +169,24 @@ func BuildPackage(packageDir string) (string, error) {
 		return "", err
 	}
 
+	// Flush the package before computing its digest.
+	if err := tarball.Close(); err != nil {
+		return "", err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return "", err
+	}
+	if err := mpmfile.Close(); err != nil {
+		return "", err
+	}
+	digest, err := util.FileChecksum(target)
+	if err != nil {
+		return "", err
+	}
+
+	reportDeduplication(dedupCount, dedupSaved)
 	fmt.Printf("Package built and stored in %s\n", target)
+	fmt.Printf("Package digest: %s\n", digest)
 
 	return target, nil
 }
@@ -154,8 +198,18 @@ func BuildPackage(packageDir string) (string, error) {
 // by comparing previous MD5 hashes to the ones in the current package
 // directory. Only modified files are uploaded and no file deletions are
 // possible at this time.
-func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pullMissing bool,
-	packageDir, appName string, bootOpts *BootOptions) error {
+// If locked is set, required packages must resolve to those in capstan.lock.
+// The image is composed for the platform of bootOpts: its overlays of run.yaml
+// apply and paths of the package that are only uploaded for some targets are
+// uploaded only if they are listed for one of the targets of the platform.
+func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pullMissing, locked bool,
+	packageDir, appName string, fs, loader string, bootOpts *BootOptions) error {
+	if err := util.ValidateFilesystem(fs); err != nil {
+		return err
+	}
+	if fs == "" {
+		fs = util.FilesystemZFS
+	}
 
 	// Package content should be collected in a subdirectory called mpm-pkg.
 	targetPath := filepath.Join(packageDir, "mpm-pkg")
@@ -168,8 +222,33 @@ func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pu
 		return err
 	}
 
+	// Run the build steps of the package before its content is collected.
+	pkg, err := core.ParsePackageManifest(filepath.Join(packageDir, "meta", "package.yaml"))
+	if err != nil {
+		return err
+	}
+	hookEnv := composeHookEnv(repo, packageDir, appName, bootOpts.platform().Profile)
+	if err := runHooks("pre_compose", pkg.Hooks.PreCompose, packageDir, hookEnv); err != nil {
+		return err
+	}
+
 	// First, collect the contents of the package.
-	if err := CollectPackage(repo, packageDir, pullMissing, bootOpts.Boot, verbose); err != nil {
+	if err := CollectPackage(repo, packageDir, pullMissing, locked, bootOpts.Boot, bootOpts.platform(), verbose); err != nil {
+		return err
+	}
+	if fs == util.FilesystemROFS {
+		if err := warnReadOnlyRoot(packageDir, bootOpts.platform()); err != nil {
+			return err
+		}
+	}
+
+	// The loader version given on command line takes precedence over the one
+	// in package.yaml.
+	if loader == "" {
+		loader = pkg.Loader
+	}
+	loaderImage, err := composeLoader(repo, packageDir, fs, loader, pullMissing, locked)
+	if err != nil {
 		return err
 	}
 
@@ -179,6 +258,13 @@ func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pu
 		return err
 	}
 
+	// Parallel composes of the same image must not interleave their uploads.
+	lock, err := repo.LockImage(appName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	// Get the path of imported image.
 	imagePath := repo.ImagePath("qemu", appName)
 	// Check whether the image already exists.
@@ -190,12 +276,24 @@ func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pu
 	imageCachePath := repo.ImageCachePath("qemu", appName)
 	var imageCache core.HashCache
 
-	// If the user requested new image or requested to update a non-existent image,
-	// initialize it first.
-	if !updatePackage || !imageExists {
+	// ROFS can not be updated, hence images with ROFS are always composed anew,
+	// just like images that change their filesystem or loader.
+	if updatePackage && imageExists && (fs == util.FilesystemROFS || repo.ImageFilesystem(appName) != fs ||
+		!repo.ImageComposedFrom(appName, loaderImage)) {
+		updatePackage = false
+	}
+
+	if fs == util.FilesystemROFS {
+		// ROFS is written on the host along with the image.
+		if err := initializeROFSImage(repo, loaderImage, appName, paths); err != nil {
+			return fmt.Errorf("Failed to initialize ROFS image named %s.\nError was: %s", appName, err)
+		}
+	} else if !updatePackage || !imageExists {
+		// If the user requested new image or requested to update a non-existent image,
+		// initialize it first.
 		// Initialize an empty image based on the provided loader image. imageSize is used to
-		// determine the size of the user partition. Use default loader image.
-		if err := repo.InitializeImage("", appName, imageSize); err != nil {
+		// determine the size of the user partition.
+		if err := repo.InitializeImage(loaderImage, appName, imageSize); err != nil {
 			return fmt.Errorf("Failed to initialize empty image named %s.\nError was: %s", appName, err)
 		}
 	} else {
@@ -205,14 +303,22 @@ func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pu
 		imageCache, _ = core.ParseHashCache(imageCachePath)
 	}
 
-	// Upload the specified path onto virtual image.
-	imageCache, err = UploadPackageContents(repo, imagePath, paths, imageCache, verbose)
-	if err != nil {
-		return err
+	// Upload the specified path onto virtual image, files of ROFS have been
+	// written along with it.
+	if fs != util.FilesystemROFS {
+		imageCache, err = UploadPackageContents(repo, imagePath, paths, imageCache, verbose)
+		if err != nil {
+			return err
+		}
+
+		// Save the new image cache
+		imageCache.WriteToFile(imageCachePath)
 	}
 
-	// Save the new image cache
-	imageCache.WriteToFile(imageCachePath)
+	// Save the list of files for 'capstan package contents'.
+	if err := storeImageContents(repo, appName, paths, updatePackage && imageExists); err != nil {
+		return err
+	}
 
 	// Set the command line.
 	if err = util.SetCmdLine(imagePath, commandLine); err != nil {
@@ -220,28 +326,205 @@ func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pu
 	}
 	fmt.Printf("Command line set to: '%s'\n", commandLine)
 
+	// Save health check, restart policy and resources for 'capstan run'.
+	if err := storeImageRunSettings(repo, appName, packageDir, bootOpts); err != nil {
+		return err
+	}
+	if err := repo.SetImageCPUFeatures(appName, pkg.CPUFeatures); err != nil {
+		return err
+	}
+
+	digest, err := ContentDigest(paths)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Content digest: %s\n", digest)
+
+	return runHooks("post_compose", pkg.Hooks.PostCompose, packageDir, hookEnv)
+}
+
+// warnReadOnlyRoot warns about config sets of the package that may fail to run
+// from the read-only root filesystem of ROFS images.
+func warnReadOnlyRoot(packageDir string, platform runtime.Platform) error {
+	cmdConf, err := runtime.ParsePackageRunManifestFor(packageDir, platform)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range cmdConf.ConfigSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, problem := range runtime.ReadOnlyRootProblems(cmdConf.ConfigSets[name]) {
+			fmt.Printf("WARNING: config set '%s' %s, but the root filesystem is read-only\n", name, problem)
+		}
+	}
+	return nil
+}
+
+// storeImageRunSettings stores the list of config sets of the package and
+// supervision settings, resources, secret definitions and boot command
+// accepting additional arguments of the config set that the image boots. Stale
+// settings are removed when no such config set is used. Settings are stored for
+// the hypervisor the image is composed for, which 'capstan run' reads them for.
+func storeImageRunSettings(repo *util.Repo, appName, packageDir string, bootOpts *BootOptions) error {
+	platform := bootOpts.platform()
+	configSetsPath := repo.ImageConfigSetsPath(platform.Hypervisor, appName)
+	supervisionPath := repo.ImageSupervisionPath(platform.Hypervisor, appName)
+	resourcesPath := repo.ImageResourcesPath(platform.Hypervisor, appName)
+	secretsPath := repo.ImageSecretsPath(platform.Hypervisor, appName)
+	argsCmdPath := repo.ImageArgsCmdPath(platform.Hypervisor, appName)
+	os.Remove(configSetsPath)
+	os.Remove(supervisionPath)
+	os.Remove(resourcesPath)
+	os.Remove(secretsPath)
+	os.Remove(argsCmdPath)
+
+	cmdConf, err := runtime.ParsePackageRunManifestFor(packageDir, platform)
+	if os.IsNotExist(err) {
+		// Packages without meta/run.yaml have no config sets.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Image boots the config set unless the command line is given directly.
+	name := ""
+	if bootOpts.Cmd == "" {
+		name = bootOpts.Boot
+		if name == "" {
+			name = cmdConf.ConfigSetDefault
+		}
+	}
+
+	configSets, err := cmdConf.ListConfigSets(name)
+	if err != nil {
+		return err
+	}
+	if err := configSets.WriteToFile(configSetsPath); err != nil {
+		return err
+	}
+	if name == "" {
+		return nil
+	}
+	// Config set may also belong to one of the required packages.
+	conf, ok := cmdConf.ConfigSets[name]
+	if !ok {
+		if conf, err = requiredConfigSet(repo, packageDir, name, platform); err != nil {
+			return err
+		}
+	}
+
+	if supervision := conf.GetSupervision(); !supervision.IsEmpty() {
+		if err := supervision.WriteToFile(supervisionPath); err != nil {
+			return err
+		}
+	}
+	if resources := conf.GetResources(); !resources.IsEmpty() {
+		if err := resources.WriteToFile(resourcesPath); err != nil {
+			return err
+		}
+	}
+	if secrets := conf.GetSecrets(); len(secrets) > 0 {
+		if err := secrets.Absolute(packageDir).WriteToFile(secretsPath); err != nil {
+			return err
+		}
+	}
+	// Arguments cannot be appended once post_boot hooks follow the command.
+	if argsConf, ok := conf.(runtime.ArgsRuntime); ok && len(conf.GetHooks().PostBoot) == 0 {
+		argsCmd, err := argsConf.GetBootCmdWithArgs(nil)
+		if err != nil {
+			return err
+		}
+		argsCmd = conf.GetHooks().Apply(argsCmd, name)
+		kernelOpts := append(conf.GetBootOpts(), bootOpts.BootOpts...)
+		if argsCmd, err = kernelOpts.Apply(argsCmd); err != nil {
+			return err
+		}
+		// Environment variables given on command line are part of the boot command.
+		if argsCmd, err = bootOpts.prependEnv(argsCmd); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(argsCmdPath, []byte(argsCmd), 0644); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// requiredConfigSet looks up the config set <package>-<config_set> among the
+// packages that capstan.lock records for the package.
+func requiredConfigSet(repo *util.Repo, packageDir, name string, platform runtime.Platform) (runtime.Runtime, error) {
+	lock, err := core.ParseLockFile(filepath.Join(packageDir, core.LockFileName))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range lock.Packages {
+		prefix := runtime.PackageConfigSet(p.Name, "")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		reader, err := repo.GetPackageTarReader(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		reqConf, err := extractPackageContent(reader, "", p.Name, platform)
+		if err != nil {
+			return nil, err
+		}
+		if reqConf == nil {
+			continue
+		}
+		if conf, ok := reqConf.ConfigSets[strings.TrimPrefix(name, prefix)]; ok {
+			return conf, nil
+		}
+	}
+	return nil, fmt.Errorf("config set '%s' is defined neither by the package nor by its required packages", name)
+}
+
 // CollectPackage will try to resolve all of the dependencies of the given package
-// and collect the content in the $CWD/mpm-pkg directory.
-func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, customBoot string, verbose bool) error {
+// and collect the content in the $CWD/mpm-pkg directory. Resolved packages are
+// recorded in capstan.lock, unless locked is set in which case they must match
+// the recorded ones. Overlays of run.yaml are resolved for the given platform
+// and paths listed under targets in package.yaml are collected only for its
+// targets.
+func CollectPackage(repo *util.Repo, packageDir string, pullMissing, locked bool, customBoot string, platform runtime.Platform, verbose bool) error {
 	// Get the manifest file of the given package.
 	pkg, err := core.ParsePackageManifest(filepath.Join(packageDir, "meta", "package.yaml"))
 	if err != nil {
 		return err
 	}
+	if err := pkg.ResolveLocalRequirements(packageDir); err != nil {
+		return err
+	}
 
 	genRuntime, err := runtime.PackageRunManifestGeneral(filepath.Join(packageDir, "meta", "run.yaml"))
 	if err != nil {
 		return err
 	}
 
-	// If runtime is known, then we add runtime dependencies to the list.
-	if genRuntime != nil && len(genRuntime.GetDependencies()) > 0 {
-		fmt.Printf("Prepending '%s' runtime dependencies to dep list: %s\n",
-			genRuntime.GetRuntimeName(), genRuntime.GetDependencies())
-		pkg.Require = append(genRuntime.GetDependencies(), pkg.Require...)
+	// If runtime is known, then we add runtime dependencies of all config sets to the list.
+	var cmdConf *runtime.CmdConfig
+	if genRuntime != nil {
+		if cmdConf, err = runtime.ParsePackageRunManifestFor(packageDir, platform); err != nil {
+			return err
+		}
+		if deps := cmdConf.GetDependencies(); len(deps) > 0 {
+			fmt.Printf("Prepending '%s' runtime dependencies to dep list: %s\n",
+				genRuntime.GetRuntimeName(), deps)
+			if err := checkRuntimePackages(repo, genRuntime.GetRuntimeName(), deps, pullMissing); err != nil {
+				return err
+			}
+			pkg.Require = append(deps, pkg.Require...)
+		}
+	}
+
+	if err := checkProfile(pkg, cmdConf, platform.Profile); err != nil {
+		return err
 	}
 
 	// The bootstrap package is implicitly required by every application package,
@@ -249,9 +532,23 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 	// the bootstrap manually, this will not result in overhead.
 	pkg.Require = append(pkg.Require, "osv.bootstrap")
 
-	// Look for all dependencies and make sure they are all available in the repository.
-	requiredPackages, err := repo.GetPackageDependencies(pkg, pullMissing)
-	if err != nil {
+	// Look for all dependencies and make sure they are all available in the
+	// repository. Locked packages are checked before any of them is pulled.
+	var requiredPackages []core.Package
+	if locked {
+		lock, err := readLockFile(packageDir)
+		if err != nil {
+			return err
+		}
+		requiredPackages, err = repo.GetLockedPackageDependencies(pkg, pullMissing, lock)
+		if err != nil {
+			return err
+		}
+	} else if requiredPackages, err = repo.GetPackageDependencies(pkg, pullMissing); err != nil {
+		return err
+	}
+
+	if err := lockPackages(repo, packageDir, requiredPackages, locked); err != nil {
 		return err
 	}
 
@@ -268,17 +565,35 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 		return err
 	}
 
-	// First collect everything from the required packages.
+	// First collect everything from the required packages. Config sets of
+	// required packages are kept by their bases, i.e. <package>:<config_set>,
+	// since config sets may be based on config sets of other packages.
+	baseSets := make(map[string]runtime.Runtime)
+	var requiredConfs []*runtime.CmdConfig
 	for _, req := range requiredPackages {
 		reader, err := repo.GetPackageTarReader(req.Name)
 		if err != nil {
 			return err
 		}
 
-		err = extractPackageContent(reader, targetPath, req.Name)
+		reqConf, err := extractPackageContent(reader, targetPath, req.Name, platform)
 		if err != nil {
 			return err
 		}
+		requiredConfs = append(requiredConfs, reqConf)
+		if reqConf != nil {
+			for name, conf := range reqConf.ConfigSets {
+				baseSets[req.Name+":"+name] = conf
+			}
+		}
+	}
+	for i, reqConf := range requiredConfs {
+		if reqConf == nil {
+			continue
+		}
+		if err := persistBootCmdsIntoFiles(reqConf, targetPath, "", requiredPackages[i].Name, baseSets); err != nil {
+			return err
+		}
 	}
 
 	// Read .capstanignore if exists.
@@ -294,9 +609,44 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 		return err
 	}
 
+	// With .capstaninclude only the listed paths are uploaded.
+	capstanincludePath := filepath.Join(packageDir, core.CapstanincludeFileName)
+	if _, err := os.Stat(capstanincludePath); err == nil {
+		if err := capstanignore.LoadIncludeFile(capstanincludePath); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", core.CapstanincludeFileName, err)
+		}
+	}
+
+	// Ignore what the selected profile ignores, after .capstanignore so that
+	// profiles can also re-include its paths.
+	if profile := platform.Profile; profile != "" {
+		for _, pattern := range pkg.Profiles[profile].Ignore {
+			if err := capstanignore.AddPattern(pattern); err != nil {
+				return fmt.Errorf("invalid ignore pattern '%s' of profile '%s': %s", pattern, profile, err)
+			}
+		}
+	}
+
+	// Ignore paths that are only uploaded for other targets.
+	if err := pkg.AddTargetPatterns(capstanignore, platform.SelectedTargets()); err != nil {
+		return err
+	}
+
+	// Real paths of the package directory and of directories whose symbolic
+	// links are being followed, to detect cycles.
+	realPackageDir, err := filepath.EvalSymlinks(packageDir)
+	if err != nil {
+		return err
+	}
+	following := []string{realPackageDir}
+
+	// Files are copied by a pool of workers while the tree is being walked.
+	jobs := newFileJobs()
+
 	// Now we need to append the content of the current package into the target directory.
 	// This should override any file from the required packages.
-	err = filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
+	var collect filepath.WalkFunc
+	collect = func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -311,16 +661,18 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 			}
 		}
 
-		relPath := strings.TrimPrefix(path, packageDir)
+		// Content of followed directory links is walked from the link path with
+		// a trailing slash.
+		relPath := strings.TrimSuffix(strings.TrimPrefix(path, packageDir), string(filepath.Separator))
 
 		// Apply meta/run.yaml before ignoring it.
 		if relPath == "/meta/run.yaml" {
 			// Prepare files with boot commands.
-			data, err := ioutil.ReadFile(path)
+			cmdConf, err := runtime.ParsePackageRunManifestFor(packageDir, platform)
 			if err != nil {
 				return err
 			}
-			if err := persistBootCmdsIntoFiles(data, targetPath, customBoot, ""); err != nil {
+			if err := persistBootCmdsIntoFiles(cmdConf, targetPath, customBoot, "", baseSets); err != nil {
 				return err
 			}
 			return nil
@@ -330,6 +682,10 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 
 		// Ignore what needs to be ignored.
 		if capstanignore.IsIgnored(relPath) {
+			// Look for included paths beneath the folder without uploading the folder itself.
+			if info.IsDir() && capstanignore.MayIncludeBeneath(relPath) {
+				return nil
+			}
 			if verbose {
 				suffix := ""
 				if info.IsDir() {
@@ -343,21 +699,69 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 			return nil
 		}
 
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			switch pkg.Symlinks {
+			case core.SymlinksError:
+				return fmt.Errorf("symbolic link %s is not allowed by symlinks policy '%s'", relPath, pkg.Symlinks)
+
+			case core.SymlinksFollow:
+				target, err := os.Stat(path)
+				if err != nil {
+					return fmt.Errorf("failed to follow symbolic link %s: %s", relPath, err)
+				}
+				if !target.IsDir() {
+					// Copy content of the linked file.
+					info = target
+					break
+				}
+
+				realTarget, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return err
+				}
+				realParent, err := filepath.EvalSymlinks(filepath.Dir(path))
+				if err != nil {
+					return err
+				}
+				if err := checkSymlinkCycle(relPath, realTarget, append(following, realParent)); err != nil {
+					return err
+				}
+				following = append(following, realTarget)
+				err = filepath.Walk(path+string(filepath.Separator), collect)
+				following = following[:len(following)-1]
+				return err
+			}
+		}
+
 		switch {
 		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+			if err := ensureDirectoryStructureForFile(filepath.Join(targetPath, relPath)); err != nil {
+				return err
+			}
 			return os.Symlink(link, filepath.Join(targetPath, relPath))
 
 		case info.IsDir():
 			return os.MkdirAll(filepath.Join(targetPath, relPath), info.Mode())
 
 		case info.Mode().IsRegular():
-			return util.CopyLocalFile(filepath.Join(targetPath, relPath), path)
+			if err := ensureDirectoryStructureForFile(filepath.Join(targetPath, relPath)); err != nil {
+				return err
+			}
+			jobs.Go(func() error {
+				return util.CopyLocalFile(filepath.Join(targetPath, relPath), path)
+			})
+			return nil
 
 		default:
 			return fmt.Errorf("File %s has unsupported mode %v", path, info.Mode())
 		}
-	})
-
+	}
+	err = filepath.Walk(packageDir, collect)
+	// Wait for the copies even if walking failed, nothing may be written into
+	// the target directory after returning.
+	if jobsErr := jobs.Wait(); err == nil {
+		err = jobsErr
+	}
 	if err != nil {
 		return err
 	}
@@ -366,8 +770,125 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 		if err := genRuntime.OnCollect(targetPath); err != nil {
 			return err
 		}
+
+		for name, conf := range cmdConf.ConfigSets {
+			if collectRuntime, ok := conf.(runtime.CollectRuntime); ok {
+				if err := collectRuntime.OnCollectPackage(packageDir, targetPath); err != nil {
+					return fmt.Errorf("failed to collect configuration set '%s': %s", name, err)
+				}
+			}
+		}
+	}
+
+	// Identical files of the package and required packages are uploaded once.
+	if pkg.Dedup {
+		count, saved, err := deduplicateFiles(targetPath)
+		if err != nil {
+			return err
+		}
+		reportDeduplication(count, saved)
+	}
+
+	return nil
+}
+
+// checkSymlinkCycle returns an error if following the symbolic link to the
+// directory with the given real path would never end, because the directory
+// contains the link itself, the package directory or a directory being
+// followed already.
+func checkSymlinkCycle(relPath, realTarget string, following []string) error {
+	for _, dir := range following {
+		if dir == realTarget || strings.HasPrefix(dir, realTarget+string(filepath.Separator)) {
+			return fmt.Errorf("symbolic link %s points to %s, which results in a cycle", relPath, realTarget)
+		}
 	}
+	return nil
+}
+
+// lockPackages records versions and hashes of the resolved packages into
+// capstan.lock of the package. When locked is set, the lockfile must exist and
+// the resolved packages must match it instead.
+func lockPackages(repo *util.Repo, packageDir string, packages []core.Package, locked bool) error {
+	lock := core.LockFile{}
+	seen := make(map[string]bool)
+	for _, p := range packages {
+		if seen[p.Name] {
+			continue
+		}
+		seen[p.Name] = true
+
+		hash, err := repo.PackageHash(p.Name)
+		if err != nil {
+			return err
+		}
+		lock.Packages = append(lock.Packages, core.LockedPackage{Name: p.Name, Version: p.Version, Hash: hash})
+	}
+
+	lockPath := filepath.Join(packageDir, core.LockFileName)
+	if !locked {
+		// The loader is recorded when the package is composed.
+		if existing, err := core.ParseLockFile(lockPath); err == nil {
+			lock.Loader = existing.Loader
+		}
+		return lock.WriteToFile(lockPath)
+	}
+
+	existing, err := readLockFile(packageDir)
+	if err != nil {
+		return err
+	}
+	if diff := existing.Diff(lock); len(diff) > 0 {
+		return fmt.Errorf("Resolved packages differ from %s:\n  %s", core.LockFileName, strings.Join(diff, "\n  "))
+	}
+	return nil
+}
+
+// readLockFile reads capstan.lock of the package that is composed with
+// --locked.
+func readLockFile(packageDir string) (core.LockFile, error) {
+	lock, err := core.ParseLockFile(filepath.Join(packageDir, core.LockFileName))
+	if os.IsNotExist(err) {
+		return lock, fmt.Errorf("%s not found, compose the package without --locked to create it", core.LockFileName)
+	}
+	return lock, err
+}
+
+// checkRuntimePackages makes sure that packages required by the runtime (e.g.
+// the selected NodeJS version) are available before anything is collected.
+func checkRuntimePackages(repo *util.Repo, runtimeName string, deps []string, pullMissing bool) error {
+	for _, dep := range deps {
+		// Versions are checked once all required packages are resolved.
+		req, err := core.ParseRequirement(dep)
+		if err != nil {
+			return err
+		}
+		dep := req.Name
+		if repo.PackageExists(dep) {
+			continue
+		}
+		if pullMissing {
+			if url, err := repo.FindRemotePackage(dep); err == nil && url != "" {
+				continue
+			}
+		}
 
+		msg := fmt.Sprintf("Package %s required by '%s' runtime is not available", dep, runtimeName)
+		if i := strings.LastIndex(dep, "-"); i > 0 {
+			var available []string
+			for _, name := range repo.LocalPackageNames() {
+				if strings.HasPrefix(name, dep[:i+1]) {
+					available = append(available, name)
+				}
+			}
+			if len(available) > 0 {
+				msg += fmt.Sprintf(" (available locally: %s)", strings.Join(available, ", "))
+			}
+		}
+		if !pullMissing {
+			msg += ". Pull it manually using 'capstan package pull " + dep + "' or add --pull-missing flag"
+		}
+		return fmt.Errorf("%s", msg)
+	}
 	return nil
 }
 
@@ -402,6 +923,13 @@ func ImportPackage(repo *util.Repo, packageDir string) error {
 	if err != nil {
 		return err
 	}
+	// Required workspace members are recorded by their names.
+	if err := pkg.ResolveLocalRequirements(packageDir); err != nil {
+		return err
+	}
+	if pkg.Runtime == "" {
+		pkg.Runtime = packageRuntime(packageDir)
+	}
 
 	defer os.Remove(packagePath)
 
@@ -409,7 +937,115 @@ func ImportPackage(repo *util.Repo, packageDir string) error {
 	return repo.ImportPackage(pkg, packagePath)
 }
 
-func extractPackageContent(tarReader *tar.Reader, target, pkgName string) error {
+// packageRuntime returns the runtime of meta/run.yaml of the package or an
+// empty string if the package has no run configuration.
+func packageRuntime(packageDir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(packageDir, "meta", "run.yaml"))
+	if err != nil {
+		return ""
+	}
+
+	var run struct {
+		Runtime string `yaml:"runtime"`
+	}
+	if err := yaml.Unmarshal(data, &run); err != nil {
+		return ""
+	}
+	return run.Runtime
+}
+
+// ExportPackage writes the package from the local repository into target
+// file, optionally compressed with xz or zstd. Empty target means the package
+// is exported into the current directory.
+func ExportPackage(repo *util.Repo, packageName, target, compression string) error {
+	packagePath := repo.PackagePath(packageName)
+	if _, err := os.Stat(packagePath); os.IsNotExist(err) {
+		return fmt.Errorf("%s: no such package", packageName)
+	}
+
+	ext, err := util.CompressionExtension(compression)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		target = packageName + ".mpm" + ext
+	}
+
+	fmt.Printf("Exporting package %s into %s...\n", packageName, target)
+	return util.CompressFile(packagePath, target, compression)
+}
+
+// ImportPackageFile imports the package file (that may be compressed with xz
+// or zstd) into the local repository.
+func ImportPackageFile(repo *util.Repo, packageFile string) error {
+	tmp, err := ioutil.TempDir("", "capstan-import")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	packagePath := filepath.Join(tmp, "package.mpm")
+	if err := util.DecompressFile(packageFile, packagePath); err != nil {
+		return err
+	}
+
+	pkg, err := readPackageManifest(packagePath)
+	if err != nil {
+		return err
+	}
+
+	// Package is stored in the repository under its name.
+	target := filepath.Join(tmp, pkg.Name+".mpm")
+	if err := os.Rename(packagePath, target); err != nil {
+		return err
+	}
+
+	return repo.ImportPackage(pkg, target)
+}
+
+// readPackageManifest reads meta/package.yaml from the package file.
+func readPackageManifest(packagePath string) (core.Package, error) {
+	var pkg core.Package
+
+	f, err := os.Open(packagePath)
+	if err != nil {
+		return pkg, err
+	}
+	defer f.Close()
+
+	gzReader, err := gzip.NewReader(f)
+	if err != nil {
+		return pkg, fmt.Errorf("%s: not a package file: %s", packagePath, err)
+	}
+	tarReader := tar.NewReader(gzReader)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return pkg, fmt.Errorf("%s: package manifest meta/package.yaml is missing", packagePath)
+		} else if err != nil {
+			return pkg, err
+		}
+
+		if absTarPathMatches(header.Name, "/meta/package.yaml") {
+			data, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return pkg, err
+			}
+			err = pkg.Parse(data)
+			return pkg, err
+		}
+	}
+}
+
+// extractPackageContent extracts content of the required package into the
+// target directory and returns its parsed meta/run.yaml, if any. Nothing is
+// extracted when target is empty.
+func extractPackageContent(tarReader *tar.Reader, target, pkgName string, platform runtime.Platform) (*runtime.CmdConfig, error) {
+	// Run configuration is parsed once the whole package is read, since its
+	// values may follow run.yaml.
+	var runData []byte
+	values := runtime.Values{}
 	for {
 		header, err := tarReader.Next()
 		if err != nil {
@@ -417,31 +1053,49 @@ func extractPackageContent(tarReader *tar.Reader, target, pkgName string) error
 				// Have we reached till the end of the tar?
 				break
 			}
-			return err
+			return nil, err
 		}
 
 		if absTarPathMatches(header.Name, "/meta/run.yaml") {
-			// Prepare files with boot commands for this package.
+			if runData, err = ioutil.ReadAll(tarReader); err != nil {
+				return nil, err
+			}
+			continue
+		} else if absTarPathMatches(header.Name, "/meta/values.yaml") {
 			data, err := ioutil.ReadAll(tarReader)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			if err := persistBootCmdsIntoFiles(data, target, "", pkgName); err != nil {
-				return err
+			if values, err = runtime.ParseValues(data); err != nil {
+				return nil, fmt.Errorf("failed to parse meta/values.yaml of package %s: %s", pkgName, err)
 			}
 			continue
 		} else if absTarPathMatches(header.Name, "/meta/.*") {
 			// Skip other manifest data
 			continue
+		} else if target == "" {
+			// Only the run configuration is read.
+			continue
 		}
 
 		path := filepath.Join(target, header.Name)
 		info := header.FileInfo()
 
+		// Hard links of deduplicated packages are extracted as copies.
+		if header.Typeflag == tar.TypeLink {
+			if err := ensureDirectoryStructureForFile(path); err != nil {
+				return nil, fmt.Errorf("Could not prepare directory structure for %s: %s", path, err)
+			}
+			if err := util.CopyLocalFile(path, filepath.Join(target, header.Linkname)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		switch {
 		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
 			if err := ensureDirectoryStructureForFile(path); err != nil {
-				return fmt.Errorf("Could not prepare directory structure for %s: %s", path, err)
+				return nil, fmt.Errorf("Could not prepare directory structure for %s: %s", path, err)
 			}
 
 			// Create symbolic link. Ignore any error that might occur locally as
@@ -450,40 +1104,54 @@ func extractPackageContent(tarReader *tar.Reader, target, pkgName string) error
 
 		case info.IsDir():
 			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
+				return nil, err
 			}
 
 		case info.Mode().IsRegular():
 			if err := ensureDirectoryStructureForFile(path); err != nil {
-				return fmt.Errorf("Could not prepare directory structure for %s: %s", path, err)
+				return nil, fmt.Errorf("Could not prepare directory structure for %s: %s", path, err)
 			}
 
 			writer, err := os.Create(path)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			_, err = io.Copy(writer, tarReader)
 			err = os.Chmod(path, os.FileMode(header.Mode))
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			writer.Close()
 
 		default:
-			return fmt.Errorf("File %s has unsupported mode %v", path, info.Mode())
+			return nil, fmt.Errorf("File %s has unsupported mode %v", path, info.Mode())
 		}
 	}
 
-	return nil
+	if runData == nil {
+		return nil, nil
+	}
+	// Env files of required packages are not available, only their env is used.
+	return runtime.ParsePackageRunManifestDataFor(runData, platform, values)
 }
 
-// PullPackage looks for the package in remote repository and tries to import
-// it into local repository.
+// PullPackage looks for the package in remote repositories and tries to import
+// it into local repository from the first one that provides it.
 func PullPackage(r *util.Repo, packageName string) error {
+	url, err := r.FindRemotePackage(packageName)
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		return fmt.Errorf("package %s is not available in the given repositories (%s)",
+			packageName, strings.Join(r.RemoteURLs(), ", "))
+	}
+
 	// Try to download the package from the remote repository.
-	return r.DownloadPackage(r.URL, packageName)
+	fmt.Printf("Pulling package %s from %s\n", packageName, url)
+	return r.DownloadPackage(url, packageName)
 }
 
 // ensureDirectoryStructureForFile creates directory path for given filepath.
@@ -611,14 +1279,12 @@ func DescribePackage(repo *util.Repo, packageName string) (string, error) {
 }
 
 // persistBootCmdsIntoFiles iterates configuration sets and generates bootcmd file for each.
-// These files can then be used by OSv bootloader to run thread based on --boot parameter.
-// Argument mpmFolder should point to the root of the OSv i.e. mpm-pkg folder. Prefix is used to
-// prefix 'default' configuration filename. E.g. prefix "abc" results in filename /run/abc-default.
-func persistBootCmdsIntoFiles(runYamlData []byte, mpmFolder, customBoot string, prefix string) error {
-	cmdConf, err := runtime.ParsePackageRunManifestData(runYamlData)
-	if err != nil {
-		return err
-	}
+// Config sets of the required package pkgName are additionally stored as
+// /run/<pkg>-<config_set> so that they cannot collide with equally named config
+// sets of other packages; pkgName is empty for the application itself. Bases
+// are looked up in baseSets, config sets of all required packages keyed by
+// <package>:<config_set>.
+func persistBootCmdsIntoFiles(cmdConf *runtime.CmdConfig, mpmFolder, customBoot string, pkgName string, baseSets map[string]runtime.Runtime) error {
 
 	// Prepare folder to store bootcmd files in.
 	targetFolder := filepath.Join(mpmFolder, "run")
@@ -637,17 +1303,48 @@ func persistBootCmdsIntoFiles(runYamlData []byte, mpmFolder, customBoot string,
 			return fmt.Errorf("Validation failed for configuration set '%s': %s", confName, err)
 		}
 
+		// Environment of the bases is set before any of their commands run.
+		baseName := confName
+		if pkgName != "" {
+			baseName = pkgName + ":" + confName
+		}
+		if err := inheritBaseEnv(baseName, currConf, baseSets, map[string]bool{}); err != nil {
+			return fmt.Errorf("Validation failed for configuration set '%s': %s", confName, err)
+		}
+
 		// Calculate boot command.
 		bootCmd, err := currConf.GetBootCmd()
 		if err != nil {
 			return err
 		}
 
-		// Persist to file.
-		cmdFile := filepath.Join(targetFolder, confName)
-		if err := ioutil.WriteFile(cmdFile, []byte(bootCmd), 0775); err != nil {
+		scriptName := confName
+		if pkgName != "" {
+			scriptName = runtime.PackageConfigSet(pkgName, confName)
+		}
+
+		// Commands chained in bootcmd and hooks are run from their own
+		// runscripts.
+		if bootCmd, err = runtime.WriteChainScript(currConf, bootCmd, targetFolder, scriptName); err != nil {
 			return err
 		}
+		if hooks := currConf.GetHooks(); !hooks.IsEmpty() {
+			if err := hooks.WriteScripts(targetFolder, scriptName); err != nil {
+				return err
+			}
+			bootCmd = hooks.Apply(bootCmd, scriptName)
+		}
+
+		// Persist to file.
+		cmdFiles := []string{filepath.Join(targetFolder, confName)}
+		if scriptName != confName {
+			cmdFiles = append(cmdFiles, filepath.Join(targetFolder, scriptName))
+		}
+		for _, cmdFile := range cmdFiles {
+			if err := ioutil.WriteFile(cmdFile, []byte(bootCmd), 0775); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Argument --boot <name> has greater priority than config_set_default in meta/run.yaml
@@ -661,11 +1358,69 @@ func persistBootCmdsIntoFiles(runYamlData []byte, mpmFolder, customBoot string,
 	return nil
 }
 
+// inheritBaseEnv merges environment variables of the bases of the config set
+// named name into it, including those of the bases' own bases. Variables of
+// the config set itself take precedence, followed by those of earlier bases.
+// Bases must refer to config sets of required packages and must not form a
+// cycle.
+func inheritBaseEnv(name string, conf runtime.Runtime, baseSets map[string]runtime.Runtime, visiting map[string]bool) error {
+	if visiting[name] {
+		return fmt.Errorf("base '%s' is based on itself", name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	for _, base := range conf.GetBase() {
+		baseConf, ok := baseSets[base]
+		if !ok {
+			return fmt.Errorf("base '%s' not found in required packages", base)
+		}
+		if err := inheritBaseEnv(base, baseConf, baseSets, visiting); err != nil {
+			return err
+		}
+		conf.InheritEnv(baseConf.GetEnv())
+	}
+	return nil
+}
+
+// checkProfile makes sure that the selected build profile is defined either
+// in package.yaml or in one of the config sets of run.yaml, so that a typo in
+// the profile name does not go unnoticed.
+func checkProfile(pkg core.Package, cmdConf *runtime.CmdConfig, profile string) error {
+	if profile == "" {
+		return nil
+	}
+	if _, ok := pkg.Profiles[profile]; ok {
+		return nil
+	}
+	if cmdConf != nil && cmdConf.DefinesProfile(profile) {
+		return nil
+	}
+	return fmt.Errorf("profile '%s' is not defined in meta/package.yaml nor in meta/run.yaml", profile)
+}
+
 type BootOptions struct {
 	Cmd        string
 	Boot       string
 	EnvList    []string
 	PackageDir string
+	// BootOpts are presets of OSv kernel options given with --boot-opts,
+	// applied on top of those of the booted config set.
+	BootOpts runtime.BootOpts
+	// Platform is the platform that the image is composed for, the default
+	// one unless given.
+	Platform runtime.Platform
+}
+
+// platform returns the platform that the image is composed for.
+func (b *BootOptions) platform() runtime.Platform {
+	if b.Platform.Hypervisor == "" {
+		platform := runtime.DefaultPlatform()
+		platform.Profile = b.Platform.Profile
+		platform.Targets = b.Platform.Targets
+		return platform
+	}
+	return b.Platform
 }
 
 // GetCmd builds final bootcmd based on three parameters (in this order):
@@ -674,6 +1429,13 @@ type BootOptions struct {
 // * config_set_default: <> (read from meta/run.yaml within packageDir)
 func (b *BootOptions) GetCmd() (string, error) {
 	command := ""
+	// Config set that the image boots, if any.
+	configSet := ""
+
+	var cmdConf *runtime.CmdConfig
+	if b.PackageDir != "" {
+		cmdConf, _ = runtime.ParsePackageRunManifestFor(b.PackageDir, b.platform())
+	}
 
 	if b.Cmd != "" { // Direct commandLine has highest priority (--run <commandLine>).
 		fmt.Println("Command line will be set based on --run parameter")
@@ -681,28 +1443,42 @@ func (b *BootOptions) GetCmd() (string, error) {
 	} else if b.Boot != "" { // Configuration name has second-highest priority (--boot <customBoot>).
 		fmt.Println("Command line will be set based on --boot parameter")
 		command = runtime.BootCmdForScript(b.Boot)
+		configSet = b.Boot
 	} else if b.PackageDir != "" { // Default configuration in yaml has third-highest priority (config_set_default: <>).
-		if data, err := ioutil.ReadFile(filepath.Join(b.PackageDir, "meta", "run.yaml")); err == nil {
-			if cmdConf, err := runtime.ParsePackageRunManifestData(data); err == nil && cmdConf.ConfigSetDefault != "" {
-				fmt.Println("Command line will be set based on config_set_default attribute of meta/run.yaml")
-				command = runtime.BootCmdForScript(cmdConf.ConfigSetDefault)
-			}
+		if cmdConf != nil && cmdConf.ConfigSetDefault != "" {
+			fmt.Println("Command line will be set based on config_set_default attribute of meta/run.yaml")
+			command = runtime.BootCmdForScript(cmdConf.ConfigSetDefault)
+			configSet = cmdConf.ConfigSetDefault
 		}
 	} else { // Fallback is empty bootcmd.
 		fmt.Println("Empty command line will be set for this image")
 		command = ""
 	}
 
-	// Prepend environment variables to the command.
-	if env, err := util.ParseEnvironmentList(b.EnvList); err == nil {
-		if command, err = runtime.PrependEnvsPrefix(command, env, false); err != nil {
-			return "", err
+	// Kernel options of the booted config set come before those given with
+	// --boot-opts.
+	bootOpts := b.BootOpts
+	if cmdConf != nil && configSet != "" {
+		if conf, ok := cmdConf.ConfigSets[configSet]; ok {
+			bootOpts = append(conf.GetBootOpts(), bootOpts...)
 		}
-	} else {
+	}
+	command, err := bootOpts.Apply(command)
+	if err != nil {
 		return "", err
 	}
 
-	return command, nil
+	// Prepend environment variables to the command.
+	return b.prependEnv(command)
+}
+
+// prependEnv prepends environment variables given with --env to the command.
+func (b *BootOptions) prependEnv(command string) (string, error) {
+	env, err := util.ParseEnvironmentList(b.EnvList)
+	if err != nil {
+		return "", err
+	}
+	return runtime.PrependEnvsPrefix(command, env, false)
 }
 
 // absTarPathMatches tells whether the tar header name matches the path pattern.
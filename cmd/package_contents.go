@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// PackageEntry is a file, directory or link stored in the package.
+type PackageEntry struct {
+	Size int64
+	Mode os.FileMode
+	// Digest is the checksum of the content of a file or the target of a link.
+	Digest string
+}
+
+// ReadPackageContents lists entries of the package by their absolute paths
+// within the package. The package is either a package from the local
+// repository or a (possibly compressed) package file.
+func ReadPackageContents(repo *util.Repo, pkg string) (map[string]PackageEntry, error) {
+	var tarReader *tar.Reader
+	if repo.PackageExists(pkg) {
+		reader, err := repo.GetPackageTarReader(pkg)
+		if err != nil {
+			return nil, err
+		}
+		tarReader = reader
+	} else if _, err := os.Stat(pkg); err == nil {
+		tmp, err := ioutil.TempDir("", "capstan-contents")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+
+		packagePath := filepath.Join(tmp, "package.mpm")
+		if err := util.DecompressFile(pkg, packagePath); err != nil {
+			return nil, err
+		}
+		file, err := os.Open(packagePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader, err := util.PackageTarReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: not a package file: %s", pkg, err)
+		}
+		tarReader = reader
+	} else {
+		return nil, fmt.Errorf("%s: no such package or package file", pkg)
+	}
+
+	entries := make(map[string]PackageEntry)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		info := header.FileInfo()
+		entry := PackageEntry{Mode: info.Mode()}
+		switch {
+		case header.Typeflag == tar.TypeLink:
+			// Hard links of deduplicated packages share content of the linked file.
+			entry = entries[path.Clean("/"+header.Linkname)]
+		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+			entry.Digest = fmt.Sprintf("%x", sha256.Sum256([]byte(header.Linkname)))
+		case info.Mode().IsRegular():
+			hash := sha256.New()
+			if _, err := io.Copy(hash, tarReader); err != nil {
+				return nil, err
+			}
+			entry.Size = header.Size
+			entry.Digest = fmt.Sprintf("%x", hash.Sum(nil))
+		}
+		entries[name] = entry
+	}
+	return entries, nil
+}
+
+// PackageContents prints the tree of files stored in the package.
+func PackageContents(repo *util.Repo, pkg string, out io.Writer) error {
+	entries, err := ReadPackageContents(repo, pkg)
+	if err != nil {
+		return err
+	}
+
+	contents := core.NewImageContents()
+	for name, entry := range entries {
+		if entry.Mode.IsDir() {
+			contents[name] = core.DirectorySize
+		} else {
+			contents[name] = entry.Size
+		}
+	}
+	fmt.Fprint(out, contents.Tree())
+	return nil
+}
+
+// PackageDiff prints files that were added, removed or changed in package b
+// compared to package a. Both are either packages from the local repository
+// or package files.
+func PackageDiff(repo *util.Repo, a, b string, out io.Writer) error {
+	before, err := ReadPackageContents(repo, a)
+	if err != nil {
+		return err
+	}
+	after, err := ReadPackageContents(repo, b)
+	if err != nil {
+		return err
+	}
+
+	all := map[string]bool{}
+	for name := range before {
+		all[name] = true
+	}
+	for name := range after {
+		all[name] = true
+	}
+	var names []string
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var added, removed, changed int
+	for _, name := range names {
+		old, inBefore := before[name]
+		cur, inAfter := after[name]
+		switch {
+		case !inBefore:
+			fmt.Fprintf(out, "+ %s\n", describeEntry(name, cur))
+			added++
+		case !inAfter:
+			fmt.Fprintf(out, "- %s\n", describeEntry(name, old))
+			removed++
+		case old.Mode != cur.Mode:
+			fmt.Fprintf(out, "~ %s (mode %s -> %s)\n", name, old.Mode, cur.Mode)
+			changed++
+		case old.Digest != cur.Digest:
+			fmt.Fprintf(out, "~ %s (%d -> %d bytes)\n", name, old.Size, cur.Size)
+			changed++
+		}
+	}
+	fmt.Fprintf(out, "%d added, %d removed, %d changed\n", added, removed, changed)
+	return nil
+}
+
+func describeEntry(name string, entry PackageEntry) string {
+	switch {
+	case entry.Mode.IsDir():
+		return name + "/"
+	case entry.Mode&os.ModeSymlink == os.ModeSymlink:
+		return name + " (link)"
+	}
+	return fmt.Sprintf("%s (%d bytes)", name, entry.Size)
+}
@@ -8,14 +8,31 @@
 package cmd
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/image/qcow2"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/osv/api"
+	"github.com/mikelangelo-project/capstan/runtime"
 	"github.com/mikelangelo-project/capstan/util"
 
 	. "github.com/mikelangelo-project/capstan/testing"
@@ -108,7 +125,7 @@ func (*suite) TestComposeNonPackageFails(c *C) {
 	imageSize, _ := util.ParseMemSize("64M")
 	appName := "test-app"
 
-	err := ComposePackage(repo, imageSize, false, false, false, tmp, appName, &BootOptions{})
+	err := ComposePackage(repo, imageSize, false, false, false, false, tmp, appName, util.FilesystemZFS, "", &BootOptions{})
 
 	c.Assert(err, NotNil)
 }
@@ -129,7 +146,7 @@ func (*suite) TestComposeCorruptPackageFails(c *C) {
 	imageSize, _ := util.ParseMemSize("64M")
 	appName := "test-app"
 
-	err = ComposePackage(repo, imageSize, false, false, false, tmp, appName, &BootOptions{})
+	err = ComposePackage(repo, imageSize, false, false, false, false, tmp, appName, util.FilesystemZFS, "", &BootOptions{})
 	c.Assert(err, NotNil)
 }
 
@@ -193,6 +210,114 @@ func (s *suite) TestBuildPackage(c *C) {
 	c.Check(resultFile, TarGzEquals, s.packageFiles)
 }
 
+func (s *suite) TestBuildPackageReproducible(c *C) {
+	first, err := BuildPackage(s.packageDir)
+	c.Assert(err, IsNil)
+	firstData, err := ioutil.ReadFile(first)
+	c.Assert(err, IsNil)
+
+	// Modification times of the files must not affect the package.
+	past := time.Now().Add(-time.Hour)
+	for path := range s.packageFiles {
+		c.Assert(os.Chtimes(filepath.Join(s.packageDir, path), past, past), IsNil)
+	}
+
+	// This is what we're testing here.
+	second, err := BuildPackage(s.packageDir)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	secondData, err := ioutil.ReadFile(second)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(firstData, secondData), Equals, true)
+}
+
+func (s *suite) TestContentDigest(c *C) {
+	dir := c.MkDir()
+	PrepareFiles(dir, map[string]string{"/a.txt": "a", "/b/c.txt": "c"})
+	paths, err := collectDirectoryContents(dir)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	digest, err := ContentDigest(paths)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(digest, Matches, "sha256:[0-9a-f]{64}")
+
+	other := c.MkDir()
+	PrepareFiles(other, map[string]string{"/a.txt": "a", "/b/c.txt": "c"})
+	otherPaths, err := collectDirectoryContents(other)
+	c.Assert(err, IsNil)
+	otherDigest, err := ContentDigest(otherPaths)
+	c.Assert(err, IsNil)
+	c.Check(otherDigest, Equals, digest)
+
+	PrepareFiles(other, map[string]string{"/b/c.txt": "changed"})
+	otherDigest, err = ContentDigest(otherPaths)
+	c.Assert(err, IsNil)
+	c.Check(otherDigest, Not(Equals), digest)
+}
+
+func (s *suite) TestFileJobs(c *C) {
+	var mu sync.Mutex
+	done := 0
+	jobs := newFileJobs()
+
+	// This is what we're testing here.
+	for i := 0; i < 100; i++ {
+		i := i
+		jobs.Go(func() error {
+			mu.Lock()
+			done++
+			mu.Unlock()
+			if i%10 == 3 {
+				return fmt.Errorf("job %d failed", i)
+			}
+			return nil
+		})
+	}
+	err := jobs.Wait()
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "job [0-9]*3 failed")
+	c.Check(done, Equals, 100)
+}
+
+func (s *suite) TestRunHooks(c *C) {
+	env := composeHookEnv(s.repo, s.packageDir, "app", "prod")
+
+	// This is what we're testing here.
+	err := runHooks("pre_compose", []string{
+		"echo $CAPSTAN_IMAGE_NAME > hook.txt",
+		"echo $CAPSTAN_OUTPUT_DIR >> hook.txt",
+		"echo $CAPSTAN_PROFILE >> hook.txt",
+	}, s.packageDir, env)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(s.packageDir, "hook.txt"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "app\n"+filepath.Join(s.repo.RepoPath(), "app")+"\nprod\n")
+
+	err = runHooks("post_compose", []string{"exit 3", "touch never.txt"}, s.packageDir, env)
+	c.Check(err, ErrorMatches, "post_compose hook 'exit 3' failed: exit status 3")
+	_, err = os.Stat(filepath.Join(s.packageDir, "never.txt"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *suite) TestParsePackageHooks(c *C) {
+	var pkg core.Package
+
+	// This is what we're testing here.
+	err := pkg.Parse([]byte("name: app\ntitle: App\nauthor: a\nhooks:\n  pre_compose:\n    - go build\n  post_compose:\n    - ./publish.sh\n"))
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(pkg.Hooks.PreCompose, DeepEquals, []string{"go build"})
+	c.Check(pkg.Hooks.PostCompose, DeepEquals, []string{"./publish.sh"})
+}
+
 func (s *suite) TestDescribePackage(c *C) {
 	// Prepare
 	ImportPackage(s.repo, s.packageDir)
@@ -212,17 +337,66 @@ func (s *suite) TestRecursiveRunYamls(c *C) {
 	s.requireFakeDemoPkg(c)
 
 	// This is what we're testing here.
-	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
 
 	// Expectations.
 	c.Assert(err, IsNil)
 	expectedBoots := map[string]string{
-		"demoBoot1": "echo Demo1",
-		"demoBoot2": "echo Demo2",
+		"demoBoot1":           "echo Demo1",
+		"demoBoot2":           "echo Demo2",
+		"fake.demo-demoBoot1": "echo Demo1",
+		"fake.demo-demoBoot2": "echo Demo2",
 	}
 	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
 }
 
+func (s *suite) TestBootOpts(c *C) {
+	// Prepare.
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  debug:
+		    bootcmd: /app.so
+		    boot_opts:
+		      - verbose
+		      - trace=vfs*
+		  plain:
+		    bootcmd: /app.so
+		config_set_default: debug
+	`, c)
+
+	m := []struct {
+		comment  string
+		opts     BootOptions
+		expected string
+	}{
+		{"default config set", BootOptions{}, "--verbose --trace=vfs* runscript /run/debug"},
+		{"presets given on command line", BootOptions{BootOpts: []string{"verbose", "noshutdown"}},
+			"--verbose --trace=vfs* --noshutdown runscript /run/debug"},
+		{"config set without presets", BootOptions{Boot: "plain", BootOpts: []string{"--maxnic=2"}}, "--maxnic=2 runscript /run/plain"},
+		{"command line given directly", BootOptions{Cmd: "/cli.so", BootOpts: []string{"bootchart"}}, "--bootchart /cli.so"},
+		{"environment variables", BootOptions{EnvList: []string{"PORT=80"}, BootOpts: []string{"noshutdown"}},
+			"--env=PORT=80 --verbose --trace=vfs* --noshutdown runscript /run/debug"},
+	}
+	for _, tt := range m {
+		tt.opts.PackageDir = s.packageDir
+
+		// This is what we're testing here.
+		cmd, err := tt.opts.GetCmd()
+
+		// Expectations.
+		c.Assert(err, IsNil, Commentf(tt.comment))
+		c.Check(cmd, Equals, tt.expected, Commentf(tt.comment))
+	}
+
+	opts := BootOptions{Cmd: "/cli.so", BootOpts: []string{"trace"}}
+	_, err := opts.GetCmd()
+	c.Check(err, ErrorMatches, "boot preset 'trace' requires a value.*")
+	opts.BootOpts = []string{"fast"}
+	_, err = opts.GetCmd()
+	c.Check(err, ErrorMatches, "unknown boot preset 'fast'.*")
+}
+
 func (s *suite) TestRecursiveRunYamlsWithOwnRunYaml(c *C) {
 	// Prepare.
 	s.importFakeOSvBootstrapPkg(c)
@@ -236,14 +410,16 @@ func (s *suite) TestRecursiveRunYamlsWithOwnRunYaml(c *C) {
 	`, c)
 
 	// This is what we're testing here.
-	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
 
 	// Expectations.
 	c.Assert(err, IsNil)
 	expectedBoots := map[string]string{
-		"demoBoot1": "echo Demo1",
-		"demoBoot2": "echo Demo2",
-		"ownBoot":   "echo MyBoot",
+		"demoBoot1":           "echo Demo1",
+		"demoBoot2":           "echo Demo2",
+		"fake.demo-demoBoot1": "echo Demo1",
+		"fake.demo-demoBoot2": "echo Demo2",
+		"ownBoot":             "echo MyBoot",
 	}
 	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
 }
@@ -261,13 +437,15 @@ func (s *suite) TestRecursiveRunYamlsWithOwnRunYamlOverwrite(c *C) {
 	`, c)
 
 	// This is what we're testing here.
-	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
 
 	// Expectations.
 	c.Assert(err, IsNil)
 	expectedBoots := map[string]string{
-		"demoBoot1": "echo MyBoot",
-		"demoBoot2": "echo Demo2",
+		"demoBoot1":           "echo MyBoot",
+		"demoBoot2":           "echo Demo2",
+		"fake.demo-demoBoot1": "echo Demo1",
+		"fake.demo-demoBoot2": "echo Demo2",
 	}
 	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
 }
@@ -319,9 +497,1917 @@ func (s *suite) TestAbsTarPathMatches(c *C) {
 	}
 }
 
-//
-// Utility
-//
+func (s *suite) TestCollectMissingRuntimePackage(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	tmpDir := c.MkDir()
+	PrepareFiles(tmpDir, map[string]string{
+		"/meta/package.yaml": "name: node-4.4.5\ntitle: NodeJS\nauthor: Node Author\n",
+	})
+	ImportPackage(s.repo, tmpDir)
+	s.setRunYaml(`
+		runtime: node
+		config_set:
+		  default:
+		    main: /server.js
+		    node_version: 8.11.2
+	`, c)
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "Package node-8.11.2 required by 'node' runtime is not available "+
+		"\\(available locally: node-4.4.5\\). Pull it manually .*")
+}
+
+func (s *suite) TestInitPackageInteractive(c *C) {
+	// Prepare.
+	packageDir := filepath.Join(c.MkDir(), "my-app")
+	answers := strings.Join([]string{
+		"",        // name: default
+		"My App",  // title
+		"tester",  // author
+		"",        // version: none
+		"unknown", // runtime: invalid, asked again
+		"node",    // runtime
+		"/app.js", // entrypoint
+		"1 GB",    // memory: invalid, asked again
+		"512M",    // memory
+		"2",       // cpus
+	}, "\n") + "\n"
+	out := &bytes.Buffer{}
+
+	// This is what we're testing here.
+	err := InitPackageInteractive(packageDir, &core.Package{}, "", strings.NewReader(answers), out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Matches, "(?s).*Invalid answer.*Invalid answer.*")
+
+	data, err := ioutil.ReadFile(filepath.Join(packageDir, "meta", "package.yaml"))
+	c.Assert(err, IsNil)
+	var pkg core.Package
+	c.Assert(pkg.Parse(data), IsNil)
+	c.Check(pkg.Name, Equals, "my-app")
+	c.Check(pkg.Title, Equals, "My App")
+	c.Check(pkg.Author, Equals, "tester")
+
+	cmdConf, err := runtime.ParsePackageRunManifest(packageDir)
+	c.Assert(err, IsNil)
+	c.Check(cmdConf.RuntimeType, Equals, runtime.NodeJS)
+	bootCmd, err := cmdConf.ConfigSets["myconfig1"].GetBootCmd()
+	c.Assert(err, IsNil)
+	c.Check(bootCmd, Matches, ".*/app.js.*")
+	c.Check(cmdConf.ConfigSets["myconfig1"].GetResources().Memory, Equals, "512M")
+	c.Check(cmdConf.ConfigSets["myconfig1"].GetResources().Cpus, Equals, 2)
+
+	ignore, err := ioutil.ReadFile(filepath.Join(packageDir, ".capstanignore"))
+	c.Assert(err, IsNil)
+	c.Check(string(ignore), Matches, "(?s).*/npm-debug.log.*")
+}
+
+func (s *suite) TestCollectLocked(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+
+	// Locked collect requires the lockfile.
+	err := CollectPackage(s.repo, s.packageDir, false, true, "", runtime.DefaultPlatform(), false)
+	c.Check(err, ErrorMatches, "capstan.lock not found, .*")
+
+	// Collect records the resolved packages...
+	c.Assert(CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false), IsNil)
+	lock, err := core.ParseLockFile(filepath.Join(s.packageDir, "capstan.lock"))
+	c.Assert(err, IsNil)
+	c.Assert(lock.Packages, HasLen, 2)
+	c.Check(lock.Packages[0].Name, Equals, "fake.demo")
+	c.Check(lock.Packages[1].Name, Equals, "osv.bootstrap")
+	c.Check(lock.Packages[0].Hash, Matches, "sha256:[0-9a-f]{64}")
+	_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", "capstan.lock"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// ... which locked collect accepts.
+	c.Check(CollectPackage(s.repo, s.packageDir, false, true, "", runtime.DefaultPlatform(), false), IsNil)
+
+	// Changed content of a required package is refused.
+	s.importPkg(map[string]string{
+		"/meta/package.yaml":  "name: fake.demo\ntitle: Fake Demo\nauthor: Demo Author\n",
+		"/fake-demo-file.txt": "changed",
+	}, c)
+	err = CollectPackage(s.repo, s.packageDir, false, true, "", runtime.DefaultPlatform(), false)
+	c.Check(err, ErrorMatches, "Resolved packages differ from capstan.lock:\n"+
+		"  fake.demo: content of version \\(none\\) differs from the locked one")
+}
+
+func (s *suite) TestCollectCapstaninclude(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/.capstaninclude":        "/data/*.txt\n",
+		"/data/other/ignored.dat": DefaultText,
+	})
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", "data", "data-file.txt"))
+	c.Check(err, IsNil)
+	for _, f := range []string{"file.txt", ".capstaninclude", "data/other"} {
+		_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", f))
+		c.Check(os.IsNotExist(err), Equals, true, Commentf("%s collected", f))
+	}
+}
+
+func (s *suite) TestCollectSymlinks(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	shared := c.MkDir()
+	PrepareFiles(shared, map[string]string{"/native/binding.node": DefaultText})
+	c.Assert(os.Symlink(filepath.Join(shared, "native"), filepath.Join(s.packageDir, "native")), IsNil)
+	c.Assert(os.Symlink("file.txt", filepath.Join(s.packageDir, "link.txt")), IsNil)
+
+	m := []struct {
+		comment string
+		policy  string
+		err     string
+		check   func(target string)
+	}{
+		{
+			"preserve by default", "", "",
+			func(target string) {
+				info, err := os.Lstat(filepath.Join(target, "link.txt"))
+				c.Assert(err, IsNil)
+				c.Check(info.Mode()&os.ModeSymlink, Equals, os.ModeSymlink)
+			},
+		},
+		{
+			"follow", "follow", "",
+			func(target string) {
+				info, err := os.Lstat(filepath.Join(target, "link.txt"))
+				c.Assert(err, IsNil)
+				c.Check(info.Mode().IsRegular(), Equals, true)
+				info, err = os.Lstat(filepath.Join(target, "native", "binding.node"))
+				c.Assert(err, IsNil)
+				c.Check(info.Mode().IsRegular(), Equals, true)
+			},
+		},
+		{
+			"error", "error", "symbolic link /link.txt is not allowed by symlinks policy 'error'", nil,
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		PrepareFiles(s.packageDir, map[string]string{
+			"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nsymlinks: " + args.policy + "\n",
+		})
+
+		// This is what we're testing here.
+		err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		args.check(filepath.Join(s.packageDir, "mpm-pkg"))
+	}
+}
+
+func (s *suite) TestCollectTargets(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml":    "name: app\ntitle: App\nauthor: a\ntargets:\n  gce:\n    - /startup/*\n  vbox:\n    - /guest\n",
+		"/startup/gce.sh":       DefaultText,
+		"/guest/additions.conf": DefaultText,
+	})
+
+	m := []struct {
+		comment    string
+		hypervisor string
+		targets    []string
+		collected  []string
+		ignored    []string
+	}{
+		{"no target", "qemu", nil, []string{"file.txt"}, []string{"startup/gce.sh", "guest"}},
+		{"gce", "qemu", []string{"gce"}, []string{"file.txt", "startup/gce.sh"}, []string{"guest"}},
+		{"gce and vbox", "qemu", []string{"gce", "vbox"}, []string{"startup/gce.sh", "guest/additions.conf"}, nil},
+		{"default target of hypervisor", "vbox", nil, []string{"guest/additions.conf"}, []string{"startup/gce.sh"}},
+		{"explicit target overrides hypervisor", "vbox", []string{"gce"}, []string{"startup/gce.sh"}, []string{"guest"}},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		platform := runtime.PlatformFor(args.hypervisor)
+		platform.Targets = args.targets
+		err := CollectPackage(s.repo, s.packageDir, false, false, "", platform, false)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		for _, f := range args.collected {
+			_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", f))
+			c.Check(err, IsNil, Commentf("%s not collected", f))
+		}
+		for _, f := range args.ignored {
+			_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", f))
+			c.Check(os.IsNotExist(err), Equals, true, Commentf("%s collected", f))
+		}
+	}
+}
+
+func (s *suite) TestCollectProfile(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml":   "name: app\ntitle: App\nauthor: a\nprofiles:\n  prod:\n    ignore:\n      - /fixtures\n      - /**/*.debug\n      - '!/logs'\n",
+		"/.capstanignore":      "/logs\n",
+		"/fixtures/users.json": DefaultText,
+		"/app.so.debug":        DefaultText,
+		"/logs/app.log":        DefaultText,
+	})
+
+	m := []struct {
+		comment   string
+		profile   string
+		collected []string
+		ignored   []string
+		err       string
+	}{
+		{"no profile", "", []string{"fixtures/users.json", "app.so.debug"}, []string{"logs"}, ""},
+		{"prod", "prod", []string{"file.txt", "logs/app.log"}, []string{"fixtures", "app.so.debug"}, ""},
+		{"undefined profile", "dev", nil, nil, "profile 'dev' is not defined in meta/package.yaml nor in meta/run.yaml"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		platform := runtime.DefaultPlatform()
+		platform.Profile = args.profile
+		err := CollectPackage(s.repo, s.packageDir, false, false, "", platform, false)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		for _, f := range args.collected {
+			_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", f))
+			c.Check(err, IsNil, Commentf("%s not collected", f))
+		}
+		for _, f := range args.ignored {
+			_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", f))
+			c.Check(os.IsNotExist(err), Equals, true, Commentf("%s collected", f))
+		}
+	}
+}
+
+func (s *suite) TestCollectRequiredPackageValues(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: lib.server\ntitle: Server\nauthor: a\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  server:
+			    bootcmd: /server.so --port ${PORT}
+		`),
+		"/meta/values.yaml": "PORT: 8000\n",
+	}, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nrequire:\n  - lib.server\n",
+	})
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	bootCmd, err := ioutil.ReadFile(filepath.Join(s.packageDir, "mpm-pkg", "run", "server"))
+	c.Assert(err, IsNil)
+	c.Check(string(bootCmd), Equals, "/server.so --port 8000")
+}
+
+func (s *suite) TestValidatePackageManifest(c *C) {
+	m := []struct {
+		comment     string
+		packageYaml string
+		problems    []string
+	}{
+		{
+			"valid",
+			"format_version: 1\nname: app\ntitle: App\nauthor: a\n",
+			nil,
+		},
+		{
+			"all problems",
+			"name: app\nrequire: lib\ntitel: App\n",
+			[]string{
+				"line 2: require: expected list, got lib",
+				"line 3: titel: unknown key",
+				"'title' must be provided",
+				"'author' must be provided",
+			},
+		},
+		{
+			"unsupported format version",
+			"format_version: 2\nname: app\n",
+			[]string{
+				"line 1: format_version: unsupported version 2, use one of \\[1\\]",
+			},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		packageDir := c.MkDir()
+		PrepareFiles(packageDir, map[string]string{"/meta/package.yaml": args.packageYaml})
+
+		// This is what we're testing here.
+		problems, err := validatePackageManifest(packageDir)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Assert(problems, HasLen, len(args.problems), Commentf("%v", problems))
+		for j, p := range problems {
+			c.Check(p, ErrorMatches, args.problems[j])
+		}
+	}
+}
+
+func (s *suite) TestStoreImageRunSettings(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: lib.server\ntitle: Server\nauthor: a\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  server:
+			    bootcmd: /server.so
+			    memory: 2G
+		`),
+	}, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nrequire:\n  - lib.server\n",
+		"/meta/run.yaml":     "runtime: native\nconfig_set:\n  app:\n    bootcmd: /app.so\n",
+	})
+	c.Assert(CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false), IsNil)
+	bootOpts := &BootOptions{Boot: "lib.server-server", Platform: runtime.PlatformFor("qemu")}
+	c.Assert(os.MkdirAll(filepath.Dir(s.repo.ImagePath("qemu", "app")), 0775), IsNil)
+
+	// This is what we're testing here.
+	err := storeImageRunSettings(s.repo, "app", s.packageDir, bootOpts)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	resources, err := runtime.ParseResources(s.repo.ImageResourcesPath("qemu", "app"))
+	c.Assert(err, IsNil)
+	c.Check(resources.Memory, Equals, "2G")
+
+	bootOpts.Boot = "lib.server-missing"
+	err = storeImageRunSettings(s.repo, "app", s.packageDir, bootOpts)
+	c.Check(err, ErrorMatches, "config set 'lib.server-missing' is defined neither by the package nor by its required packages")
+
+	PrepareFiles(s.packageDir, map[string]string{"/meta/run.yaml": "runtime: native\nconfig_set: [\n"})
+	err = storeImageRunSettings(s.repo, "app", s.packageDir, bootOpts)
+	c.Check(err, NotNil)
+}
+
+func (s *suite) TestCollectBaseOfRequiredPackage(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: openjdk8\ntitle: Java\nauthor: a\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  default:
+			    bootcmd: /java.so
+		`),
+	}, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nrequire:\n  - openjdk8\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  default:
+			    base: openjdk8:default
+			    bootcmd: /app.so
+		`),
+	})
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	expectedBoots := map[string]string{
+		"default":          "runscript /run/openjdk8-default & /app.so",
+		"openjdk8-default": "/java.so",
+	}
+	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
+}
+
+func (s *suite) TestCollectEquallyNamedBases(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: lib.a\ntitle: A\nauthor: a\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  server:
+			    bootcmd: /a.so
+			    env:
+			      PORT: 8000
+		`),
+	}, c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: lib.b\ntitle: B\nauthor: a\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  server:
+			    bootcmd: /b.so
+		`),
+	}, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nrequire:\n  - lib.a\n  - lib.b\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  default:
+			    base:
+			      - lib.a:server
+			      - lib.b:server
+			    bootcmd: /app.so
+		`),
+	})
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	expectedBoots := map[string]string{
+		"default":      "--env=PORT?=8000 runscript /run/lib.a-server & runscript /run/lib.b-server & /app.so",
+		"server":       "/b.so",
+		"lib.a-server": "--env=PORT?=8000 /a.so",
+		"lib.b-server": "/b.so",
+	}
+	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
+}
+
+func (s *suite) TestCollectCyclicBases(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: lib.a\ntitle: A\nauthor: a\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  server:
+			    base: lib.b:server
+			    bootcmd: /a.so
+		`),
+	}, c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: lib.b\ntitle: B\nauthor: a\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  server:
+			    base: lib.a:server
+			    bootcmd: /b.so
+		`),
+	}, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nrequire:\n  - lib.a\n  - lib.b\n",
+	})
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "Validation failed for configuration set 'server': base 'lib.a:server' is based on itself")
+}
+
+func (s *suite) TestCollectPlatformOverlays(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\n",
+		"/meta/run.yaml": fixIndent(`
+			runtime: native
+			config_set:
+			  default:
+			    bootcmd: /app.so
+			    overlays:
+			      - when: hypervisor=vbox
+			        bootcmd: /app-vbox.so
+		`),
+	})
+
+	m := []struct {
+		hypervisor string
+		expected   string
+	}{
+		{"qemu", "/app.so"},
+		{"vbox", "/app-vbox.so"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.hypervisor)
+
+		// This is what we're testing here.
+		err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.PlatformFor(args.hypervisor), false)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		bootCmd, err := ioutil.ReadFile(filepath.Join(s.packageDir, "mpm-pkg", "run", "default"))
+		c.Assert(err, IsNil)
+		c.Check(string(bootCmd), Equals, args.expected)
+	}
+}
+
+func (s *suite) TestCollectSymlinksCycle(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nsymlinks: follow\n",
+	})
+	c.Assert(os.Symlink("..", filepath.Join(s.packageDir, "data", "loop")), IsNil)
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "symbolic link /data/loop points to .*, which results in a cycle")
+}
+
+func (s *suite) TestDedup(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: libs\ntitle: Libs\nauthor: a\ndedup: true\n",
+		"/a/lib.jar":         "jar content",
+		"/b/lib.jar":         "jar content",
+	}, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\ndedup: true\nrequire:\n  - libs\n",
+		"/lib/app.jar":       "jar content",
+	})
+
+	// Package stores the duplicate as a hard link.
+	var linked []string
+	reader, err := s.repo.GetPackageTarReader("libs")
+	c.Assert(err, IsNil)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		if header.Typeflag == tar.TypeLink {
+			linked = append(linked, header.Name+" -> "+header.Linkname)
+		}
+	}
+	c.Check(linked, DeepEquals, []string{"/b/lib.jar -> /a/lib.jar"})
+
+	// This is what we're testing here.
+	err = CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	target := filepath.Join(s.packageDir, "mpm-pkg")
+	for path, link := range map[string]string{"/b/lib.jar": "../a/lib.jar", "/lib/app.jar": "../a/lib.jar"} {
+		actual, err := os.Readlink(filepath.Join(target, path))
+		c.Assert(err, IsNil)
+		c.Check(actual, Equals, link)
+		data, err := ioutil.ReadFile(filepath.Join(target, path))
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, "jar content")
+	}
+}
+
+func (s *suite) TestCollectVendored(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+
+	// Vendored collect requires the vendor directory.
+	err := UseVendoredPackages(s.repo, s.packageDir)
+	c.Check(err, ErrorMatches, ".*vendor not found, .*")
+
+	// This is what we're testing here.
+	c.Assert(VendorPackages(s.repo, s.packageDir, false), IsNil)
+
+	// Expectations.
+	for _, f := range []string{"fake.demo.mpm", "fake.demo.yaml", "osv.bootstrap.mpm", "osv.bootstrap.yaml"} {
+		_, err := os.Stat(filepath.Join(s.packageDir, "vendor", f))
+		c.Check(err, IsNil, Commentf("%s not vendored", f))
+	}
+
+	// Packages are resolved from the vendor directory once removed from the local repository.
+	c.Assert(os.RemoveAll(s.repo.PackagesPath()), IsNil)
+	c.Assert(UseVendoredPackages(s.repo, s.packageDir), IsNil)
+	c.Assert(CollectPackage(s.repo, s.packageDir, false, false, "", runtime.DefaultPlatform(), false), IsNil)
+	_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", "fake-demo-file.txt"))
+	c.Check(err, IsNil)
+	_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", "vendor", "fake.demo.mpm"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *suite) TestWorkspaceMembers(c *C) {
+	// Prepare.
+	dir := c.MkDir()
+	PrepareFiles(dir, map[string]string{
+		"/capstan-workspace.yaml":         "members:\n  - services/api\n  - libs/common\n  - libs/db\n",
+		"/services/api/meta/package.yaml": "name: api\ntitle: API\nauthor: a\nrequire:\n  - ../../libs/db\n",
+		"/libs/db/meta/package.yaml":      "name: db\ntitle: DB\nauthor: a\nrequire:\n  - common\n  - osv.cli\n",
+		"/libs/common/meta/package.yaml":  "name: common\ntitle: Common\nauthor: a\n",
+		"/cycle/capstan-workspace.yaml":   "members:\n  - a\n  - b\n",
+		"/cycle/a/meta/package.yaml":      "name: a\ntitle: A\nauthor: a\nrequire:\n  - ../b\n",
+		"/cycle/b/meta/package.yaml":      "name: b\ntitle: B\nauthor: a\nrequire:\n  - a\n",
+	})
+
+	// This is what we're testing here.
+	members, err := WorkspaceMembers(dir)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	var names []string
+	for _, member := range members {
+		names = append(names, member.Package.Name)
+	}
+	c.Check(names, DeepEquals, []string{"common", "db", "api"})
+	c.Check(members[2].Package.Require, DeepEquals, []string{"db"})
+	c.Check(members[2].Dir, Equals, filepath.Join(dir, "services", "api"))
+
+	_, err = WorkspaceMembers(filepath.Join(dir, "cycle"))
+	c.Check(err, ErrorMatches, "dependency cycle between workspace members: a -> b -> a")
+}
+
+func (s *suite) TestOutdatedPackages(c *C) {
+	files := map[string]string{
+		"/packages/osv.cli.yaml":       "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 2.1\n",
+		"/packages/osv.cli.mpm":        "",
+		"/packages/osv.bootstrap.yaml": "name: osv.bootstrap\ntitle: Bootstrap\nauthor: a\nversion: 0.25\n",
+		"/packages/osv.bootstrap.mpm":  "",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/" {
+			listing := "<ListBucketResult>"
+			for path := range files {
+				listing += "<Contents><Key>" + strings.TrimPrefix(path, "/") + "</Key></Contents>"
+			}
+			fmt.Fprint(w, listing+"</ListBucketResult>")
+			return
+		}
+		fmt.Fprint(w, files[req.URL.Path])
+	}))
+	defer server.Close()
+	s.repo.URL = server.URL + "/"
+
+	s.importPkg(map[string]string{"/meta/package.yaml": "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 1.2\n"}, c)
+	s.importPkg(map[string]string{"/meta/package.yaml": "name: osv.httpserver\ntitle: HTTP\nauthor: a\nversion: 1.0\n"}, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nrequire:\n  - osv.cli ^1.0\n  - osv.httpserver\n",
+	})
+	lock := core.LockFile{Packages: []core.LockedPackage{
+		{Name: "osv.bootstrap", Version: "0.24", Hash: "sha256:0"},
+		{Name: "osv.cli", Version: "1.1", Hash: "sha256:1"},
+	}}
+	c.Assert(lock.WriteToFile(filepath.Join(s.packageDir, "capstan.lock")), IsNil)
+
+	// This is what we're testing here.
+	outdated, err := OutdatedPackages(s.repo, s.packageDir)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(outdated, DeepEquals, []OutdatedPackage{
+		{Name: "osv.bootstrap", Current: "0.24", Wanted: "0.25", Latest: "0.25", Repository: server.URL + "/"},
+		{Name: "osv.cli", Constraint: "^1.0", Current: "1.1", Wanted: "1.2", Latest: "2.1", Repository: server.URL + "/"},
+	})
+
+	// Unreachable repositories are skipped.
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	s.repo.URL = unreachable.URL + "/"
+	s.repo.Repositories = []string{unreachable.URL + "/", server.URL + "/"}
+	outdated, err = OutdatedPackages(s.repo, s.packageDir)
+	c.Assert(err, IsNil)
+	c.Check(outdated, HasLen, 2)
+}
+
+func (s *suite) TestPackageGraph(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{"/meta/package.yaml": "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 1.2\n"}, c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: osv.httpserver\ntitle: HTTP\nauthor: a\nversion: 2.0\nrequire:\n  - osv.cli >=1.0\n",
+	}, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nrequire:\n  - osv.cli ^1.2\n  - osv.httpserver\n",
+	})
+
+	// This is what we're testing here.
+	graph, err := PackageGraph(s.repo, s.packageDir, "", false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(graph.Root, Equals, "app")
+	c.Check(graph.Packages, DeepEquals, []GraphPackage{
+		{Name: "app"},
+		{Name: "osv.bootstrap"},
+		{Name: "osv.cli", Version: "1.2"},
+		{Name: "osv.httpserver", Version: "2.0"},
+	})
+	c.Check(graph.Dependencies, DeepEquals, []GraphRequires{
+		{From: "app", To: "osv.cli", Constraint: "^1.2"},
+		{From: "app", To: "osv.httpserver"},
+		{From: "app", To: "osv.bootstrap"},
+		{From: "osv.httpserver", To: "osv.cli", Constraint: ">=1.0"},
+	})
+	c.Check(graph.Duplicates(), DeepEquals, []string{"osv.cli"})
+
+	var out bytes.Buffer
+	c.Assert(PrintPackageGraph(graph, "dot", &out), IsNil)
+	c.Check(out.String(), Matches, `(?s)digraph "app" \{\n.*  "osv.cli" \[label="osv.cli\\n1.2" color=red\];\n.*`+
+		`  "osv.httpserver" -> "osv.cli" \[label=">=1.0"\];\n\}\n`)
+}
+
+func (s *suite) TestPackageDiff(c *C) {
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nversion: 1.0\n",
+		"/same.txt":          "same",
+		"/changed.txt":       "before",
+		"/removed.txt":       "removed",
+	}, c)
+	exported := filepath.Join(c.MkDir(), "app-1.0.mpm")
+	c.Assert(ExportPackage(s.repo, "app", exported, ""), IsNil)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: app\ntitle: App\nauthor: a\nversion: 1.0\n",
+		"/same.txt":          "same",
+		"/changed.txt":       "after!",
+		"/lib/added.so":      "added",
+	}, c)
+
+	// This is what we're testing here.
+	var out bytes.Buffer
+	err := PackageDiff(s.repo, exported, "app", &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, ""+
+		"~ /changed.txt (6 -> 6 bytes)\n"+
+		"+ /lib/\n"+
+		"+ /lib/added.so (5 bytes)\n"+
+		"- /removed.txt (7 bytes)\n"+
+		"2 added, 1 removed, 1 changed\n")
+
+	out.Reset()
+	c.Assert(PackageContents(s.repo, "app", &out), IsNil)
+	c.Check(out.String(), Matches, "(?s).*lib/\n  added.so .*")
+}
+
+//
+// Utility
+//
+
+func (s *suite) TestSearchPackages(c *C) {
+	files := map[string]string{
+		"/packages/node-4.4.5.yaml":    "name: node-4.4.5\ntitle: Node\nauthor: a\nversion: 4.4.5\nruntime: node\nplatform: x86_64\n",
+		"/packages/node-6.10.0.yaml":   "name: node-6.10.0\ntitle: Node\nauthor: a\nversion: 6.10.0\nruntime: node\nplatform: aarch64\n",
+		"/packages/osv.cli.yaml":       "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 1.0\n",
+		"/packages/openjdk8-zulu.yaml": "name: openjdk8-zulu\ntitle: Java\nauthor: a\nversion: 8.0\nruntime: java\n",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/" {
+			listing := "<ListBucketResult>"
+			for path := range files {
+				listing += "<Contents><Key>" + strings.TrimPrefix(path, "/") + "</Key></Contents>"
+			}
+			fmt.Fprint(w, listing+"</ListBucketResult>")
+			return
+		}
+		fmt.Fprint(w, files[req.URL.Path])
+	}))
+	defer server.Close()
+	s.repo.URL = server.URL + "/"
+
+	m := []struct {
+		comment  string
+		search   string
+		filter   PackageFilter
+		expected []string
+	}{
+		{"no filter", "", PackageFilter{}, []string{"node-4.4.5", "node-6.10.0", "openjdk8-zulu", "osv.cli"}},
+		{"search term", "node", PackageFilter{}, []string{"node-4.4.5", "node-6.10.0"}},
+		{"runtime", "", PackageFilter{Runtime: "java"}, []string{"openjdk8-zulu"}},
+		{"platform", "", PackageFilter{Platform: "aarch64"}, []string{"node-6.10.0", "openjdk8-zulu", "osv.cli"}},
+		{"version", "node", PackageFilter{Version: ">=5"}, []string{"node-6.10.0"}},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		var out bytes.Buffer
+
+		// This is what we're testing here.
+		err := SearchPackages(s.repo, args.search, args.filter, "json", &out)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		var results []PackageSearchResult
+		c.Assert(json.Unmarshal(out.Bytes(), &results), IsNil)
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Name)
+			c.Check(r.Repository, Equals, s.repo.URL)
+		}
+		sort.Strings(names)
+		c.Check(names, DeepEquals, args.expected)
+	}
+
+	err := SearchPackages(s.repo, "", PackageFilter{}, "xml", ioutil.Discard)
+	c.Check(err, ErrorMatches, "unsupported format 'xml', use one of table\\|json")
+}
+
+func (s *suite) TestBundleExportImport(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	loaderDir := filepath.Join(s.repo.RepoPath(), "mike", "osv-loader")
+	PrepareFiles(loaderDir, map[string]string{
+		"/index.yaml":      "format_version: 1\n",
+		"/osv-loader.qemu": DefaultText,
+	})
+	bundle := filepath.Join(c.MkDir(), "app.bundle.tar.gz")
+
+	// This is what we're testing here.
+	err := ExportBundle(s.repo, s.packageDir, bundle, false)
+	c.Assert(err, IsNil)
+	target := util.NewRepo(util.DefaultRepositoryUrl)
+	target.Path = c.MkDir()
+	err = ImportBundle(target, bundle)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(target.PackageExists("osv.bootstrap"), Equals, true)
+	c.Check(target.PackageExists("fake.demo"), Equals, true)
+	c.Check(target.ImageExists("qemu", "mike/osv-loader"), Equals, true)
+	_, err = os.Stat(filepath.Join(target.RepoPath(), "mike", "osv-loader", "index.yaml"))
+	c.Check(err, IsNil)
+}
+
+func (s *suite) TestResolveLoader(c *C) {
+	// Prepare.
+	for _, image := range []string{"osv-loader-v0.23", "osv-loader-v0.24", "osv-loader-rofs-v0.25"} {
+		PrepareFiles(filepath.Join(s.repo.RepoPath(), "mike", image), map[string]string{
+			"/index.yaml":         "format_version: 1\n",
+			"/" + image + ".qemu": DefaultText,
+		})
+	}
+
+	// This is what we're testing here.
+	c.Check(s.repo.LoaderVersions(util.FilesystemZFS), DeepEquals, []string{"0.23", "0.24"})
+	image, err := ResolveLoader(s.repo, util.FilesystemZFS, "", false)
+	c.Check(err, IsNil)
+	c.Check(image, Equals, "mike/osv-loader")
+	image, err = ResolveLoader(s.repo, util.FilesystemZFS, ">= 0.23", false)
+	c.Check(err, IsNil)
+	c.Check(image, Equals, "mike/osv-loader-v0.24")
+	image, err = ResolveLoader(s.repo, util.FilesystemZFS, "0.23", false)
+	c.Check(err, IsNil)
+	c.Check(image, Equals, "mike/osv-loader-v0.23")
+	c.Check(s.repo.LoaderVersion(image), Equals, "0.23")
+	image, err = ResolveLoader(s.repo, util.FilesystemROFS, "~0.25", false)
+	c.Check(err, IsNil)
+	c.Check(image, Equals, "mike/osv-loader-rofs-v0.25")
+	_, err = ResolveLoader(s.repo, util.FilesystemZFS, ">= 0.25", false)
+	c.Check(err, ErrorMatches, "no loader image of version >= 0.25 is available.*")
+}
+
+func (s *suite) TestComposeLoader(c *C) {
+	// Prepare.
+	PrepareFiles(filepath.Join(s.repo.RepoPath(), "mike", "osv-loader-v0.24"), map[string]string{
+		"/index.yaml":            "format_version: 1\n",
+		"/osv-loader-v0.24.qemu": DefaultText,
+	})
+	packageDir := c.MkDir()
+	lockPath := filepath.Join(packageDir, core.LockFileName)
+
+	// This is what we're testing here.
+	image, err := composeLoader(s.repo, packageDir, util.FilesystemZFS, "0.24", false, false)
+	c.Assert(err, IsNil)
+	c.Check(image, Equals, "mike/osv-loader-v0.24")
+	_, err = os.Stat(lockPath)
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	c.Assert(core.LockFile{}.WriteToFile(lockPath), IsNil)
+	_, err = composeLoader(s.repo, packageDir, util.FilesystemZFS, "0.24", false, false)
+	c.Assert(err, IsNil)
+	lock, err := core.ParseLockFile(lockPath)
+	c.Assert(err, IsNil)
+	c.Assert(lock.Loader, NotNil)
+	c.Check(lock.Loader.Name, Equals, "mike/osv-loader-v0.24")
+	c.Check(lock.Loader.Version, Equals, "0.24")
+
+	// Unchanged loader leaves the lockfile alone.
+	data, err := ioutil.ReadFile(lockPath)
+	c.Assert(err, IsNil)
+	data = append(data, "# kept\n"...)
+	c.Assert(ioutil.WriteFile(lockPath, data, 0644), IsNil)
+	_, err = composeLoader(s.repo, packageDir, util.FilesystemZFS, "0.24", false, false)
+	c.Check(err, IsNil)
+	_, err = composeLoader(s.repo, packageDir, util.FilesystemZFS, "", false, true)
+	c.Check(err, IsNil)
+	kept, err := ioutil.ReadFile(lockPath)
+	c.Assert(err, IsNil)
+	c.Check(string(kept), Equals, string(data))
+}
+
+func (s *suite) TestBuildOSvSource(c *C) {
+	// Prepare.
+	dir := c.MkDir()
+	src := OSvSource{Dir: dir, Mode: "debug"}
+	c.Assert(BuildOSvSource(s.repo, src), ErrorMatches, ".* is not an OSv source tree: scripts/build is missing")
+	PrepareFiles(dir, map[string]string{
+		"/scripts/build": "#!/bin/sh\n" +
+			"echo \"$@\" > args.txt\n" +
+			"mkdir -p build/debug\n" +
+			"printf 'QFI\\373' > build/debug/usr.img\n" +
+			"head -c 128 /dev/zero >> build/debug/usr.img\n" +
+			"echo loader > build/debug/loader.img\n",
+	})
+
+	// This is what we're testing here.
+	src.Prebuilt = true
+	c.Check(BuildOSvSource(s.repo, src), ErrorMatches, ".*/build/debug/usr.img: OSv build artifact is missing.*")
+	src.Prebuilt = false
+	err := BuildOSvSource(s.repo, src)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args.txt"))
+	c.Check(string(args), Matches, "image=empty fs=zfs mode=debug -j[0-9]+\n")
+	c.Check(s.repo.ImageExists("qemu", OSvSourceBaseImage), Equals, true)
+	c.Check(s.repo.ImageExists("qemu", OSvSourceLoaderImage), Equals, true)
+	loader, _ := ioutil.ReadFile(s.repo.ImagePath("qemu", OSvSourceLoaderImage))
+	c.Check(string(loader), Equals, "loader\n")
+	c.Check(ValidateOSvMode("fast"), ErrorMatches, "unknown OSv build mode 'fast'.*")
+}
+
+func (s *suite) TestBundleImportTampered(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	bundle := filepath.Join(c.MkDir(), "bundle.tar.gz")
+	c.Assert(ExportBundle(s.repo, "osv.bootstrap", bundle, false), ErrorMatches, "loader image mike/osv-loader is not available.*")
+	PrepareFiles(filepath.Join(s.repo.RepoPath(), "mike", "osv-loader"), map[string]string{
+		"/osv-loader.qemu": DefaultText,
+	})
+	c.Assert(ExportBundle(s.repo, "osv.bootstrap", bundle, false), IsNil)
+
+	// Replace the content of the loader image in the bundle.
+	tampered := filepath.Join(c.MkDir(), "tampered.tar.gz")
+	rewriteBundle(c, bundle, tampered, "repository/mike/osv-loader/osv-loader.qemu", "tampered")
+	target := util.NewRepo(util.DefaultRepositoryUrl)
+	target.Path = c.MkDir()
+
+	// This is what we're testing here.
+	err := ImportBundle(target, tampered)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "repository/mike/osv-loader/osv-loader.qemu: checksum mismatch.*")
+	c.Check(target.PackageExists("osv.bootstrap"), Equals, false)
+}
+
+// writeOverlayDisk writes the header of a QCOW2 overlay disk based on the
+// backing image, which is all that instances need for their image to be found.
+func writeOverlayDisk(c *C, path, backing string) {
+	header := qcow2.Header{Magic: qcow2.QCOW2_MAGIC, Version: 2, BackingFileOffset: 512, BackingFileSize: uint32(len(backing))}
+	var buf bytes.Buffer
+	c.Assert(binary.Write(&buf, binary.BigEndian, header), IsNil)
+	data := make([]byte, 512+len(backing))
+	copy(data, buf.Bytes())
+	copy(data[512:], backing)
+	c.Assert(ioutil.WriteFile(path, data, 0644), IsNil)
+}
+
+// rewriteBundle copies the bundle, replacing content of the named file.
+func rewriteBundle(c *C, src, dst, name, content string) {
+	input, err := os.Open(src)
+	c.Assert(err, IsNil)
+	defer input.Close()
+	gzReader, err := gzip.NewReader(input)
+	c.Assert(err, IsNil)
+	tarReader := tar.NewReader(gzReader)
+
+	output, err := os.Create(dst)
+	c.Assert(err, IsNil)
+	defer output.Close()
+	gzWriter := gzip.NewWriter(output)
+	defer gzWriter.Close()
+	tarWriter := tar.NewWriter(gzWriter)
+	defer tarWriter.Close()
+
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(tarReader)
+		c.Assert(err, IsNil)
+		if hdr.Name == name {
+			data = []byte(content)
+			hdr.Size = int64(len(data))
+		}
+		c.Assert(tarWriter.WriteHeader(hdr), IsNil)
+		_, err = tarWriter.Write(data)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *suite) TestPrintInstances(c *C) {
+	instances := []InstanceInfo{
+		{Name: "web", Hypervisor: "qemu", Status: "Running", Image: "app/web", Memory: 512, Cpus: 2, Ports: []string{"8080:80"}, Uptime: 90,
+			Labels: map[string]string{"env": "test", "team": "core"}, Created: "2017-06-12T10:21:04Z", CapstanVersion: "v0.3.0"},
+		{Name: "db", Hypervisor: "vbox", Status: "Stopped", Image: "app/db"},
+	}
+
+	m := []struct {
+		comment  string
+		format   string
+		expected string
+	}{
+		{
+			"table", "table",
+			"Name +Platform +Status +Image +Memory +Cpus +Uptime +Created +Ports +Labels\n" +
+				"web +qemu +Running +app/web +512M +2 +1m30s +2017-06-1[23] [0-9:]{5} +8080:80 +env=test,team=core\n" +
+				"db +vbox +Stopped +app/db *\n",
+		},
+		{
+			"json", "json",
+			`(?s)\[\n  \{\n    "name": "web",\n    "hypervisor": "qemu",.*"ports": \[\n      "8080:80"\n    \],\n    "uptime": 90,\n    "labels": \{\n      "env": "test",\n      "team": "core"\n    \},\n    "created": "2017-06-12T10:21:04Z",\n    "capstan_version": "v0.3.0"\n  \},.*"image": "app/db"\n  \}\n\]\n`,
+		},
+		{
+			"yaml", "yaml",
+			`(?s)- name: web\n  hypervisor: qemu\n.*  memory: 512\n  cpus: 2\n  ports:\n  - 8080:80\n  uptime: 90\n  labels:\n    env: test\n    team: core\n  created: "2017-06-12T10:21:04Z"\n  capstan_version: v0.3.0\n- name: db\n.*`,
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		var out bytes.Buffer
+
+		// This is what we're testing here.
+		err := PrintInstances(instances, args.format, &out)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(out.String(), Matches, args.expected)
+	}
+}
+
+func (s *suite) TestImportInstance(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	tmp := c.MkDir()
+	disk := filepath.Join(tmp, "disk.qcow2")
+	c.Assert(ioutil.WriteFile(disk, []byte("flattened disk"), 0644), IsNil)
+	checksum, err := util.FileChecksum(disk)
+	c.Assert(err, IsNil)
+	dataDisk := filepath.Join(tmp, "data.img")
+	c.Assert(ioutil.WriteFile(dataDisk, []byte("data disk"), 0644), IsNil)
+	dataChecksum, err := util.FileChecksum(dataDisk)
+	c.Assert(err, IsNil)
+	manifest := InstanceManifest{
+		Name:         "app",
+		Memory:       512,
+		Cpus:         2,
+		Networking:   "nat",
+		Ports:        []string{"8000:8000"},
+		MAC:          "52:54:00:12:34:56",
+		Cmd:          "/tools/hello.so",
+		Labels:       map[string]string{"env": "test"},
+		Metadata:     util.InstanceMetadata{Image: "app/web"},
+		DiskChecksum: checksum,
+		Volumes: []util.Volume{
+			{Type: "disk", Source: "data.img", Path: "/data"},
+			{Type: "nfs", Source: "nfs://192.168.122.1/export", Path: "/shared"},
+		},
+		VolumeChecksums: map[string]string{"data.img": dataChecksum},
+	}
+	archive := filepath.Join(tmp, "app.instance.tar.gz")
+	files := map[string]string{"data.img": dataDisk}
+	c.Assert(writeInstanceArchive(manifest, disk, files, archive), IsNil)
+
+	// This is what we're testing here.
+	c.Assert(ImportInstance(s.repo, archive, "", false), IsNil)
+	c.Assert(ImportInstance(s.repo, archive, "app2", true), IsNil)
+
+	// Expectations.
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", "app")
+	conf, err := qemu.LoadConfig("app")
+	c.Assert(err, IsNil)
+	c.Check(conf.Image, Equals, filepath.Join(dir, "disk.qcow2"))
+	c.Check(conf.ConfigFile, Equals, filepath.Join(dir, "osv.config"))
+	c.Check(conf.Memory, Equals, int64(512))
+	c.Check(conf.Cpus, Equals, 2)
+	c.Check(conf.NatRules, DeepEquals, []nat.Rule{{HostPort: "8000", GuestPort: "8000"}})
+	c.Check(conf.MAC, Equals, "52:54:00:12:34:56")
+	c.Check(conf.Cmd, Equals, "/tools/hello.so")
+	c.Check(conf.Labels, DeepEquals, map[string]string{"env": "test"})
+	c.Check(conf.Metadata.Image, Equals, "app/web")
+	data, err := ioutil.ReadFile(filepath.Join(dir, "disk.qcow2"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "flattened disk")
+	c.Check(conf.Volumes, DeepEquals, []util.Volume{
+		{Type: "disk", Source: filepath.Join(dir, "data.img"), Path: "/data"},
+		{Type: "nfs", Source: "nfs://192.168.122.1/export", Path: "/shared"},
+	})
+	data, err = ioutil.ReadFile(filepath.Join(dir, "data.img"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "data disk")
+	other, err := qemu.LoadConfig("app2")
+	c.Assert(err, IsNil)
+	c.Check(other.MAC, Not(Equals), conf.MAC)
+
+	c.Check(ImportInstance(s.repo, archive, "", false), ErrorMatches, "Instance app already exists on qemu")
+	c.Assert(writeInstanceArchive(manifest, disk, map[string]string{"../data.img": dataDisk}, archive), IsNil)
+	c.Check(ImportInstance(s.repo, archive, "app3", false), ErrorMatches, ".*unexpected ../data.img in the archive")
+	c.Assert(writeInstanceArchive(manifest, disk, nil, archive), IsNil)
+	c.Check(ImportInstance(s.repo, archive, "app3", false), ErrorMatches, ".*data.img is missing from the archive")
+	manifest.DiskChecksum = "sha256:0000"
+	c.Assert(writeInstanceArchive(manifest, disk, files, archive), IsNil)
+	c.Check(ImportInstance(s.repo, archive, "app3", false), ErrorMatches, "disk.qcow2: checksum mismatch.*")
+	_, err = os.Stat(filepath.Join(util.ConfigDir(), "instances", "qemu", "app3"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	c.Check(ImportInstance(s.repo, disk, "", false), ErrorMatches, ".*not an instance archive.*")
+}
+
+func (s *suite) TestPorts(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	for name, networking := range map[string]string{"web": "nat", "db": "bridge"} {
+		dir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+		c.Assert(os.MkdirAll(dir, 0775), IsNil)
+		c.Assert(qemu.StoreConfig(&qemu.VMConfig{
+			Name:       name,
+			ConfigFile: filepath.Join(dir, "osv.config"),
+			Networking: networking,
+			NatRules:   []nat.Rule{{HostPort: "8000", GuestPort: "8000"}},
+		}), IsNil)
+	}
+
+	// This is what we're testing here.
+	c.Assert(AddPort("web", "2222:22"), IsNil)
+	c.Assert(AddPort("web", "8080:80"), IsNil)
+	c.Assert(RemovePort("web", "8000"), IsNil)
+
+	// Expectations.
+	conf, err := qemu.LoadConfig("web")
+	c.Assert(err, IsNil)
+	c.Check(conf.NatRules, DeepEquals, []nat.Rule{{HostPort: "2222", GuestPort: "22"}, {HostPort: "8080", GuestPort: "80"}})
+
+	c.Check(AddPort("web", "2222:23"), ErrorMatches, "Host port 2222 is forwarded to guest port 22 already")
+	c.Check(RemovePort("web", "8000"), ErrorMatches, "Host port 8000 is not forwarded")
+	c.Check(AddPort("db", "2222:22"), ErrorMatches, "Instance db uses bridge networking, ports can only be forwarded with nat")
+	c.Check(AddPort("missing", "2222:22"), ErrorMatches, "Instance missing does not exist or is not a qemu instance")
+	c.Check(AddPort("web", "2222"), ErrorMatches, `invalid port forwarding rule '2222', use \[<host ip>:\]<host port>:<guest port>\[/udp\]`)
+	c.Check(AddPort("web", "2222:http"), ErrorMatches, "invalid guest port 'http' in '2222:http'")
+}
+
+func (s *suite) TestPortsOfRunningInstance(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", "web")
+	c.Assert(os.MkdirAll(dir, 0775), IsNil)
+
+	// Fake QMP monitor of a running instance that is not persisted.
+	listener, err := net.Listen("unix", filepath.Join(dir, "osv.monitor"))
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	var mu sync.Mutex
+	var commands []string
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				fmt.Fprintln(conn, `{"QMP": {"version": {}}}`)
+				decoder := json.NewDecoder(conn)
+				for {
+					var request struct {
+						Execute   string            `json:"execute"`
+						Arguments map[string]string `json:"arguments"`
+					}
+					if err := decoder.Decode(&request); err != nil {
+						return
+					}
+					if request.Execute == "human-monitor-command" {
+						mu.Lock()
+						commands = append(commands, request.Arguments["command-line"])
+						mu.Unlock()
+						fmt.Fprintln(conn, `{"return": ""}`)
+						continue
+					}
+					fmt.Fprintln(conn, `{"return": {}}`)
+				}
+			}(conn)
+		}
+	}()
+
+	// This is what we're testing here.
+	c.Assert(AddPort("web", "8080:80"), IsNil)
+	c.Assert(RemovePort("web", "8080"), IsNil)
+
+	// Expectations.
+	mu.Lock()
+	defer mu.Unlock()
+	c.Check(commands, DeepEquals, []string{"hostfwd_add un0 tcp::8080-:80", "hostfwd_remove un0 tcp::8080"})
+	_, err = os.Stat(filepath.Join(dir, "osv.config"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *suite) TestAutostartInstances(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	for _, name := range []string{"web", "db", "tmp"} {
+		dir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+		c.Assert(os.MkdirAll(dir, 0775), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "disk.qcow2"), []byte("disk"), 0644), IsNil)
+		c.Assert(qemu.StoreConfig(&qemu.VMConfig{
+			Name:        name,
+			Image:       filepath.Join(dir, "disk.qcow2"),
+			InstanceDir: dir,
+			ConfigFile:  filepath.Join(dir, "osv.config"),
+			Autostart:   name == "tmp",
+		}), IsNil)
+	}
+
+	// This is what we're testing here.
+	c.Assert(SetAutostart("web", true), IsNil)
+	c.Assert(SetAutostart("db", true), IsNil)
+	c.Assert(SetAutostart("tmp", false), IsNil)
+	c.Assert(CloneInstance("web", "web2"), IsNil)
+	names, err := AutostartInstances(s.repo)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"db", "web"})
+	c.Check(SetAutostart("missing", true), ErrorMatches, "Instance missing does not exist")
+}
+
+func (s *suite) TestSetResources(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", "web")
+	c.Assert(os.MkdirAll(dir, 0775), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "disk.qcow2"), []byte("disk"), 0644), IsNil)
+	c.Assert(qemu.StoreConfig(&qemu.VMConfig{
+		Name:        "web",
+		Image:       filepath.Join(dir, "disk.qcow2"),
+		InstanceDir: dir,
+		ConfigFile:  filepath.Join(dir, "osv.config"),
+		Memory:      1024,
+		Cpus:        2,
+	}), IsNil)
+
+	// This is what we're testing here.
+	c.Assert(SetResources("web", "2G", 0), IsNil)
+	c.Assert(SetResources("web", "", 4), IsNil)
+
+	// Expectations.
+	conf, err := qemu.LoadConfig("web")
+	c.Assert(err, IsNil)
+	c.Check(conf.Memory, Equals, int64(2048))
+	c.Check(conf.Cpus, Equals, 4)
+	c.Check(SetResources("web", "", 0), ErrorMatches, "nothing to change, .*")
+	c.Check(SetResources("web", "2T", 0), ErrorMatches, "2T: unrecognized memory size")
+	c.Check(SetResources("missing", "2G", 0), ErrorMatches, "Instance missing does not exist")
+}
+
+func (s *suite) TestSelectInstances(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	for name, labels := range map[string]map[string]string{
+		"web1": {"env": "test", "role": "web"},
+		"web2": {"env": "prod", "role": "web"},
+		"db":   nil,
+	} {
+		dir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+		c.Assert(os.MkdirAll(dir, 0775), IsNil)
+		c.Assert(qemu.StoreConfig(&qemu.VMConfig{Name: name, ConfigFile: filepath.Join(dir, "osv.config"), Labels: labels}), IsNil)
+	}
+
+	m := []struct {
+		comment  string
+		selector string
+		expected []string
+	}{
+		{"no selector", "", []string{"db", "web1", "web2"}},
+		{"equality", "role=web", []string{"web1", "web2"}},
+		{"all requirements", "role=web,env!=prod", []string{"web1"}},
+		{"missing label", "!role", []string{"db"}},
+		{"nothing", "env=staging", nil},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		instances, err := SelectInstances(s.repo, args.selector)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		var names []string
+		for _, instance := range instances {
+			names = append(names, instance.Name)
+		}
+		c.Check(names, DeepEquals, args.expected)
+	}
+
+	_, err := SelectInstances(s.repo, "env=test,")
+	c.Check(err, ErrorMatches, "invalid label selector ''")
+}
+
+func (s *suite) TestInspectInstance(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	defer func(version string) { util.CapstanVersion = version }(util.CapstanVersion)
+	util.CapstanVersion = "v0.3.0"
+
+	imagePath := filepath.Join(c.MkDir(), "app.qemu")
+	c.Assert(ioutil.WriteFile(imagePath, []byte("image"), 0644), IsNil)
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", "app")
+	c.Assert(os.MkdirAll(dir, 0775), IsNil)
+	c.Assert(qemu.StoreConfig(&qemu.VMConfig{
+		Name:       "app",
+		Image:      imagePath,
+		ConfigFile: filepath.Join(dir, "osv.config"),
+		Memory:     512,
+		Metadata:   util.NewInstanceMetadata("app/web", imagePath),
+	}), IsNil)
+	// The disk is based on an image of the repository rather than the one of
+	// the configuration, e.g. after being rebased.
+	PrepareFiles(s.repo.RepoPath(), map[string]string{"/app/web/web.qemu": "image"})
+	writeOverlayDisk(c, filepath.Join(dir, "disk.qcow2"), s.repo.ImagePath("qemu", "app/web"))
+
+	// This is what we're testing here.
+	var out bytes.Buffer
+	err := InspectInstance(s.repo, "app", "table", &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(out.String(), MatchesMultiline, "(?m)^Name: +app$")
+	c.Check(out.String(), MatchesMultiline, "(?m)^Status: +Stopped$")
+	c.Check(out.String(), MatchesMultiline, "(?m)^Image: +app/web$")
+	c.Check(out.String(), MatchesMultiline, "(?m)^Image checksum: +sha256:6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d$")
+	c.Check(out.String(), MatchesMultiline, "(?m)^Created: +[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}$")
+	c.Check(out.String(), MatchesMultiline, "(?m)^Capstan version: +v0.3.0$")
+	c.Check(out.String(), MatchesMultiline, "(?m)^Memory: +512M$")
+	c.Check(out.String(), MatchesMultiline, "(?m)^Autostart: +false$")
+
+	out.Reset()
+	c.Assert(InspectInstance(s.repo, "app", "json", &out), IsNil)
+	var info InstanceInfo
+	c.Assert(json.Unmarshal(out.Bytes(), &info), IsNil)
+	c.Check(info.Name, Equals, "app")
+	c.Check(info.CapstanVersion, Equals, "v0.3.0")
+
+	c.Check(InspectInstance(s.repo, "missing", "table", &out), ErrorMatches, "Instance missing does not exist")
+}
+
+func (s *suite) TestPrune(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+
+	usedImage := s.repo.ImagePath("qemu", "app/web")
+	// Composed images record the loader they were composed from, unlike
+	// loaders and images pulled from remote repositories.
+	composed := "format_version: \"1\"\nloader: mike/osv-loader\n"
+	pulled := "format_version: \"1\"\nversion: v0.24\n"
+	PrepareFiles(s.repo.RepoPath(), map[string]string{
+		"/app/web/web.qemu":                "image",
+		"/app/web/index.yaml":              composed,
+		"/app/db/db.qemu":                  "image",
+		"/app/db/index.yaml":               composed,
+		"/old/old.qemu":                    "image",
+		"/old/index.yaml":                  composed,
+		"/mike/osv-loader/osv-loader.qemu": "image",
+		"/mike/osv-loader/index.yaml":      pulled,
+		"/mike/osv-loader-rofs-v0.24/osv-loader-rofs-v0.24.qemu": "image",
+		"/mike/osv-loader-rofs-v0.24/index.yaml":                 pulled,
+		"/cloudius/base/base.qemu":                               "image",
+		"/cloudius/base/index.yaml":                              pulled,
+	})
+	instances := filepath.Join(util.ConfigDir(), "instances", "qemu")
+	for name, files := range map[string]map[string]string{
+		"dead":   {"/disk.qcow2": ""},
+		"stale":  {"/osv.config": "", "/osv.monitor": ""},
+		"broken": {"/osv.config": "", "/disk.qcow2": "/missing/image.qemu"},
+		"ok":     {"/osv.config": "", "/disk.qcow2": usedImage},
+	} {
+		dir := filepath.Join(instances, name)
+		c.Assert(os.MkdirAll(dir, 0775), IsNil)
+		for file, content := range files {
+			if file == "/disk.qcow2" {
+				writeOverlayDisk(c, dir+file, content)
+			} else {
+				c.Assert(ioutil.WriteFile(dir+file, []byte(content), 0644), IsNil)
+			}
+		}
+	}
+
+	// This is what we're testing here.
+	items, err := FindPrunable(s.repo, true, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	reasons := make(map[string]string)
+	for _, item := range items {
+		reasons[item.Path] = item.Reason
+	}
+	c.Check(reasons, DeepEquals, map[string]string{
+		filepath.Join(instances, "dead"):                 "instance without configuration",
+		filepath.Join(instances, "stale", "osv.monitor"): "stale monitor socket",
+		filepath.Join(instances, "broken"):               "disk based on missing image /missing/image.qemu",
+		filepath.Join(s.repo.RepoPath(), "app", "db"):    "image not used by any instance",
+		filepath.Join(s.repo.RepoPath(), "old"):          "image not used by any instance",
+	})
+
+	// Loaders and pulled images are only pruned with all images.
+	items, err = FindPrunable(s.repo, true, true)
+	c.Assert(err, IsNil)
+	var images []string
+	for _, item := range items {
+		if rel, err := filepath.Rel(s.repo.RepoPath(), item.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			images = append(images, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(images)
+	c.Check(images, DeepEquals, []string{"app/db", "cloudius/base", "mike/osv-loader", "mike/osv-loader-rofs-v0.24", "old"})
+
+	// Nothing is removed unless confirmed.
+	var out bytes.Buffer
+	c.Assert(Prune(s.repo, false, false, false, strings.NewReader("n\n"), &out), IsNil)
+	c.Check(out.String(), Matches, "(?s).*Remove 3 item\\(s\\)\\? \\[y/N\\] Nothing removed\n")
+	_, err = os.Stat(filepath.Join(instances, "dead"))
+	c.Check(err, IsNil)
+
+	c.Assert(Prune(s.repo, false, false, false, strings.NewReader("y\n"), &out), IsNil)
+	entries, _ := ioutil.ReadDir(instances)
+	c.Assert(entries, HasLen, 2)
+	c.Check(entries[0].Name(), Equals, "ok")
+	c.Check(entries[1].Name(), Equals, "stale")
+	_, err = os.Stat(filepath.Join(instances, "stale", "osv.monitor"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	out.Reset()
+	c.Assert(Prune(s.repo, false, false, true, nil, &out), IsNil)
+	c.Check(out.String(), Equals, "Nothing to prune\n")
+}
+
+func (s *suite) TestRestartDelay(c *C) {
+	// This is what we're testing here.
+	var delays []time.Duration
+	for restarts := 0; restarts < 8; restarts++ {
+		delays = append(delays, restartDelay(restarts))
+	}
+
+	// Expectations.
+	c.Check(delays, DeepEquals, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute})
+}
+
+func (s *suite) TestReplicas(c *C) {
+	// This is what we're testing here.
+	names := []string{replicaName("web", 1), replicaName("web", 2), replicaName("web%d.test", 3)}
+	taken := make(map[string]bool)
+	rules := []nat.Rule{{HostPort: "8000", GuestPort: "8000"}, {HostPort: "2222", GuestPort: "22"}, {HostPort: "8000", GuestPort: "53", Protocol: "udp"}}
+	first, err := replicaNatRules(rules, 1, taken)
+	c.Assert(err, IsNil)
+	second, err := replicaNatRules(rules, 2, taken)
+	c.Assert(err, IsNil)
+
+	// Expectations.
+	c.Check(names, DeepEquals, []string{"web-1", "web-2", "web3.test"})
+	c.Check(first, DeepEquals, rules)
+	c.Check(taken, DeepEquals, map[string]bool{"8000/tcp": true, "2222/tcp": true, "8000/udp": true,
+		second[0].HostPort + "/tcp": true, second[1].HostPort + "/tcp": true, second[2].HostPort + "/udp": true})
+	c.Assert(second, HasLen, 3)
+	c.Check(second[0].GuestPort, Equals, "8000")
+	c.Check(second[1].GuestPort, Equals, "22")
+	c.Check(second[2].Proto(), Equals, "udp")
+	c.Check(second[0].HostPort, Not(Equals), second[1].HostPort)
+	for _, rule := range second {
+		c.Check(rule.HostPort, Not(Equals), "8000")
+		c.Check(rule.HostPort, Not(Equals), "2222")
+	}
+}
+
+func (s *suite) TestTopology(c *C) {
+	m := []struct {
+		comment  string
+		topology string
+		expected []string
+		err      string
+	}{
+		{
+			"dependency order",
+			"services:\n  web: {package: ./web, depends_on: [api]}\n  api: {image: app/api, depends_on: [db, cache]}\n" +
+				"  db: {image: app/db}\n  cache: {image: app/cache}\n",
+			[]string{"cache", "db", "api", "web"}, "",
+		},
+		{
+			"bridge network",
+			"name: shop\nnetworks:\n  backend: {bridge: virbr0}\nservices:\n  db: {image: app/db, network: backend}\n",
+			[]string{"db"}, "",
+		},
+		{
+			"dependency cycle",
+			"services:\n  a: {image: x, depends_on: [b]}\n  b: {image: x, depends_on: [a]}\n",
+			nil, "dependency cycle between services: a -> b -> a",
+		},
+		{
+			"unknown dependency",
+			"services:\n  a: {image: x, depends_on: [b]}\n",
+			nil, ".*service a: depends on unknown service b",
+		},
+		{
+			"both image and package",
+			"services:\n  a: {image: x, package: ./a}\n",
+			nil, ".*service a: exactly one of image and package must be given",
+		},
+		{
+			"unknown network",
+			"services:\n  a: {image: x, network: front}\n",
+			nil, ".*service a: unknown network front",
+		},
+		{
+			"invalid port",
+			"services:\n  a: {image: x, ports: [\"8000:http\"]}\n",
+			nil, ".*service a: invalid guest port 'http' in '8000:http'",
+		},
+		{
+			"no services",
+			"name: empty\n",
+			nil, ".*no services listed",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		dir := filepath.Join(c.MkDir(), "demo")
+		c.Assert(os.MkdirAll(dir, 0775), IsNil)
+		path := filepath.Join(dir, core.TopologyFileName)
+		c.Assert(ioutil.WriteFile(path, []byte(args.topology), 0644), IsNil)
+
+		// This is what we're testing here.
+		topology, err := core.ParseTopology(path)
+		var order []string
+		if err == nil {
+			order, err = topology.StartOrder()
+		}
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(order, DeepEquals, args.expected)
+	}
+}
+
+func (s *suite) TestTopologyInstances(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+	dir := filepath.Join(c.MkDir(), "shop")
+	c.Assert(os.MkdirAll(dir, 0775), IsNil)
+	path := filepath.Join(dir, core.TopologyFileName)
+	c.Assert(ioutil.WriteFile(path, []byte("services:\n  db: {image: app/db, ports: [\"5432:5432\"]}\n"), 0644), IsNil)
+	topology, err := core.ParseTopology(path)
+	c.Assert(err, IsNil)
+
+	for name, labels := range map[string]map[string]string{
+		"shop-db":   {TopologyLabel: "shop", ServiceLabel: "db"},
+		"shop-web":  {TopologyLabel: "shop", ServiceLabel: "web"},
+		"other-web": {TopologyLabel: "other", ServiceLabel: "web"},
+	} {
+		instanceDir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+		c.Assert(os.MkdirAll(instanceDir, 0775), IsNil)
+		c.Assert(qemu.StoreConfig(&qemu.VMConfig{Name: name, ConfigFile: filepath.Join(instanceDir, "osv.config"), Labels: labels}), IsNil)
+	}
+
+	// This is what we're testing here.
+	instances, err := TopologyInstances(s.repo, topology.Name)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	var names []string
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+	}
+	c.Check(topology.Name, Equals, "shop")
+	c.Check(names, DeepEquals, []string{"shop-db", "shop-web"})
+}
+
+func (s *suite) TestAllocatePorts(c *C) {
+	busy, err := net.Listen("tcp", ":0")
+	c.Assert(err, IsNil)
+	defer busy.Close()
+	busyPort := fmt.Sprint(busy.Addr().(*net.TCPAddr).Port)
+	free, err := nat.FreePort("tcp")
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	rules, err := allocatePorts([]nat.Rule{{HostPort: free, GuestPort: "8000"}, {GuestPort: "22"}, {GuestPort: "80"}}, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Assert(rules, HasLen, 3)
+	c.Check(rules[0], DeepEquals, nat.Rule{HostPort: free, GuestPort: "8000"})
+	c.Check(rules[1].GuestPort, Equals, "22")
+	c.Check(rules[2].GuestPort, Equals, "80")
+	c.Check(rules[1].HostPort, Not(Equals), "")
+	c.Check(rules[2].HostPort, Not(Equals), "")
+	c.Check(rules[1].HostPort, Not(Equals), rules[2].HostPort)
+
+	_, err = allocatePorts([]nat.Rule{{HostPort: busyPort, GuestPort: "8000"}}, false)
+	c.Check(err, ErrorMatches, "host port "+busyPort+" is already in use, forward another port or use --auto-ports")
+	rules, err = allocatePorts([]nat.Rule{{HostPort: busyPort, GuestPort: "8000"}}, true)
+	c.Assert(err, IsNil)
+	c.Check(rules[0].HostPort, Not(Equals), busyPort)
+	c.Check(rules[0].GuestPort, Equals, "8000")
+	_, err = allocatePorts([]nat.Rule{{HostPort: free, GuestPort: "8000"}, {HostPort: free, GuestPort: "22"}}, true)
+	c.Check(err, ErrorMatches, "host port "+free+" is forwarded more than once")
+}
+
+func (s *suite) TestInstanceImageName(c *C) {
+	// This is what we're testing here.
+	inRepo := instanceImageName(s.repo, s.repo.ImagePath("qemu", "app/web"))
+	outside := instanceImageName(s.repo, "/tmp/custom.qemu")
+
+	// Expectations.
+	c.Check(inRepo, Equals, "app/web")
+	c.Check(outside, Equals, "/tmp/custom.qemu")
+}
+
+func (s *suite) TestExecCommand(c *C) {
+	execPollInterval = time.Millisecond
+	consoleLog := filepath.Join(c.MkDir(), "console.log")
+	c.Assert(ioutil.WriteFile(consoleLog, []byte("OSv booted\n"), 0644), IsNil)
+	appendConsole := func(text string) {
+		f, err := os.OpenFile(consoleLog, os.O_APPEND|os.O_WRONLY, 0644)
+		c.Assert(err, IsNil)
+		defer f.Close()
+		f.WriteString(text)
+	}
+	var command string
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "PUT" && req.URL.Path == "/app/":
+			command = req.URL.Query().Get("command")
+			appendConsole("bin\n")
+			w.Write([]byte("42"))
+		case req.URL.Path == "/app/finished" && req.URL.Query().Get("tid") == "42":
+			polls++
+			if polls == 2 {
+				appendConsole("etc\n")
+			}
+			w.Write([]byte(fmt.Sprint(polls > 1)))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	var out bytes.Buffer
+
+	// This is what we're testing here.
+	err := execCommand(server.URL, consoleLog, "/tools/ls.so /etc", true, &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(command, Equals, "/tools/ls.so /etc")
+	c.Check(polls, Equals, 2)
+	c.Check(out.String(), Equals, "Started '/tools/ls.so /etc' as thread 42\n"+
+		"bin\netc\n"+
+		"Command '/tools/ls.so /etc' finished\n")
+
+	err = execCommand(server.URL+"/missing", "", "/tools/ls.so", false, &out)
+	c.Check(err, ErrorMatches, "failed to run '/tools/ls.so': 404 Not Found .*")
+}
+
+func (s *suite) TestParseInstancePath(c *C) {
+	m := []struct {
+		comment  string
+		arg      string
+		expected InstancePath
+		remote   bool
+	}{
+		{"instance path", "app:/var/log/app.log", InstancePath{"app", "/var/log/app.log"}, true},
+		{"local path", "logs/app.log", InstancePath{}, false},
+		{"local path with colon", "./a:b", InstancePath{}, false},
+		{"windows drive", `C:\logs`, InstancePath{}, false},
+		{"one-letter instance", "a:/etc/hosts", InstancePath{"a", "/etc/hosts"}, true},
+		{"empty instance", ":/etc/hosts", InstancePath{}, false},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		path, remote := ParseInstancePath(args.arg)
+
+		// Expectations.
+		c.Check(remote, Equals, args.remote)
+		c.Check(path, Equals, args.expected)
+	}
+}
+
+func (s *suite) TestCopyInstanceFile(c *C) {
+	files := map[string]string{"/etc/app.conf": "debug=false\n"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := strings.TrimPrefix(req.URL.Path, "/file")
+		switch req.Method {
+		case "GET":
+			content, ok := files[path]
+			if !ok || req.URL.Query().Get("op") != "GET" {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write([]byte(content))
+		case "POST":
+			file, _, err := req.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := ioutil.ReadAll(file)
+			files[path] = string(data)
+		}
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+	local := c.MkDir()
+
+	// This is what we're testing here.
+	err := CopyInstanceFile("app:/etc/app.conf", local, address)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(local, "app.conf"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "debug=false\n")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(local, "app.conf"), []byte("debug=true\n"), 0644), IsNil)
+	c.Assert(CopyInstanceFile(filepath.Join(local, "app.conf"), "app:/etc/", address), IsNil)
+	c.Check(files["/etc/app.conf"], Equals, "debug=true\n")
+
+	c.Check(CopyInstanceFile("app:/missing.log", local, address), ErrorMatches, "failed to copy /missing.log: 404 Not Found .*")
+	c.Check(CopyInstanceFile(local, local, address), ErrorMatches, "exactly one of the paths .*")
+}
+
+func (s *suite) TestStats(c *C) {
+	var polls int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/os/threads":
+			polls++
+			// Every poll takes a second, half of which the application runs.
+			fmt.Fprintf(w, `{"time_ms": %d, "list": [{"name": "idle0", "cpu_ms": %d}, {"name": "app", "cpu_ms": %d}]}`,
+				polls*1000, polls*500, polls*500)
+		case "/os/memory/total":
+			fmt.Fprint(w, 1073741824)
+		case "/os/memory/free":
+			fmt.Fprint(w, 1073741824-polls*1048576)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	sampler := &osvStatsSampler{client: api.NewClient(server.URL)}
+
+	// This is what we're testing here.
+	var out bytes.Buffer
+	err := printStats(sampler, "json", time.Millisecond, 2, &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	decoder := json.NewDecoder(&out)
+	for _, used := range []int64{2, 3} {
+		var stats InstanceStats
+		c.Assert(decoder.Decode(&stats), IsNil)
+		c.Check(stats.Source, Equals, "osv")
+		c.Check(stats.CPU, Equals, 50.0)
+		c.Check(stats.MemoryUsed, Equals, used*1048576)
+		c.Check(stats.MemoryTotal, Equals, int64(1073741824))
+		c.Check(stats.Threads, Equals, 2)
+	}
+	c.Check(decoder.More(), Equals, false)
+
+	out.Reset()
+	c.Assert(printStats(sampler, "table", time.Millisecond, 1, &out), IsNil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Check(strings.Fields(lines[1])[2:], DeepEquals, []string{"osv", "50.0%", "5M", "1024M", "2"})
+}
+
+func (s *suite) TestWaitForStop(c *C) {
+	defer func(interval time.Duration) { restartPollInterval = interval }(restartPollInterval)
+	restartPollInterval = time.Millisecond
+
+	polls := 0
+	stopping := func() string {
+		polls++
+		if polls < 3 {
+			return "Running"
+		}
+		return "Stopped"
+	}
+	running := func() string { return "Running" }
+
+	// This is what we're testing here.
+	err := waitForStop("app", stopping, time.Minute)
+
+	// Expectations.
+	c.Check(err, IsNil)
+	c.Check(polls, Equals, 3)
+	c.Check(waitForStop("app", running, 10*time.Millisecond), ErrorMatches, "Instance app did not stop within 10ms")
+}
+
+func (s *suite) TestRenameAndCloneInstance(c *C) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", c.MkDir())
+
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", "app")
+	c.Assert(os.MkdirAll(dir, 0775), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "disk.qcow2"), []byte("disk"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "osv.monitor"), nil, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "data.img"), []byte("data"), 0644), IsNil)
+	c.Assert(qemu.StoreConfig(&qemu.VMConfig{
+		Name:        "app",
+		Image:       filepath.Join(dir, "disk.qcow2"),
+		BackingFile: true,
+		InstanceDir: dir,
+		Monitor:     filepath.Join(dir, "osv.monitor"),
+		ConfigFile:  filepath.Join(dir, "osv.config"),
+		MAC:         "52:54:00:12:34:56",
+		Volumes: []util.Volume{
+			{Type: "disk", Source: filepath.Join(dir, "data.img"), Path: "/data"},
+			{Type: "nfs", Source: "nfs://192.168.122.1/export", Path: "/shared"},
+		},
+	}), IsNil)
+
+	// This is what we're testing here.
+	c.Assert(RenameInstance("app", "web"), IsNil)
+	c.Assert(CloneInstance("web", "web2"), IsNil)
+
+	// Expectations.
+	_, err := os.Stat(dir)
+	c.Check(os.IsNotExist(err), Equals, true)
+	for _, name := range []string{"web", "web2"} {
+		newDir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+		conf, err := qemu.LoadConfig(name)
+		c.Assert(err, IsNil)
+		c.Check(conf.Name, Equals, name)
+		c.Check(conf.Image, Equals, filepath.Join(newDir, "disk.qcow2"))
+		c.Check(conf.InstanceDir, Equals, newDir)
+		c.Check(conf.Monitor, Equals, filepath.Join(newDir, "osv.monitor"))
+		c.Check(conf.ConfigFile, Equals, filepath.Join(newDir, "osv.config"))
+		_, err = os.Stat(filepath.Join(newDir, "osv.monitor"))
+		c.Check(os.IsNotExist(err), Equals, true)
+		data, err := ioutil.ReadFile(filepath.Join(newDir, "disk.qcow2"))
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, "disk")
+		c.Check(conf.Volumes, DeepEquals, []util.Volume{
+			{Type: "disk", Source: filepath.Join(newDir, "data.img"), Path: "/data"},
+			{Type: "nfs", Source: "nfs://192.168.122.1/export", Path: "/shared"},
+		})
+		data, err = ioutil.ReadFile(filepath.Join(newDir, "data.img"))
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, "data")
+	}
+	web, _ := qemu.LoadConfig("web")
+	clone, _ := qemu.LoadConfig("web2")
+	c.Check(web.MAC, Equals, "52:54:00:12:34:56")
+	c.Check(clone.MAC, Not(Equals), web.MAC)
+	c.Check(clone.MAC, Matches, "([0-9a-f]{2}:){5}[0-9a-f]{2}")
+
+	c.Check(CloneInstance("web", "web2"), ErrorMatches, "Instance web2 already exists on qemu")
+	c.Check(RenameInstance("web", "a/b"), ErrorMatches, "invalid instance name: 'a/b'")
+	c.Check(RenameInstance("missing", "other"), ErrorMatches, "Instance: missing not found")
+}
 
 func (s *suite) importFakeOSvBootstrapPkg(c *C) {
 	packageYamlText := fixIndent(`
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"runtime"
+	"sync"
+)
+
+// fileWorkers is the number of files that are copied or hashed at once when
+// collecting and composing packages.
+var fileWorkers = runtime.NumCPU()
+
+// fileJobs runs jobs on files with a pool of at most fileWorkers goroutines.
+// All jobs are run, the first error is returned by Wait.
+type fileJobs struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	err   error
+}
+
+func newFileJobs() *fileJobs {
+	workers := fileWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	return &fileJobs{slots: make(chan struct{}, workers)}
+}
+
+// Go runs the job as soon as one of the workers is free. It blocks until
+// then, so that walking a large tree does not queue up all of its files.
+func (j *fileJobs) Go(job func() error) {
+	j.slots <- struct{}{}
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		defer func() { <-j.slots }()
+
+		if err := job(); err != nil {
+			j.mu.Lock()
+			if j.err == nil {
+				j.err = err
+			}
+			j.mu.Unlock()
+		}
+	}()
+}
+
+// Wait waits for all jobs to finish and returns the first error.
+func (j *fileJobs) Wait() error {
+	j.wg.Wait()
+	return j.err
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// AddPort forwards the host port to the guest port of the qemu instance that
+// uses NAT networking, e.g. "8080:8000". The port is forwarded right away if
+// the instance is running, without restarting it, and is stored with the
+// persisted instance so that it is forwarded on later launches too.
+func AddPort(name, rule string) error {
+	r, err := parsePortRule(rule, true)
+	if err != nil {
+		return err
+	}
+	return changePort(name, r, true)
+}
+
+// RemovePort stops forwarding the host port to the qemu instance, see
+// AddPort. The rule is given either as "8080:8000" or only by host port.
+func RemovePort(name, rule string) error {
+	r, err := parsePortRule(rule, false)
+	if err != nil {
+		return err
+	}
+	return changePort(name, r, false)
+}
+
+func changePort(name string, rule nat.Rule, add bool) error {
+	lock, err := util.LockInstance("qemu", name)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+	status, _ := qemu.GetVMStatus(name, dir)
+	running := status == "Running"
+	// Instances that are not persisted exist only while they are running.
+	var c *qemu.VMConfig
+	if _, err := os.Stat(filepath.Join(dir, "osv.config")); err == nil {
+		if c, err = qemu.LoadConfig(name); err != nil {
+			return err
+		}
+	} else if !running {
+		return fmt.Errorf("Instance %s does not exist or is not a qemu instance", name)
+	}
+
+	if c != nil {
+		if c.Networking != "nat" {
+			return fmt.Errorf("Instance %s uses %s networking, ports can only be forwarded with nat", name, c.Networking)
+		}
+		index := -1
+		for i, existing := range c.NatRules {
+			if existing.HostPort == rule.HostPort && existing.Proto() == rule.Proto() {
+				index = i
+			}
+		}
+		if add && index >= 0 {
+			return fmt.Errorf("Host port %s is forwarded to guest port %s already", rule.HostPort, c.NatRules[index].GuestPort)
+		}
+		if !add && index < 0 {
+			return fmt.Errorf("Host port %s is not forwarded", rule.HostPort)
+		}
+		if add {
+			c.NatRules = append(c.NatRules, rule)
+		} else {
+			// The forwarding is removed from the address it was added on.
+			rule.HostIP = c.NatRules[index].HostIP
+			c.NatRules = append(c.NatRules[:index], c.NatRules[index+1:]...)
+		}
+	}
+
+	if running {
+		if add {
+			err = qemu.AddPortForward(name, rule)
+		} else {
+			err = qemu.RemovePortForward(name, rule)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if c != nil {
+		if err := qemu.StoreConfig(c); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case add && c == nil:
+		fmt.Printf("Forwarding host port %s to guest port %s of instance %s until it stops\n", rule.HostPort, rule.GuestPort, name)
+	case add:
+		fmt.Printf("Forwarding host port %s to guest port %s of instance %s\n", rule.HostPort, rule.GuestPort, name)
+	default:
+		fmt.Printf("Host port %s is no longer forwarded to instance %s\n", rule.HostPort, name)
+	}
+	return nil
+}
+
+// parsePortRule parses a port forwarding rule, see nat.ParseRule. Guest port
+// may be omitted unless it is required, e.g. 8080 or 8080/udp, but host port
+// may not.
+func parsePortRule(rule string, guestRequired bool) (nat.Rule, error) {
+	r, err := nat.ParseRule(rule)
+	if err != nil {
+		return nat.Rule{}, err
+	}
+	if r.HostPort == "" {
+		if guestRequired || strings.Contains(rule, ":") {
+			return nat.Rule{}, fmt.Errorf("invalid port forwarding rule '%s', use [<host ip>:]<host port>:<guest port>[/udp]", rule)
+		}
+		r.HostPort, r.GuestPort = r.GuestPort, ""
+	}
+	return r, nil
+}
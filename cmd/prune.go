@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/gce"
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
+	"github.com/mikelangelo-project/capstan/hypervisor/vmw"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// imageHypervisors are extensions of image files in the repository.
+var imageHypervisors = []string{"qemu", "vbox", "vmw", "vmware", "gce", "raw"}
+
+// PruneItem is a leftover that can be removed, either a file or a directory.
+type PruneItem struct {
+	Path   string
+	Reason string
+}
+
+// Prune removes leftovers of instances and, when images is set, images of the
+// repository that no instance is based on, see FindPrunable. Unless force is
+// set, the user is asked for confirmation on in first.
+func Prune(repo *util.Repo, images, all, force bool, in io.Reader, out io.Writer) error {
+	items, err := FindPrunable(repo, images, all)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Fprintln(out, "Nothing to prune")
+		return nil
+	}
+
+	for _, item := range items {
+		fmt.Fprintf(out, "%s (%s)\n", item.Path, item.Reason)
+	}
+	if !force {
+		fmt.Fprintf(out, "Remove %d item(s)? [y/N] ", len(items))
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Fprintln(out, "Nothing removed")
+			return nil
+		}
+	}
+
+	for _, item := range items {
+		if err := os.RemoveAll(item.Path); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "Removed %d item(s)\n", len(items))
+	return nil
+}
+
+// FindPrunable returns leftovers of instances that are not running: instance
+// directories without configuration, stale monitor sockets and instances
+// whose disk is based on an image that no longer exists. When images is set,
+// images of the repository that were composed locally and that no instance is
+// based on are returned too. Loader images and images pulled from remote
+// repositories, which other images are composed from, are only returned when
+// all is set as well.
+func FindPrunable(repo *util.Repo, images, all bool) ([]PruneItem, error) {
+	var items []PruneItem
+	// Files that instances are based on.
+	used := make(map[string]bool)
+
+	instancesDir := filepath.Join(util.ConfigDir(), "instances")
+	platforms, _ := ioutil.ReadDir(instancesDir)
+	for _, platform := range platforms {
+		if !platform.IsDir() {
+			continue
+		}
+		entries, _ := ioutil.ReadDir(filepath.Join(instancesDir, platform.Name()))
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			dir := filepath.Join(instancesDir, platform.Name(), entry.Name())
+			if platform.Name() == "qemu" {
+				items = append(items, pruneQemuInstance(entry.Name(), dir, used)...)
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(dir, "osv.config")); os.IsNotExist(err) {
+				items = append(items, PruneItem{dir, "instance without configuration"})
+				continue
+			}
+			for _, path := range instanceImages(entry.Name(), platform.Name()) {
+				used[filepath.Clean(path)] = true
+			}
+		}
+	}
+
+	if images {
+		imageDirs, err := repositoryImageDirs(repo.RepoPath())
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range imageDirs {
+			inUse := false
+			for path := range used {
+				if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+					inUse = true
+					break
+				}
+			}
+			if inUse {
+				continue
+			}
+			rel, err := filepath.Rel(repo.RepoPath(), dir)
+			if err != nil {
+				return nil, err
+			}
+			if all || repo.IsComposedImage(filepath.ToSlash(rel)) {
+				items = append(items, PruneItem{dir, "image not used by any instance"})
+			}
+		}
+	}
+	return items, nil
+}
+
+// pruneQemuInstance returns leftovers of the qemu instance and records the
+// image its disk is based on.
+func pruneQemuInstance(name, dir string, used map[string]bool) []PruneItem {
+	disk := filepath.Join(dir, "disk.qcow2")
+	backing, err := util.QcowBackingFile(disk)
+	if err == nil && backing != "" {
+		used[filepath.Clean(backing)] = true
+	}
+
+	// Running instances are left alone, even if they are not persisted.
+	if status, _ := qemu.GetVMStatus(name, dir); status == "Running" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "osv.config")); os.IsNotExist(err) {
+		return []PruneItem{{dir, "instance without configuration"}}
+	}
+	if err == nil && backing != "" {
+		if _, err := os.Stat(backing); os.IsNotExist(err) {
+			return []PruneItem{{dir, fmt.Sprintf("disk based on missing image %s", backing)}}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "osv.monitor")); err == nil {
+		return []PruneItem{{filepath.Join(dir, "osv.monitor"), "stale monitor socket"}}
+	}
+	return nil
+}
+
+// instanceImages returns paths of images that the instance is based on.
+func instanceImages(name, platform string) []string {
+	switch platform {
+	case "vbox":
+		if c, err := vbox.LoadConfig(name); err == nil {
+			return []string{c.Image}
+		}
+	case "vmw":
+		if c, err := vmw.LoadConfig(name); err == nil {
+			return []string{c.Image, c.OriginalVMDK}
+		}
+	case "gce":
+		if c, err := gce.LoadConfig(name); err == nil {
+			return []string{c.Tarball}
+		}
+	}
+	return nil
+}
+
+// repositoryImageDirs returns directories of images in the repository, which
+// are either directly in the repository or in a namespace directory.
+func repositoryImageDirs(root string) ([]string, error) {
+	isImageDir := func(dir string) bool {
+		for _, hypervisor := range imageHypervisors {
+			if _, err := os.Stat(filepath.Join(dir, filepath.Base(dir)+"."+hypervisor)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	var dirs []string
+	namespaces, err := ioutil.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, namespace := range namespaces {
+		if !namespace.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, namespace.Name())
+		if isImageDir(dir) {
+			dirs = append(dirs, dir)
+			continue
+		}
+		images, _ := ioutil.ReadDir(dir)
+		for _, image := range images {
+			if image.IsDir() && isImageDir(filepath.Join(dir, image.Name())) {
+				dirs = append(dirs, filepath.Join(dir, image.Name()))
+			}
+		}
+	}
+	return dirs, nil
+}
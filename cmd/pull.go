@@ -13,12 +13,17 @@ import (
 )
 
 func Pull(r *util.Repo, hypervisor string, image string) error {
-	remote, err := util.IsRemoteImage(r.URL, image)
+	url, err := r.FindRemoteImage(image)
 	if err != nil {
 		return err
 	}
-	if remote {
-		return r.DownloadImage(r.URL, hypervisor, image)
+	lock, err := r.LockImage(image)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if url != "" {
+		return r.DownloadImage(url, hypervisor, image)
 	}
 	return r.PullImage(image)
 }
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// reproducibleModTime is the modification time of all files in built
+// packages, so that building the same tree twice results in identical
+// packages.
+var reproducibleModTime = time.Unix(0, 0)
+
+// normalizeTarHeader removes properties of the file that depend on the host
+// it was built on rather than on the content of the package.
+func normalizeTarHeader(header *tar.Header) {
+	header.ModTime = reproducibleModTime
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uid = 0
+	header.Gid = 0
+	header.Uname = ""
+	header.Gname = ""
+}
+
+// sortedUploadPaths returns host paths of the given upload paths sorted by
+// their paths in the image, which places directories before their content.
+func sortedUploadPaths(uploadPaths map[string]string) []string {
+	var srcs []string
+	for src := range uploadPaths {
+		srcs = append(srcs, src)
+	}
+	sort.Slice(srcs, func(i, j int) bool {
+		return uploadPaths[srcs[i]] < uploadPaths[srcs[j]]
+	})
+	return srcs
+}
+
+// ContentDigest returns the SHA256 digest of the files that are uploaded into
+// the image, covering their paths in the image, types, permissions and
+// content. Two images composed from the same content have the same digest
+// even though the images themselves may differ.
+func ContentDigest(uploadPaths map[string]string) (string, error) {
+	hash := sha256.New()
+	for _, src := range sortedUploadPaths(uploadPaths) {
+		info, err := os.Lstat(src)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(hash, "L %s %s\x00", uploadPaths[src], target)
+		case info.IsDir():
+			fmt.Fprintf(hash, "D %s %o\x00", uploadPaths[src], info.Mode().Perm())
+		default:
+			fmt.Fprintf(hash, "F %s %o %d\x00", uploadPaths[src], info.Mode().Perm(), info.Size())
+			file, err := os.Open(src)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(hash, file)
+			file.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// SetResources changes memory and number of CPUs of the persisted qemu
+// instance without recreating it. Values that are not given, i.e. empty
+// memory or zero cpus, are kept. Changes take effect on the next launch of the
+// instance, OSv has no balloon driver that would resize memory of a running
+// instance.
+func SetResources(name, memory string, cpus int) error {
+	if memory == "" && cpus == 0 {
+		return fmt.Errorf("nothing to change, give memory or number of CPUs")
+	}
+	var size int64
+	if memory != "" {
+		var err error
+		if size, err = util.ParseMemSize(memory); err != nil {
+			return err
+		}
+	}
+	if cpus < 0 {
+		return fmt.Errorf("number of CPUs must be at least 1")
+	}
+
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" {
+		return fmt.Errorf("Instance %s does not exist", name)
+	}
+	if platform != "qemu" {
+		return fmt.Errorf("%s: changing resources is only supported for qemu", platform)
+	}
+	lock, err := util.LockInstance(platform, instanceName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	c, err := qemu.LoadConfig(instanceName)
+	if err != nil {
+		return fmt.Errorf("Instance %s is not persisted: %s", instanceName, err)
+	}
+
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", instanceName)
+	status, _ := qemu.GetVMStatus(instanceName, dir)
+	pending := status == "Running" && ((cpus != 0 && cpus != c.Cpus) || (size != 0 && size != c.Memory))
+
+	if size != 0 {
+		c.Memory = size
+	}
+	if cpus != 0 {
+		c.Cpus = cpus
+	}
+	if err := qemu.StoreConfig(c); err != nil {
+		return err
+	}
+
+	fmt.Printf("Instance %s now has %d MB of memory and %d CPUs\n", instanceName, c.Memory, c.Cpus)
+	if pending {
+		fmt.Printf("Changes take effect when instance %s is restarted\n", instanceName)
+	}
+	return nil
+}
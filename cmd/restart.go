@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// restartPollInterval is how often the instance is checked to have stopped.
+var restartPollInterval = 500 * time.Millisecond
+
+// Restart stops the running instance and launches it again using its
+// persisted configuration, i.e. with the same MAC address, port forwarding
+// rules and disk. Secrets of the image are read again, the same as when the
+// instance is started. If the instance is not running, it is only launched.
+// QEMU instances are asked to power off and are only forced to quit when
+// they do not stop within the timeout, other instances must stop within it.
+func Restart(repo *util.Repo, name string, timeout time.Duration, keyFile string) error {
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" {
+		return fmt.Errorf("Instance %s does not exist", name)
+	}
+	dir := filepath.Join(util.ConfigDir(), "instances", platform, instanceName)
+	status := func() string {
+		return describeInstance(repo, instanceName, platform, dir).Status
+	}
+
+	if status() == "Running" {
+		if err := stopForRestart(instanceName, platform, status, timeout); err != nil {
+			return err
+		}
+	}
+	if platform == "qemu" {
+		qemu.ClearStopRequest(instanceName)
+	}
+
+	fmt.Printf("Restarting instance: %s\n", instanceName)
+	return RunInstance(repo, &runtime.RunConfig{InstanceName: instanceName, KeyFile: keyFile})
+}
+
+// stopForRestart stops the running instance and waits for it to stop. QEMU
+// instances get the chance to shut down on their own before they are forced
+// to quit.
+func stopForRestart(name, platform string, status func() string, timeout time.Duration) error {
+	if platform != "qemu" {
+		if err := Stop(name); err != nil {
+			return err
+		}
+		return waitForStop(name, status, timeout)
+	}
+
+	if err := qemu.PowerdownVM(name); err != nil {
+		return err
+	}
+	if err := waitForStop(name, status, timeout); err == nil {
+		return nil
+	}
+	fmt.Printf("Instance %s did not power off within %s, forcing it to quit\n", name, timeout)
+	if err := qemu.StopVM(name); err != nil {
+		return err
+	}
+	return waitForStop(name, status, timeout)
+}
+
+// waitForStop waits until the status of the instance is no longer Running.
+func waitForStop(name string, status func() string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for status() == "Running" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Instance %s did not stop within %s", name, timeout)
+		}
+		time.Sleep(restartPollInterval)
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
 	"github.com/mikelangelo-project/capstan/hypervisor/vmw"
 	"github.com/mikelangelo-project/capstan/image"
+	"github.com/mikelangelo-project/capstan/nat"
 	"github.com/mikelangelo-project/capstan/runtime"
 	"github.com/mikelangelo-project/capstan/util"
 )
@@ -29,29 +30,87 @@ import (
 func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 	var path string
 	var cmd *exec.Cmd
+	// lock is held while the instance is created, imageLock while it is
+	// created from an image of the repository.
+	var lock, imageLock *util.FileLock
+	defer func() {
+		if lock != nil {
+			lock.Unlock()
+		}
+		if imageLock != nil {
+			imageLock.Unlock()
+		}
+	}()
 
 	// Start an existing instance
 	if config.ImageName == "" && config.InstanceName != "" {
 		instanceName, instancePlatform := util.SearchInstance(config.InstanceName)
 		if instanceName != "" {
+			if len(config.Args) > 0 {
+				return fmt.Errorf("arguments can only be passed when running an image, use -i <image>")
+			}
 			defer fmt.Println("")
 
-			// Do not set RawTerm for gce
-			if instancePlatform != "gce" {
+			// Encryption key and secrets may have to be prompted for, so obtain them
+			// before switching to raw terminal.
+			var keyFile string
+			var natRules []nat.Rule
+			var secrets map[string]string
+			if instancePlatform == "qemu" {
+				dir := filepath.Join(util.ConfigDir(), "instances/qemu", instanceName)
+				var cleanup func()
+				var err error
+				keyFile, cleanup, err = encryptionKeyFile(filepath.Join(dir, "disk.qcow2"), config.KeyFile, dir)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				if c, err := qemu.LoadConfig(instanceName); err == nil {
+					if c.Networking == "nat" {
+						if natRules, err = allocatePorts(c.NatRules, config.AutoPorts); err != nil {
+							return err
+						}
+					}
+					// Secrets are passed to the instance on every launch.
+					if secrets, err = imageSecrets(repo, instancePlatform, c.Metadata.Image); err != nil {
+						return err
+					}
+				}
+			}
+
+			// Do not set RawTerm for gce and instances detached from the terminal
+			if instancePlatform != "gce" && config.Console == nil {
 				util.RawTerm()
 				defer util.ResetTerm()
 			}
 
 			var err error
+			if lock, err = util.LockInstance(instancePlatform, instanceName); err != nil {
+				return err
+			}
 			switch instancePlatform {
 			case "qemu":
 				c, err := qemu.LoadConfig(instanceName)
+				if err != nil {
+					return err
+				}
 				// Also pass the command line to the instance (note that this is not stored in the config)
+				if err := applyEnvOverrides(config, filepath.Join(util.ConfigDir(), "instances/qemu", instanceName, "disk.qcow2")); err != nil {
+					return err
+				}
 				c.Cmd = config.Cmd
-
-				if err != nil {
+				c.EncryptionKeyFile = keyFile
+				if natRules != nil {
+					c.NatRules = natRules
+				}
+				c.Console = config.Console
+				if err := registerManagedHost(c); err != nil {
 					return err
 				}
+
+				// Secrets are removed once the instance exits.
+				c.Secrets = secrets
+				defer qemu.ClearSecrets(c)
 				cmd, err = qemu.LaunchVM(c)
 			case "vbox":
 				c, err := vbox.LoadConfig(instanceName)
@@ -72,6 +131,8 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 				}
 				cmd, err = gce.LaunchVM(c)
 			}
+			lock.Unlock()
+			lock = nil
 
 			if err != nil {
 				return err
@@ -100,11 +161,11 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			} else if image.IsCloudImage(config.ImageName) {
 				path = config.ImageName
 			} else {
-				remote, err := util.IsRemoteImage(repo.URL, config.ImageName)
+				url, err := repo.FindRemoteImage(config.ImageName)
 				if err != nil {
 					return err
 				}
-				if remote {
+				if url != "" {
 					err := Pull(repo, config.Hypervisor, config.ImageName)
 					if err != nil {
 						return err
@@ -132,7 +193,10 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 				path = config.ImageName
 			}
 		}
-		deleteInstance(config.InstanceName)
+		var err error
+		if lock, err = recreateInstance(config); err != nil {
+			return err
+		}
 	} else if config.ImageName == "" && config.InstanceName == "" {
 		if core.IsTemplateFile("Capstanfile") {
 			// Valid only when Capstanfile is present
@@ -153,7 +217,7 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 				if err != nil {
 					return err
 				}
-				if err := Build(repo, image, template, config.Verbose, config.Memory); err != nil {
+				if err := Build(repo, image, template, config.Verbose, memoryOrDefault(config.Memory), 0); err != nil {
 					return err
 				}
 			}
@@ -171,8 +235,10 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			if err != nil {
 				return err
 			}
-			bootOpts := BootOptions{Boot: config.Cmd}
-			err = ComposePackage(repo, sz, true, false, true, wd, pkg.Name, &bootOpts)
+			platform := runtime.PlatformFor(config.Hypervisor)
+			platform.Profile = config.Profile
+			bootOpts := BootOptions{Boot: config.Cmd, Platform: platform}
+			err = ComposePackage(repo, sz, true, false, true, false, wd, pkg.Name, repo.ImageFilesystem(pkg.Name), "", &bootOpts)
 			if err != nil {
 				return err
 			}
@@ -180,13 +246,23 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			return fmt.Errorf("Missing Capstanfile or package metadata")
 		}
 		path = repo.ImagePath(config.Hypervisor, config.ImageName)
-		deleteInstance(config.InstanceName)
+		var err error
+		if lock, err = recreateInstance(config); err != nil {
+			return err
+		}
 	} else {
 		// Cmdline option is not valid
 		usage()
 		return nil
 	}
 
+	if config.ImageName != "" && repo.ImageExists(config.Hypervisor, config.ImageName) {
+		var err error
+		if imageLock, err = repo.LockImageShared(config.ImageName); err != nil {
+			return err
+		}
+	}
+
 	format, err := image.Probe(path)
 	if err != nil {
 		return err
@@ -194,6 +270,34 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 	if format == image.Unknown {
 		return fmt.Errorf("%s: image format not recognized, unable to run it.", path)
 	}
+	applyResources(repo, config)
+	if config.DiskSize > 0 && config.ImageName != "" && repo.ImageFilesystem(config.ImageName) == util.FilesystemROFS {
+		return fmt.Errorf("%s: disk of images with ROFS can not be grown, their filesystem is read-only", config.ImageName)
+	}
+	if config.Networking == "private" && config.GuestNetwork.IsEmpty() {
+		return fmt.Errorf("private networks have no DHCP server, give the instance a static IP with --ip")
+	}
+	if len(config.Args) > 0 {
+		if err := applyArgs(repo, config); err != nil {
+			return err
+		}
+	}
+	if len(config.Env) > 0 {
+		if config.Hypervisor != "qemu" {
+			return fmt.Errorf("%s: environment variables can only be overridden for qemu", config.Hypervisor)
+		}
+		if err := applyEnvOverrides(config, path); err != nil {
+			return err
+		}
+	}
+	if len(config.BootOpts) > 0 {
+		if config.Hypervisor != "qemu" {
+			return fmt.Errorf("%s: kernel options can only be given for qemu", config.Hypervisor)
+		}
+		if err := applyBootOpts(config, path); err != nil {
+			return err
+		}
+	}
 	size, err := util.ParseMemSize(config.Memory)
 	if err != nil {
 		return err
@@ -201,18 +305,55 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 	defer fmt.Println("")
 
 	id := config.InstanceName
+	metadata := util.NewInstanceMetadata(config.ImageName, path)
+
+	// Encryption key and secrets may have to be prompted for, so obtain them before
+	// switching to raw terminal.
+	var keyFile string
+	var secrets map[string]string
+	if config.Hypervisor == "qemu" {
+		var cleanup func()
+		keyFile, cleanup, err = encryptionKeyFile(path, config.KeyFile, filepath.Join(util.ConfigDir(), "instances/qemu", id))
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		if secrets, err = imageSecrets(repo, config.Hypervisor, config.ImageName); err != nil {
+			return err
+		}
+
+		if config.Networking == "nat" {
+			if config.NatRules, err = allocatePorts(config.NatRules, config.AutoPorts); err != nil {
+				return err
+			}
+		}
+	}
+
+	// MAC addresses given by the user must not be used by other instances.
+	if config.MAC != "" && (config.Hypervisor == "qemu" || config.Hypervisor == "vbox") {
+		if err := util.ReserveMAC(id, config.MAC); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("Created instance: %s\n", id)
-	// Do not set RawTerm for gce
-	if config.Hypervisor != "gce" {
+	// Do not set RawTerm for gce and instances detached from the terminal
+	if config.Hypervisor != "gce" && config.Console == nil {
 		util.RawTerm()
 		defer util.ResetTerm()
 	}
 
+	// relaunch starts the instance again when it is supervised.
+	var relaunch func() (*exec.Cmd, error)
+
 	switch config.Hypervisor {
 	case "qemu":
 		dir := filepath.Join(util.ConfigDir(), "instances/qemu", id)
 		bridge := config.Bridge
-		if bridge == "" {
+		if bridge == "" && config.Networking == "private" {
+			bridge = qemu.DefaultPrivateNetwork
+		} else if bridge == "" {
 			bridge = "virbr0"
 		}
 		config := &qemu.VMConfig{
@@ -224,6 +365,8 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			Networking:  config.Networking,
 			Bridge:      bridge,
 			NatRules:    config.NatRules,
+			IPv6Net:     config.IPv6Net,
+			IPv6Host:    config.IPv6Host,
 			BackingFile: true,
 			InstanceDir: dir,
 			Monitor:     filepath.Join(dir, "osv.monitor"),
@@ -231,10 +374,44 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			MAC:         config.MAC,
 			Cmd:         config.Cmd,
 			DisableKvm:  repo.DisableKvm,
-			Persist:     config.Persist,
+			Persist:     config.Persist || config.Autostart || config.CreateTap || len(config.Labels) > 0,
+			Qcow2:       repo.Qcow2,
+			DiskSize:    config.DiskSize,
+			Labels:      config.Labels,
+			Metadata:    metadata,
+			Console:     config.Console,
+			Autostart:   config.Autostart,
+
+			EncryptionKeyFile: keyFile,
+			GuestNetwork:      config.GuestNetwork,
+			NatOptions:        config.NatOptions,
+			CreateTap:         config.CreateTap,
+			TapBridge:         config.TapBridge,
+			IngressRate:       config.IngressRate,
+			EgressRate:        config.EgressRate,
+			Volumes:           instanceVolumes(dir, config),
+			CloudInit:         cloudInit(id, config),
+			CPUModel:          config.CPUModel,
+			CPUFeatures:       repo.ImageCPUFeatures(config.ImageName),
+		}
+
+		if err := registerManagedHost(config); err != nil {
+			return err
 		}
 
-		cmd, err = qemu.LaunchVM(config)
+		// Secrets are removed once the instance exits, each relaunch passes
+		// them again.
+		config.Secrets = secrets
+		defer qemu.ClearSecrets(config)
+
+		// LaunchVM modifies the config, hence each launch gets its own copy.
+		vmConfig := *config
+		relaunch = func() (*exec.Cmd, error) {
+			c := vmConfig
+			return qemu.LaunchVM(&c)
+		}
+		qemu.ClearStopRequest(id)
+		cmd, err = relaunch()
 	case "vbox":
 		if format != image.VDI && format != image.VMDK {
 			return fmt.Errorf("%s: image format of %s is not supported, unable to run it.", config.Hypervisor, path)
@@ -255,6 +432,8 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			NatRules:   config.NatRules,
 			ConfigFile: filepath.Join(dir, "osv.config"),
 			MAC:        config.MAC,
+			Labels:     config.Labels,
+			Metadata:   metadata,
 		}
 		cmd, err = vbox.LaunchVM(config)
 	case "gce":
@@ -270,6 +449,8 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			Zone:        "us-central1-a",
 			ConfigFile:  filepath.Join(dir, "osv.config"),
 			InstanceDir: dir,
+			Labels:      config.Labels,
+			Metadata:    metadata,
 		}
 		if format == image.GCE_TARBALL {
 			c.CloudStoragePath = strings.TrimSuffix(config.GCEUploadDir, "/") + "/" + id + ".tar.gz"
@@ -295,16 +476,31 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			InstanceDir:  dir,
 			OriginalVMDK: path,
 			ConfigFile:   filepath.Join(dir, "osv.config"),
+			Labels:       config.Labels,
+			Metadata:     metadata,
 		}
 		cmd, err = vmw.LaunchVM(config)
 	default:
 		err = fmt.Errorf("%s: is not a supported hypervisor", config.Hypervisor)
 	}
+	if lock != nil {
+		lock.Unlock()
+		lock = nil
+	}
+	if imageLock != nil {
+		imageLock.Unlock()
+		imageLock = nil
+	}
 	if err != nil {
 		return err
 	}
 	if cmd != nil {
-		err = cmd.Wait()
+		supervisionPath := repo.ImageSupervisionPath(config.Hypervisor, config.ImageName)
+		if supervision, serr := runtime.ParseSupervision(supervisionPath); serr == nil && relaunch != nil {
+			err = superviseVM(id, cmd, relaunch, supervision)
+		} else {
+			err = cmd.Wait()
+		}
 		if err != nil && strings.Contains(err.Error(), "failed to initialize KVM: Device or resource busy") {
 			// Probably KVM is already in use e.g. by VirtualBox. Suggest user to turn it off.
 			fmt.Println("Could not run QEMU VM. Try to set 'disable_kvm:true' in ~/.capstan/config.yaml")
@@ -315,6 +511,111 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 	}
 }
 
+// encryptionKeyFile returns the file with the key of the encrypted image or an
+// empty string when the image is not encrypted. Returned cleanup function must
+// be called once the VM exits.
+func encryptionKeyFile(imagePath, keyFile, dir string) (string, func(), error) {
+	if !util.IsEncryptedImage(imagePath) {
+		if keyFile != "" {
+			return "", nil, fmt.Errorf("%s: image is not encrypted", imagePath)
+		}
+		return "", func() {}, nil
+	}
+	return util.EncryptionKeyFile(keyFile, dir, false)
+}
+
+// applyArgs appends arguments to the boot command given with -e or to the boot
+// command of the image that accepts additional arguments.
+func applyArgs(repo *util.Repo, config *runtime.RunConfig) error {
+	cmd := config.Cmd
+	if strings.HasPrefix(cmd, "runscript ") {
+		return fmt.Errorf("arguments cannot be passed to config set selected with --boot")
+	}
+	if cmd == "" {
+		data, err := ioutil.ReadFile(repo.ImageArgsCmdPath(config.Hypervisor, config.ImageName))
+		if err != nil {
+			return fmt.Errorf("%s: image does not accept additional arguments, use -e to set the command line", config.ImageName)
+		}
+		cmd = string(data)
+	}
+
+	config.Cmd = strings.Join(append([]string{cmd}, config.Args...), " ")
+	return nil
+}
+
+// applyEnvOverrides forces environment variables of the run config onto the
+// command line. The command line of the image is used unless one is given.
+func applyEnvOverrides(config *runtime.RunConfig, imagePath string) error {
+	if len(config.Env) == 0 {
+		return nil
+	}
+
+	cmd := config.Cmd
+	if cmd == "" {
+		var err error
+		if cmd, err = util.GetCmdLine(imagePath); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	config.Cmd, err = runtime.ForceEnv(cmd, config.Env)
+	return err
+}
+
+// applyBootOpts applies presets of kernel options of the run config to the
+// command line. The command line of the image is used unless one is given.
+func applyBootOpts(config *runtime.RunConfig, imagePath string) error {
+	cmd := config.Cmd
+	if cmd == "" {
+		var err error
+		if cmd, err = util.GetCmdLine(imagePath); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	config.Cmd, err = config.BootOpts.Apply(cmd)
+	return err
+}
+
+// imageSecrets reads values of the secrets declared by the image. Images
+// without secrets have no secrets file.
+func imageSecrets(repo *util.Repo, hypervisor, image string) (map[string]string, error) {
+	path := repo.ImageSecretsPath(hypervisor, image)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	secrets, err := runtime.ParseSecrets(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse secrets of image %s: %s", image, err)
+	}
+	return secrets.Resolve()
+}
+
+// applyResources fills memory and cpus that were not given on command line with
+// the resources declared by the image, falling back to defaults.
+func applyResources(repo *util.Repo, config *runtime.RunConfig) {
+	resourcesPath := repo.ImageResourcesPath(config.Hypervisor, config.ImageName)
+	if resources, err := runtime.ParseResources(resourcesPath); err == nil {
+		for _, warning := range resources.Apply(config) {
+			fmt.Printf("WARNING: %s\n", warning)
+		}
+	}
+
+	config.Memory = memoryOrDefault(config.Memory)
+	if config.Cpus == 0 {
+		config.Cpus = runtime.DefaultCpus
+	}
+}
+
+func memoryOrDefault(memory string) string {
+	if memory == "" {
+		return runtime.DefaultMemory
+	}
+	return memory
+}
+
 func buildJarImage(repo *util.Repo, config *runtime.RunConfig) (*runtime.RunConfig, error) {
 	jarPath := config.ImageName
 	imageName, jarName := parseJarNames(jarPath)
@@ -330,7 +631,7 @@ func buildJarImage(repo *util.Repo, config *runtime.RunConfig) (*runtime.RunConf
 			targetJarPath: jarPath,
 		},
 	}
-	if err := Build(repo, image, template, config.Verbose, config.Memory); err != nil {
+	if err := Build(repo, image, template, config.Verbose, memoryOrDefault(config.Memory), 0); err != nil {
 		return nil, err
 	}
 	newConfig := *config
@@ -355,6 +656,61 @@ func usage() {
 	fmt.Println("   start an instance using $image_name")
 }
 
+// allocatePorts checks that host ports of the NAT rules are free before the
+// instance is launched. Host ports that are omitted, or that are in use when
+// auto is set, are replaced with free ones. The final mapping is printed.
+func allocatePorts(rules []nat.Rule, auto bool) ([]nat.Rule, error) {
+	// Host ports are taken per protocol, 8000/tcp and 8000/udp are distinct.
+	taken := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.HostPort == "" {
+			continue
+		}
+		if taken[rule.HostPort+"/"+rule.Proto()] {
+			return nil, fmt.Errorf("host port %s is forwarded more than once", rule.HostPort)
+		}
+		taken[rule.HostPort+"/"+rule.Proto()] = true
+	}
+
+	allocated := make([]nat.Rule, len(rules))
+	for i, rule := range rules {
+		if rule.HostPort != "" && !rule.HostPortAvailable() {
+			if !auto {
+				return nil, fmt.Errorf("host port %s is already in use, forward another port or use --auto-ports", rule.HostPort)
+			}
+			fmt.Printf("Host port %s is already in use\n", rule.HostPort)
+			rule.HostPort = ""
+		}
+		if rule.HostPort == "" {
+			port, err := nat.FreePort(rule.Proto())
+			for err == nil && taken[port+"/"+rule.Proto()] {
+				port, err = nat.FreePort(rule.Proto())
+			}
+			if err != nil {
+				return nil, err
+			}
+			rule.HostPort = port
+			taken[port+"/"+rule.Proto()] = true
+		}
+		allocated[i] = rule
+	}
+	if len(allocated) > 0 {
+		fmt.Printf("Forwarding ports: %s\n", strings.Join(natPorts(allocated), ", "))
+	}
+	return allocated, nil
+}
+
+// recreateInstance locks the instance of the config and deletes the instance
+// of the same name. The lock must be held until the new instance is launched.
+func recreateInstance(config *runtime.RunConfig) (*util.FileLock, error) {
+	lock, err := util.LockInstance(config.Hypervisor, config.InstanceName)
+	if err != nil {
+		return nil, err
+	}
+	deleteInstance(config.InstanceName)
+	return lock, nil
+}
+
 func deleteInstance(name string) error {
 	instanceName, instancePlatform := util.SearchInstance(name)
 	if instanceName == "" {
@@ -373,3 +729,42 @@ func deleteInstance(name string) error {
 	}
 	return err
 }
+
+// cloudInit returns cloud-init configuration of the instance, with instance
+// ID and hostname set from the instance unless given, or nil when the
+// instance is not contextualized.
+func cloudInit(id string, config *runtime.RunConfig) *util.CloudInit {
+	if config.CloudInit == nil {
+		return nil
+	}
+	ci := *config.CloudInit
+	if ci.InstanceID == "" {
+		ci.InstanceID = id
+	}
+	if ci.Hostname == "" {
+		ci.Hostname = config.NatOptions.Hostname
+	}
+	if ci.Hostname == "" {
+		ci.Hostname = util.GuestHostname(id)
+	}
+	return &ci
+}
+
+// instanceVolumes returns volumes of the instance along with its data disk and
+// tmpfs mounts.
+func instanceVolumes(dir string, config *runtime.RunConfig) []util.Volume {
+	volumes := append([]util.Volume{}, config.Volumes...)
+	if config.DataDisk != "" {
+		volumes = append(volumes, util.Volume{
+			Type:   "disk",
+			Source: filepath.Join(dir, qemu.DataDiskFileName),
+			Path:   config.DataPath,
+			FS:     "ext",
+			Size:   config.DataDisk,
+		})
+	}
+	for _, path := range config.Tmpfs {
+		volumes = append(volumes, util.Volume{Type: "tmpfs", Path: path})
+	}
+	return volumes
+}
@@ -75,8 +75,13 @@ func RuntimeInit(runtimeName string, plain bool, force bool) error {
 }
 
 func RuntimeList() error {
+	runtimes, err := runtime.AvailableRuntimes()
+	if err != nil {
+		return err
+	}
+
 	fmt.Printf("%-20s%-50s%-20s\n", "RUNTIME", "DESCRIPTION", "DEPENDENCIES")
-	for _, runtimeType := range runtime.SupportedRuntimes {
+	for _, runtimeType := range runtimes {
 		rt, _ := runtime.PickRuntime(runtimeType)
 		fmt.Printf("%-20s%-50s%-20s\n", string(runtimeType), rt.GetRuntimeDescription(), rt.GetDependencies())
 	}
@@ -96,6 +101,12 @@ func removeComments(s string) string {
 }
 
 func composeConf(rt runtime.Runtime) string {
+	return composeConfFromTemplate(rt, rt.GetYamlTemplate())
+}
+
+// composeConfFromTemplate returns meta/run.yaml with the given runtime-specific
+// template used as the content of the config set.
+func composeConfFromTemplate(rt runtime.Runtime, template string) string {
 	res := `
 runtime: RUNTIME
 
@@ -115,7 +126,7 @@ config_set:
 config_set_default: myconfig1
 `
 	// Properly indent runtime-specific part.
-	s := strings.TrimSpace(rt.GetYamlTemplate())
+	s := strings.TrimSpace(template)
 	s = strings.Replace(s, "\n", "\n      ", -1)
 	res = strings.Replace(res, "PLACEHOLDER", s, -1)
 
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// RunReplicas launches the given number of qemu instances of the image at
+// once and waits for all of them to exit. Instances are named after the
+// instance name of the config, see replicaName. The first replica forwards
+// the host ports of the config, the others forward ports that are free.
+// Every replica gets its own MAC address and writes its output into the
+// console file of its directory instead of the terminal.
+func RunReplicas(repo *util.Repo, config *runtime.RunConfig, replicas int) error {
+	if config.Hypervisor != "qemu" {
+		return fmt.Errorf("%s: replicas are only supported for qemu", config.Hypervisor)
+	}
+	if config.MAC != "" {
+		return fmt.Errorf("MAC address can not be given for replicas")
+	}
+	name := config.InstanceName
+	if config.ImageName == "" {
+		// The instance name is actually the image name, like in RunInstance.
+		config.ImageName = name
+		name = strings.Replace(name, "/", "-", -1)
+	}
+	if config.ImageName == "" {
+		return fmt.Errorf("image to run replicas of must be given")
+	}
+
+	// Replicas must not race to pull the image or prompt for its key.
+	path := config.ImageName
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if !repo.ImageExists("qemu", config.ImageName) {
+			if err := Pull(repo, "qemu", config.ImageName); err != nil {
+				return err
+			}
+		}
+		path = repo.ImagePath("qemu", config.ImageName)
+	}
+	if util.IsEncryptedImage(path) && config.KeyFile == "" {
+		return fmt.Errorf("%s: key file must be given to run replicas of encrypted image", config.ImageName)
+	}
+
+	// All replicas are prepared before any is launched.
+	var configs []*runtime.RunConfig
+	taken := make(map[string]bool)
+	for i := 1; i <= replicas; i++ {
+		replica := *config
+		replica.InstanceName = replicaName(name, i)
+		rules, err := replicaNatRules(config.NatRules, i, taken)
+		if err != nil {
+			return err
+		}
+		replica.NatRules = rules
+		mac, err := util.AllocateMAC(replica.InstanceName)
+		if err != nil {
+			return err
+		}
+		replica.MAC = mac.String()
+		configs = append(configs, &replica)
+	}
+
+	runs := newDetachedRuns(repo)
+	for _, replica := range configs {
+		if err := runs.start(replica); err != nil {
+			runs.fail(err)
+			break
+		}
+	}
+	return runs.wait()
+}
+
+// replicaName returns name of the i-th replica, counting from 1. The number
+// replaces %d in the name or is appended to it, e.g. web-1.
+func replicaName(name string, i int) string {
+	if strings.Contains(name, "%d") {
+		return strings.Replace(name, "%d", fmt.Sprint(i), -1)
+	}
+	return fmt.Sprintf("%s-%d", name, i)
+}
+
+// replicaNatRules returns port forwarding rules of the i-th replica. Host
+// ports of the first replica are kept, the others get ports that are free and
+// not taken by other replicas yet. Host ports are taken per protocol, 8000/tcp
+// and 8000/udp are distinct.
+func replicaNatRules(rules []nat.Rule, i int, taken map[string]bool) ([]nat.Rule, error) {
+	if i == 1 {
+		for _, rule := range rules {
+			taken[rule.HostPort+"/"+rule.Proto()] = true
+		}
+		return rules, nil
+	}
+	replica := make([]nat.Rule, len(rules))
+	for j, rule := range rules {
+		port, err := nat.FreePort(rule.Proto())
+		for err == nil && taken[port+"/"+rule.Proto()] {
+			port, err = nat.FreePort(rule.Proto())
+		}
+		if err != nil {
+			return nil, err
+		}
+		taken[port+"/"+rule.Proto()] = true
+		replica[j] = rule
+		replica[j].HostPort = port
+	}
+	return replica, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// PackageFilter narrows down package search results. Empty fields match all
+// packages.
+type PackageFilter struct {
+	Runtime string
+	// Platform matches packages built for the given architecture as well as
+	// packages that do not depend on it.
+	Platform string
+	// Version is a version constraint, e.g. ">=1.2" or "^2".
+	Version string
+}
+
+// Matches reports whether the package passes the filter.
+func (f PackageFilter) Matches(pkg core.Package) (bool, error) {
+	if f.Runtime != "" && !strings.EqualFold(pkg.Runtime, f.Runtime) {
+		return false, nil
+	}
+	if f.Platform != "" && pkg.Platform != "" && pkg.Platform != f.Platform {
+		return false, nil
+	}
+	if f.Version != "" {
+		req, err := core.ParseRequirement(pkg.Name + " " + f.Version)
+		if err != nil {
+			return false, err
+		}
+		return req.Matches(pkg.Version), nil
+	}
+	return true, nil
+}
+
+// PackageSearchResult is a package found in a remote repository.
+type PackageSearchResult struct {
+	Name       string   `json:"name"`
+	Title      string   `json:"title"`
+	Author     string   `json:"author"`
+	Version    string   `json:"version"`
+	Runtime    string   `json:"runtime"`
+	Platform   string   `json:"platform"`
+	Require    []string `json:"require"`
+	Repository string   `json:"repository"`
+}
+
+// SearchPackages searches remote repositories for packages whose names
+// contain the search term and that pass the filter. Results are printed in
+// the given format, either table or json.
+func SearchPackages(repo *util.Repo, search string, filter PackageFilter, format string, out io.Writer) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unsupported format '%s', use one of table|json", format)
+	}
+
+	results := []PackageSearchResult{}
+	for _, url := range repo.RemoteURLs() {
+		packages, err := util.SearchPackagesRemote(url, search)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range packages {
+			matches, err := filter.Matches(pkg)
+			if err != nil {
+				return err
+			}
+			if !matches {
+				continue
+			}
+			results = append(results, PackageSearchResult{
+				Name:       pkg.Name,
+				Title:      pkg.Title,
+				Author:     pkg.Author,
+				Version:    pkg.Version,
+				Runtime:    pkg.Runtime,
+				Platform:   pkg.Platform,
+				Require:    pkg.Require,
+				Repository: url,
+			})
+		}
+	}
+
+	if format == "json" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(data))
+		return nil
+	}
+
+	fmt.Fprintf(out, "%-35s %-35s %-20s %-10s %-10s %s\n", "Name", "Description", "Version", "Runtime", "Platform", "Repository")
+	for _, r := range results {
+		fmt.Fprintf(out, "%-35s %-35s %-20s %-10s %-10s %s\n", r.Name, r.Title, r.Version, r.Runtime, r.Platform, r.Repository)
+	}
+	return nil
+}
@@ -72,7 +72,7 @@ func OpenStackPush(c *cli.Context) error {
 
 	// Compose image locally.
 	fmt.Printf("Creating image of user-usable size %d MB.\n", sizeMB)
-	err = ComposePackage(repo, sizeMB, false, verbose, pullMissing, packageDir, appName, &bootOpts)
+	err = ComposePackage(repo, sizeMB, false, verbose, pullMissing, false, packageDir, appName, util.FilesystemZFS, "", &bootOpts)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/osv/api"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// InstanceStats are resource usage statistics of a running instance. Source
+// is "osv" when they are reported by OSv httpserver and "host" when they are
+// those of the qemu process running the instance. CPU is the percentage of a
+// single CPU used since the previous statistics, memory is in bytes.
+type InstanceStats struct {
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	CPU         float64   `json:"cpu"`
+	MemoryUsed  int64     `json:"memory_used"`
+	MemoryTotal int64     `json:"memory_total,omitempty"`
+	Threads     int       `json:"threads"`
+}
+
+// statsSample is a snapshot of the counters that statistics are computed of.
+type statsSample struct {
+	time        time.Time
+	cpuTime     time.Duration
+	memoryUsed  int64
+	memoryTotal int64
+	threads     int
+}
+
+// statsSampler takes snapshots of counters of a single instance.
+type statsSampler interface {
+	source() string
+	sample() (statsSample, error)
+}
+
+// Stats prints statistics of the running instance every interval in the
+// given format until count statistics are printed, or forever if count is 0.
+// Statistics are taken from OSv httpserver if it is reachable, otherwise from
+// the host process of qemu instances.
+func Stats(name, address, format string, interval time.Duration, count int, out io.Writer) error {
+	sampler, err := newStatsSampler(name, address)
+	if err != nil {
+		return err
+	}
+	return printStats(sampler, format, interval, count, out)
+}
+
+// newStatsSampler returns a sampler using OSv httpserver and falls back to
+// the qemu process when httpserver can not be reached.
+func newStatsSampler(name, address string) (statsSampler, error) {
+	baseURL, urlErr := httpServerURL(name, address)
+	if urlErr == nil {
+		sampler := &osvStatsSampler{client: api.NewClient(baseURL)}
+		if _, urlErr = sampler.sample(); urlErr == nil {
+			return sampler, nil
+		}
+	}
+	if address != "" {
+		return nil, urlErr
+	}
+
+	instanceName, platform := util.SearchInstance(name)
+	if platform != "qemu" {
+		return nil, urlErr
+	}
+	pid, err := qemu.ProcessID(instanceName)
+	if err != nil {
+		return nil, err
+	}
+	sampler := &hostStatsSampler{pid: pid}
+	if c, err := qemu.LoadConfig(instanceName); err == nil {
+		sampler.memoryTotal = c.Memory * 1024 * 1024
+	}
+	if _, err := sampler.sample(); err != nil {
+		return nil, fmt.Errorf("%s; %s", urlErr, err)
+	}
+	return sampler, nil
+}
+
+// printStats prints statistics computed of consecutive samples.
+func printStats(sampler statsSampler, format string, interval time.Duration, count int, out io.Writer) error {
+	previous, err := sampler.sample()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	if format != "json" {
+		fmt.Fprintf(out, "%-20s %-7s %-8s %-10s %-10s %s\n", "Time", "Source", "CPU", "Memory", "Total", "Threads")
+	}
+	for i := 0; count == 0 || i < count; i++ {
+		time.Sleep(interval)
+		current, err := sampler.sample()
+		if err != nil {
+			return err
+		}
+
+		stats := InstanceStats{
+			Time:        current.time,
+			Source:      sampler.source(),
+			MemoryUsed:  current.memoryUsed,
+			MemoryTotal: current.memoryTotal,
+			Threads:     current.threads,
+		}
+		if elapsed := current.time.Sub(previous.time); elapsed > 0 {
+			stats.CPU = float64(current.cpuTime-previous.cpuTime) / float64(elapsed) * 100
+		}
+		previous = current
+
+		if format == "json" {
+			if err := encoder.Encode(stats); err != nil {
+				return err
+			}
+			continue
+		}
+		total := ""
+		if stats.MemoryTotal > 0 {
+			total = fmt.Sprintf("%dM", stats.MemoryTotal/1024/1024)
+		}
+		fmt.Fprintf(out, "%-20s %-7s %-8s %-10s %-10s %d\n", stats.Time.Format("2006-01-02 15:04:05"), stats.Source,
+			fmt.Sprintf("%.1f%%", stats.CPU), fmt.Sprintf("%dM", stats.MemoryUsed/1024/1024), total, stats.Threads)
+	}
+	return nil
+}
+
+// osvStatsSampler takes samples using the REST API of OSv httpserver.
+type osvStatsSampler struct {
+	client *api.Client
+}
+
+func (s *osvStatsSampler) source() string {
+	return "osv"
+}
+
+func (s *osvStatsSampler) sample() (statsSample, error) {
+	threads, err := s.client.Threads()
+	if err != nil {
+		return statsSample{}, err
+	}
+	total, err := s.client.MemoryTotal()
+	if err != nil {
+		return statsSample{}, err
+	}
+	free, err := s.client.MemoryFree()
+	if err != nil {
+		return statsSample{}, err
+	}
+
+	sample := statsSample{
+		time:        time.Unix(0, threads.TimeMs*int64(time.Millisecond)),
+		memoryUsed:  total - free,
+		memoryTotal: total,
+		threads:     len(threads.List),
+	}
+	for _, thread := range threads.List {
+		// Idle threads of OSv run whenever the CPU is not used.
+		if strings.HasPrefix(thread.Name, "idle") {
+			continue
+		}
+		sample.cpuTime += time.Duration(thread.CpuMs) * time.Millisecond
+	}
+	return sample, nil
+}
+
+// hostStatsSampler takes samples of the qemu process running the instance.
+// Memory used is the resident memory of the process, including the memory
+// used by qemu itself.
+type hostStatsSampler struct {
+	pid         int
+	memoryTotal int64
+}
+
+func (s *hostStatsSampler) source() string {
+	return "host"
+}
+
+func (s *hostStatsSampler) sample() (statsSample, error) {
+	stats, err := util.GetProcessStats(s.pid)
+	if err != nil {
+		return statsSample{}, err
+	}
+	return statsSample{
+		time:        time.Now(),
+		cpuTime:     stats.CPUTime,
+		memoryUsed:  stats.RSS,
+		memoryTotal: s.memoryTotal,
+		threads:     stats.Threads,
+	}, nil
+}
@@ -10,6 +10,9 @@ package cmd
 
 import (
 	"fmt"
+	"path/filepath"
+	"time"
+
 	"github.com/mikelangelo-project/capstan/hypervisor/gce"
 	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
 	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
@@ -27,7 +30,10 @@ func Stop(name string) error {
 	var err error
 	switch instancePlatform {
 	case "qemu":
-		err = qemu.StopVM(name)
+		c, _ := qemu.LoadConfig(name)
+		if err = qemu.StopVM(name); err == nil {
+			releaseTap(name, c)
+		}
 	case "vbox":
 		err = vbox.StopVM(name)
 	case "vmw":
@@ -43,3 +49,30 @@ func Stop(name string) error {
 	fmt.Printf("Stopped instance: %s\n", name)
 	return nil
 }
+
+// tapReleaseTimeout is how long an instance is waited for to stop before its
+// tap device is deleted.
+var tapReleaseTimeout = 30 * time.Second
+
+// releaseTap deletes the tap device that was created for the qemu instance
+// once the instance stops. Failures are only reported, the device may be
+// deleted manually.
+func releaseTap(name string, c *qemu.VMConfig) {
+	if c == nil || c.Networking != "tap" || !c.CreateTap {
+		return
+	}
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", name)
+	status := func() string {
+		status, _ := qemu.GetVMStatus(name, dir)
+		return status
+	}
+	err := waitForStop(name, status, tapReleaseTimeout)
+	if err == nil {
+		err = util.DeleteTap(c.Bridge)
+	}
+	if err != nil {
+		fmt.Printf("Failed to delete tap device %s: %s\n", c.Bridge, err)
+		return
+	}
+	fmt.Printf("Deleted tap device: %s\n", c.Bridge)
+}
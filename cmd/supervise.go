@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/runtime"
+)
+
+// Restarts of supervised instances are delayed exponentially, from
+// restartBackoffMin up to restartBackoffMax. Instances that run for
+// restartResetAfter are considered started and the delay starts anew.
+const (
+	restartBackoffMin = time.Second
+	restartBackoffMax = time.Minute
+	restartResetAfter = time.Minute
+)
+
+// restartDelay returns how long to wait before the given restart in a row,
+// counting from 0.
+func restartDelay(restarts int) time.Duration {
+	delay := restartBackoffMin
+	for i := 0; i < restarts && delay < restartBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > restartBackoffMax {
+		return restartBackoffMax
+	}
+	return delay
+}
+
+// superviseVM waits for the qemu instance to exit while probing its health and
+// restarts it according to the restart policy. Restarts are delayed and
+// supervision gives up once the instance keeps exiting shortly after its
+// launch. Instances stopped with 'capstan stop' are never restarted. Note that
+// the terminal is in raw mode.
+func superviseVM(name string, cmd *exec.Cmd, relaunch func() (*exec.Cmd, error), s runtime.Supervision) error {
+	policy := s.GetRestartPolicy()
+	restarts := 0
+	for {
+		launched := time.Now()
+		unhealthy := make(chan struct{})
+		done := make(chan struct{})
+		if s.HealthCheck != nil {
+			go probeHealth(cmd, s.HealthCheck, policy != runtime.RestartNever, unhealthy, done)
+		}
+
+		err := cmd.Wait()
+		close(done)
+
+		failed := err != nil
+		select {
+		case <-unhealthy:
+			failed = true
+		default:
+		}
+
+		if qemu.StopRequested(name) {
+			return err
+		}
+		if policy == runtime.RestartNever || (policy == runtime.RestartOnFailure && !failed) {
+			return err
+		}
+
+		if time.Since(launched) >= restartResetAfter {
+			restarts = 0
+		}
+		if restarts >= s.GetMaxRestarts() {
+			return fmt.Errorf("Instance %s was restarted %d times in a row without running for %s, giving up",
+				name, restarts, restartResetAfter)
+		}
+		delay := restartDelay(restarts)
+		restarts++
+		fmt.Printf("\r\nRestarting instance %s in %s (restart_policy: %s)\r\n", name, delay, policy)
+		time.Sleep(delay)
+		if qemu.StopRequested(name) {
+			return err
+		}
+		if cmd, err = relaunch(); err != nil {
+			return err
+		}
+	}
+}
+
+// probeHealth periodically probes the instance until done is closed. Once the
+// health check fails given number of times in a row, unhealthy is closed and
+// the instance is killed if kill is set.
+func probeHealth(cmd *exec.Cmd, h *runtime.HealthCheck, kill bool, unhealthy, done chan struct{}) {
+	ticker := time.NewTicker(h.GetInterval())
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := h.Probe(); err != nil {
+			failures++
+			if failures < h.GetRetries() {
+				continue
+			}
+			fmt.Printf("\r\nInstance is unhealthy: %s\r\n", err)
+			close(unhealthy)
+			if kill {
+				cmd.Process.Kill()
+			}
+			return
+		}
+		failures = 0
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+const (
+	// TopologyLabel is the label holding the name of the topology that an
+	// instance belongs to.
+	TopologyLabel = "capstan.topology"
+	// ServiceLabel is the label holding the name of the service that an
+	// instance runs.
+	ServiceLabel = "capstan.service"
+)
+
+// dependencyTimeout is how long a service waits for the services it depends
+// on to be running.
+var dependencyTimeout = 60 * time.Second
+
+// ComposeUp brings up all services of the topology file as qemu instances
+// and waits for all of them to exit. Packages of services are composed into
+// images first. Services are started in dependency order, each once the
+// services it depends on are running, and write their output into the
+// console files of their instances.
+func ComposeUp(repo *util.Repo, topologyPath string, imageSize int64, verbose bool) error {
+	topology, err := core.ParseTopology(topologyPath)
+	if err != nil {
+		return err
+	}
+	order, err := topology.StartOrder()
+	if err != nil {
+		return err
+	}
+	instances, err := TopologyInstances(repo, topology.Name)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if instance.Status == "Running" {
+			return fmt.Errorf("topology %s is already up, instance %s is running", topology.Name, instance.Name)
+		}
+	}
+
+	// All services are prepared before any is launched.
+	configs := make(map[string]*runtime.RunConfig)
+	for _, name := range order {
+		config, err := serviceRunConfig(repo, &topology, name, filepath.Dir(topologyPath), imageSize, verbose)
+		if err != nil {
+			return fmt.Errorf("service %s: %s", name, err)
+		}
+		configs[name] = config
+	}
+
+	runs := newDetachedRuns(repo)
+	var started []string
+	for _, name := range order {
+		err := waitForDependencies(&topology, name, runs)
+		if err == nil {
+			fmt.Printf("Starting service %s\n", name)
+			err = runs.start(configs[name])
+		}
+		if err != nil {
+			runs.fail(fmt.Errorf("service %s: %s", name, err))
+			for _, instanceName := range started {
+				qemu.StopVM(instanceName)
+			}
+			break
+		}
+		started = append(started, configs[name].InstanceName)
+	}
+	return runs.wait()
+}
+
+// ComposeDown stops all instances of the topology file. When remove is set,
+// the instances are deleted as well.
+func ComposeDown(repo *util.Repo, topologyPath string, remove bool) error {
+	topology, err := core.ParseTopology(topologyPath)
+	if err != nil {
+		return err
+	}
+	instances, err := TopologyInstances(repo, topology.Name)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		fmt.Printf("No instances of topology %s\n", topology.Name)
+		return nil
+	}
+
+	// Services are stopped in reverse dependency order, followed by instances
+	// of services that were removed from the topology file since.
+	byName := make(map[string]bool)
+	for _, instance := range instances {
+		byName[instance.Name] = true
+	}
+	var names []string
+	order, _ := topology.StartOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		if name := topology.InstanceName(order[i]); byName[name] {
+			names = append(names, name)
+			delete(byName, name)
+		}
+	}
+	for _, instance := range instances {
+		if byName[instance.Name] {
+			names = append(names, instance.Name)
+		}
+	}
+
+	for _, name := range names {
+		if remove {
+			err = Delete(name)
+		} else {
+			err = Stop(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TopologyInstances returns instances that belong to the named topology.
+func TopologyInstances(repo *util.Repo, name string) ([]InstanceInfo, error) {
+	return SelectInstances(repo, TopologyLabel+"="+name)
+}
+
+// serviceRunConfig returns run config of the service, composing its package
+// or pulling its image first.
+func serviceRunConfig(repo *util.Repo, topology *core.Topology, name, topologyDir string, imageSize int64, verbose bool) (*runtime.RunConfig, error) {
+	service := topology.Services[name]
+	config := &runtime.RunConfig{
+		InstanceName: topology.InstanceName(name),
+		ImageName:    service.Image,
+		Hypervisor:   "qemu",
+		Verbose:      verbose,
+		Memory:       service.Memory,
+		Cpus:         service.Cpus,
+		Networking:   "nat",
+		Env:          service.Env,
+		Labels:       map[string]string{TopologyLabel: topology.Name, ServiceLabel: name},
+	}
+	// Ports were validated along with the topology.
+	config.NatRules, _ = nat.Parse(service.Ports)
+	if service.Network != "" {
+		config.Networking = "bridge"
+		config.Bridge = topology.Networks[service.Network].Bridge
+	}
+
+	if service.Package != "" {
+		packageDir := filepath.Join(topologyDir, filepath.FromSlash(service.Package))
+		config.ImageName = topology.InstanceName(name)
+		bootOpts := BootOptions{Boot: service.Boot, PackageDir: packageDir}
+		if err := ComposePackage(repo, imageSize, true, verbose, true, false,
+			packageDir, config.ImageName, repo.ImageFilesystem(config.ImageName), "", &bootOpts); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+
+	if service.Boot != "" {
+		config.Cmd = runtime.BootCmdForScript(service.Boot)
+	}
+	if !repo.ImageExists("qemu", config.ImageName) {
+		if err := Pull(repo, "qemu", config.ImageName); err != nil {
+			return nil, err
+		}
+	}
+	if util.IsEncryptedImage(repo.ImagePath("qemu", config.ImageName)) {
+		return nil, fmt.Errorf("%s: encrypted images can not be run in a topology", config.ImageName)
+	}
+	return config, nil
+}
+
+// waitForDependencies waits until instances of all services that the service
+// depends on are running.
+func waitForDependencies(topology *core.Topology, name string, runs *detachedRuns) error {
+	for _, dependency := range topology.Services[name].DependsOn {
+		instanceName := topology.InstanceName(dependency)
+		dir := filepath.Join(util.ConfigDir(), "instances", "qemu", instanceName)
+		deadline := time.Now().Add(dependencyTimeout)
+		for {
+			if status, _ := qemu.GetVMStatus(instanceName, dir); status == "Running" {
+				break
+			}
+			if runs.hasExited(instanceName) {
+				return fmt.Errorf("service %s it depends on exited, see %s", dependency,
+					filepath.Join(dir, qemu.ConsoleFileName))
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("service %s it depends on is not running after %s", dependency, dependencyTimeout)
+			}
+			time.Sleep(restartPollInterval)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// Up launches the existing qemu instances in the background and waits for
+// all of them to exit. Instances that are running already are skipped. An
+// instance that can not be launched does not prevent the others from being
+// launched, its error is returned once they exit.
+func Up(repo *util.Repo, names []string) error {
+	runs := newDetachedRuns(repo)
+	for _, name := range names {
+		if err := upInstance(runs, name); err != nil {
+			fmt.Printf("Failed to bring up instance %s: %s\n", name, err)
+			runs.fail(fmt.Errorf("instance %s: %s", name, err))
+		}
+	}
+	return runs.wait()
+}
+
+func upInstance(runs *detachedRuns, name string) error {
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" {
+		return fmt.Errorf("instance does not exist")
+	}
+	if platform != "qemu" {
+		return fmt.Errorf("only qemu instances can be brought up")
+	}
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", instanceName)
+	if status, _ := qemu.GetVMStatus(instanceName, dir); status == "Running" {
+		fmt.Printf("Instance %s is running already\n", instanceName)
+		return nil
+	}
+	// There is no terminal to prompt for the key on.
+	if util.IsEncryptedImage(filepath.Join(dir, "disk.qcow2")) {
+		return fmt.Errorf("encrypted instance must be run with 'capstan run --key-file'")
+	}
+
+	qemu.ClearStopRequest(instanceName)
+	return runs.start(&runtime.RunConfig{InstanceName: instanceName})
+}
+
+// AutostartInstances returns names of instances marked for autostart.
+func AutostartInstances(repo *util.Repo) ([]string, error) {
+	instances, err := ListInstances(repo)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, instance := range instances {
+		if instance.Autostart {
+			names = append(names, instance.Name)
+		}
+	}
+	return names, nil
+}
+
+// SetAutostart marks the persisted qemu instance to be launched by
+// 'capstan up --all-autostart', or removes the mark.
+func SetAutostart(name string, autostart bool) error {
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" {
+		return fmt.Errorf("Instance %s does not exist", name)
+	}
+	if platform != "qemu" {
+		return fmt.Errorf("%s: autostart is only supported for qemu", platform)
+	}
+	lock, err := util.LockInstance(platform, instanceName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	c, err := qemu.LoadConfig(instanceName)
+	if err != nil {
+		return fmt.Errorf("Instance %s is not persisted: %s", instanceName, err)
+	}
+
+	c.Autostart = autostart
+	if err := qemu.StoreConfig(c); err != nil {
+		return err
+	}
+	if autostart {
+		fmt.Printf("Instance %s will be autostarted\n", instanceName)
+	} else {
+		fmt.Printf("Instance %s will not be autostarted\n", instanceName)
+	}
+	return nil
+}
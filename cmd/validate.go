@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// ValidatePackage checks meta/package.yaml and meta/run.yaml (when present)
+// of the given package and prints all problems found.
+func ValidatePackage(packageDir string) error {
+	packageProblems, err := validatePackageManifest(packageDir)
+	if err != nil {
+		return err
+	}
+	printProblems("meta/package.yaml", packageProblems)
+
+	var runProblems []error
+	if _, err := os.Stat(filepath.Join(packageDir, "meta", "run.yaml")); err == nil {
+		if runProblems, err = runtime.ValidatePackageRunManifest(packageDir); err != nil {
+			return err
+		}
+		printProblems("meta/run.yaml", runProblems)
+	}
+
+	if count := len(packageProblems) + len(runProblems); count > 0 {
+		return fmt.Errorf("Validation failed: %d problem(s) found", count)
+	}
+
+	fmt.Println("Package is valid")
+	return nil
+}
+
+// packageManifestVersions are format versions of meta/package.yaml, the latest
+// one last, and packageManifestChecks check manifests of each of them.
+var packageManifestVersions = []string{"1"}
+var packageManifestChecks = map[string]func(data []byte, doc map[interface{}]interface{}, locator *util.LineLocator) []error{
+	"1": checkPackageManifestV1,
+}
+
+func validatePackageManifest(packageDir string) ([]error, error) {
+	data, err := ioutil.ReadFile(filepath.Join(packageDir, "meta", "package.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	locator := util.NewLineLocator(data)
+
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []error{err}, nil
+	}
+
+	version, err := util.SchemaVersion(doc, packageManifestVersions, locator)
+	if err != nil {
+		return []error{err}, nil
+	}
+	return packageManifestChecks[version](data, doc, locator), nil
+}
+
+func checkPackageManifestV1(data []byte, doc map[interface{}]interface{}, locator *util.LineLocator) []error {
+	problems := util.CheckSchema(doc, reflect.TypeOf(core.Package{}), nil, locator)
+	for _, key := range []string{"name", "title", "author"} {
+		if value, ok := doc[key]; !ok || value == nil || value == "" {
+			problems = append(problems, util.SchemaError{Message: fmt.Sprintf("'%s' must be provided", key)})
+		}
+	}
+
+	// Parse errors are only reported when the schema did not already explain
+	// them.
+	if len(problems) == 0 {
+		var pkg core.Package
+		if err := pkg.Parse(data); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+func printProblems(file string, problems []error) {
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", file, p)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// VendorPath returns the directory holding vendored packages of the package.
+func VendorPath(packageDir string) string {
+	return filepath.Join(packageDir, core.VendorDirName)
+}
+
+// VendorPackages copies all packages required by the package in packageDir,
+// including runtime dependencies and the bootstrap package, from the local
+// repository into its vendor directory. Packages that were vendored before
+// are removed, so that the directory matches the current requirements. Other
+// files in the directory are left intact.
+func VendorPackages(repo *util.Repo, packageDir string, pullMissing bool) error {
+	pkg, err := packageWithImplicitRequirements(packageDir)
+	if err != nil {
+		return err
+	}
+
+	requiredPackages, err := repo.GetPackageDependencies(pkg, pullMissing)
+	if err != nil {
+		return err
+	}
+
+	vendorPath := VendorPath(packageDir)
+	if err := os.MkdirAll(vendorPath, 0775); err != nil {
+		return err
+	}
+	vendored, err := vendoredFiles(vendorPath)
+	if err != nil {
+		return err
+	}
+	for _, f := range vendored {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range requiredPackages {
+		for _, src := range []string{repo.PackagePath(p.Name), repo.PackageManifest(p.Name)} {
+			if err := util.CopyLocalFile(filepath.Join(vendorPath, filepath.Base(src)), src); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Vendored %s %s\n", p.Name, p.Version)
+	}
+
+	fmt.Printf("%d packages vendored into %s\n", len(requiredPackages), vendorPath)
+	return nil
+}
+
+// packageWithImplicitRequirements returns the manifest of the package in
+// packageDir that additionally requires runtime dependencies of all its config
+// sets and the bootstrap package, i.e. all packages the package is composed
+// with.
+func packageWithImplicitRequirements(packageDir string) (core.Package, error) {
+	pkg, err := core.ParsePackageManifest(filepath.Join(packageDir, "meta", "package.yaml"))
+	if err != nil {
+		return pkg, err
+	}
+	if err := pkg.ResolveLocalRequirements(packageDir); err != nil {
+		return pkg, err
+	}
+
+	cmdConf, err := runtime.ParsePackageRunManifest(packageDir)
+	if err != nil && !os.IsNotExist(err) {
+		return pkg, err
+	}
+	if cmdConf != nil {
+		pkg.Require = append(cmdConf.GetDependencies(), pkg.Require...)
+	}
+	pkg.Require = append(pkg.Require, "osv.bootstrap")
+	return pkg, nil
+}
+
+// vendoredFiles returns paths of package files and manifests in the vendor
+// directory.
+func vendoredFiles(vendorPath string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"*.mpm", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(vendorPath, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// isVendoredFile reports whether the path relative to the package directory is
+// a vendored package file or manifest.
+func isVendoredFile(relPath string) bool {
+	dir, name := filepath.Split(relPath)
+	if filepath.Clean(dir) != "/"+core.VendorDirName {
+		return false
+	}
+	ext := filepath.Ext(name)
+	return ext == ".mpm" || ext == ".yaml"
+}
+
+// UseVendoredPackages makes the repository resolve packages exclusively from
+// the vendor directory of the package.
+func UseVendoredPackages(repo *util.Repo, packageDir string) error {
+	vendorPath := VendorPath(packageDir)
+	if _, err := os.Stat(vendorPath); err != nil {
+		return fmt.Errorf("%s not found, vendor required packages with 'capstan package vendor'", vendorPath)
+	}
+	repo.PackagesDir = vendorPath
+	return nil
+}
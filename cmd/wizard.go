@@ -0,0 +1,229 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// entrypointFields maps runtimes to the field of run.yaml that holds the
+// entrypoint of the application. Runtimes not listed use 'main'.
+var entrypointFields = map[runtime.RuntimeType]string{
+	runtime.Native: "bootcmd",
+	runtime.Erlang: "release",
+}
+
+// capstanignoreTemplates hold starter .capstanignore patterns for runtimes.
+var capstanignoreTemplates = map[runtime.RuntimeType][]string{
+	runtime.NodeJS: {"/npm-debug.log", "/**/*.log"},
+	runtime.Java:   {"/src", "/target", "/build", "/.gradle"},
+	runtime.Python: {"/**/__pycache__", "/**/*.pyc", "/venv", "/.venv"},
+	runtime.Golang: {"/**/*.go", "/vendor"},
+	runtime.Ruby:   {"/.bundle", "/log", "/tmp"},
+	runtime.Dotnet: {"/obj"},
+	runtime.Erlang: {"/_build/test"},
+}
+
+// wizard asks questions and reads answers from the given streams.
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints the question and returns the answer or the default value when
+// the answer is empty. Answers are asked for again until valid.
+func (w *wizard) ask(question, def string, valid func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(w.out, "%s: ", question)
+		}
+
+		line, err := w.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", fmt.Errorf("no answer to '%s'", question)
+		}
+
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if valid != nil {
+			if err := valid(answer); err != nil {
+				fmt.Fprintf(w.out, "Invalid answer: %s\n", err)
+				continue
+			}
+		}
+		return answer, nil
+	}
+}
+
+// InitPackageInteractive asks for package details, runtime, entrypoint and
+// resources and writes meta/package.yaml, meta/run.yaml and .capstanignore.
+// Values of the given package and runtime are offered as defaults.
+func InitPackageInteractive(packagePath string, defaults *core.Package, runtimeName string, in io.Reader, out io.Writer) error {
+	w := &wizard{in: bufio.NewReader(in), out: out}
+	required := func(s string) error {
+		if s == "" {
+			return fmt.Errorf("value is required")
+		}
+		return nil
+	}
+
+	if defaults.Name == "" {
+		if abs, err := filepath.Abs(packagePath); err == nil {
+			defaults.Name = filepath.Base(abs)
+		}
+	}
+	if defaults.Author == "" {
+		defaults.Author = os.Getenv("USER")
+	}
+	if runtimeName == "" {
+		runtimeName = string(runtime.Native)
+	}
+
+	p := &core.Package{Require: defaults.Require}
+	var err error
+	if p.Name, err = w.ask("Package name", defaults.Name, required); err != nil {
+		return err
+	}
+	if defaults.Title == "" {
+		defaults.Title = p.Name
+	}
+	if p.Title, err = w.ask("Package title", defaults.Title, required); err != nil {
+		return err
+	}
+	if p.Author, err = w.ask("Package author", defaults.Author, required); err != nil {
+		return err
+	}
+	if p.Version, err = w.ask("Package version", defaults.Version, nil); err != nil {
+		return err
+	}
+
+	// Invalid runtime definitions are reported once the runtime is picked.
+	runtimes, _ := runtime.AvailableRuntimes()
+	var names []string
+	for _, rt := range runtimes {
+		names = append(names, string(rt))
+	}
+	runtimeName, err = w.ask(fmt.Sprintf("Runtime (%s)", strings.Join(names, "|")), runtimeName, func(s string) error {
+		_, err := runtime.PickRuntime(runtime.RuntimeType(s))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	rt, _ := runtime.PickRuntime(runtime.RuntimeType(runtimeName))
+
+	// Answered fields of the config set, in order.
+	var fields yaml.MapSlice
+
+	entrypoint, ok := entrypointFields[runtime.RuntimeType(runtimeName)]
+	if !ok {
+		entrypoint = "main"
+	}
+	value, err := w.ask(fmt.Sprintf("Entrypoint (%s)", entrypoint), "", nil)
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		fields = append(fields, yaml.MapItem{Key: entrypoint, Value: value})
+	}
+
+	value, err = w.ask("Memory (e.g. 512M, leave empty for default)", "", func(s string) error {
+		if s == "" {
+			return nil
+		}
+		_, err := util.ParseMemSize(s)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		fields = append(fields, yaml.MapItem{Key: "memory", Value: value})
+	}
+
+	value, err = w.ask("CPUs (leave empty for default)", "", func(s string) error {
+		if s == "" {
+			return nil
+		}
+		if cpus, err := strconv.Atoi(s); err != nil || cpus < 1 {
+			return fmt.Errorf("positive number expected")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		cpus, _ := strconv.Atoi(value)
+		fields = append(fields, yaml.MapItem{Key: "cpus", Value: cpus})
+	}
+
+	// Write the files.
+	if err := InitPackage(packagePath, p); err != nil {
+		return err
+	}
+
+	runYaml, err := composeWizardConf(rt, fields)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(packagePath, "meta", "run.yaml"), []byte(runYaml), 0644); err != nil {
+		return err
+	}
+
+	capstanignorePath := filepath.Join(packagePath, ".capstanignore")
+	if _, err := os.Stat(capstanignorePath); os.IsNotExist(err) {
+		content := "# Files and folders that are not uploaded to the unikernel.\n/.idea\n/.vscode\n/*.mpm\n"
+		for _, pattern := range capstanignoreTemplates[runtime.RuntimeType(runtimeName)] {
+			content += pattern + "\n"
+		}
+		if err := ioutil.WriteFile(capstanignorePath, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(out, "Package initialized. Please review meta/run.yaml and .capstanignore in editor.")
+	return nil
+}
+
+// composeWizardConf returns meta/run.yaml with the answered fields set and
+// the rest of the runtime template commented out for reference.
+func composeWizardConf(rt runtime.Runtime, fields yaml.MapSlice) (string, error) {
+	template := ""
+	if len(fields) > 0 {
+		data, err := yaml.Marshal(fields)
+		if err != nil {
+			return "", err
+		}
+		template = string(data)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(rt.GetYamlTemplate()), "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			line = "# " + line
+		}
+		template += line + "\n"
+	}
+	return composeConfFromTemplate(rt, template), nil
+}
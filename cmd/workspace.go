@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// WorkspaceMember is a package of the workspace.
+type WorkspaceMember struct {
+	Dir     string
+	Package core.Package
+}
+
+// WorkspaceMembers returns members of the workspace in the given directory
+// sorted so that every member follows the members it requires. Members that
+// do not depend on each other keep the order of the workspace file.
+func WorkspaceMembers(workspaceDir string) ([]WorkspaceMember, error) {
+	workspace, err := core.ParseWorkspace(filepath.Join(workspaceDir, core.WorkspaceFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var members []WorkspaceMember
+	byName := make(map[string]int)
+	for _, dir := range workspace.Members {
+		dir = filepath.Join(workspaceDir, filepath.FromSlash(dir))
+		pkg, err := core.ParsePackageManifest(filepath.Join(dir, "meta", "package.yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspace member %s: %s", dir, err)
+		}
+		if err := pkg.ResolveLocalRequirements(dir); err != nil {
+			return nil, fmt.Errorf("invalid workspace member %s: %s", dir, err)
+		}
+		if other, ok := byName[pkg.Name]; ok {
+			return nil, fmt.Errorf("workspace members %s and %s are both named %s", members[other].Dir, dir, pkg.Name)
+		}
+		byName[pkg.Name] = len(members)
+		members = append(members, WorkspaceMember{Dir: dir, Package: pkg})
+	}
+
+	var sorted []WorkspaceMember
+	done := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if done[name] {
+			return nil
+		}
+		for i, n := range path {
+			if n == name {
+				return fmt.Errorf("dependency cycle between workspace members: %s", strings.Join(append(path[i:], name), " -> "))
+			}
+		}
+
+		member := members[byName[name]]
+		for _, require := range member.Package.Require {
+			req, err := core.ParseRequirement(require)
+			if err != nil {
+				return err
+			}
+			if _, ok := byName[req.Name]; ok {
+				if err := visit(req.Name, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		done[name] = true
+		sorted = append(sorted, member)
+		return nil
+	}
+	for _, member := range members {
+		if err := visit(member.Package.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// ComposeWorkspace imports all members of the workspace into the repository
+// in dependency order, so that members can require each other, and composes
+// an image named after the package of every member that has a run
+// configuration, with the given build profile (if any) applied. Names of the
+// composed images are returned.
+func ComposeWorkspace(repo *util.Repo, workspaceDir string, imageSize int64, verbose, pullMissing bool, fs, profile string) ([]string, error) {
+	members, err := WorkspaceMembers(workspaceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []string
+	for _, member := range members {
+		fmt.Printf("Building workspace member %s\n", member.Package.Name)
+		if err := ImportPackage(repo, member.Dir); err != nil {
+			return images, fmt.Errorf("failed to build workspace member %s: %s", member.Package.Name, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(member.Dir, "meta", "run.yaml")); os.IsNotExist(err) {
+			continue
+		}
+		bootOpts := BootOptions{PackageDir: member.Dir, Platform: runtime.Platform{Profile: profile}}
+		if err := ComposePackage(repo, imageSize, false, verbose, pullMissing, false,
+			member.Dir, member.Package.Name, fs, "", &bootOpts); err != nil {
+			return images, fmt.Errorf("failed to compose workspace member %s: %s", member.Package.Name, err)
+		}
+		images = append(images, member.Package.Name)
+	}
+	return images, nil
+}
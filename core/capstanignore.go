@@ -11,6 +11,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -18,12 +19,22 @@ import (
 type Capstanignore interface {
 	LoadFile(path string) error
 	AddPattern(pattern string) error
+	LoadIncludeFile(path string) error
+	AddIncludePattern(pattern string) error
+	AddTargetPattern(pattern string, selected bool) error
 	PrintPatterns()
+	PrintIncludePatterns()
 	IsIgnored(path string) bool
+	MayIncludeBeneath(dir string) bool
 }
 
+// CapstanincludeFileName is the name of the file in the package directory
+// listing the only paths that are uploaded.
+const CapstanincludeFileName = ".capstaninclude"
+
 var CAPSTANIGNORE_ALWAYS []string = []string{
-	"/meta/*", "/mpm-pkg", "/.git", "/.capstanignore", "/.gitignore",
+	"/meta/*", "/mpm-pkg", "/.git", "/.capstanignore", "/" + CapstanincludeFileName, "/.gitignore", "/" + LockFileName,
+	"/" + VendorDirName + "/*.mpm", "/" + VendorDirName + "/*.yaml",
 }
 
 // CapstanignoreInit creates a new Capstanignore struct that is
@@ -43,9 +54,10 @@ func CapstanignoreInit(path string) (Capstanignore, error) {
 		}
 	}
 
-	// Always ignore some common paths.
+	// Always ignore some common paths, negated patterns do not apply to them.
 	for _, pattern := range CAPSTANIGNORE_ALWAYS {
 		c.AddPattern(pattern)
+		c.always = append(c.always, c.compiledPatterns[len(c.compiledPatterns)-1])
 	}
 	return &c, nil
 }
@@ -53,11 +65,27 @@ func CapstanignoreInit(path string) (Capstanignore, error) {
 type capstanignore struct {
 	patterns         []string         // list of all ignored patterns
 	compiledPatterns []*regexp.Regexp // list of compiled patterns
+	negated          []bool           // whether the pattern re-includes paths
+	always           []*regexp.Regexp // compiled patterns that can not be negated
+	includePatterns  []string         // list of included patterns, empty to include everything
+	compiledIncludes []*regexp.Regexp // list of compiled included patterns
+	otherTargets     []*regexp.Regexp // compiled patterns of other targets than composed for
+	selectedTargets  []*regexp.Regexp // compiled patterns of targets composed for
 }
 
 // LoadFile attempts to parse .capstanignore file on given path.
 // If success, it remembers all patterns and closes file.
 func (c *capstanignore) LoadFile(path string) error {
+	return loadPatterns(path, c.AddPattern)
+}
+
+// LoadIncludeFile attempts to parse .capstaninclude file on given path.
+// If success, it remembers all patterns and closes file.
+func (c *capstanignore) LoadIncludeFile(path string) error {
+	return loadPatterns(path, c.AddIncludePattern)
+}
+
+func loadPatterns(path string, add func(pattern string) error) error {
 	if file, err := os.Open(path); err == nil {
 		defer file.Close()
 
@@ -67,7 +95,7 @@ func (c *capstanignore) LoadFile(path string) error {
 			if line == "" || strings.HasPrefix(line, "#") {
 				continue
 			}
-			if errPattern := c.AddPattern(line); errPattern != nil {
+			if errPattern := add(line); errPattern != nil {
 				return errPattern
 			}
 		}
@@ -77,7 +105,10 @@ func (c *capstanignore) LoadFile(path string) error {
 	return nil
 }
 
-// AddPattern adds a pattern to be ignored.
+// AddPattern adds a pattern to be ignored. Pattern prefixed with ! re-includes
+// paths that are ignored by preceding patterns, e.g. `/node_modules/*`
+// followed by `!/node_modules/native` ignores all modules but the native one.
+// Use \! for patterns starting with an exclamation mark.
 func (c *capstanignore) AddPattern(pattern string) error {
 	// Protect user from strange behavior when ignoring whole /meta folder.
 	// (runscript files don't get created if ignored)
@@ -85,10 +116,20 @@ func (c *capstanignore) AddPattern(pattern string) error {
 		return fmt.Errorf("please remove '/meta' from .capstanignore")
 	}
 
-	safePattern := transformCapstanignoreToRegex(pattern)
+	negated := false
+	path := pattern
+	if strings.HasPrefix(path, "!") {
+		negated = true
+		path = strings.TrimPrefix(path, "!")
+	} else if strings.HasPrefix(path, "\\!") {
+		path = strings.TrimPrefix(path, "\\")
+	}
+
+	safePattern := transformCapstanignoreToRegex(path)
 	if compiled, err := regexp.Compile(safePattern); err == nil {
 		c.patterns = append(c.patterns, pattern)
 		c.compiledPatterns = append(c.compiledPatterns, compiled)
+		c.negated = append(c.negated, negated)
 	} else {
 		return err
 	}
@@ -96,26 +137,163 @@ func (c *capstanignore) AddPattern(pattern string) error {
 	return nil
 }
 
+// AddIncludePattern adds a pattern to be included. Once any is added, only
+// paths that match an included pattern, together with their content, are
+// uploaded. Ignored patterns still apply to included paths.
+func (c *capstanignore) AddIncludePattern(pattern string) error {
+	compiled, err := regexp.Compile(transformCapstanignoreToRegex(pattern))
+	if err != nil {
+		return err
+	}
+	c.includePatterns = append(c.includePatterns, pattern)
+	c.compiledIncludes = append(c.compiledIncludes, compiled)
+	return nil
+}
+
+// AddTargetPattern adds a pattern of paths that are only uploaded for some
+// targets. Paths matching patterns of other targets, together with their
+// content, are ignored unless they also match a pattern of a selected target.
+func (c *capstanignore) AddTargetPattern(pattern string, selected bool) error {
+	compiled, err := regexp.Compile(transformCapstanignoreToRegex(pattern))
+	if err != nil {
+		return err
+	}
+	if selected {
+		c.selectedTargets = append(c.selectedTargets, compiled)
+	} else {
+		c.otherTargets = append(c.otherTargets, compiled)
+	}
+	return nil
+}
+
 // IsIgnored returns true if path given is on ignore list.
 // But notice that if a folder is ignored, it is up to caller
 // to ignore all files beneath as well. E.g. if pattern `/myfolder`
 // is used, then IsIgnored will return false for all subfolders and
 // files inside the `/myfolder` directory.
+// The last pattern that applies to the path decides. Negated patterns
+// apply to the matching path and everything beneath it. As the caller
+// does not descend into ignored folders, files can not be re-included
+// when their parent folder is ignored, e.g. with `/myfolder` rather than
+// `/myfolder/*`.
 func (c *capstanignore) IsIgnored(path string) bool {
-	for _, pattern := range c.compiledPatterns {
+	for _, pattern := range c.always {
 		if pattern.MatchString(path) {
 			return true
 		}
 	}
+
+	if len(c.compiledIncludes) > 0 && !c.isIncluded(path) {
+		return true
+	}
+
+	if matchesAny(c.otherTargets, path) && !matchesAny(c.selectedTargets, path) {
+		return true
+	}
+
+	ignored := false
+	for i, pattern := range c.compiledPatterns {
+		if c.negated[i] {
+			if ignored && matchesPathOrParent(pattern, path) {
+				ignored = false
+			}
+		} else if !ignored && pattern.MatchString(path) {
+			ignored = true
+		}
+	}
+	return ignored
+}
+
+// matchesPathOrParent reports whether the pattern matches the path or any of
+// its parent folders.
+func matchesPathOrParent(pattern *regexp.Regexp, path string) bool {
+	for ; path != "" && path != "/"; path = path[:strings.LastIndex(path, "/")] {
+		if pattern.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether any of the patterns matches the path or any of
+// its parent folders.
+func matchesAny(patterns []*regexp.Regexp, path string) bool {
+	for _, pattern := range patterns {
+		if matchesPathOrParent(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIncluded reports whether an included pattern matches the path or any of
+// its parent folders.
+func (c *capstanignore) isIncluded(path string) bool {
+	return matchesAny(c.compiledIncludes, path)
+}
+
+// MayIncludeBeneath returns true if the folder is not included itself, but
+// included patterns may match paths beneath it. The caller should then look
+// into the folder instead of ignoring it entirely. E.g. with included pattern
+// `/build/*.jar` this is the case for folder `/build`.
+func (c *capstanignore) MayIncludeBeneath(dir string) bool {
+	if len(c.compiledIncludes) == 0 || c.isIncluded(dir) {
+		return false
+	}
+
+	// Ignored folders are never looked into.
+	ignores := &capstanignore{
+		patterns:         c.patterns,
+		compiledPatterns: c.compiledPatterns,
+		negated:          c.negated,
+		always:           c.always,
+	}
+	if ignores.IsIgnored(dir) {
+		return false
+	}
+
+	var dirSegments []string
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		dirSegments = strings.Split(dir, "/")
+	}
+	for _, pattern := range c.includePatterns {
+		if patternMayMatchBeneath(pattern, dirSegments) {
+			return true
+		}
+	}
 	return false
 }
 
+// patternMayMatchBeneath compares the leading segments of the pattern with
+// segments of the folder.
+func patternMayMatchBeneath(pattern string, dirSegments []string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	for i, segment := range dirSegments {
+		if i >= len(patternSegments) {
+			return false
+		}
+		if patternSegments[i] == "**" {
+			return true
+		}
+		if matched, err := filepath.Match(patternSegments[i], segment); err != nil || !matched {
+			return false
+		}
+	}
+	return len(patternSegments) > len(dirSegments)
+}
+
 func (c *capstanignore) PrintPatterns() {
 	for _, pattern := range c.patterns {
 		fmt.Println(pattern)
 	}
 }
 
+func (c *capstanignore) PrintIncludePatterns() {
+	for _, pattern := range c.includePatterns {
+		fmt.Println(pattern)
+	}
+}
+
 // transformCapstanignoreToRegex transforms capstanignore synstax to regex systax.
 func transformCapstanignoreToRegex(pattern string) string {
 	// preprocess
@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DirectorySize is the size stored in ImageContents for directories.
+const DirectorySize = -1
+
+// ImageContents describes files that were uploaded onto the image. It maps
+// the path of the file inside the image to its size.
+type ImageContents map[string]int64
+
+func NewImageContents() ImageContents {
+	return make(map[string]int64)
+}
+
+// CollectImageContents builds ImageContents from the map of host paths to
+// paths inside the image, as used when uploading files.
+func CollectImageContents(paths map[string]string) (ImageContents, error) {
+	contents := NewImageContents()
+	for src, dest := range paths {
+		info, err := os.Lstat(src)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.IsDir() {
+			contents[dest] = DirectorySize
+		} else {
+			contents[dest] = info.Size()
+		}
+	}
+
+	return contents, nil
+}
+
+// ParseImageContents reads ImageContents from the given file.
+func ParseImageContents(contentsPath string) (ImageContents, error) {
+	data, err := ioutil.ReadFile(contentsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := NewImageContents()
+	if err := yaml.Unmarshal(data, &contents); err != nil {
+		return nil, err
+	}
+
+	return contents, nil
+}
+
+func (c ImageContents) WriteToFile(path string) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Tree renders the contents as an indented file tree with file sizes.
+func (c ImageContents) Tree() string {
+	// Make sure that parent directories are listed even when they were not
+	// uploaded explicitly.
+	all := map[string]int64{}
+	for p, size := range c {
+		all[p] = size
+		for dir := path.Dir(p); dir != "/" && dir != "."; dir = path.Dir(dir) {
+			all[dir] = DirectorySize
+		}
+	}
+
+	paths := make([]string, 0, len(all))
+	for p := range all {
+		paths = append(paths, p)
+	}
+	// Sort component-wise so that children directly follow their parent.
+	sort.Sort(byComponents(paths))
+
+	var buf bytes.Buffer
+	var files, total int64
+	for _, p := range paths {
+		depth := strings.Count(strings.TrimSuffix(p, "/"), "/") - 1
+		name := strings.Repeat("  ", depth) + path.Base(p)
+
+		if all[p] == DirectorySize {
+			fmt.Fprintf(&buf, "%s/\n", name)
+			continue
+		}
+
+		fmt.Fprintf(&buf, "%-60s %10s\n", name, formatSize(all[p]))
+		files++
+		total += all[p]
+	}
+	fmt.Fprintf(&buf, "\n%d files, %s total\n", files, formatSize(total))
+
+	return buf.String()
+}
+
+type byComponents []string
+
+func (p byComponents) Len() int      { return len(p) }
+func (p byComponents) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byComponents) Less(i, j int) bool {
+	return strings.Replace(p[i], "/", "\x00", -1) < strings.Replace(p[j], "/", "\x00", -1)
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LockFileName is the name of the lockfile in the package directory.
+const LockFileName = "capstan.lock"
+
+// VendorDirName is the name of the directory in the package directory that
+// holds vendored copies of required packages.
+const VendorDirName = "vendor"
+
+const lockFileHeader = "# This file is generated by capstan when the package is composed, do not edit.\n"
+
+// LockFile records exact versions and content hashes of all packages that
+// were resolved when the package was composed.
+type LockFile struct {
+	Packages []LockedPackage `yaml:"packages"`
+	// Loader is the OSv loader image that the package was composed with.
+	Loader *LockedPackage `yaml:"loader,omitempty"`
+}
+
+// LockedPackage is a resolved package. Hash is the checksum of the package
+// file in form of <algorithm>:<hex>.
+type LockedPackage struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version,omitempty"`
+	Hash    string `yaml:"hash"`
+}
+
+// ParseLockFile reads the lockfile from the given path.
+func ParseLockFile(path string) (LockFile, error) {
+	var lock LockFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return lock, err
+	}
+
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return lock, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return lock, nil
+}
+
+func (l LockFile) WriteToFile(path string) error {
+	sort.Slice(l.Packages, func(i, j int) bool {
+		return l.Packages[i].Name < l.Packages[j].Name
+	})
+
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append([]byte(lockFileHeader), data...), 0644)
+}
+
+// Diff returns descriptions of differences between the locked packages and
+// the given ones, sorted by package name. It is empty when they are the same.
+func (l LockFile) Diff(other LockFile) []string {
+	locked := make(map[string]LockedPackage)
+	for _, p := range l.Packages {
+		locked[p.Name] = p
+	}
+	resolved := make(map[string]LockedPackage)
+	for _, p := range other.Packages {
+		resolved[p.Name] = p
+	}
+
+	var names []string
+	for name := range locked {
+		names = append(names, name)
+	}
+	for name := range resolved {
+		if _, ok := locked[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diff []string
+	for _, name := range names {
+		l, isLocked := locked[name]
+		r, isResolved := resolved[name]
+		switch {
+		case !isResolved:
+			diff = append(diff, fmt.Sprintf("%s: locked but no longer required", name))
+		case !isLocked:
+			diff = append(diff, fmt.Sprintf("%s: required but not locked", name))
+		case l.Version != r.Version:
+			diff = append(diff, fmt.Sprintf("%s: locked version %s, resolved %s", name, describeLockedVersion(l.Version), describeLockedVersion(r.Version)))
+		case l.Hash != r.Hash:
+			diff = append(diff, fmt.Sprintf("%s: content of version %s differs from the locked one", name, describeLockedVersion(r.Version)))
+		}
+	}
+	return diff
+}
+
+func describeLockedVersion(version string) string {
+	if version == "" {
+		return "(none)"
+	}
+	return version
+}
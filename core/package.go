@@ -12,6 +12,7 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -22,11 +23,78 @@ type Package struct {
 	Version string            "version,omitempty"
 	Require []string          "require,omitempty"
 	Binary  map[string]string "binary,omitempty"
+	// Runtime is the runtime of the package's run configuration (e.g. node
+	// or java) and Platform the architecture its binaries are built for
+	// (e.g. x86_64). Both are empty when not relevant.
+	Runtime  string "runtime,omitempty"
+	Platform string "platform,omitempty"
+	// Checksum is the digest of the package file in form of <algorithm>:<hex>.
+	// It is set when the package is imported into the repository and is used
+	// to verify packages downloaded from the remote repository.
+	Checksum string "checksum,omitempty"
+	// Hooks are host commands run when the package is composed.
+	Hooks PackageHooks "hooks,omitempty"
+	// Symlinks is the policy for symbolic links in the package directory
+	// when its content is collected, one of SymlinksPolicies.
+	Symlinks string "symlinks,omitempty"
+	// Targets lists paths of the package (in .capstanignore syntax) that are
+	// only uploaded when composing for the given targets, e.g. a hypervisor
+	// (gce) or a platform (x86_64).
+	Targets map[string][]string "targets,omitempty"
+	// Profiles are settings that apply when the named build profile is
+	// selected.
+	Profiles map[string]PackageProfile "profiles,omitempty"
+	// Dedup stores identical files of the package only once, as hard links
+	// in the package file and as symbolic links on the composed image.
+	Dedup bool "dedup,omitempty"
+	// Loader is the version of the OSv loader that the package is composed
+	// with, either exact (e.g. 0.24) or a constraint (e.g. ">=0.24 <0.25").
+	Loader string "loader,omitempty"
+	// CPUFeatures are features of the CPU that the package needs, e.g. aes
+	// or sse4.2. Instances of the composed image are only launched on CPUs
+	// that provide them.
+	CPUFeatures []string "cpu_features,omitempty"
+	// FormatVersion is the version of the schema that the manifest is written
+	// for, the latest one when empty.
+	FormatVersion string "format_version,omitempty"
 	// ModTime is currently used only for setting the modification time of local
 	// packages. It is ignored by the YAML parser.
 	ModTime time.Time "-"
 }
 
+// Policies for symbolic links in the package directory. Links are either
+// preserved as links (the default), replaced with content of their targets,
+// or refused.
+const (
+	SymlinksPreserve = "preserve"
+	SymlinksFollow   = "follow"
+	SymlinksError    = "error"
+)
+
+var SymlinksPolicies = []string{SymlinksPreserve, SymlinksFollow, SymlinksError}
+
+// ProfileEnv is the environment variable selecting the build profile (e.g.
+// dev or prod) when none is given with --profile. Build hooks get the
+// selected profile in it.
+const ProfileEnv = "CAPSTAN_PROFILE"
+
+// PackageProfile holds settings of the package that apply when the profile
+// is selected. Ignore patterns (in .capstanignore syntax, including negation)
+// are added to those of .capstanignore, e.g. to leave test fixtures or debug
+// symbols out of production images.
+type PackageProfile struct {
+	Ignore []string "ignore,omitempty"
+}
+
+// PackageHooks are host commands that build the package, e.g. compile the
+// application or bundle its assets. PreCompose commands run before the
+// content of the package is collected and PostCompose commands after the
+// image is composed. Hooks of required packages are never run.
+type PackageHooks struct {
+	PreCompose  []string "pre_compose,omitempty"
+	PostCompose []string "post_compose,omitempty"
+}
+
 func (p *Package) Parse(data []byte) error {
 	if err := yaml.Unmarshal(data, p); err != nil {
 		return err
@@ -44,6 +112,40 @@ func (p *Package) Parse(data []byte) error {
 		return fmt.Errorf("'author' must be provided for the package")
 	}
 
+	for _, require := range p.Require {
+		if _, err := ParseRequirement(require); err != nil {
+			return err
+		}
+	}
+
+	if p.Loader != "" {
+		if _, err := ParseLoaderConstraint(p.Loader); err != nil {
+			return err
+		}
+	}
+
+	if p.Symlinks != "" && p.Symlinks != SymlinksPreserve && p.Symlinks != SymlinksFollow && p.Symlinks != SymlinksError {
+		return fmt.Errorf("unsupported symlinks policy '%s', use one of %s", p.Symlinks, strings.Join(SymlinksPolicies, "|"))
+	}
+
+	return nil
+}
+
+// AddTargetPatterns adds paths that are only uploaded for some targets to
+// the capstanignore. Paths listed for targets other than the given ones are
+// ignored unless they are listed for one of the given targets as well.
+func (p *Package) AddTargetPatterns(capstanignore Capstanignore, targets []string) error {
+	for target, patterns := range p.Targets {
+		selected := false
+		for _, t := range targets {
+			selected = selected || t == target
+		}
+		for _, pattern := range patterns {
+			if err := capstanignore.AddTargetPattern(pattern, selected); err != nil {
+				return fmt.Errorf("invalid path '%s' of target '%s': %s", pattern, target, err)
+			}
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Requirement is a required package, optionally with a constraint on its
+// version, e.g. "openjdk8-zulu-compact1>=1.2", "osv.cli ^1.2" or
+// "osv.httpserver >=2.0 <3.0 || 4.1".
+type Requirement struct {
+	Name string
+	// Constraint is the version constraint as given, empty when any version
+	// is accepted.
+	Constraint string
+	// Ranges are alternatives of which at least one must hold. Comparators
+	// of each range must hold all.
+	Ranges [][]Comparator
+}
+
+// Comparator compares the version of a package with the given version.
+type Comparator struct {
+	Operator string
+	Version  string
+}
+
+// Operators are ordered so that two-character ones are matched first.
+var comparatorOperators = []string{">=", "<=", "==", "!=", ">", "<", "="}
+
+// ParseRequirement parses the package name and the optional version
+// constraint. Constraint consists of comparators with one of operators
+// >= <= > < = != separated by spaces, caret ranges (^1.2 means >=1.2 <2)
+// and tilde ranges (~1.2 means >=1.2 <1.3). Alternatives are separated by ||.
+// Version without operator must match exactly.
+func ParseRequirement(s string) (Requirement, error) {
+	s = strings.TrimSpace(s)
+	req := Requirement{Name: s}
+
+	if i := strings.IndexAny(s, " <>=!^~"); i >= 0 {
+		req.Name = s[:i]
+		req.Constraint = strings.TrimSpace(s[i:])
+	}
+	if req.Name == "" {
+		return req, fmt.Errorf("invalid package name in '%s'", s)
+	}
+	if req.Constraint == "" {
+		return req, nil
+	}
+
+	for _, alternative := range strings.Split(req.Constraint, "||") {
+		tokens := splitComparators(alternative)
+		if len(tokens) == 0 {
+			return req, fmt.Errorf("invalid version constraint in '%s': empty range", s)
+		}
+
+		comparators := []Comparator{}
+		for _, token := range tokens {
+			c, err := parseComparators(token)
+			if err != nil {
+				return req, fmt.Errorf("invalid version constraint in '%s': %s", s, err)
+			}
+			comparators = append(comparators, c...)
+		}
+		req.Ranges = append(req.Ranges, comparators)
+	}
+	return req, nil
+}
+
+// ParseLoaderConstraint parses the version constraint of the OSv loader,
+// which has the same syntax as constraints of required packages.
+func ParseLoaderConstraint(constraint string) (Requirement, error) {
+	req, err := ParseRequirement("loader " + constraint)
+	if err != nil {
+		return req, fmt.Errorf("invalid loader version '%s': %s", constraint, err)
+	}
+	if req.Name != "loader" || req.Constraint == "" {
+		return req, fmt.Errorf("invalid loader version '%s'", constraint)
+	}
+	return req, nil
+}
+
+// splitComparators splits the range into comparators, joining operators that
+// are separated from their versions by spaces, e.g. ">= 1.2".
+func splitComparators(s string) []string {
+	var tokens []string
+	for _, field := range strings.Fields(s) {
+		if n := len(tokens); n > 0 && strings.Trim(tokens[n-1], "<>=!^~") == "" {
+			tokens[n-1] += field
+			continue
+		}
+		tokens = append(tokens, field)
+	}
+	return tokens
+}
+
+var versionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+-]*$`)
+
+// parseComparators parses a single comparator or expands a caret or tilde
+// range into comparators.
+func parseComparators(token string) ([]Comparator, error) {
+	if token == "*" {
+		return nil, nil
+	}
+
+	operator := ""
+	for _, op := range append([]string{"^", "~"}, comparatorOperators...) {
+		if strings.HasPrefix(token, op) {
+			operator = op
+			break
+		}
+	}
+	version := token[len(operator):]
+	if !versionPattern.MatchString(version) {
+		return nil, fmt.Errorf("invalid version '%s'", version)
+	}
+
+	switch operator {
+	case "":
+		operator = "="
+	case "==":
+		operator = "="
+	case "^", "~":
+		upper, err := upperBound(version, operator == "^")
+		if err != nil {
+			return nil, err
+		}
+		return []Comparator{{">=", version}, {"<", upper}}, nil
+	}
+	return []Comparator{{operator, version}}, nil
+}
+
+var releasePattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*`)
+
+// upperBound returns the first version that caret (compatible) or tilde
+// (patch-level) range of the given version does not include.
+func upperBound(version string, caret bool) (string, error) {
+	release := releasePattern.FindString(version)
+	if release == "" {
+		return "", fmt.Errorf("version '%s' of caret or tilde range must be numeric", version)
+	}
+
+	var segments []int
+	for _, s := range strings.Split(release, ".") {
+		n, _ := strconv.Atoi(s)
+		segments = append(segments, n)
+	}
+
+	// Caret allows changes that do not modify the left-most non-zero segment,
+	// tilde allows changes of the patch version only (or the minor version
+	// when it is not given).
+	bump := 0
+	if caret {
+		for bump < len(segments)-1 && segments[bump] == 0 {
+			bump++
+		}
+	} else if len(segments) > 1 {
+		bump = 1
+	}
+
+	var upper []string
+	for _, n := range segments[:bump] {
+		upper = append(upper, strconv.Itoa(n))
+	}
+	upper = append(upper, strconv.Itoa(segments[bump]+1))
+	return strings.Join(upper, "."), nil
+}
+
+// Matches reports whether the given version satisfies the constraint.
+// Packages without version only satisfy requirements without constraint.
+func (r Requirement) Matches(version string) bool {
+	if len(r.Ranges) == 0 {
+		return true
+	}
+	if version == "" {
+		return false
+	}
+
+	for _, comparators := range r.Ranges {
+		matches := true
+		for _, c := range comparators {
+			if !c.Matches(version) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Comparator) Matches(version string) bool {
+	cmp := CompareVersions(version, c.Version)
+	switch c.Operator {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	}
+	return cmp == 0
+}
+
+func (r Requirement) String() string {
+	if r.Constraint == "" {
+		return r.Name
+	}
+	return r.Name + " " + r.Constraint
+}
+
+var versionSegmentPattern = regexp.MustCompile(`[0-9]+|[a-zA-Z]+`)
+
+// CompareVersions compares versions segment by segment, numeric segments by
+// value and others alphabetically, e.g. 1.10 > 1.9 and 0.24 > 0.23-24-gc60331d.
+// Missing segments are considered lower. It returns -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	as := versionSegmentPattern.FindAllString(a, -1)
+	bs := versionSegmentPattern.FindAllString(b, -1)
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.ParseUint(as[i], 10, 64)
+		bn, berr := strconv.ParseUint(bs[i], 10, 64)
+
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				return compareOrdered(an < bn)
+			}
+		case aerr == nil:
+			// Numeric segment is considered newer than a textual one.
+			return 1
+		case berr == nil:
+			return -1
+		case as[i] != bs[i]:
+			return compareOrdered(as[i] < bs[i])
+		}
+	}
+
+	if len(as) != len(bs) {
+		return compareOrdered(len(as) < len(bs))
+	}
+	return 0
+}
+
+func compareOrdered(less bool) int {
+	if less {
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/nat"
+	"gopkg.in/yaml.v2"
+)
+
+// TopologyFileName is the name of the file describing services that are
+// brought up together with 'capstan compose-up'.
+const TopologyFileName = "capstan-compose.yaml"
+
+// topologyNamePattern restricts names of topologies and their services, which
+// become parts of instance and image names.
+var topologyNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// Topology is a set of services, each running in its own instance. Name
+// defaults to the name of the directory of the topology file.
+type Topology struct {
+	Name     string                     `yaml:"name"`
+	Networks map[string]TopologyNetwork `yaml:"networks"`
+	Services map[string]TopologyService `yaml:"services"`
+}
+
+// TopologyNetwork is a host bridge that services can be attached to.
+type TopologyNetwork struct {
+	Bridge string `yaml:"bridge"`
+}
+
+// TopologyService is an instance of the topology. It runs either an image of
+// the repository or the package in the given directory, relative to the
+// topology file. Services that are not attached to any network use NAT and
+// can only be reached through their forwarded ports.
+type TopologyService struct {
+	Image     string            `yaml:"image"`
+	Package   string            `yaml:"package"`
+	Boot      string            `yaml:"boot"`
+	Memory    string            `yaml:"memory"`
+	Cpus      int               `yaml:"cpus"`
+	Network   string            `yaml:"network"`
+	Ports     []string          `yaml:"ports"`
+	Env       map[string]string `yaml:"env"`
+	DependsOn []string          `yaml:"depends_on"`
+}
+
+// ParseTopology reads the topology file from the given path.
+func ParseTopology(path string) (Topology, error) {
+	var topology Topology
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return topology, err
+	}
+
+	if err := yaml.Unmarshal(data, &topology); err != nil {
+		return topology, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	if topology.Name == "" {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return topology, err
+		}
+		topology.Name = filepath.Base(filepath.Dir(absPath))
+	}
+	if err := topology.Validate(); err != nil {
+		return topology, fmt.Errorf("%s: %s", path, err)
+	}
+	return topology, nil
+}
+
+// Validate checks that services of the topology are complete and only refer
+// to networks and services that exist.
+func (t *Topology) Validate() error {
+	if !topologyNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid name '%s': only letters, digits, _ and - are allowed", t.Name)
+	}
+	if len(t.Services) == 0 {
+		return fmt.Errorf("no services listed")
+	}
+	for name, network := range t.Networks {
+		if network.Bridge == "" {
+			return fmt.Errorf("network %s: bridge must be given", name)
+		}
+	}
+	for name, service := range t.Services {
+		if !topologyNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid service name '%s': only letters, digits, _ and - are allowed", name)
+		}
+		if (service.Image == "") == (service.Package == "") {
+			return fmt.Errorf("service %s: exactly one of image and package must be given", name)
+		}
+		if _, ok := t.Networks[service.Network]; service.Network != "" && !ok {
+			return fmt.Errorf("service %s: unknown network %s", name, service.Network)
+		}
+		if service.Network != "" && len(service.Ports) > 0 {
+			return fmt.Errorf("service %s: ports can only be forwarded without network", name)
+		}
+		if _, err := nat.Parse(service.Ports); err != nil {
+			return fmt.Errorf("service %s: %s", name, err)
+		}
+		for _, dependency := range service.DependsOn {
+			if _, ok := t.Services[dependency]; !ok {
+				return fmt.Errorf("service %s: depends on unknown service %s", name, dependency)
+			}
+		}
+	}
+	return nil
+}
+
+// StartOrder returns names of the services sorted so that every service
+// follows the services it depends on. Services that do not depend on each
+// other are sorted by name.
+func (t *Topology) StartOrder() ([]string, error) {
+	var names []string
+	for name := range t.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sorted []string
+	done := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if done[name] {
+			return nil
+		}
+		for i, n := range path {
+			if n == name {
+				return fmt.Errorf("dependency cycle between services: %s", strings.Join(append(path[i:], name), " -> "))
+			}
+		}
+
+		dependencies := append([]string(nil), t.Services[name].DependsOn...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		sorted = append(sorted, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// InstanceName returns name of the instance running the given service.
+func (t *Topology) InstanceName(service string) string {
+	return t.Name + "-" + service
+}
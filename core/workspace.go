@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// WorkspaceFileName is the name of the file in the top-level directory of a
+// workspace that lists its member packages.
+const WorkspaceFileName = "capstan-workspace.yaml"
+
+// Workspace is a set of packages in subdirectories of a single directory
+// (e.g. a monorepo) that are composed together. Members are directories of
+// the packages relative to the workspace directory.
+type Workspace struct {
+	Members []string `yaml:"members"`
+}
+
+// ParseWorkspace reads the workspace file from the given path.
+func ParseWorkspace(path string) (Workspace, error) {
+	var workspace Workspace
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return workspace, err
+	}
+
+	if err := yaml.Unmarshal(data, &workspace); err != nil {
+		return workspace, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	if len(workspace.Members) == 0 {
+		return workspace, fmt.Errorf("%s: no members listed", path)
+	}
+	return workspace, nil
+}
+
+// IsLocalRequirement reports whether the requirement refers to a package by
+// the path of its directory relative to the requiring package, e.g.
+// "../common", rather than by its name.
+func IsLocalRequirement(require string) bool {
+	return strings.HasPrefix(require, "./") || strings.HasPrefix(require, "../")
+}
+
+// ResolveLocalRequirements replaces requirements given by paths relative to
+// the package directory with names of the packages in those directories.
+func (p *Package) ResolveLocalRequirements(packageDir string) error {
+	for i, require := range p.Require {
+		if !IsLocalRequirement(require) {
+			continue
+		}
+		dir := filepath.Join(packageDir, filepath.FromSlash(require))
+		local, err := ParsePackageManifest(filepath.Join(dir, "meta", "package.yaml"))
+		if err != nil {
+			return fmt.Errorf("invalid local requirement '%s': %s", require, err)
+		}
+		p.Require[i] = local.Name
+	}
+	return nil
+}
@@ -10,7 +10,7 @@ package cpio
 
 import (
 	"fmt"
-	"net"
+	"io"
 )
 
 const (
@@ -19,7 +19,7 @@ const (
 	C_ISDIR = 0040000
 )
 
-func WritePadded(c net.Conn, data []byte) {
+func WritePadded(c io.Writer, data []byte) {
 	c.Write(data)
 	partial := len(data) % 4
 	if partial != 0 {
@@ -28,6 +28,22 @@ func WritePadded(c net.Conn, data []byte) {
 	}
 }
 
+// CopyPadded streams exactly size bytes from the reader, padding them the
+// same way as WritePadded, without holding the whole content in memory.
+func CopyPadded(c io.Writer, r io.Reader, size int64) error {
+	if _, err := io.CopyN(c, r, size); err != nil {
+		return err
+	}
+	partial := size % 4
+	if partial != 0 {
+		padding := make([]byte, 4-partial)
+		if _, err := c.Write(padding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func ToWireFormat(filename string, mode uint64, filesize int64) []byte {
 	hdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\u0000",
 		"070701",        // magic
@@ -30,6 +30,8 @@ type VMConfig struct {
 	ConfigFile       string
 	InstanceDir      string
 	BootDisk         string
+	Labels           map[string]string
+	Metadata         util.InstanceMetadata
 }
 
 func LaunchVM(c *VMConfig) (*exec.Cmd, error) {
@@ -232,7 +234,7 @@ func StoreConfig(c *VMConfig) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(c.ConfigFile, data, 0644)
+	return util.WriteFileAtomic(c.ConfigFile, data, 0644)
 }
 
 func LoadConfig(name string) (*VMConfig, error) {
@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qemu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// Features of generations of Intel CPU models, each adds to the previous.
+var (
+	penrynFeatures      = []string{"pni", "ssse3", "sse4_1"}
+	nehalemFeatures     = withFeatures(penrynFeatures, "sse4_2", "popcnt")
+	westmereFeatures    = withFeatures(nehalemFeatures, "aes", "pclmulqdq")
+	sandyBridgeFeatures = withFeatures(westmereFeatures, "x2apic", "avx", "xsave")
+	ivyBridgeFeatures   = withFeatures(sandyBridgeFeatures, "f16c", "rdrand")
+	haswellFeatures     = withFeatures(ivyBridgeFeatures, "fma", "movbe", "avx2", "bmi1", "bmi2")
+)
+
+// withFeatures returns the base features along with additional ones.
+func withFeatures(base []string, features ...string) []string {
+	return append(append([]string{}, base...), features...)
+}
+
+// cpuModelFeatures lists features of common QEMU CPU models as reported in
+// /proc/cpuinfo. Only features in trackedCPUFeatures are listed, others can
+// not be verified for named models.
+var cpuModelFeatures = map[string][]string{
+	"qemu64":         {"pni"},
+	"kvm64":          {"pni"},
+	"Conroe":         {"pni", "ssse3"},
+	"Penryn":         penrynFeatures,
+	"Nehalem":        nehalemFeatures,
+	"Westmere":       westmereFeatures,
+	"SandyBridge":    sandyBridgeFeatures,
+	"IvyBridge":      ivyBridgeFeatures,
+	"Haswell":        haswellFeatures,
+	"Broadwell":      haswellFeatures,
+	"Skylake-Client": haswellFeatures,
+	"Skylake-Server": haswellFeatures,
+	"EPYC":           haswellFeatures,
+}
+
+// trackedCPUFeatures are features that cpuModelFeatures lists.
+var trackedCPUFeatures = map[string]bool{
+	"pni": true, "ssse3": true, "sse4_1": true, "sse4_2": true, "popcnt": true,
+	"aes": true, "pclmulqdq": true, "x2apic": true, "avx": true, "xsave": true,
+	"f16c": true, "rdrand": true, "fma": true, "movbe": true, "avx2": true,
+	"bmi1": true, "bmi2": true,
+}
+
+// cpuModel returns the CPU model that the instance is launched with: the
+// one given or the host CPU with KVM, and QEMU's default one without KVM.
+func (c *VMConfig) cpuModel(kvm bool) string {
+	switch {
+	case c.CPUModel != "":
+		return c.CPUModel
+	case kvm:
+		return "host,+x2apic"
+	}
+	return "qemu64"
+}
+
+// CheckCPUFeatures verifies that the CPU model of the instance provides the
+// CPU features that its image requires, so that the instance fails with a
+// clear message instead of crashing early in boot.
+func CheckCPUFeatures(c *VMConfig) error {
+	if len(c.CPUFeatures) == 0 {
+		return nil
+	}
+	kvm := c.kvmEnabled()
+	host, err := util.HostCPUFeatures()
+	if err != nil {
+		// Features of the host are unknown, hence there is nothing to verify.
+		return nil
+	}
+	model := c.cpuModel(kvm)
+	if missing := missingCPUFeatures(model, kvm, host, c.CPUFeatures); len(missing) > 0 {
+		name := strings.SplitN(model, ",", 2)[0]
+		return fmt.Errorf("CPU model %s lacks features required by the image: %s (choose another model with --cpu or another host)",
+			name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingCPUFeatures returns the required features that the CPU model does
+// not provide. The host CPU model provides features of the host, while named
+// models provide their own features. With KVM, features must also be those
+// of the host, except x2apic which KVM emulates for all models. Features are
+// added and removed from the model with +feature and -feature.
+func missingCPUFeatures(model string, kvm bool, host map[string]bool, required []string) []string {
+	parts := strings.Split(model, ",")
+	// Without KVM, the max model is whatever QEMU emulates.
+	named := parts[0] != "host" && !(parts[0] == "max" && kvm)
+	modelFeatures, known := cpuModelFeatures[parts[0]]
+
+	provided := make(map[string]bool)
+	if named {
+		for _, feature := range modelFeatures {
+			provided[feature] = true
+		}
+	} else {
+		for feature := range host {
+			provided[feature] = true
+		}
+	}
+	for _, modifier := range parts[1:] {
+		switch {
+		case strings.HasPrefix(modifier, "+"):
+			provided[util.NormalizeCPUFeature(modifier[1:])] = true
+		case strings.HasPrefix(modifier, "-"):
+			delete(provided, util.NormalizeCPUFeature(modifier[1:]))
+		case strings.HasSuffix(modifier, "=on"):
+			provided[util.NormalizeCPUFeature(strings.TrimSuffix(modifier, "=on"))] = true
+		case strings.HasSuffix(modifier, "=off"):
+			delete(provided, util.NormalizeCPUFeature(strings.TrimSuffix(modifier, "=off")))
+		}
+	}
+
+	var missing []string
+	for _, feature := range required {
+		feature = util.NormalizeCPUFeature(feature)
+		if kvm && feature == "x2apic" {
+			continue
+		}
+		// Features of unknown models or untracked features can not be
+		// verified unless given explicitly.
+		if named && (!known || !trackedCPUFeatures[feature]) && !provided[feature] {
+			if !kvm || host[feature] {
+				continue
+			}
+		}
+		if !provided[feature] || (kvm && !host[feature]) {
+			missing = append(missing, feature)
+		}
+	}
+	return missing
+}
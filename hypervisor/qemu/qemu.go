@@ -10,10 +10,13 @@ package qemu
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/mikelangelo-project/capstan/nat"
 	"github.com/mikelangelo-project/capstan/util"
 	"gopkg.in/yaml.v1"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -22,6 +25,7 @@ import (
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
 type VMConfig struct {
@@ -41,8 +45,69 @@ type VMConfig struct {
 	Cmd         string
 	DisableKvm  bool
 	Persist     bool
+	Qcow2       util.Qcow2Options
+	DiskSize    int64
+	// EncryptionKeyFile holds the key of LUKS encrypted image. It may be a
+	// temporary file, hence it is never persisted.
+	EncryptionKeyFile string `yaml:"-"`
+	// Secrets are environment variables passed to the instance on top of the
+	// command line. They are never persisted, see ClearSecrets.
+	Secrets map[string]string `yaml:"-"`
+	// secretsOverlay is the overlay of the instance disk that the instance
+	// boots from when secrets are passed to it.
+	secretsOverlay string
+	// Labels are key=value pairs used to select instances.
+	Labels   map[string]string
+	Metadata util.InstanceMetadata
+	// Autostart marks the instance to be launched by 'capstan up --all-autostart'.
+	Autostart bool
+	// IPv6Net enables IPv6 in NAT networking with the given prefix, e.g.
+	// fd00::/64. IPv6Host is the address of the host within it, QEMU picks
+	// one when it is empty.
+	IPv6Net  string `yaml:"ipv6net,omitempty"`
+	IPv6Host string `yaml:"ipv6host,omitempty"`
+	// NatOptions configure the user-mode network of NAT networking.
+	NatOptions nat.Options `yaml:"natoptions,omitempty"`
+	// CreateTap makes capstan create the tap device named by Bridge before
+	// the instance is launched and delete it once the instance is stopped
+	// or deleted. The device is attached to TapBridge, if given.
+	CreateTap bool   `yaml:"createtap,omitempty"`
+	TapBridge string `yaml:"tapbridge,omitempty"`
+	// IngressRate and EgressRate limit the rate of traffic towards and from
+	// the guest using tap networking, e.g. 10mbit, see util.LimitTapRate.
+	IngressRate string `yaml:"ingressrate,omitempty"`
+	EgressRate  string `yaml:"egressrate,omitempty"`
+	// GuestNetwork configures the guest statically with bridge, tap and
+	// private networking. It is applied to the command line on every launch.
+	GuestNetwork util.GuestNetwork `yaml:"guestnetwork,omitempty"`
+	// Volumes are mounted into the guest, disk volumes are attached after
+	// the instance disk. They are applied to the command line on every
+	// launch.
+	Volumes []util.Volume `yaml:"volumes,omitempty"`
+	// CloudInit is written into a seed ISO in the instance directory on
+	// every launch, which is attached as a cdrom.
+	CloudInit *util.CloudInit `yaml:"cloudinit,omitempty"`
+	// CPUModel is the -cpu option of QEMU, the host CPU with KVM unless
+	// given. CPUFeatures are required by the image, they are verified
+	// before every launch, see CheckCPUFeatures.
+	CPUModel    string   `yaml:"cpumodel,omitempty"`
+	CPUFeatures []string `yaml:"cpufeatures,omitempty"`
+	// Console receives output of the instance, which is then detached from
+	// the terminal. It is never persisted.
+	Console io.Writer `yaml:"-"`
 }
 
+// ConsoleFileName is the file in the instance directory that output of the
+// instance is written to when it is detached from the terminal.
+const ConsoleFileName = "console.log"
+
+// CloudInitFileName is the seed ISO of cloud-init in the instance directory.
+const CloudInitFileName = "cloud-init.iso"
+
+// DataDiskFileName is the writable data disk in the instance directory,
+// which is removed along with the instance.
+const DataDiskFileName = "data.img"
+
 type Version struct {
 	Major int
 	Minor int
@@ -57,13 +122,16 @@ func DeleteVM(name string) error {
 		Image:       filepath.Join(dir, "disk.qcow2"),
 		ConfigFile:  filepath.Join(dir, "osv.config"),
 	}
-	cmd := exec.Command("rm", "-f", c.Image, " ", c.Monitor, " ", c.ConfigFile)
+	cmd := exec.Command("rm", "-f", c.Image, " ", c.Monitor, " ", c.ConfigFile, " ", filepath.Join(dir, ConsoleFileName),
+		" ", filepath.Join(dir, CloudInitFileName), " ", filepath.Join(dir, DataDiskFileName))
 	_, err := cmd.Output()
 	if err != nil {
 		fmt.Printf("rm failed: %s, %s", c.Image, c.Monitor)
 		return err
 	}
 
+	os.Remove(secretsOverlayPath(name))
+
 	cmd = exec.Command("rmdir", c.InstanceDir)
 	_, err = cmd.Output()
 	if err != nil {
@@ -71,10 +139,23 @@ func DeleteVM(name string) error {
 		return err
 	}
 
-	return nil
+	return util.ReleaseMAC(name)
 }
 
 func StopVM(name string) error {
+	return sendStopCommands(name, `{ "execute": "system_powerdown" }`, `{ "execute": "quit" }`)
+}
+
+// PowerdownVM asks the guest to shut down by pressing its power button. Unlike
+// StopVM, qemu is not told to quit, so the instance keeps running until the
+// guest powers off.
+func PowerdownVM(name string) error {
+	return sendStopCommands(name, `{ "execute": "system_powerdown" }`)
+}
+
+// sendStopCommands sends the QMP commands that stop the instance to its
+// monitor. Stopped instances are left alone.
+func sendStopCommands(name string, commands ...string) error {
 	dir := filepath.Join(util.ConfigDir(), "instances/qemu", name)
 	c := &VMConfig{
 		Monitor: filepath.Join(dir, "osv.monitor"),
@@ -85,20 +166,19 @@ func StopVM(name string) error {
 		return nil
 	}
 
+	// Let the supervisor of 'capstan run' know that the instance must not be restarted.
+	ioutil.WriteFile(filepath.Join(dir, "osv.stopped"), []byte{}, 0644)
+
 	writer := bufio.NewWriter(conn)
 
 	cmd := `{ "execute": "qmp_capabilities"}`
 	writer.WriteString(cmd)
 
-	cmd = `{ "execute": "system_powerdown" }`
-	writer.WriteString(cmd)
-
-	cmd = `{ "execute": "quit" }`
-	writer.WriteString(cmd)
-
-	writer.Flush()
+	for _, cmd := range commands {
+		writer.WriteString(cmd)
+	}
 
-	return nil
+	return writer.Flush()
 }
 
 func GetVMStatus(name, dir string) (string, error) {
@@ -113,6 +193,138 @@ func GetVMStatus(name, dir string) (string, error) {
 	return "Running", nil
 }
 
+// ProcessID returns the host process ID of the running instance. It is looked
+// up through the QMP monitor, which reports host threads of the vCPUs.
+func ProcessID(name string) (int, error) {
+	session, err := openQMP(name)
+	if err != nil {
+		return 0, err
+	}
+	defer session.close()
+
+	var cpus []struct {
+		ThreadID int `json:"thread-id"`
+	}
+	// query-cpus-fast is not available before QEMU 2.12.
+	if err := session.execute("query-cpus-fast", nil, &cpus); err != nil {
+		if err := session.execute("query-cpus", nil, &cpus); err != nil {
+			return 0, err
+		}
+	}
+	if len(cpus) == 0 {
+		return 0, fmt.Errorf("Instance %s reports no vCPUs", name)
+	}
+	return util.ThreadProcessID(cpus[0].ThreadID)
+}
+
+// AddPortForward forwards the host port to the guest port of the running
+// instance that uses NAT networking.
+func AddPortForward(name string, rule nat.Rule) error {
+	return humanMonitorCommand(name, fmt.Sprintf("hostfwd_add un0 %s-:%s", hostForward(rule), rule.GuestPort))
+}
+
+// RemovePortForward stops forwarding the host port to the running instance
+// that uses NAT networking.
+func RemovePortForward(name string, rule nat.Rule) error {
+	return humanMonitorCommand(name, "hostfwd_remove un0 "+hostForward(rule))
+}
+
+// hostForward returns the host side of the rule in form that hostfwd options
+// expect, i.e. <protocol>:[<host ip>]:<host port>. IPv6 host addresses are
+// enclosed in brackets.
+func hostForward(rule nat.Rule) string {
+	host := rule.HostIP
+	if rule.IsIPv6() {
+		host = "[" + host + "]"
+	}
+	return fmt.Sprintf("%s:%s:%s", rule.Proto(), host, rule.HostPort)
+}
+
+// humanMonitorCommand runs the command of the human monitor through QMP.
+// Commands report failures only in their output, which is empty otherwise.
+func humanMonitorCommand(name, command string) error {
+	session, err := openQMP(name)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	var output string
+	if err := session.execute("human-monitor-command", map[string]string{"command-line": command}, &output); err != nil {
+		return err
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("%s: %s", command, output)
+	}
+	return nil
+}
+
+// qmpSession is a connection to the QMP monitor of a running instance.
+type qmpSession struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+// openQMP connects to the monitor of the instance and negotiates
+// capabilities.
+func openQMP(name string) (*qmpSession, error) {
+	dir := filepath.Join(util.ConfigDir(), "instances/qemu", name)
+	conn, err := net.Dial("unix", filepath.Join(dir, "osv.monitor"))
+	if err != nil {
+		return nil, fmt.Errorf("Instance %s is not running", name)
+	}
+	session := &qmpSession{conn: conn, decoder: json.NewDecoder(conn)}
+
+	// Read the greeting first.
+	var greeting map[string]interface{}
+	if err := session.decoder.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := session.execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// execute runs the command with the given arguments, if any, and unmarshals
+// its return value into v, unless v is nil.
+func (s *qmpSession) execute(command string, arguments interface{}, v interface{}) error {
+	request := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	if err := json.NewEncoder(s.conn).Encode(request); err != nil {
+		return err
+	}
+	// Skip asynchronous events until the reply arrives.
+	for {
+		var reply struct {
+			Return json.RawMessage `json:"return"`
+			Error  *struct {
+				Desc string `json:"desc"`
+			} `json:"error"`
+		}
+		if err := s.decoder.Decode(&reply); err != nil {
+			return err
+		}
+		if reply.Error != nil {
+			return fmt.Errorf("%s: %s", command, reply.Error.Desc)
+		}
+		if reply.Return != nil {
+			if v == nil {
+				return nil
+			}
+			return json.Unmarshal(reply.Return, v)
+		}
+	}
+}
+
+func (s *qmpSession) close() error {
+	return s.conn.Close()
+}
+
 func LoadConfig(name string) (*VMConfig, error) {
 	dir := filepath.Join(util.ConfigDir(), "instances/qemu", name)
 	file := filepath.Join(dir, "osv.config")
@@ -136,10 +348,14 @@ func StoreConfig(c *VMConfig) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(c.ConfigFile, data, 0644)
+	return util.WriteFileAtomic(c.ConfigFile, data, 0644)
 }
 
 func VMCommand(c *VMConfig, extra ...string) (*exec.Cmd, error) {
+	if err := CheckCPUFeatures(c); err != nil {
+		return nil, err
+	}
+
 	if c.BackingFile {
 		dir := c.InstanceDir
 		err := os.MkdirAll(dir, 0775)
@@ -157,7 +373,20 @@ func VMCommand(c *VMConfig, extra ...string) (*exec.Cmd, error) {
 		newDisk := dir + "/disk.qcow2"
 
 		if _, err := os.Stat(newDisk); os.IsNotExist(err) {
-			cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-o", backingFile, newDisk)
+			args := []string{"create", "-f", "qcow2", "-o", c.Qcow2.CreateOptions(backingFile), newDisk}
+			// Whatever the instance writes is encrypted with the key of the
+			// image as well. qemu-img cannot open encrypted backing image, so
+			// the size must be given explicitly.
+			if c.EncryptionKeyFile != "" {
+				info, err := util.ReadImageHeader(image)
+				if err != nil {
+					return nil, err
+				}
+				args = []string{"create", "--object", util.QemuSecretObject(c.EncryptionKeyFile), "-f", "qcow2",
+					"-o", c.Qcow2.CreateOptions(backingFile, "encrypt.format=luks", "encrypt.key-secret="+util.EncryptionSecretID),
+					newDisk, strconv.FormatUint(info.Size, 10)}
+			}
+			cmd := exec.Command("qemu-img", args...)
 			_, err = cmd.Output()
 			if err != nil {
 				fmt.Printf("qemu-img failed: %s", newDisk)
@@ -165,17 +394,102 @@ func VMCommand(c *VMConfig, extra ...string) (*exec.Cmd, error) {
 			}
 		}
 		c.Image = newDisk
+
+		// Merge the overlay with secrets that was left behind by a capstan
+		// that did not exit cleanly.
+		if err := ClearSecrets(c); err != nil {
+			return nil, err
+		}
+
+		// Grow the instance disk if requested. The base image is left intact.
+		if c.DiskSize > 0 {
+			if c.EncryptionKeyFile != "" {
+				return nil, fmt.Errorf("growing disk of encrypted image is not supported")
+			}
+			grown, err := util.GrowImage(c.Image, c.DiskSize, c.Qcow2)
+			if err != nil {
+				return nil, err
+			}
+			if grown {
+				// Keep the command line embedded into the image unless overridden.
+				if c.Cmd == "" {
+					if c.Cmd, err = util.GetCmdLine(c.Image); err != nil {
+						return nil, err
+					}
+				}
+				c.Cmd = util.ExpandFilesystemCmd(c.Cmd)
+			}
+		}
 	}
 
 	if c.Cmd != "" {
 		fmt.Printf("Setting cmdline: %s\n", c.Cmd)
-		util.SetCmdLine(c.Image, c.Cmd)
+		if err := util.SetCmdLine(c.Image, c.Cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.CloudInit != nil {
+		if err := util.CreateCloudInitISO(*c.CloudInit, filepath.Join(c.InstanceDir, CloudInitFileName)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.Volumes) > 0 {
+		if err := util.CreateVolumeDisks(c.Volumes); err != nil {
+			return nil, err
+		}
+		for _, volume := range util.DiskVolumes(c.Volumes) {
+			if _, err := os.Stat(volume.Source); err != nil {
+				return nil, fmt.Errorf("disk of volume %s: %s", volume.Path, err)
+			}
+		}
+		cmdLine, err := util.GetCmdLine(c.Image)
+		if err != nil {
+			return nil, err
+		}
+		if err := util.SetCmdLine(c.Image, util.ApplyVolumes(cmdLine, c.Volumes)); err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.GuestNetwork.IsEmpty() {
+		cmdLine, err := util.GetCmdLine(c.Image)
+		if err != nil {
+			return nil, err
+		}
+		if err := util.SetCmdLine(c.Image, util.ApplyGuestNetwork(cmdLine, c.GuestNetwork)); err != nil {
+			return nil, err
+		}
 	}
 
 	if c.Persist {
 		StoreConfig(c)
 	}
 
+	if len(c.Secrets) > 0 {
+		if !c.BackingFile {
+			return nil, fmt.Errorf("secrets can only be passed to instances with backing file")
+		}
+		fmt.Printf("Passing %d secret(s) to the instance\n", len(c.Secrets))
+		overlay, err := createSecretsOverlay(c)
+		if err != nil {
+			return nil, err
+		}
+		c.secretsOverlay = overlay
+	}
+
+	if c.Networking == "tap" && c.CreateTap {
+		if err := util.CreateTap(c.Bridge, c.TapBridge); err != nil {
+			return nil, err
+		}
+	}
+	if c.Networking == "tap" && (c.IngressRate != "" || c.EgressRate != "") {
+		if err := util.LimitTapRate(c.Bridge, c.IngressRate, c.EgressRate); err != nil {
+			return nil, err
+		}
+	}
+
 	version, err := ProbeVersion()
 	if err != nil {
 		return nil, err
@@ -194,16 +508,33 @@ func VMCommand(c *VMConfig, extra ...string) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
+// StopRequested tells whether the instance was stopped with StopVM since the
+// request was last cleared.
+func StopRequested(name string) bool {
+	_, err := os.Stat(filepath.Join(util.ConfigDir(), "instances/qemu", name, "osv.stopped"))
+	return err == nil
+}
+
+// ClearStopRequest forgets that the instance was stopped with StopVM.
+func ClearStopRequest(name string) {
+	os.Remove(filepath.Join(util.ConfigDir(), "instances/qemu", name, "osv.stopped"))
+}
+
 func LaunchVM(c *VMConfig, extra ...string) (*exec.Cmd, error) {
 	cmd, err := VMCommand(c, extra...)
 	if err != nil {
 		return nil, err
 	}
-	if c.Verbose {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+	if c.Console != nil {
+		cmd.Stdout = c.Console
+		cmd.Stderr = c.Console
+	} else {
+		if c.Verbose {
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+		}
+		cmd.Stdin = os.Stdin
 	}
-	cmd.Stdin = os.Stdin
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
@@ -254,8 +585,8 @@ func ParseVersion(text string) (*Version, error) {
 	}, nil
 }
 
-func (c *VMConfig) vmDriveCache() string {
-	if util.IsDirectIOSupported(c.Image) {
+func vmDriveCache(path string) string {
+	if util.IsDirectIOSupported(path) {
 		return "none"
 	}
 	return "unsafe"
@@ -267,7 +598,27 @@ func (c *VMConfig) vmArguments(version *Version) ([]string, error) {
 	args = append(args, "-m", strconv.FormatInt(c.Memory, 10))
 	args = append(args, "-smp", strconv.Itoa(c.Cpus))
 	args = append(args, "-device", "virtio-blk-pci,id=blk0,bootindex=0,drive=hd0")
-	args = append(args, "-drive", "file="+c.Image+",if=none,id=hd0,aio=native,cache="+c.vmDriveCache())
+	image := c.Image
+	if c.secretsOverlay != "" {
+		image = c.secretsOverlay
+	}
+	drive := "file=" + image + ",if=none,id=hd0,aio=native,cache=" + vmDriveCache(image)
+	if c.EncryptionKeyFile != "" {
+		args = append(args, "-object", util.QemuSecretObject(c.EncryptionKeyFile))
+		drive += ",format=qcow2," + c.vmEncryptionOption()
+	}
+	args = append(args, "-drive", drive)
+	for i, volume := range util.DiskVolumes(c.Volumes) {
+		id := fmt.Sprintf("vol%d", i+1)
+		volumeDrive := "file=" + volume.Source + ",if=none,id=" + id + ",aio=native,cache=" + vmDriveCache(volume.Source)
+		if volume.ReadOnly {
+			volumeDrive += ",readonly=on"
+		}
+		args = append(args, "-device", fmt.Sprintf("virtio-blk-pci,id=blk%d,drive=%s", i+1, id), "-drive", volumeDrive)
+	}
+	if c.CloudInit != nil {
+		args = append(args, "-cdrom", filepath.Join(c.InstanceDir, CloudInitFileName))
+	}
 	if version.Major >= 1 && version.Minor >= 3 {
 		args = append(args, "-device", "virtio-rng-pci")
 	}
@@ -280,17 +631,46 @@ func (c *VMConfig) vmArguments(version *Version) ([]string, error) {
 	args = append(args, net...)
 	monitor := fmt.Sprintf("socket,id=charmonitor,path=%s,server,nowait", c.Monitor)
 	args = append(args, "-chardev", monitor, "-mon", "chardev=charmonitor,id=monitor,mode=control")
-	if !c.DisableKvm && runtime.GOOS == "linux" && checkKVM() {
-		args = append(args, "-enable-kvm", "-cpu", "host,+x2apic")
+	if kvm := c.kvmEnabled(); kvm {
+		args = append(args, "-enable-kvm", "-cpu", c.cpuModel(kvm))
+	} else if c.CPUModel != "" {
+		args = append(args, "-cpu", c.CPUModel)
 	}
 	return args, nil
 }
 
+// kvmEnabled tells whether the instance is accelerated with KVM.
+func (c *VMConfig) kvmEnabled() bool {
+	return !c.DisableKvm && runtime.GOOS == "linux" && checkKVM()
+}
+
+// vmEncryptionOption binds the encryption key to the image itself and, for
+// instance disks, to the image they are an overlay of. Instance disks created
+// before they were encrypted only bind the key to their backing image.
+func (c *VMConfig) vmEncryptionOption() string {
+	option := "encrypt.key-secret=" + util.EncryptionSecretID
+	header, err := util.ReadImageHeader(c.Image)
+	encrypted := err != nil || header.CryptMethod != 0
+	switch {
+	case encrypted && c.BackingFile:
+		return option + ",backing." + option
+	case encrypted:
+		return option
+	default:
+		return "backing." + option
+	}
+}
+
 func (c *VMConfig) vmMAC() (net.HardwareAddr, error) {
 	if c.MAC != "" {
 		return net.ParseMAC(c.MAC)
 	}
-	return util.GenerateMAC()
+	mac, err := util.AllocateMAC(c.Name)
+	if err != nil {
+		return nil, err
+	}
+	c.MAC = mac.String()
+	return mac, nil
 }
 
 func (c *VMConfig) vmNetworking() ([]string, error) {
@@ -310,11 +690,17 @@ func (c *VMConfig) vmNetworking() ([]string, error) {
 		args = append(args, "-netdev", fmt.Sprintf("bridge,id=hn0,br=%s,helper=%s", c.Bridge, bridgeHelper), "-device", fmt.Sprintf("virtio-net-pci,netdev=hn0,id=nic1,mac=%s", mac.String()))
 		return args, nil
 	case "nat":
-		args = append(args, "-netdev", "user,id=un0,net=192.168.122.0/24,host=192.168.122.1", "-device", "virtio-net-pci,netdev=un0")
+		netdev := fmt.Sprintf("user,id=un0,net=%s,host=%s", nat.UserNetwork, nat.UserHost) + c.NatOptions.NetdevOptions()
+		if c.IPv6Net != "" {
+			netdev += ",ipv6=on,ipv6-net=" + c.IPv6Net
+			if c.IPv6Host != "" {
+				netdev += ",ipv6-host=" + c.IPv6Host
+			}
+		}
 		for _, portForward := range c.NatRules {
-			redirect := fmt.Sprintf("tcp:%s::%s", portForward.HostPort, portForward.GuestPort)
-			args = append(args, "-redir", redirect)
+			netdev += fmt.Sprintf(",hostfwd=%s-:%s", hostForward(portForward), portForward.GuestPort)
 		}
+		args = append(args, "-netdev", netdev, "-device", "virtio-net-pci,netdev=un0")
 		return args, nil
 	case "tap":
 		mac, err := c.vmMAC()
@@ -323,6 +709,13 @@ func (c *VMConfig) vmNetworking() ([]string, error) {
 		}
 		args = append(args, "-netdev", fmt.Sprintf("tap,id=hn0,ifname=%s,script=no,downscript=no", c.Bridge), "-device", fmt.Sprintf("virtio-net-pci,netdev=hn0,id=nic1,mac=%s", mac.String()))
 		return args, nil
+	case "private":
+		mac, err := c.vmMAC()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-netdev", fmt.Sprintf("socket,id=pn0,mcast=%s", PrivateNetworkGroup(c.Bridge)), "-device", fmt.Sprintf("virtio-net-pci,netdev=pn0,id=nic1,mac=%s", mac.String()))
+		return args, nil
 	case "vhost":
 		mac, err := c.vmMAC()
 		if err != nil {
@@ -335,6 +728,21 @@ func (c *VMConfig) vmNetworking() ([]string, error) {
 	return nil, fmt.Errorf("%s: networking not supported", c.Networking)
 }
 
+// DefaultPrivateNetwork is the private network that instances are attached
+// to with private networking unless another one is named.
+const DefaultPrivateNetwork = "default"
+
+// PrivateNetworkGroup returns the multicast group and port that instances
+// attached to the named private network exchange their frames over. Each
+// network gets a group of its own, derived from its name, so that networks
+// do not see each other's traffic.
+func PrivateNetworkGroup(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	sum := h.Sum32()
+	return fmt.Sprintf("239.192.%d.%d:%d", sum>>24, sum>>16&0xff, 20000+sum%10000)
+}
+
 func qemuExecutable() (string, error) {
 	paths := []string{
 		"/usr/bin/qemu-system-x86_64",
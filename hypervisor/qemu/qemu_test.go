@@ -8,7 +8,18 @@
 package qemu
 
 import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/util"
 )
 
 var parsingtests = []struct {
@@ -30,3 +41,185 @@ func TestVersionParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestNATNetworking(t *testing.T) {
+	c := &VMConfig{
+		Networking: "nat",
+		NatRules: []nat.Rule{
+			{HostPort: "8080", GuestPort: "80"},
+			{HostIP: "::1", HostPort: "5353", GuestPort: "53", Protocol: "udp"},
+		},
+		IPv6Net:    "fd00::/64",
+		IPv6Host:   "fd00::2",
+		NatOptions: nat.Options{Hostname: "web", DNSSearch: []string{"example.com", "test"}},
+	}
+	args, err := c.vmNetworking()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"-netdev", "user,id=un0,net=192.168.122.0/24,host=192.168.122.1,hostname=web,dnssearch=example.com,dnssearch=test" +
+			",ipv6=on,ipv6-net=fd00::/64,ipv6-host=fd00::2,hostfwd=tcp::8080-:80,hostfwd=udp:[::1]:5353-:53",
+		"-device", "virtio-net-pci,netdev=un0",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("vmNetworking() => %q, want %q", args, expected)
+	}
+}
+
+func TestPrivateNetworking(t *testing.T) {
+	c := &VMConfig{Networking: "private", Bridge: "backend", MAC: "52:54:00:12:34:56"}
+	args, err := c.vmNetworking()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"-netdev", "socket,id=pn0,mcast=" + PrivateNetworkGroup("backend"),
+		"-device", "virtio-net-pci,netdev=pn0,id=nic1,mac=52:54:00:12:34:56",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("vmNetworking() => %q, want %q", args, expected)
+	}
+	if PrivateNetworkGroup("backend") == PrivateNetworkGroup("frontend") {
+		t.Errorf("private networks share multicast group %s", PrivateNetworkGroup("backend"))
+	}
+}
+
+func TestMissingCPUFeatures(t *testing.T) {
+	host := map[string]bool{"pni": true, "sse4_2": true, "aes": true, "avx512f": true}
+	m := []struct {
+		comment  string
+		model    string
+		kvm      bool
+		required []string
+		expected []string
+	}{
+		{"host CPU", "host,+x2apic", true, []string{"x2apic", "sse4.2", "aes"}, nil},
+		{"host CPU lacks feature", "host,+x2apic", true, []string{"aes", "avx2"}, []string{"avx2"}},
+		{"x2apic is emulated by KVM", "Nehalem", true, []string{"x2apic", "sse4.2"}, nil},
+		{"model lacks feature", "Nehalem", true, []string{"sse4.2", "aes"}, []string{"aes"}},
+		{"feature added to model", "Nehalem,+aes", true, []string{"sse4.2", "aes"}, nil},
+		{"feature removed from model", "Westmere,-aes", false, []string{"aes"}, []string{"aes"}},
+		{"model provides feature missing on host", "Haswell", true, []string{"avx2"}, []string{"avx2"}},
+		{"emulated model", "Haswell", false, []string{"avx2", "x2apic"}, nil},
+		{"default model without KVM", "qemu64", false, []string{"SSE3", "sse4.2", "x2apic"}, []string{"sse4_2", "x2apic"}},
+		{"untracked feature of host", "Nehalem", true, []string{"avx512f"}, nil},
+		{"unknown model", "Cooperlake", false, []string{"aes"}, nil},
+	}
+	for _, tt := range m {
+		missing := missingCPUFeatures(tt.model, tt.kvm, host, tt.required)
+		if !reflect.DeepEqual(missing, tt.expected) {
+			t.Errorf("%s: missingCPUFeatures(%q) => %q, want %q", tt.comment, tt.model, missing, tt.expected)
+		}
+	}
+}
+
+func TestSecretsCmdLine(t *testing.T) {
+	secrets := map[string]string{"TOKEN": "t0k3n", "DB_PASSWORD": "p w"}
+	cmdLine := secretsCmdLine("--env=PORT=8000 runscript /run/default", secrets)
+	expected := `"--env=DB_PASSWORD=p w" --env=TOKEN=t0k3n --env=PORT=8000 runscript /run/default`
+	if cmdLine != expected {
+		t.Errorf("secretsCmdLine() => %q, want %q", cmdLine, expected)
+	}
+
+	// Instances boot from the overlay with secrets, never from the disk.
+	c := &VMConfig{Image: "/instances/app/disk.qcow2", Networking: "nat", secretsOverlay: secretsOverlayPath("app")}
+	args, err := c.vmArguments(&Version{Major: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, arg := range args {
+		if arg == "-drive" && !strings.HasPrefix(args[i+1], "file="+secretsOverlayPath("app")+",") {
+			t.Errorf("instance boots from %s, want overlay %s", args[i+1], secretsOverlayPath("app"))
+		}
+	}
+}
+
+func TestVMEncryptionOption(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "capstan-qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// QCOW2 header with the given crypt_method.
+	writeHeader := func(path string, cryptMethod uint32) {
+		header := make([]byte, 104)
+		copy(header, "QFI\xfb")
+		binary.BigEndian.PutUint32(header[4:], 3)
+		binary.BigEndian.PutUint32(header[32:], cryptMethod)
+		if err := ioutil.WriteFile(path, header, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := filepath.Join(tmp, "image.qcow2")
+	writeHeader(image, 2)
+	disk := filepath.Join(tmp, "disk.qcow2")
+	writeHeader(disk, 2)
+	legacyDisk := filepath.Join(tmp, "legacy.qcow2")
+	writeHeader(legacyDisk, 0)
+
+	m := []struct {
+		comment     string
+		c           VMConfig
+		expectedOpt string
+	}{
+		{"encrypted image", VMConfig{Image: image}, "encrypt.key-secret=capstan-luks0"},
+		{"encrypted instance disk", VMConfig{Image: disk, BackingFile: true},
+			"encrypt.key-secret=capstan-luks0,backing.encrypt.key-secret=capstan-luks0"},
+		{"unencrypted instance disk", VMConfig{Image: legacyDisk, BackingFile: true}, "backing.encrypt.key-secret=capstan-luks0"},
+	}
+	for _, tt := range m {
+		if option := tt.c.vmEncryptionOption(); option != tt.expectedOpt {
+			t.Errorf("%s: vmEncryptionOption() => %q, want %q", tt.comment, option, tt.expectedOpt)
+		}
+	}
+}
+
+func TestStopCommands(t *testing.T) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	home, err := ioutil.TempDir("", "capstan-qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	os.Setenv("HOME", home)
+
+	dir := filepath.Join(util.ConfigDir(), "instances", "qemu", "app")
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "osv.monitor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, tt := range []struct {
+		stop     func(string) error
+		expected string
+	}{
+		{PowerdownVM, `{ "execute": "qmp_capabilities"}{ "execute": "system_powerdown" }`},
+		{StopVM, `{ "execute": "qmp_capabilities"}{ "execute": "system_powerdown" }{ "execute": "quit" }`},
+	} {
+		if err := tt.stop("app"); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The connection is left open, so read whatever arrives meanwhile.
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		received, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if string(received) != tt.expected {
+			t.Errorf("monitor received %q, want %q", received, tt.expected)
+		}
+	}
+
+	// The supervisor of 'capstan run' must not restart stopped instances.
+	if _, err := os.Stat(filepath.Join(dir, "osv.stopped")); err != nil {
+		t.Errorf("stop request not recorded: %s", err)
+	}
+}
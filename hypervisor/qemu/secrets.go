@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// secretsOverlayPath returns the overlay of the instance disk that holds the
+// command line with secrets while the instance runs. It is kept in the
+// temporary directory of the host, the instance directory never holds secrets.
+func secretsOverlayPath(name string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("capstan-%d", os.Getuid()), "secrets", name+".qcow2")
+}
+
+// secretsCmdLine returns the command line with secrets prepended to it.
+func secretsCmdLine(cmdLine string, secrets map[string]string) string {
+	var names []string
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		args = append(args, util.FormatEnvArg(name, "=", secrets[name]))
+	}
+	return strings.TrimSpace(strings.Join(args, " ") + " " + cmdLine)
+}
+
+// createSecretsOverlay creates a throwaway overlay of the instance disk with
+// secrets prepended to its command line, which the instance then boots from.
+func createSecretsOverlay(c *VMConfig) (string, error) {
+	disk, err := filepath.Abs(c.Image)
+	if err != nil {
+		return "", err
+	}
+	cmdLine, err := util.GetCmdLine(disk)
+	if err != nil {
+		return "", err
+	}
+
+	overlay := secretsOverlayPath(c.Name)
+	if err := os.MkdirAll(filepath.Dir(overlay), 0700); err != nil {
+		return "", err
+	}
+	os.Remove(overlay)
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", disk, overlay)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to create overlay with secrets: %s", strings.TrimSpace(string(out)))
+	}
+	if err := os.Chmod(overlay, 0600); err != nil {
+		os.Remove(overlay)
+		return "", err
+	}
+	if err := util.SetCmdLine(overlay, secretsCmdLine(cmdLine, c.Secrets)); err != nil {
+		os.Remove(overlay)
+		return "", err
+	}
+	return overlay, nil
+}
+
+// ClearSecrets merges what the instance wrote while it was running with
+// secrets into the instance disk and removes the overlay holding the secrets.
+// The command line of the overlay is restored first, so that secrets never
+// reach the instance disk. It must only be called once the instance is not
+// running anymore.
+func ClearSecrets(c *VMConfig) error {
+	overlay := secretsOverlayPath(c.Name)
+	if _, err := os.Stat(overlay); os.IsNotExist(err) {
+		return nil
+	}
+
+	cmdLine, err := util.GetCmdLine(filepath.Join(c.InstanceDir, "disk.qcow2"))
+	if err != nil {
+		return err
+	}
+	if err := util.SetCmdLine(overlay, cmdLine); err != nil {
+		return err
+	}
+	cmd := exec.Command("qemu-img", "commit", overlay)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to merge overlay with secrets into the instance disk: %s", strings.TrimSpace(string(out)))
+	}
+	return os.Remove(overlay)
+}
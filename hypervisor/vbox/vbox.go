@@ -35,6 +35,8 @@ type VMConfig struct {
 	NatRules   []nat.Rule
 	ConfigFile string
 	MAC        string
+	Labels     map[string]string
+	Metadata   util.InstanceMetadata
 }
 
 func LaunchVM(c *VMConfig) (*exec.Cmd, error) {
@@ -149,7 +151,7 @@ func (c *VMConfig) vmMAC() (net.HardwareAddr, error) {
 	if c.MAC != "" {
 		return net.ParseMAC(c.MAC)
 	}
-	return util.GenerateMAC()
+	return util.AllocateMAC(c.Name)
 }
 
 func vmSetupNetworking(c *VMConfig) error {
@@ -174,7 +176,14 @@ func vmSetupNAT(c *VMConfig) error {
 		return err
 	}
 	for _, rule := range c.NatRules {
-		natRule := fmt.Sprintf("guest%s,tcp,,%s,,%s", rule.GuestPort, rule.HostPort, rule.GuestPort)
+		if rule.IsIPv6() {
+			return fmt.Errorf("%s: IPv6 port forwarding is only supported for qemu", rule)
+		}
+		name := "guest" + rule.GuestPort
+		if rule.Proto() != "tcp" {
+			name += rule.Proto()
+		}
+		natRule := fmt.Sprintf("%s,%s,%s,%s,,%s", name, rule.Proto(), rule.HostIP, rule.HostPort, rule.GuestPort)
 		err := VBoxManage("modifyvm", c.Name, "--natpf1", natRule)
 		if err != nil {
 			return err
@@ -197,6 +206,9 @@ func DeleteVM(name string) error {
 		fmt.Printf("Failed to delete: %s, %s", c.ConfigFile, sockFile)
 		return err
 	}
+	if err := util.ReleaseMAC(name); err != nil {
+		return err
+	}
 
 	return VBoxManage("unregistervm", name, "--delete")
 }
@@ -255,7 +267,7 @@ func StoreConfig(c *VMConfig) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(c.ConfigFile, data, 0644)
+	return util.WriteFileAtomic(c.ConfigFile, data, 0644)
 }
 
 func GetVMStatus(name, dir string) (string, error) {
@@ -35,6 +35,8 @@ type VMConfig struct {
 	InstanceDir  string
 	OriginalVMDK string
 	ConfigFile   string
+	Labels       map[string]string
+	Metadata     util.InstanceMetadata
 }
 
 func vmxRun(args ...string) (*exec.Cmd, error) {
@@ -247,7 +249,7 @@ func StoreConfig(c *VMConfig) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(c.ConfigFile, data, 0644)
+	return util.WriteFileAtomic(c.ConfigFile, data, 0644)
 }
 
 func vmList() ([]string, error) {
@@ -30,17 +30,24 @@ type Header struct {
 	RefcountTableClusters uint32
 	NbSnapshots           uint32
 	SnapshotsOffset       uint64
+	// Fields below are only valid for version 3 and newer.
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
 }
 
 func Probe(f *os.File) bool {
-	header, err := readHeader(f)
+	header, err := ReadHeader(f)
 	if err != nil {
 		return false
 	}
 	return header.Magic == QCOW2_MAGIC
 }
 
-func readHeader(f *os.File) (*Header, error) {
+// ReadHeader reads QCOW2 header from the current position of the file.
+func ReadHeader(f *os.File) (*Header, error) {
 	var header Header
 	err := binary.Read(f, binary.BigEndian, &header)
 	if err != nil {
@@ -8,19 +8,312 @@
 package nat
 
 import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+// Addresses of the user-mode network that guests using NAT networking are
+// attached to.
+const (
+	UserNetwork = "192.168.122.0/24"
+	UserHost    = "192.168.122.1"
+)
+
+// Options configure the user-mode network beyond port forwarding: the
+// hostname and DNS search domains that the guest is given via DHCP, address
+// of the DNS server within the network, and a directory served over TFTP
+// along with the file offered for network boot.
+type Options struct {
+	Hostname  string   `yaml:"hostname,omitempty"`
+	DNSSearch []string `yaml:"dnssearch,omitempty"`
+	DNS       string   `yaml:"dns,omitempty"`
+	TFTP      string   `yaml:"tftp,omitempty"`
+	Bootfile  string   `yaml:"bootfile,omitempty"`
+}
+
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// IsEmpty tells whether QEMU defaults are used.
+func (o Options) IsEmpty() bool {
+	return o.Hostname == "" && len(o.DNSSearch) == 0 && o.DNS == "" && o.TFTP == "" && o.Bootfile == ""
+}
+
+// Validate checks the options, the TFTP directory must exist.
+func (o Options) Validate() error {
+	if o.Hostname != "" && !hostnamePattern.MatchString(o.Hostname) {
+		return fmt.Errorf("invalid hostname '%s'", o.Hostname)
+	}
+	for _, domain := range o.DNSSearch {
+		if !hostnamePattern.MatchString(domain) {
+			return fmt.Errorf("invalid DNS search domain '%s'", domain)
+		}
+	}
+	if o.DNS != "" {
+		_, network, _ := net.ParseCIDR(UserNetwork)
+		dns := net.ParseIP(o.DNS)
+		if dns == nil || !network.Contains(dns) || o.DNS == UserHost {
+			return fmt.Errorf("invalid DNS server '%s', use an address within %s other than %s", o.DNS, UserNetwork, UserHost)
+		}
+	}
+	if o.TFTP != "" {
+		if info, err := os.Stat(o.TFTP); err != nil || !info.IsDir() {
+			return fmt.Errorf("TFTP directory %s does not exist", o.TFTP)
+		}
+	}
+	if o.Bootfile != "" && o.TFTP == "" {
+		return fmt.Errorf("bootfile can only be given along with TFTP directory")
+	}
+	return nil
+}
+
+// NetdevOptions returns the options in form of QEMU user netdev options, each
+// preceded by a comma.
+func (o Options) NetdevOptions() string {
+	options := ""
+	if o.Hostname != "" {
+		options += ",hostname=" + o.Hostname
+	}
+	for _, domain := range o.DNSSearch {
+		options += ",dnssearch=" + domain
+	}
+	if o.DNS != "" {
+		options += ",dns=" + o.DNS
+	}
+	// Commas in values are escaped by doubling them.
+	if o.TFTP != "" {
+		options += ",tftp=" + strings.Replace(o.TFTP, ",", ",,", -1)
+	}
+	if o.Bootfile != "" {
+		options += ",bootfile=" + strings.Replace(o.Bootfile, ",", ",,", -1)
+	}
+	return options
+}
+
+// Rule forwards the host port to the guest port. HostIP restricts the host
+// address the port is bound to, all addresses are used when it is empty.
+// Protocol is either tcp or udp, empty meaning tcp.
 type Rule struct {
+	HostIP    string `yaml:"hostip,omitempty"`
 	HostPort  string
 	GuestPort string
+	Protocol  string `yaml:"protocol,omitempty"`
+}
+
+// Proto returns the protocol of the rule, tcp unless udp is given.
+func (r Rule) Proto() string {
+	if r.Protocol == "" {
+		return "tcp"
+	}
+	return r.Protocol
+}
+
+// IsIPv6 tells whether the host port is bound on an IPv6 address.
+func (r Rule) IsIPv6() bool {
+	return strings.Contains(r.HostIP, ":")
+}
+
+// String formats the rule the way ParseRule accepts it, e.g.
+// 127.0.0.1:8080:80/udp. The default protocol is omitted.
+func (r Rule) String() string {
+	s := r.HostPort + ":" + r.GuestPort
+	if r.HostIP != "" {
+		host := r.HostIP
+		if r.IsIPv6() {
+			host = "[" + host + "]"
+		}
+		s = host + ":" + s
+	}
+	if r.Proto() != "tcp" {
+		s += "/" + r.Proto()
+	}
+	return s
 }
 
-func Parse(rules []string) []Rule {
+// ParseRule parses a port forwarding rule in form of
+// [<host ip>:]<host port>:<guest port>[/tcp|udp]. Host port may also be
+// omitted (e.g. 8000, :8000 or 127.0.0.1::8000), a free one is forwarded
+// then. IPv6 host addresses are enclosed in brackets, e.g. [::1]:8080:80.
+func ParseRule(rule string) (Rule, error) {
+	rules, err := ParseRules(rule)
+	if err != nil {
+		return Rule{}, err
+	}
+	if len(rules) != 1 {
+		return Rule{}, fmt.Errorf("invalid port forwarding rule '%s', port ranges are not supported here", rule)
+	}
+	return rules[0], nil
+}
+
+// ParseRules parses a port forwarding rule the same as ParseRule, except
+// that ports may be given as ranges, e.g. 8000-8010:9000-9010/udp, which
+// forward each port of the host range to the port of the guest range at the
+// same offset. Both ranges must be of the same size. A rule is returned for
+// every port of the range.
+func ParseRules(rule string) ([]Rule, error) {
+	r := Rule{}
+	spec := rule
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		r.Protocol = spec[i+1:]
+		spec = spec[:i]
+		if r.Protocol != "tcp" && r.Protocol != "udp" {
+			return nil, fmt.Errorf("invalid protocol '%s' in '%s', use tcp or udp", r.Protocol, rule)
+		}
+		if r.Protocol == "tcp" {
+			r.Protocol = ""
+		}
+	}
+
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]:")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid host address in '%s'", rule)
+		}
+		r.HostIP = spec[1:end]
+		spec = spec[end+2:]
+		if ip := net.ParseIP(r.HostIP); ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 host address '%s' in '%s'", r.HostIP, rule)
+		}
+		if !strings.Contains(spec, ":") {
+			return nil, fmt.Errorf("invalid port forwarding rule '%s', use [<host ip>]:<host port>:<guest port>[/udp]", rule)
+		}
+	}
+
+	ports := strings.Split(spec, ":")
+	switch len(ports) {
+	case 1:
+		r.GuestPort = ports[0]
+	case 2:
+		r.HostPort, r.GuestPort = ports[0], ports[1]
+	case 3:
+		if r.HostIP != "" {
+			return nil, fmt.Errorf("invalid port forwarding rule '%s'", rule)
+		}
+		r.HostIP, r.HostPort, r.GuestPort = ports[0], ports[1], ports[2]
+		if ip := net.ParseIP(r.HostIP); ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid host address '%s' in '%s'", r.HostIP, rule)
+		}
+	default:
+		return nil, fmt.Errorf("invalid port forwarding rule '%s', use [<host ip>:]<host port>:<guest port>[/udp]", rule)
+	}
+
+	guestFirst, guestLast, ok := parsePortRange(r.GuestPort)
+	if !ok {
+		return nil, fmt.Errorf("invalid guest port '%s' in '%s'", r.GuestPort, rule)
+	}
+	hostFirst := 0
+	if r.HostPort != "" {
+		first, last, ok := parsePortRange(r.HostPort)
+		if !ok {
+			return nil, fmt.Errorf("invalid host port '%s' in '%s'", r.HostPort, rule)
+		}
+		if last-first != guestLast-guestFirst {
+			return nil, fmt.Errorf("host port range %s and guest port range %s in '%s' differ in size", r.HostPort, r.GuestPort, rule)
+		}
+		hostFirst = first
+	}
+
+	rules := make([]Rule, 0, guestLast-guestFirst+1)
+	for offset := 0; offset <= guestLast-guestFirst; offset++ {
+		expanded := r
+		expanded.GuestPort = strconv.Itoa(guestFirst + offset)
+		if r.HostPort != "" {
+			expanded.HostPort = strconv.Itoa(hostFirst + offset)
+		}
+		rules = append(rules, expanded)
+	}
+	return rules, nil
+}
+
+// parsePortRange parses a port or a range of ports, e.g. 8000-8010.
+func parsePortRange(ports string) (int, int, bool) {
+	bounds := strings.SplitN(ports, "-", 2)
+	if !validPort(bounds[0]) || (len(bounds) == 2 && !validPort(bounds[1])) {
+		return 0, 0, false
+	}
+	first, _ := strconv.Atoi(bounds[0])
+	last := first
+	if len(bounds) == 2 {
+		last, _ = strconv.Atoi(bounds[1])
+	}
+	return first, last, first <= last
+}
+
+// ValidateIPv6 checks the IPv6 prefix of the user-mode network, e.g.
+// fd00::/64, and the address of the host within it, which may be empty.
+func ValidateIPv6(prefix, host string) error {
+	ip, network, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil {
+		return fmt.Errorf("invalid IPv6 prefix '%s', use e.g. fd00::/64", prefix)
+	}
+	if host == "" {
+		return nil
+	}
+	if hostIP := net.ParseIP(host); hostIP == nil || hostIP.To4() != nil {
+		return fmt.Errorf("invalid IPv6 host address '%s'", host)
+	} else if !network.Contains(hostIP) {
+		return fmt.Errorf("IPv6 host address %s is not within %s", host, prefix)
+	}
+	return nil
+}
+
+// Parse parses port forwarding rules, expanding port ranges, see
+// ParseRules.
+func Parse(rules []string) ([]Rule, error) {
 	fwds := make([]Rule, 0, 0)
 	for _, rule := range rules {
-		ports := strings.Split(rule, ":")
-		fwds = append(fwds, Rule{HostPort: ports[0], GuestPort: ports[1]})
+		r, err := ParseRules(rule)
+		if err != nil {
+			return nil, err
+		}
+		fwds = append(fwds, r...)
+	}
+	return fwds, nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// FreePort returns a port of the host that is not in use at the moment by
+// the given protocol, tcp or udp.
+func FreePort(protocol string) (string, error) {
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port), nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// HostPortAvailable reports whether the host port of the rule can be bound
+// to on its host address.
+func (r Rule) HostPortAvailable() bool {
+	address := net.JoinHostPort(r.HostIP, r.HostPort)
+	if r.Proto() == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
 	}
-	return fwds
+	l.Close()
+	return true
 }
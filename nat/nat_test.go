@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package nat
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	valid := []struct {
+		rule     string
+		expected Rule
+	}{
+		{"8080:80", Rule{HostPort: "8080", GuestPort: "80"}},
+		{"8080:80/tcp", Rule{HostPort: "8080", GuestPort: "80"}},
+		{"5353:53/udp", Rule{HostPort: "5353", GuestPort: "53", Protocol: "udp"}},
+		{"127.0.0.1:8080:80", Rule{HostIP: "127.0.0.1", HostPort: "8080", GuestPort: "80"}},
+		{"127.0.0.1::80", Rule{HostIP: "127.0.0.1", GuestPort: "80"}},
+		{"80", Rule{GuestPort: "80"}},
+		{":80/udp", Rule{GuestPort: "80", Protocol: "udp"}},
+		{"[::1]:8080:80", Rule{HostIP: "::1", HostPort: "8080", GuestPort: "80"}},
+		{"[fd00::2]::53/udp", Rule{HostIP: "fd00::2", GuestPort: "53", Protocol: "udp"}},
+	}
+	for _, c := range valid {
+		r, err := ParseRule(c.rule)
+		if err != nil {
+			t.Errorf("%s: %s", c.rule, err)
+			continue
+		}
+		if r != c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.rule, c.expected, r)
+		}
+	}
+
+	invalid := []string{"", "8080:", "8080:http", "70000:80", "8080:80/sctp", "localhost:8080:80", "::1:8080:80", "[::1]:80", "[127.0.0.1]:8080:80", "[::1]:1:8080:80"}
+	for _, rule := range invalid {
+		if _, err := ParseRule(rule); err == nil {
+			t.Errorf("%s: expected an error", rule)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	valid := []struct {
+		rule     string
+		expected []Rule
+	}{
+		{"8080:80", []Rule{{HostPort: "8080", GuestPort: "80"}}},
+		{"8000-8002:9000-9002/udp", []Rule{
+			{HostPort: "8000", GuestPort: "9000", Protocol: "udp"},
+			{HostPort: "8001", GuestPort: "9001", Protocol: "udp"},
+			{HostPort: "8002", GuestPort: "9002", Protocol: "udp"},
+		}},
+		{"127.0.0.1::80-81", []Rule{{HostIP: "127.0.0.1", GuestPort: "80"}, {HostIP: "127.0.0.1", GuestPort: "81"}}},
+	}
+	for _, c := range valid {
+		rules, err := ParseRules(c.rule)
+		if err != nil {
+			t.Errorf("%s: %s", c.rule, err)
+			continue
+		}
+		if !reflect.DeepEqual(rules, c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", c.rule, c.expected, rules)
+		}
+	}
+
+	invalid := []string{"8000-8010:9000-9005", "8010-8000:8010-8000", "8000-:8000", "8000-8010-8020:8000", "8000:8000-8001"}
+	for _, rule := range invalid {
+		_, err := ParseRules(rule)
+		if err == nil {
+			t.Errorf("%s: expected an error", rule)
+		} else if !strings.Contains(err.Error(), "'"+rule+"'") {
+			t.Errorf("%s: error does not point at the rule: %s", rule, err)
+		}
+	}
+
+	if _, err := ParseRule("8000-8001:8000-8001"); err == nil {
+		t.Errorf("expected ParseRule to reject port ranges")
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	for _, rule := range []string{"8080:80", "5353:53/udp", "127.0.0.1:8080:80", "[::1]:8080:80"} {
+		r, err := ParseRule(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.String() != rule {
+			t.Errorf("expected %s, got %s", rule, r.String())
+		}
+	}
+}
+
+func TestValidateIPv6(t *testing.T) {
+	valid := [][2]string{{"fd00::/64", ""}, {"fd00::/64", "fd00::2"}}
+	for _, c := range valid {
+		if err := ValidateIPv6(c[0], c[1]); err != nil {
+			t.Errorf("%s %s: %s", c[0], c[1], err)
+		}
+	}
+
+	invalid := [][2]string{{"fd00::", ""}, {"10.0.2.0/24", ""}, {"fd00::/64", "10.0.2.2"}, {"fd00::/64", "fd01::2"}}
+	for _, c := range invalid {
+		if err := ValidateIPv6(c[0], c[1]); err == nil {
+			t.Errorf("%s %s: expected an error", c[0], c[1])
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capstan-tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := Options{Hostname: "web.local", DNSSearch: []string{"example.com"}, DNS: "192.168.122.3", TFTP: dir, Bootfile: "pxe,0"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	expected := ",hostname=web.local,dnssearch=example.com,dns=192.168.122.3,tftp=" + dir + ",bootfile=pxe,,0"
+	if options := o.NetdevOptions(); options != expected {
+		t.Errorf("expected %s, got %s", expected, options)
+	}
+
+	invalid := []Options{
+		{Hostname: "web_1"},
+		{DNSSearch: []string{"-example.com"}},
+		{DNS: "10.0.2.3"},
+		{DNS: UserHost},
+		{TFTP: dir + "/missing"},
+		{Bootfile: "pxe.0"},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", o)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the timeout of requests of clients returned by
+// NewClient.
+const DefaultTimeout = 10 * time.Second
+
+// Client talks to the REST API of the httpserver module of a running OSv
+// instance. It is safe for concurrent use.
+type Client struct {
+	// BaseURL is the URL that httpserver listens on, e.g.
+	// http://127.0.0.1:8000.
+	BaseURL string
+	// HTTP performs the requests, its timeout applies to whole requests
+	// including file transfers.
+	HTTP *http.Client
+}
+
+// StatusError is returned when httpserver responds with a status other than
+// 200 OK. Message is the body of the response.
+type StatusError struct {
+	Status  string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return strings.TrimSpace(e.Status + " " + e.Message)
+}
+
+// NewClient returns a client of httpserver at the given address, either
+// host:port or the base URL.
+func NewClient(address string) *Client {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return &Client{
+		BaseURL: strings.TrimSuffix(address, "/"),
+		HTTP:    &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// Version returns version of OSv.
+func (c *Client) Version() (string, error) {
+	var version string
+	err := c.getJSON("/os/version", &version)
+	return version, err
+}
+
+// Hostname returns hostname of the instance.
+func (c *Client) Hostname() (string, error) {
+	var hostname string
+	err := c.getJSON("/os/hostname", &hostname)
+	return hostname, err
+}
+
+// Uptime returns how long the instance has been running.
+func (c *Client) Uptime() (time.Duration, error) {
+	var seconds int64
+	err := c.getJSON("/os/uptime", &seconds)
+	return time.Duration(seconds) * time.Second, err
+}
+
+// Dmesg returns the kernel log of OSv.
+func (c *Client) Dmesg() (string, error) {
+	var dmesg string
+	err := c.getJSON("/os/dmesg", &dmesg)
+	return dmesg, err
+}
+
+// MemoryTotal returns the memory of the instance in bytes.
+func (c *Client) MemoryTotal() (int64, error) {
+	var total int64
+	err := c.getJSON("/os/memory/total", &total)
+	return total, err
+}
+
+// MemoryFree returns the free memory of the instance in bytes.
+func (c *Client) MemoryFree() (int64, error) {
+	var free int64
+	err := c.getJSON("/os/memory/free", &free)
+	return free, err
+}
+
+// Thread is a thread of the instance. CpuMs is the CPU time it used.
+type Thread struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	CpuMs  int64  `json:"cpu_ms"`
+	Status string `json:"status"`
+}
+
+// Threads are the threads of the instance at TimeMs, the time of the
+// instance in milliseconds.
+type Threads struct {
+	TimeMs int64    `json:"time_ms"`
+	List   []Thread `json:"list"`
+}
+
+// Threads returns all threads of the instance.
+func (c *Client) Threads() (*Threads, error) {
+	threads := &Threads{}
+	if err := c.getJSON("/os/threads", threads); err != nil {
+		return nil, err
+	}
+	return threads, nil
+}
+
+// Env returns the value of the environment variable.
+func (c *Client) Env(name string) (string, error) {
+	var value string
+	err := c.getJSON("/env/"+url.PathEscape(name), &value)
+	return value, err
+}
+
+// Environ returns all environment variables in form of NAME=value.
+func (c *Client) Environ() ([]string, error) {
+	var env []string
+	err := c.getJSON("/env/", &env)
+	return env, err
+}
+
+// SetEnv sets the environment variable.
+func (c *Client) SetEnv(name, value string) error {
+	return c.do("POST", "/env/"+url.PathEscape(name)+"?"+url.Values{"val": {value}}.Encode(), "", nil, nil)
+}
+
+// StartApp starts the command, e.g. "/tools/ls.so /etc", and returns ID of
+// its thread. When newProgram is set, the command gets its own ELF
+// namespace, so that it can run alongside other instances of the program.
+func (c *Client) StartApp(command string, newProgram bool) (string, error) {
+	params := url.Values{"command": {command}, "new_program": {strconv.FormatBool(newProgram)}}
+	resp, err := c.request("PUT", "/app/?"+params.Encode(), "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	// The thread ID is returned either as a number or as a string.
+	tid, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(strings.TrimSpace(string(tid)), `"`), nil
+}
+
+// AppFinished tells whether the command started as the thread has finished.
+func (c *Client) AppFinished(tid string) (bool, error) {
+	var finished bool
+	err := c.getJSON("/app/finished?tid="+url.QueryEscape(tid), &finished)
+	return finished, err
+}
+
+// getJSON decodes the JSON response of the endpoint into v.
+func (c *Client) getJSON(endpoint string, v interface{}) error {
+	return c.do("GET", endpoint, "", nil, v)
+}
+
+// do sends the request to the endpoint and decodes the JSON response into
+// v, unless it is nil.
+func (c *Client) do(method, endpoint, contentType string, body io.Reader, v interface{}) error {
+	resp, err := c.request(method, endpoint, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// request sends the request and returns the response unless its status is
+// other than 200 OK. The caller closes the body of the response.
+func (c *Client) request(method, endpoint, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.BaseURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach httpserver of the instance: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &StatusError{Status: resp.Status, Message: strings.TrimSpace(string(message))}
+	}
+	return resp, nil
+}
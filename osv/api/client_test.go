@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	env := map[string]string{"PORT": "8000"}
+	files := map[string]string{"/etc/hosts": "127.0.0.1 localhost\n"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/os/version":
+			w.Write([]byte(`"v0.51.0"`))
+		case req.URL.Path == "/os/threads":
+			w.Write([]byte(`{"time_ms": 1500, "list": [{"id": 1, "name": "idle0", "cpu_ms": 10, "status": "running"}]}`))
+		case req.URL.Path == "/env/PORT" && req.Method == "GET":
+			w.Write([]byte(`"` + env["PORT"] + `"`))
+		case req.URL.Path == "/env/PORT" && req.Method == "POST":
+			env["PORT"] = req.URL.Query().Get("val")
+		case req.URL.Path == "/app/" && req.Method == "PUT":
+			w.Write([]byte(`"17"`))
+		case strings.HasPrefix(req.URL.Path, "/file/") && req.Method == "GET":
+			content, ok := files[strings.TrimPrefix(req.URL.Path, "/file")]
+			if !ok {
+				http.Error(w, "no such file", http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(content))
+		case strings.HasPrefix(req.URL.Path, "/file/") && req.Method == "POST":
+			file, _, err := req.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := ioutil.ReadAll(file)
+			files[strings.TrimPrefix(req.URL.Path, "/file")] = string(data)
+		case req.URL.Path == "/trace/status":
+			w.Write([]byte(`[{"id": "sched_switch", "name": "sched_switch", "enabled": true, "backtrace": false}]`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	client := NewClient(strings.TrimPrefix(server.URL, "http://"))
+
+	if version, err := client.Version(); err != nil || version != "v0.51.0" {
+		t.Errorf("unexpected version %s, %v", version, err)
+	}
+	threads, err := client.Threads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Threads{TimeMs: 1500, List: []Thread{{ID: 1, Name: "idle0", CpuMs: 10, Status: "running"}}}
+	if !reflect.DeepEqual(threads, expected) {
+		t.Errorf("expected %+v, got %+v", expected, threads)
+	}
+
+	if err := client.SetEnv("PORT", "9000"); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := client.Env("PORT"); err != nil || port != "9000" {
+		t.Errorf("unexpected PORT %s, %v", port, err)
+	}
+	if tid, err := client.StartApp("/tools/ls.so", true); err != nil || tid != "17" {
+		t.Errorf("unexpected thread %s, %v", tid, err)
+	}
+
+	var content bytes.Buffer
+	if _, err := client.Download("/etc/hosts", &content); err != nil || content.String() != files["/etc/hosts"] {
+		t.Errorf("unexpected content %q, %v", content.String(), err)
+	}
+	if _, err := client.Upload("/etc/app.conf", strings.NewReader("debug=true\n")); err != nil {
+		t.Fatal(err)
+	}
+	if files["/etc/app.conf"] != "debug=true\n" {
+		t.Errorf("unexpected uploaded content %q", files["/etc/app.conf"])
+	}
+
+	points, err := client.TracePoints()
+	if err != nil || len(points) != 1 || !points[0].Enabled {
+		t.Errorf("unexpected tracepoints %+v, %v", points, err)
+	}
+
+	_, err = client.Download("/missing", &content)
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.Status != "404 Not Found" || statusErr.Message != "no such file" {
+		t.Errorf("expected 404 status error, got %v", err)
+	}
+	if _, err := client.Download("relative", &content); err == nil {
+		t.Errorf("expected relative path to be rejected")
+	}
+}
+
+func TestUploadFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, _, err := req.FormFile("file"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "read-only file system", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	// Content that can not be read fails the upload.
+	if _, err := client.Upload("/etc/app.conf", errorReader{}); err == nil || !strings.Contains(err.Error(), "disk failure") {
+		t.Errorf("expected read error, got %v", err)
+	}
+
+	// Errors of the instance are returned once the whole file is sent.
+	_, err := client.Upload("/etc/app.conf", bytes.NewReader(make([]byte, 1<<20)))
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.Message != "read-only file system" {
+		t.Errorf("expected status error, got %v", err)
+	}
+}
+
+// errorReader fails every read.
+type errorReader struct{}
+
+func (errorReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("disk failure")
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package api
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+)
+
+// Download writes the file of the instance at the absolute path to w and
+// returns the number of bytes written.
+func (c *Client) Download(path string, w io.Writer) (int64, error) {
+	if !strings.HasPrefix(path, "/") {
+		return 0, fmt.Errorf("path in the instance must be absolute: %s", path)
+	}
+	resp, err := c.request("GET", "/file"+path+"?op=GET", "", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// Upload writes content of r into the file of the instance at the absolute
+// path and returns the number of bytes written. Content is streamed to the
+// instance as it is read rather than buffered in memory.
+func (c *Client) Upload(path string, r io.Reader) (int64, error) {
+	if !strings.HasPrefix(path, "/") {
+		return 0, fmt.Errorf("path in the instance must be absolute: %s", path)
+	}
+	body, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+	written := make(chan int64, 1)
+	go func() {
+		n, err := writeFormFile(writer, path[strings.LastIndex(path, "/")+1:], r)
+		written <- n
+		pipe.CloseWithError(err)
+	}()
+
+	err := c.do("POST", "/file"+path, writer.FormDataContentType(), body, nil)
+	// Unblock the writer in case the request ended before the whole body
+	// was sent.
+	body.Close()
+	n := <-written
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeFormFile writes content of r as the file form field of the multipart
+// body and returns the number of bytes of the content.
+func writeFormFile(writer *multipart.Writer, name string, r io.Reader) (int64, error) {
+	part, err := writer.CreateFormFile("file", name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(part, r)
+	if err != nil {
+		return n, err
+	}
+	return n, writer.Close()
+}
+
+// FileStatus describes a file of the instance.
+type FileStatus struct {
+	Name   string `json:"pathSuffix"`
+	Type   string `json:"type"`
+	Length int64  `json:"length"`
+}
+
+// ListDir returns files of the directory of the instance at the absolute
+// path.
+func (c *Client) ListDir(path string) ([]FileStatus, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path in the instance must be absolute: %s", path)
+	}
+	var files []FileStatus
+	err := c.getJSON("/file"+path+"?op=LISTSTATUS", &files)
+	return files, err
+}
+
+// Delete removes the file of the instance at the absolute path.
+func (c *Client) Delete(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path in the instance must be absolute: %s", path)
+	}
+	return c.do("DELETE", "/file"+path+"?op=DELETE", "", nil, nil)
+}
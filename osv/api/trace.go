@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package api
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+)
+
+// TracePoint is a tracepoint of OSv. Backtrace tells whether backtraces are
+// recorded along with its events.
+type TracePoint struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Enabled   bool   `json:"enabled"`
+	Backtrace bool   `json:"backtrace"`
+}
+
+// TracePoints returns all tracepoints of the instance.
+func (c *Client) TracePoints() ([]TracePoint, error) {
+	var points []TracePoint
+	err := c.getJSON("/trace/status", &points)
+	return points, err
+}
+
+// EnableTracePoints enables or disables tracepoints whose IDs match the
+// pattern, e.g. "sched*", and returns the updated tracepoints.
+func (c *Client) EnableTracePoints(match string, enabled, backtrace bool) ([]TracePoint, error) {
+	params := url.Values{
+		"match":     {match},
+		"enabled":   {strconv.FormatBool(enabled)},
+		"backtrace": {strconv.FormatBool(backtrace)},
+	}
+	var points []TracePoint
+	err := c.do("POST", "/trace/status?"+params.Encode(), "", nil, &points)
+	return points, err
+}
+
+// TraceBuffers writes the binary dump of trace buffers to w, which is read
+// by the trace.py script of OSv.
+func (c *Client) TraceBuffers(w io.Writer) (int64, error) {
+	resp, err := c.request("GET", "/trace/buffers", "", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package rofs writes the read-only filesystem of OSv, the same layout as
+// scripts/gen-rofs-img.py of OSv produces. The filesystem is written on the
+// host, hence images with ROFS need no VM to be composed.
+package rofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// BlockSize is the size of blocks that offsets of the filesystem refer to.
+	BlockSize = 512
+
+	magic   = 0xDEADBEAD
+	version = 1
+
+	modeDir     = 0x4000
+	modeRegular = 0x8000
+	modeSymlink = 0xA000
+)
+
+// superBlock is stored in the first block of the filesystem.
+type superBlock struct {
+	Magic                    uint64
+	Version                  uint64
+	BlockSize                uint64
+	StructureInfoFirstBlock  uint64
+	StructureInfoBlocksCount uint64
+	DirectoryEntriesCount    uint64
+	SymlinksCount            uint64
+	InodesCount              uint64
+}
+
+// inode describes a file. DataOffset is the first block of a regular file,
+// the index of the first directory entry of a directory or the index of a
+// symlink. Count is the size of a regular file, the number of entries of a
+// directory or 1 for a symlink.
+type inode struct {
+	Mode       uint64
+	InodeNo    uint64
+	DataOffset uint64
+	Count      uint64
+}
+
+// node is a file of the filesystem being composed.
+type node struct {
+	mode     uint64
+	source   string
+	size     int64
+	target   string
+	children map[string]*node
+}
+
+// Filesystem collects files and writes them into a ROFS filesystem.
+type Filesystem struct {
+	root *node
+}
+
+// New returns an empty filesystem.
+func New() *Filesystem {
+	return &Filesystem{root: &node{mode: modeDir, children: map[string]*node{}}}
+}
+
+// AddDir adds the directory at the absolute path of the guest.
+func (fs *Filesystem) AddDir(path string) error {
+	_, err := fs.add(path, &node{mode: modeDir, children: map[string]*node{}})
+	return err
+}
+
+// AddFile adds the regular file of the host at the absolute path of the
+// guest.
+func (fs *Filesystem) AddFile(path, source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	_, err = fs.add(path, &node{mode: modeRegular, source: source, size: info.Size()})
+	return err
+}
+
+// AddSymlink adds the symlink pointing to target at the absolute path of the
+// guest.
+func (fs *Filesystem) AddSymlink(path, target string) error {
+	_, err := fs.add(path, &node{mode: modeSymlink, target: target})
+	return err
+}
+
+// add puts the node at the path, creating missing parent directories. An
+// existing directory is kept when a directory is added again.
+func (fs *Filesystem) add(path string, n *node) (*node, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("%s: path in the filesystem must be absolute", path)
+	}
+	names := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	if len(names) == 0 {
+		if n.mode != modeDir {
+			return nil, fmt.Errorf("%s: root must be a directory", path)
+		}
+		return fs.root, nil
+	}
+
+	dir := fs.root
+	for _, name := range names[:len(names)-1] {
+		child, ok := dir.children[name]
+		if !ok {
+			child = &node{mode: modeDir, children: map[string]*node{}}
+			dir.children[name] = child
+		} else if child.mode != modeDir {
+			return nil, fmt.Errorf("%s: %s is not a directory", path, name)
+		}
+		dir = child
+	}
+
+	name := names[len(names)-1]
+	if existing, ok := dir.children[name]; ok && existing.mode == modeDir && n.mode == modeDir {
+		return existing, nil
+	}
+	dir.children[name] = n
+	return n, nil
+}
+
+// writer keeps the state of the filesystem being written.
+type writer struct {
+	w       io.WriteSeeker
+	block   uint64
+	inodes  []inode
+	entries []byte
+	nentry  uint64
+	links   []byte
+	nlink   uint64
+}
+
+// Save writes the filesystem to w, which must be positioned at the start
+// of the filesystem, and returns its size in bytes, a multiple of BlockSize.
+func (fs *Filesystem) Save(w io.WriteSeeker) (int64, error) {
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	wr := &writer{w: w, block: 1}
+	if _, err := w.Seek(start+BlockSize, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	// The root directory is always the first inode.
+	wr.inodes = append(wr.inodes, inode{Mode: modeDir, InodeNo: 1})
+	count, first, err := wr.writeDir(fs.root)
+	if err != nil {
+		return 0, err
+	}
+	wr.inodes[0].Count = count
+	wr.inodes[0].DataOffset = first
+
+	// Directory entries, symlinks and inodes follow the content of files.
+	structure := append(wr.entries, wr.links...)
+	for _, in := range wr.inodes {
+		var buf [32]byte
+		binary.LittleEndian.PutUint64(buf[0:], in.Mode)
+		binary.LittleEndian.PutUint64(buf[8:], in.InodeNo)
+		binary.LittleEndian.PutUint64(buf[16:], in.DataOffset)
+		binary.LittleEndian.PutUint64(buf[24:], in.Count)
+		structure = append(structure, buf[:]...)
+	}
+	structureBlocks := blocks(int64(len(structure)))
+	structure = append(structure, make([]byte, structureBlocks*BlockSize-uint64(len(structure)))...)
+	if _, err := w.Write(structure); err != nil {
+		return 0, err
+	}
+
+	sb := superBlock{
+		Magic:                    magic,
+		Version:                  version,
+		BlockSize:                BlockSize,
+		StructureInfoFirstBlock:  wr.block,
+		StructureInfoBlocksCount: structureBlocks,
+		DirectoryEntriesCount:    wr.nentry,
+		SymlinksCount:            wr.nlink,
+		InodesCount:              uint64(len(wr.inodes)),
+	}
+	if _, err := w.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, sb); err != nil {
+		return 0, err
+	}
+	size := int64(wr.block+structureBlocks) * BlockSize
+	if _, err := w.Seek(start+size, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// writeDir writes the content of the directory and returns the number of its
+// entries along with the index of the first one. Inodes are numbered in the
+// order they are visited, entries of a directory follow those of its
+// subdirectories.
+func (wr *writer) writeDir(dir *node) (uint64, uint64, error) {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	inodeNos := make([]uint64, len(names))
+	for i, name := range names {
+		child := dir.children[name]
+		in := inode{Mode: child.mode, InodeNo: uint64(len(wr.inodes) + 1)}
+		index := len(wr.inodes)
+		wr.inodes = append(wr.inodes, in)
+		inodeNos[i] = in.InodeNo
+
+		switch child.mode {
+		case modeDir:
+			count, first, err := wr.writeDir(child)
+			if err != nil {
+				return 0, 0, err
+			}
+			in.Count, in.DataOffset = count, first
+		case modeRegular:
+			in.Count, in.DataOffset = uint64(child.size), wr.block
+			if err := wr.writeFile(child); err != nil {
+				return 0, 0, err
+			}
+		case modeSymlink:
+			in.Count, in.DataOffset = 1, wr.nlink
+			wr.links = appendString(wr.links, child.target)
+			wr.nlink++
+		}
+		wr.inodes[index] = in
+	}
+
+	first := wr.nentry
+	for i, name := range names {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], inodeNos[i])
+		wr.entries = appendString(append(wr.entries, buf[:]...), name)
+		wr.nentry++
+	}
+	return uint64(len(names)), first, nil
+}
+
+// writeFile writes content of the regular file padded to whole blocks.
+func (wr *writer) writeFile(n *node) error {
+	file, err := os.Open(n.source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.CopyN(wr.w, file, n.size); err != nil {
+		return fmt.Errorf("%s: %s", n.source, err)
+	}
+	count := blocks(n.size)
+	if padding := int64(count*BlockSize) - n.size; padding > 0 {
+		if _, err := wr.w.Write(make([]byte, padding)); err != nil {
+			return err
+		}
+	}
+	wr.block += count
+	return nil
+}
+
+// appendString appends the string prefixed with its 16-bit length.
+func appendString(b []byte, s string) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], uint16(len(s)))
+	return append(append(b, buf[:]...), s...)
+}
+
+// blocks returns the number of blocks that size bytes occupy.
+func blocks(size int64) uint64 {
+	return uint64((size + BlockSize - 1) / BlockSize)
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package rofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFS is a minimal reader of the filesystem, the same as OSv reads it.
+type readFS struct {
+	data    []byte
+	sb      superBlock
+	entries []struct {
+		inodeNo uint64
+		name    string
+	}
+	links  []string
+	inodes []inode
+}
+
+func parse(t *testing.T, data []byte) *readFS {
+	fs := &readFS{data: data}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &fs.sb); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(data[fs.sb.StructureInfoFirstBlock*BlockSize:])
+	readString := func() string {
+		var size uint16
+		binary.Read(r, binary.LittleEndian, &size)
+		s := make([]byte, size)
+		r.Read(s)
+		return string(s)
+	}
+	for i := uint64(0); i < fs.sb.DirectoryEntriesCount; i++ {
+		var inodeNo uint64
+		binary.Read(r, binary.LittleEndian, &inodeNo)
+		fs.entries = append(fs.entries, struct {
+			inodeNo uint64
+			name    string
+		}{inodeNo, readString()})
+	}
+	for i := uint64(0); i < fs.sb.SymlinksCount; i++ {
+		fs.links = append(fs.links, readString())
+	}
+	fs.inodes = make([]inode, fs.sb.InodesCount)
+	if err := binary.Read(r, binary.LittleEndian, fs.inodes); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// lookup returns the inode of the name in the directory.
+func (fs *readFS) lookup(dir inode, name string) (inode, bool) {
+	for _, e := range fs.entries[dir.DataOffset : dir.DataOffset+dir.Count] {
+		if e.name == name {
+			return fs.inodes[e.inodeNo-1], true
+		}
+	}
+	return inode{}, false
+}
+
+func TestSave(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rofs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	hello := filepath.Join(tmp, "hello.so")
+	content := bytes.Repeat([]byte("hello"), 200)
+	ioutil.WriteFile(hello, content, 0644)
+	config := filepath.Join(tmp, "app.conf")
+	ioutil.WriteFile(config, []byte("debug=true\n"), 0644)
+
+	fs := New()
+	for _, err := range []error{
+		fs.AddDir("/etc"),
+		fs.AddFile("/etc/app.conf", config),
+		fs.AddFile("/usr/lib/hello.so", hello),
+		fs.AddSymlink("/hello.so", "/usr/lib/hello.so"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.AddFile("relative", hello); err == nil {
+		t.Errorf("expected relative path to be rejected")
+	}
+
+	image, err := os.Create(filepath.Join(tmp, "rofs.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	size, err := fs.Save(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size%BlockSize != 0 {
+		t.Errorf("size %d is not a multiple of block size", size)
+	}
+	data, _ := ioutil.ReadFile(image.Name())
+	if int64(len(data)) != size {
+		t.Errorf("expected %d bytes to be written, got %d", size, len(data))
+	}
+
+	r := parse(t, data)
+	if r.sb.Magic != magic || r.sb.InodesCount != 7 || r.sb.SymlinksCount != 1 {
+		t.Fatalf("unexpected superblock %+v", r.sb)
+	}
+	root := r.inodes[0]
+	if root.Mode != modeDir || root.Count != 3 {
+		t.Fatalf("unexpected root %+v", root)
+	}
+
+	usr, _ := r.lookup(root, "usr")
+	lib, _ := r.lookup(usr, "lib")
+	so, ok := r.lookup(lib, "hello.so")
+	if !ok || so.Mode != modeRegular || so.Count != uint64(len(content)) {
+		t.Fatalf("unexpected /usr/lib/hello.so %+v", so)
+	}
+	if got := data[so.DataOffset*BlockSize : so.DataOffset*BlockSize+so.Count]; !bytes.Equal(got, content) {
+		t.Errorf("unexpected content of /usr/lib/hello.so")
+	}
+
+	etc, _ := r.lookup(root, "etc")
+	conf, ok := r.lookup(etc, "app.conf")
+	if !ok || string(data[conf.DataOffset*BlockSize:conf.DataOffset*BlockSize+conf.Count]) != "debug=true\n" {
+		t.Errorf("unexpected /etc/app.conf %+v", conf)
+	}
+
+	link, ok := r.lookup(root, "hello.so")
+	if !ok || link.Mode != modeSymlink || r.links[link.DataOffset] != "/usr/lib/hello.so" {
+		t.Errorf("unexpected symlink %+v", link)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// BootPreset is a well-known option of the OSv kernel that is given by its
+// name instead of the option itself, e.g. verbose for --verbose.
+type BootPreset struct {
+	Option string
+	// Value tells whether the option takes a value, given as
+	// <preset>=<value>, e.g. trace=vfs*.
+	Value       bool
+	Description string
+}
+
+// BootPresets are options of the OSv kernel by their preset names.
+var BootPresets = map[string]BootPreset{
+	"verbose":            {"--verbose", false, "print kernel messages while booting"},
+	"bootchart":          {"--bootchart", false, "print how long each stage of the boot takes"},
+	"trace":              {"--trace", true, "enable tracepoints matching the patterns, e.g. trace=vfs*,sched*"},
+	"trace-backtrace":    {"--trace-backtrace", false, "record backtraces of enabled tracepoints"},
+	"strace":             {"--strace", false, "print enabled tracepoints as they are hit"},
+	"noshutdown":         {"--noshutdown", false, "keep the instance running once the application exits"},
+	"power-off-on-abort": {"--power-off-on-abort", false, "power the instance off instead of halting when the kernel aborts"},
+	"nopci":              {"--nopci", false, "do not probe PCI devices"},
+	"leak":               {"--leak", false, "detect memory leaks of the application"},
+	"sampler":            {"--sampler", true, "sample CPUs with the given frequency in Hz, e.g. sampler=1000"},
+	"redirect":           {"--redirect", true, "redirect output of the application to the file, e.g. redirect=/out.log"},
+}
+
+// BootPresetNames returns names of the boot presets in alphabetical order.
+func BootPresetNames() []string {
+	var names []string
+	for name := range BootPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BootOpts are presets of OSv kernel options, e.g. verbose or trace=vfs*.
+// Options of the kernel that have no preset are given as they are, e.g.
+// --maxnic=2.
+type BootOpts []string
+
+func (b *BootOpts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list StringList
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*b = BootOpts(list)
+	return nil
+}
+
+// Options returns options of the OSv kernel that the presets stand for.
+func (b BootOpts) Options() ([]string, error) {
+	var options []string
+	for _, preset := range b {
+		preset = strings.TrimSpace(preset)
+		if strings.HasPrefix(preset, "--") {
+			options = append(options, preset)
+			continue
+		}
+
+		parts := strings.SplitN(preset, "=", 2)
+		p, ok := BootPresets[parts[0]]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("unknown boot preset '%s', use one of %s or an OSv option starting with --",
+				parts[0], strings.Join(BootPresetNames(), "|"))
+		case p.Value && (len(parts) != 2 || parts[1] == ""):
+			return nil, fmt.Errorf("boot preset '%s' requires a value, give it as %s=<value>", parts[0], parts[0])
+		case !p.Value && len(parts) == 2:
+			return nil, fmt.Errorf("boot preset '%s' takes no value", parts[0])
+		case p.Value:
+			options = append(options, p.Option+"="+parts[1])
+		default:
+			options = append(options, p.Option)
+		}
+	}
+	return options, nil
+}
+
+func (b BootOpts) Validate() error {
+	options, err := b.Options()
+	if err != nil {
+		return err
+	}
+	for _, option := range options {
+		if strings.ContainsAny(option, " \n") {
+			return fmt.Errorf("boot option '%s' must not contain whitespace", option)
+		}
+	}
+	return nil
+}
+
+// Apply inserts options of the presets into the command line, after the
+// options of the kernel that precede the command, e.g. environment variables.
+// Options that the command line already holds are not repeated.
+func (b BootOpts) Apply(cmdLine string) (string, error) {
+	options, err := b.Options()
+	if err != nil || len(options) == 0 {
+		return cmdLine, err
+	}
+
+	var leading []string
+	present := make(map[string]bool)
+	rest := strings.TrimSpace(cmdLine)
+	for strings.HasPrefix(rest, "--") || strings.HasPrefix(rest, `"--`) {
+		token := util.LeadingToken(rest)
+		leading = append(leading, token)
+		present[token] = true
+		rest = strings.TrimLeft(rest[len(token):], " ")
+	}
+	for _, option := range options {
+		if !present[option] {
+			leading = append(leading, option)
+			present[option] = true
+		}
+	}
+	if rest != "" {
+		leading = append(leading, rest)
+	}
+	return strings.Join(leading, " "), nil
+}
+
+func (b BootOpts) GetYamlTemplate() string {
+	return `
+# OPTIONAL
+# Options of the OSv kernel prepended to the command line when the image boots
+# this config set, given by presets: ` + strings.Join(BootPresetNames(), ", ") + `.
+# Presets with a value are given as <preset>=<value>, other kernel options
+# starting with -- are given as they are.
+# Example value:  boot_opts:
+#                    - verbose
+#                    - trace=vfs*
+boot_opts:
+   <list>
+`
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigSetInfo describes a config set that can be selected with --boot or
+// --runconfig.
+type ConfigSetInfo struct {
+	Name    string `yaml:"name" json:"name"`
+	Runtime string `yaml:"runtime" json:"runtime"`
+	Default bool   `yaml:"default,omitempty" json:"default"`
+	BootCmd string `yaml:"bootcmd" json:"bootcmd"`
+}
+
+// ConfigSetList is a list of config sets ordered by name.
+type ConfigSetList []ConfigSetInfo
+
+// ListConfigSets returns config sets of the manifest with their boot commands
+// resolved. The config set given as defaultName is marked as default.
+func (c *CmdConfig) ListConfigSets(defaultName string) (ConfigSetList, error) {
+	var names []string
+	for name := range c.ConfigSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := ConfigSetList{}
+	for _, name := range names {
+		conf := c.ConfigSets[name]
+		bootCmd, err := conf.GetBootCmd()
+		if err != nil {
+			return nil, err
+		}
+		if hooks := conf.GetHooks(); !hooks.IsEmpty() {
+			bootCmd = hooks.Apply(bootCmd, name)
+		}
+		list = append(list, ConfigSetInfo{
+			Name:    name,
+			Runtime: string(c.RuntimeType),
+			Default: name == defaultName,
+			BootCmd: bootCmd,
+		})
+	}
+	return list, nil
+}
+
+// ParseConfigSetList reads the list of config sets from the given file.
+func ParseConfigSetList(path string) (ConfigSetList, error) {
+	list := ConfigSetList{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return list, err
+	}
+
+	err = yaml.Unmarshal(data, &list)
+	return list, err
+}
+
+func (l ConfigSetList) WriteToFile(path string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
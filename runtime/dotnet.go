@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+type dotnetRuntime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Main          string   `yaml:"main"`
+	RuntimeConfig string   `yaml:"runtimeconfig"`
+	Args          []string `yaml:"args"`
+}
+
+//
+// Interface implementation
+//
+
+func (conf dotnetRuntime) GetRuntimeName() string {
+	return string(Dotnet)
+}
+func (conf dotnetRuntime) GetRuntimeDescription() string {
+	return "Run .NET Core application"
+}
+func (conf dotnetRuntime) GetDependencies() []string {
+	return []string{"dotnet-core"}
+}
+func (conf dotnetRuntime) Validate() error {
+	if conf.Main == "" {
+		return fmt.Errorf("'main' must be provided")
+	}
+
+	if filepath.Ext(conf.Main) != ".dll" {
+		return fmt.Errorf("'main' must be a .dll assembly, got '%s'", conf.Main)
+	}
+
+	if conf.RuntimeConfig != "" && !strings.HasSuffix(conf.RuntimeConfig, ".json") {
+		return fmt.Errorf("'runtimeconfig' must be a .json file, got '%s'", conf.RuntimeConfig)
+	}
+
+	return conf.CommonRuntime.Validate()
+}
+func (conf dotnetRuntime) GetBootCmd() (string, error) {
+	cmd := "/usr/bin/dotnet exec"
+	if conf.RuntimeConfig != "" {
+		cmd += " --runtimeconfig " + conf.RuntimeConfig
+	}
+	cmd += " " + conf.Main
+	if len(conf.Args) > 0 {
+		cmd += " " + strings.Join(conf.Args, " ")
+	}
+	return conf.CommonRuntime.BuildBootCmd(cmd)
+}
+func (conf dotnetRuntime) OnCollect(targetPath string) error {
+	return nil
+}
+func (conf dotnetRuntime) GetYamlTemplate() string {
+	return `
+# REQUIRED
+# Filepath of the application assembly.
+# Note that package root will correspond to filesystem root (/) in OSv image.
+# Example value: /app/hello.dll
+main: <filepath>
+
+# OPTIONAL
+# Filepath of the runtime configuration. By default the {name}.runtimeconfig.json
+# next to the assembly is used.
+# Example value: /app/hello.runtimeconfig.json
+runtimeconfig: <filepath>
+
+# OPTIONAL
+# A list of command line args used by the application.
+# Example value: args:
+#                   - --urls=http://0.0.0.0:5000
+args:
+   <list>
+` + conf.CommonRuntime.GetYamlTemplate()
+}
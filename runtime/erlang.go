@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type erlangRuntime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Release       string   `yaml:"release"`
+	Version       string   `yaml:"version"`
+	Name          string   `yaml:"name"`
+	Cookie        string   `yaml:"cookie"`
+	VmArgs        []string `yaml:"vmargs"`
+}
+
+//
+// Interface implementation
+//
+
+func (conf erlangRuntime) GetRuntimeName() string {
+	return string(Erlang)
+}
+func (conf erlangRuntime) GetRuntimeDescription() string {
+	return "Run Erlang/Elixir OTP release"
+}
+func (conf erlangRuntime) GetDependencies() []string {
+	return []string{"osv.erlang"}
+}
+func (conf erlangRuntime) Validate() error {
+	if conf.Release == "" {
+		return fmt.Errorf("'release' must be provided")
+	}
+
+	if conf.Version == "" {
+		return fmt.Errorf("'version' must be provided")
+	}
+
+	if strings.Contains(conf.Name, " ") {
+		return fmt.Errorf("spaces not allowed in node name: '%s'", conf.Name)
+	}
+
+	if strings.Contains(conf.Cookie, " ") {
+		return fmt.Errorf("spaces not allowed in cookie")
+	}
+
+	if conf.Cookie != "" && conf.Name == "" {
+		return fmt.Errorf("'cookie' requires node 'name' to be provided")
+	}
+
+	return conf.CommonRuntime.Validate()
+}
+func (conf erlangRuntime) GetBootCmd() (string, error) {
+	releaseDir := path.Join(conf.Release, "releases", conf.Version)
+
+	cmd := fmt.Sprintf("/usr/lib64/erlang/bin/erlexec -boot %s -config %s",
+		path.Join(releaseDir, "start"), path.Join(releaseDir, "sys"))
+
+	// Fully qualified node names (name@host) use long names.
+	if conf.Name != "" {
+		if strings.Contains(conf.Name, "@") {
+			cmd += " -name " + conf.Name
+		} else {
+			cmd += " -sname " + conf.Name
+		}
+	}
+	if conf.Cookie != "" {
+		cmd += " -setcookie " + conf.Cookie
+	}
+	for _, arg := range conf.VmArgs {
+		cmd += " " + arg
+	}
+	cmd += " -noshell -noinput"
+
+	// Release root is needed by the emulator to locate applications.
+	common := conf.CommonRuntime
+	common.Env = conf.GetEnv()
+	return common.BuildBootCmd(cmd)
+}
+func (conf erlangRuntime) OnCollect(targetPath string) error {
+	return nil
+}
+func (conf erlangRuntime) GetYamlTemplate() string {
+	return `
+# REQUIRED
+# Root directory of the OTP release (as built by relx, rebar3 or distillery).
+# Note that package root will correspond to filesystem root (/) in OSv image.
+# Example value: /myapp
+release: <directory>
+
+# REQUIRED
+# Version of the release to boot, i.e. name of the directory in releases/.
+# Example value: 0.1.0
+version: <version>
+
+# OPTIONAL
+# Name of the distributed node. Names with host part use long names.
+# Example value: myapp@192.168.122.15
+name: <name>
+
+# OPTIONAL
+# Magic cookie used by distributed nodes.
+# Example value: secret
+cookie: <cookie>
+
+# OPTIONAL
+# A list of additional emulator flags.
+# Example value: vmargs:
+#                   - +K true
+#                   - +A 4
+vmargs:
+   <list>
+` + conf.CommonRuntime.GetYamlTemplate()
+}
+
+// GetEnv returns environment variables including release ROOTDIR.
+// Explicitly provided variables take precedence.
+func (conf erlangRuntime) GetEnv() map[string]string {
+	env := map[string]string{
+		"ROOTDIR": conf.Release,
+	}
+	for k, v := range conf.Env {
+		env[k] = v
+	}
+	return env
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// RuntimeDefinition describes a runtime that is not built into capstan.
+// Definitions are read from yaml files in $HOME/.capstan/runtimes.
+type RuntimeDefinition struct {
+	Name         string                     `yaml:"name"`
+	Description  string                     `yaml:"description"`
+	Dependencies []string                   `yaml:"dependencies"`
+	BootCmd      string                     `yaml:"bootcmd"`
+	Fields       map[string]FieldDefinition `yaml:"fields"`
+}
+
+// FieldDefinition describes a field that config sets of the runtime accept.
+// Value of the field replaces ${<field>} in boot command of the runtime.
+type FieldDefinition struct {
+	Description string `yaml:"description"`
+	Required    bool   `yaml:"required"`
+	Example     string `yaml:"example"`
+}
+
+// externalRuntimes holds runtimes registered with RegisterRuntime, apart from
+// the built-in SupportedRuntimes.
+var externalRuntimes = map[RuntimeType]*RuntimeDefinition{}
+
+// Runtimes defined in $HOME/.capstan/runtimes are registered once external
+// runtimes are first looked up.
+var loadUserDefinitions sync.Once
+var userDefinitionsErr error
+
+// fieldPlaceholder matches ${<field>} in boot commands of runtimes.
+var fieldPlaceholder = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// RegisterRuntime makes the runtime described by the definition available
+// to meta/run.yaml.
+func RegisterRuntime(def RuntimeDefinition) error {
+	if def.Name == "" {
+		return fmt.Errorf("'name' must be provided")
+	}
+	if def.BootCmd == "" {
+		return fmt.Errorf("'bootcmd' must be provided for runtime '%s'", def.Name)
+	}
+
+	for _, dep := range def.Dependencies {
+		if _, err := core.ParseRequirement(dep); err != nil {
+			return err
+		}
+	}
+
+	runtimeType := RuntimeType(def.Name)
+	for _, builtin := range SupportedRuntimes {
+		if builtin == runtimeType {
+			return fmt.Errorf("runtime '%s' is already defined", def.Name)
+		}
+	}
+	if _, ok := externalRuntimes[runtimeType]; ok {
+		return fmt.Errorf("runtime '%s' is already defined", def.Name)
+	}
+
+	externalRuntimes[runtimeType] = &def
+	return nil
+}
+
+// AvailableRuntimes returns names of the built-in runtimes followed by those
+// registered apart from them, including runtimes defined in
+// $HOME/.capstan/runtimes.
+func AvailableRuntimes() ([]RuntimeType, error) {
+	err := loadUserRuntimeDefinitions()
+	var external []RuntimeType
+	for name := range externalRuntimes {
+		external = append(external, name)
+	}
+	sort.Slice(external, func(i, j int) bool { return external[i] < external[j] })
+	return append(append([]RuntimeType{}, SupportedRuntimes...), external...), err
+}
+
+// loadUserRuntimeDefinitions registers runtimes defined in
+// $HOME/.capstan/runtimes, only the first time it is called.
+func loadUserRuntimeDefinitions() error {
+	loadUserDefinitions.Do(func() {
+		userDefinitionsErr = LoadRuntimeDefinitions(filepath.Join(util.ConfigDir(), "runtimes"))
+	})
+	return userDefinitionsErr
+}
+
+// pickExternalRuntime returns the registered runtime with the given name or
+// nil when there is none.
+func pickExternalRuntime(runtimeName RuntimeType) (Runtime, error) {
+	if err := loadUserRuntimeDefinitions(); err != nil {
+		return nil, err
+	}
+	if def, ok := externalRuntimes[runtimeName]; ok {
+		return &externalRuntime{definition: def}, nil
+	}
+	return nil, nil
+}
+
+// LoadRuntimeDefinitions registers runtimes defined in yaml files of the
+// given directory. Missing directory is not an error.
+func LoadRuntimeDefinitions(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		def := RuntimeDefinition{}
+		if err := yaml.Unmarshal(data, &def); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", file, err)
+		}
+		if err := RegisterRuntime(def); err != nil {
+			return fmt.Errorf("failed to register runtime from %s: %s", file, err)
+		}
+	}
+	return nil
+}
+
+type externalRuntime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Values        map[string]interface{} `yaml:",inline"`
+	definition    *RuntimeDefinition
+}
+
+//
+// Interface implementation
+//
+
+func (conf externalRuntime) GetRuntimeName() string {
+	return conf.definition.Name
+}
+func (conf externalRuntime) GetRuntimeDescription() string {
+	return conf.definition.Description
+}
+func (conf externalRuntime) GetDependencies() []string {
+	return conf.definition.Dependencies
+}
+func (conf externalRuntime) Validate() error {
+	for _, name := range conf.fieldNames() {
+		if _, ok := conf.Values[name]; !ok && conf.definition.Fields[name].Required {
+			return fmt.Errorf("'%s' must be provided", name)
+		}
+	}
+
+	for name, value := range conf.Values {
+		if _, ok := conf.definition.Fields[name]; !ok {
+			return fmt.Errorf("unknown field '%s' of runtime '%s'", name, conf.definition.Name)
+		}
+		if _, err := formatValue(value); err != nil {
+			return fmt.Errorf("invalid value of '%s': %s", name, err)
+		}
+	}
+
+	return conf.CommonRuntime.Validate()
+}
+func (conf externalRuntime) GetBootCmd() (string, error) {
+	// Only fields of the runtime are replaced, any other $ is kept as is.
+	var err error
+	cmd := fieldPlaceholder.ReplaceAllStringFunc(conf.definition.BootCmd, func(placeholder string) string {
+		name := fieldPlaceholder.FindStringSubmatch(placeholder)[1]
+		if _, ok := conf.definition.Fields[name]; !ok {
+			return placeholder
+		}
+		value, ferr := formatValue(conf.Values[name])
+		if ferr != nil {
+			err = ferr
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Unset optional fields leave additional spaces behind.
+	cmd = strings.Join(strings.Fields(cmd), " ")
+	return conf.CommonRuntime.BuildBootCmd(cmd)
+}
+func (conf externalRuntime) OnCollect(targetPath string) error {
+	return nil
+}
+func (conf externalRuntime) GetYamlTemplate() string {
+	res := ""
+	for _, name := range conf.fieldNames() {
+		field := conf.definition.Fields[name]
+		if field.Required {
+			res += "\n# REQUIRED\n"
+		} else {
+			res += "\n# OPTIONAL\n"
+		}
+		if field.Description != "" {
+			res += fmt.Sprintf("# %s\n", field.Description)
+		}
+		if field.Example != "" {
+			res += fmt.Sprintf("# Example value: %s\n", field.Example)
+		}
+		res += fmt.Sprintf("%s: <value>\n", name)
+	}
+	return res + conf.CommonRuntime.GetYamlTemplate()
+}
+
+//
+// Utility
+//
+
+func (conf externalRuntime) fieldNames() []string {
+	var names []string
+	for name := range conf.definition.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatValue returns the value as it appears in boot command. Lists are
+// joined with spaces.
+func formatValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		var items []string
+		for _, item := range value {
+			s, err := formatValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, " "), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("maps are not supported")
+	}
+	return fmt.Sprint(value), nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// goLoader is the OSv loader that runs Go applications built as shared objects.
+const goLoader = "/go.so"
+
+type golangRuntime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Main          string   `yaml:"main"`
+	BuildMode     string   `yaml:"buildmode"`
+	Args          []string `yaml:"args"`
+	MaxProcs      int      `yaml:"maxprocs"`
+	GoGC          string   `yaml:"gogc"`
+}
+
+//
+// Interface implementation
+//
+
+func (conf golangRuntime) GetRuntimeName() string {
+	return string(Golang)
+}
+func (conf golangRuntime) GetRuntimeDescription() string {
+	return "Run Go application built with the OSv toolchain"
+}
+func (conf golangRuntime) GetDependencies() []string {
+	return []string{}
+}
+func (conf golangRuntime) Validate() error {
+	if conf.Main == "" {
+		return fmt.Errorf("'main' must be provided")
+	}
+
+	switch conf.GetBuildMode() {
+	case "pie", "shared":
+	default:
+		return fmt.Errorf("unknown buildmode '%s', use one of pie|shared", conf.BuildMode)
+	}
+
+	if conf.MaxProcs < 0 {
+		return fmt.Errorf("'maxprocs' must not be negative")
+	}
+
+	if conf.GoGC != "" && conf.GoGC != "off" {
+		if _, err := strconv.Atoi(conf.GoGC); err != nil {
+			return fmt.Errorf("'gogc' must be a percentage or 'off', got '%s'", conf.GoGC)
+		}
+	}
+
+	return conf.CommonRuntime.Validate()
+}
+func (conf golangRuntime) GetBootCmd() (string, error) {
+	cmd := conf.Main
+	if conf.GetBuildMode() == "shared" {
+		cmd = goLoader + " " + cmd
+	}
+	if len(conf.Args) > 0 {
+		cmd += " " + strings.Join(conf.Args, " ")
+	}
+
+	// Go runtime settings are set together with other environment variables.
+	common := conf.CommonRuntime
+	common.Env = conf.GetEnv()
+	return common.BuildBootCmd(cmd)
+}
+func (conf golangRuntime) OnCollect(targetPath string) error {
+	return nil
+}
+func (conf golangRuntime) GetYamlTemplate() string {
+	return `
+# REQUIRED
+# Filepath of the Go application binary.
+# Note that package root will correspond to filesystem root (/) in OSv image.
+# Example value: /app/server.so
+main: <filepath>
+
+# OPTIONAL
+# How the application was built: pie (go build -buildmode=pie) runs the binary
+# directly, shared (go build -buildmode=c-shared) runs it with the OSv Go loader.
+# Example value: shared
+buildmode: pie
+
+# OPTIONAL
+# A list of command line args used by the application.
+# Example value: args:
+#                   - -port=8000
+args:
+   <list>
+
+# OPTIONAL
+# Maximum number of CPUs executing Go code simultaneously (GOMAXPROCS).
+# Example value: 2
+maxprocs: <number>
+
+# OPTIONAL
+# Garbage collection target percentage (GOGC) or 'off' (quoted, since plain
+# off is parsed as boolean).
+# Example value: 200
+gogc: <percentage>
+` + conf.CommonRuntime.GetYamlTemplate()
+}
+
+// GetEnv returns environment variables including Go runtime settings.
+// Explicitly provided variables take precedence over maxprocs and gogc.
+func (conf golangRuntime) GetEnv() map[string]string {
+	env := map[string]string{}
+	if conf.MaxProcs > 0 {
+		env["GOMAXPROCS"] = strconv.Itoa(conf.MaxProcs)
+	}
+	if conf.GoGC != "" {
+		env["GOGC"] = conf.GoGC
+	}
+	for k, v := range conf.Env {
+		env[k] = v
+	}
+	return env
+}
+
+//
+// Utility
+//
+
+func (conf golangRuntime) GetBuildMode() string {
+	if conf.BuildMode == "" {
+		return "pie"
+	}
+	return conf.BuildMode
+}
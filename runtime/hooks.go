@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// Hooks are commands that OSv runs before the main command of the config set
+// starts and after it exits, e.g. to create directories or write config files
+// from environment variables.
+type Hooks struct {
+	PreBoot  StringList `yaml:"pre_boot"`
+	PostBoot StringList `yaml:"post_boot"`
+}
+
+func (h Hooks) IsEmpty() bool {
+	return len(h.PreBoot) == 0 && len(h.PostBoot) == 0
+}
+
+type hook struct {
+	name string
+	cmds StringList
+}
+
+// hooks returns names and commands of the hooks in the order they run.
+func (h Hooks) hooks() []hook {
+	return []hook{{"pre_boot", h.PreBoot}, {"post_boot", h.PostBoot}}
+}
+
+func (h Hooks) Validate() error {
+	for _, hook := range h.hooks() {
+		for i, cmd := range hook.cmds {
+			if strings.TrimSpace(cmd) == "" {
+				return fmt.Errorf("empty command #%d of '%s' hook", i, hook.name)
+			}
+			if strings.Contains(cmd, "\n") {
+				return fmt.Errorf("newlines not allowed in command #%d of '%s' hook", i, hook.name)
+			}
+		}
+	}
+	return nil
+}
+
+// HookScript returns path of the runscript in the image that runs the given
+// hook (pre_boot or post_boot) of the config set.
+func HookScript(configSet, hook string) string {
+	return fmt.Sprintf("/run/%s.%s", configSet, hook)
+}
+
+// WriteScripts writes runscripts of the hooks of the config set into the
+// given run directory. Commands of each hook are run one after another.
+func (h Hooks) WriteScripts(runDir, configSet string) error {
+	for _, hook := range h.hooks() {
+		if len(hook.cmds) == 0 {
+			continue
+		}
+
+		var trimmed []string
+		for _, cmd := range hook.cmds {
+			trimmed = append(trimmed, strings.TrimSpace(cmd))
+		}
+		script := filepath.Join(runDir, filepath.Base(HookScript(configSet, hook.name)))
+		if err := ioutil.WriteFile(script, []byte(strings.Join(trimmed, " ; ")), 0775); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply wraps the boot command of the config set with runscripts of its
+// hooks. Environment variables set by the boot command come first so that
+// hooks see them as well.
+func (h Hooks) Apply(bootCmd, configSet string) string {
+	env := ""
+	rest := strings.TrimSpace(bootCmd)
+	for strings.HasPrefix(rest, "--env=") || strings.HasPrefix(rest, `"--env=`) {
+		token := util.LeadingToken(rest)
+		env += token + " "
+		rest = strings.TrimLeft(rest[len(token):], " ")
+	}
+
+	if len(h.PreBoot) > 0 {
+		rest = fmt.Sprintf("runscript %s ; %s", HookScript(configSet, "pre_boot"), rest)
+	}
+	if len(h.PostBoot) > 0 {
+		rest = fmt.Sprintf("%s ; runscript %s", rest, HookScript(configSet, "post_boot"))
+	}
+	return env + rest
+}
+
+func (h Hooks) GetYamlTemplate() string {
+	return `
+# OPTIONAL
+# Commands that OSv runs before the main command starts (pre_boot) and after
+# it exits (post_boot), one after another. Environment variables of this config
+# set are available to them. Use them for simple setup steps, e.g. to create
+# directories or to write config files.
+# Example value:  hooks:
+#                    pre_boot:
+#                       - /tools/mkdir.so /data/cache
+#                       - /tools/render-config.so /etc/app.conf
+#                    post_boot:
+#                       - /tools/flush.so
+hooks:
+   <map>
+`
+}
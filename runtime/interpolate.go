@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ValuesFileEnv is the environment variable pointing to the values file that
+// is used instead of meta/values.yaml of the package.
+const ValuesFileEnv = "CAPSTAN_VALUES"
+
+var variablePattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+var singleVariablePattern = regexp.MustCompile(`^\$\{[A-Za-z_][A-Za-z0-9_]*(:-[^}]*)?\}$`)
+
+// Values are used to expand ${VAR} references in meta/run.yaml. Variables
+// from the host environment take precedence over values.
+type Values map[string]string
+
+// LoadValues reads values of the package from meta/values.yaml or from the
+// file given in CAPSTAN_VALUES environment variable. Missing meta/values.yaml
+// is not an error.
+func LoadValues(packageDir string) (Values, error) {
+	valuesFile := os.Getenv(ValuesFileEnv)
+	if valuesFile == "" {
+		valuesFile = filepath.Join(packageDir, "meta", "values.yaml")
+		if _, err := os.Stat(valuesFile); os.IsNotExist(err) {
+			return Values{}, nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(valuesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := ParseValues(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", valuesFile, err)
+	}
+	return values, nil
+}
+
+// ParseValues parses the content of a values file, e.g. meta/values.yaml of
+// a required package.
+func ParseValues(data []byte) (Values, error) {
+	values := Values{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Lookup returns the value of the variable, looking into host environment first.
+func (v Values) Lookup(name string) (string, bool) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	value, ok := v[name]
+	return value, ok
+}
+
+// Expand replaces ${VAR} and ${VAR:-default} references in the string. The
+// default is used when the variable is unset or empty. Use $$ for literal $.
+func (v Values) Expand(s string) (string, error) {
+	var undefined []string
+	res := variablePattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		groups := variablePattern.FindStringSubmatch(match)
+		value, ok := v.Lookup(groups[1])
+		if groups[2] != "" && value == "" {
+			return groups[3]
+		}
+		if !ok {
+			undefined = append(undefined, groups[1])
+		}
+		return value
+	})
+
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("undefined variable: %s", strings.Join(undefined, ", "))
+	}
+	return res, nil
+}
+
+// expandValues expands variables in all strings of the parsed yaml value.
+func (v Values) expandValues(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		expanded, err := v.Expand(value)
+		if err != nil || !singleVariablePattern.MatchString(value) {
+			return expanded, err
+		}
+
+		// Value consisting of a single variable gets the type of the expanded
+		// scalar, e.g. 'cpus: ${CPUS}' is an integer. Only scalars written
+		// the way yaml writes them back are typed, so that the value is
+		// substituted as is, e.g. '1.10' and 'yes' remain strings.
+		var typed interface{}
+		if err := yaml.Unmarshal([]byte(expanded), &typed); err == nil {
+			switch typed.(type) {
+			case int, int64, uint64, float64, bool:
+				if out, err := yaml.Marshal(typed); err == nil && strings.TrimSpace(string(out)) == expanded {
+					return typed, nil
+				}
+			}
+		}
+		return expanded, nil
+	case []interface{}:
+		res := make([]interface{}, len(value))
+		for i, item := range value {
+			expanded, err := v.expandValues(item)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = expanded
+		}
+		return res, nil
+	case map[interface{}]interface{}:
+		res := make(map[interface{}]interface{})
+		for k, item := range value {
+			expanded, err := v.expandValues(item)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = expanded
+		}
+		return res, nil
+	case map[string]interface{}:
+		res := make(map[string]interface{})
+		for k, item := range value {
+			expanded, err := v.expandValues(item)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = expanded
+		}
+		return res, nil
+	}
+	return value, nil
+}
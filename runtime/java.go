@@ -8,21 +8,54 @@
 package runtime
 
 import (
+	"archive/zip"
+	"bufio"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
 )
 
 type javaRuntime struct {
 	CommonRuntime `yaml:"-,inline"`
+	JavaVersion   string   `yaml:"java_version"`
+	JdkPackage    string   `yaml:"jdk_package"`
+	JdkConfigSet  string   `yaml:"jdk_config_set"`
 	Main          string   `yaml:"main"`
+	Module        string   `yaml:"module"`
+	Jar           string   `yaml:"jar"`
+	Build         string   `yaml:"build"`
 	Args          []string `yaml:"args"`
 	Classpath     []string `yaml:"classpath"`
 	JvmArgs       []string `yaml:"jvmargs"`
 }
 
+// DefaultJavaVersion is used when java_version is not set.
+const DefaultJavaVersion = "8"
+
+// jdkPackages maps supported Java versions to OSv JDK packages published in
+// the package repository.
+var jdkPackages = map[string]string{
+	"8":  "openjdk8-zulu-compact1",
+	"11": "openjdk11-zulu",
+	"17": "openjdk17-zulu",
+}
+
+// buildTools maps supported build tools to their wrapper scripts, commands
+// and directories where they store the produced artifacts.
+var buildTools = map[string]struct {
+	wrapper string
+	command []string
+	output  string
+}{
+	"maven":  {"mvnw", []string{"mvn", "package"}, "target"},
+	"gradle": {"gradlew", []string{"gradle", "build"}, filepath.Join("build", "libs")},
+}
+
 //
 // Interface implementation
 //
@@ -34,24 +67,113 @@ func (conf javaRuntime) GetRuntimeDescription() string {
 	return "Run Java application"
 }
 func (conf javaRuntime) GetDependencies() []string {
-	return []string{"openjdk8-zulu-compact1"}
+	if jdk := conf.GetJdkPackage(); jdk != "" {
+		return []string{jdk}
+	}
+	return nil
+}
+func (conf javaRuntime) GetBase() []string {
+	if conf.JdkConfigSet == "" {
+		return conf.Base
+	}
+	return append([]string{conf.GetJdkPackage() + ":" + conf.JdkConfigSet}, conf.Base...)
 }
 func (conf javaRuntime) Validate() error {
-	if conf.Main == "" {
-		return fmt.Errorf("'main' must be provided")
+	if conf.Main == "" && conf.Jar == "" {
+		return fmt.Errorf("'main' or 'jar' must be provided")
 	}
 
-	if conf.Classpath == nil {
+	if conf.Classpath == nil && conf.Jar == "" {
 		return fmt.Errorf("'classpath' must be provided")
 	}
 
+	if conf.Classpath != nil && conf.Jar != "" && conf.Main == "" {
+		return fmt.Errorf("'classpath' cannot be used with 'jar' unless 'main' is provided")
+	}
+
+	if _, ok := jdkPackages[conf.GetJavaVersion()]; !ok {
+		return fmt.Errorf("unsupported java_version '%s', use one of 8|11|17", conf.JavaVersion)
+	}
+
+	if conf.Module != "" && !conf.isModular() {
+		return fmt.Errorf("'module' requires java_version 11 or newer")
+	}
+
+	if conf.Module != "" && conf.Main == "" {
+		return fmt.Errorf("'main' must be provided when 'module' is used")
+	}
+
+	if conf.Build != "" {
+		if _, ok := buildTools[conf.Build]; !ok {
+			return fmt.Errorf("unknown build tool '%s', use one of maven|gradle", conf.Build)
+		}
+		if conf.Jar == "" {
+			return fmt.Errorf("'jar' must be provided when 'build' is used")
+		}
+	}
+
 	return conf.CommonRuntime.Validate()
 }
 func (conf javaRuntime) GetBootCmd() (string, error) {
+	// Jar is started directly, its main class is read from the manifest. JDK 11
+	// and newer lack the isolated loader of JDK 8 and run the application
+	// with the standard launcher.
+	if conf.Jar != "" || conf.isModular() {
+		return conf.GetBootCmdWithArgs(nil)
+	}
+
+	conf.CommonRuntime.Base = conf.GetBase()
 	cmd := fmt.Sprintf("java.so %s io.osv.isolated.MultiJarLoader -mains /etc/javamains", conf.GetJvmArgs())
 	return conf.CommonRuntime.BuildBootCmd(cmd)
 }
+func (conf javaRuntime) GetBootCmdWithArgs(args []string) (string, error) {
+	// Arguments cannot be appended to /etc/javamains, hence the application is
+	// started directly.
+	conf.Args = append(append([]string{}, conf.Args...), args...)
+	conf.CommonRuntime.Base = conf.GetBase()
+	cmd := "java.so"
+	if jvmArgs := conf.GetJvmArgs(); jvmArgs != "" {
+		cmd += " " + jvmArgs
+	}
+	cmd += " " + conf.GetCommandLine()
+	return conf.CommonRuntime.BuildBootCmd(cmd)
+}
+func (conf javaRuntime) OnCollectPackage(packageDir, targetPath string) error {
+	if conf.Jar == "" {
+		return nil
+	}
+
+	jarPath := filepath.Join(targetPath, conf.Jar)
+	if conf.Build != "" {
+		artifact, err := conf.buildJar(packageDir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Using %s as %s\n", artifact, conf.Jar)
+		if err := os.MkdirAll(filepath.Dir(jarPath), 0775); err != nil {
+			return err
+		}
+		if err := util.CopyLocalFile(jarPath, artifact); err != nil {
+			return err
+		}
+	}
+
+	if conf.Main == "" {
+		if _, err := ReadMainClass(jarPath); err != nil {
+			return fmt.Errorf("failed to read main class of %s: %s", conf.Jar, err)
+		}
+	}
+	return nil
+}
+func (conf javaRuntime) GetWrittenPaths() map[string]string {
+	return map[string]string{"/tmp": "JVM performance data"}
+}
 func (conf javaRuntime) OnCollect(targetPath string) error {
+	// Java launch definition is only read by the isolated loader of JDK 8.
+	if conf.isModular() {
+		return nil
+	}
+
 	// Check if /etc folder is already available. This is where we are going to store
 	// Java launch definition.
 	etcDir := filepath.Join(targetPath, "etc")
@@ -68,12 +190,48 @@ func (conf javaRuntime) OnCollect(targetPath string) error {
 }
 func (conf javaRuntime) GetYamlTemplate() string {
 	return `
-# REQUIRED
+# OPTIONAL
+# Version of the JDK to run the application with: 8 (default), 11 or 17.
+# Example value: 11
+java_version: 8
+
+# OPTIONAL
+# Package providing the JDK instead of the one of java_version, which is
+# openjdk8-zulu-compact1, openjdk11-zulu or openjdk17-zulu.
+# Example value: openjdk11-from-host
+jdk_package: <name>
+
+# OPTIONAL
+# Config set of the JDK package that this config set is based on, e.g. one
+# that sets JAVA_OPTS.
+# Example value: default
+jdk_config_set: <name>
+
+# OPTIONAL
+# Name of the module to run the main class from, Java 11 and newer only.
+# The classpath is then used as the module path.
+# Example value: com.example.hello
+module: <name>
+
+# REQUIRED (unless jar is provided)
 # Fully classified name of the main class.
 # Example value: main.Hello
 main: <name>
 
-# REQUIRED
+# OPTIONAL
+# Path to the executable jar. Main class is read from its manifest unless
+# main is provided.
+# Example value: /app.jar
+jar: <path>
+
+# OPTIONAL
+# Build tool used to build the jar during collect, either maven or gradle.
+# The jar produced by 'mvn package' (target/) or 'gradle build' (build/libs/)
+# is used as jar. Wrapper scripts mvnw and gradlew are preferred if present.
+# Example value: maven
+build: <tool>
+
+# REQUIRED (unless jar is provided)
 # A list of paths where classes and other resources can be found.
 # Example value: classpath:
 #                   - /
@@ -107,16 +265,45 @@ jvmargs:
 func (conf javaRuntime) GetCommandLine() string {
 	var cp, args string
 
-	if len(conf.Classpath) > 0 {
-		cp = "-cp " + strings.Join(conf.Classpath, ":")
+	classpath := conf.Classpath
+	if conf.Jar != "" {
+		classpath = append([]string{conf.Jar}, classpath...)
+	}
+	if len(classpath) > 0 {
+		cp = "-cp " + strings.Join(classpath, ":")
 	}
 
 	if len(conf.Args) > 0 {
 		args = strings.Join(conf.Args, " ")
 	}
 
+	if conf.Jar != "" && conf.Main == "" {
+		return strings.TrimSpace(fmt.Sprintf("-jar %s %s", conf.Jar, args))
+	}
+	if conf.Module != "" {
+		return strings.TrimSpace(fmt.Sprintf("--module-path %s -m %s/%s %s",
+			strings.Join(classpath, ":"), conf.Module, conf.Main, args))
+	}
 	return strings.TrimSpace(fmt.Sprintf("%s %s %s", cp, conf.Main, args))
 }
+func (conf javaRuntime) GetJavaVersion() string {
+	if conf.JavaVersion == "" {
+		return DefaultJavaVersion
+	}
+	return conf.JavaVersion
+}
+func (conf javaRuntime) GetJdkPackage() string {
+	if conf.JdkPackage != "" {
+		return conf.JdkPackage
+	}
+	return jdkPackages[conf.GetJavaVersion()]
+}
+
+// isModular tells whether the JDK is 11 or newer, i.e. with the module system
+// and without the isolated loader of JDK 8.
+func (conf javaRuntime) isModular() bool {
+	return conf.GetJavaVersion() != "8"
+}
 func (conf javaRuntime) GetJvmArgs() string {
 	vmargs := ""
 
@@ -126,3 +313,70 @@ func (conf javaRuntime) GetJvmArgs() string {
 
 	return strings.TrimSpace(vmargs)
 }
+
+// buildJar runs the build tool in the package directory and returns the jar
+// it produced.
+func (conf javaRuntime) buildJar(packageDir string) (string, error) {
+	tool := buildTools[conf.Build]
+
+	command := tool.command
+	if _, err := os.Stat(filepath.Join(packageDir, tool.wrapper)); err == nil {
+		command = append([]string{"./" + tool.wrapper}, command[1:]...)
+	}
+
+	fmt.Printf("Building jar with '%s'\n", strings.Join(command, " "))
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = packageDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to build jar with %s: %s", conf.Build, err)
+	}
+
+	jars, _ := filepath.Glob(filepath.Join(packageDir, tool.output, "*.jar"))
+	var candidates []string
+	for _, jar := range jars {
+		name := filepath.Base(jar)
+		if strings.HasSuffix(name, "-sources.jar") || strings.HasSuffix(name, "-javadoc.jar") ||
+			strings.HasSuffix(name, "-plain.jar") || strings.HasPrefix(name, "original-") {
+			continue
+		}
+		candidates = append(candidates, jar)
+	}
+	if len(candidates) != 1 {
+		return "", fmt.Errorf("expected exactly one jar in %s, found %d", tool.output, len(candidates))
+	}
+	return candidates[0], nil
+}
+
+// ReadMainClass returns Main-Class attribute from the manifest of the jar.
+func ReadMainClass(jarPath string) (string, error) {
+	r, err := zip.OpenReader(jarPath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != "META-INF/MANIFEST.MF" {
+			continue
+		}
+
+		manifest, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer manifest.Close()
+
+		scanner := bufio.NewScanner(manifest)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "Main-Class:") {
+				return strings.TrimSpace(strings.TrimPrefix(line, "Main-Class:")), nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("Main-Class not found in manifest")
+}
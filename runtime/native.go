@@ -9,6 +9,9 @@ package runtime
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 )
 
 type nativeRuntime struct {
@@ -30,14 +33,29 @@ func (conf nativeRuntime) GetDependencies() []string {
 	return []string{}
 }
 func (conf nativeRuntime) Validate() error {
-	if conf.BootCmd == "" {
-		return fmt.Errorf("'bootcmd' must be provided")
+	if conf.BootCmd == "" && len(conf.Base) == 0 {
+		return fmt.Errorf("'bootcmd' or 'base' must be provided")
+	}
+
+	if _, err := chainCommands(conf.BootCmd); err != nil {
+		return err
 	}
 
 	return conf.CommonRuntime.Validate()
 }
 func (conf nativeRuntime) GetBootCmd() (string, error) {
-	cmd := conf.BootCmd
+	commands, err := chainCommands(conf.BootCmd)
+	if err != nil {
+		return "", err
+	}
+	return conf.CommonRuntime.BuildBootCmd(strings.Join(commands, " ; "))
+}
+func (conf nativeRuntime) GetBootCmdWithArgs(args []string) (string, error) {
+	commands, err := chainCommands(conf.BootCmd)
+	if err != nil {
+		return "", err
+	}
+	cmd := strings.TrimSpace(strings.Join(append([]string{strings.Join(commands, " ; ")}, args...), " "))
 	return conf.CommonRuntime.BuildBootCmd(cmd)
 }
 func (conf nativeRuntime) OnCollect(targetPath string) error {
@@ -48,7 +66,92 @@ func (conf nativeRuntime) GetYamlTemplate() string {
 # REQUIRED
 # Command to be executed in OSv.
 # Note that package root will correspond to filesystem root (/) in OSv image.
+# Several commands can be joined with && or ; to run them one after another,
+# e.g. to prepare data before the application is started. They are written
+# into their own runscript when the package is composed. OSv powers the
+# instance off when a command of the chain can not be started, hence the
+# commands after it are not run.
 # Example value: /usr/bin/simpleFoam.so -help
 bootcmd: <command>
 `
 }
+
+//
+// Utility
+//
+
+// ChainScript returns path of the runscript in the image that runs the
+// commands chained in bootcmd of the native config set.
+func ChainScript(configSet string) string {
+	return fmt.Sprintf("/run/%s.chain", configSet)
+}
+
+// WriteChainScript writes commands chained in bootcmd of the native config
+// set into their own runscript in runDir, one after another, and returns the
+// boot command that runs the runscript instead. Environment variables set by
+// the boot command are kept in front of it. Boot commands of other config sets
+// and of a single command are returned unchanged.
+func WriteChainScript(conf Runtime, bootCmd, runDir, configSet string) (string, error) {
+	native, ok := conf.(*nativeRuntime)
+	if !ok {
+		return bootCmd, nil
+	}
+	commands, err := chainCommands(native.BootCmd)
+	if err != nil || len(commands) < 2 {
+		return bootCmd, err
+	}
+
+	script := filepath.Join(runDir, filepath.Base(ChainScript(configSet)))
+	if err := ioutil.WriteFile(script, []byte(strings.Join(commands, " ; ")), 0775); err != nil {
+		return "", err
+	}
+	return strings.Replace(bootCmd, strings.Join(commands, " ; "), "runscript "+ChainScript(configSet), 1), nil
+}
+
+// chainCommands splits commands joined with && or ; into commands that OSv
+// runs one after another. Separators inside quotes are left intact. || is
+// rejected since OSv has no means to run a command only when another one
+// failed.
+func chainCommands(bootCmd string) ([]string, error) {
+	var commands []string
+	quote := byte(0)
+	start := 0
+	for i := 0; i <= len(bootCmd); i++ {
+		separator := 0
+		switch {
+		case i == len(bootCmd):
+		case quote != 0:
+			if bootCmd[i] == '\\' {
+				i++
+			} else if bootCmd[i] == quote {
+				quote = 0
+			}
+			continue
+		case bootCmd[i] == '"' || bootCmd[i] == '\'':
+			quote = bootCmd[i]
+			continue
+		case strings.HasPrefix(bootCmd[i:], "||"):
+			return nil, fmt.Errorf("'||' is not supported by OSv, join commands with '&&' or ';' instead: '%s'", bootCmd)
+		case strings.HasPrefix(bootCmd[i:], "&&"):
+			separator = 2
+		case bootCmd[i] == ';':
+			separator = 1
+		default:
+			continue
+		}
+
+		command := strings.TrimSpace(bootCmd[start:i])
+		if command == "" && (separator > 0 || len(commands) > 0) {
+			return nil, fmt.Errorf("empty command in bootcmd: '%s'", bootCmd)
+		}
+		if command != "" {
+			commands = append(commands, command)
+		}
+		if separator == 0 {
+			break
+		}
+		i += separator - 1
+		start = i + 1
+	}
+	return commands, nil
+}
@@ -8,12 +8,34 @@
 package runtime
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 )
 
+// DefaultNodeVersion is used when node_version is not set.
+const DefaultNodeVersion = "4.4.5"
+
+var nodeVersionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,2}$`)
+
 type nodeJsRuntime struct {
 	CommonRuntime `yaml:"-,inline"`
-	Main          string `yaml:"main"`
+	NodeVersion   string   `yaml:"node_version"`
+	Main          string   `yaml:"main"`
+	Args          []string `yaml:"args"`
+	NpmInstall    bool     `yaml:"npm_install"`
+}
+
+// packageJson holds the fields of package.json that the runtime uses.
+type packageJson struct {
+	Main    string            `json:"main"`
+	Scripts map[string]string `json:"scripts"`
 }
 
 //
@@ -24,12 +46,16 @@ func (conf nodeJsRuntime) GetRuntimeName() string {
 	return string(NodeJS)
 }
 func (conf nodeJsRuntime) GetRuntimeDescription() string {
-	return "Run JavaScript NodeJS 4.4.5 application"
+	return "Run JavaScript NodeJS application"
 }
 func (conf nodeJsRuntime) GetDependencies() []string {
-	return []string{"node-4.4.5"}
+	return []string{"node-" + conf.GetNodeVersion()}
 }
 func (conf nodeJsRuntime) Validate() error {
+	if !nodeVersionPattern.MatchString(conf.GetNodeVersion()) {
+		return fmt.Errorf("invalid node_version '%s', expected e.g. 4.4.5", conf.NodeVersion)
+	}
+
 	if conf.Main == "" {
 		return fmt.Errorf("'main' must be provided")
 	}
@@ -37,18 +63,120 @@ func (conf nodeJsRuntime) Validate() error {
 	return conf.CommonRuntime.Validate()
 }
 func (conf nodeJsRuntime) GetBootCmd() (string, error) {
-	cmd := fmt.Sprintf("node %s", conf.Main)
-	return conf.CommonRuntime.BuildBootCmd(cmd)
+	return conf.GetBootCmdWithArgs(nil)
+}
+func (conf nodeJsRuntime) GetBootCmdWithArgs(args []string) (string, error) {
+	cmd := strings.Join(append(append([]string{"node", conf.Main}, conf.Args...), args...), " ")
+	common := conf.CommonRuntime
+	common.Env = conf.GetEnv()
+	return common.BuildBootCmd(cmd)
+}
+func (conf *nodeJsRuntime) ResolvePackage(packageDir string) error {
+	if conf.Main != "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(packageDir, "package.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	pkg := packageJson{}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return fmt.Errorf("failed to parse package.json: %s", err)
+	}
+
+	// Start script takes precedence since this is what 'npm start' runs.
+	if start := strings.Fields(pkg.Scripts["start"]); len(start) > 1 && start[0] == "node" {
+		conf.Main = path.Join("/", start[1])
+		conf.Args = append(start[2:], conf.Args...)
+	} else if pkg.Main != "" {
+		conf.Main = path.Join("/", pkg.Main)
+	}
+	return nil
+}
+func (conf nodeJsRuntime) OnCollectPackage(packageDir, targetPath string) error {
+	if !conf.NpmInstall {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(targetPath, "package.json")); err != nil {
+		return fmt.Errorf("package.json is required for npm_install")
+	}
+
+	// Use exact versions from the lock file if it is available.
+	args := []string{"install", "--production"}
+	if _, err := os.Stat(filepath.Join(targetPath, "package-lock.json")); err == nil {
+		args = []string{"ci", "--production"}
+	}
+
+	fmt.Printf("Installing node modules with 'npm %s'\n", strings.Join(args, " "))
+	cmd := exec.Command("npm", args...)
+	cmd.Dir = targetPath
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("npm %s failed: %s", args[0], err)
+	}
+	return nil
 }
 func (conf nodeJsRuntime) OnCollect(targetPath string) error {
 	return nil
 }
 func (conf nodeJsRuntime) GetYamlTemplate() string {
 	return `
-# REQUIRED
+# OPTIONAL
+# Version of NodeJS to run the application with. Package node-<version> must
+# be available in the repository.
+# Example value: 4.4.5
+node_version: ` + DefaultNodeVersion + `
+
+# REQUIRED (unless package.json is provided)
 # Filepath of the NodeJS entrypoint (where server is defined).
 # Note that package root will correspond to filesystem root (/) in OSv image.
+# When omitted, it is read from 'scripts.start' or 'main' of package.json.
 # Example value: /server.js
 main: <filepath>
+
+# OPTIONAL
+# A list of command line args used by the application.
+# Example value: args:
+#                   - --port=8000
+args:
+   <list>
+
+# OPTIONAL
+# Install production dependencies of package.json into the package with
+# 'npm ci --production' (or 'npm install --production' when there is no
+# package-lock.json) when the package is collected. NODE_PATH is set to
+# /node_modules.
+# Example value: true
+npm_install: false
 ` + conf.CommonRuntime.GetYamlTemplate()
 }
+
+//
+// Utility
+//
+
+func (conf nodeJsRuntime) GetNodeVersion() string {
+	if conf.NodeVersion == "" {
+		return DefaultNodeVersion
+	}
+	return conf.NodeVersion
+}
+
+// GetEnv returns environment variables including NODE_PATH when modules are
+// installed. Explicitly provided variables take precedence.
+func (conf nodeJsRuntime) GetEnv() map[string]string {
+	env := map[string]string{}
+	if conf.NpmInstall {
+		env["NODE_PATH"] = "/node_modules"
+	}
+	for k, v := range conf.Env {
+		env[k] = v
+	}
+	return env
+}
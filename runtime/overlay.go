@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	goruntime "runtime"
+	"strings"
+)
+
+// Platform describes the target that the config sets are resolved for.
+// Profile is the selected build profile (e.g. dev or prod), empty if none.
+type Platform struct {
+	Hypervisor string
+	Arch       string
+	Profile    string
+	// Targets of package.yaml whose paths are uploaded, e.g. gce or x86_64.
+	// When empty, the hypervisor and the architecture are the targets.
+	Targets []string
+}
+
+// SelectedTargets returns the targets of package.yaml whose paths are
+// uploaded, defaulting to the hypervisor and the architecture.
+func (p Platform) SelectedTargets() []string {
+	if len(p.Targets) > 0 {
+		return p.Targets
+	}
+	return []string{p.Hypervisor, p.Arch}
+}
+
+// DefaultPlatform returns the platform that composed images are built for,
+// i.e. qemu on the architecture of the host, without a profile.
+func DefaultPlatform() Platform {
+	arch := goruntime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "arm64":
+		arch = "aarch64"
+	}
+	return Platform{Hypervisor: "qemu", Arch: arch}
+}
+
+// PlatformFor returns the default platform with the given hypervisor, i.e. the
+// platform of images composed to run on that hypervisor.
+func PlatformFor(hypervisor string) Platform {
+	p := DefaultPlatform()
+	if hypervisor != "" {
+		p.Hypervisor = hypervisor
+	}
+	return p
+}
+
+// Matches tells whether the platform satisfies the condition of an overlay.
+// Condition is a comma separated list of key=value pairs that must all hold,
+// e.g. "hypervisor=qemu,arch=aarch64" or "profile=prod".
+func (p Platform) Matches(condition string) (bool, error) {
+	matches := true
+	for _, part := range strings.Split(condition, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return false, fmt.Errorf("invalid condition '%s', expected key=value", part)
+		}
+
+		var actual string
+		switch kv[0] {
+		case "hypervisor":
+			actual = p.Hypervisor
+		case "arch":
+			actual = p.Arch
+		case "profile":
+			actual = p.Profile
+		default:
+			return false, fmt.Errorf("unknown condition key '%s', use one of hypervisor|arch|profile", kv[0])
+		}
+		if actual != kv[1] {
+			matches = false
+		}
+	}
+	return matches, nil
+}
+
+// applyOverlays merges overlays of the config set that match the platform
+// into the config set. Overlays are listed under the 'overlays' key, each
+// being a map with a 'when' condition and the values to set. Maps (e.g. env)
+// are merged key by key, all other values are replaced. Values of the
+// selected profile, listed under the 'profiles' key by profile names, are
+// merged last.
+func applyOverlays(configSet map[string]interface{}, platform Platform) (map[string]interface{}, error) {
+	rawOverlays, hasOverlays := configSet["overlays"]
+	rawProfiles, hasProfiles := configSet["profiles"]
+	if !hasOverlays && !hasProfiles {
+		return configSet, nil
+	}
+
+	overlays, ok := rawOverlays.([]interface{})
+	if hasOverlays && !ok {
+		return nil, fmt.Errorf("'overlays' must be a list")
+	}
+	profiles, ok := rawProfiles.(map[interface{}]interface{})
+	if hasProfiles && !ok {
+		return nil, fmt.Errorf("'profiles' must be a map")
+	}
+
+	res := make(map[interface{}]interface{})
+	for k, v := range configSet {
+		if k != "overlays" && k != "profiles" {
+			res[k] = v
+		}
+	}
+
+	for i, o := range overlays {
+		overlay, ok := o.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("overlay #%d must be a map", i)
+		}
+
+		condition, ok := overlay["when"].(string)
+		if !ok || condition == "" {
+			return nil, fmt.Errorf("'when' must be provided for overlay #%d", i)
+		}
+		matches, err := platform.Matches(condition)
+		if err != nil {
+			return nil, fmt.Errorf("overlay #%d: %s", i, err)
+		}
+		if !matches {
+			continue
+		}
+
+		delete(overlay, "when")
+		res = mergeMaps(res, overlay)
+	}
+
+	if profile, ok := profiles[platform.Profile]; ok && profile != nil && platform.Profile != "" {
+		values, ok := profile.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("profile '%s' must be a map", platform.Profile)
+		}
+		res = mergeMaps(res, values)
+	}
+
+	merged := make(map[string]interface{})
+	for k, v := range res {
+		merged[fmt.Sprint(k)] = v
+	}
+	return merged, nil
+}
+
+// definedProfiles returns names of the profiles listed under the 'profiles'
+// key of the config set and those that its overlays are conditioned on.
+// Malformed entries are left to applyOverlays to report.
+func definedProfiles(configSet map[string]interface{}) []string {
+	var names []string
+	if profiles, ok := configSet["profiles"].(map[interface{}]interface{}); ok {
+		for name := range profiles {
+			names = append(names, fmt.Sprint(name))
+		}
+	}
+	overlays, _ := configSet["overlays"].([]interface{})
+	for _, o := range overlays {
+		overlay, _ := o.(map[interface{}]interface{})
+		condition, _ := overlay["when"].(string)
+		for _, part := range strings.Split(condition, ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) == 2 && kv[0] == "profile" {
+				names = append(names, kv[1])
+			}
+		}
+	}
+	return names
+}
+
+// mergeMaps returns base with values from overlay. Nested maps are merged
+// recursively, all other values are replaced.
+func mergeMaps(base, overlay map[interface{}]interface{}) map[interface{}]interface{} {
+	res := make(map[interface{}]interface{})
+	for k, v := range base {
+		res[k] = v
+	}
+
+	for k, v := range overlay {
+		baseMap, baseOk := res[k].(map[interface{}]interface{})
+		overlayMap, overlayOk := v.(map[interface{}]interface{})
+		if baseOk && overlayOk {
+			res[k] = mergeMaps(baseMap, overlayMap)
+		} else {
+			res[k] = v
+		}
+	}
+	return res
+}
@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -22,6 +23,7 @@ type cmdConfigInternal struct {
 	Runtime          RuntimeType                       `yaml:"runtime"`
 	ConfigSet        map[string]map[string]interface{} `yaml:"config_set"`
 	ConfigSetDefault string                            `yaml:"config_set_default"`
+	FormatVersion    string                            `yaml:"format_version,omitempty"`
 }
 
 // CmdConfig is a result that parsing meta/run.yaml yields.
@@ -32,19 +34,31 @@ type CmdConfig struct {
 	// ConfigSets is a map of available <config-name>:<runtime> pairs.
 	// The map is built based on meta/run.yaml.
 	ConfigSets map[string]Runtime
+
+	// profiles are names of build profiles that config sets define.
+	profiles map[string]bool
+}
+
+// DefinesProfile tells whether any of the config sets defines the build
+// profile, either under 'profiles' or as a condition of an overlay.
+func (r *CmdConfig) DefinesProfile(profile string) bool {
+	return r.profiles[profile]
 }
 
 // PackageRunManifestGeneral parses meta/run.yaml file into blank RunConfig.
 // By 'blank' we mean that the struct has no fields populated, but it is of
 // correct type i.e. appropriate implementation of Runtime interface.
 // NOTE: We must differentiate two things regarding Runtime interface implementation:
-//    a) what struct is it implemented with -> e.g. nodeJsRuntime
-//    b) what fields is struct populated with -> e.g. nodeJsRuntime.Main
 //
-//    For a given meta/run.yaml all config sets get the same (a), but are populated
-//    with different values for (b).
+//	a) what struct is it implemented with -> e.g. nodeJsRuntime
+//	b) what fields is struct populated with -> e.g. nodeJsRuntime.Main
+//
+//	For a given meta/run.yaml all config sets get the same (a), but are populated
+//	with different values for (b).
+//
 // NOTE: when Capstan needs to know what packages to require, it needs (a), but
-//    not (b). And this function returns exactly this, (a) without (b).
+//
+//	not (b). And this function returns exactly this, (a) without (b).
 func PackageRunManifestGeneral(cmdConfigFile string) (Runtime, error) {
 
 	// Take meta/run.yaml from the current directory if not provided.
@@ -78,8 +92,57 @@ func PackageRunManifestGeneral(cmdConfigFile string) (Runtime, error) {
 	return blankRuntime, err
 }
 
-// ParsePackageRunManifestData returns parsed manifest data.
+// ParsePackageRunManifestData returns parsed manifest data with overlays
+// resolved for the default platform and variables expanded from the host
+// environment.
 func ParsePackageRunManifestData(cmdConfigData []byte) (*CmdConfig, error) {
+	return ParsePackageRunManifestDataFor(cmdConfigData, DefaultPlatform(), Values{})
+}
+
+// ParsePackageRunManifest parses meta/run.yaml of the given package directory
+// with variables expanded from the host environment and package values. Env
+// files of the config sets are loaded and settings that runtimes read from
+// files of the package (e.g. package.json) are resolved as well. Overlays are
+// resolved for the default platform.
+func ParsePackageRunManifest(packageDir string) (*CmdConfig, error) {
+	return ParsePackageRunManifestFor(packageDir, DefaultPlatform())
+}
+
+// ParsePackageRunManifestFor parses meta/run.yaml of the given package
+// directory just like ParsePackageRunManifest, with overlays resolved for the
+// given platform.
+func ParsePackageRunManifestFor(packageDir string, platform Platform) (*CmdConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Join(packageDir, "meta", "run.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := LoadValues(packageDir)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdConfig, err := ParsePackageRunManifestDataFor(data, platform, values)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, conf := range cmdConfig.ConfigSets {
+		if err := conf.LoadEnvFiles(packageDir); err != nil {
+			return nil, fmt.Errorf("failed to load env_file for configset '%s': %s", k, err)
+		}
+		if resolvingRuntime, ok := conf.(ResolvingRuntime); ok {
+			if err := resolvingRuntime.ResolvePackage(packageDir); err != nil {
+				return nil, fmt.Errorf("failed to resolve configset '%s': %s", k, err)
+			}
+		}
+	}
+	return cmdConfig, nil
+}
+
+// ParsePackageRunManifestDataFor returns parsed manifest data with overlays
+// resolved for the given platform and ${VAR} references expanded with values.
+func ParsePackageRunManifestDataFor(cmdConfigData []byte, platform Platform, values Values) (*CmdConfig, error) {
 	res := CmdConfig{}
 
 	// Parse basic fields.
@@ -93,6 +156,7 @@ func ParsePackageRunManifestData(cmdConfigData []byte) (*CmdConfig, error) {
 	}
 
 	res.ConfigSets = make(map[string]Runtime)
+	res.profiles = make(map[string]bool)
 
 	// We are marshalling the `map[interface{}]interface{}` data here (containing single
 	// configuration set parameters) so that we will be able to unmarshal it in the next
@@ -114,8 +178,24 @@ func ParsePackageRunManifestData(cmdConfigData []byte) (*CmdConfig, error) {
 			return nil, err
 		}
 
+		for _, profile := range definedProfiles(internal.ConfigSet[k]) {
+			res.profiles[profile] = true
+		}
+
+		// Apply platform specific overlays.
+		configSet, err := applyOverlays(internal.ConfigSet[k], platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse data for configset '%s': %s", k, err)
+		}
+
+		// Expand variables.
+		expanded, err := values.expandValues(configSet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse data for configset '%s': %s", k, err)
+		}
+
 		// Use appropriate subsection of yaml only.
-		subdata, _ := yaml.Marshal(internal.ConfigSet[k])
+		subdata, _ := yaml.Marshal(expanded)
 
 		// Parse runtime-specific settings.
 		if err := yaml.Unmarshal(subdata, theRuntime); err != nil {
@@ -132,6 +212,25 @@ func ParsePackageRunManifestData(cmdConfigData []byte) (*CmdConfig, error) {
 	return &res, nil
 }
 
+// GetDependencies returns packages required by any of the config sets.
+func (r *CmdConfig) GetDependencies() []string {
+	names := keysOfMap(r.ConfigSets)
+	sort.Strings(names)
+
+	var deps []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		conf := r.ConfigSets[name]
+		for _, dep := range PinDependencies(conf.GetDependencies(), conf.GetDependencyVersions()) {
+			if !seen[dep] {
+				seen[dep] = true
+				deps = append(deps, dep)
+			}
+		}
+	}
+	return deps
+}
+
 // selectConfigSetByName selects appropriate config set and returns it.
 func (r *CmdConfig) selectConfigSetByName(name string) (Runtime, error) {
 	availableNames := fmt.Sprintf("['%s']", strings.Join(keysOfMap(r.ConfigSets), "', '"))
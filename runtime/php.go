@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const defaultPhpListen = "0.0.0.0:8000"
+
+type phpRuntime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Mode          string            `yaml:"mode"`
+	Main          string            `yaml:"main"`
+	DocRoot       string            `yaml:"docroot"`
+	Listen        string            `yaml:"listen"`
+	Ini           map[string]string `yaml:"ini"`
+	Args          []string          `yaml:"args"`
+}
+
+//
+// Interface implementation
+//
+
+func (conf phpRuntime) GetRuntimeName() string {
+	return string(PHP)
+}
+func (conf phpRuntime) GetRuntimeDescription() string {
+	return "Run PHP script or built-in web server"
+}
+func (conf phpRuntime) GetDependencies() []string {
+	return []string{"osv.php"}
+}
+func (conf phpRuntime) Validate() error {
+	switch conf.GetMode() {
+	case "script":
+		if conf.Main == "" {
+			return fmt.Errorf("'main' must be provided in script mode")
+		}
+		if conf.DocRoot != "" || conf.Listen != "" {
+			return fmt.Errorf("'docroot' and 'listen' are only supported in server mode")
+		}
+	case "server":
+		if conf.DocRoot == "" {
+			return fmt.Errorf("'docroot' must be provided in server mode")
+		}
+		if len(conf.Args) > 0 {
+			return fmt.Errorf("'args' are only supported in script mode")
+		}
+	default:
+		return fmt.Errorf("unknown mode '%s', use one of script|server", conf.Mode)
+	}
+
+	for k, v := range conf.Ini {
+		if strings.ContainsAny(k, " =") || strings.Contains(v, " ") {
+			return fmt.Errorf("spaces not allowed in ini key/value: '%s':'%s'", k, v)
+		}
+	}
+
+	return conf.CommonRuntime.Validate()
+}
+func (conf phpRuntime) GetBootCmd() (string, error) {
+	cmd := "/php.so"
+
+	// Sort ini overrides to get deterministic boot command.
+	keys := make([]string, 0, len(conf.Ini))
+	for k := range conf.Ini {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd += fmt.Sprintf(" -d %s=%s", k, conf.Ini[k])
+	}
+
+	if conf.GetMode() == "server" {
+		cmd += fmt.Sprintf(" -S %s -t %s", conf.GetListen(), conf.DocRoot)
+		// Optional router script.
+		if conf.Main != "" {
+			cmd += " " + conf.Main
+		}
+	} else {
+		cmd += " " + conf.Main
+		if len(conf.Args) > 0 {
+			cmd += " " + strings.Join(conf.Args, " ")
+		}
+	}
+
+	return conf.CommonRuntime.BuildBootCmd(cmd)
+}
+func (conf phpRuntime) OnCollect(targetPath string) error {
+	return nil
+}
+func (conf phpRuntime) GetYamlTemplate() string {
+	return `
+# OPTIONAL
+# Either run a single script (script) or PHP built-in web server (server).
+# Example value: server
+mode: script
+
+# REQUIRED in script mode, OPTIONAL in server mode
+# Filepath of the PHP script to run. In server mode this is the router script.
+# Note that package root will correspond to filesystem root (/) in OSv image.
+# Example value: /app/index.php
+main: <filepath>
+
+# REQUIRED in server mode
+# Directory served by the built-in web server.
+# Example value: /app/public
+docroot: <directory>
+
+# OPTIONAL
+# Address the built-in web server listens on (server mode only).
+# Example value: 0.0.0.0:80
+listen: ` + defaultPhpListen + `
+
+# OPTIONAL
+# A map of php.ini overrides (passed with -d).
+# Example value: ini:
+#                   memory_limit: 256M
+#                   display_errors: 0
+ini:
+   <map>
+
+# OPTIONAL
+# A list of command line args used by the script (script mode only).
+# Example value: args:
+#                   - --verbose
+args:
+   <list>
+` + conf.CommonRuntime.GetYamlTemplate()
+}
+
+//
+// Utility
+//
+
+func (conf phpRuntime) GetMode() string {
+	if conf.Mode == "" {
+		return "script"
+	}
+	return conf.Mode
+}
+func (conf phpRuntime) GetListen() string {
+	if conf.Listen == "" {
+		return defaultPhpListen
+	}
+	return conf.Listen
+}
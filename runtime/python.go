@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultRequirementsTarget is the directory in the image that requirements
+// are installed into when requirements_target is not set.
+const DefaultRequirementsTarget = "/site-packages"
+
+// pythonInterpreters maps supported interpreter names to their executables
+// inside the OSv image.
+var pythonInterpreters = map[string]string{
+	"python2": "/python",
+	"python3": "/python3",
+}
+
+// pythonPackages maps supported interpreter names to the packages that provide
+// them.
+var pythonPackages = map[string]string{
+	"python2": "python-2.7",
+	"python3": "python-3",
+}
+
+// pipCommands maps supported interpreter names to pip executables on the host.
+var pipCommands = map[string]string{
+	"python2": "pip",
+	"python3": "pip3",
+}
+
+type pythonRuntime struct {
+	CommonRuntime      `yaml:"-,inline"`
+	Interpreter        string   `yaml:"interpreter"`
+	Main               string   `yaml:"main"`
+	Module             string   `yaml:"module"`
+	Args               []string `yaml:"args"`
+	PythonPath         []string `yaml:"pythonpath"`
+	Requirements       string   `yaml:"requirements"`
+	RequirementsTarget string   `yaml:"requirements_target"`
+}
+
+//
+// Interface implementation
+//
+
+func (conf pythonRuntime) GetRuntimeName() string {
+	return string(Python)
+}
+func (conf pythonRuntime) GetRuntimeDescription() string {
+	return "Run Python 2.7 (or Python 3) application"
+}
+func (conf pythonRuntime) GetDependencies() []string {
+	if pkg, ok := pythonPackages[conf.GetInterpreter()]; ok {
+		return []string{pkg}
+	}
+	return nil
+}
+func (conf pythonRuntime) Validate() error {
+	if _, ok := pythonInterpreters[conf.GetInterpreter()]; !ok {
+		return fmt.Errorf("unknown interpreter '%s', use one of python2|python3", conf.Interpreter)
+	}
+
+	if (conf.Main == "") == (conf.Module == "") {
+		return fmt.Errorf("exactly one of 'main' or 'module' must be provided")
+	}
+
+	for _, path := range conf.PythonPath {
+		if strings.ContainsAny(path, " :") {
+			return fmt.Errorf("spaces and colons not allowed in pythonpath: '%s'", path)
+		}
+	}
+
+	if conf.RequirementsTarget != "" {
+		if conf.Requirements == "" {
+			return fmt.Errorf("'requirements' must be provided when 'requirements_target' is used")
+		}
+		if strings.ContainsAny(conf.RequirementsTarget, " :") {
+			return fmt.Errorf("spaces and colons not allowed in requirements_target: '%s'", conf.RequirementsTarget)
+		}
+	}
+
+	return conf.CommonRuntime.Validate()
+}
+func (conf pythonRuntime) GetBootCmd() (string, error) {
+	cmd := pythonInterpreters[conf.GetInterpreter()]
+	if conf.Module != "" {
+		cmd += " -m " + conf.Module
+	} else {
+		cmd += " " + conf.Main
+	}
+	if len(conf.Args) > 0 {
+		cmd += " " + strings.Join(conf.Args, " ")
+	}
+
+	// PYTHONPATH is set together with other environment variables.
+	common := conf.CommonRuntime
+	common.Env = conf.GetEnv()
+	return common.BuildBootCmd(cmd)
+}
+func (conf pythonRuntime) OnCollect(targetPath string) error {
+	return nil
+}
+func (conf pythonRuntime) OnCollectPackage(packageDir, targetPath string) error {
+	if conf.Requirements == "" {
+		return nil
+	}
+
+	requirements := filepath.Join(packageDir, conf.Requirements)
+	target := filepath.Join(targetPath, conf.GetRequirementsTarget())
+
+	pip := pipCommands[conf.GetInterpreter()]
+	args := []string{"install", "--requirement", requirements, "--target", target}
+	fmt.Printf("Installing requirements with '%s %s'\n", pip, strings.Join(args, " "))
+	cmd := exec.Command(pip, args...)
+	cmd.Dir = packageDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to install requirements: %s", err)
+	}
+	return nil
+}
+func (conf pythonRuntime) GetYamlTemplate() string {
+	return `
+# OPTIONAL
+# Python interpreter to run the application with: python2 (default, provided
+# by python-2.7 package) or python3 (provided by python-3 package).
+# Example value: python3
+interpreter: python2
+
+# REQUIRED (either main or module)
+# Filepath of the Python script to run.
+# Note that package root will correspond to filesystem root (/) in OSv image.
+# Example value: /app/main.py
+main: <filepath>
+
+# REQUIRED (either main or module)
+# Name of the Python module to run as a script (like python -m).
+# Example value: http.server
+module: <name>
+
+# OPTIONAL
+# A list of command line args used by the application.
+# Example value: args:
+#                   - --port=8000
+args:
+   <list>
+
+# OPTIONAL
+# A list of directories that are added to the PYTHONPATH.
+# Example value: pythonpath:
+#                   - /app
+#                   - /app/lib
+pythonpath:
+   <list>
+
+# OPTIONAL
+# Path to the requirements file (relative to the package root). Requirements
+# are installed with pip of the host when the package is collected and the
+# directory they are installed into is added to the PYTHONPATH.
+# Example value: /requirements.txt
+requirements: <filepath>
+
+# OPTIONAL
+# Directory in the image that requirements are installed into.
+# Example value: /app/vendor
+requirements_target: ` + DefaultRequirementsTarget + `
+` + conf.CommonRuntime.GetYamlTemplate()
+}
+
+// GetEnv returns environment variables including PYTHONPATH. Explicitly
+// provided PYTHONPATH variable takes precedence over the pythonpath list and
+// the directory of installed requirements.
+func (conf pythonRuntime) GetEnv() map[string]string {
+	env := map[string]string{}
+	pythonPath := conf.PythonPath
+	if conf.Requirements != "" {
+		pythonPath = append(append([]string{}, pythonPath...), conf.GetRequirementsTarget())
+	}
+	if len(pythonPath) > 0 {
+		env["PYTHONPATH"] = strings.Join(pythonPath, ":")
+	}
+	for k, v := range conf.Env {
+		env[k] = v
+	}
+	return env
+}
+
+//
+// Utility
+//
+
+func (conf pythonRuntime) GetWrittenPaths() map[string]string {
+	if conf.Requirements == "" {
+		return nil
+	}
+	// Requirements are byte-compiled by pip of the host, which may differ
+	// from the interpreter in the image.
+	return map[string]string{conf.GetRequirementsTarget(): "bytecode of requirements"}
+}
+func (conf pythonRuntime) GetRequirementsTarget() string {
+	if conf.RequirementsTarget == "" {
+		return DefaultRequirementsTarget
+	}
+	return conf.RequirementsTarget
+}
+func (conf pythonRuntime) GetInterpreter() string {
+	if conf.Interpreter == "" {
+		return "python2"
+	}
+	return conf.Interpreter
+}
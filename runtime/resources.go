@@ -0,0 +1,270 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// Resources used by 'capstan run' when they are not given on command line.
+const (
+	DefaultMemory = "1G"
+	DefaultCpus   = 2
+)
+
+// Resources hold resources that the application needs. Memory and cpus are
+// used when they are not given to 'capstan run' and are also treated as the
+// minimums. Ports are the guest ports that the application listens on.
+// Publish holds port forwarding rules used when none are given on command line.
+// Network is the static network of the guest used with bridge, tap and
+// private networking unless one is given on command line. Volumes are
+// mounted into qemu instances.
+type Resources struct {
+	Memory  string             `yaml:"memory,omitempty"`
+	Cpus    int                `yaml:"cpus,omitempty"`
+	Ports   []int              `yaml:"ports,omitempty"`
+	Publish []string           `yaml:"publish,omitempty"`
+	Network *util.GuestNetwork `yaml:"network,omitempty"`
+	Volumes []util.Volume      `yaml:"volumes,omitempty"`
+}
+
+func (r Resources) GetResources() Resources {
+	return r
+}
+
+// IsEmpty tells whether any resources are declared at all.
+func (r Resources) IsEmpty() bool {
+	return r.Memory == "" && r.Cpus == 0 && len(r.Ports) == 0 && len(r.Publish) == 0 && r.Network == nil &&
+		len(r.Volumes) == 0
+}
+
+func (r Resources) GetYamlTemplate() string {
+	return `
+# OPTIONAL
+# Memory, number of CPUs and guest ports that the application needs.
+# Memory and cpus are used by 'capstan run' unless overridden on command
+# line, and a warning is printed when less is given. A warning is also
+# printed for ports that are not forwarded when NAT networking is used.
+# Example value:  memory: 512M
+#                 cpus: 2
+#                 ports:
+#                    - 8000
+memory: <size>
+cpus: <number>
+ports:
+   <list>
+
+# OPTIONAL
+# Port forwarding rules used by 'capstan run' with NAT networking unless
+# ports are published on command line with --publish. Rules are in form of
+# [<host ip>:]<host port>:<guest port>[/udp], host port may be omitted to
+# forward a free one.
+# Example value:  publish:
+#                    - 8000:8000
+#                    - 127.0.0.1:5353:53/udp
+publish:
+   <list>
+
+# OPTIONAL
+# Static network of the guest used by 'capstan run' with bridge, tap and
+# private networking instead of DHCP, unless given on command line with --ip. IP may
+# be given in CIDR notation instead of giving the netmask.
+# Example value:  network:
+#                    ip: 192.168.122.10/24
+#                    gateway: 192.168.122.1
+#                    dns: 192.168.122.1
+network:
+   <map>
+
+# OPTIONAL
+# Volumes mounted into the guest by 'capstan run' with qemu, so that data is
+# kept outside of the image. Type nfs mounts the NFS export given as source,
+# which needs the NFS module of OSv in the image. Type disk attaches the disk
+# image given as source (relative to the directory 'capstan run' is invoked
+# in), which must hold a filesystem given as fs: zfs (default), rofs or ext.
+# A disk with fs: ext and size (e.g. 1G) is created when it does not exist.
+# Type tmpfs keeps files at path in memory of the guest.
+# Example value:  volumes:
+#                    - type: nfs
+#                      source: nfs://192.168.122.1/export/data
+#                      path: /data
+#                    - type: disk
+#                      source: db.qcow2
+#                      path: /var/lib/db
+#                      readonly: false
+#                    - type: tmpfs
+#                      path: /tmp
+volumes:
+   <list>
+`
+}
+
+func (r Resources) Validate() error {
+	if r.Memory != "" {
+		if _, err := util.ParseMemSize(r.Memory); err != nil {
+			return fmt.Errorf("invalid memory '%s': %s", r.Memory, err)
+		}
+	}
+
+	if r.Cpus < 0 {
+		return fmt.Errorf("'cpus' must not be negative")
+	}
+
+	for _, port := range r.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+
+	if _, err := nat.Parse(r.Publish); err != nil {
+		return fmt.Errorf("'publish': %s", err)
+	}
+
+	if r.Network != nil {
+		if r.Network.IP == "" {
+			return fmt.Errorf("'network': ip is missing")
+		}
+		if err := r.Network.Validate(); err != nil {
+			return fmt.Errorf("'network': %s", err)
+		}
+	}
+
+	paths := make(map[string]bool)
+	for _, volume := range r.Volumes {
+		if err := volume.Validate(); err != nil {
+			return fmt.Errorf("'volumes': %s", err)
+		}
+		if paths[volume.Path] {
+			return fmt.Errorf("'volumes': more than one volume is mounted at %s", volume.Path)
+		}
+		paths[volume.Path] = true
+	}
+	return nil
+}
+
+// Apply fills memory, cpus, published ports, the guest network and volumes
+// of the run config that were not given on command line and returns warnings
+// about resources below declared minimums.
+func (r Resources) Apply(config *RunConfig) []string {
+	var warnings []string
+
+	if config.Memory == "" {
+		config.Memory = r.Memory
+	} else if r.Memory != "" {
+		given, err1 := util.ParseMemSize(config.Memory)
+		needed, err2 := util.ParseMemSize(r.Memory)
+		if err1 == nil && err2 == nil && given < needed {
+			warnings = append(warnings, fmt.Sprintf("memory %s is less than %s required by the application", config.Memory, r.Memory))
+		}
+	}
+
+	if config.Cpus == 0 {
+		config.Cpus = r.Cpus
+	} else if config.Cpus < r.Cpus {
+		warnings = append(warnings, fmt.Sprintf("%d CPUs is less than %d required by the application", config.Cpus, r.Cpus))
+	}
+
+	if util.StaticNetworking(config.Networking) && config.GuestNetwork.IsEmpty() && r.Network != nil {
+		config.GuestNetwork = *r.Network
+	}
+
+	if len(r.Volumes) > 0 {
+		if config.Hypervisor != "qemu" {
+			warnings = append(warnings, fmt.Sprintf("volumes are only mounted into qemu instances, not %s", config.Hypervisor))
+		} else if len(config.Volumes) == 0 {
+			config.Volumes = util.ResolveVolumes(r.Volumes)
+		}
+	}
+
+	if config.Networking == "nat" {
+		if len(config.NatRules) == 0 && len(r.Publish) > 0 {
+			// Rules were validated when the package was composed.
+			config.NatRules, _ = nat.Parse(r.Publish)
+		}
+		for _, port := range r.Ports {
+			forwarded := false
+			for _, rule := range config.NatRules {
+				if rule.GuestPort == strconv.Itoa(port) {
+					forwarded = true
+				}
+			}
+			if !forwarded {
+				warnings = append(warnings, fmt.Sprintf("port %d of the application is not forwarded, use --publish <host-port>:%d", port, port))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// ReadOnlyRootProblems returns why the config set may fail to run from a
+// read-only root filesystem: hooks, which usually write files, and directories
+// that the runtime writes to without a writable volume mounted on them.
+func ReadOnlyRootProblems(conf Runtime) []string {
+	var problems []string
+	if !conf.GetHooks().IsEmpty() {
+		problems = append(problems, "runs hooks, which can only write files to volumes")
+	}
+
+	writing, ok := conf.(WritingRuntime)
+	if !ok {
+		return problems
+	}
+	written := writing.GetWrittenPaths()
+	var paths []string
+	for path := range written {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !conf.GetResources().isWritable(path) {
+			problems = append(problems, fmt.Sprintf("writes %s to %s, which needs a writable volume (e.g. of type tmpfs)", written[path], path))
+		}
+	}
+	return problems
+}
+
+// isWritable tells whether a writable volume is mounted on the path or on
+// one of its parents.
+func (r Resources) isWritable(path string) bool {
+	for _, v := range r.Volumes {
+		if !v.ReadOnly && (path == v.Path || strings.HasPrefix(path, strings.TrimSuffix(v.Path, "/")+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseResources reads resources from the given file.
+func ParseResources(path string) (Resources, error) {
+	r := Resources{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return r, err
+	}
+
+	err = yaml.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r Resources) WriteToFile(path string) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"strings"
+)
+
+type rubyRuntime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Main          string   `yaml:"main"`
+	Args          []string `yaml:"args"`
+	GemPath       []string `yaml:"gempath"`
+	RubyOpt       string   `yaml:"rubyopt"`
+}
+
+//
+// Interface implementation
+//
+
+func (conf rubyRuntime) GetRuntimeName() string {
+	return string(Ruby)
+}
+func (conf rubyRuntime) GetRuntimeDescription() string {
+	return "Run Ruby application"
+}
+func (conf rubyRuntime) GetDependencies() []string {
+	return []string{"osv.ruby"}
+}
+func (conf rubyRuntime) Validate() error {
+	if conf.Main == "" {
+		return fmt.Errorf("'main' must be provided")
+	}
+
+	for _, path := range conf.GemPath {
+		if strings.ContainsAny(path, " :") {
+			return fmt.Errorf("spaces and colons not allowed in gempath: '%s'", path)
+		}
+	}
+
+	return conf.CommonRuntime.Validate()
+}
+func (conf rubyRuntime) GetBootCmd() (string, error) {
+	cmd := fmt.Sprintf("/ruby.so %s", conf.Main)
+	if len(conf.Args) > 0 {
+		cmd += " " + strings.Join(conf.Args, " ")
+	}
+
+	// GEM_PATH and RUBYOPT are set together with other environment variables.
+	common := conf.CommonRuntime
+	common.Env = conf.GetEnv()
+	return common.BuildBootCmd(cmd)
+}
+func (conf rubyRuntime) OnCollect(targetPath string) error {
+	return nil
+}
+func (conf rubyRuntime) GetYamlTemplate() string {
+	return `
+# REQUIRED
+# Filepath of the Ruby script to run.
+# Note that package root will correspond to filesystem root (/) in OSv image.
+# Example value: /app/server.rb
+main: <filepath>
+
+# OPTIONAL
+# A list of command line args used by the application.
+# Example value: args:
+#                   - --port=8000
+args:
+   <list>
+
+# OPTIONAL
+# A list of directories where gems are looked up (GEM_PATH).
+# Example value: gempath:
+#                   - /app/vendor/bundle
+gempath:
+   <list>
+
+# OPTIONAL
+# Options passed to the interpreter via RUBYOPT.
+# Example value: -W0 -rbundler/setup
+rubyopt: <option>
+` + conf.CommonRuntime.GetYamlTemplate()
+}
+
+// GetEnv returns environment variables including GEM_PATH and RUBYOPT.
+// Explicitly provided variables take precedence over gempath and rubyopt.
+func (conf rubyRuntime) GetEnv() map[string]string {
+	env := map[string]string{}
+	if len(conf.GemPath) > 0 {
+		env["GEM_PATH"] = strings.Join(conf.GemPath, ":")
+	}
+	if conf.RubyOpt != "" {
+		env["RUBYOPT"] = conf.RubyOpt
+	}
+	for k, v := range conf.Env {
+		env[k] = v
+	}
+	return env
+}
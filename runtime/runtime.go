@@ -9,9 +9,14 @@ package runtime
 
 import (
 	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/mikelangelo-project/capstan/core"
 	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/util"
 )
 
 type RuntimeType string
@@ -20,12 +25,24 @@ const (
 	Native RuntimeType = "native"
 	NodeJS RuntimeType = "node"
 	Java   RuntimeType = "java"
+	Python RuntimeType = "python"
+	Golang RuntimeType = "golang"
+	Ruby   RuntimeType = "ruby"
+	Dotnet RuntimeType = "dotnet"
+	PHP    RuntimeType = "php"
+	Erlang RuntimeType = "erlang"
 )
 
 var SupportedRuntimes []RuntimeType = []RuntimeType{
 	Native,
 	NodeJS,
 	Java,
+	Python,
+	Golang,
+	Ruby,
+	Dotnet,
+	PHP,
+	Erlang,
 }
 
 type RunConfig struct {
@@ -42,6 +59,58 @@ type RunConfig struct {
 	MAC          string
 	Cmd          string
 	Persist      bool
+	DiskSize     int64
+	KeyFile      string
+	// Env overrides environment variables of the config set the image boots.
+	Env map[string]string
+	// Args are appended to the arguments of the application.
+	Args []string
+	// Labels are stored with the instance to select it later on.
+	Labels map[string]string
+	// Console receives output of a qemu instance instead of the terminal.
+	Console io.Writer
+	// Autostart marks a new qemu instance to be launched at host boot.
+	Autostart bool
+	// AutoPorts forwards free host ports instead of those that are in use.
+	AutoPorts bool
+	// Profile is the build profile applied when the package is composed.
+	Profile string
+	// IPv6Net and IPv6Host enable IPv6 in NAT networking of qemu instances,
+	// see qemu.VMConfig.
+	IPv6Net  string
+	IPv6Host string
+	// NatOptions configure the user-mode network of qemu instances using
+	// NAT networking, e.g. the hostname of the guest.
+	NatOptions nat.Options
+	// CreateTap creates the tap device of a qemu instance using tap
+	// networking, attached to TapBridge, see qemu.VMConfig.
+	CreateTap bool
+	TapBridge string
+	// IngressRate and EgressRate limit the rate of traffic towards and from
+	// a qemu instance using tap networking, see qemu.VMConfig.
+	IngressRate string
+	EgressRate  string
+	// GuestNetwork configures a qemu instance statically instead of DHCP
+	// with bridge, tap and private networking.
+	GuestNetwork util.GuestNetwork
+	// Volumes are mounted into a qemu instance, see util.Volume.
+	Volumes []util.Volume
+	// DataDisk is the size of the writable disk of a qemu instance mounted
+	// at DataPath, which is kept until the instance is deleted. Tmpfs are
+	// paths that the instance keeps in memory. Both give instances with
+	// read-only root filesystem a place for their data.
+	DataDisk string
+	DataPath string
+	Tmpfs    []string
+	// CloudInit is given to a qemu instance on a seed ISO. Instance ID and
+	// hostname default to those of the instance.
+	CloudInit *util.CloudInit
+	// CPUModel is the CPU model of a qemu instance, e.g. Haswell, the host
+	// CPU with KVM unless given.
+	CPUModel string
+	// BootOpts are presets of OSv kernel options applied to the command line
+	// of a qemu instance.
+	BootOpts BootOpts
 }
 
 // Runtime interface must be extended for every new runtime.
@@ -77,49 +146,365 @@ type Runtime interface {
 
 	// GetEnv returns map of environment variables read from run.yaml.
 	GetEnv() map[string]string
+
+	// GetSupervision returns health check and restart policy read from run.yaml.
+	GetSupervision() Supervision
+
+	// GetResources returns memory, cpus and ports read from run.yaml.
+	GetResources() Resources
+
+	// LoadEnvFiles merges variables from env_file files (relative to the given
+	// package directory) under the environment variables read from run.yaml.
+	LoadEnvFiles(string) error
+
+	// GetSecrets returns secret environment variables read from run.yaml.
+	GetSecrets() Secrets
+
+	// GetBase returns config sets of required packages that this config set
+	// is based on, in form of <package>:<config_set>.
+	GetBase() []string
+
+	// InheritEnv merges environment variables of a base under the
+	// environment variables of the config set.
+	InheritEnv(map[string]string)
+
+	// GetDependencyVersions returns version constraints of dependencies
+	// read from run.yaml.
+	GetDependencyVersions() map[string]string
+
+	// GetHooks returns commands run before and after the main command.
+	GetHooks() Hooks
+
+	// GetBootOpts returns presets of OSv kernel options read from run.yaml.
+	GetBootOpts() BootOpts
+}
+
+// ResolvingRuntime is implemented by runtimes that fill settings which are
+// not given in meta/run.yaml from files of the package, e.g. package.json.
+type ResolvingRuntime interface {
+	ResolvePackage(packageDir string) error
+}
+
+// CollectRuntime is implemented by runtimes that need to prepare content of
+// the package when it is collected, e.g. build the application.
+type CollectRuntime interface {
+	// OnCollectPackage is called for each config set of the package after the
+	// package content has been copied into targetPath.
+	OnCollectPackage(packageDir, targetPath string) error
+}
+
+// ArgsRuntime is implemented by runtimes whose boot command accepts additional
+// arguments of the application, e.g. those given to 'capstan run' after '--'.
+type ArgsRuntime interface {
+	// GetBootCmdWithArgs produces bootcmd with arguments appended to the
+	// arguments read from meta/run.yaml. Unlike GetBootCmd, arguments must
+	// come last so that more can be appended to the result.
+	GetBootCmdWithArgs(args []string) (string, error)
+}
+
+// WritingRuntime is implemented by runtimes whose applications write into
+// directories of the root filesystem, which is read-only on ROFS images.
+type WritingRuntime interface {
+	// GetWrittenPaths returns directories that are written to, each with
+	// what is written there.
+	GetWrittenPaths() map[string]string
 }
 
 // CommonRuntime fields are those common to all runtimes.
 // This fields are set for each named-configuration separately, nothing
 // is shared.
 type CommonRuntime struct {
+	Base               StringList        `yaml:"base"`
+	DependencyVersions map[string]string `yaml:"dependency_versions"`
+	Env                map[string]string `yaml:"env"`
+	EnvFile            StringList        `yaml:"env_file"`
+	Secrets            Secrets           `yaml:"secrets"`
+	Commands           []Command         `yaml:"commands"`
+	Hooks              Hooks             `yaml:"hooks"`
+	BootOpts           BootOpts          `yaml:"boot_opts"`
+	Supervision        `yaml:",inline"`
+	Resources          `yaml:",inline"`
+}
+
+// Command is an additional process that OSv runs alongside the main command
+// of the config set, e.g. a metrics agent next to the application.
+type Command struct {
+	Cmd string            `yaml:"cmd"`
 	Env map[string]string `yaml:"env"`
+	// Mode defines how the command is run with respect to the commands that
+	// follow it: sequential (wait for it to finish), parallel (run in
+	// background, wait for it on exit) or detached (run in background, do
+	// not wait for it).
+	Mode string `yaml:"mode"`
+}
+
+// commandSeparators maps command modes to OSv command line separators.
+var commandSeparators = map[string]string{
+	"sequential": ";",
+	"parallel":   "&",
+	"detached":   "&!",
+}
+
+// GetMode returns mode of the command, parallel if not specified.
+func (c Command) GetMode() string {
+	if c.Mode == "" {
+		return "parallel"
+	}
+	return c.Mode
 }
 
 func (r CommonRuntime) GetEnv() map[string]string {
 	return r.Env
 }
 
+func (r CommonRuntime) GetSecrets() Secrets {
+	return r.Secrets
+}
+
+func (r CommonRuntime) GetBase() []string {
+	return r.Base
+}
+
+func (r CommonRuntime) GetHooks() Hooks {
+	return r.Hooks
+}
+
+func (r CommonRuntime) GetBootOpts() BootOpts {
+	return r.BootOpts
+}
+
+func (r CommonRuntime) GetDependencyVersions() map[string]string {
+	return r.DependencyVersions
+}
+
+// PinDependencies applies version constraints to the dependencies. Constraints
+// replace those that the runtime itself sets for the same package.
+func PinDependencies(deps []string, versions map[string]string) []string {
+	if len(versions) == 0 {
+		return deps
+	}
+
+	var pinned []string
+	for _, dep := range deps {
+		req, err := core.ParseRequirement(dep)
+		if constraint, ok := versions[req.Name]; ok && err == nil {
+			dep = req.Name + " " + strings.TrimSpace(constraint)
+		}
+		pinned = append(pinned, dep)
+	}
+	return pinned
+}
+
+// BaseConfigSet returns name of the runscript of the config set that the
+// base refers to.
+func BaseConfigSet(base string) string {
+	i := strings.Index(base, ":")
+	return PackageConfigSet(base[:i], base[i+1:])
+}
+
+// PackageConfigSet returns name of the runscript of the config set of the
+// given required package. Unlike config set names, which are shared by all
+// packages, it is unique among packages.
+func PackageConfigSet(pkg, configSet string) string {
+	return strings.Replace(pkg, "/", "-", -1) + "-" + configSet
+}
+
+// LoadEnvFiles merges variables from env_file files into Env. Variables in env
+// take precedence over env files and later env files take precedence over
+// earlier ones.
+func (r *CommonRuntime) LoadEnvFiles(packageDir string) error {
+	if len(r.EnvFile) == 0 {
+		return nil
+	}
+
+	env := make(map[string]string)
+	for _, envFile := range r.EnvFile {
+		if !filepath.IsAbs(envFile) {
+			envFile = filepath.Join(packageDir, envFile)
+		}
+		fileEnv, err := util.ParseEnvFile(envFile)
+		if err != nil {
+			return err
+		}
+		for k, v := range fileEnv {
+			env[k] = v
+		}
+	}
+	for k, v := range r.Env {
+		env[k] = v
+	}
+
+	r.Env = env
+	r.EnvFile = nil
+	return nil
+}
+
+func (r *CommonRuntime) InheritEnv(env map[string]string) {
+	if len(env) == 0 {
+		return
+	}
+	if r.Env == nil {
+		r.Env = make(map[string]string)
+	}
+	for k, v := range env {
+		if _, ok := r.Env[k]; !ok {
+			r.Env[k] = v
+		}
+	}
+}
+
+// StringList is a list of strings that can also be given as a single string in yaml.
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = StringList(list)
+	return nil
+}
+
 func (r CommonRuntime) GetYamlTemplate() string {
 	return `
 # OPTIONAL
+# Config sets of required packages that this config set is based on, in form
+# of <package>:<config_set>. Bases are run in the given order in background,
+# before the command of this config set. Environment variables of this config
+# set take precedence over those of the bases.
+# Example value:  base:
+#                    - openjdk8-zulu-compact1:default
+#                    - app.monitoring-agent:default
+base:
+   <list>
+
+# OPTIONAL
+# Version constraints of packages that the runtime depends on, in form of
+# <op><version> with op one of >= <= > < = !=. Packages in the local repository
+# must satisfy them, otherwise they are pulled (with --pull-missing) or
+# composing fails.
+# Example value:  dependency_versions:
+#                    openjdk8-zulu-compact1: ">=1.2"
+dependency_versions:
+   <package>: <constraint>
+
+# OPTIONAL
 # Environment variables.
 # A map of environment variables to be set when unikernel is run.
+# Values may contain spaces, they are quoted in the boot command.
 # Example value:  env:
 #                    PORT: 8000
 #                    HOSTNAME: www.myserver.org
+#                    JVM_ARGS: -Xmx1g -Xms512m
 env:
    <key>: <value>
-`
+
+# OPTIONAL
+# Dotenv files with KEY=VALUE pairs, relative to the package directory.
+# Variables given in env take precedence over those from env files, and later
+# env files take precedence over earlier ones.
+# Example value:  env_file:
+#                    - config/common.env
+#                    - config/production.env
+env_file:
+   <list>
+
+# OPTIONAL
+# Additional commands to be run before the main command of this config set.
+# Each command may have its own environment variables and mode: parallel
+# (default, run in background), detached (run in background and do not wait
+# for it on exit) or sequential (wait for it to finish).
+# Example value:  commands:
+#                    - cmd: /agent/metrics.so --port=9100
+#                      env:
+#                         INTERVAL: 10
+#                    - cmd: /tools/migrate.so
+#                      mode: sequential
+commands:
+   <list>
+` + r.Hooks.GetYamlTemplate() + r.BootOpts.GetYamlTemplate() + r.Secrets.GetYamlTemplate() + r.Supervision.GetYamlTemplate() + r.Resources.GetYamlTemplate()
 }
 
 func (r CommonRuntime) Validate() error {
-	for k, v := range r.Env {
-		if strings.Contains(k, " ") || strings.Contains(v, " ") {
-			return fmt.Errorf("spaces not allowed in env key/value: '%s':'%s'", k, v)
+	for _, base := range r.Base {
+		if parts := strings.Split(base, ":"); len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(base, " ") {
+			return fmt.Errorf("invalid base '%s', expected <package>:<config_set>", base)
 		}
 	}
-	return nil
+	for name, constraint := range r.DependencyVersions {
+		if _, err := core.ParseRequirement(name + " " + strings.TrimSpace(constraint)); err != nil {
+			return fmt.Errorf("invalid 'dependency_versions': %s", err)
+		}
+	}
+	if err := validateEnv(r.Env); err != nil {
+		return err
+	}
+	for i, c := range r.Commands {
+		if strings.TrimSpace(c.Cmd) == "" {
+			return fmt.Errorf("'cmd' must be provided for command #%d", i)
+		}
+		if _, ok := commandSeparators[c.GetMode()]; !ok {
+			return fmt.Errorf("unknown mode '%s' of command #%d, use one of sequential|parallel|detached", c.Mode, i)
+		}
+		if err := validateEnv(c.Env); err != nil {
+			return fmt.Errorf("%s of command #%d", err, i)
+		}
+	}
+	if err := r.Hooks.Validate(); err != nil {
+		return err
+	}
+	if err := r.BootOpts.Validate(); err != nil {
+		return err
+	}
+	if err := r.Secrets.Validate(); err != nil {
+		return err
+	}
+	if err := r.Supervision.Validate(); err != nil {
+		return err
+	}
+	return r.Resources.Validate()
 }
 
 // BuildBootCmd equips runtime-specific bootcmd with common parts.
 func (r CommonRuntime) BuildBootCmd(bootCmd string) (string, error) {
+	// Bases are run before the command. When there is no command, the last
+	// base is the main command.
+	if len(r.Base) > 0 {
+		var bases []string
+		for _, base := range r.Base {
+			bases = append(bases, BootCmdForScript(BaseConfigSet(base)))
+		}
+		if bootCmd != "" {
+			bases = append(bases, bootCmd)
+		}
+		bootCmd = strings.Join(bases, " & ")
+	}
+
 	// Prepend environment variables
 	newBootCmd, err := PrependEnvsPrefix(bootCmd, r.GetEnv(), true)
 	if err != nil {
 		return "", err
 	}
 
+	// Prepend additional commands, each with its own environment variables.
+	if len(r.Commands) > 0 {
+		cmds := ""
+		for _, c := range r.Commands {
+			cmd, err := PrependEnvsPrefix(strings.TrimSpace(c.Cmd), c.Env, false)
+			if err != nil {
+				return "", err
+			}
+			cmds += fmt.Sprintf("%s %s ", cmd, commandSeparators[c.GetMode()])
+		}
+		newBootCmd = strings.TrimSpace(cmds + newBootCmd)
+	}
+
 	return newBootCmd, nil
 }
 
@@ -132,14 +517,48 @@ func PickRuntime(runtimeName RuntimeType) (Runtime, error) {
 		return &nodeJsRuntime{}, nil
 	case Java:
 		return &javaRuntime{}, nil
+	case Python:
+		return &pythonRuntime{}, nil
+	case Golang:
+		return &golangRuntime{}, nil
+	case Ruby:
+		return &rubyRuntime{}, nil
+	case Dotnet:
+		return &dotnetRuntime{}, nil
+	case PHP:
+		return &phpRuntime{}, nil
+	case Erlang:
+		return &erlangRuntime{}, nil
+	}
+
+	rt, err := pickExternalRuntime(runtimeName)
+	if err != nil {
+		return nil, err
+	} else if rt != nil {
+		return rt, nil
 	}
 
 	return nil, fmt.Errorf("Unknown runtime: '%s'\n", runtimeName)
 }
 
+// validateEnv checks that keys contain no spaces and values no newlines.
+// Values with spaces are quoted when prepended to the boot command.
+func validateEnv(env map[string]string) error {
+	for k, v := range env {
+		if k == "" || strings.ContainsAny(k, " =") {
+			return fmt.Errorf("invalid env key: '%s'", k)
+		}
+		if strings.Contains(v, "\n") {
+			return fmt.Errorf("newlines not allowed in env value: '%s'", k)
+		}
+	}
+	return nil
+}
+
 // PrependEnvsPrefix prepends all key-values of env map to the boot cmd give.
-// It prepends each pair in a form of "--env={KEY}={VALUE}".
-// Also performs check that neither key nor value contains space.
+// It prepends each pair in a form of "--env={KEY}={VALUE}", quoting the pair
+// when the value contains spaces. Pairs are sorted by keys so that the same
+// package always results in the same boot command.
 // Argument `soft` means that operator '?=' is used that only sets env
 // variable if it's not set yet.
 func PrependEnvsPrefix(cmd string, env map[string]string, soft bool) (string, error) {
@@ -148,13 +567,37 @@ func PrependEnvsPrefix(cmd string, env map[string]string, soft bool) (string, er
 		operator = "?="
 	}
 
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	s := ""
-	for k, v := range env {
-		s += fmt.Sprintf("--env=%s%s%s ", k, operator, v)
+	for _, k := range keys {
+		s += util.FormatEnvArg(k, operator, env[k]) + " "
 	}
 	return fmt.Sprintf("%s%s", s, cmd), nil
 }
 
+// ForceEnv prepends environment variables that override those set by the
+// boot command, including the ones set by config sets (using '?='). Variables
+// previously forced onto the command with the same keys are replaced.
+func ForceEnv(cmd string, env map[string]string) (string, error) {
+	kept := ""
+	rest := strings.TrimSpace(cmd)
+	for strings.HasPrefix(rest, "--env=") || strings.HasPrefix(rest, `"--env=`) {
+		token := util.LeadingToken(rest)
+		keyValue := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(token, `"`), "--env="), "=", 2)
+		if _, ok := env[keyValue[0]]; !ok {
+			kept += token + " "
+		}
+		rest = strings.TrimLeft(rest[len(token):], " ")
+	}
+
+	return PrependEnvsPrefix(strings.TrimSpace(kept+rest), env, false)
+}
+
 // BootCmdForScript returns boot command that is to be used
 // to run config set with name bootName.
 func BootCmdForScript(bootName string) string {
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Secret tells where the value of a secret environment variable is read from
+// at run time. Exactly one of the sources must be given.
+type Secret struct {
+	File    string `yaml:"file,omitempty"`
+	Env     string `yaml:"env,omitempty"`
+	Command string `yaml:"command,omitempty"`
+}
+
+// Secrets map environment variable names to their sources. Secrets are never
+// part of the boot command stored in the image, they are only passed to the
+// instance when it is run.
+type Secrets map[string]Secret
+
+func (s Secrets) GetYamlTemplate() string {
+	return `
+# OPTIONAL
+# Secret environment variables. Values are read when the instance is run and
+# are never stored into the image. Each secret is read either from a file
+# (relative to the package directory), from host environment variable or
+# from the output of a command.
+# Example value:  secrets:
+#                    DB_PASSWORD:
+#                       file: secrets/db-password
+#                    API_TOKEN:
+#                       env: MY_API_TOKEN
+#                    TLS_KEY:
+#                       command: pass show tls-key
+secrets:
+   <map>
+`
+}
+
+func (s Secrets) Validate() error {
+	for name, secret := range s {
+		if strings.Contains(name, " ") {
+			return fmt.Errorf("spaces not allowed in secret name: '%s'", name)
+		}
+
+		sources := 0
+		for _, source := range []string{secret.File, secret.Env, secret.Command} {
+			if source != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return fmt.Errorf("exactly one of 'file', 'env' or 'command' must be provided for secret '%s'", name)
+		}
+	}
+	return nil
+}
+
+// Absolute returns secrets with file paths relative to the given package directory.
+func (s Secrets) Absolute(packageDir string) Secrets {
+	res := Secrets{}
+	for name, secret := range s {
+		if secret.File != "" && !filepath.IsAbs(secret.File) {
+			secret.File = filepath.Join(packageDir, secret.File)
+			if abs, err := filepath.Abs(secret.File); err == nil {
+				secret.File = abs
+			}
+		}
+		res[name] = secret
+	}
+	return res
+}
+
+// Resolve reads the values of all secrets.
+func (s Secrets) Resolve() (map[string]string, error) {
+	res := make(map[string]string)
+	for name, secret := range s {
+		value, err := secret.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret '%s': %s", name, err)
+		}
+		if strings.Contains(value, "\n") {
+			return nil, fmt.Errorf("failed to read secret '%s': newlines not allowed in value", name)
+		}
+		res[name] = value
+	}
+	return res, nil
+}
+
+func (secret Secret) resolve() (string, error) {
+	switch {
+	case secret.File != "":
+		data, err := ioutil.ReadFile(secret.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case secret.Env != "":
+		value, ok := os.LookupEnv(secret.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", secret.Env)
+		}
+		return value, nil
+	default:
+		cmd := exec.Command("sh", "-c", secret.Command)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+}
+
+// ParseSecrets reads secret definitions from the given file.
+func ParseSecrets(path string) (Secrets, error) {
+	s := Secrets{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, &s)
+	return s, err
+}
+
+// WriteToFile stores secret definitions (not their values).
+func (s Secrets) WriteToFile(path string) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Restart policies supported in run.yaml.
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// HealthCheck describes how the running instance is probed. The address must
+// be reachable from the host, e.g. a port forwarded to the instance.
+type HealthCheck struct {
+	Type     string `yaml:"type"`
+	Address  string `yaml:"address"`
+	Path     string `yaml:"path,omitempty"`
+	Interval string `yaml:"interval,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty"`
+	Retries  int    `yaml:"retries,omitempty"`
+}
+
+// Supervision holds settings used by 'capstan run' to supervise the instance.
+type Supervision struct {
+	HealthCheck   *HealthCheck `yaml:"healthcheck,omitempty"`
+	RestartPolicy string       `yaml:"restart_policy,omitempty"`
+	MaxRestarts   int          `yaml:"max_restarts,omitempty"`
+}
+
+func (s Supervision) GetSupervision() Supervision {
+	return s
+}
+
+// IsEmpty tells whether the instance needs to be supervised at all.
+func (s Supervision) IsEmpty() bool {
+	return s.HealthCheck == nil && s.GetRestartPolicy() == RestartNever
+}
+
+func (s Supervision) GetRestartPolicy() string {
+	if s.RestartPolicy == "" {
+		return RestartNever
+	}
+	return s.RestartPolicy
+}
+
+// GetMaxRestarts returns how many times in a row the instance is restarted
+// when it exits shortly after its launch before supervision gives up.
+func (s Supervision) GetMaxRestarts() int {
+	if s.MaxRestarts == 0 {
+		return 5
+	}
+	return s.MaxRestarts
+}
+
+func (s Supervision) GetYamlTemplate() string {
+	return `
+# OPTIONAL
+# Health check that 'capstan run' uses to probe the instance. Type is either
+# tcp (connect to the address) or http (GET request must succeed). The address
+# must be reachable from the host, e.g. a port forwarded with --publish.
+# Instance is considered unhealthy after given number of failed probes.
+# Example value:  healthcheck:
+#                    type: http
+#                    address: localhost:8000
+#                    path: /health
+#                    interval: 10s
+#                    timeout: 2s
+#                    retries: 3
+healthcheck:
+   <map>
+
+# OPTIONAL
+# What to do when the instance exits or becomes unhealthy: never (default),
+# on-failure (restart on non-zero exit or failed health check) or always.
+# Example value: on-failure
+restart_policy: never
+
+# OPTIONAL
+# Restarts are delayed, starting with one second and doubling up to a minute.
+# Supervision gives up once the instance has been restarted this many times
+# in a row without running for a minute. Defaults to 5.
+# Example value: 10
+max_restarts: 5
+`
+}
+
+func (s Supervision) Validate() error {
+	switch s.GetRestartPolicy() {
+	case RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return fmt.Errorf("unknown restart_policy '%s', use one of never|on-failure|always", s.RestartPolicy)
+	}
+	if s.MaxRestarts < 0 {
+		return fmt.Errorf("max_restarts must not be negative")
+	}
+
+	if s.HealthCheck != nil {
+		return s.HealthCheck.Validate()
+	}
+	return nil
+}
+
+func (h *HealthCheck) Validate() error {
+	switch h.Type {
+	case "tcp", "http":
+	default:
+		return fmt.Errorf("unknown healthcheck type '%s', use one of tcp|http", h.Type)
+	}
+
+	if _, _, err := net.SplitHostPort(h.Address); err != nil {
+		return fmt.Errorf("invalid healthcheck address '%s': %s", h.Address, err)
+	}
+
+	if h.Path != "" && h.Type != "http" {
+		return fmt.Errorf("healthcheck path is only supported for http type")
+	}
+
+	for _, d := range []string{h.Interval, h.Timeout} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return fmt.Errorf("invalid healthcheck duration '%s'", d)
+		}
+	}
+
+	if h.Retries < 0 {
+		return fmt.Errorf("healthcheck retries must not be negative")
+	}
+	return nil
+}
+
+func (h *HealthCheck) GetInterval() time.Duration {
+	if d, err := time.ParseDuration(h.Interval); err == nil {
+		return d
+	}
+	return 10 * time.Second
+}
+
+func (h *HealthCheck) GetTimeout() time.Duration {
+	if d, err := time.ParseDuration(h.Timeout); err == nil {
+		return d
+	}
+	return 2 * time.Second
+}
+
+func (h *HealthCheck) GetRetries() int {
+	if h.Retries == 0 {
+		return 3
+	}
+	return h.Retries
+}
+
+// Probe checks the health of the instance once.
+func (h *HealthCheck) Probe() error {
+	if h.Type == "tcp" {
+		conn, err := net.DialTimeout("tcp", h.Address, h.GetTimeout())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	// Instances are probed directly, never through the configured proxy.
+	client := http.Client{Timeout: h.GetTimeout(), Transport: &http.Transport{Proxy: nil}}
+	resp, err := client.Get(fmt.Sprintf("http://%s/%s", h.Address, strings.TrimPrefix(h.Path, "/")))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ParseSupervision reads supervision settings from the given file.
+func ParseSupervision(path string) (Supervision, error) {
+	s := Supervision{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	err = yaml.Unmarshal(data, &s)
+	return s, err
+}
+
+func (s Supervision) WriteToFile(path string) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
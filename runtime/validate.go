@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// runManifestVersions are format versions of meta/run.yaml, the latest one
+// last, and runManifestChecks check manifests of each of them.
+var runManifestVersions = []string{"1"}
+var runManifestChecks = map[string]func(packageDir string, doc map[interface{}]interface{}, locator *util.LineLocator) []error{
+	"1": checkRunManifestV1,
+}
+
+// ValidatePackageRunManifest checks meta/run.yaml of the given package
+// directory against the schema of its format version and runtime. It returns
+// all problems found: unknown keys, type mismatches and missing required
+// fields.
+func ValidatePackageRunManifest(packageDir string) ([]error, error) {
+	data, err := ioutil.ReadFile(filepath.Join(packageDir, "meta", "run.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	locator := util.NewLineLocator(data)
+
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []error{err}, nil
+	}
+
+	version, err := util.SchemaVersion(doc, runManifestVersions, locator)
+	if err != nil {
+		return []error{err}, nil
+	}
+	return runManifestChecks[version](packageDir, doc, locator), nil
+}
+
+func checkRunManifestV1(packageDir string, doc map[interface{}]interface{}, locator *util.LineLocator) []error {
+	problems := util.CheckSchema(doc, reflect.TypeOf(cmdConfigInternal{}), nil, locator)
+
+	// Config sets are only checked against the schema of a known runtime.
+	var runtimeType reflect.Type
+	runtimeName, _ := doc["runtime"].(string)
+	if runtimeName == "" {
+		problems = append(problems, util.SchemaError{Message: "'runtime' must be provided"})
+	} else if theRuntime, err := PickRuntime(RuntimeType(runtimeName)); err != nil {
+		runtimes, _ := AvailableRuntimes()
+		problems = append(problems, util.SchemaError{Line: locator.Line([]string{"runtime"}), Path: []string{"runtime"}, Message: fmt.Sprintf("unknown runtime, use one of %v", runtimes)})
+	} else {
+		runtimeType = reflect.TypeOf(theRuntime)
+	}
+
+	configSets, _ := doc["config_set"].(map[interface{}]interface{})
+	if len(configSets) == 0 {
+		problems = append(problems, util.SchemaError{Message: "at least one config_set must be provided"})
+	}
+
+	var names []string
+	byName := make(map[string]interface{})
+	for name, configSet := range configSets {
+		names = append(names, fmt.Sprint(name))
+		byName[fmt.Sprint(name)] = configSet
+	}
+	sort.Strings(names)
+
+	// Check each config set and its overlays against the runtime schema.
+	for _, name := range names {
+		path := []string{"config_set", name}
+		configSet, ok := byName[name].(map[interface{}]interface{})
+		if !ok {
+			problems = append(problems, util.SchemaError{Line: locator.Line(path), Path: path, Message: "expected map"})
+			continue
+		}
+		if runtimeType == nil {
+			continue
+		}
+
+		base := make(map[interface{}]interface{})
+		for k, v := range configSet {
+			if k != "overlays" {
+				base[k] = v
+			}
+		}
+		problems = append(problems, util.CheckSchema(base, runtimeType, path, locator)...)
+
+		overlays, _ := configSet["overlays"].([]interface{})
+		for i, o := range overlays {
+			overlayPath := append(append([]string{}, path...), "overlays", fmt.Sprintf("[%d]", i))
+			overlay, ok := o.(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			values := make(map[interface{}]interface{})
+			for k, v := range overlay {
+				if k != "when" {
+					values[k] = v
+				}
+			}
+			problems = append(problems, util.CheckSchema(values, runtimeType, overlayPath, locator)...)
+		}
+	}
+	if runtimeType == nil {
+		return problems
+	}
+
+	// Parse the manifest as compose does and validate the config sets. Parse
+	// errors are only reported when the schema did not already explain them.
+	cmdConfig, err := ParsePackageRunManifest(packageDir)
+	if err != nil {
+		if len(problems) == 0 {
+			problems = append(problems, err)
+		}
+		return problems
+	}
+	for _, name := range names {
+		if conf, ok := cmdConfig.ConfigSets[name]; ok {
+			if err := conf.Validate(); err != nil {
+				path := []string{"config_set", name}
+				problems = append(problems, util.SchemaError{Line: locator.Line(path), Path: path, Message: err.Error()})
+			}
+		}
+	}
+
+	if cmdConfig.ConfigSetDefault != "" && cmdConfig.ConfigSets[cmdConfig.ConfigSetDefault] == nil {
+		path := []string{"config_set_default"}
+		problems = append(problems, util.SchemaError{Line: locator.Line(path), Path: path, Message: fmt.Sprintf("config set '%s' does not exist", cmdConfig.ConfigSetDefault)})
+	}
+
+	return problems
+}
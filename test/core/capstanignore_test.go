@@ -186,3 +186,188 @@ func (s *testingCapstanignoreSuite) TestIsIgnoredMeta(c *C) {
 	// Expectations.
 	c.Check(err, ErrorMatches, "please remove '/meta' from .capstanignore")
 }
+
+func (s *testingCapstanignoreSuite) TestIsIgnoredNegation(c *C) {
+	m := []struct {
+		comment      string
+		patterns     []string
+		path         string
+		shouldIgnore bool
+	}{
+		{
+			"re-included folder",
+			[]string{"/node_modules/*", "!/node_modules/native"}, "/node_modules/native", false,
+		},
+		{
+			"file beneath re-included folder",
+			[]string{"/node_modules/*", "!/node_modules/native"}, "/node_modules/native/lib/binding.node", false,
+		},
+		{
+			"other folder remains ignored",
+			[]string{"/node_modules/*", "!/node_modules/native"}, "/node_modules/express", true,
+		},
+		{
+			"re-included file by extension",
+			[]string{"/data/*", "!/data/*.json"}, "/data/config.json", false,
+		},
+		{
+			"later pattern ignores again",
+			[]string{"/node_modules/*", "!/node_modules/native", "/**/*.md"}, "/node_modules/native/README.md", true,
+		},
+		{
+			"negation without preceding pattern",
+			[]string{"!/myfile.txt"}, "/myfile.txt", false,
+		},
+		{
+			"escaped exclamation mark",
+			[]string{"\\!important.txt"}, "!important.txt", true,
+		},
+		{
+			"always ignored paths can not be re-included",
+			[]string{"!/mpm-pkg"}, "/mpm-pkg", true,
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Setup
+		capstanignore, _ := core.CapstanignoreInit("")
+		for _, pattern := range args.patterns {
+			capstanignore.AddPattern(pattern)
+		}
+
+		// This is what we're testing here.
+		ignoreYesNo := capstanignore.IsIgnored(args.path)
+
+		// Expectations.
+		c.Check(ignoreYesNo, Equals, args.shouldIgnore)
+	}
+}
+
+func (s *testingCapstanignoreSuite) TestIsIgnoredInclude(c *C) {
+	m := []struct {
+		comment      string
+		includes     []string
+		ignores      []string
+		path         string
+		shouldIgnore bool
+	}{
+		{
+			"included file",
+			[]string{"/server.js"}, nil, "/server.js", false,
+		},
+		{
+			"not included file",
+			[]string{"/server.js"}, nil, "/README.md", true,
+		},
+		{
+			"file beneath included folder",
+			[]string{"/lib"}, nil, "/lib/util/index.js", false,
+		},
+		{
+			"file by extension",
+			[]string{"/build/*.jar"}, nil, "/build/app.jar", false,
+		},
+		{
+			"parent folder of included file is not included itself",
+			[]string{"/build/*.jar"}, nil, "/build", true,
+		},
+		{
+			"ignored pattern applies to included paths",
+			[]string{"/lib"}, []string{"/**/*.md"}, "/lib/README.md", true,
+		},
+		{
+			"always ignored paths are ignored",
+			[]string{"/meta"}, nil, "/meta/package.yaml", true,
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Setup
+		capstanignore, _ := core.CapstanignoreInit("")
+		for _, pattern := range args.includes {
+			capstanignore.AddIncludePattern(pattern)
+		}
+		for _, pattern := range args.ignores {
+			capstanignore.AddPattern(pattern)
+		}
+
+		// This is what we're testing here.
+		ignoreYesNo := capstanignore.IsIgnored(args.path)
+
+		// Expectations.
+		c.Check(ignoreYesNo, Equals, args.shouldIgnore)
+	}
+}
+
+func (s *testingCapstanignoreSuite) TestMayIncludeBeneath(c *C) {
+	m := []struct {
+		comment  string
+		includes []string
+		ignores  []string
+		dir      string
+		expected bool
+	}{
+		{"parent of included file", []string{"/build/libs/app.jar"}, nil, "/build", true},
+		{"parent of included pattern", []string{"/build/*/app.jar"}, nil, "/build/libs", true},
+		{"any folder level", []string{"/dist/**/*.js"}, nil, "/dist/js/vendor", true},
+		{"package root", []string{"/build/*.jar"}, nil, "", true},
+		{"unrelated folder", []string{"/build/*.jar"}, nil, "/src", false},
+		{"included folder", []string{"/build"}, nil, "/build", false},
+		{"ignored folder", []string{"/build/*.jar"}, []string{"/build"}, "/build", false},
+		{"include mode off", nil, nil, "/build", false},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Setup
+		capstanignore, _ := core.CapstanignoreInit("")
+		for _, pattern := range args.includes {
+			capstanignore.AddIncludePattern(pattern)
+		}
+		for _, pattern := range args.ignores {
+			capstanignore.AddPattern(pattern)
+		}
+
+		// This is what we're testing here.
+		may := capstanignore.MayIncludeBeneath(args.dir)
+
+		// Expectations.
+		c.Check(may, Equals, args.expected)
+	}
+}
+
+func (s *testingCapstanignoreSuite) TestIsIgnoredTarget(c *C) {
+	m := []struct {
+		comment      string
+		selected     []string
+		others       []string
+		path         string
+		shouldIgnore bool
+	}{
+		{"file of other target", nil, []string{"/startup/*"}, "/startup/gce.sh", true},
+		{"folder of other target", nil, []string{"/startup"}, "/startup/gce.sh", true},
+		{"file of selected target", []string{"/startup/*"}, nil, "/startup/gce.sh", false},
+		{"file of both targets", []string{"/startup/gce.sh"}, []string{"/startup/*"}, "/startup/gce.sh", false},
+		{"file of no target", nil, []string{"/startup/*"}, "/app/main.js", false},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Setup
+		capstanignore, _ := core.CapstanignoreInit("")
+		for _, pattern := range args.selected {
+			capstanignore.AddTargetPattern(pattern, true)
+		}
+		for _, pattern := range args.others {
+			capstanignore.AddTargetPattern(pattern, false)
+		}
+
+		// This is what we're testing here.
+		ignoreYesNo := capstanignore.IsIgnored(args.path)
+
+		// Expectations.
+		c.Check(ignoreYesNo, Equals, args.shouldIgnore)
+	}
+}
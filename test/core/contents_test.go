@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/core"
+	. "gopkg.in/check.v1"
+)
+
+type testingContentsSuite struct{}
+
+var _ = Suite(&testingContentsSuite{})
+
+func (s *testingContentsSuite) TestCollectImageContents(c *C) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	os.MkdirAll(filepath.Join(tmp, "app"), 0700)
+	ioutil.WriteFile(filepath.Join(tmp, "app", "server.js"), []byte("12345"), 0700)
+
+	// When
+	contents, err := core.CollectImageContents(map[string]string{
+		filepath.Join(tmp, "app"):              "/app",
+		filepath.Join(tmp, "app", "server.js"): "/app/server.js",
+	})
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Check(contents, DeepEquals, core.ImageContents{
+		"/app":           core.DirectorySize,
+		"/app/server.js": 5,
+	})
+}
+
+func (s *testingContentsSuite) TestTree(c *C) {
+	contents := core.ImageContents{
+		"/app-x.txt":         2048,
+		"/app/lib/module.so": 3 * 1024 * 1024,
+		"/app/server.js":     100,
+	}
+
+	// When
+	tree := contents.Tree()
+
+	// Then
+	c.Check(tree, Equals, ""+
+		"app/\n"+
+		"  lib/\n"+
+		"    module.so                                                    3.0 MB\n"+
+		"  server.js                                                       100 B\n"+
+		"app-x.txt                                                        2.0 KB\n"+
+		"\n"+
+		"3 files, 3.0 MB total\n")
+}
+
+func (s *testingContentsSuite) TestWriteAndParse(c *C) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	contents := core.ImageContents{"/app": core.DirectorySize, "/app/server.js": 100}
+	path := filepath.Join(tmp, "image.qemu.contents")
+
+	// When
+	c.Assert(contents.WriteToFile(path), IsNil)
+	parsed, err := core.ParseImageContents(path)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Check(parsed, DeepEquals, contents)
+}
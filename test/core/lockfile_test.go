@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/core"
+	. "gopkg.in/check.v1"
+)
+
+type testingLockFileSuite struct{}
+
+var _ = Suite(&testingLockFileSuite{})
+
+func (s *testingLockFileSuite) TestWriteAndParse(c *C) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, core.LockFileName)
+
+	lock := core.LockFile{Packages: []core.LockedPackage{
+		{Name: "osv.cli", Version: "1.2", Hash: "sha256:cli"},
+		{Name: "osv.bootstrap", Hash: "sha256:bootstrap"},
+	}}
+
+	// When
+	err := lock.WriteToFile(path)
+
+	// Then
+	c.Assert(err, IsNil)
+	parsed, err := core.ParseLockFile(path)
+	c.Assert(err, IsNil)
+	c.Check(parsed.Packages, DeepEquals, []core.LockedPackage{
+		{Name: "osv.bootstrap", Hash: "sha256:bootstrap"},
+		{Name: "osv.cli", Version: "1.2", Hash: "sha256:cli"},
+	})
+}
+
+func (s *testingLockFileSuite) TestDiff(c *C) {
+	lock := core.LockFile{Packages: []core.LockedPackage{
+		{Name: "osv.bootstrap", Hash: "sha256:a"},
+		{Name: "osv.cli", Version: "1.2", Hash: "sha256:b"},
+		{Name: "osv.httpserver", Version: "2.0", Hash: "sha256:c"},
+		{Name: "osv.nginx", Version: "1.0", Hash: "sha256:d"},
+	}}
+	resolved := core.LockFile{Packages: []core.LockedPackage{
+		{Name: "node-4.4.5", Version: "4.4.5", Hash: "sha256:e"},
+		{Name: "osv.bootstrap", Hash: "sha256:a"},
+		{Name: "osv.cli", Version: "1.3", Hash: "sha256:f"},
+		{Name: "osv.httpserver", Version: "2.0", Hash: "sha256:g"},
+	}}
+
+	// When
+	diff := lock.Diff(resolved)
+
+	// Then
+	c.Check(diff, DeepEquals, []string{
+		"node-4.4.5: required but not locked",
+		"osv.cli: locked version 1.2, resolved 1.3",
+		"osv.httpserver: content of version 2.0 differs from the locked one",
+		"osv.nginx: locked but no longer required",
+	})
+	c.Check(lock.Diff(lock), HasLen, 0)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package core_test
+
+import (
+	"github.com/mikelangelo-project/capstan/core"
+	. "gopkg.in/check.v1"
+)
+
+type testingRequirementSuite struct{}
+
+var _ = Suite(&testingRequirementSuite{})
+
+func (s *testingRequirementSuite) TestParseRequirement(c *C) {
+	m := []struct {
+		comment     string
+		requirement string
+		expected    [][]core.Comparator
+		err         string
+	}{
+		{
+			"name only",
+			"osv.bootstrap",
+			nil, "",
+		},
+		{
+			"at least",
+			"openjdk8-zulu-compact1>=1.2",
+			[][]core.Comparator{{{Operator: ">=", Version: "1.2"}}}, "",
+		},
+		{
+			"exact with spaces",
+			"node-4.4.5 = 0.23-24-gc60331d",
+			[][]core.Comparator{{{Operator: "=", Version: "0.23-24-gc60331d"}}}, "",
+		},
+		{
+			"version without operator",
+			"app 2.1",
+			[][]core.Comparator{{{Operator: "=", Version: "2.1"}}}, "",
+		},
+		{
+			"range",
+			"app >=2.0 <3.0",
+			[][]core.Comparator{{{Operator: ">=", Version: "2.0"}, {Operator: "<", Version: "3.0"}}}, "",
+		},
+		{
+			"caret",
+			"app ^1.2",
+			[][]core.Comparator{{{Operator: ">=", Version: "1.2"}, {Operator: "<", Version: "2"}}}, "",
+		},
+		{
+			"caret below 1",
+			"app^0.2.3",
+			[][]core.Comparator{{{Operator: ">=", Version: "0.2.3"}, {Operator: "<", Version: "0.3"}}}, "",
+		},
+		{
+			"tilde",
+			"app ~1.2.3",
+			[][]core.Comparator{{{Operator: ">=", Version: "1.2.3"}, {Operator: "<", Version: "1.3"}}}, "",
+		},
+		{
+			"alternatives",
+			"app ^1.2 || >= 3",
+			[][]core.Comparator{{{Operator: ">=", Version: "1.2"}, {Operator: "<", Version: "2"}}, {{Operator: ">=", Version: "3"}}}, "",
+		},
+		{
+			"missing version",
+			"app>=",
+			nil, "invalid version constraint in 'app>=': invalid version ''",
+		},
+		{
+			"unknown operator",
+			"app=>1",
+			nil, "invalid version constraint in 'app=>1': invalid version '>1'",
+		},
+		{
+			"empty alternative",
+			"app ^1 ||",
+			nil, "invalid version constraint in 'app \\^1 \\|\\|': empty range",
+		},
+		{
+			"missing name",
+			">=1",
+			nil, "invalid package name in '>=1'",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		req, err := core.ParseRequirement(args.requirement)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+		} else {
+			c.Assert(err, IsNil)
+			c.Check(req.Ranges, DeepEquals, args.expected)
+		}
+	}
+}
+
+func (s *testingRequirementSuite) TestRequirementMatches(c *C) {
+	m := []struct {
+		requirement string
+		version     string
+		expected    bool
+	}{
+		{"app", "", true},
+		{"app>=1.2", "1.2", true},
+		{"app>=1.2", "1.10", true},
+		{"app>=1.2", "1.1.9", false},
+		{"app>1.2", "1.2", false},
+		{"app<2", "1.99", true},
+		{"app<=2", "2.0.1", false},
+		{"app=0.23-24-gc60331d", "0.23-24-gc60331d", true},
+		{"app==1.2", "1.2", true},
+		{"app!=1.2", "1.3", true},
+		{"app>=0.23", "0.24-1-gabc", true},
+		{"app>=1", "", false},
+		{"app ^1.2", "1.9.7", true},
+		{"app ^1.2", "2.0", false},
+		{"app ~1.2", "1.2.9", true},
+		{"app ~1.2", "1.3", false},
+		{"app >=2.0 <3.0", "2.5", true},
+		{"app >=2.0 <3.0", "3.0", false},
+		{"app ^1.2 || ^3", "3.1", true},
+		{"app ^1.2 || ^3", "2.1", false},
+		{"app *", "0.1", true},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s with version '%s'", i, args.requirement, args.version)
+		req, err := core.ParseRequirement(args.requirement)
+		c.Assert(err, IsNil)
+
+		// This is what we're testing here.
+		c.Check(req.Matches(args.version), Equals, args.expected)
+	}
+}
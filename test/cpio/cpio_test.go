@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cpio_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mikelangelo-project/capstan/cpio"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type testingCpioSuite struct{}
+
+var _ = Suite(&testingCpioSuite{})
+
+func (s *testingCpioSuite) TestCopyPadded(c *C) {
+	m := []struct {
+		comment  string
+		content  string
+		expected int
+	}{
+		{"aligned", "abcd", 4},
+		{"one byte", "a", 4},
+		{"three bytes", "abc", 4},
+		{"five bytes", "abcde", 8},
+		{"empty", "", 0},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		var streamed, buffered bytes.Buffer
+
+		// This is what we're testing here.
+		err := cpio.CopyPadded(&streamed, strings.NewReader(args.content), int64(len(args.content)))
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		cpio.WritePadded(&buffered, []byte(args.content))
+		c.Check(streamed.Len(), Equals, args.expected)
+		c.Check(streamed.String(), Equals, buffered.String())
+	}
+}
+
+func (s *testingCpioSuite) TestCopyPaddedShortContent(c *C) {
+	var out bytes.Buffer
+
+	// This is what we're testing here.
+	err := cpio.CopyPadded(&out, strings.NewReader("ab"), 4)
+
+	// Expectations.
+	c.Check(err, NotNil)
+}
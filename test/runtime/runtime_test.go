@@ -8,8 +8,14 @@
 package runtime_test
 
 import (
+	"archive/zip"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/mikelangelo-project/capstan/nat"
 	"github.com/mikelangelo-project/capstan/runtime"
 	. "github.com/mikelangelo-project/capstan/testing"
 	. "gopkg.in/check.v1"
@@ -21,6 +27,56 @@ type testingRuntimeSuite struct{}
 
 var _ = Suite(&testingRuntimeSuite{})
 
+// bootCmdCase is a config set written in flow style, either with the boot
+// command that it yields or with the error that its validation fails with.
+// Environment variables are compared regardless of their order when
+// expectedEnv is given, otherwise they are part of expectedCmd.
+type bootCmdCase struct {
+	comment     string
+	configSet   string
+	expectedCmd string
+	expectedEnv []string
+	err         string
+}
+
+// parseConfigSet parses the config set as the default config set of the
+// runtime.
+func parseConfigSet(c *C, runtimeName, configSet string) runtime.Runtime {
+	cmdConfig, err := runtime.ParsePackageRunManifestData([]byte(
+		"runtime: " + runtimeName + "\nconfig_set:\n  default: " + configSet + "\n"))
+	c.Assert(err, IsNil)
+	return cmdConfig.ConfigSets["default"]
+}
+
+// checkBootCmds validates config sets of the cases and checks their boot
+// commands, with hooks applied as in the image.
+func checkBootCmds(c *C, runtimeName string, cases []bootCmdCase) {
+	for i, args := range cases {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		rt := parseConfigSet(c, runtimeName, args.configSet)
+
+		// This is what we're testing here.
+		err := rt.Validate()
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		bootCmd, err := rt.GetBootCmd()
+		c.Assert(err, IsNil)
+		if hooks := rt.GetHooks(); !hooks.IsEmpty() {
+			bootCmd = hooks.Apply(bootCmd, "default")
+		}
+		if args.expectedEnv != nil {
+			c.Check(bootCmd, BootCmdEquals, args.expectedCmd, args.expectedEnv)
+		} else {
+			c.Check(bootCmd, Equals, args.expectedCmd)
+		}
+	}
+}
+
 func (s *testingRuntimeSuite) TestPrependEnvsPrefix(c *C) {
 	m := []struct {
 		comment     string
@@ -67,6 +123,36 @@ func (s *testingRuntimeSuite) TestPrependEnvsPrefix(c *C) {
 			"/node server.js", []string{"--env=PORT?=8000", "--env=ENDPOINT?=foo.com"},
 			"",
 		},
+		{
+			"value with spaces",
+			"/node server.js", map[string]string{"JVM_ARGS": "-Xmx1g -Xms512m"}, true,
+			"/node server.js", []string{`"--env=JVM_ARGS?=-Xmx1g -Xms512m"`},
+			"",
+		},
+		{
+			"value with quotes and backslashes",
+			"/node server.js", map[string]string{"MSG": `say "hi" \o/`}, false,
+			"/node server.js", []string{`"--env=MSG=say \"hi\" \\o/"`},
+			"",
+		},
+		{
+			"value with semicolon",
+			"/node server.js", map[string]string{"CMD": "a;/evil.so"}, false,
+			"/node server.js", []string{`"--env=CMD=a;/evil.so"`},
+			"",
+		},
+		{
+			"value with ampersand",
+			"/node server.js", map[string]string{"URL": "/?a=1&b=2"}, false,
+			"/node server.js", []string{`"--env=URL=/?a=1&b=2"`},
+			"",
+		},
+		{
+			"value with exclamation mark",
+			"/node server.js", map[string]string{"MSG": "hi!"}, false,
+			"/node server.js", []string{`"--env=MSG=hi!"`},
+			"",
+		},
 	}
 	for i, args := range m {
 		c.Logf("CASE #%d: %s", i, args.comment)
@@ -82,3 +168,1676 @@ func (s *testingRuntimeSuite) TestPrependEnvsPrefix(c *C) {
 		}
 	}
 }
+
+func (s *testingRuntimeSuite) TestPythonBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"script with default interpreter",
+			"{main: /app/main.py}",
+			"/python /app/main.py", []string{},
+			"",
+		},
+		{
+			"module with python3 and args",
+			"{interpreter: python3, module: http.server, args: ['8000']}",
+			"/python3 -m http.server 8000", []string{},
+			"",
+		},
+		{
+			"pythonpath",
+			"{main: /app/main.py, pythonpath: [/app, /app/lib], env: {PORT: '80'}}",
+			"/python /app/main.py", []string{"--env=PYTHONPATH?=/app:/app/lib", "--env=PORT?=80"},
+			"",
+		},
+		{
+			"requirements",
+			"{main: /app/main.py, pythonpath: [/app], requirements: /requirements.txt}",
+			"/python /app/main.py", []string{"--env=PYTHONPATH?=/app:/site-packages"},
+			"",
+		},
+		{
+			"requirements with target",
+			"{main: /app/main.py, requirements: /requirements.txt, requirements_target: /app/vendor}",
+			"/python /app/main.py", []string{"--env=PYTHONPATH?=/app/vendor"},
+			"",
+		},
+		{
+			"requirements target without requirements",
+			"{main: /app/main.py, requirements_target: /app/vendor}",
+			"", nil,
+			"'requirements' must be provided when 'requirements_target' is used",
+		},
+		{
+			"explicit PYTHONPATH overrides pythonpath",
+			"{main: /app/main.py, pythonpath: [/app], env: {PYTHONPATH: /lib}}",
+			"/python /app/main.py", []string{"--env=PYTHONPATH?=/lib"},
+			"",
+		},
+		{
+			"both main and module",
+			"{main: /app/main.py, module: app}",
+			"", nil,
+			"exactly one of 'main' or 'module' must be provided",
+		},
+		{
+			"unknown interpreter",
+			"{interpreter: pypy, main: /app/main.py}",
+			"", nil,
+			"unknown interpreter 'pypy', use one of python2\\|python3",
+		},
+	}
+	checkBootCmds(c, "python", cases)
+}
+
+func (s *testingRuntimeSuite) TestPythonDependencies(c *C) {
+	m := []struct {
+		comment      string
+		configSet    string
+		expectedDeps []string
+	}{
+		{"default interpreter", "{main: /app/main.py}", []string{"python-2.7"}},
+		{"python2", "{interpreter: python2, main: /app/main.py}", []string{"python-2.7"}},
+		{"python3", "{interpreter: python3, main: /app/main.py}", []string{"python-3"}},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		rt := parseConfigSet(c, "python", args.configSet)
+
+		// This is what we're testing here.
+		deps := rt.GetDependencies()
+
+		// Expectations.
+		c.Check(deps, DeepEquals, args.expectedDeps)
+	}
+}
+
+func (s *testingRuntimeSuite) TestGolangBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"pie binary",
+			"{main: /app/server, args: [-port=8000]}",
+			"/app/server -port=8000", []string{},
+			"",
+		},
+		{
+			"shared object",
+			"{main: /app/server.so, buildmode: shared}",
+			"/go.so /app/server.so", []string{},
+			"",
+		},
+		{
+			"runtime settings",
+			"{main: /app/server, maxprocs: 2, gogc: 'off'}",
+			"/app/server", []string{"--env=GOMAXPROCS?=2", "--env=GOGC?=off"},
+			"",
+		},
+		{
+			"explicit GOMAXPROCS overrides maxprocs",
+			"{main: /app/server, maxprocs: 2, env: {GOMAXPROCS: '4'}}",
+			"/app/server", []string{"--env=GOMAXPROCS?=4"},
+			"",
+		},
+		{
+			"missing main",
+			"{buildmode: pie}",
+			"", nil,
+			"'main' must be provided",
+		},
+		{
+			"unknown buildmode",
+			"{main: /app/server, buildmode: plugin}",
+			"", nil,
+			"unknown buildmode 'plugin', use one of pie\\|shared",
+		},
+		{
+			"invalid gogc",
+			"{main: /app/server, gogc: lots}",
+			"", nil,
+			"'gogc' must be a percentage or 'off', got 'lots'",
+		},
+	}
+	checkBootCmds(c, "golang", cases)
+}
+
+func (s *testingRuntimeSuite) TestEnvOrderIsStable(c *C) {
+	data := []byte("runtime: native\n" +
+		"config_set:\n" +
+		"  default:\n" +
+		"    bootcmd: /app.so\n" +
+		"    env: {E: '5', B: '2', D: '4', A: '1', C: '3', F: '6', H: '8', G: '7'}\n")
+
+	var bootCmds []string
+	for i := 0; i < 2; i++ {
+		cmdConfig, err := runtime.ParsePackageRunManifestData(data)
+		c.Assert(err, IsNil)
+
+		// This is what we're testing here.
+		bootCmd, err := cmdConfig.ConfigSets["default"].GetBootCmd()
+
+		c.Assert(err, IsNil)
+		bootCmds = append(bootCmds, bootCmd)
+	}
+
+	// Expectations.
+	c.Check(bootCmds[0], Equals, "--env=A?=1 --env=B?=2 --env=C?=3 --env=D?=4 --env=E?=5 --env=F?=6 --env=G?=7 --env=H?=8 /app.so")
+	c.Check(bootCmds[1], Equals, bootCmds[0])
+}
+
+func (s *testingRuntimeSuite) TestNativeCommandChain(c *C) {
+	cases := []bootCmdCase{
+		{
+			"single command",
+			"{bootcmd: /app.so --port=8000}",
+			"/app.so --port=8000", nil,
+			"",
+		},
+		{
+			"commands joined with ;",
+			"{bootcmd: /prepare.so --data=/data ; /app.so}",
+			"/prepare.so --data=/data ; /app.so", nil,
+			"",
+		},
+		{
+			"mixed separators",
+			"{bootcmd: '/a.so;/b.so ; /c.so & /d.so'}",
+			"/a.so ; /b.so ; /c.so & /d.so", nil,
+			"",
+		},
+		{
+			"separators in quotes",
+			"{bootcmd: '/app.so \"a && b\" ''c;d||e'' ; /other.so'}",
+			"/app.so \"a && b\" 'c;d||e' ; /other.so", nil,
+			"",
+		},
+		{
+			"with env",
+			"{bootcmd: /prepare.so ; /app.so, env: {PORT: '80'}}",
+			"--env=PORT?=80 /prepare.so ; /app.so", nil,
+			"",
+		},
+		{
+			"commands joined with &&",
+			"{bootcmd: /prepare.so --data=/data && /app.so}",
+			"/prepare.so --data=/data ; /app.so", nil,
+			"",
+		},
+		{
+			"conditional or",
+			"{bootcmd: /prepare.so || /app.so}",
+			"", nil,
+			"'\\|\\|' is not supported by OSv, join commands with '&&' or ';' instead: '/prepare.so \\|\\| /app.so'",
+		},
+		{
+			"empty command",
+			"{bootcmd: /prepare.so ; ; /app.so}",
+			"", nil,
+			"empty command in bootcmd: '/prepare.so ; ; /app.so'",
+		},
+		{
+			"trailing separator",
+			"{bootcmd: /app.so ;}",
+			"", nil,
+			"empty command in bootcmd: '/app.so ;'",
+		},
+	}
+	checkBootCmds(c, "native", cases)
+}
+
+func (s *testingRuntimeSuite) TestWriteChainScript(c *C) {
+	m := []struct {
+		comment        string
+		runtime        string
+		configSet      string
+		expectedCmd    string
+		expectedScript string
+	}{
+		{
+			"single command",
+			"native",
+			"{bootcmd: /app.so}",
+			"/app.so",
+			"",
+		},
+		{
+			"chained commands",
+			"native",
+			"{bootcmd: /prepare.so && /app.so, env: {PORT: '80'}}",
+			"--env=PORT?=80 runscript /run/default.chain",
+			"/prepare.so ; /app.so",
+		},
+		{
+			"other runtime",
+			"node",
+			"{main: /server.js}",
+			"node /server.js",
+			"",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		rt := parseConfigSet(c, args.runtime, args.configSet)
+		bootCmd, err := rt.GetBootCmd()
+		c.Assert(err, IsNil)
+		runDir := c.MkDir()
+
+		// This is what we're testing here.
+		bootCmd, err = runtime.WriteChainScript(rt, bootCmd, runDir, "default")
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(bootCmd, Equals, args.expectedCmd)
+		data, err := ioutil.ReadFile(filepath.Join(runDir, "default.chain"))
+		if args.expectedScript == "" {
+			c.Check(os.IsNotExist(err), Equals, true)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, args.expectedScript)
+	}
+}
+
+func (s *testingRuntimeSuite) TestJavaBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"main class",
+			"{main: main.Hello, classpath: [/app]}",
+			"java.so  io.osv.isolated.MultiJarLoader -mains /etc/javamains", nil,
+			"",
+		},
+		{
+			"jar with main class from manifest",
+			"{jar: /app.jar, args: [--port=8000], jvmargs: [Xmx512m]}",
+			"java.so -Xmx512m -jar /app.jar --port=8000", nil,
+			"",
+		},
+		{
+			"jar with explicit main class",
+			"{jar: /app.jar, main: main.Hello, classpath: [/lib]}",
+			"java.so -cp /app.jar:/lib main.Hello", nil,
+			"",
+		},
+		{
+			"jar built with maven",
+			"{jar: /app.jar, build: maven}",
+			"java.so -jar /app.jar", nil,
+			"",
+		},
+		{
+			"missing main and jar",
+			"{classpath: [/app]}",
+			"", nil,
+			"'main' or 'jar' must be provided",
+		},
+		{
+			"classpath with jar",
+			"{jar: /app.jar, classpath: [/lib]}",
+			"", nil,
+			"'classpath' cannot be used with 'jar' unless 'main' is provided",
+		},
+		{
+			"unknown build tool",
+			"{jar: /app.jar, build: ant}",
+			"", nil,
+			"unknown build tool 'ant', use one of maven\\|gradle",
+		},
+		{
+			"unsupported java version",
+			"{main: main.Hello, classpath: [/app], java_version: 9}",
+			"", nil,
+			"unsupported java_version '9', use one of 8\\|11\\|17",
+		},
+		{
+			"build without jar",
+			"{main: main.Hello, classpath: [/app], build: gradle}",
+			"", nil,
+			"'jar' must be provided when 'build' is used",
+		},
+		{
+			"java 11 main class",
+			"{main: main.Hello, classpath: [/app, /lib], java_version: 11, jdk_package: openjdk11-from-host, jvmargs: [Xmx512m]}",
+			"java.so -Xmx512m -cp /app:/lib main.Hello", nil,
+			"",
+		},
+		{
+			"java 17 module",
+			"{main: com.example.Hello, module: com.example, classpath: [/app], java_version: 17, jdk_package: openjdk17-from-host}",
+			"java.so --module-path /app -m com.example/com.example.Hello", nil,
+			"",
+		},
+		{
+			"java 11 without jdk package",
+			"{main: main.Hello, classpath: [/app], java_version: 11}",
+			"java.so -cp /app main.Hello", nil,
+			"",
+		},
+		{
+			"module with java 8",
+			"{main: main.Hello, module: com.example, classpath: [/app]}",
+			"", nil,
+			"'module' requires java_version 11 or newer",
+		},
+		{
+			"module without main",
+			"{jar: /app.jar, module: com.example, java_version: 11, jdk_package: openjdk11-from-host}",
+			"", nil,
+			"'main' must be provided when 'module' is used",
+		},
+		{
+			"jdk config set as base",
+			"{main: main.Hello, classpath: [/app], java_version: 11, jdk_package: openjdk11-from-host, jdk_config_set: default}",
+			"runscript /run/openjdk11-from-host-default & java.so -cp /app main.Hello", nil,
+			"",
+		},
+	}
+	checkBootCmds(c, "java", cases)
+}
+
+func (s *testingRuntimeSuite) TestJavaVersionDependencies(c *C) {
+	cmdConfig, err := runtime.ParsePackageRunManifestData([]byte(
+		"runtime: java\n" +
+			"config_set:\n" +
+			"  default: {main: main.Hello, classpath: [/]}\n" +
+			"  modern: {main: main.Hello, classpath: [/], java_version: 17, jdk_package: openjdk17-from-host}\n" +
+			"  legacy: {main: main.Hello, classpath: [/], java_version: '8'}\n" +
+			"  lts: {main: main.Hello, classpath: [/], java_version: 11}\n"))
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	deps := cmdConfig.GetDependencies()
+
+	// Expectations.
+	c.Check(deps, DeepEquals, []string{"openjdk8-zulu-compact1", "openjdk11-zulu", "openjdk17-from-host"})
+}
+
+func (s *testingRuntimeSuite) TestListConfigSets(c *C) {
+	cmdConfig, err := runtime.ParsePackageRunManifestData([]byte(
+		"runtime: native\n" +
+			"config_set:\n" +
+			"  worker: {bootcmd: /worker.so}\n" +
+			"  server: {bootcmd: /server.so, env: {PORT: 8000}}\n" +
+			"config_set_default: server\n"))
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	list, err := cmdConfig.ListConfigSets(cmdConfig.ConfigSetDefault)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(list, DeepEquals, runtime.ConfigSetList{
+		{Name: "server", Runtime: "native", Default: true, BootCmd: "--env=PORT?=8000 /server.so"},
+		{Name: "worker", Runtime: "native", BootCmd: "/worker.so"},
+	})
+
+	// Stored list is read back the same.
+	path := filepath.Join(c.MkDir(), "configsets")
+	c.Assert(list.WriteToFile(path), IsNil)
+	stored, err := runtime.ParseConfigSetList(path)
+	c.Assert(err, IsNil)
+	c.Check(stored, DeepEquals, list)
+}
+
+func (s *testingRuntimeSuite) TestDependencyVersions(c *C) {
+	cmdConfig, err := runtime.ParsePackageRunManifestData([]byte(
+		"runtime: java\n" +
+			"config_set:\n" +
+			"  default: {main: main.Hello, classpath: [/], dependency_versions: {openjdk8-zulu-compact1: '>=1.2'}}\n" +
+			"  modern: {main: main.Hello, classpath: [/], java_version: 17, jdk_package: openjdk17-from-host}\n"))
+	c.Assert(err, IsNil)
+	c.Assert(cmdConfig.ConfigSets["default"].Validate(), IsNil)
+
+	// This is what we're testing here.
+	deps := cmdConfig.GetDependencies()
+
+	// Expectations.
+	c.Check(deps, DeepEquals, []string{"openjdk8-zulu-compact1 >=1.2", "openjdk17-from-host"})
+
+	// Invalid constraints are reported.
+	cmdConfig, err = runtime.ParsePackageRunManifestData([]byte(
+		"runtime: java\n" +
+			"config_set:\n" +
+			"  default: {main: main.Hello, classpath: [/], dependency_versions: {openjdk8-zulu-compact1: '=>1.2'}}\n"))
+	c.Assert(err, IsNil)
+	c.Check(cmdConfig.ConfigSets["default"].Validate(), ErrorMatches, "invalid 'dependency_versions': .*")
+}
+
+func (s *testingRuntimeSuite) TestReadMainClass(c *C) {
+	tmp, _ := ioutil.TempDir("", "jar")
+	defer os.RemoveAll(tmp)
+
+	writeJar := func(name, manifest string) string {
+		path := filepath.Join(tmp, name)
+		f, _ := os.Create(path)
+		w := zip.NewWriter(f)
+		if manifest != "" {
+			mf, _ := w.Create("META-INF/MANIFEST.MF")
+			mf.Write([]byte(manifest))
+		}
+		w.Close()
+		f.Close()
+		return path
+	}
+
+	// This is what we're testing here.
+	mainClass, err := runtime.ReadMainClass(writeJar("app.jar", "Manifest-Version: 1.0\r\nMain-Class: com.example.App\r\n"))
+	c.Assert(err, IsNil)
+	c.Check(mainClass, Equals, "com.example.App")
+
+	_, err = runtime.ReadMainClass(writeJar("lib.jar", "Manifest-Version: 1.0\r\n"))
+	c.Check(err, ErrorMatches, "Main-Class not found in manifest")
+
+	_, err = runtime.ReadMainClass(writeJar("empty.jar", ""))
+	c.Check(err, ErrorMatches, "Main-Class not found in manifest")
+}
+
+func (s *testingRuntimeSuite) TestNodePackageJson(c *C) {
+	m := []struct {
+		comment     string
+		configSet   string
+		packageJson string
+		expectedCmd string
+		expectedEnv []string
+		err         string
+	}{
+		{
+			"main from run.yaml",
+			"{main: /server.js, args: [--debug]}",
+			`{"main": "index.js", "scripts": {"start": "node app.js"}}`,
+			"node /server.js --debug", []string{},
+			"",
+		},
+		{
+			"start script",
+			"{args: [--debug]}",
+			`{"main": "index.js", "scripts": {"start": "node ./bin/www --port 8000"}}`,
+			"node /bin/www --port 8000 --debug", []string{},
+			"",
+		},
+		{
+			"main from package.json",
+			"{env: {PORT: '80'}}",
+			`{"main": "lib/index.js", "scripts": {"start": "nodemon"}}`,
+			"node /lib/index.js", []string{"--env=PORT?=80"},
+			"",
+		},
+		{
+			"npm install",
+			"{npm_install: true}",
+			`{"main": "index.js"}`,
+			"node /index.js", []string{"--env=NODE_PATH?=/node_modules"},
+			"",
+		},
+		{
+			"no package.json",
+			"{args: [--debug]}",
+			"",
+			"", nil,
+			"'main' must be provided",
+		},
+		{
+			"invalid package.json",
+			"{args: [--debug]}",
+			"{main",
+			"", nil,
+			"failed to resolve configset 'default': failed to parse package.json: .*",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		tmp, _ := ioutil.TempDir("", "pkg")
+		defer os.RemoveAll(tmp)
+		os.MkdirAll(filepath.Join(tmp, "meta"), 0755)
+		ioutil.WriteFile(filepath.Join(tmp, "meta", "run.yaml"), []byte(
+			"runtime: node\nconfig_set:\n  default: "+args.configSet+"\n"), 0644)
+		if args.packageJson != "" {
+			ioutil.WriteFile(filepath.Join(tmp, "package.json"), []byte(args.packageJson), 0644)
+		}
+
+		// This is what we're testing here.
+		cmdConfig, err := runtime.ParsePackageRunManifest(tmp)
+		if err == nil {
+			err = cmdConfig.ConfigSets["default"].Validate()
+		}
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		bootCmd, err := cmdConfig.ConfigSets["default"].GetBootCmd()
+		c.Assert(err, IsNil)
+		c.Check(bootCmd, BootCmdEquals, args.expectedCmd, args.expectedEnv)
+	}
+}
+
+func (s *testingRuntimeSuite) TestNodeVersion(c *C) {
+	m := []struct {
+		comment      string
+		configSet    string
+		expectedDeps []string
+		err          string
+	}{
+		{
+			"default version",
+			"{main: /server.js}",
+			[]string{"node-4.4.5"},
+			"",
+		},
+		{
+			"selected version",
+			"{main: /server.js, node_version: 8.11.2}",
+			[]string{"node-8.11.2"},
+			"",
+		},
+		{
+			"invalid version",
+			"{main: /server.js, node_version: latest}",
+			nil,
+			"invalid node_version 'latest', expected e.g. 4.4.5",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		rt := parseConfigSet(c, "node", args.configSet)
+
+		// This is what we're testing here.
+		err := rt.Validate()
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(rt.GetDependencies(), DeepEquals, args.expectedDeps)
+	}
+}
+
+func (s *testingRuntimeSuite) TestRubyBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"script with args",
+			"{main: /app/server.rb, args: [--port=8000]}",
+			"/ruby.so /app/server.rb --port=8000", []string{},
+			"",
+		},
+		{
+			"gempath and rubyopt",
+			"{main: /app/server.rb, gempath: [/app/gems, /gems], rubyopt: -rbundler/setup}",
+			"/ruby.so /app/server.rb", []string{"--env=GEM_PATH?=/app/gems:/gems", "--env=RUBYOPT?=-rbundler/setup"},
+			"",
+		},
+		{
+			"explicit GEM_PATH overrides gempath",
+			"{main: /app/server.rb, gempath: [/app/gems], env: {GEM_PATH: /gems}}",
+			"/ruby.so /app/server.rb", []string{"--env=GEM_PATH?=/gems"},
+			"",
+		},
+		{
+			"missing main",
+			"{args: [--port=8000]}",
+			"", nil,
+			"'main' must be provided",
+		},
+		{
+			"rubyopt with spaces",
+			"{main: /app/server.rb, rubyopt: -W0 -rbundler/setup}",
+			"/ruby.so /app/server.rb", []string{`"--env=RUBYOPT?=-W0 -rbundler/setup"`},
+			"",
+		},
+	}
+	checkBootCmds(c, "ruby", cases)
+}
+
+func (s *testingRuntimeSuite) TestDotnetBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"assembly",
+			"{main: /app/hello.dll}",
+			"/usr/bin/dotnet exec /app/hello.dll", nil,
+			"",
+		},
+		{
+			"runtimeconfig and args",
+			"{main: /app/web.dll, runtimeconfig: /app/web.runtimeconfig.json, args: [--urls=http://0.0.0.0:5000]}",
+			"/usr/bin/dotnet exec --runtimeconfig /app/web.runtimeconfig.json /app/web.dll --urls=http://0.0.0.0:5000", nil,
+			"",
+		},
+		{
+			"missing main",
+			"{args: [hello]}",
+			"", nil,
+			"'main' must be provided",
+		},
+		{
+			"not an assembly",
+			"{main: /app/hello.exe}",
+			"", nil,
+			"'main' must be a .dll assembly, got '/app/hello.exe'",
+		},
+	}
+	checkBootCmds(c, "dotnet", cases)
+}
+
+func (s *testingRuntimeSuite) TestPhpBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"script",
+			"{main: /app/job.php, args: [--verbose]}",
+			"/php.so /app/job.php --verbose", nil,
+			"",
+		},
+		{
+			"server with default listen",
+			"{mode: server, docroot: /app/public}",
+			"/php.so -S 0.0.0.0:8000 -t /app/public", nil,
+			"",
+		},
+		{
+			"server with router and ini",
+			"{mode: server, docroot: /app, main: /app/router.php, listen: '0.0.0.0:80', ini: {memory_limit: 256M, display_errors: '0'}}",
+			"/php.so -d display_errors=0 -d memory_limit=256M -S 0.0.0.0:80 -t /app /app/router.php", nil,
+			"",
+		},
+		{
+			"script without main",
+			"{args: [--verbose]}",
+			"", nil,
+			"'main' must be provided in script mode",
+		},
+		{
+			"server without docroot",
+			"{mode: server}",
+			"", nil,
+			"'docroot' must be provided in server mode",
+		},
+		{
+			"unknown mode",
+			"{mode: fpm, main: /app/index.php}",
+			"", nil,
+			"unknown mode 'fpm', use one of script\\|server",
+		},
+	}
+	checkBootCmds(c, "php", cases)
+}
+
+func (s *testingRuntimeSuite) TestErlangBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"release",
+			"{release: /myapp, version: 0.1.0}",
+			"/usr/lib64/erlang/bin/erlexec -boot /myapp/releases/0.1.0/start -config /myapp/releases/0.1.0/sys -noshell -noinput",
+			[]string{"--env=ROOTDIR?=/myapp"},
+			"",
+		},
+		{
+			"distributed node",
+			"{release: /myapp, version: 0.1.0, name: myapp@10.0.0.1, cookie: secret, vmargs: [+K true]}",
+			"/usr/lib64/erlang/bin/erlexec -boot /myapp/releases/0.1.0/start -config /myapp/releases/0.1.0/sys -name myapp@10.0.0.1 -setcookie secret +K true -noshell -noinput",
+			[]string{"--env=ROOTDIR?=/myapp"},
+			"",
+		},
+		{
+			"short node name",
+			"{release: /myapp, version: 0.1.0, name: myapp}",
+			"/usr/lib64/erlang/bin/erlexec -boot /myapp/releases/0.1.0/start -config /myapp/releases/0.1.0/sys -sname myapp -noshell -noinput",
+			[]string{"--env=ROOTDIR?=/myapp"},
+			"",
+		},
+		{
+			"missing version",
+			"{release: /myapp}",
+			"", nil,
+			"'version' must be provided",
+		},
+		{
+			"cookie without name",
+			"{release: /myapp, version: 0.1.0, cookie: secret}",
+			"", nil,
+			"'cookie' requires node 'name' to be provided",
+		},
+	}
+	checkBootCmds(c, "erlang", cases)
+}
+
+func (s *testingRuntimeSuite) TestMultiCommandBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"parallel sidecar",
+			"{bootcmd: /app.so, commands: [{cmd: /agent.so --port=9100}]}",
+			"/agent.so --port=9100 & /app.so", nil,
+			"",
+		},
+		{
+			"all modes with env",
+			"{bootcmd: /app.so, env: {PORT: '80'}, commands: [" +
+				"{cmd: /migrate.so, mode: sequential}, " +
+				"{cmd: /agent.so, mode: detached, env: {INTERVAL: '10'}}]}",
+			"/migrate.so ; --env=INTERVAL=10 /agent.so &! --env=PORT?=80 /app.so", nil,
+			"",
+		},
+		{
+			"missing cmd",
+			"{bootcmd: /app.so, commands: [{mode: parallel}]}",
+			"", nil,
+			"'cmd' must be provided for command #0",
+		},
+		{
+			"unknown mode",
+			"{bootcmd: /app.so, commands: [{cmd: /agent.so, mode: forked}]}",
+			"", nil,
+			"unknown mode 'forked' of command #0, use one of sequential\\|parallel\\|detached",
+		},
+		{
+			"spaces in command env",
+			"{bootcmd: /app.so, commands: [{cmd: /agent.so, env: {NAME: 'a b'}}]}",
+			"\"--env=NAME=a b\" /agent.so & /app.so", nil,
+			"",
+		},
+		{
+			"spaces in command env key",
+			"{bootcmd: /app.so, commands: [{cmd: /agent.so, env: {'MY NAME': 'a'}}]}",
+			"", nil,
+			"invalid env key: 'MY NAME' of command #0",
+		},
+	}
+	checkBootCmds(c, "native", cases)
+}
+
+func (s *testingRuntimeSuite) TestHooks(c *C) {
+	cases := []bootCmdCase{
+		{
+			"pre boot only",
+			"{bootcmd: /app.so, hooks: {pre_boot: /tools/mkdir.so /data}}",
+			"runscript /run/default.pre_boot ; /app.so", nil,
+			"",
+		},
+		{
+			"both hooks after env",
+			"{bootcmd: /app.so, env: {DIR: /data}, hooks: {pre_boot: [/a.so, /b.so], post_boot: [/c.so]}}",
+			"--env=DIR?=/data runscript /run/default.pre_boot ; /app.so ; runscript /run/default.post_boot", nil,
+			"",
+		},
+		{
+			"empty command",
+			"{bootcmd: /app.so, hooks: {post_boot: [/c.so, ' ']}}",
+			"", nil,
+			"empty command #1 of 'post_boot' hook",
+		},
+	}
+	checkBootCmds(c, "native", cases)
+}
+
+func (s *testingRuntimeSuite) TestHooksWriteScripts(c *C) {
+	runDir := c.MkDir()
+	hooks := runtime.Hooks{PreBoot: runtime.StringList{"/a.so --x", " /b.so "}}
+
+	// This is what we're testing here.
+	err := hooks.WriteScripts(runDir, "default")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(runDir, "default.pre_boot"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "/a.so --x ; /b.so")
+	_, err = os.Stat(filepath.Join(runDir, "default.post_boot"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *testingRuntimeSuite) TestBaseBootCmd(c *C) {
+	cases := []bootCmdCase{
+		{
+			"single base",
+			"{bootcmd: /app.so, base: openjdk8:default}",
+			"runscript /run/openjdk8-default & /app.so", nil,
+			"",
+		},
+		{
+			"multiple bases with env",
+			"{bootcmd: /app.so, env: {PORT: '80'}, base: [java:jvm, agent:monitoring]}",
+			"--env=PORT?=80 runscript /run/java-jvm & runscript /run/agent-monitoring & /app.so", nil,
+			"",
+		},
+		{
+			"last base as main command",
+			"{base: [agent:monitoring, app:server]}",
+			"runscript /run/agent-monitoring & runscript /run/app-server", nil,
+			"",
+		},
+		{
+			"neither bootcmd nor base",
+			"{env: {PORT: '80'}}",
+			"", nil,
+			"'bootcmd' or 'base' must be provided",
+		},
+		{
+			"missing config set",
+			"{bootcmd: /app.so, base: [agent]}",
+			"", nil,
+			"invalid base 'agent', expected <package>:<config_set>",
+		},
+	}
+	checkBootCmds(c, "native", cases)
+}
+
+func (s *testingRuntimeSuite) TestSupervision(c *C) {
+	m := []struct {
+		comment  string
+		yaml     string
+		expected runtime.Supervision
+		err      string
+	}{
+		{
+			"no supervision",
+			"{bootcmd: /app.so}",
+			runtime.Supervision{},
+			"",
+		},
+		{
+			"http health check with restart",
+			"{bootcmd: /app.so, restart_policy: on-failure, healthcheck: {type: http, address: 'localhost:8000', path: /health, interval: 5s}}",
+			runtime.Supervision{
+				HealthCheck: &runtime.HealthCheck{
+					Type: "http", Address: "localhost:8000", Path: "/health", Interval: "5s",
+				},
+				RestartPolicy: runtime.RestartOnFailure,
+			},
+			"",
+		},
+		{
+			"unknown restart policy",
+			"{bootcmd: /app.so, restart_policy: sometimes}",
+			runtime.Supervision{},
+			"unknown restart_policy 'sometimes', use one of never\\|on-failure\\|always",
+		},
+		{
+			"restart limit",
+			"{bootcmd: /app.so, restart_policy: always, max_restarts: 10}",
+			runtime.Supervision{RestartPolicy: runtime.RestartAlways, MaxRestarts: 10},
+			"",
+		},
+		{
+			"negative restart limit",
+			"{bootcmd: /app.so, restart_policy: always, max_restarts: -1}",
+			runtime.Supervision{},
+			"max_restarts must not be negative",
+		},
+		{
+			"unknown health check type",
+			"{bootcmd: /app.so, healthcheck: {type: udp, address: 'localhost:53'}}",
+			runtime.Supervision{},
+			"unknown healthcheck type 'udp', use one of tcp\\|http",
+		},
+		{
+			"address without port",
+			"{bootcmd: /app.so, healthcheck: {type: tcp, address: localhost}}",
+			runtime.Supervision{},
+			"invalid healthcheck address 'localhost': .*",
+		},
+		{
+			"invalid interval",
+			"{bootcmd: /app.so, healthcheck: {type: tcp, address: 'localhost:80', interval: often}}",
+			runtime.Supervision{},
+			"invalid healthcheck duration 'often'",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		rt := parseConfigSet(c, "native", args.yaml)
+
+		// This is what we're testing here.
+		err := rt.Validate()
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(rt.GetSupervision(), DeepEquals, args.expected)
+		c.Check(rt.GetSupervision().IsEmpty(), Equals, args.expected.HealthCheck == nil && args.expected.RestartPolicy == "")
+	}
+}
+
+func (s *testingRuntimeSuite) TestHealthCheckProbe(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	address := l.Addr().String()
+
+	h := &runtime.HealthCheck{Type: "tcp", Address: address}
+	c.Check(h.Probe(), IsNil)
+
+	l.Close()
+	c.Check(h.Probe(), NotNil)
+}
+
+func (s *testingRuntimeSuite) TestResourcesApply(c *C) {
+	m := []struct {
+		comment          string
+		resources        runtime.Resources
+		config           runtime.RunConfig
+		expectedMemory   string
+		expectedCpus     int
+		expectedWarnings []string
+	}{
+		{
+			"nothing declared",
+			runtime.Resources{},
+			runtime.RunConfig{Memory: "2G", Cpus: 4},
+			"2G", 4, nil,
+		},
+		{
+			"declared resources are used by default",
+			runtime.Resources{Memory: "512M", Cpus: 1},
+			runtime.RunConfig{},
+			"512M", 1, nil,
+		},
+		{
+			"given resources above minimums",
+			runtime.Resources{Memory: "512M", Cpus: 1},
+			runtime.RunConfig{Memory: "1G", Cpus: 2},
+			"1G", 2, nil,
+		},
+		{
+			"given resources below minimums",
+			runtime.Resources{Memory: "2G", Cpus: 4},
+			runtime.RunConfig{Memory: "1G", Cpus: 2},
+			"1G", 2, []string{
+				"memory 1G is less than 2G required by the application",
+				"2 CPUs is less than 4 required by the application",
+			},
+		},
+		{
+			"ports not forwarded",
+			runtime.Resources{Ports: []int{8000, 9000}},
+			runtime.RunConfig{Networking: "nat", NatRules: []nat.Rule{{HostPort: "8080", GuestPort: "8000"}}},
+			"", 0, []string{
+				"port 9000 of the application is not forwarded, use --publish <host-port>:9000",
+			},
+		},
+		{
+			"ports published in run.yaml",
+			runtime.Resources{Ports: []int{8000}, Publish: []string{"8080:8000"}},
+			runtime.RunConfig{Networking: "nat"},
+			"", 0, nil,
+		},
+		{
+			"ports with bridged networking",
+			runtime.Resources{Ports: []int{8000}},
+			runtime.RunConfig{Networking: "bridge"},
+			"", 0, nil,
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		config := args.config
+		warnings := args.resources.Apply(&config)
+
+		// Expectations.
+		c.Check(config.Memory, Equals, args.expectedMemory)
+		c.Check(config.Cpus, Equals, args.expectedCpus)
+		c.Check(warnings, DeepEquals, args.expectedWarnings)
+	}
+}
+
+func (s *testingRuntimeSuite) TestOverlays(c *C) {
+	m := []struct {
+		comment     string
+		configSet   string
+		platform    runtime.Platform
+		expectedCmd string
+		expectedEnv []string
+		err         string
+	}{
+		{
+			"no overlays",
+			"{bootcmd: /app.so}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "x86_64"},
+			"/app.so", []string{},
+			"",
+		},
+		{
+			"matching overlay replaces bootcmd",
+			"{bootcmd: /app.so, overlays: [{when: hypervisor=vbox, bootcmd: /app-vbox.so}]}",
+			runtime.Platform{Hypervisor: "vbox", Arch: "x86_64"},
+			"/app-vbox.so", []string{},
+			"",
+		},
+		{
+			"non-matching overlay is ignored",
+			"{bootcmd: /app.so, overlays: [{when: 'hypervisor=qemu,arch=aarch64', bootcmd: /app-arm.so}]}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "x86_64"},
+			"/app.so", []string{},
+			"",
+		},
+		{
+			"env is merged",
+			"{bootcmd: /app.so, env: {PORT: '80', MODE: fast}, overlays: [" +
+				"{when: hypervisor=qemu, env: {MODE: slow}}, " +
+				"{when: arch=aarch64, env: {ARCH: arm}}]}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "aarch64"},
+			"/app.so", []string{"--env=PORT?=80", "--env=MODE?=slow", "--env=ARCH?=arm"},
+			"",
+		},
+		{
+			"missing condition",
+			"{bootcmd: /app.so, overlays: [{bootcmd: /other.so}]}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "x86_64"},
+			"", nil,
+			".*'when' must be provided for overlay #0",
+		},
+		{
+			"unknown condition key",
+			"{bootcmd: /app.so, overlays: [{when: os=linux, bootcmd: /other.so}]}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "x86_64"},
+			"", nil,
+			".*overlay #0: unknown condition key 'os', use one of hypervisor\\|arch\\|profile",
+		},
+		{
+			"profile overlay",
+			"{bootcmd: /app.so, overlays: [{when: profile=dev, bootcmd: /app-debug.so}]}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "x86_64", Profile: "dev"},
+			"/app-debug.so", []string{},
+			"",
+		},
+		{
+			"selected profile is merged last",
+			"{bootcmd: /app.so, env: {LOG: info}, " +
+				"overlays: [{when: hypervisor=qemu, env: {LOG: warn}}], " +
+				"profiles: {dev: {env: {LOG: debug}}, prod: {memory: 2G}}}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "x86_64", Profile: "dev"},
+			"/app.so", []string{"--env=LOG?=debug"},
+			"",
+		},
+		{
+			"profiles without selected profile",
+			"{bootcmd: /app.so, env: {LOG: info}, profiles: {dev: {env: {LOG: debug}}}}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "x86_64"},
+			"/app.so", []string{"--env=LOG?=info"},
+			"",
+		},
+		{
+			"invalid profiles",
+			"{bootcmd: /app.so, profiles: [dev]}",
+			runtime.Platform{Hypervisor: "qemu", Arch: "x86_64"},
+			"", nil,
+			".*'profiles' must be a map",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		cmdConfig, err := runtime.ParsePackageRunManifestDataFor([]byte(
+			"runtime: native\nconfig_set:\n  default: "+args.configSet+"\n"), args.platform, runtime.Values{})
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		rt := cmdConfig.ConfigSets["default"]
+		c.Assert(rt.Validate(), IsNil)
+		bootCmd, err := rt.GetBootCmd()
+		c.Assert(err, IsNil)
+		c.Check(bootCmd, BootCmdEquals, args.expectedCmd, args.expectedEnv)
+	}
+}
+
+func (s *testingRuntimeSuite) TestDefinesProfile(c *C) {
+	// This is what we're testing here.
+	cmdConfig, err := runtime.ParsePackageRunManifestDataFor([]byte(
+		"runtime: native\nconfig_set:\n"+
+			"  default: {bootcmd: /app.so, profiles: {dev: {env: {LOG: debug}}}}\n"+
+			"  other: {bootcmd: /app.so, overlays: [{when: 'hypervisor=qemu,profile=prod', bootcmd: /other.so}]}\n"),
+		runtime.Platform{Hypervisor: "qemu", Arch: "x86_64"}, runtime.Values{})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(cmdConfig.DefinesProfile("dev"), Equals, true)
+	c.Check(cmdConfig.DefinesProfile("prod"), Equals, true)
+	c.Check(cmdConfig.DefinesProfile("test"), Equals, false)
+}
+
+func (s *testingRuntimeSuite) TestValuesExpand(c *C) {
+	os.Setenv("CAPSTAN_TEST_HOST", "host.example.com")
+	os.Setenv("CAPSTAN_TEST_EMPTY", "")
+	defer os.Unsetenv("CAPSTAN_TEST_HOST")
+	defer os.Unsetenv("CAPSTAN_TEST_EMPTY")
+
+	values := runtime.Values{"PORT": "8000", "CAPSTAN_TEST_HOST": "ignored"}
+
+	m := []struct {
+		comment  string
+		input    string
+		expected string
+		err      string
+	}{
+		{"no variables", "/app.so --port=80", "/app.so --port=80", ""},
+		{"value", "--port=${PORT}", "--port=8000", ""},
+		{"host environment takes precedence", "${CAPSTAN_TEST_HOST}:${PORT}", "host.example.com:8000", ""},
+		{"default for unset variable", "${CAPSTAN_TEST_UNSET:-info}", "info", ""},
+		{"default for empty variable", "${CAPSTAN_TEST_EMPTY:-info}", "info", ""},
+		{"default not used", "${PORT:-80}", "8000", ""},
+		{"escaped dollar", "$$HOME ${PORT}", "$HOME 8000", ""},
+		{"bare variable untouched", "$PORT", "$PORT", ""},
+		{"undefined variable", "${CAPSTAN_TEST_UNSET} ${PORT}", "", "undefined variable: CAPSTAN_TEST_UNSET"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		res, err := values.Expand(args.input)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(res, Equals, args.expected)
+	}
+}
+
+func (s *testingRuntimeSuite) TestParsePackageRunManifestWithValues(c *C) {
+	tmp, _ := ioutil.TempDir("", "pkg")
+	defer os.RemoveAll(tmp)
+	os.MkdirAll(filepath.Join(tmp, "meta"), 0755)
+	ioutil.WriteFile(filepath.Join(tmp, "meta", "run.yaml"), []byte(
+		"runtime: native\n"+
+			"config_set:\n"+
+			"  default:\n"+
+			"    bootcmd: /app.so --port=${PORT} --log=${LOG_LEVEL:-info}\n"+
+			"    env:\n"+
+			"      # Comments may mention ${UNDEFINED} safely\n"+
+			"      ENDPOINT: ${ENDPOINT}\n"+
+			"      VERSION: ${VERSION}\n"+
+			"      VERBOSE: ${VERBOSE}\n"+
+			"    cpus: ${CPUS}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(tmp, "meta", "values.yaml"), []byte(
+		"PORT: 8000\nENDPOINT: api.example.com\nVERSION: 1.10\nVERBOSE: yes\nCPUS: 2\n"), 0644)
+
+	// This is what we're testing here.
+	cmdConfig, err := runtime.ParsePackageRunManifest(tmp)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	bootCmd, err := cmdConfig.ConfigSets["default"].GetBootCmd()
+	c.Assert(err, IsNil)
+	c.Check(bootCmd, BootCmdEquals, "/app.so --port=8000 --log=info",
+		[]string{"--env=ENDPOINT?=api.example.com", "--env=VERSION?=1.10", "--env=VERBOSE?=yes"})
+	c.Check(cmdConfig.ConfigSets["default"].GetResources().Cpus, Equals, 2)
+}
+
+func (s *testingRuntimeSuite) TestEnvFile(c *C) {
+	m := []struct {
+		comment     string
+		envFile     string
+		expectedEnv []string
+		err         string
+	}{
+		{
+			"single env file",
+			"env_file: common.env",
+			[]string{"--env=HOST?=common", "--env=PORT?=80", "--env=MODE?=debug"},
+			"",
+		},
+		{
+			"later env file and env take precedence",
+			"env_file: [common.env, prod.env]",
+			[]string{"--env=HOST?=prod", "--env=PORT?=80", "--env=MODE?=debug"},
+			"",
+		},
+		{
+			"missing env file",
+			"env_file: missing.env",
+			nil,
+			"failed to load env_file for configset 'default': .*missing.env.*",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		tmp, _ := ioutil.TempDir("", "pkg")
+		defer os.RemoveAll(tmp)
+		os.MkdirAll(filepath.Join(tmp, "meta"), 0755)
+		ioutil.WriteFile(filepath.Join(tmp, "common.env"), []byte("HOST=common\nPORT=8000\n"), 0644)
+		ioutil.WriteFile(filepath.Join(tmp, "prod.env"), []byte("HOST=prod\n"), 0644)
+		ioutil.WriteFile(filepath.Join(tmp, "meta", "run.yaml"), []byte(
+			"runtime: native\n"+
+				"config_set:\n"+
+				"  default:\n"+
+				"    bootcmd: /app.so\n"+
+				"    env: {PORT: '80', MODE: debug}\n"+
+				"    "+args.envFile+"\n"), 0644)
+
+		// This is what we're testing here.
+		cmdConfig, err := runtime.ParsePackageRunManifest(tmp)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		bootCmd, err := cmdConfig.ConfigSets["default"].GetBootCmd()
+		c.Assert(err, IsNil)
+		c.Check(bootCmd, BootCmdEquals, "/app.so", args.expectedEnv)
+	}
+}
+
+func (s *testingRuntimeSuite) TestSecrets(c *C) {
+	tmp, _ := ioutil.TempDir("", "pkg")
+	defer os.RemoveAll(tmp)
+	ioutil.WriteFile(filepath.Join(tmp, "password"), []byte("s3cret\n"), 0600)
+	os.Setenv("CAPSTAN_TEST_TOKEN", "t0ken")
+	defer os.Unsetenv("CAPSTAN_TEST_TOKEN")
+
+	m := []struct {
+		comment     string
+		configSet   string
+		expected    map[string]string
+		expectedCmd string
+		err         string
+	}{
+		{
+			"all sources",
+			"{bootcmd: /app.so, secrets: {PASSWORD: {file: password}, TOKEN: {env: CAPSTAN_TEST_TOKEN}, KEY: {command: echo k3y}}}",
+			map[string]string{"PASSWORD": "s3cret", "TOKEN": "t0ken", "KEY": "k3y"},
+			"/app.so",
+			"",
+		},
+		{
+			"no source",
+			"{bootcmd: /app.so, secrets: {PASSWORD: {}}}",
+			nil, "",
+			"exactly one of 'file', 'env' or 'command' must be provided for secret 'PASSWORD'",
+		},
+		{
+			"two sources",
+			"{bootcmd: /app.so, secrets: {PASSWORD: {file: password, env: PASSWORD}}}",
+			nil, "",
+			"exactly one of 'file', 'env' or 'command' must be provided for secret 'PASSWORD'",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		rt := parseConfigSet(c, "native", args.configSet)
+
+		// This is what we're testing here.
+		err := rt.Validate()
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		values, err := rt.GetSecrets().Absolute(tmp).Resolve()
+		c.Assert(err, IsNil)
+		c.Check(values, DeepEquals, args.expected)
+		// Secrets are never part of the boot command.
+		bootCmd, err := rt.GetBootCmd()
+		c.Assert(err, IsNil)
+		c.Check(bootCmd, Equals, args.expectedCmd)
+	}
+}
+
+func (s *testingRuntimeSuite) TestSecretsResolveErrors(c *C) {
+	m := []struct {
+		comment string
+		secrets runtime.Secrets
+		err     string
+	}{
+		{
+			"missing environment variable",
+			runtime.Secrets{"TOKEN": {Env: "CAPSTAN_TEST_UNSET"}},
+			"failed to read secret 'TOKEN': environment variable CAPSTAN_TEST_UNSET is not set",
+		},
+		{
+			"failing command",
+			runtime.Secrets{"KEY": {Command: "exit 1"}},
+			"failed to read secret 'KEY': exit status 1",
+		},
+		{
+			"value with newlines",
+			runtime.Secrets{"KEY": {Command: "printf 'a\\nb'"}},
+			"failed to read secret 'KEY': newlines not allowed in value",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		_, err := args.secrets.Resolve()
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.err)
+	}
+}
+
+func (s *testingRuntimeSuite) TestForceEnv(c *C) {
+	m := []struct {
+		comment     string
+		cmd         string
+		env         map[string]string
+		expectedCmd string
+		expectedEnv []string
+	}{
+		{
+			"plain command",
+			"/node server.js", map[string]string{"PORT": "9000"},
+			"/node server.js", []string{"--env=PORT=9000"},
+		},
+		{
+			"config set script",
+			"runscript /run/default", map[string]string{"PORT": "9000", "HOSTNAME": "example.com"},
+			"runscript /run/default", []string{"--env=PORT=9000", "--env=HOSTNAME=example.com"},
+		},
+		{
+			"previously forced variable is replaced",
+			"--env=PORT=8000 --env=MODE=fast /node server.js", map[string]string{"PORT": "9000"},
+			"/node server.js", []string{"--env=PORT=9000", "--env=MODE=fast"},
+		},
+		{
+			"soft variables are kept",
+			"--env=PORT?=8000 /node server.js", map[string]string{"PORT": "9000"},
+			"/node server.js", []string{"--env=PORT=9000", "--env=PORT?=8000"},
+		},
+		{
+			"quoted variables",
+			`"--env=JVM_ARGS=-Xmx1g -Xms512m" "--env=MSG=a \" b" /node server.js`, map[string]string{"JVM_ARGS": "-Xmx2g -Xms1g"},
+			"/node server.js", []string{`"--env=JVM_ARGS=-Xmx2g -Xms1g"`, `"--env=MSG=a \" b"`},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		cmd, err := runtime.ForceEnv(args.cmd, args.env)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(cmd, BootCmdEquals, args.expectedCmd, args.expectedEnv)
+	}
+}
+
+func (s *testingRuntimeSuite) TestBootCmdWithArgs(c *C) {
+	m := []struct {
+		comment     string
+		runtime     string
+		configSet   string
+		args        []string
+		expectedCmd string
+	}{
+		{
+			"native",
+			"native", "{bootcmd: /app.so -v}", []string{"--port=80", "x"},
+			"/app.so -v --port=80 x",
+		},
+		{
+			"native without arguments",
+			"native", "{bootcmd: /app.so -v}", nil,
+			"/app.so -v",
+		},
+		{
+			"node",
+			"node", "{main: /server.js}", []string{"--debug"},
+			"node /server.js --debug",
+		},
+		{
+			"java",
+			"java", "{main: main.Hello, classpath: [/app], args: [a], jvmargs: [Xmx512m]}", []string{"b"},
+			"java.so -Xmx512m -cp /app main.Hello a b",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		rt, ok := parseConfigSet(c, args.runtime, args.configSet).(runtime.ArgsRuntime)
+		c.Assert(ok, Equals, true)
+
+		// This is what we're testing here.
+		bootCmd, err := rt.GetBootCmdWithArgs(args.args)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(bootCmd, Equals, args.expectedCmd)
+	}
+}
+
+func (s *testingRuntimeSuite) TestReadOnlyRootProblems(c *C) {
+	m := []struct {
+		comment  string
+		runYaml  string
+		problems []string
+	}{
+		{
+			"native",
+			"runtime: native\nconfig_set:\n  default:\n    bootcmd: /app.so\n",
+			nil,
+		},
+		{
+			"hooks",
+			"runtime: native\nconfig_set:\n  default:\n    bootcmd: /app.so\n    hooks:\n      pre_boot: mkdir /data\n",
+			[]string{"runs hooks, which can only write files to volumes"},
+		},
+		{
+			"java without volume",
+			"runtime: java\nconfig_set:\n  default:\n    main: Main\n",
+			[]string{"writes JVM performance data to /tmp, which needs a writable volume (e.g. of type tmpfs)"},
+		},
+		{
+			"java with tmpfs volume",
+			"runtime: java\nconfig_set:\n  default:\n    main: Main\n    volumes:\n      - {type: tmpfs, path: /tmp}\n",
+			nil,
+		},
+		{
+			"python requirements",
+			"runtime: python\nconfig_set:\n  default:\n    main: /app.py\n    requirements: requirements.txt\n" +
+				"    requirements_target: /app/vendor\n    volumes:\n      - {type: tmpfs, path: /app, readonly: true}\n",
+			[]string{"writes bytecode of requirements to /app/vendor, which needs a writable volume (e.g. of type tmpfs)"},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		cmdConf, err := runtime.ParsePackageRunManifestData([]byte(args.runYaml))
+		c.Assert(err, IsNil)
+
+		// This is what we're testing here.
+		problems := runtime.ReadOnlyRootProblems(cmdConf.ConfigSets["default"])
+
+		// Expectations.
+		c.Check(problems, DeepEquals, args.problems)
+	}
+}
+
+func (s *testingRuntimeSuite) TestValidatePackageRunManifest(c *C) {
+	m := []struct {
+		comment  string
+		runYaml  string
+		problems []string
+	}{
+		{
+			"valid",
+			"runtime: node\n" +
+				"config_set:\n" +
+				"  default:\n" +
+				"    main: /server.js\n" +
+				"    cpus: ${CPUS:-2}\n" +
+				"    overlays:\n" +
+				"      - when: arch=aarch64\n" +
+				"        memory: 2G\n",
+			nil,
+		},
+		{
+			"unknown keys",
+			"runtime: node\n" +
+				"config_set:\n" +
+				"  default:\n" +
+				"    mian: /server.js\n" +
+				"    healthcheck:\n" +
+				"      type: tcp\n" +
+				"      adress: localhost:8000\n" +
+				"configset_default: default\n",
+			[]string{
+				"line 8: configset_default: unknown key",
+				"line 7: config_set.default.healthcheck.adress: unknown key",
+				"line 4: config_set.default.mian: unknown key",
+				"line 3: config_set.default: 'main' must be provided",
+			},
+		},
+		{
+			"unknown keys in config set",
+			"runtime: node\n" +
+				"config_set:\n" +
+				"  default:\n" +
+				"    mian: /server.js\n" +
+				"    healthcheck:\n" +
+				"      type: tcp\n" +
+				"      adress: localhost:8000\n",
+			[]string{
+				"line 7: config_set.default.healthcheck.adress: unknown key",
+				"line 4: config_set.default.mian: unknown key",
+				"line 3: config_set.default: 'main' must be provided",
+			},
+		},
+		{
+			"type mismatches",
+			"runtime: node\n" +
+				"config_set:\n" +
+				"  default:\n" +
+				"    main: /server.js\n" +
+				"    cpus: two\n" +
+				"    env: [PORT]\n",
+			[]string{
+				"line 5: config_set.default.cpus: expected integer, got two",
+				"line 6: config_set.default.env: expected map, got \\[PORT\\]",
+			},
+		},
+		{
+			"missing required field",
+			"runtime: node\n" +
+				"config_set:\n" +
+				"  default:\n" +
+				"    env: {PORT: '80'}\n" +
+				"  other:\n" +
+				"    main: /server.js\n" +
+				"config_set_default: missing\n",
+			[]string{
+				"line 3: config_set.default: 'main' must be provided",
+				"line 7: config_set_default: config set 'missing' does not exist",
+			},
+		},
+		{
+			"unknown runtime",
+			"runtime: cobol\nconfig_set:\n  default:\n    main: /app\n",
+			[]string{
+				"line 1: runtime: unknown runtime, use one of .*",
+			},
+		},
+		{
+			"unknown runtime and no config sets",
+			"runtime: cobol\n",
+			[]string{
+				"line 1: runtime: unknown runtime, use one of .*",
+				"at least one config_set must be provided",
+			},
+		},
+		{
+			"format version",
+			"format_version: 1\nruntime: node\nconfig_set:\n  default:\n    main: /server.js\n",
+			nil,
+		},
+		{
+			"unsupported format version",
+			"format_version: 2\nruntime: node\nconfig_set:\n  default:\n    main: /server.js\n",
+			[]string{
+				"line 1: format_version: unsupported version 2, use one of \\[1\\]",
+			},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		tmp, _ := ioutil.TempDir("", "pkg")
+		defer os.RemoveAll(tmp)
+		os.MkdirAll(filepath.Join(tmp, "meta"), 0755)
+		ioutil.WriteFile(filepath.Join(tmp, "meta", "run.yaml"), []byte(args.runYaml), 0644)
+
+		// This is what we're testing here.
+		problems, err := runtime.ValidatePackageRunManifest(tmp)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Assert(problems, HasLen, len(args.problems), Commentf("%v", problems))
+		for j, p := range problems {
+			c.Check(p, ErrorMatches, args.problems[j])
+		}
+	}
+}
+
+func (s *testingRuntimeSuite) TestExternalRuntime(c *C) {
+	tmp, _ := ioutil.TempDir("", "runtimes")
+	defer os.RemoveAll(tmp)
+	ioutil.WriteFile(filepath.Join(tmp, "lua.yaml"), []byte(
+		"name: lua-test\n"+
+			"description: Run Lua application\n"+
+			"dependencies: [osv.lua]\n"+
+			"bootcmd: /lua.so ${flags} ${main} ${args} --path=$LUA_PATH ${HOME}\n"+
+			"fields:\n"+
+			"  main: {required: true, description: Lua script to run, example: /app.lua}\n"+
+			"  flags: {}\n"+
+			"  args: {}\n"), 0644)
+
+	// Register runtimes defined in the directory.
+	c.Assert(runtime.LoadRuntimeDefinitions(tmp), IsNil)
+	c.Check(runtime.LoadRuntimeDefinitions(tmp), ErrorMatches, ".*runtime 'lua-test' is already defined")
+	c.Check(runtime.RegisterRuntime(runtime.RuntimeDefinition{Name: "java", BootCmd: "java"}), ErrorMatches,
+		"runtime 'java' is already defined")
+	runtimes, err := runtime.AvailableRuntimes()
+	c.Assert(err, IsNil)
+	c.Check(runtimes, DeepEquals, append(append([]runtime.RuntimeType{}, runtime.SupportedRuntimes...), "lua-test"))
+	for _, rt := range runtime.SupportedRuntimes {
+		c.Check(rt, Not(Equals), runtime.RuntimeType("lua-test"))
+	}
+
+	c.Check(parseConfigSet(c, "lua-test", "{main: /app.lua}").GetDependencies(), DeepEquals, []string{"osv.lua"})
+
+	cases := []bootCmdCase{
+		{
+			"required field only",
+			"{main: /app.lua}",
+			"/lua.so /app.lua --path=$LUA_PATH ${HOME}", []string{},
+			"",
+		},
+		{
+			"all fields and env",
+			"{main: /app.lua, flags: -W, args: [a, 1], env: {PORT: '80'}}",
+			"/lua.so -W /app.lua a 1 --path=$LUA_PATH ${HOME}", []string{"--env=PORT?=80"},
+			"",
+		},
+		{
+			"missing required field",
+			"{args: [a]}",
+			"", nil,
+			"'main' must be provided",
+		},
+		{
+			"unknown field",
+			"{main: /app.lua, mian: /app.lua}",
+			"", nil,
+			"unknown field 'mian' of runtime 'lua-test'",
+		},
+	}
+	checkBootCmds(c, "lua-test", cases)
+}
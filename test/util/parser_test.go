@@ -8,6 +8,8 @@
 package util_test
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/mikelangelo-project/capstan/util"
@@ -46,10 +48,10 @@ func (s *testingParserSuite) TestParseEnvironmentList(c *C) {
 			"",
 		},
 		{
-			"invalid char (space) #1",
+			"value with spaces",
 			[]string{"NAME=my name"},
-			map[string]string{},
-			"failed to parse --env argument .*",
+			map[string]string{"NAME": "my name"},
+			"",
 		},
 		{
 			"invalid char (space) #2",
@@ -77,7 +79,7 @@ func (s *testingParserSuite) TestParseEnvironmentList(c *C) {
 		},
 		{
 			"one parameter ok, other not",
-			[]string{"PORT=8000", "ENDPOINT=i am invalid"},
+			[]string{"PORT=8000", "I AM=invalid"},
 			map[string]string{},
 			"failed to parse --env argument .*",
 		},
@@ -114,3 +116,56 @@ func (s *testingParserSuite) TestParseEnvironmentList(c *C) {
 		}
 	}
 }
+
+func (s *testingParserSuite) TestParseEnvFile(c *C) {
+	m := []struct {
+		comment     string
+		content     string
+		expectedRes map[string]string
+		err         string
+	}{
+		{
+			"comments and empty lines",
+			"# database\n\nDB_HOST=localhost\nDB_PORT=5432\n",
+			map[string]string{"DB_HOST": "localhost", "DB_PORT": "5432"},
+			"",
+		},
+		{
+			"export prefix and quotes",
+			"export MODE=production\nNAME=\"my app\"\nTOKEN='a=b'\n",
+			map[string]string{"MODE": "production", "NAME": "my app", "TOKEN": "a=b"},
+			"",
+		},
+		{
+			"empty value",
+			"EMPTY=\n",
+			map[string]string{"EMPTY": ""},
+			"",
+		},
+		{
+			"missing =",
+			"PORT=80\nHOST\n",
+			nil,
+			".*:2: missing =",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		f, _ := ioutil.TempFile("", "env")
+		f.WriteString(args.content)
+		f.Close()
+		defer os.Remove(f.Name())
+
+		// This is what we're testing here.
+		res, err := util.ParseEnvFile(f.Name())
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(res, DeepEquals, args.expectedRes)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// cloudInitVolumeLabel is the volume label that cloud-init looks for to find
+// the seed of its NoCloud data source.
+const cloudInitVolumeLabel = "cidata"
+
+// CloudInit contextualizes an instance through cloud-init of the guest, which
+// reads it from a seed ISO (NoCloud data source). UserData is the content of
+// the user-data file, an empty #cloud-config unless given. InstanceID and
+// Hostname are set from the instance unless given.
+type CloudInit struct {
+	InstanceID string   `yaml:"instanceid,omitempty"`
+	Hostname   string   `yaml:"hostname,omitempty"`
+	SSHKeys    []string `yaml:"sshkeys,omitempty"`
+	UserData   string   `yaml:"userdata,omitempty"`
+}
+
+// cloudInitMetaData is the meta-data file of the seed.
+type cloudInitMetaData struct {
+	InstanceID    string   `yaml:"instance-id"`
+	LocalHostname string   `yaml:"local-hostname,omitempty"`
+	PublicKeys    []string `yaml:"public-keys,omitempty"`
+}
+
+// MetaData returns content of the meta-data file of the seed.
+func (c CloudInit) MetaData() (string, error) {
+	data, err := yaml.Marshal(cloudInitMetaData{
+		InstanceID:    c.InstanceID,
+		LocalHostname: c.Hostname,
+		PublicKeys:    c.SSHKeys,
+	})
+	return string(data), err
+}
+
+// CreateCloudInitISO writes the seed ISO of cloud-init to isoPath,
+// replacing the existing one.
+func CreateCloudInitISO(c CloudInit, isoPath string) error {
+	tool, args, err := isoTool()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir("", "capstan-cloud-init")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	metaData, err := c.MetaData()
+	if err != nil {
+		return err
+	}
+	userData := c.UserData
+	if userData == "" {
+		userData = "#cloud-config\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "meta-data"), []byte(metaData), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "user-data"), []byte(userData), 0644); err != nil {
+		return err
+	}
+
+	os.Remove(isoPath)
+	args = append(args, "-o", isoPath, "-V", cloudInitVolumeLabel, "-R", "-J", tmp)
+	cmd := exec.Command(tool, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed to create %s: %s", tool, isoPath, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// isoTool returns the first available ISO authoring tool together with the
+// arguments that switch it to mkisofs compatible mode.
+func isoTool() (string, []string, error) {
+	if path, err := exec.LookPath("xorriso"); err == nil {
+		return path, []string{"-as", "mkisofs"}, nil
+	}
+	for _, tool := range []string{"genisoimage", "mkisofs"} {
+		if path, err := exec.LookPath(tool); err == nil {
+			return path, nil, nil
+		}
+	}
+	return "", nil, errors.New("creating ISO requires xorriso, genisoimage or mkisofs to be installed")
+}
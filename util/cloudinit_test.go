@@ -0,0 +1,39 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"testing"
+)
+
+func TestCloudInitMetaData(t *testing.T) {
+	m := []struct {
+		comment  string
+		ci       CloudInit
+		expected string
+	}{
+		{
+			"instance only",
+			CloudInit{InstanceID: "web-1"},
+			"instance-id: web-1\n",
+		},
+		{
+			"hostname and keys",
+			CloudInit{InstanceID: "web-1", Hostname: "web", SSHKeys: []string{"ssh-ed25519 AAAA user@host"}, UserData: "#cloud-config\n"},
+			"instance-id: web-1\nlocal-hostname: web\npublic-keys:\n- ssh-ed25519 AAAA user@host\n",
+		},
+	}
+	for _, args := range m {
+		metaData, err := args.ci.MetaData()
+		if err != nil {
+			t.Errorf("%s: %s", args.comment, err)
+		} else if metaData != args.expected {
+			t.Errorf("%s: expected %q, got %q", args.comment, args.expected, metaData)
+		}
+	}
+}
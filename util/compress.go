@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Compression formats supported for exported artifacts. Compression itself is
+// done by xz and zstd tools that have to be installed on the host.
+const (
+	CompressionNone = "none"
+	CompressionXz   = "xz"
+	CompressionZstd = "zstd"
+)
+
+var compressionMagic = map[string][]byte{
+	CompressionXz:   {0xfd, '7', 'z', 'X', 'Z', 0x00},
+	CompressionZstd: {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// CompressionExtension returns file extension for the given compression format.
+func CompressionExtension(format string) (string, error) {
+	switch format {
+	case CompressionNone, "":
+		return "", nil
+	case CompressionXz:
+		return ".xz", nil
+	case CompressionZstd:
+		return ".zst", nil
+	}
+	return "", fmt.Errorf("%s: unsupported compression, use one of none|xz|zstd", format)
+}
+
+// DetectCompression returns compression format of the file based on its magic
+// number or CompressionNone when the file is not compressed.
+func DetectCompression(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 6)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return CompressionNone, nil
+	}
+
+	for format, magic := range compressionMagic {
+		if bytes.HasPrefix(header[:n], magic) {
+			return format, nil
+		}
+	}
+	return CompressionNone, nil
+}
+
+// CompressFile writes compressed content of src into dst.
+func CompressFile(src, dst, format string) error {
+	if _, err := CompressionExtension(format); err != nil {
+		return err
+	}
+	if format == CompressionNone || format == "" {
+		return CopyLocalFile(dst, src)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Both tools use all available cores with -T0.
+	cmd := exec.Command(format, "-c", "-q", "-T0")
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to compress %s with %s: %s", src, format, err)
+	}
+	return nil
+}
+
+// decompressingReader streams the output of the decompression tool.
+type decompressingReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *decompressingReader) Close() error {
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+// OpenDecompressed opens the file that may be compressed with any of the
+// supported formats. The content is decompressed while being read.
+func OpenDecompressed(path string) (io.ReadCloser, error) {
+	format, err := DetectCompression(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == CompressionNone {
+		return os.Open(path)
+	}
+
+	cmd := exec.Command(format, "-d", "-c", "-q", path)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to decompress %s with %s: %s", path, format, err)
+	}
+	return &decompressingReader{stdout, cmd}, nil
+}
+
+// DecompressFile writes decompressed content of src into dst.
+func DecompressFile(src, dst string) error {
+	in, err := OpenDecompressed(src)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if closeErr := in.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to decompress %s: %s", src, err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressRoundtrip(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	content := bytes.Repeat([]byte("capstan"), 1000)
+	src := filepath.Join(tmp, "image.qcow2")
+	if err := ioutil.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{CompressionNone, CompressionXz, CompressionZstd} {
+		if format != CompressionNone {
+			if _, err := exec.LookPath(format); err != nil {
+				t.Logf("capstan: %s not installed, skipping", format)
+				continue
+			}
+		}
+
+		compressed := filepath.Join(tmp, "compressed."+format)
+		if err := CompressFile(src, compressed, format); err != nil {
+			t.Fatal(err)
+		}
+		if detected, _ := DetectCompression(compressed); detected != format {
+			t.Errorf("capstan: want %s compression, detected %s", format, detected)
+		}
+
+		decompressed := filepath.Join(tmp, "decompressed."+format)
+		if err := DecompressFile(compressed, decompressed); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := ioutil.ReadFile(decompressed); !bytes.Equal(data, content) {
+			t.Errorf("capstan: %s: decompressed content differs", format)
+		}
+	}
+}
+
+func TestCompressionExtension(t *testing.T) {
+	m := map[string]string{"none": "", "xz": ".xz", "zstd": ".zst"}
+	for format, expected := range m {
+		if ext, err := CompressionExtension(format); err != nil || ext != expected {
+			t.Errorf("capstan: %s: want %q, got %q (%v)", format, expected, ext, err)
+		}
+	}
+	if _, err := CompressionExtension("gzip"); err == nil {
+		t.Error("capstan: expected error for unsupported compression")
+	}
+}
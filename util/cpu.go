@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// cpuFeatureAliases maps names of CPU features used by QEMU to those that
+// Linux reports in /proc/cpuinfo.
+var cpuFeatureAliases = map[string]string{
+	"sse3": "pni",
+}
+
+// NormalizeCPUFeature returns the name of the CPU feature as reported in
+// /proc/cpuinfo, so that features can be given as QEMU names them too, e.g.
+// sse4.2 is sse4_2.
+func NormalizeCPUFeature(feature string) string {
+	feature = strings.ToLower(strings.TrimSpace(feature))
+	feature = strings.NewReplacer(".", "_", "-", "_").Replace(feature)
+	if alias, ok := cpuFeatureAliases[feature]; ok {
+		return alias
+	}
+	return feature
+}
+
+// ParseCPUFlags returns features listed in flags of the first processor in
+// the content of /proc/cpuinfo.
+func ParseCPUFlags(r io.Reader) map[string]bool {
+	features := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "flags" {
+			continue
+		}
+		for _, feature := range strings.Fields(parts[1]) {
+			features[feature] = true
+		}
+		break
+	}
+	return features
+}
+
+// HostCPUFeatures returns features of the host CPU. They are only known on
+// Linux, elsewhere an error is returned.
+func HostCPUFeatures() (map[string]bool, error) {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseCPUFlags(file), nil
+}
+
+// ImageCPUFeatures returns CPU features that the image requires.
+func (r *Repo) ImageCPUFeatures(image string) []string {
+	info, _ := r.imageInfo(image)
+	return info.CPUFeatures
+}
+
+// SetImageCPUFeatures records CPU features that the image requires in its
+// index.
+func (r *Repo) SetImageCPUFeatures(image string, features []string) error {
+	info, err := r.imageInfo(image)
+	if err != nil {
+		return err
+	}
+	info.CPUFeatures = features
+	value, err := yaml.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.RepoPath(), image, "index.yaml"), value, 0644)
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCPUFlags(t *testing.T) {
+	cpuinfo := "processor\t: 0\nmodel name\t: Intel(R) Xeon(R)\nflags\t\t: fpu pni sse4_2 x2apic aes\n\n" +
+		"processor\t: 1\nflags\t\t: fpu\n"
+	expected := map[string]bool{"fpu": true, "pni": true, "sse4_2": true, "x2apic": true, "aes": true}
+	if features := ParseCPUFlags(strings.NewReader(cpuinfo)); !reflect.DeepEqual(features, expected) {
+		t.Errorf("ParseCPUFlags() => %v, want %v", features, expected)
+	}
+}
+
+func TestNormalizeCPUFeature(t *testing.T) {
+	m := map[string]string{
+		"sse4.2":      "sse4_2",
+		" AES ":       "aes",
+		"sse3":        "pni",
+		"avx512-vnni": "avx512_vnni",
+	}
+	for feature, expected := range m {
+		if normalized := NormalizeCPUFeature(feature); normalized != expected {
+			t.Errorf("NormalizeCPUFeature(%q) => %q, want %q", feature, normalized, expected)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CredentialsFileName is the name of the file in Capstan root that holds
+// credentials of private repositories.
+const CredentialsFileName = "credentials.yaml"
+
+// RepositoryCredentials are credentials for the repository at the given URL.
+// Either bearer token or username and password are used.
+type RepositoryCredentials struct {
+	URL      string `yaml:"url"`
+	Token    string `yaml:"token,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+func (c RepositoryCredentials) IsEmpty() bool {
+	return c.Token == "" && c.Username == ""
+}
+
+// Apply sets the authorization header of the request.
+func (c RepositoryCredentials) Apply(req *http.Request) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// CapstanRoot returns the directory holding Capstan configuration and the
+// local repository.
+func CapstanRoot() string {
+	if root := os.Getenv("CAPSTAN_ROOT"); root != "" {
+		return root
+	}
+	return filepath.Join(HomePath(), "/.capstan/")
+}
+
+// ParseCredentials reads credentials of repositories from the given file.
+func ParseCredentials(path string) ([]RepositoryCredentials, error) {
+	var credentials []RepositoryCredentials
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return credentials, err
+	}
+
+	if err := yaml.Unmarshal(data, &credentials); err != nil {
+		return credentials, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	for i, c := range credentials {
+		if c.URL == "" {
+			return credentials, fmt.Errorf("%s: missing 'url' of entry #%d", path, i)
+		}
+		if c.Token != "" && c.Username != "" {
+			return credentials, fmt.Errorf("%s: both token and username given for %s", path, c.URL)
+		}
+	}
+	return credentials, nil
+}
+
+// CredentialsFor returns credentials for the given URL. Credentials of the
+// repository with the longest matching URL from the credentials file are
+// preferred. Otherwise credentials are taken from environment variables
+// CAPSTAN_REPO_TOKEN or CAPSTAN_REPO_USERNAME and CAPSTAN_REPO_PASSWORD, but
+// only for the repository given in CAPSTAN_REPO_URL.
+func CredentialsFor(target string) (RepositoryCredentials, error) {
+	var found RepositoryCredentials
+
+	path := filepath.Join(CapstanRoot(), CredentialsFileName)
+	credentials, err := ParseCredentials(path)
+	if err != nil && !os.IsNotExist(err) {
+		return found, err
+	}
+	for _, c := range credentials {
+		if urlMatches(c.URL, target) && len(c.URL) > len(found.URL) {
+			found = c
+		}
+	}
+	if !found.IsEmpty() {
+		return found, nil
+	}
+
+	found = RepositoryCredentials{URL: target}
+	if repoURL := os.Getenv("CAPSTAN_REPO_URL"); repoURL != "" && urlMatches(repoURL, target) {
+		found.Token = os.Getenv("CAPSTAN_REPO_TOKEN")
+		found.Username = os.Getenv("CAPSTAN_REPO_USERNAME")
+		found.Password = os.Getenv("CAPSTAN_REPO_PASSWORD")
+	}
+	return found, nil
+}
+
+// urlMatches tells whether the target URL is within the repository URL, i.e.
+// has the same scheme, host and port and its path is below the repository
+// path. Paths are compared by whole segments, so that credentials of
+// https://host/team are not sent to https://host/team-other.
+func urlMatches(repository, target string) bool {
+	r, err := url.Parse(repository)
+	if err != nil {
+		return false
+	}
+	t, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if !strings.EqualFold(r.Scheme, t.Scheme) || hostPort(r) != hostPort(t) {
+		return false
+	}
+
+	prefix := strings.TrimSuffix(r.EscapedPath(), "/")
+	path := t.EscapedPath()
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// hostPort returns lowercase host of the URL with explicit port.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return strings.ToLower(u.Hostname()) + ":" + port
+}
+
+// remoteGet requests the given URL of the remote repository, authorizing
+// with its credentials. Responses other than 200 OK are reported as errors.
+func remoteGet(url string) (*http.Response, error) {
+	return remoteGetRange(url, "", "")
+}
+
+// remoteGetRange requests the given byte range (e.g. bytes=0-1023) of the
+// file, or the entire file when the range is empty. With ifRange (a date or
+// an entity tag) the entire file is returned if it has changed since. Responses
+// other than 200 OK, 206 Partial Content and, for ranges, 416 Requested Range
+// Not Satisfiable are reported as errors.
+func remoteGetRange(url, byteRange, ifRange string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	credentials, err := CredentialsFor(url)
+	if err != nil {
+		return nil, err
+	}
+	credentials.Apply(req)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableCompression: true,
+			Proxy:              http.ProxyFromEnvironment,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		if byteRange != "" {
+			return resp, nil
+		}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		resp.Body.Close()
+		if credentials.IsEmpty() {
+			return nil, fmt.Errorf("%s: access denied (%s), add credentials of the repository to %s",
+				url, resp.Status, filepath.Join(CapstanRoot(), CredentialsFileName))
+		}
+		return nil, fmt.Errorf("%s: access denied (%s), check credentials of the repository", url, resp.Status)
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("%s: request failed: %s", url, resp.Status)
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/util"
+	. "gopkg.in/check.v1"
+)
+
+type credentialsSuite struct {
+	root string
+}
+
+var _ = Suite(&credentialsSuite{})
+
+func (s *credentialsSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+	os.Setenv("CAPSTAN_ROOT", s.root)
+	for _, env := range []string{"CAPSTAN_REPO_TOKEN", "CAPSTAN_REPO_USERNAME", "CAPSTAN_REPO_PASSWORD"} {
+		os.Unsetenv(env)
+	}
+}
+
+func (s *credentialsSuite) TearDownTest(c *C) {
+	os.Unsetenv("CAPSTAN_ROOT")
+	os.Unsetenv("CAPSTAN_REPO_TOKEN")
+	os.Unsetenv("CAPSTAN_REPO_URL")
+}
+
+func (s *credentialsSuite) writeCredentials(c *C, content string) {
+	err := ioutil.WriteFile(filepath.Join(s.root, util.CredentialsFileName), []byte(content), 0600)
+	c.Assert(err, IsNil)
+}
+
+func (s *credentialsSuite) TestCredentialsFor(c *C) {
+	s.writeCredentials(c, `
+- url: https://repo.example.com/
+  username: user
+  password: secret
+- url: https://repo.example.com/team/
+  token: abc
+`)
+	m := []struct {
+		comment  string
+		url      string
+		env      string
+		expected util.RepositoryCredentials
+	}{
+		{
+			"basic auth",
+			"https://repo.example.com/packages/osv.cli.mpm", "",
+			util.RepositoryCredentials{URL: "https://repo.example.com/", Username: "user", Password: "secret"},
+		},
+		{
+			"longest URL wins",
+			"https://repo.example.com/team/packages/osv.cli.mpm", "",
+			util.RepositoryCredentials{URL: "https://repo.example.com/team/", Token: "abc"},
+		},
+		{
+			"unknown repository",
+			"https://other.example.com/", "",
+			util.RepositoryCredentials{URL: "https://other.example.com/"},
+		},
+		{
+			"token from environment",
+			"https://other.example.com/packages/osv.cli.mpm", "xyz",
+			util.RepositoryCredentials{URL: "https://other.example.com/packages/osv.cli.mpm", Token: "xyz"},
+		},
+		{
+			"token from environment for another host",
+			"https://evil.example.com/", "xyz",
+			util.RepositoryCredentials{URL: "https://evil.example.com/"},
+		},
+		{
+			"host with longer name",
+			"https://repo.example.com.evil.org/packages/osv.cli.mpm", "",
+			util.RepositoryCredentials{URL: "https://repo.example.com.evil.org/packages/osv.cli.mpm"},
+		},
+		{
+			"host with user info",
+			"https://repo.example.com@evil.org/", "",
+			util.RepositoryCredentials{URL: "https://repo.example.com@evil.org/"},
+		},
+		{
+			"path matched on segment boundary",
+			"https://repo.example.com/team-other/osv.cli.mpm", "",
+			util.RepositoryCredentials{URL: "https://repo.example.com/", Username: "user", Password: "secret"},
+		},
+		{
+			"repository path itself",
+			"https://repo.example.com/team", "",
+			util.RepositoryCredentials{URL: "https://repo.example.com/team/", Token: "abc"},
+		},
+		{
+			"different scheme",
+			"http://repo.example.com/packages/osv.cli.mpm", "",
+			util.RepositoryCredentials{URL: "http://repo.example.com/packages/osv.cli.mpm"},
+		},
+		{
+			"different port",
+			"https://repo.example.com:8443/packages/osv.cli.mpm", "",
+			util.RepositoryCredentials{URL: "https://repo.example.com:8443/packages/osv.cli.mpm"},
+		},
+		{
+			"default port and case of host",
+			"https://REPO.example.com:443/packages/osv.cli.mpm", "",
+			util.RepositoryCredentials{URL: "https://repo.example.com/", Username: "user", Password: "secret"},
+		},
+	}
+	os.Setenv("CAPSTAN_REPO_URL", "https://other.example.com/")
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		os.Setenv("CAPSTAN_REPO_TOKEN", args.env)
+
+		// This is what we're testing here.
+		credentials, err := util.CredentialsFor(args.url)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(credentials, DeepEquals, args.expected)
+	}
+}
+
+func (s *credentialsSuite) TestParseCredentialsInvalid(c *C) {
+	s.writeCredentials(c, `
+- url: https://repo.example.com/
+  username: user
+  token: abc
+`)
+
+	// This is what we're testing here.
+	_, err := util.CredentialsFor("https://repo.example.com/")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, ".*both token and username given for https://repo.example.com/")
+}
+
+func (s *credentialsSuite) TestPrivateRepository(c *C) {
+	files := serveRepository(map[string]string{
+		"/packages/osv.cli.yaml": "name: osv.cli\ntitle: CLI\nauthor: a\n",
+		"/packages/osv.cli.mpm":  "cli",
+	})
+	defer files.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		resp, err := http.Get(files.URL + req.URL.Path)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		w.Write(data)
+	}))
+	defer server.Close()
+	repo := util.NewRepo(server.URL + "/")
+
+	// Without credentials access is denied.
+	_, err := util.IsRemotePackage(repo.URL, "osv.cli")
+	c.Check(err, ErrorMatches, ".*access denied \\(401 Unauthorized\\), add credentials of the repository to .*")
+
+	// This is what we're testing here.
+	s.writeCredentials(c, "- url: "+server.URL+"/\n  token: abc\n")
+	err = repo.DownloadPackage(repo.URL, "osv.cli")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(repo.PackageExists("osv.cli"), Equals, true)
+}
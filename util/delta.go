@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DeltaBlockSize is the size of blocks that files are split into for delta
+// updates.
+const DeltaBlockSize = 64 * 1024
+
+// BlockIndexSuffix is appended to the name of the file to get the name of
+// its block index.
+const BlockIndexSuffix = ".blocks"
+
+// BlockIndex lists SHA256 digests of consecutive blocks of a file. Blocks of
+// a newer version of the file that are already present in the cached copy
+// do not have to be downloaded again.
+type BlockIndex struct {
+	BlockSize int64    `yaml:"block_size"`
+	Size      int64    `yaml:"size"`
+	Blocks    []string `yaml:"blocks"`
+}
+
+// ComputeBlockIndex splits the file into blocks of DeltaBlockSize bytes and
+// returns their digests.
+func ComputeBlockIndex(path string) (BlockIndex, error) {
+	index := BlockIndex{BlockSize: DeltaBlockSize}
+	err := forEachBlock(path, DeltaBlockSize, func(offset int64, block []byte) {
+		index.Blocks = append(index.Blocks, fmt.Sprintf("%x", sha256.Sum256(block)))
+		index.Size = offset + int64(len(block))
+	})
+	return index, err
+}
+
+// WriteBlockIndex writes the block index of the file next to it, so that the
+// file can be updated with a delta once the repository is published.
+func WriteBlockIndex(path string) error {
+	index, err := ComputeBlockIndex(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+BlockIndexSuffix, data, 0644)
+}
+
+func forEachBlock(path string, blockSize int64, fn func(offset int64, block []byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	block := make([]byte, blockSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(file, block)
+		if n > 0 {
+			fn(offset, block[:n])
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fetchFile downloads the named file into destPath and returns checksum of
+// its content, which must match the expected checksum. When a cached copy of
+// the file already matches it, nothing is downloaded. When an older copy is
+// cached and the repository publishes block index of deltaName (the
+// uncompressed file), only blocks missing from the cached copy are
+// downloaded. Otherwise, or if the delta does not result in the expected
+// content, the entire file is downloaded. Cached copy is kept when the
+// downloaded file does not match.
+func (r *Repo) fetchFile(repo_url, destPath, name, deltaName, expected string) (string, error) {
+	cached := filepath.Join(destPath, deltaName)
+	if _, err := os.Stat(cached); err != nil || deltaName == "" {
+		return r.downloadVerifiedFile(repo_url, destPath, name, expected)
+	}
+
+	if expected != "" {
+		if checksum, err := FileChecksum(cached); err == nil && VerifyChecksum(deltaName, expected, checksum) == nil {
+			fmt.Printf("%s is up to date\n", deltaName)
+			return checksum, nil
+		}
+	}
+
+	checksum, err := r.downloadDelta(repo_url, cached, deltaName, expected)
+	if err != nil {
+		fmt.Printf("Delta update of %s not possible (%s), downloading entire file\n", deltaName, err)
+		return r.downloadVerifiedFile(repo_url, destPath, name, expected)
+	}
+	return checksum, nil
+}
+
+// downloadDelta updates the cached file to the version in the repository
+// using its block index and returns checksum of the updated file. Blocks
+// found anywhere in the cached file are reused, the rest are downloaded with
+// range requests. The cached file is only replaced when the updated one
+// matches the expected checksum.
+func (r *Repo) downloadDelta(repo_url, cached, name, expected string) (string, error) {
+	resp, err := remoteGet(repo_url + name + BlockIndexSuffix)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	var index BlockIndex
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return "", err
+	}
+	if index.BlockSize <= 0 || int64(len(index.Blocks)) != (index.Size+index.BlockSize-1)/index.BlockSize {
+		return "", fmt.Errorf("invalid block index")
+	}
+
+	// Offsets of blocks of the cached file by their digests.
+	local := make(map[string]int64)
+	err = forEachBlock(cached, index.BlockSize, func(offset int64, block []byte) {
+		digest := fmt.Sprintf("%x", sha256.Sum256(block))
+		if _, ok := local[digest]; !ok {
+			local[digest] = offset
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	source, err := os.Open(cached)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	output, err := ioutil.TempFile(filepath.Dir(cached), "delta")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	fmt.Printf("Downloading delta of %s...\n", name)
+	hash := sha256.New()
+	writer := io.MultiWriter(output, hash)
+	var downloaded int64
+	for i := 0; i < len(index.Blocks); {
+		offset := int64(i) * index.BlockSize
+		if localOffset, ok := local[index.Blocks[i]]; ok {
+			length := blockLength(index, i)
+			if _, err := io.Copy(writer, io.NewSectionReader(source, localOffset, length)); err != nil {
+				return "", err
+			}
+			i++
+			continue
+		}
+
+		// Download consecutive missing blocks with a single request.
+		j := i + 1
+		for j < len(index.Blocks) {
+			if _, ok := local[index.Blocks[j]]; ok {
+				break
+			}
+			j++
+		}
+		end := offset
+		for k := i; k < j; k++ {
+			end += blockLength(index, k)
+		}
+		if err := downloadRange(repo_url+name, offset, end, writer); err != nil {
+			return "", err
+		}
+		downloaded += end - offset
+		i = j
+	}
+
+	if err := output.Close(); err != nil {
+		return "", err
+	}
+	checksum := formatChecksum(hash.Sum(nil))
+	if err := verifyDownload(name, expected, checksum); err != nil {
+		return "", fmt.Errorf("unexpected content: %s", err)
+	}
+	if err := os.Rename(output.Name(), cached); err != nil {
+		return "", err
+	}
+	fmt.Printf("Downloaded %d of %d bytes of %s\n", downloaded, index.Size, name)
+	return checksum, nil
+}
+
+// blockLength returns the length of the i-th block, the last one may be
+// shorter.
+func blockLength(index BlockIndex, i int) int64 {
+	if rest := index.Size - int64(i)*index.BlockSize; rest < index.BlockSize {
+		return rest
+	}
+	return index.BlockSize
+}
+
+// downloadRange writes bytes [start, end) of the remote file to the writer.
+func downloadRange(url string, start, end int64, w io.Writer) error {
+	resp, err := remoteGetRange(url, fmt.Sprintf("bytes=%d-%d", start, end-1), "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("repository does not support range requests")
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+	if n != end-start {
+		return fmt.Errorf("short range response, expected %d bytes, got %d", end-start, n)
+	}
+	return nil
+}
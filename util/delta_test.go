@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+type deltaSuite struct{}
+
+var _ = Suite(&deltaSuite{})
+
+func (*deltaSuite) TestComputeBlockIndex(c *C) {
+	path := filepath.Join(c.MkDir(), "file")
+	c.Assert(ioutil.WriteFile(path, bytes.Repeat([]byte("a"), util.DeltaBlockSize+10), 0644), IsNil)
+
+	// This is what we're testing here.
+	index, err := util.ComputeBlockIndex(path)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(index.Size, Equals, int64(util.DeltaBlockSize+10))
+	c.Check(index.Blocks, HasLen, 2)
+}
+
+func (*deltaSuite) TestDownloadPackageDelta(c *C) {
+	repo := util.NewRepo(util.DefaultRepositoryUrl)
+	repo.Path = c.MkDir()
+
+	// The cached package differs from the new one in its second block only.
+	block := func(b string) []byte { return bytes.Repeat([]byte(b), util.DeltaBlockSize) }
+	cached := bytes.Join([][]byte{block("a"), block("b"), block("c"), []byte("tail")}, nil)
+	updated := bytes.Join([][]byte{block("a"), block("x"), block("c"), []byte("tail")}, nil)
+
+	c.Assert(os.MkdirAll(repo.PackagesPath(), 0775), IsNil)
+	c.Assert(ioutil.WriteFile(repo.PackagePath("osv.cli"), cached, 0644), IsNil)
+
+	published := filepath.Join(c.MkDir(), "osv.cli.mpm")
+	c.Assert(ioutil.WriteFile(published, updated, 0644), IsNil)
+	c.Assert(util.WriteBlockIndex(published), IsNil)
+	blocks, err := ioutil.ReadFile(published + util.BlockIndexSuffix)
+	c.Assert(err, IsNil)
+	checksum, err := util.FileChecksum(published)
+	c.Assert(err, IsNil)
+	manifest, err := yaml.Marshal(map[string]string{"name": "osv.cli", "title": "CLI", "author": "a", "checksum": checksum})
+	c.Assert(err, IsNil)
+
+	files := map[string][]byte{
+		"/packages/osv.cli.yaml":       manifest,
+		"/packages/osv.cli.mpm":        updated,
+		"/packages/osv.cli.mpm.blocks": blocks,
+	}
+	var served int64
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if req.URL.Path == "/" {
+			listing := "<ListBucketResult>"
+			for path := range files {
+				listing += "<Contents><Key>" + strings.TrimPrefix(path, "/") + "</Key></Contents>"
+			}
+			w.Write([]byte(listing + "</ListBucketResult>"))
+			return
+		}
+		content, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if strings.HasSuffix(req.URL.Path, ".mpm") {
+			counter := &countingWriter{ResponseWriter: w}
+			http.ServeContent(counter, req, req.URL.Path, time.Time{}, bytes.NewReader(content))
+			atomic.AddInt64(&served, counter.n)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	// This is what we're testing here.
+	err = repo.DownloadPackage(server.URL+"/", "osv.cli")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(repo.PackagePath("osv.cli"))
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(data, updated), Equals, true)
+	c.Check(atomic.LoadInt64(&served), Equals, int64(util.DeltaBlockSize))
+
+	// Cached package is kept when neither the delta nor the entire file
+	// matches the published checksum.
+	c.Assert(ioutil.WriteFile(repo.PackagePath("osv.cli"), cached, 0644), IsNil)
+	mutex.Lock()
+	files["/packages/osv.cli.mpm"] = bytes.Join([][]byte{block("a"), block("y"), block("c"), []byte("tail")}, nil)
+	mutex.Unlock()
+	err = repo.DownloadPackage(server.URL+"/", "osv.cli")
+	c.Check(err, ErrorMatches, "osv.cli.mpm: checksum mismatch.*")
+	data, err = ioutil.ReadFile(repo.PackagePath("osv.cli"))
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(data, cached), Equals, true)
+}
+
+// countingWriter counts bytes of content served with successful responses.
+type countingWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if w.status < 300 {
+		w.n += int64(n)
+	}
+	return n, err
+}
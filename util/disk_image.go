@@ -0,0 +1,395 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/image"
+	"github.com/mikelangelo-project/capstan/image/qcow2"
+)
+
+// errUnsupportedImage is returned for images that cannot be accessed natively
+// e.g. QCOW2 images with compressed clusters or internal snapshots.
+var errUnsupportedImage = errors.New("image layout not supported for native access")
+
+const (
+	qcow2OffsetMask  = 0x00fffffffffffe00
+	qcow2Copied      = uint64(1) << 63
+	qcow2Compressed  = uint64(1) << 62
+	qcow2ZeroCluster = uint64(1)
+)
+
+// diskImage gives access to the image content as seen by the guest.
+type diskImage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// openDiskImage opens either raw or QCOW2 image.
+func openDiskImage(path string, writable bool) (diskImage, error) {
+	format, err := image.Probe(path)
+	if err != nil {
+		return nil, err
+	}
+
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+	}
+
+	switch format {
+	case image.RAW:
+		return os.OpenFile(path, flag, 0)
+	case image.QCOW2:
+		return openQcow2Image(path, flag)
+	}
+	return nil, errUnsupportedImage
+}
+
+// readImage reads len(data) bytes of guest content starting at offset.
+func readImage(path string, offset int64, data []byte) error {
+	img, err := openDiskImage(path, false)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	_, err = img.ReadAt(data, offset)
+	return err
+}
+
+// writeImage writes data into the guest content starting at offset.
+func writeImage(path string, offset int64, data []byte) error {
+	img, err := openDiskImage(path, true)
+	if err != nil {
+		return err
+	}
+
+	if _, err := img.WriteAt(data, offset); err != nil {
+		img.Close()
+		return err
+	}
+	return img.Close()
+}
+
+type qcow2Image struct {
+	file        *os.File
+	header      *qcow2.Header
+	clusterSize int64
+	l2Entries   int64
+	backing     diskImage
+}
+
+func openQcow2Image(path string, flag int) (*qcow2Image, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := qcow2.ReadHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Clusters of encrypted images and images with snapshots cannot be simply
+	// overwritten. Incompatible features (e.g. dirty refcounts) are unknown to us.
+	if header.CryptMethod != 0 || header.NbSnapshots != 0 ||
+		(header.Version >= 3 && header.IncompatibleFeatures != 0) {
+		f.Close()
+		return nil, errUnsupportedImage
+	}
+
+	img := &qcow2Image{
+		file:        f,
+		header:      header,
+		clusterSize: int64(1) << header.ClusterBits,
+	}
+	img.l2Entries = img.clusterSize / 8
+
+	backingPath, err := qcow2BackingFile(f, header, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if backingPath != "" {
+		// Backing image is never modified.
+		if img.backing, err = openDiskImage(backingPath, false); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+// QcowBackingFile returns path to the backing image of the QCOW2 image or an
+// empty string when there is none. Unlike qemu-img, it does not need the
+// backing image to exist.
+func QcowBackingFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header, err := qcow2.ReadHeader(f)
+	if err != nil {
+		return "", err
+	}
+	if header.Magic != qcow2.QCOW2_MAGIC {
+		return "", fmt.Errorf("%s: not a QCOW2 image", path)
+	}
+	return qcow2BackingFile(f, header, path)
+}
+
+// qcow2BackingFile returns path to the backing image of the QCOW2 image at
+// path or an empty string when there is none.
+func qcow2BackingFile(f *os.File, header *qcow2.Header, path string) (string, error) {
+	if header.BackingFileOffset == 0 {
+		return "", nil
+	}
+
+	name := make([]byte, header.BackingFileSize)
+	if _, err := f.ReadAt(name, int64(header.BackingFileOffset)); err != nil {
+		return "", err
+	}
+
+	backingPath := string(name)
+	if !filepath.IsAbs(backingPath) {
+		backingPath = filepath.Join(filepath.Dir(path), backingPath)
+	}
+	return backingPath, nil
+}
+
+func (img *qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk := img.chunkSize(off+int64(n), len(p)-n)
+		if err := img.readChunk(p[n:n+chunk], off+int64(n)); err != nil {
+			return n, err
+		}
+		n += chunk
+	}
+	return n, nil
+}
+
+func (img *qcow2Image) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk := img.chunkSize(off+int64(n), len(p)-n)
+		if err := img.writeChunk(p[n:n+chunk], off+int64(n)); err != nil {
+			return n, err
+		}
+		n += chunk
+	}
+	return n, nil
+}
+
+func (img *qcow2Image) Close() error {
+	if img.backing != nil {
+		img.backing.Close()
+	}
+	return img.file.Close()
+}
+
+// chunkSize returns how many of the remaining bytes fit into the cluster at offset.
+func (img *qcow2Image) chunkSize(off int64, remaining int) int {
+	if left := img.clusterSize - off%img.clusterSize; int64(remaining) > left {
+		return int(left)
+	}
+	return remaining
+}
+
+// l2Entry returns the offset of the L2 table entry describing the cluster at
+// the given guest offset together with the entry itself. Zero offset means
+// that the L2 table is not allocated yet.
+func (img *qcow2Image) l2Entry(off int64) (int64, uint64, error) {
+	clusterIndex := off / img.clusterSize
+	l1Index := clusterIndex / img.l2Entries
+	if l1Index >= int64(img.header.L1Size) {
+		return 0, 0, fmt.Errorf("offset %d is beyond the end of the image", off)
+	}
+
+	l1Entry, err := img.readUint64(int64(img.header.L1TableOffset) + l1Index*8)
+	if err != nil {
+		return 0, 0, err
+	}
+	l2Table := int64(l1Entry & qcow2OffsetMask)
+	if l2Table == 0 {
+		return 0, 0, nil
+	}
+
+	entryOffset := l2Table + (clusterIndex%img.l2Entries)*8
+	entry, err := img.readUint64(entryOffset)
+	return entryOffset, entry, err
+}
+
+func (img *qcow2Image) readChunk(p []byte, off int64) error {
+	_, entry, err := img.l2Entry(off)
+	if err != nil {
+		return err
+	}
+
+	host := int64(entry & qcow2OffsetMask)
+	switch {
+	case entry&qcow2Compressed != 0:
+		return errUnsupportedImage
+	case entry&qcow2ZeroCluster != 0:
+		zero(p)
+	case host != 0:
+		_, err = img.file.ReadAt(p, host+off%img.clusterSize)
+		return err
+	case img.backing != nil:
+		// Backing image may be smaller than this one; the rest reads as zeros.
+		n, err := img.backing.ReadAt(p, off)
+		if err == io.EOF {
+			zero(p[n:])
+			return nil
+		}
+		return err
+	default:
+		zero(p)
+	}
+	return nil
+}
+
+func (img *qcow2Image) writeChunk(p []byte, off int64) error {
+	entryOffset, entry, err := img.l2Entry(off)
+	if err != nil {
+		return err
+	}
+
+	if entry&qcow2Compressed != 0 {
+		return errUnsupportedImage
+	}
+
+	host := int64(entry & qcow2OffsetMask)
+	if host != 0 && entry&qcow2ZeroCluster == 0 {
+		_, err := img.file.WriteAt(p, host+off%img.clusterSize)
+		return err
+	}
+
+	// The cluster must be written as a whole, so merge data into its current content.
+	clusterStart := off - off%img.clusterSize
+	data := make([]byte, img.clusterSize)
+	if err := img.readChunk(data, clusterStart); err != nil {
+		return err
+	}
+	copy(data[off-clusterStart:], p)
+
+	if host == 0 {
+		if entryOffset == 0 {
+			if entryOffset, err = img.allocateL2Table(off); err != nil {
+				return err
+			}
+		}
+		if host, err = img.allocateCluster(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := img.file.WriteAt(data, host); err != nil {
+		return err
+	}
+	return img.writeUint64(entryOffset, uint64(host)|qcow2Copied)
+}
+
+// allocateL2Table allocates L2 table for the given guest offset and returns
+// the offset of the L2 entry for it.
+func (img *qcow2Image) allocateL2Table(off int64) (int64, error) {
+	table, err := img.allocateCluster()
+	if err != nil {
+		return 0, err
+	}
+
+	clusterIndex := off / img.clusterSize
+	l1Offset := int64(img.header.L1TableOffset) + (clusterIndex/img.l2Entries)*8
+	if err := img.writeUint64(l1Offset, uint64(table)|qcow2Copied); err != nil {
+		return 0, err
+	}
+
+	return table + (clusterIndex%img.l2Entries)*8, nil
+}
+
+// allocateCluster appends an empty cluster to the end of the image file and
+// returns its offset.
+func (img *qcow2Image) allocateCluster() (int64, error) {
+	info, err := img.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset := (info.Size() + img.clusterSize - 1) / img.clusterSize * img.clusterSize
+
+	// Reference count is set first since it fails for images that would require
+	// a new refcount block. The image is left untouched in such case.
+	if err := img.setRefcount(offset, 1); err != nil {
+		return 0, err
+	}
+
+	if _, err := img.file.WriteAt(make([]byte, img.clusterSize), offset); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (img *qcow2Image) setRefcount(offset int64, refcount uint16) error {
+	// Only the default 16-bit refcounts are supported.
+	if img.header.Version >= 3 && img.header.RefcountOrder != 4 {
+		return errUnsupportedImage
+	}
+
+	entriesPerBlock := img.clusterSize / 2
+	clusterIndex := offset / img.clusterSize
+	tableIndex := clusterIndex / entriesPerBlock
+	if tableIndex >= int64(img.header.RefcountTableClusters)*img.clusterSize/8 {
+		return errUnsupportedImage
+	}
+
+	block, err := img.readUint64(int64(img.header.RefcountTableOffset) + tableIndex*8)
+	if err != nil {
+		return err
+	}
+	block &= qcow2OffsetMask
+	if block == 0 {
+		return errUnsupportedImage
+	}
+
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, refcount)
+	_, err = img.file.WriteAt(buf, int64(block)+(clusterIndex%entriesPerBlock)*2)
+	return err
+}
+
+func (img *qcow2Image) readUint64(offset int64) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := img.file.ReadAt(buf, offset); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+func (img *qcow2Image) writeUint64(offset int64, value uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	_, err := img.file.WriteAt(buf, offset)
+	return err
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
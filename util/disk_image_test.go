@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikelangelo-project/capstan/image/qcow2"
+)
+
+const testClusterBits = 16
+
+// writeTestQcow2 creates an empty 1MB QCOW2 image with header in cluster 0,
+// L1 table in cluster 1, refcount table in cluster 2 and refcount block in
+// cluster 3. L2 tables are not allocated.
+func writeTestQcow2(t *testing.T, path string, backingFile string) {
+	clusterSize := int64(1) << testClusterBits
+	header := qcow2.Header{
+		Magic:                 qcow2.QCOW2_MAGIC,
+		Version:               2,
+		ClusterBits:           testClusterBits,
+		Size:                  1024 * 1024,
+		L1Size:                1,
+		L1TableOffset:         uint64(clusterSize),
+		RefcountTableOffset:   uint64(2 * clusterSize),
+		RefcountTableClusters: 1,
+	}
+	if backingFile != "" {
+		header.BackingFileOffset = 512
+		header.BackingFileSize = uint32(len(backingFile))
+	}
+
+	data := make([]byte, 4*clusterSize)
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.BigEndian, header); err != nil {
+		t.Fatal(err)
+	}
+	copy(data, buf.Bytes())
+	copy(data[512:], backingFile)
+	binary.BigEndian.PutUint64(data[2*clusterSize:], uint64(3*clusterSize))
+	for i := int64(0); i < 4; i++ {
+		binary.BigEndian.PutUint16(data[3*clusterSize+i*2:], 1)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestCmdLine(t *testing.T, path string, length int) string {
+	data := make([]byte, length)
+	if err := readImage(path, 512, data); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSetCmdLineRaw(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "disk.raw")
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte{0xff}, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetCmdLine(path, "/hello.so"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestCmdLine(t, path, 10); got != "/hello.so\x00" {
+		t.Errorf("capstan: unexpected cmdline %q", got)
+	}
+}
+
+func TestSetCmdLineQcow2(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "disk.qcow2")
+	writeTestQcow2(t, path, "")
+
+	for _, cmdLine := range []string{"/hello.so", "/tools/cpiod.so --prefix /zfs"} {
+		if err := SetCmdLine(path, cmdLine); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestCmdLine(t, path, len(cmdLine)+1); got != cmdLine+"\x00" {
+			t.Errorf("capstan: unexpected cmdline %q", got)
+		}
+	}
+
+	// Header, L1, refcount table, refcount block, L2 table and a single data cluster.
+	if info, _ := os.Stat(path); info.Size() != 6<<testClusterBits {
+		t.Errorf("capstan: unexpected image size %d", info.Size())
+	}
+}
+
+func TestSetCmdLineQcow2Overlay(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	// Data following the command line must be preserved from backing image.
+	base := filepath.Join(tmp, "base.raw")
+	if err := ioutil.WriteFile(base, bytes.Repeat([]byte{'x'}, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmp, "disk.qcow2")
+	writeTestQcow2(t, path, "base.raw")
+
+	if err := SetCmdLine(path, "/hello.so"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "/hello.so" + strings.Repeat("\x00", 503) + strings.Repeat("x", 1024)
+	if got := readTestCmdLine(t, path, len(expected)); got != expected {
+		t.Errorf("capstan: unexpected image content %q", got)
+	}
+	if got := readTestCmdLine(t, base, 10); got != "xxxxxxxxxx" {
+		t.Errorf("capstan: backing image was modified: %q", got)
+	}
+}
+
+func TestSetCmdLineTooLong(t *testing.T) {
+	if err := SetCmdLine("/nonexistent", strings.Repeat("x", MaxCmdLineLength+1)); err == nil {
+		t.Error("capstan: expected error for too long command line")
+	}
+}
+
+func TestGetCmdLine(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "disk.qcow2")
+	writeTestQcow2(t, path, "")
+
+	if cmdLine, err := GetCmdLine(path); err != nil || cmdLine != "" {
+		t.Errorf("capstan: want empty cmdline, got %q (%v)", cmdLine, err)
+	}
+
+	// Shorter command line must not leave remains of the previous one.
+	for _, expected := range []string{"/tools/cpiod.so --prefix /zfs", "/hello.so"} {
+		if err := SetCmdLine(path, expected); err != nil {
+			t.Fatal(err)
+		}
+		if cmdLine, err := GetCmdLine(path); err != nil || cmdLine != expected {
+			t.Errorf("capstan: want %q, got %q (%v)", expected, cmdLine, err)
+		}
+	}
+}
+
+func TestQcowBackingFile(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	base := filepath.Join(tmp, "base.qcow2")
+	writeTestQcow2(t, base, "")
+	if backing, err := QcowBackingFile(base); err != nil || backing != "" {
+		t.Errorf("capstan: want no backing file, got %q (%v)", backing, err)
+	}
+
+	// Backing file need not exist, relative path is relative to the overlay.
+	overlay := filepath.Join(tmp, "disk.qcow2")
+	writeTestQcow2(t, overlay, "missing.qcow2")
+	if backing, err := QcowBackingFile(overlay); err != nil || backing != filepath.Join(tmp, "missing.qcow2") {
+		t.Errorf("capstan: want %q, got %q (%v)", filepath.Join(tmp, "missing.qcow2"), backing, err)
+	}
+}
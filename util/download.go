@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cheggaaa/pb"
+)
+
+// DefaultDownloadConcurrency is the number of packages downloaded at once
+// unless configured otherwise.
+const DefaultDownloadConcurrency = 4
+
+// packageDownload is a package to download from the given remote repository.
+type packageDownload struct {
+	repoURL string
+	name    string
+}
+
+// downloadPackages downloads the packages concurrently, at most
+// DownloadConcurrency at a time, showing progress of each package file
+// together with the number of downloaded packages. All downloads are
+// attempted, the first error is returned.
+func (r *Repo) downloadPackages(downloads []packageDownload) error {
+	if len(downloads) == 1 || r.downloadConcurrency() == 1 {
+		for _, d := range downloads {
+			if err := r.DownloadPackage(d.repoURL, d.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var files []string
+	for _, d := range downloads {
+		files = append(files, fmt.Sprintf("%s.mpm", d.name))
+	}
+	r.progress = startDownloadProgress(files)
+	defer func() {
+		r.progress.stop()
+		r.progress = nil
+	}()
+
+	errs := make([]error, len(downloads))
+	slots := make(chan struct{}, r.downloadConcurrency())
+	var wg sync.WaitGroup
+	for i, d := range downloads {
+		wg.Add(1)
+		go func(i int, d packageDownload) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			errs[i] = r.DownloadPackage(d.repoURL, d.name)
+			r.progress.done(fmt.Sprintf("%s.mpm", d.name))
+		}(i, d)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repo) downloadConcurrency() int {
+	if r.DownloadConcurrency < 1 {
+		return DefaultDownloadConcurrency
+	}
+	return r.DownloadConcurrency
+}
+
+// downloadProgress shows progress bars of concurrent downloads. When the
+// output is not a terminal, downloaded files are only listed.
+type downloadProgress struct {
+	pool  *pb.Pool
+	bars  map[string]*pb.ProgressBar
+	total *pb.ProgressBar
+}
+
+func startDownloadProgress(files []string) *downloadProgress {
+	width := 0
+	for _, f := range files {
+		if len(f) > width {
+			width = len(f)
+		}
+	}
+
+	bars := make(map[string]*pb.ProgressBar)
+	var all []*pb.ProgressBar
+	for _, f := range files {
+		bar := pb.New64(0).SetUnits(pb.U_BYTES).Prefix(fmt.Sprintf("%-*s ", width, f))
+		bars[f] = bar
+		all = append(all, bar)
+	}
+	total := pb.New(len(files)).Prefix(fmt.Sprintf("%-*s ", width, "Total"))
+	all = append(all, total)
+
+	pool, err := pb.StartPool(all...)
+	if err != nil {
+		return &downloadProgress{}
+	}
+	return &downloadProgress{pool: pool, bars: bars, total: total}
+}
+
+// plain reports whether progress bars are not shown.
+func (p *downloadProgress) plain() bool {
+	return p.pool == nil
+}
+
+// bar returns the progress bar of the file or nil if the file is not
+// tracked, e.g. package manifests.
+func (p *downloadProgress) bar(name string) *pb.ProgressBar {
+	return p.bars[name]
+}
+
+func (p *downloadProgress) done(name string) {
+	if p.plain() {
+		fmt.Printf("Downloaded %s\n", name)
+		return
+	}
+	if bar := p.bars[name]; bar != nil {
+		bar.Finish()
+	}
+	p.total.Increment()
+}
+
+func (p *downloadProgress) stop() {
+	if p.plain() {
+		return
+	}
+	p.total.Finish()
+	p.pool.Stop()
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/util"
+	. "gopkg.in/check.v1"
+)
+
+type downloadSuite struct{}
+
+var _ = Suite(&downloadSuite{})
+
+func (*downloadSuite) TestResumeDownload(c *C) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	m := []struct {
+		comment string
+		// resumed is the remote file and its entity tag when the download is
+		// run again.
+		resumed     []byte
+		resumedETag string
+		served      int64
+	}{
+		{"resumed from partial file", content, `"v1"`, 6000},
+		{"remote file changed since", bytes.Repeat([]byte("abcdefghij"), 1000), `"v2"`, 10000},
+		{"remote file shrunk without changing its tag", content[:3000], `"v1"`, 3000},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		repo := util.NewRepo(util.DefaultRepositoryUrl)
+		repo.Path = c.MkDir()
+		var mutex sync.Mutex
+		file, etag, interrupt := content, `"v1"`, true
+		var served int64
+		var ifRange []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch req.URL.Path {
+			case "/":
+				w.Write([]byte("<ListBucketResult><Contents><Key>packages/osv.cli.yaml</Key></Contents>" +
+					"<Contents><Key>packages/osv.cli.mpm</Key></Contents></ListBucketResult>"))
+			case "/packages/osv.cli.yaml":
+				w.Write([]byte("name: osv.cli\ntitle: CLI\nauthor: a\n"))
+			case "/packages/osv.cli.mpm":
+				ifRange = append(ifRange, req.Header.Get("If-Range"))
+				w.Header().Set("ETag", etag)
+				if interrupt {
+					// Connection breaks after 4000 bytes.
+					w.Header().Set("Content-Length", strconv.Itoa(len(file)))
+					w.Write(file[:4000])
+					w.(http.Flusher).Flush()
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				counter := &countingWriter{ResponseWriter: w}
+				http.ServeContent(counter, req, "osv.cli.mpm", time.Time{}, bytes.NewReader(file))
+				served += counter.n
+			}
+		}))
+
+		// Download is interrupted...
+		err := repo.DownloadPackage(server.URL+"/", "osv.cli")
+		c.Assert(err, ErrorMatches, "download of osv.cli.mpm interrupted .*")
+
+		// ... and run again, possibly after the remote file has changed.
+		mutex.Lock()
+		file, etag, interrupt = args.resumed, args.resumedETag, false
+		mutex.Unlock()
+
+		// This is what we're testing here.
+		err = repo.DownloadPackage(server.URL+"/", "osv.cli")
+		server.Close()
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadFile(repo.PackagePath("osv.cli"))
+		c.Assert(err, IsNil)
+		c.Check(bytes.Equal(data, args.resumed), Equals, true)
+		c.Check(served, Equals, args.served)
+		c.Check(ifRange[:2], DeepEquals, []string{"", `"v1"`})
+		leftovers, _ := filepath.Glob(repo.PackagePath("osv.cli") + ".*")
+		c.Check(leftovers, HasLen, 0)
+	}
+}
+
+func (*downloadSuite) TestInterruptedDownloadKeepsPartialFile(c *C) {
+	repo := util.NewRepo(util.DefaultRepositoryUrl)
+	repo.Path = c.MkDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			w.Write([]byte("<ListBucketResult><Contents><Key>packages/osv.cli.yaml</Key></Contents>" +
+				"<Contents><Key>packages/osv.cli.mpm</Key></Contents></ListBucketResult>"))
+		case "/packages/osv.cli.yaml":
+			w.Write([]byte("name: osv.cli\ntitle: CLI\nauthor: a\n"))
+		case "/packages/osv.cli.mpm":
+			// Announce more content than is sent before the connection is closed.
+			w.Header().Set("Content-Length", "10000")
+			w.Write([]byte(strings.Repeat("x", 4000)))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	// This is what we're testing here.
+	err := repo.DownloadPackage(server.URL+"/", "osv.cli")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "download of osv.cli.mpm interrupted .*, run the command again to resume")
+	info, err := os.Stat(repo.PackagePath("osv.cli") + util.PartialDownloadSuffix)
+	c.Assert(err, IsNil)
+	c.Check(info.Size(), Equals, int64(4000))
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/rofs"
+)
+
+// Root filesystems of composed images. ZFS is writable and can grow along
+// with the disk, while ROFS is a small immutable filesystem written on the
+// host, which needs an OSv loader built with fs=rofs.
+const (
+	FilesystemZFS  = "zfs"
+	FilesystemROFS = "rofs"
+)
+
+// ValidateFilesystem checks the root filesystem, an empty one is ZFS.
+func ValidateFilesystem(fs string) error {
+	switch fs {
+	case "", FilesystemZFS, FilesystemROFS:
+		return nil
+	}
+	return fmt.Errorf("unknown filesystem '%s', use one of %s|%s", fs, FilesystemZFS, FilesystemROFS)
+}
+
+// DefaultLoaderImage returns the loader image that images with the root
+// filesystem are composed from.
+func DefaultLoaderImage(fs string) string {
+	if fs == FilesystemROFS {
+		return "mike/osv-loader-rofs"
+	}
+	return "mike/osv-loader"
+}
+
+// ImageFilesystem returns the root filesystem of the image, ZFS unless the
+// image was composed with another one.
+func (r *Repo) ImageFilesystem(image string) string {
+	info, err := r.imageInfo(image)
+	if err != nil || info.Filesystem == "" {
+		return FilesystemZFS
+	}
+	return info.Filesystem
+}
+
+// InitializeROFSImage creates the image with the filesystem written after
+// the loader image, in its second partition. Unlike InitializeImage, the
+// image is complete as the filesystem already holds all files, and its size
+// is that of the loader and the filesystem.
+func (r *Repo) InitializeROFSImage(loaderImage string, imageName string, fs *rofs.Filesystem) error {
+	if loaderImage == "" {
+		loaderImage = DefaultLoaderImage(FilesystemROFS)
+	}
+
+	loaderImagePath := r.ImagePath("qemu", loaderImage)
+	loaderInfo, err := os.Stat(loaderImagePath)
+	if os.IsNotExist(err) {
+		fmt.Printf("The specified loader image (%s) does not exist.\n", loaderImagePath)
+		return err
+	}
+	// The filesystem starts at the closest 2MB after the loader, the same
+	// as the ZFS partition.
+	fsStart := (loaderInfo.Size() + 2097151) & ^2097151
+
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+	imagePath := filepath.Join(tmp, "application.img")
+
+	if err := CopyLocalFile(imagePath, loaderImagePath); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(fsStart, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	fsSize, err := fs.Save(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write ROFS filesystem: %s", err)
+	}
+	if err := file.Truncate(fsStart + fsSize); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := ConvertImageToQCOW2(imagePath, r.Qcow2); err != nil {
+		return err
+	}
+
+	if err := SetPartition(imagePath, 2, uint64(fsStart), uint64(fsSize)); err != nil {
+		fmt.Printf("Setting the ROFS partition failed for %s\n", imagePath)
+		return err
+	}
+
+	info := ImageInfo{
+		FormatVersion: "1",
+		Created:       time.Now().Format(time.RFC3339),
+		Filesystem:    FilesystemROFS,
+		Loader:        loaderImage,
+		LoaderVersion: r.LoaderVersion(loaderImage),
+	}
+	return r.importImage(imageName, imagePath, info, false)
+}
@@ -9,17 +9,77 @@
 package util
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"strings"
 )
 
-func ConvertImageToQCOW2(imagePath string) error {
+// ZfsExpandCmd is the OSv command that makes ZFS pool occupy the entire
+// (previously enlarged) partition.
+const ZfsExpandCmd = "/zpool.so online -e osv /dev/vblk0.1"
+
+// Qcow2Options describe how new QCOW2 images (both base images and instance
+// overlays) are created. Zero value means that qemu-img defaults are used.
+type Qcow2Options struct {
+	// Preallocation is one of off|metadata|falloc|full.
+	Preallocation string `yaml:"preallocation"`
+	// ClusterSize is the size of QCOW2 clusters, e.g. 64K or 2M.
+	ClusterSize string `yaml:"cluster_size"`
+	// Compress enables compression of base image clusters. It is ignored
+	// for instance overlays since qemu-img can only compress when converting.
+	Compress bool `yaml:"compress"`
+}
+
+func (o Qcow2Options) Validate() error {
+	switch o.Preallocation {
+	case "", "off", "metadata", "falloc", "full":
+	default:
+		return fmt.Errorf("%s: unsupported qcow2 preallocation mode, use one of off|metadata|falloc|full", o.Preallocation)
+	}
+
+	if o.ClusterSize != "" {
+		if match, _ := regexp.MatchString("^[0-9]+[kKmM]?$", o.ClusterSize); !match {
+			return fmt.Errorf("%s: unrecognized qcow2 cluster size", o.ClusterSize)
+		}
+	}
+
+	return nil
+}
+
+// CreateOptions returns the comma separated list of options suitable for
+// the -o argument of qemu-img. Additional options (e.g. backing_file) are
+// put in front of the QCOW2 creation options.
+func (o Qcow2Options) CreateOptions(extra ...string) string {
+	opts := extra
+	if o.Preallocation != "" {
+		opts = append(opts, "preallocation="+o.Preallocation)
+	}
+	if o.ClusterSize != "" {
+		opts = append(opts, "cluster_size="+o.ClusterSize)
+	}
+	return strings.Join(opts, ",")
+}
+
+func ConvertImageToQCOW2(imagePath string, opts Qcow2Options) error {
 	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
 		return err
 	}
 
-	cmd := exec.Command("qemu-img", "convert", "-f", "raw", "-O", "qcow2", imagePath, imagePath+".qcow2")
+	args := []string{"convert", "-f", "raw", "-O", "qcow2"}
+	if o := opts.CreateOptions(); o != "" {
+		args = append(args, "-o", o)
+	}
+	if opts.Compress {
+		args = append(args, "-c")
+	}
+	args = append(args, imagePath, imagePath+".qcow2")
+
+	cmd := exec.Command("qemu-img", args...)
 	_, err := cmd.Output()
 	if err != nil {
 		fmt.Printf("Converting image %s to QCOW2 format failed in qemu-img\n", imagePath)
@@ -39,12 +99,19 @@ func ConvertImageToQCOW2(imagePath string) error {
 	return nil
 }
 
-func ResizeImage(imagePath string, targetSize uint64) error {
+func ResizeImage(imagePath string, targetSize uint64, opts Qcow2Options) error {
 	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
 		return err
 	}
 
-	cmd := exec.Command("qemu-img", "resize", imagePath, fmt.Sprintf("%db", targetSize))
+	args := []string{"resize"}
+	// Keep the newly added space preallocated the same way as the rest of the image.
+	if opts.Preallocation != "" && opts.Preallocation != "off" {
+		args = append(args, "--preallocation="+opts.Preallocation)
+	}
+	args = append(args, imagePath, fmt.Sprintf("%db", targetSize))
+
+	cmd := exec.Command("qemu-img", args...)
 	_, err := cmd.Output()
 	if err != nil {
 		fmt.Printf("Resizing %s to new size %db failed in qemu-img\n", imagePath, targetSize)
@@ -54,6 +121,181 @@ func ResizeImage(imagePath string, targetSize uint64) error {
 	return nil
 }
 
+// QemuImageInfo contains the subset of `qemu-img info` output that capstan uses.
+type QemuImageInfo struct {
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+	BackingFile string `json:"full-backing-filename"`
+}
+
+// GetQemuImageInfo asks qemu-img for information about the image.
+func GetQemuImageInfo(imagePath string) (*QemuImageInfo, error) {
+	cmd := exec.Command("qemu-img", "info", "--output=json", imagePath)
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("reading information about %s failed in qemu-img: %s", imagePath, strings.TrimSpace(string(exitErr.Stderr)))
+	} else if err != nil {
+		return nil, fmt.Errorf("reading information about %s failed in qemu-img: %s", imagePath, err)
+	}
+
+	info := QemuImageInfo{}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// ImageVirtualSize returns the virtual size of the image in bytes.
+func ImageVirtualSize(imagePath string) (int64, error) {
+	info, err := GetQemuImageInfo(imagePath)
+	if err != nil {
+		return 0, err
+	}
+	return info.VirtualSize, nil
+}
+
+// RebaseImage points the overlay image to a new backing file. Empty backingFile
+// flattens the overlay into a standalone image. Unsafe rebase only rewrites the
+// reference and must be used when the old backing file is not available anymore.
+func RebaseImage(imagePath string, backingFile string, unsafe bool) error {
+	args := []string{"rebase"}
+	if unsafe {
+		args = append(args, "-u")
+	}
+	args = append(args, "-b", backingFile)
+	if backingFile != "" {
+		format, err := ImageFormat(backingFile)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-F", format)
+	}
+	args = append(args, imagePath)
+
+	cmd := exec.Command("qemu-img", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Printf("Rebasing %s failed in qemu-img: %s\n", imagePath, strings.TrimSpace(string(out)))
+		return err
+	}
+
+	return nil
+}
+
+// ImageFormat tells whether the image is a QCOW2 or a raw image by its header.
+func ImageFormat(imagePath string) (string, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err == nil && bytes.Equal(magic, []byte("QFI\xfb")) {
+		return "qcow2", nil
+	}
+	return "raw", nil
+}
+
+// FlattenImage writes the image, merged with all its backing files, into a
+// standalone QCOW2 image at the target path.
+func FlattenImage(imagePath, target string) error {
+	cmd := exec.Command("qemu-img", "convert", "-O", "qcow2", imagePath, target)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Printf("Flattening %s failed in qemu-img: %s\n", imagePath, strings.TrimSpace(string(out)))
+		return err
+	}
+
+	return nil
+}
+
+// ConvertImageToRaw converts the image into raw disk image at target.
+func ConvertImageToRaw(imagePath, target string) error {
+	cmd := exec.Command("qemu-img", "convert", "-O", "raw", imagePath, target)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to convert %s to raw image: %s", imagePath, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// CommitImage writes the changes of the overlay image into its backing file.
+func CommitImage(imagePath string) error {
+	cmd := exec.Command("qemu-img", "commit", imagePath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Printf("Committing %s failed in qemu-img: %s\n", imagePath, strings.TrimSpace(string(out)))
+		return err
+	}
+
+	return nil
+}
+
+// GrowImage enlarges the image to the given size (in MB) and extends the ZFS
+// partition so that it spans till the end of the image. Images are never shrunk.
+// Returned value tells whether the image was actually resized. Note that OSv
+// must be instructed to expand the filesystem as well, see ExpandFilesystemCmd.
+func GrowImage(imagePath string, sizeMB int64, opts Qcow2Options) (bool, error) {
+	currentSize, err := ImageVirtualSize(imagePath)
+	if err != nil {
+		return false, err
+	}
+
+	targetSize := sizeMB * 1024 * 1024
+	if targetSize < currentSize {
+		return false, fmt.Errorf("%s: cannot shrink image from %d MB to %d MB",
+			imagePath, currentSize/1024/1024, sizeMB)
+	} else if targetSize == currentSize {
+		return false, nil
+	}
+
+	if err := ResizeImage(imagePath, uint64(targetSize), opts); err != nil {
+		return false, err
+	}
+
+	zfsStart, err := GetPartitionStart(imagePath, 2)
+	if err != nil {
+		return false, err
+	}
+	if err := SetPartition(imagePath, 2, zfsStart, uint64(targetSize)-zfsStart); err != nil {
+		fmt.Printf("Setting the ZFS partition failed for %s\n", imagePath)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ExpandFilesystemCmd inserts the command that expands ZFS pool into the given
+// OSv command line, after the options of the kernel that precede the commands.
+func ExpandFilesystemCmd(cmdLine string) string {
+	options, rest := SplitCmdLineOptions(cmdLine)
+	cmd := ZfsExpandCmd
+	if rest != "" {
+		cmd = fmt.Sprintf("%s; %s", ZfsExpandCmd, rest)
+	}
+	return strings.Join(append(options, cmd), " ")
+}
+
+// GetPartitionStart reads the offset (in bytes) of the given partition from the MBR.
+func GetPartitionStart(image string, partition int) (uint64, error) {
+	partition = 0x1be + ((partition - 1) * 0x10)
+
+	nbdFile, err := NewNbdFile(image)
+	if err != nil {
+		return 0, err
+	}
+
+	start, err := nbdFile.ReadInt(uint64(partition + 8))
+	if err != nil {
+		nbdFile.Close()
+		return 0, err
+	}
+
+	if err := nbdFile.Close(); err != nil {
+		return 0, err
+	}
+
+	return uint64(start) * 512, nil
+}
+
 func SetPartition(image string, partition int, start uint64, size uint64) error {
 	partition = 0x1be + ((partition - 1) * 0x10)
 
@@ -97,16 +339,80 @@ func SetPartition(image string, partition int, start uint64, size uint64) error
 	return nil
 }
 
+// MaxCmdLineLength is the longest command line OSv loader is able to read. The
+// loader reads 63 sectors starting with sector 1 and expects a terminating NUL.
+const MaxCmdLineLength = 63*512 - 1
+
+// SetCmdLine writes the command line into the raw or QCOW2 image directly.
+// Images that cannot be edited natively are edited with qemu-nbd instead.
 func SetCmdLine(imagePath string, cmdLine string) error {
-	nbdFile, err := NewNbdFile(imagePath)
-	if err != nil {
-		return err
+	if len(cmdLine) > MaxCmdLineLength {
+		return fmt.Errorf("command line is %d characters long, but at most %d are supported",
+			len(cmdLine), MaxCmdLineLength)
+	}
+
+	if IsEncryptedImage(imagePath) {
+		return errEncryptedImage
 	}
 
 	padding := 512 - (len(cmdLine) % 512)
 
 	data := append([]byte(cmdLine), make([]byte, padding)...)
 
+	err := writeImage(imagePath, 512, data)
+	if err == errUnsupportedImage {
+		return setCmdLineNbd(imagePath, data)
+	}
+	return err
+}
+
+// GetCmdLine returns the command line that is currently embedded into the image.
+func GetCmdLine(imagePath string) (string, error) {
+	if IsEncryptedImage(imagePath) {
+		return "", errEncryptedImage
+	}
+
+	data := make([]byte, MaxCmdLineLength+1)
+
+	err := readImage(imagePath, 512, data)
+	if err == errUnsupportedImage {
+		data, err = getCmdLineNbd(imagePath, len(data))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+	return string(data), nil
+}
+
+func getCmdLineNbd(imagePath string, length int) ([]byte, error) {
+	nbdFile, err := NewNbdFile(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := nbdFile.Session.Read(512, uint32(length))
+	if err != nil {
+		nbdFile.Close()
+		return nil, err
+	}
+
+	if err := nbdFile.Close(); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func setCmdLineNbd(imagePath string, data []byte) error {
+	nbdFile, err := NewNbdFile(imagePath)
+	if err != nil {
+		return err
+	}
+
 	if err := nbdFile.Write(512, data); err != nil {
 		return err
 	}
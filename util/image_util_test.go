@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQcow2CreateOptions(t *testing.T) {
+	m := []struct {
+		opts     Qcow2Options
+		extra    []string
+		expected string
+	}{
+		{Qcow2Options{}, nil, ""},
+		{Qcow2Options{}, []string{"backing_file=/base.qcow2"}, "backing_file=/base.qcow2"},
+		{Qcow2Options{Preallocation: "metadata"}, nil, "preallocation=metadata"},
+		{Qcow2Options{ClusterSize: "2M", Compress: true}, nil, "cluster_size=2M"},
+		{Qcow2Options{Preallocation: "full", ClusterSize: "64K"}, []string{"backing_file=/base.qcow2"},
+			"backing_file=/base.qcow2,preallocation=full,cluster_size=64K"},
+	}
+	for _, test := range m {
+		if got := test.opts.CreateOptions(test.extra...); got != test.expected {
+			t.Errorf("capstan: want %q, got %q", test.expected, got)
+		}
+	}
+}
+
+func TestQcow2OptionsValidate(t *testing.T) {
+	m := map[Qcow2Options]bool{
+		Qcow2Options{}:                        true,
+		Qcow2Options{Preallocation: "falloc"}: true,
+		Qcow2Options{Preallocation: "sparse"}: false,
+		Qcow2Options{ClusterSize: "64K"}:      true,
+		Qcow2Options{ClusterSize: "65536"}:    true,
+		Qcow2Options{ClusterSize: "64KB"}:     false,
+	}
+	for opts, valid := range m {
+		if err := opts.Validate(); (err == nil) != valid {
+			t.Errorf("capstan: %+v: unexpected validation result: %v", opts, err)
+		}
+	}
+}
+
+func TestExpandFilesystemCmd(t *testing.T) {
+	m := map[string]string{
+		"":                                  ZfsExpandCmd,
+		"/tools/cpiod.so":                   ZfsExpandCmd + "; /tools/cpiod.so",
+		"--verbose --env=PORT=8000 /app.so": "--verbose --env=PORT=8000 " + ZfsExpandCmd + "; /app.so",
+		`"--env=MSG=a b" --verbose /app.so`: `"--env=MSG=a b" --verbose ` + ZfsExpandCmd + "; /app.so",
+		"--verbose":                         "--verbose " + ZfsExpandCmd,
+	}
+	for cmd, expected := range m {
+		if got := ExpandFilesystemCmd(cmd); got != expected {
+			t.Errorf("capstan: want %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capstan-image-format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := map[string]string{
+		"qcow2": "QFI\xfb\x00\x00\x00\x03",
+		"raw":   "\xeb\x63\x90\x00",
+		"tiny":  "QF",
+	}
+	expected := map[string]string{"qcow2": "qcow2", "raw": "raw", "tiny": "raw"}
+	for name, content := range m {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if format, err := ImageFormat(path); err != nil || format != expected[name] {
+			t.Errorf("capstan: %s: want %s, got %s (%v)", name, expected[name], format, err)
+		}
+	}
+
+	if _, err := ImageFormat(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("capstan: expected error for a missing image")
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// loaderVersionSeparator separates the version in names of loader images,
+// e.g. mike/osv-loader-v0.24 or mike/osv-loader-rofs-v0.24.
+const loaderVersionSeparator = "-v"
+
+// LoaderImage returns the loader image of the given version for images with
+// the root filesystem, the default one when no version is given.
+func LoaderImage(fs, version string) string {
+	if version == "" {
+		return DefaultLoaderImage(fs)
+	}
+	return DefaultLoaderImage(fs) + loaderVersionSeparator + strings.TrimPrefix(version, "v")
+}
+
+// LoaderImageVersion returns the version in the name of the loader image for
+// images with the root filesystem, or false when the image is not one of
+// its versioned loader images.
+func LoaderImageVersion(fs, image string) (string, bool) {
+	prefix := DefaultLoaderImage(fs) + loaderVersionSeparator
+	if !strings.HasPrefix(image, prefix) {
+		return "", false
+	}
+	version := strings.TrimPrefix(image, prefix)
+	if version == "" || !unicode.IsDigit(rune(version[0])) {
+		return "", false
+	}
+	return version, true
+}
+
+// IsLoaderImage tells whether the image is a loader image, either the default
+// or a versioned one, for images with any of the root filesystems.
+func IsLoaderImage(image string) bool {
+	for _, fs := range []string{FilesystemZFS, FilesystemROFS} {
+		if _, ok := LoaderImageVersion(fs, image); ok || image == DefaultLoaderImage(fs) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsComposedImage tells whether the image was composed locally, i.e. it
+// records the loader image it was composed from. Loader images and images
+// pulled from remote repositories do not.
+func (r *Repo) IsComposedImage(image string) bool {
+	info, err := r.imageInfo(image)
+	return err == nil && info.Loader != "" && !IsLoaderImage(image)
+}
+
+// LoaderVersions returns versions of versioned loader images for images with
+// the root filesystem that are available in the local repository.
+func (r *Repo) LoaderVersions(fs string) []string {
+	namespace := path.Dir(DefaultLoaderImage(fs))
+	images, _ := ioutil.ReadDir(filepath.Join(r.RepoPath(), namespace))
+
+	var versions []string
+	for _, image := range images {
+		name := namespace + "/" + image.Name()
+		if version, ok := LoaderImageVersion(fs, name); ok && r.ImageExists("qemu", name) {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// RemoteLoaderVersions returns versions of versioned loader images for images
+// with the root filesystem that the remote repository provides.
+func RemoteLoaderVersions(repoURL, fs string) ([]string, error) {
+	q, err := QueryRemote(repoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, content := range q.ContentsList {
+		if !strings.HasSuffix(content.Key, "/index.yaml") {
+			continue
+		}
+		if version, ok := LoaderImageVersion(fs, strings.TrimSuffix(content.Key, "/index.yaml")); ok {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+// ImportLoaderImage imports the loader image built by OSv, e.g.
+// build/release/loader.img. It is a raw image, which is nevertheless stored
+// as the qemu image like loader images of remote repositories, since images
+// are composed by appending a partition to it.
+func (r *Repo) ImportLoaderImage(imageName, file string, info ImageInfo) error {
+	lock, err := r.LockImage(imageName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return r.storeImage(imageName, file, "qemu", info, true)
+}
+
+// LoaderVersion returns the version of the loader image, either given in its
+// name or recorded when it was imported.
+func (r *Repo) LoaderVersion(image string) string {
+	for _, fs := range []string{FilesystemZFS, FilesystemROFS} {
+		if version, ok := LoaderImageVersion(fs, image); ok {
+			return version
+		}
+	}
+
+	info, _ := r.imageInfo(image)
+	return info.Version
+}
+
+// ImageComposedFrom tells whether the image was composed from the loader
+// image. Images that do not record their loader are assumed to be.
+func (r *Repo) ImageComposedFrom(image, loaderImage string) bool {
+	info, err := r.imageInfo(image)
+	return err != nil || info.Loader == "" || info.Loader == loaderImage
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileLock is an exclusive advisory lock held on a file. It serialises
+// operations of capstan invocations running in parallel, e.g. in CI. Lock
+// files are kept in a directory of their own so that removing the locked
+// instance or image does not remove its lock file.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile blocks until the lock on the file at the given path is acquired.
+// The file and its directory are created if needed.
+func LockFile(path string) (*FileLock, error) {
+	return lockPath(path, false)
+}
+
+// LockFileShared blocks until a shared lock on the file at the given path is
+// acquired, i.e. until nobody holds the exclusive lock. Shared locks only
+// exclude LockFile, not each other.
+func LockFileShared(path string) (*FileLock, error) {
+	return lockPath(path, true)
+}
+
+func lockPath(path string, shared bool) (*FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, shared); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %s", path, err)
+	}
+	return &FileLock{file: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	return l.file.Close()
+}
+
+// LockInstance locks the instance of the platform while it is created,
+// modified or deleted.
+func LockInstance(platform, name string) (*FileLock, error) {
+	return LockFile(filepath.Join(ConfigDir(), "locks", "instances", platform, name+".lock"))
+}
+
+// LockImage locks the image of the repository while it is pulled, imported
+// or removed.
+func (r *Repo) LockImage(image string) (*FileLock, error) {
+	return LockFile(r.imageLockPath(image))
+}
+
+// LockImageShared locks the image of the repository while instances are
+// created from it, so that it is not replaced or removed meanwhile. Any
+// number of instances can be created from the image at the same time.
+func (r *Repo) LockImageShared(image string) (*FileLock, error) {
+	return LockFileShared(r.imageLockPath(image))
+}
+
+func (r *Repo) imageLockPath(image string) string {
+	return filepath.Join(r.Path, "locks", "images", filepath.FromSlash(image)+".lock")
+}
+
+// LockPackage locks the package of the repository while it is downloaded,
+// so that parallel downloads do not write into the same partial file.
+func (r *Repo) LockPackage(name string) (*FileLock, error) {
+	return LockFile(filepath.Join(r.Path, "locks", "packages", filepath.FromSlash(name)+".lock"))
+}
+
+// WriteFileAtomic writes data into a temporary file next to the given path
+// and renames it over the path, so that readers never see a partially
+// written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
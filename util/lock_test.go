@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capstan-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locks", "app.lock")
+
+	lock, err := LockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan *FileLock)
+	go func() {
+		second, err := LockFile(path)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- second
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected second lock to wait for the first one")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case second := <-acquired:
+		if second != nil {
+			second.Unlock()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected second lock once the first one is released")
+	}
+}
+
+func TestLockFileShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capstan-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locks", "image.lock")
+
+	// Shared locks do not wait for each other.
+	first, err := LockFileShared(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LockFileShared(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan *FileLock)
+	go func() {
+		exclusive, err := LockFile(path)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- exclusive
+	}()
+	for _, lock := range []*FileLock{first, second} {
+		select {
+		case <-acquired:
+			t.Fatal("expected exclusive lock to wait for shared ones")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if err := lock.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case exclusive := <-acquired:
+		if exclusive != nil {
+			exclusive.Unlock()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected exclusive lock once shared ones are released")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capstan-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "osv.config")
+
+	for _, data := range []string{"name: first\n", "name: second\n"} {
+		if err := WriteFileAtomic(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != data {
+			t.Errorf("expected '%s', got '%s'", data, content)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("expected mode 0644, got %v (%v)", info, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected temporary files to be removed, got %d files", len(files))
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/image/qcow2"
+)
+
+// EncryptionSecretID is the id of the qemu secret object holding the key of
+// LUKS encrypted image.
+const EncryptionSecretID = "capstan-luks0"
+
+// EncryptionKeyEnv is the environment variable that the key of LUKS encrypted
+// images is read from when no key file is given. It is meant to be set by a
+// secret agent (or CI) so that capstan does not need to prompt for the key.
+const EncryptionKeyEnv = "CAPSTAN_ENCRYPTION_KEY"
+
+var errEncryptedImage = errors.New("command line of encrypted images cannot be accessed, hence it cannot be changed when running them")
+
+// IsEncryptedImage returns true when the QCOW2 image or any of its backing
+// images is encrypted.
+func IsEncryptedImage(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header, err := qcow2.ReadHeader(f)
+	if err != nil || header.Magic != qcow2.QCOW2_MAGIC {
+		return false
+	}
+	if header.CryptMethod != 0 {
+		return true
+	}
+
+	backingPath, err := qcow2BackingFile(f, header, path)
+	if err != nil || backingPath == "" {
+		return false
+	}
+	return IsEncryptedImage(backingPath)
+}
+
+// ReadImageHeader reads the header of QCOW2 image.
+func ReadImageHeader(path string) (*qcow2.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header, err := qcow2.ReadHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if header.Magic != qcow2.QCOW2_MAGIC {
+		return nil, fmt.Errorf("%s: not a QCOW2 image", path)
+	}
+	return header, nil
+}
+
+// QemuSecretObject returns the qemu object definition that reads the key of
+// encrypted image from the given file.
+func QemuSecretObject(keyFile string) string {
+	return fmt.Sprintf("secret,id=%s,file=%s,format=raw", EncryptionSecretID, keyFile)
+}
+
+// EncryptionKeyFile returns path to the file containing the encryption key.
+// When keyFile is not given, the key is taken from the environment or the
+// user is prompted for it. Such key is stored into a temporary file in dir
+// that is removed by the returned cleanup function.
+func EncryptionKeyFile(keyFile, dir string, confirm bool) (string, func(), error) {
+	noop := func() {}
+	if keyFile != "" {
+		path, err := filepath.Abs(keyFile)
+		if err != nil {
+			return "", noop, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return "", noop, err
+		}
+		return path, noop, nil
+	}
+
+	key := os.Getenv(EncryptionKeyEnv)
+	if key == "" {
+		var err error
+		if key, err = promptEncryptionKey(confirm); err != nil {
+			return "", noop, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", noop, err
+	}
+	f, err := ioutil.TempFile(dir, "key")
+	if err != nil {
+		return "", noop, err
+	}
+	defer f.Close()
+
+	cleanup := func() { os.Remove(f.Name()) }
+	if err := f.Chmod(0600); err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	if _, err := f.WriteString(key); err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	return f.Name(), cleanup, nil
+}
+
+func promptEncryptionKey(confirm bool) (string, error) {
+	key, err := readSecret("Encryption key: ")
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", errors.New("encryption key must not be empty")
+	}
+
+	if confirm {
+		again, err := readSecret("Repeat encryption key: ")
+		if err != nil {
+			return "", err
+		}
+		if again != key {
+			return "", errors.New("encryption keys do not match")
+		}
+	}
+	return key, nil
+}
+
+func readSecret(prompt string) (string, error) {
+	fmt.Print(prompt)
+	DisableEcho()
+	defer fmt.Println()
+	defer EnableEcho()
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// EncryptImage converts the image into LUKS encrypted QCOW2 image in place.
+func EncryptImage(imagePath, keyFile string, opts Qcow2Options) error {
+	tmp := imagePath + ".luks"
+	cmd := exec.Command("qemu-img", "convert", "--object", QemuSecretObject(keyFile), "-O", "qcow2",
+		"-o", opts.CreateOptions("encrypt.format=luks", "encrypt.key-secret="+EncryptionSecretID),
+		imagePath, tmp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to encrypt %s: %s", imagePath, strings.TrimSpace(string(out)))
+	}
+
+	return os.Rename(tmp, imagePath)
+}
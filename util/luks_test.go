@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsEncryptedImage(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	base := filepath.Join(tmp, "base.qcow2")
+	writeTestQcow2(t, base, "")
+	overlay := filepath.Join(tmp, "disk.qcow2")
+	writeTestQcow2(t, overlay, "base.qcow2")
+
+	if IsEncryptedImage(base) || IsEncryptedImage(overlay) {
+		t.Error("capstan: unencrypted image reported as encrypted")
+	}
+
+	// Mark base image as LUKS encrypted (crypt_method = 2).
+	f, err := os.OpenFile(base, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, 2)
+	f.WriteAt(buf, 32)
+	f.Close()
+
+	if !IsEncryptedImage(base) || !IsEncryptedImage(overlay) {
+		t.Error("capstan: encrypted image not recognized")
+	}
+	if err := SetCmdLine(overlay, "/hello.so"); err != errEncryptedImage {
+		t.Errorf("capstan: want %v, got %v", errEncryptedImage, err)
+	}
+}
+
+func TestEncryptionKeyFileFromEnv(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "capstan")
+	defer os.RemoveAll(tmp)
+
+	os.Setenv(EncryptionKeyEnv, "secret")
+	defer os.Unsetenv(EncryptionKeyEnv)
+
+	path, cleanup, err := EncryptionKeyFile("", tmp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := ioutil.ReadFile(path); string(data) != "secret" {
+		t.Errorf("capstan: unexpected key %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("capstan: key file must only be readable by owner, got %v", info.Mode())
+	}
+
+	cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("capstan: key file was not removed")
+	}
+}
@@ -2,7 +2,14 @@ package util
 
 import (
 	"crypto/rand"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
 )
 
 // Generate a MAC address.
@@ -16,3 +23,165 @@ func GenerateMAC() (net.HardwareAddr, error) {
 	buf[0] |= 0x02 // Locally administered
 	return net.HardwareAddr(buf), nil
 }
+
+// macPoolAttempts is how many random addresses are generated before giving
+// up on finding one that was not issued yet.
+const macPoolAttempts = 1000
+
+// GenerateMACWithPrefix generates a MAC address that starts with the given
+// prefix, e.g. the OUI "52:54:00". An empty prefix generates a locally
+// administered address, see GenerateMAC.
+func GenerateMACWithPrefix(prefix string) (net.HardwareAddr, error) {
+	mac, err := GenerateMAC()
+	if err != nil || prefix == "" {
+		return mac, err
+	}
+	oui, err := ParseMACPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	copy(mac, oui)
+	return mac, nil
+}
+
+// ParseMACPrefix parses the prefix of unicast MAC addresses, one to five
+// octets separated by colons.
+func ParseMACPrefix(prefix string) ([]byte, error) {
+	octets := strings.Split(prefix, ":")
+	if len(octets) > 5 {
+		return nil, fmt.Errorf("invalid MAC prefix '%s', at most 5 octets are allowed", prefix)
+	}
+	mac, err := net.ParseMAC(prefix + strings.Repeat(":00", 6-len(octets)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC prefix '%s'", prefix)
+	}
+	if mac[0]&0x01 != 0 {
+		return nil, fmt.Errorf("invalid MAC prefix '%s', it is a multicast address", prefix)
+	}
+	return mac[:len(octets)], nil
+}
+
+// MACPrefix returns the prefix of generated MAC addresses, taken from
+// mac_prefix of config.yaml or CAPSTAN_MAC_PREFIX.
+func MACPrefix() string {
+	if prefix := LoadCapstanSettings(CapstanRoot()).MACPrefix; prefix != "" {
+		return prefix
+	}
+	return os.Getenv("CAPSTAN_MAC_PREFIX")
+}
+
+// macPool maps MAC addresses issued on this host to their instances.
+type macPool map[string]string
+
+func macPoolPath() string {
+	return filepath.Join(ConfigDir(), "macs.yaml")
+}
+
+// updateMACPool locks the pool of issued MAC addresses, passes it to the
+// update function and stores it unless the function fails.
+func updateMACPool(update func(pool macPool) error) error {
+	lock, err := LockFile(filepath.Join(ConfigDir(), "locks", "macs.lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	pool := make(macPool)
+	data, err := ioutil.ReadFile(macPoolPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(data, &pool); err != nil {
+		return fmt.Errorf("%s: %s", macPoolPath(), err)
+	}
+	if err := update(pool); err != nil {
+		return err
+	}
+
+	if data, err = yaml.Marshal(pool); err != nil {
+		return err
+	}
+	return WriteFileAtomic(macPoolPath(), data, 0644)
+}
+
+// instanceMAC returns the MAC address issued to the instance, if any.
+func (pool macPool) instanceMAC(instance string) string {
+	for mac, owner := range pool {
+		if owner == instance {
+			return mac
+		}
+	}
+	return ""
+}
+
+func (pool macPool) release(instance string) {
+	for mac, owner := range pool {
+		if owner == instance {
+			delete(pool, mac)
+		}
+	}
+}
+
+// AllocateMAC returns a MAC address of the instance that was not issued to
+// any other instance of this host. The instance keeps the address it was
+// issued before, if any, until it is released.
+func AllocateMAC(instance string) (net.HardwareAddr, error) {
+	var mac net.HardwareAddr
+	err := updateMACPool(func(pool macPool) error {
+		if existing := pool.instanceMAC(instance); existing != "" {
+			var err error
+			mac, err = net.ParseMAC(existing)
+			return err
+		}
+		prefix := MACPrefix()
+		for i := 0; i < macPoolAttempts; i++ {
+			generated, err := GenerateMACWithPrefix(prefix)
+			if err != nil {
+				return err
+			}
+			if _, issued := pool[generated.String()]; !issued {
+				mac = generated
+				pool[mac.String()] = instance
+				return nil
+			}
+		}
+		return fmt.Errorf("no MAC address with prefix '%s' is available", prefix)
+	})
+	return mac, err
+}
+
+// ReserveMAC records the given MAC address as issued to the instance, e.g.
+// when it is given by the user. The address must not be issued to another
+// instance of this host.
+func ReserveMAC(instance, mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	return updateMACPool(func(pool macPool) error {
+		if owner, issued := pool[hw.String()]; issued && owner != instance {
+			return fmt.Errorf("MAC address %s is used by instance %s already", hw, owner)
+		}
+		pool.release(instance)
+		pool[hw.String()] = instance
+		return nil
+	})
+}
+
+// ReleaseMAC makes the MAC address issued to the instance available again.
+func ReleaseMAC(instance string) error {
+	return updateMACPool(func(pool macPool) error {
+		pool.release(instance)
+		return nil
+	})
+}
+
+// RenameMAC moves the MAC address issued to the instance to its new name.
+func RenameMAC(instance, newInstance string) error {
+	return updateMACPool(func(pool macPool) error {
+		if mac := pool.instanceMAC(instance); mac != "" {
+			pool[mac] = newInstance
+		}
+		return nil
+	})
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseMACPrefix(t *testing.T) {
+	for _, prefix := range []string{"52:54:00", "02", "52:54:00:12:34"} {
+		if _, err := ParseMACPrefix(prefix); err != nil {
+			t.Errorf("%s: %s", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"", "52:54:00:12:34:56", "01:00:5e", "52:54:xx"} {
+		if _, err := ParseMACPrefix(prefix); err == nil {
+			t.Errorf("%s: expected an error", prefix)
+		}
+	}
+}
+
+func TestMACPool(t *testing.T) {
+	home, err := ioutil.TempDir("", "capstan-mac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+	defer os.Unsetenv("CAPSTAN_MAC_PREFIX")
+	os.Setenv("CAPSTAN_MAC_PREFIX", "52:54:00")
+
+	first, err := AllocateMAC("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first.String(), "52:54:00:") {
+		t.Errorf("%s does not start with the prefix", first)
+	}
+	if again, _ := AllocateMAC("first"); again.String() != first.String() {
+		t.Errorf("instance was issued %s, expected %s", again, first)
+	}
+	if second, _ := AllocateMAC("second"); second.String() == first.String() {
+		t.Errorf("%s was issued to two instances", first)
+	}
+
+	if err := ReserveMAC("third", first.String()); err == nil {
+		t.Errorf("expected %s to be reserved by instance first", first)
+	}
+	if err := RenameMAC("first", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseMAC("renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReserveMAC("third", first.String()); err != nil {
+		t.Errorf("released %s could not be reserved: %s", first, err)
+	}
+}
@@ -0,0 +1,363 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultManagedNetworkAddress is the address of the host on bridges that
+// capstan manages, along with their subnet.
+const DefaultManagedNetworkAddress = "10.0.77.1/24"
+
+// ManagedNetwork is a bridge created by capstan, with a dnsmasq instance
+// scoped to it handing out DHCP leases to instances attached to the bridge
+// and resolving their hostnames. Address is the address of the host on the
+// bridge in CIDR notation, its subnet is the network of the instances.
+// Domain, if given, is appended to hostnames of the instances.
+type ManagedNetwork struct {
+	Bridge  string `yaml:"bridge"`
+	Address string `yaml:"address"`
+	Domain  string `yaml:"domain,omitempty"`
+}
+
+// ManagedNetworkLease is a DHCP lease handed out by dnsmasq.
+type ManagedNetworkLease struct {
+	MAC      string
+	IP       string
+	Hostname string
+}
+
+var (
+	invalidHostnameChars = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+	domainPattern        = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+)
+
+func managedNetworkDir(bridge string) string {
+	return filepath.Join(ConfigDir(), "networks", bridge)
+}
+
+// IsManagedNetwork tells whether the bridge is managed by capstan.
+func IsManagedNetwork(bridge string) bool {
+	if bridge == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(managedNetworkDir(bridge), "network.yaml"))
+	return err == nil
+}
+
+// LoadManagedNetwork reads the managed network of the bridge.
+func LoadManagedNetwork(bridge string) (*ManagedNetwork, error) {
+	data, err := ioutil.ReadFile(filepath.Join(managedNetworkDir(bridge), "network.yaml"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Bridge %s is not managed by capstan", bridge)
+	} else if err != nil {
+		return nil, err
+	}
+	n := &ManagedNetwork{}
+	if err := yaml.Unmarshal(data, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListManagedNetworks returns all networks managed by capstan.
+func ListManagedNetworks() ([]*ManagedNetwork, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(ConfigDir(), "networks"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var networks []*ManagedNetwork
+	for _, dir := range dirs {
+		if n, err := LoadManagedNetwork(dir.Name()); err == nil {
+			networks = append(networks, n)
+		}
+	}
+	return networks, nil
+}
+
+// Validate checks the name of the bridge, the address and the domain.
+func (n *ManagedNetwork) Validate() error {
+	if n.Bridge == "" || len(n.Bridge) > 15 || strings.ContainsAny(n.Bridge, `/\ `) {
+		return fmt.Errorf("invalid bridge name '%s'", n.Bridge)
+	}
+	ip, network, err := net.ParseCIDR(n.Address)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("invalid address '%s', use e.g. %s", n.Address, DefaultManagedNetworkAddress)
+	}
+	if ones, _ := network.Mask.Size(); ones > 28 {
+		return fmt.Errorf("subnet of address %s is too small, use at most /28", n.Address)
+	}
+	if ip.Equal(network.IP) || ip.Equal(lastAddress(network)) {
+		return fmt.Errorf("address %s is not a host address of its subnet", n.Address)
+	}
+	if n.Domain != "" && !domainPattern.MatchString(n.Domain) {
+		return fmt.Errorf("invalid domain '%s'", n.Domain)
+	}
+	return nil
+}
+
+// Create stores the managed network and brings it up. The network must not
+// exist yet.
+func (n *ManagedNetwork) Create() error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	if IsManagedNetwork(n.Bridge) {
+		return fmt.Errorf("Network %s exists already", n.Bridge)
+	}
+	dir := managedNetworkDir(n.Bridge)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(n)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hosts"), nil, 0644); err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, "network.yaml"), data, 0644); err != nil {
+		return err
+	}
+	if err := n.Up(); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// Up creates the bridge unless it exists, e.g. after the host was restarted,
+// assigns the address of the host to it and starts dnsmasq unless it is
+// running. It needs the privileges to configure network devices, e.g. root.
+func (n *ManagedNetwork) Up() error {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", n.Bridge)); os.IsNotExist(err) {
+		if err := ipCommand("link", "add", "name", n.Bridge, "type", "bridge"); err != nil {
+			return err
+		}
+	}
+	if err := ipCommand("addr", "replace", n.Address, "dev", n.Bridge); err != nil {
+		return err
+	}
+	if err := ipCommand("link", "set", "dev", n.Bridge, "up"); err != nil {
+		return err
+	}
+	if n.DnsmasqPid() != 0 {
+		return nil
+	}
+
+	out, err := exec.Command("dnsmasq", n.dnsmasqArgs()...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dnsmasq failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Delete stops dnsmasq, deletes the bridge and forgets the network.
+func (n *ManagedNetwork) Delete() error {
+	if pid := n.DnsmasqPid(); pid != 0 {
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Signal(syscall.SIGTERM)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/net", n.Bridge)); err == nil {
+		if err := ipCommand("link", "del", "dev", n.Bridge); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(managedNetworkDir(n.Bridge))
+}
+
+// DnsmasqPid returns ID of the dnsmasq process of the network, zero when it
+// is not running.
+func (n *ManagedNetwork) DnsmasqPid() int {
+	data, err := ioutil.ReadFile(filepath.Join(managedNetworkDir(n.Bridge), "dnsmasq.pid"))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	if p, err := os.FindProcess(pid); err != nil || p.Signal(syscall.Signal(0)) != nil {
+		return 0
+	}
+	return pid
+}
+
+// dnsmasqArgs returns arguments of dnsmasq that serves the bridge only.
+// Lower half of the subnet is left for static addresses of the instances,
+// leases are handed out from the upper half. dnsmasq keeps running as the
+// current user, so that it can reread the hosts file of the network.
+func (n *ManagedNetwork) dnsmasqArgs() []string {
+	ip, network, _ := net.ParseCIDR(n.Address)
+	first, last := dhcpRange(network)
+	dir := managedNetworkDir(n.Bridge)
+	args := []string{
+		"--conf-file=",
+		"--user=" + currentUsername(),
+		"--strict-order",
+		"--bind-interfaces",
+		"--except-interface=lo",
+		"--interface=" + n.Bridge,
+		"--listen-address=" + ip.String(),
+		"--pid-file=" + filepath.Join(dir, "dnsmasq.pid"),
+		"--dhcp-leasefile=" + filepath.Join(dir, "leases"),
+		"--dhcp-hostsfile=" + filepath.Join(dir, "hosts"),
+		"--dhcp-range=" + first.String() + "," + last.String() + "," + net.IP(network.Mask).String() + ",12h",
+		"--dhcp-option=option:router," + ip.String(),
+		"--dhcp-authoritative",
+	}
+	if n.Domain != "" {
+		args = append(args, "--domain="+n.Domain, "--local=/"+n.Domain+"/", "--expand-hosts")
+	}
+	return args
+}
+
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+func dhcpRange(network *net.IPNet) (net.IP, net.IP) {
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	last := binary.BigEndian.Uint32(lastAddress(network))
+	first := make(net.IP, 4)
+	binary.BigEndian.PutUint32(first, base+(last-base+1)/2)
+	end := make(net.IP, 4)
+	binary.BigEndian.PutUint32(end, last-1)
+	return first, end
+}
+
+// lastAddress returns the broadcast address of the IPv4 network.
+func lastAddress(network *net.IPNet) net.IP {
+	ip := make(net.IP, 4)
+	for i, b := range network.IP.To4() {
+		ip[i] = b | ^network.Mask[len(network.Mask)-4+i]
+	}
+	return ip
+}
+
+// GuestHostname returns the hostname that dnsmasq registers for the
+// instance, characters that are not allowed in hostnames are replaced.
+func GuestHostname(instance string) string {
+	return strings.Trim(invalidHostnameChars.ReplaceAllString(instance, "-"), "-")
+}
+
+// RegisterHost makes dnsmasq of the network give the hostname of the
+// instance to the guest with the MAC address, so that other instances can
+// resolve it. Entries of the same MAC address or hostname are replaced.
+// The network is brought up first if needed.
+func (n *ManagedNetwork) RegisterHost(mac, instance string) error {
+	hostname := GuestHostname(instance)
+	return n.updateHosts(func(hosts []string) []string {
+		hosts = removeHostEntries(hosts, mac, hostname)
+		return append(hosts, mac+","+hostname)
+	})
+}
+
+// UnregisterHost removes the entry of the MAC address from dnsmasq.
+func (n *ManagedNetwork) UnregisterHost(mac string) error {
+	return n.updateHosts(func(hosts []string) []string {
+		return removeHostEntries(hosts, mac, "")
+	})
+}
+
+func removeHostEntries(hosts []string, mac, hostname string) []string {
+	var kept []string
+	for _, host := range hosts {
+		fields := strings.Split(host, ",")
+		if strings.EqualFold(fields[0], mac) || (hostname != "" && fields[len(fields)-1] == hostname) {
+			continue
+		}
+		kept = append(kept, host)
+	}
+	return kept
+}
+
+// updateHosts rewrites the hosts file of dnsmasq and makes it reread it.
+func (n *ManagedNetwork) updateHosts(update func(hosts []string) []string) error {
+	dir := managedNetworkDir(n.Bridge)
+	lock, err := LockFile(filepath.Join(ConfigDir(), "locks", "networks", n.Bridge+".lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	path := filepath.Join(dir, "hosts")
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var hosts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			hosts = append(hosts, line)
+		}
+	}
+	hosts = update(hosts)
+	content := strings.Join(hosts, "\n")
+	if len(hosts) > 0 {
+		content += "\n"
+	}
+	if err := WriteFileAtomic(path, []byte(content), 0644); err != nil {
+		return err
+	}
+
+	if n.DnsmasqPid() == 0 {
+		return n.Up()
+	}
+	p, _ := os.FindProcess(n.DnsmasqPid())
+	return p.Signal(syscall.SIGHUP)
+}
+
+// Leases returns the DHCP leases handed out by dnsmasq of the network.
+func (n *ManagedNetwork) Leases() ([]ManagedNetworkLease, error) {
+	f, err := os.Open(filepath.Join(managedNetworkDir(n.Bridge), "leases"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Each line holds expiry time, MAC address, IP address, hostname and
+	// client ID.
+	var leases []ManagedNetworkLease
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		lease := ManagedNetworkLease{MAC: fields[1], IP: fields[2]}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
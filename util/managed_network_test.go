@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestManagedNetworkValidate(t *testing.T) {
+	valid := []ManagedNetwork{
+		{Bridge: "capbr0", Address: DefaultManagedNetworkAddress},
+		{Bridge: "capbr0", Address: "172.20.0.254/16", Domain: "capstan.local"},
+	}
+	for _, n := range valid {
+		if err := n.Validate(); err != nil {
+			t.Errorf("%+v: %s", n, err)
+		}
+	}
+
+	invalid := []ManagedNetwork{
+		{Bridge: "", Address: DefaultManagedNetworkAddress},
+		{Bridge: "averyverylongbridge", Address: DefaultManagedNetworkAddress},
+		{Bridge: "capbr0", Address: "10.0.77.1"},
+		{Bridge: "capbr0", Address: "fd00::1/64"},
+		{Bridge: "capbr0", Address: "10.0.77.1/30"},
+		{Bridge: "capbr0", Address: "10.0.77.0/24"},
+		{Bridge: "capbr0", Address: "10.0.77.255/24"},
+		{Bridge: "capbr0", Address: DefaultManagedNetworkAddress, Domain: "-local"},
+	}
+	for _, n := range invalid {
+		if err := n.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", n)
+		}
+	}
+}
+
+func TestDHCPRange(t *testing.T) {
+	cases := []struct {
+		network     string
+		first, last string
+	}{
+		{"10.0.77.0/24", "10.0.77.128", "10.0.77.254"},
+		{"172.20.0.0/16", "172.20.128.0", "172.20.255.254"},
+		{"192.168.1.16/28", "192.168.1.24", "192.168.1.30"},
+	}
+	for _, c := range cases {
+		_, network, _ := net.ParseCIDR(c.network)
+		first, last := dhcpRange(network)
+		if first.String() != c.first || last.String() != c.last {
+			t.Errorf("%s: expected %s-%s, got %s-%s", c.network, c.first, c.last, first, last)
+		}
+	}
+}
+
+func TestGuestHostname(t *testing.T) {
+	for instance, expected := range map[string]string{"web": "web", "app.demo": "app-demo", "app_demo-1": "app-demo-1", ".hidden": "hidden"} {
+		if hostname := GuestHostname(instance); hostname != expected {
+			t.Errorf("%s: expected %s, got %s", instance, expected, hostname)
+		}
+	}
+}
+
+func TestRemoveHostEntries(t *testing.T) {
+	hosts := []string{"52:54:00:00:00:01,web", "52:54:00:00:00:02,db", "52:54:00:00:00:03,cache"}
+
+	kept := removeHostEntries(hosts, "52:54:00:00:00:02", "cache")
+
+	expected := []string{"52:54:00:00:00:01,web"}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Errorf("expected %v, got %v", expected, kept)
+	}
+}
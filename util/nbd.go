@@ -153,6 +153,15 @@ func (file *NbdFile) WriteInt(offset uint64, i uint32) error {
 	return file.Write(offset, buf.Bytes())
 }
 
+func (file *NbdFile) ReadInt(offset uint64) (uint32, error) {
+	data, err := file.Session.Read(offset, 4)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(data), nil
+}
+
 func (file *NbdFile) Wait() {
 	file.Cmd.Wait()
 }
@@ -283,7 +292,7 @@ func (session *NbdSession) Recv() ([]byte, error) {
 
 	if session.Req.Type == NBD_CMD_READ {
 		data := make([]byte, session.Req.Len)
-		_, err := session.Conn.Read(data)
+		_, err := io.ReadFull(session.Conn, data)
 		if err != nil {
 			return nil, err
 		}
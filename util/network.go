@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// GuestNetwork is a static network configuration of the first interface of
+// the guest, which is used instead of DHCP. IP may be given in CIDR notation,
+// e.g. 192.168.122.10/24, netmask is derived from it then.
+type GuestNetwork struct {
+	IP      string `yaml:"ip,omitempty"`
+	Netmask string `yaml:"netmask,omitempty"`
+	Gateway string `yaml:"gateway,omitempty"`
+	DNS     string `yaml:"dns,omitempty"`
+}
+
+// StaticNetworking tells whether the guest may be given a static network with
+// the networking, i.e. bridge, tap or private.
+func StaticNetworking(networking string) bool {
+	return networking == "bridge" || networking == "tap" || networking == "private"
+}
+
+// guestNetworkOptions are OSv options that configure the guest network. They
+// precede the command of the application on the command line.
+var guestNetworkOptions = []string{"--ip=", "--defaultgw=", "--nameserver="}
+
+// IsEmpty tells whether the guest uses DHCP.
+func (n GuestNetwork) IsEmpty() bool {
+	return n == GuestNetwork{}
+}
+
+// Validate checks that addresses are IPv4 addresses and that the gateway is
+// within the network of the guest.
+func (n GuestNetwork) Validate() error {
+	if n.IsEmpty() {
+		return nil
+	}
+	if n.IP == "" {
+		return fmt.Errorf("static IP must be given along with netmask, gateway or DNS")
+	}
+	ip, mask, err := n.address()
+	if err != nil {
+		return err
+	}
+	if n.Gateway != "" {
+		gateway := net.ParseIP(n.Gateway)
+		if gateway == nil || gateway.To4() == nil {
+			return fmt.Errorf("invalid gateway '%s'", n.Gateway)
+		}
+		if !ip.Mask(mask).Equal(gateway.Mask(mask)) {
+			return fmt.Errorf("gateway %s is not within the network of %s", n.Gateway, n.IP)
+		}
+	}
+	if n.DNS != "" {
+		if dns := net.ParseIP(n.DNS); dns == nil || dns.To4() == nil {
+			return fmt.Errorf("invalid DNS server '%s'", n.DNS)
+		}
+	}
+	return nil
+}
+
+// address returns IP and netmask of the guest.
+func (n GuestNetwork) address() (net.IP, net.IPMask, error) {
+	if strings.Contains(n.IP, "/") {
+		if n.Netmask != "" {
+			return nil, nil, fmt.Errorf("netmask must not be given along with IP in CIDR notation '%s'", n.IP)
+		}
+		ip, network, err := net.ParseCIDR(n.IP)
+		if err != nil || ip.To4() == nil {
+			return nil, nil, fmt.Errorf("invalid IP '%s'", n.IP)
+		}
+		return ip.To4(), network.Mask, nil
+	}
+
+	ip := net.ParseIP(n.IP)
+	if ip == nil || ip.To4() == nil {
+		return nil, nil, fmt.Errorf("invalid IP '%s'", n.IP)
+	}
+	if n.Netmask == "" {
+		return nil, nil, fmt.Errorf("netmask of IP %s is missing, give it or use CIDR notation", n.IP)
+	}
+	maskIP := net.ParseIP(n.Netmask)
+	if maskIP == nil || maskIP.To4() == nil {
+		return nil, nil, fmt.Errorf("invalid netmask '%s'", n.Netmask)
+	}
+	mask := net.IPMask(maskIP.To4())
+	if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+		return nil, nil, fmt.Errorf("invalid netmask '%s'", n.Netmask)
+	}
+	return ip.To4(), mask, nil
+}
+
+// BootOptions returns OSv options that configure the guest network, which is
+// expected to be valid.
+func (n GuestNetwork) BootOptions() string {
+	if n.IsEmpty() {
+		return ""
+	}
+	ip, mask, _ := n.address()
+	options := fmt.Sprintf("--ip=eth0,%s,%s", ip, net.IP(mask))
+	if n.Gateway != "" {
+		options += " --defaultgw=" + n.Gateway
+	}
+	if n.DNS != "" {
+		options += " --nameserver=" + n.DNS
+	}
+	return options
+}
+
+// ApplyGuestNetwork replaces options that configure the guest network at the
+// beginning of the command line with those of the given network. Options are
+// just removed when the guest uses DHCP.
+func ApplyGuestNetwork(cmdLine string, n GuestNetwork) string {
+	rest := strings.TrimLeft(cmdLine, " ")
+	for hasGuestNetworkOption(rest) {
+		end := strings.Index(rest, " ")
+		if end < 0 {
+			end = len(rest)
+		}
+		rest = strings.TrimLeft(rest[end:], " ")
+	}
+
+	if n.IsEmpty() {
+		return rest
+	}
+	if rest == "" {
+		return n.BootOptions()
+	}
+	return n.BootOptions() + " " + rest
+}
+
+func hasGuestNetworkOption(cmdLine string) bool {
+	for _, prefix := range guestNetworkOptions {
+		if strings.HasPrefix(cmdLine, prefix) {
+			return true
+		}
+	}
+	return false
+}
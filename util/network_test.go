@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"testing"
+)
+
+func TestGuestNetworkValidate(t *testing.T) {
+	valid := []GuestNetwork{
+		{},
+		{IP: "192.168.122.10/24"},
+		{IP: "192.168.122.10", Netmask: "255.255.255.0", Gateway: "192.168.122.1", DNS: "8.8.8.8"},
+	}
+	for _, n := range valid {
+		if err := n.Validate(); err != nil {
+			t.Errorf("%+v: %s", n, err)
+		}
+	}
+
+	invalid := []GuestNetwork{
+		{Gateway: "192.168.122.1"},
+		{IP: "192.168.122.10"},
+		{IP: "192.168.122.10/24", Netmask: "255.255.255.0"},
+		{IP: "fd00::10/64"},
+		{IP: "192.168.122.10", Netmask: "255.0.255.0"},
+		{IP: "192.168.122.10/24", Gateway: "10.0.0.1"},
+		{IP: "192.168.122.10/24", DNS: "dns.example.com"},
+	}
+	for _, n := range invalid {
+		if err := n.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", n)
+		}
+	}
+}
+
+func TestApplyGuestNetwork(t *testing.T) {
+	n := GuestNetwork{IP: "192.168.122.10/24", Gateway: "192.168.122.1", DNS: "192.168.122.1"}
+	options := "--ip=eth0,192.168.122.10,255.255.255.0 --defaultgw=192.168.122.1 --nameserver=192.168.122.1"
+
+	cmdLine := ApplyGuestNetwork("runscript /run/default", n)
+	if cmdLine != options+" runscript /run/default" {
+		t.Errorf("unexpected command line: %s", cmdLine)
+	}
+	// Options applied before are replaced.
+	cmdLine = ApplyGuestNetwork(cmdLine, GuestNetwork{IP: "10.0.0.2", Netmask: "255.0.0.0"})
+	if cmdLine != "--ip=eth0,10.0.0.2,255.0.0.0 runscript /run/default" {
+		t.Errorf("unexpected command line: %s", cmdLine)
+	}
+	if cmdLine = ApplyGuestNetwork(cmdLine, GuestNetwork{}); cmdLine != "runscript /run/default" {
+		t.Errorf("unexpected command line: %s", cmdLine)
+	}
+}
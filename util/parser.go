@@ -1,7 +1,9 @@
 package util
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -33,11 +35,162 @@ func ParseEnvironmentList(envList []string) (map[string]string, error) {
 			return nil, fmt.Errorf("failed to parse --env argument '%s': missing =", part)
 		} else if strings.Contains(keyValue[0], " ") {
 			return nil, fmt.Errorf("failed to parse --env argument '%s': key must not contain spaces", part)
-		} else if strings.Contains(keyValue[1], " ") {
-			return nil, fmt.Errorf("failed to parse --env argument '%s': value must not contain spaces", part)
+		} else if strings.Contains(keyValue[1], "\n") {
+			return nil, fmt.Errorf("failed to parse --env argument '%s': value must not contain newlines", part)
 		} else {
 			res[keyValue[0]] = keyValue[1]
 		}
 	}
 	return res, nil
 }
+
+// FormatEnvArg returns OSv --env argument that sets the variable using the
+// given operator ('=' or '?='). The argument is quoted when the value contains
+// spaces, quotes or backslashes so that OSv parses it as a single token, or
+// command separators ';', '&' and '!' so that they do not end the command.
+func FormatEnvArg(key, operator, value string) string {
+	arg := fmt.Sprintf("--env=%s%s%s", key, operator, value)
+	if !strings.ContainsAny(value, " \t\"'\\;&!") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// LeadingToken returns the first token of the OSv command line, respecting
+// double quotes and backslash escapes inside them.
+func LeadingToken(cmdLine string) string {
+	quoted := false
+	for i := 0; i < len(cmdLine); i++ {
+		switch {
+		case quoted && cmdLine[i] == '\\':
+			i++
+		case cmdLine[i] == '"':
+			quoted = !quoted
+		case cmdLine[i] == ' ' && !quoted:
+			return cmdLine[:i]
+		}
+	}
+	return cmdLine
+}
+
+// SplitCmdLineOptions splits the OSv command line into options of the kernel
+// at its beginning, e.g. --env=K=V or "--env=K=a b", and the rest of it.
+func SplitCmdLineOptions(cmdLine string) ([]string, string) {
+	var options []string
+	rest := strings.TrimSpace(cmdLine)
+	for strings.HasPrefix(rest, "--") || strings.HasPrefix(rest, `"--`) {
+		token := LeadingToken(rest)
+		options = append(options, token)
+		rest = strings.TrimLeft(rest[len(token):], " ")
+	}
+	return options, rest
+}
+
+// ParseEnvFile reads KEY=VALUE pairs from the dotenv file. Empty lines and
+// lines starting with # are skipped, 'export ' prefix and quotes around the
+// value are removed.
+func ParseEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing =", path, lineNo)
+		}
+		key := strings.TrimSpace(keyValue[0])
+		value := strings.TrimSpace(keyValue[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if key == "" || strings.Contains(key, " ") {
+			return nil, fmt.Errorf("%s:%d: invalid key '%s'", path, lineNo, key)
+		}
+		res[key] = value
+	}
+	return res, scanner.Err()
+}
+
+// labelPattern restricts keys and values of instance labels.
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// ParseLabels parses key=value labels of an instance.
+func ParseLabels(labelList []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, part := range labelList {
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) < 2 {
+			return nil, fmt.Errorf("failed to parse label '%s': missing =", part)
+		}
+		if !labelPattern.MatchString(keyValue[0]) || (keyValue[1] != "" && !labelPattern.MatchString(keyValue[1])) {
+			return nil, fmt.Errorf("failed to parse label '%s': only letters, digits and ._/- are allowed", part)
+		}
+		labels[keyValue[0]] = keyValue[1]
+	}
+	return labels, nil
+}
+
+// LabelSelector selects instances by their labels. Each requirement is one of
+// key=value, key!=value, key (label is set) and !key (label is not set); all
+// of them must hold.
+type LabelSelector []labelRequirement
+
+type labelRequirement struct {
+	key   string
+	op    string
+	value string
+}
+
+// ParseLabelSelector parses comma-separated requirements, e.g. "env=test,!keep".
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var s LabelSelector
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		r := labelRequirement{key: part, op: "exists"}
+		if keyValue := strings.SplitN(part, "!=", 2); len(keyValue) == 2 {
+			r = labelRequirement{key: keyValue[0], op: "!=", value: keyValue[1]}
+		} else if keyValue := strings.SplitN(part, "=", 2); len(keyValue) == 2 {
+			r = labelRequirement{key: keyValue[0], op: "=", value: keyValue[1]}
+		} else if strings.HasPrefix(part, "!") {
+			r = labelRequirement{key: part[1:], op: "!exists"}
+		}
+		if !labelPattern.MatchString(r.key) {
+			return nil, fmt.Errorf("invalid label selector '%s'", part)
+		}
+		s = append(s, r)
+	}
+	return s, nil
+}
+
+// Matches tells whether the labels satisfy all requirements of the selector.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.key]
+		var matches bool
+		switch r.op {
+		case "=":
+			matches = ok && value == r.value
+		case "!=":
+			matches = !ok || value != r.value
+		case "exists":
+			matches = ok
+		case "!exists":
+			matches = !ok
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
@@ -51,3 +51,52 @@ func TestParseMemSizeErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels([]string{"env=test", "team=core/db", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 3 || labels["env"] != "test" || labels["team"] != "core/db" || labels["empty"] != "" {
+		t.Errorf("capstan: unexpected labels %v", labels)
+	}
+
+	for _, label := range []string{"env", "=test", "env=a b"} {
+		if _, err := ParseLabels([]string{label}); err == nil {
+			t.Errorf("capstan: expected error for label '%s'", label)
+		}
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"env": "test", "team": "core"}
+	m := map[string]bool{
+		"env=test":           true,
+		"env=prod":           false,
+		"env!=prod":          true,
+		"env!=test":          false,
+		"owner!=me":          true,
+		"team":               true,
+		"owner":              false,
+		"!owner":             true,
+		"!team":              false,
+		"env=test, team":     true,
+		"env=test,team=misc": false,
+	}
+	for selector, expected := range m {
+		s, err := ParseLabelSelector(selector)
+		if err != nil {
+			t.Errorf("capstan: %v", err)
+			continue
+		}
+		if s.Matches(labels) != expected {
+			t.Errorf("capstan: selector '%s' matching %v: want %v", selector, labels, expected)
+		}
+	}
+
+	for _, selector := range []string{"", "env=test,", "!"} {
+		if _, err := ParseLabelSelector(selector); err == nil {
+			t.Errorf("capstan: expected error for selector '%s'", selector)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func ThreadProcessID(tid int) (int, error) {
+	return 0, fmt.Errorf("process statistics are not supported on %s", runtime.GOOS)
+}
+
+func GetProcessStats(pid int) (*ProcessStats, error) {
+	return nil, fmt.Errorf("process statistics are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc.
+const clockTicks = 100
+
+// ThreadProcessID returns ID of the process that the thread belongs to.
+func ThreadProcessID(tid int) (int, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "Tgid:") {
+			return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "Tgid:")))
+		}
+	}
+	return 0, fmt.Errorf("no process ID of thread %d", tid)
+}
+
+// GetProcessStats reads statistics of the process from /proc.
+func GetProcessStats(pid int) (*ProcessStats, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	return parseProcessStat(string(data))
+}
+
+// parseProcessStat parses the content of /proc/<pid>/stat, see proc(5).
+func parseProcessStat(stat string) (*ProcessStats, error) {
+	// The command name may contain spaces and parentheses.
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return nil, fmt.Errorf("invalid process stat: %s", stat)
+	}
+	// Fields start with the state, which is the third field.
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("invalid process stat: %s", stat)
+	}
+
+	var values [4]int64
+	for i, field := range []int{14, 15, 20, 24} {
+		v, err := strconv.ParseInt(fields[field-3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid process stat: %s", err)
+		}
+		values[i] = v
+	}
+	return &ProcessStats{
+		CPUTime: time.Duration(values[0]+values[1]) * time.Second / clockTicks,
+		Threads: int(values[2]),
+		RSS:     values[3] * int64(os.Getpagesize()),
+	}, nil
+}
@@ -0,0 +1,35 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseProcessStat(t *testing.T) {
+	stat := "4242 (qemu (x86) 2) S 1 4242 4242 0 -1 4194560 12 0 0 0 250 50 0 0 20 0 7 0 100 1000000 2048 18446744073709551615"
+	stats, err := parseProcessStat(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CPUTime != 3*time.Second {
+		t.Errorf("expected CPU time 3s, got %s", stats.CPUTime)
+	}
+	if stats.Threads != 7 {
+		t.Errorf("expected 7 threads, got %d", stats.Threads)
+	}
+	if stats.RSS != 2048*int64(os.Getpagesize()) {
+		t.Errorf("expected RSS of 2048 pages, got %d bytes", stats.RSS)
+	}
+
+	if _, err := parseProcessStat("4242 (qemu) S 1"); err == nil {
+		t.Error("expected error for truncated stat")
+	}
+}
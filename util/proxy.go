@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"os"
+	"strings"
+)
+
+// ProxySettings configure the proxy for remote repositories, pulling of
+// images and uploads to clouds. Settings that are not given are taken from
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+type ProxySettings struct {
+	HTTP  string `yaml:"http"`
+	HTTPS string `yaml:"https"`
+	// NoProxy is a comma separated list of hosts and domains that are
+	// accessed directly, e.g. "localhost,.internal.example.com".
+	NoProxy string `yaml:"no_proxy"`
+}
+
+// Apply exports the settings into the environment of the process, so that
+// both Capstan and the tools it runs (e.g. git, curl and gsutil) use them.
+// It must be called before the first request is made. HTTPS proxy defaults
+// to the HTTP one.
+func (p ProxySettings) Apply() {
+	https := p.HTTPS
+	if https == "" {
+		https = p.HTTP
+	}
+
+	for _, v := range []struct{ name, value string }{
+		{"HTTP_PROXY", p.HTTP},
+		{"HTTPS_PROXY", https},
+		{"NO_PROXY", p.NoProxy},
+	} {
+		if v.value == "" {
+			continue
+		}
+		os.Setenv(v.name, v.value)
+		os.Setenv(strings.ToLower(v.name), v.value)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/util"
+	. "gopkg.in/check.v1"
+)
+
+type proxySuite struct{}
+
+var _ = Suite(&proxySuite{})
+
+func (*proxySuite) TearDownTest(c *C) {
+	for _, env := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy", "CAPSTAN_ROOT"} {
+		os.Unsetenv(env)
+	}
+}
+
+func (*proxySuite) TestApply(c *C) {
+	m := []struct {
+		comment  string
+		env      map[string]string
+		settings util.ProxySettings
+		expected map[string]string
+	}{
+		{
+			"https defaults to http",
+			map[string]string{},
+			util.ProxySettings{HTTP: "http://proxy:3128", NoProxy: "localhost"},
+			map[string]string{"HTTP_PROXY": "http://proxy:3128", "https_proxy": "http://proxy:3128", "NO_PROXY": "localhost"},
+		},
+		{
+			"environment is kept when not configured",
+			map[string]string{"HTTPS_PROXY": "http://env:8080", "NO_PROXY": ".example.com"},
+			util.ProxySettings{},
+			map[string]string{"HTTPS_PROXY": "http://env:8080", "NO_PROXY": ".example.com"},
+		},
+		{
+			"configuration precedes environment",
+			map[string]string{"HTTPS_PROXY": "http://env:8080"},
+			util.ProxySettings{HTTPS: "http://secure:3129"},
+			map[string]string{"HTTPS_PROXY": "http://secure:3129", "https_proxy": "http://secure:3129"},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		for k, v := range args.env {
+			os.Setenv(k, v)
+		}
+
+		// This is what we're testing here.
+		args.settings.Apply()
+
+		// Expectations.
+		for k, v := range args.expected {
+			c.Check(os.Getenv(k), Equals, v)
+		}
+	}
+}
+
+func (*proxySuite) TestLoadCapstanSettings(c *C) {
+	root := c.MkDir()
+	config := "proxy:\n  http: http://proxy:3128\n  no_proxy: localhost,.internal\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "config.yaml"), []byte(config), 0644), IsNil)
+
+	// This is what we're testing here.
+	settings := util.LoadCapstanSettings(root)
+
+	// Expectations.
+	c.Check(settings.Proxy, DeepEquals, util.ProxySettings{HTTP: "http://proxy:3128", NoProxy: "localhost,.internal"})
+}
@@ -11,6 +11,7 @@ package util
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -35,39 +36,79 @@ type Repo struct {
 	URL        string
 	Path       string
 	DisableKvm bool
+	Qcow2      Qcow2Options
+	// Repositories are URLs of enabled remote repositories in the order they
+	// are searched. URL is the first of them.
+	Repositories []string
+	// PackagesDir overrides the directory of local packages, e.g. with the
+	// vendor directory of a package.
+	PackagesDir string
+	// DownloadConcurrency is the number of packages downloaded at once.
+	DownloadConcurrency int
+	// progress tracks concurrent downloads while they are in progress.
+	progress *downloadProgress
 }
 
 type CapstanSettings struct {
-	RepoUrl    string `yaml:"repo_url"`
-	DisableKvm bool   `yaml:"disable_kvm"`
+	RepoUrl             string             `yaml:"repo_url"`
+	Repositories        []RemoteRepository `yaml:"repositories"`
+	DisableKvm          bool               `yaml:"disable_kvm"`
+	Qcow2               Qcow2Options       `yaml:"qcow2"`
+	DownloadConcurrency int                `yaml:"download_concurrency"`
+	Proxy               ProxySettings      `yaml:"proxy"`
+	MACPrefix           string             `yaml:"mac_prefix"`
 }
 
-func NewRepo(url string) *Repo {
-	root := os.Getenv("CAPSTAN_ROOT")
-	if root == "" {
-		root = filepath.Join(HomePath(), "/.capstan/")
-	}
+// RemoteRepository is an entry of the list of remote repositories in the
+// configuration file. Repositories are searched in the order they are listed.
+type RemoteRepository struct {
+	URL      string `yaml:"url"`
+	Disabled bool   `yaml:"disabled"`
+}
 
-	// Read configuration file
+// LoadCapstanSettings reads config.yaml of the given Capstan root. Missing
+// or invalid file results in default settings.
+func LoadCapstanSettings(root string) CapstanSettings {
 	config := CapstanSettings{
 		RepoUrl:    "",
 		DisableKvm: false,
 	}
 	data, err := ioutil.ReadFile(filepath.Join(root, "config.yaml"))
 	if err == nil {
-		err = yaml.Unmarshal(data, &config)
+		yaml.Unmarshal(data, &config)
 	}
+	return config
+}
+
+func NewRepo(url string) *Repo {
+	root := CapstanRoot()
+
+	// Read configuration file
+	config := LoadCapstanSettings(root)
 
 	// Decide which repo URL to choose. Take first non-empty value of:
 	// 1. -u
-	// 2. Capstan.yaml, if contains CAPSTAN_REPO_URL
+	// 2. Capstan.yaml, if contains enabled repositories or CAPSTAN_REPO_URL
 	// 3. Env variable CAPSTAN_REPO_URL
 	// 4. Default
 	// Config file preceeds Env variable to enable per-capstan-root config.
+	var repositories []string
+	for _, repository := range config.Repositories {
+		if !repository.Disabled && repository.URL != "" {
+			repositories = append(repositories, repository.URL)
+		}
+	}
+	// Repository given with -u is the only one searched.
+	if url != "" {
+		repositories = nil
+	}
 	url = func(flagUrl string) string {
 		if flagUrl != "" {
 			return flagUrl
 		}
+		if len(repositories) > 0 {
+			return repositories[0]
+		}
 		if config.RepoUrl != "" {
 			return config.RepoUrl
 		}
@@ -82,28 +123,117 @@ func NewRepo(url string) *Repo {
 		config.DisableKvm = envDisableKvm
 	}
 
+	if len(repositories) == 0 {
+		repositories = []string{url}
+	}
+
 	return &Repo{
-		URL:        url,
-		Path:       root,
-		DisableKvm: config.DisableKvm,
+		URL:                 url,
+		Path:                root,
+		DisableKvm:          config.DisableKvm,
+		Qcow2:               config.Qcow2,
+		Repositories:        repositories,
+		DownloadConcurrency: config.DownloadConcurrency,
 	}
 }
 
+// RemoteURLs returns URLs of remote repositories in the order they are
+// searched.
+func (r *Repo) RemoteURLs() []string {
+	if len(r.Repositories) == 0 || r.Repositories[0] != r.URL {
+		return []string{r.URL}
+	}
+	return r.Repositories
+}
+
 type ImageInfo struct {
 	FormatVersion string `yaml:"format_version"`
 	Version       string
 	Created       string
 	Description   string
 	Build         string
+	// Checksums are digests of the image files by hypervisor, in form of
+	// <algorithm>:<hex>.
+	Checksums map[string]string `yaml:"checksums,omitempty"`
+	// Filesystem is the root filesystem of composed images, ZFS unless
+	// given.
+	Filesystem string `yaml:"filesystem,omitempty"`
+	// Loader and LoaderVersion are the loader image that the image was
+	// composed from and its version, if known.
+	Loader        string `yaml:"loader,omitempty"`
+	LoaderVersion string `yaml:"loader_version,omitempty"`
+	// CPUFeatures are required by the image, they are verified before its
+	// instances are launched.
+	CPUFeatures []string `yaml:"cpu_features,omitempty"`
+}
+
+// imageInfo reads the information of the image in the local repository.
+func (r *Repo) imageInfo(image string) (ImageInfo, error) {
+	var info ImageInfo
+	data, err := ioutil.ReadFile(filepath.Join(r.RepoPath(), image, "index.yaml"))
+	if err != nil {
+		return info, err
+	}
+	err = yaml.Unmarshal(data, &info)
+	return info, err
 }
 
 func (r *Repo) PrintRepo() {
 	fmt.Printf("CAPSTAN_ROOT: %s\n", r.Path)
 	fmt.Printf("CAPSTAN_REPO_URL: %s\n", r.URL)
+	if urls := r.RemoteURLs(); len(urls) > 1 {
+		fmt.Printf("CAPSTAN_REPOSITORIES: %s\n", strings.Join(urls, ", "))
+	}
 	fmt.Printf("CAPSTAN_DISABLE_KVM: %v\n", r.DisableKvm)
+	for _, env := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		if value := os.Getenv(env); value != "" {
+			fmt.Printf("%s: %s\n", env, value)
+		}
+	}
+	fmt.Printf("QCOW2_PREALLOCATION: %s\n", r.Qcow2.Preallocation)
+	fmt.Printf("QCOW2_CLUSTER_SIZE: %s\n", r.Qcow2.ClusterSize)
+	fmt.Printf("QCOW2_COMPRESS: %v\n", r.Qcow2.Compress)
 }
 
 func (r *Repo) ImportImage(imageName string, file string, version string, created string, description string, build string) error {
+	info := ImageInfo{
+		FormatVersion: "1",
+		Version:       version,
+		Created:       created,
+		Description:   description,
+		Build:         build,
+	}
+	lock, err := r.LockImage(imageName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return r.importImage(imageName, file, info, true)
+}
+
+// importImage imports the image and writes its index. Checksum of the image
+// is recorded only when asked for, as images that are composed afterwards
+// would not match it anymore.
+func (r *Repo) importImage(imageName string, file string, info ImageInfo, checksum bool) error {
+	// Compressed images are decompressed into a temporary file first.
+	if compression, err := DetectCompression(file); err == nil && compression != CompressionNone {
+		if err := os.MkdirAll(r.RepoPath(), 0775); err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile(r.RepoPath(), "import")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		fmt.Printf("Decompressing %s...\n", file)
+		if err := DecompressFile(file, tmp.Name()); err != nil {
+			return err
+		}
+		file = tmp.Name()
+	}
+
 	format, err := image.Probe(file)
 	if err != nil {
 		return err
@@ -121,12 +251,18 @@ func (r *Repo) ImportImage(imageName string, file string, version string, create
 	default:
 		return fmt.Errorf("%s: unsupported image format", file)
 	}
+	return r.storeImage(imageName, file, hypervisor, info, checksum)
+}
+
+// storeImage copies the image file of the hypervisor into the repository and
+// writes its index.
+func (r *Repo) storeImage(imageName string, file string, hypervisor string, info ImageInfo, checksum bool) error {
 	if _, err := os.Stat(file); os.IsNotExist(err) {
 		return errors.New(fmt.Sprintf("%s: no such file", file))
 	}
 	fmt.Printf("Importing %s...\n", imageName)
 	dir := filepath.Dir(r.ImagePath(hypervisor, imageName))
-	err = os.MkdirAll(dir, 0775)
+	err := os.MkdirAll(dir, 0775)
 	if err != nil {
 		return errors.New(fmt.Sprintf("%s: mkdir failed", dir))
 	}
@@ -138,12 +274,15 @@ func (r *Repo) ImportImage(imageName string, file string, version string, create
 	if err != nil {
 		return err
 	}
-	info := ImageInfo{
-		FormatVersion: "1",
-		Version:       version,
-		Created:       created,
-		Description:   description,
-		Build:         build,
+	if checksum {
+		sum, err := FileChecksum(dst)
+		if err != nil {
+			return err
+		}
+		info.Checksums = map[string]string{hypervisor: sum}
+		if err := WriteBlockIndex(dst); err != nil {
+			return err
+		}
 	}
 	value, err := yaml.Marshal(info)
 	if err != nil {
@@ -179,20 +318,30 @@ func (r *Repo) PackageExists(packageName string) bool {
 }
 
 func (r *Repo) RemoveImage(image string) error {
+	lock, err := r.LockImage(image)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	path := filepath.Join(r.RepoPath(), image)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return errors.New(fmt.Sprintf("%s: no such image\n", image))
 	}
 	fmt.Printf("Removing %s...\n", image)
-	err := os.RemoveAll(path)
-	return err
+	return os.RemoveAll(path)
 }
 
 func (r *Repo) RepoPath() string {
 	return filepath.Join(r.Path, "repository")
 }
 
+// PackagesPath returns the directory of local packages, either the packages
+// directory of Capstan root or PackagesDir when set.
 func (r *Repo) PackagesPath() string {
+	if r.PackagesDir != "" {
+		return r.PackagesDir
+	}
 	return filepath.Join(r.Path, "packages")
 }
 
@@ -204,12 +353,78 @@ func (r *Repo) ImageCachePath(hypervisor string, image string) string {
 	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.cache", filepath.Base(image), hypervisor))
 }
 
+// ImageContentsPath returns path to the list of files that were uploaded onto the image.
+func (r *Repo) ImageContentsPath(hypervisor string, image string) string {
+	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.contents", filepath.Base(image), hypervisor))
+}
+
+// ImageSupervisionPath returns path to the health check and restart policy of the image.
+func (r *Repo) ImageSupervisionPath(hypervisor string, image string) string {
+	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.supervision", filepath.Base(image), hypervisor))
+}
+
+// ImageResourcesPath returns path to the resources that the image needs.
+func (r *Repo) ImageResourcesPath(hypervisor string, image string) string {
+	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.resources", filepath.Base(image), hypervisor))
+}
+
+// ImageSecretsPath returns path to the definitions of secrets that are passed to the image when run.
+func (r *Repo) ImageSecretsPath(hypervisor string, image string) string {
+	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.secrets", filepath.Base(image), hypervisor))
+}
+
+// ImageArgsCmdPath returns path to the boot command of the image that accepts additional arguments.
+func (r *Repo) ImageArgsCmdPath(hypervisor string, image string) string {
+	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.argscmd", filepath.Base(image), hypervisor))
+}
+
+// ImageConfigSetsPath returns path to the list of config sets available in the image.
+func (r *Repo) ImageConfigSetsPath(hypervisor string, image string) string {
+	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.configsets", filepath.Base(image), hypervisor))
+}
+
+// PackageHash returns checksum of the package file in form of sha256:<hex>.
+func (r *Repo) PackageHash(packageName string) (string, error) {
+	return FileChecksum(r.PackagePath(packageName))
+}
+
+// FileChecksum returns SHA256 digest of the file in form of sha256:<hex>.
+func FileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return formatChecksum(hash.Sum(nil)), nil
+}
+
+func formatChecksum(sum []byte) string {
+	return fmt.Sprintf("sha256:%x", sum)
+}
+
+// VerifyChecksum checks that the actual checksum of the named file matches
+// the expected one.
+func VerifyChecksum(name, expected, actual string) error {
+	if !strings.HasPrefix(expected, "sha256:") {
+		return fmt.Errorf("%s: unsupported checksum '%s', expected sha256:<hex>", name, expected)
+	}
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("%s: checksum mismatch, expected %s, got %s", name, expected, actual)
+	}
+	return nil
+}
+
 func (r *Repo) PackagePath(packageName string) string {
-	return filepath.Join(r.Path, "packages", fmt.Sprintf("%s.mpm", packageName))
+	return filepath.Join(r.PackagesPath(), fmt.Sprintf("%s.mpm", packageName))
 }
 
 func (r *Repo) PackageManifest(packageName string) string {
-	return filepath.Join(r.Path, "packages", fmt.Sprintf("%s.yaml", packageName))
+	return filepath.Join(r.PackagesPath(), fmt.Sprintf("%s.yaml", packageName))
 }
 
 func (r *Repo) ListImages() {
@@ -259,6 +474,21 @@ func (r *Repo) ListPackages() {
 	}
 }
 
+// LocalPackageNames returns names of all packages in the local repository.
+func (r *Repo) LocalPackageNames() []string {
+	var names []string
+	packages, _ := ioutil.ReadDir(r.PackagesPath())
+	for _, p := range packages {
+		if filepath.Ext(p.Name()) == ".yaml" {
+			name := strings.TrimSuffix(p.Name(), ".yaml")
+			if r.PackageExists(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
 func (r *Repo) DefaultImage() string {
 	if !core.IsTemplateFile("Capstanfile") {
 		return ""
@@ -277,7 +507,7 @@ func (r *Repo) InitializeImage(loaderImage string, imageName string, imageSize i
 	//
 	// capstan import mike/osv-loader /path/to/osv/build/release/loader.img
 	if loaderImage == "" {
-		loaderImage = "mike/osv-loader"
+		loaderImage = DefaultLoaderImage(FilesystemZFS)
 	}
 
 	// Get the actual path of the loader image.
@@ -315,7 +545,7 @@ func (r *Repo) InitializeImage(loaderImage string, imageName string, imageSize i
 
 	// Convert the image to QCOW2 format. This will prevent the image file from
 	// becoming to large in the next step when we actually resize it.
-	if err := ConvertImageToQCOW2(imagePath); err != nil {
+	if err := ConvertImageToQCOW2(imagePath, r.Qcow2); err != nil {
 		return err
 	}
 
@@ -326,20 +556,27 @@ func (r *Repo) InitializeImage(loaderImage string, imageName string, imageSize i
 	}
 
 	// Now that the partition has been created, resize the virtual image size.
-	if err := ResizeImage(imagePath, uint64(zfsSize+zfsStart)); err != nil {
+	if err := ResizeImage(imagePath, uint64(zfsSize+zfsStart), r.Qcow2); err != nil {
 		fmt.Printf("Failed to set the target size (%db) of the image %s\n", (zfsSize + zfsStart), imagePath)
 		return err
 	}
 
-	// The image can now be imported into Capstan's repository.
-	return r.ImportImage(imageName, imagePath, "", time.Now().Format(time.RFC3339), "", "")
+	// The image can now be imported into Capstan's repository. Its checksum is
+	// not recorded since the image is yet to be composed.
+	info := ImageInfo{
+		FormatVersion: "1",
+		Created:       time.Now().Format(time.RFC3339),
+		Loader:        loaderImage,
+		LoaderVersion: r.LoaderVersion(loaderImage),
+	}
+	return r.importImage(imageName, imagePath, info, false)
 }
 
 func (r *Repo) ImportPackage(pkg core.Package, packagePath string) error {
 	fmt.Printf("Importing package %s...\n", packagePath)
 
 	// Get the root of the packages dir.
-	dir := filepath.Join(r.Path, "packages")
+	dir := r.PackagesPath()
 
 	// Make sure the path exists by creating the entire directory structure.
 	err := os.MkdirAll(dir, 0775)
@@ -359,6 +596,18 @@ func (r *Repo) ImportPackage(pkg core.Package, packagePath string) error {
 		return err
 	}
 
+	// Record checksum of the package so that its downloads can be verified
+	// once the repository is published.
+	pkg.Checksum, err = FileChecksum(target)
+	if err == nil {
+		err = WriteBlockIndex(target)
+	}
+	if err != nil {
+		os.Remove(target)
+
+		return err
+	}
+
 	// Store package metadata descriptor into the repository.
 	d, err := yaml.Marshal(pkg)
 	if err != nil {
@@ -398,8 +647,12 @@ func (r *Repo) GetPackageTarReader(pkgname string) (*tar.Reader, error) {
 	if err != nil {
 		return nil, err
 	}
+	return PackageTarReader(reader)
+}
 
-	// Load package (tar.gz or tar supported).
+// PackageTarReader returns tar reader for the package content, which is
+// either tar.gz or tar.
+func PackageTarReader(reader io.ReadSeeker) (*tar.Reader, error) {
 	if gzReader, err := gzip.NewReader(reader); err == nil {
 		return tar.NewReader(gzReader), nil
 	} else if err == gzip.ErrHeader {
@@ -410,33 +663,44 @@ func (r *Repo) GetPackageTarReader(pkgname string) (*tar.Reader, error) {
 	}
 }
 
+// GetPackageDependencies returns all packages that the given package requires,
+// directly or through other packages. Versions of the packages are resolved
+// first so that all version constraints hold.
 func (r *Repo) GetPackageDependencies(pkg core.Package, downloadMissing bool) ([]core.Package, error) {
+	if _, err := r.ResolvePackageVersions(pkg, downloadMissing); err != nil {
+		return nil, err
+	}
+	return r.collectDependencies(pkg)
+}
+
+// GetLockedPackageDependencies is like GetPackageDependencies, except that
+// the packages must be the ones recorded in the lock file.
+func (r *Repo) GetLockedPackageDependencies(pkg core.Package, downloadMissing bool, lock core.LockFile) ([]core.Package, error) {
+	if _, err := r.ResolveLockedPackageVersions(pkg, downloadMissing, lock); err != nil {
+		return nil, err
+	}
+	return r.collectDependencies(pkg)
+}
+
+// collectDependencies returns required packages of the given package from the
+// local repository, each followed by its own required packages.
+func (r *Repo) collectDependencies(pkg core.Package) ([]core.Package, error) {
 	var dependencies []core.Package
 
-	for _, requiredPackage := range pkg.Require {
-		// If the package does not exist in the local repository and the request
-		// was made to download missing packages we should try to download them
-		// from the remote repository.
-		if !r.PackageExists(requiredPackage) {
-			if downloadMissing {
-				if err := r.DownloadPackage(r.URL, requiredPackage); err != nil {
-					return nil, err
-				}
-			} else {
-				return nil, fmt.Errorf("Package %s does not exist in your local repository. Pull it manually using "+
-					"'capstan package pull %s' or enable automatic pulling of missing "+
-					"packages by adding --pull-missing flag", requiredPackage, requiredPackage)
-			}
+	for _, require := range pkg.Require {
+		req, err := core.ParseRequirement(require)
+		if err != nil {
+			return nil, err
 		}
 
 		// Proceed with the evaluation of the package content.
-		rpkg, err := core.ParsePackageManifest(r.PackageManifest(requiredPackage))
+		rpkg, err := core.ParsePackageManifest(r.PackageManifest(req.Name))
 		if err != nil {
 			return nil, err
 		}
 
 		// Process all additional required packages.
-		rdeps, err := r.GetPackageDependencies(rpkg, downloadMissing)
+		rdeps, err := r.collectDependencies(rpkg)
 		if err != nil {
 			return nil, err
 		}
@@ -9,9 +9,21 @@
 package util_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/mikelangelo-project/capstan/core"
 	"github.com/mikelangelo-project/capstan/util"
 	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type suite struct {
@@ -33,3 +45,388 @@ func (s *suite) TestPackagePath(c *C) {
 	path := s.repo.PackagePath("package")
 	c.Assert(path, Equals, filepath.Join(util.HomePath(), ".capstan", "packages", "package.mpm"))
 }
+
+func (s *suite) TestGetPackageDependenciesVersions(c *C) {
+	s.repo.Path = c.MkDir()
+	writeLocalPackage(c, s.repo, "openjdk8", "1.1")
+
+	m := []struct {
+		require string
+		err     string
+	}{
+		{"openjdk8", ""},
+		{"openjdk8>=1.1", ""},
+		{"openjdk8 ^1.0", ""},
+		{"openjdk8<1.10", ""},
+		{"openjdk8>=1.2", "(?s)No version of package openjdk8 satisfies all requirements:\n" +
+			"  app requires openjdk8 >=1.2\n" +
+			"Available versions: 1.1 \\(local\\)\n" +
+			"Add --pull-missing flag .*"},
+		{"openjdk8>=", "invalid version constraint .*"},
+		{"openjdk9", "Package openjdk9 does not exist in your local repository.*"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.require)
+
+		// This is what we're testing here.
+		deps, err := s.repo.GetPackageDependencies(core.Package{Name: "app", Require: []string{args.require}}, false)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+		} else {
+			c.Assert(err, IsNil)
+			c.Check(deps, HasLen, 1)
+			c.Check(deps[0].Name, Equals, "openjdk8")
+		}
+	}
+}
+
+func (s *suite) TestResolvePackageVersionsConflict(c *C) {
+	s.repo.Path = c.MkDir()
+	writeLocalPackage(c, s.repo, "osv.cli", "1.3")
+	writeLocalPackage(c, s.repo, "osv.httpserver", "2.0", "osv.cli <1.0")
+
+	// This is what we're testing here.
+	_, err := s.repo.ResolvePackageVersions(core.Package{Name: "app", Require: []string{"osv.cli ^1.2", "osv.httpserver"}}, false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "(?s)No version of package osv.cli satisfies all requirements:\n"+
+		"  app requires osv.cli \\^1.2\n"+
+		"  osv.httpserver requires osv.cli <1.0\n"+
+		"Available versions: 1.3 \\(local\\).*")
+}
+
+func (s *suite) TestResolvePackageVersionsRemote(c *C) {
+	s.repo.Path = c.MkDir()
+	writeLocalPackage(c, s.repo, "osv.cli", "1.3")
+
+	// Remote repository has a newer osv.cli and osv.httpserver requiring it.
+	files := map[string]string{
+		"/packages/osv.cli.yaml":        "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 2.1\n",
+		"/packages/osv.cli.mpm":         "cli",
+		"/packages/osv.httpserver.yaml": "name: osv.httpserver\ntitle: HTTP\nauthor: a\nversion: 3.0\nrequire:\n - osv.cli >=2\n",
+		"/packages/osv.httpserver.mpm":  "httpserver",
+	}
+	server := serveRepository(files)
+	defer server.Close()
+	s.repo.URL = server.URL + "/"
+
+	// This is what we're testing here.
+	packages, err := s.repo.ResolvePackageVersions(core.Package{Name: "app", Require: []string{"osv.cli ^1 || ^2", "osv.httpserver"}}, true)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(packages["osv.cli"].Version, Equals, "2.1")
+	c.Check(packages["osv.httpserver"].Version, Equals, "3.0")
+	local, err := core.ParsePackageManifest(s.repo.PackageManifest("osv.cli"))
+	c.Assert(err, IsNil)
+	c.Check(local.Version, Equals, "2.1")
+}
+
+func (s *suite) TestResolvePackageVersionsRepositories(c *C) {
+	s.repo.Path = c.MkDir()
+
+	// Repositories are searched in order, the first one has an older osv.cli.
+	first := serveRepository(map[string]string{
+		"/packages/osv.cli.yaml": "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 1.0\n",
+		"/packages/osv.cli.mpm":  "cli",
+	})
+	defer first.Close()
+	second := serveRepository(map[string]string{
+		"/packages/osv.cli.yaml":        "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 2.0\n",
+		"/packages/osv.cli.mpm":         "cli",
+		"/packages/osv.httpserver.yaml": "name: osv.httpserver\ntitle: HTTP\nauthor: a\nversion: 1.0\n",
+		"/packages/osv.httpserver.mpm":  "httpserver",
+	})
+	defer second.Close()
+	s.repo.URL = first.URL + "/"
+	s.repo.Repositories = []string{first.URL + "/", second.URL + "/"}
+
+	// This is what we're testing here.
+	packages, err := s.repo.ResolvePackageVersions(core.Package{Name: "app", Require: []string{"osv.cli", "osv.httpserver"}}, true)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(packages["osv.cli"].Version, Equals, "1.0")
+	c.Check(packages["osv.httpserver"].Version, Equals, "1.0")
+
+	// Version that only the second repository provides.
+	s.repo.Path = c.MkDir()
+	packages, err = s.repo.ResolvePackageVersions(core.Package{Name: "app", Require: []string{"osv.cli >=2"}}, true)
+	c.Assert(err, IsNil)
+	c.Check(packages["osv.cli"].Version, Equals, "2.0")
+
+	// Conflicts list versions of all repositories.
+	_, err = s.repo.ResolvePackageVersions(core.Package{Name: "app", Require: []string{"osv.cli >=3"}}, true)
+	c.Check(err, ErrorMatches, "(?s).*Available versions: 2.0 \\(local\\), 1.0 \\(http.*\\), 2.0 \\(http.*\\)")
+}
+
+func (s *suite) TestResolveLockedPackageVersions(c *C) {
+	s.repo.Path = c.MkDir()
+	server := serveRepository(map[string]string{
+		"/packages/osv.cli.yaml":        "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 2.0\n",
+		"/packages/osv.cli.mpm":         "cli",
+		"/packages/osv.httpserver.yaml": "name: osv.httpserver\ntitle: HTTP\nauthor: a\nversion: 1.0\n",
+		"/packages/osv.httpserver.mpm":  "httpserver",
+	})
+	defer server.Close()
+	s.repo.URL = server.URL + "/"
+	app := core.Package{Name: "app", Require: []string{"osv.cli", "osv.httpserver"}}
+
+	// Packages missing in the lock file are refused before anything is downloaded.
+	lock := core.LockFile{Packages: []core.LockedPackage{{Name: "osv.cli", Version: "2.0"}}}
+	_, err := s.repo.ResolveLockedPackageVersions(app, true, lock)
+	c.Check(err, ErrorMatches, "Resolved packages differ from capstan.lock:\n  osv.httpserver: required but not locked")
+	c.Check(s.repo.PackageExists("osv.cli"), Equals, false)
+	c.Check(s.repo.PackageExists("osv.httpserver"), Equals, false)
+
+	// So are locked versions that are no longer available.
+	lock.Packages = []core.LockedPackage{{Name: "osv.cli", Version: "1.0"}, {Name: "osv.httpserver", Version: "1.0"}}
+	_, err = s.repo.ResolveLockedPackageVersions(app, true, lock)
+	c.Check(err, NotNil)
+	c.Check(s.repo.PackageExists("osv.httpserver"), Equals, false)
+
+	// Locked versions are downloaded.
+	lock.Packages[0].Version = "2.0"
+	packages, err := s.repo.ResolveLockedPackageVersions(app, true, lock)
+	c.Assert(err, IsNil)
+	c.Check(packages["osv.cli"].Version, Equals, "2.0")
+	c.Check(s.repo.PackageExists("osv.httpserver"), Equals, true)
+}
+
+func (s *suite) TestFindRemotePackageUnreachableRepository(c *C) {
+	server := serveRepository(map[string]string{
+		"/packages/osv.cli.yaml": "name: osv.cli\ntitle: CLI\nauthor: a\n",
+		"/packages/osv.cli.mpm":  "cli",
+	})
+	defer server.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	s.repo.URL = unreachable.URL + "/"
+	s.repo.Repositories = []string{unreachable.URL + "/", server.URL + "/"}
+
+	// This is what we're testing here.
+	url, err := s.repo.FindRemotePackage("osv.cli")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(url, Equals, server.URL+"/")
+
+	// Resolving versions skips the unreachable repository as well.
+	s.repo.Path = c.MkDir()
+	packages, err := s.repo.ResolvePackageVersions(core.Package{Name: "app", Require: []string{"osv.cli"}}, true)
+	c.Assert(err, IsNil)
+	c.Check(packages, HasLen, 1)
+
+	// Error is only reported when none of the repositories answers.
+	s.repo.Repositories = []string{unreachable.URL + "/"}
+	_, err = s.repo.FindRemotePackage("osv.cli")
+	c.Check(err, ErrorMatches, "(?s)none of the repositories answered:.*")
+}
+
+func (s *suite) TestResolvePackageVersionsConcurrentDownloads(c *C) {
+	s.repo.Path = c.MkDir()
+	s.repo.DownloadConcurrency = 2
+
+	files := map[string]string{}
+	var require []string
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		files["/packages/"+name+".yaml"] = "name: " + name + "\ntitle: T\nauthor: a\n"
+		files["/packages/"+name+".mpm"] = name
+		require = append(require, name)
+	}
+	var mutex sync.Mutex
+	active, maxActive := 0, 0
+	repository := serveRepository(files)
+	defer repository.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".mpm") {
+			mutex.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mutex.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			defer func() {
+				mutex.Lock()
+				active--
+				mutex.Unlock()
+			}()
+		}
+		http.Redirect(w, req, repository.URL+req.URL.Path, http.StatusFound)
+	}))
+	defer server.Close()
+	s.repo.URL = server.URL + "/"
+
+	// This is what we're testing here.
+	_, err := s.repo.ResolvePackageVersions(core.Package{Name: "app", Require: require}, true)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	for _, name := range require {
+		c.Check(s.repo.PackageExists(name), Equals, true)
+	}
+	c.Check(maxActive, Equals, 2)
+}
+
+func (s *suite) TestNewRepoRepositories(c *C) {
+	root := c.MkDir()
+	os.Setenv("CAPSTAN_ROOT", root)
+	defer os.Unsetenv("CAPSTAN_ROOT")
+	config := `
+repositories:
+  - url: https://private.example.com/
+  - url: https://disabled.example.com/
+    disabled: true
+  - url: https://public.example.com/
+`
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "config.yaml"), []byte(config), 0644), IsNil)
+
+	// This is what we're testing here.
+	repo := util.NewRepo("")
+
+	// Expectations.
+	c.Check(repo.URL, Equals, "https://private.example.com/")
+	c.Check(repo.RemoteURLs(), DeepEquals, []string{"https://private.example.com/", "https://public.example.com/"})
+
+	// Repository given with -u is the only one searched.
+	repo = util.NewRepo("https://other.example.com/")
+	c.Check(repo.RemoteURLs(), DeepEquals, []string{"https://other.example.com/"})
+}
+
+func (s *suite) TestDownloadPackageChecksum(c *C) {
+	m := []struct {
+		comment  string
+		checksum string
+		err      string
+	}{
+		{
+			"matching checksum",
+			"sha256:99bb88401742848e032fd6f51709415fb6be169a72d2e5d7fc44289255160d3c", "",
+		},
+		{
+			"checksum mismatch",
+			"sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			"osv.cli.mpm: checksum mismatch, expected sha256:0+, got sha256:99bb88.*",
+		},
+		{
+			"no checksum published",
+			"", "",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		s.repo.Path = c.MkDir()
+		server := serveRepository(map[string]string{
+			"/packages/osv.cli.yaml": "name: osv.cli\ntitle: CLI\nauthor: a\nchecksum: " + args.checksum + "\n",
+			"/packages/osv.cli.mpm":  "cli",
+		})
+		s.repo.URL = server.URL + "/"
+
+		// This is what we're testing here.
+		err := s.repo.DownloadPackage(s.repo.URL, "osv.cli")
+		server.Close()
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+			c.Check(s.repo.PackageExists("osv.cli"), Equals, false)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(s.repo.PackageExists("osv.cli"), Equals, true)
+		}
+	}
+}
+
+func (s *suite) TestDownloadPackageChecksumKeepsCachedPackage(c *C) {
+	s.repo.Path = c.MkDir()
+	writeLocalPackage(c, s.repo, "osv.cli", "1.0")
+	c.Assert(ioutil.WriteFile(s.repo.PackagePath("osv.cli"), []byte("good"), 0644), IsNil)
+	server := serveRepository(map[string]string{
+		"/packages/osv.cli.yaml": "name: osv.cli\ntitle: CLI\nauthor: a\nversion: 2.0\n" +
+			"checksum: sha256:0000000000000000000000000000000000000000000000000000000000000000\n",
+		"/packages/osv.cli.mpm": "corrupted",
+	})
+	defer server.Close()
+
+	// This is what we're testing here.
+	err := s.repo.DownloadPackage(server.URL+"/", "osv.cli")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "osv.cli.mpm: checksum mismatch.*")
+	data, err := ioutil.ReadFile(s.repo.PackagePath("osv.cli"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "good")
+	pkg, err := core.ParsePackageManifest(s.repo.PackageManifest("osv.cli"))
+	c.Assert(err, IsNil)
+	c.Check(pkg.Version, Equals, "1.0")
+	leftovers, _ := filepath.Glob(filepath.Join(s.repo.PackagesPath(), "*"+util.VerifiedDownloadSuffix))
+	c.Check(leftovers, HasLen, 0)
+}
+
+func (s *suite) TestDownloadImageChecksum(c *C) {
+	s.repo.Path = c.MkDir()
+	var image bytes.Buffer
+	w := gzip.NewWriter(&image)
+	w.Write([]byte("image"))
+	w.Close()
+	server := serveRepository(map[string]string{
+		"/mike/osv-loader/index.yaml":         "format_version: 1\nchecksums:\n  qemu: sha256:0000\n",
+		"/mike/osv-loader/osv-loader.qemu.gz": image.String(),
+	})
+	defer server.Close()
+
+	// This is what we're testing here.
+	err := s.repo.DownloadImage(server.URL+"/", "qemu", "mike/osv-loader")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "mike/osv-loader/osv-loader.qemu.gz: checksum mismatch.*")
+	c.Check(s.repo.ImageExists("qemu", "mike/osv-loader"), Equals, false)
+}
+
+func (s *suite) TestImportPackageChecksum(c *C) {
+	s.repo.Path = c.MkDir()
+	packagePath := filepath.Join(c.MkDir(), "osv.cli.mpm")
+	c.Assert(ioutil.WriteFile(packagePath, []byte("cli"), 0644), IsNil)
+
+	// This is what we're testing here.
+	err := s.repo.ImportPackage(core.Package{Name: "osv.cli", Title: "CLI", Author: "a"}, packagePath)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	pkg, err := core.ParsePackageManifest(s.repo.PackageManifest("osv.cli"))
+	c.Assert(err, IsNil)
+	c.Check(pkg.Checksum, Equals, "sha256:99bb88401742848e032fd6f51709415fb6be169a72d2e5d7fc44289255160d3c")
+}
+
+// serveRepository serves the given files as a remote repository, listing
+// them at its root.
+func serveRepository(files map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/" {
+			listing := "<ListBucketResult>"
+			for path := range files {
+				listing += "<Contents><Key>" + strings.TrimPrefix(path, "/") + "</Key></Contents>"
+			}
+			fmt.Fprint(w, listing+"</ListBucketResult>")
+			return
+		}
+		if content, ok := files[req.URL.Path]; ok {
+			fmt.Fprint(w, content)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+}
+
+func writeLocalPackage(c *C, repo *util.Repo, name, version string, require ...string) {
+	pkg := core.Package{Name: name, Title: name, Author: "a", Version: version, Require: require}
+	data, err := yaml.Marshal(pkg)
+	c.Assert(err, IsNil)
+	c.Assert(os.MkdirAll(repo.PackagesPath(), 0775), IsNil)
+	c.Assert(ioutil.WriteFile(repo.PackageManifest(name), data, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(repo.PackagePath(name), []byte{}, 0644), IsNil)
+}
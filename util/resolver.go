@@ -0,0 +1,293 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/core"
+)
+
+// maxResolveRounds limits how many times versions are picked again after
+// requirements of the picked packages have changed.
+const maxResolveRounds = 100
+
+// requirementSource is a requirement together with the package requiring it.
+type requirementSource struct {
+	requirement core.Requirement
+	requiredBy  string
+}
+
+// packageCandidate is a package manifest found either in the local or in one
+// of the remote repositories.
+type packageCandidate struct {
+	pkg core.Package
+	// repository is URL of the remote repository providing the package,
+	// empty for local packages.
+	repository string
+}
+
+func (c packageCandidate) remote() bool {
+	return c.repository != ""
+}
+
+type resolver struct {
+	repo            *Repo
+	downloadMissing bool
+	// remote caches manifests of the package in remote repositories that
+	// provide it, in the order repositories are searched.
+	remote map[string][]packageCandidate
+	// locked are the packages that must be picked, nil unless resolving
+	// against a lock file.
+	locked *core.LockFile
+}
+
+// ResolvePackageVersions picks a version of each package that the given
+// package requires, directly or through other packages, so that all version
+// constraints hold. Local packages are preferred. Remote repository is only
+// considered when missing packages are to be downloaded, in which case the
+// picked remote packages replace the local ones. Remote repositories are
+// searched in order and the first one providing a suitable version is used.
+func (r *Repo) ResolvePackageVersions(pkg core.Package, downloadMissing bool) (map[string]core.Package, error) {
+	return r.resolvePackageVersions(pkg, downloadMissing, nil)
+}
+
+// ResolveLockedPackageVersions picks versions just like ResolvePackageVersions
+// but only those recorded in the lock file. It fails before anything is
+// downloaded when the requirements no longer resolve to the locked packages.
+func (r *Repo) ResolveLockedPackageVersions(pkg core.Package, downloadMissing bool, lock core.LockFile) (map[string]core.Package, error) {
+	return r.resolvePackageVersions(pkg, downloadMissing, &lock)
+}
+
+func (r *Repo) resolvePackageVersions(pkg core.Package, downloadMissing bool, locked *core.LockFile) (map[string]core.Package, error) {
+	res := &resolver{repo: r, downloadMissing: downloadMissing, remote: make(map[string][]packageCandidate), locked: locked}
+
+	picked := make(map[string]packageCandidate)
+	for round := 0; round < maxResolveRounds; round++ {
+		requirements, err := res.requirements(pkg, picked)
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for name := range requirements {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		changed := len(requirements) != len(picked)
+		next := make(map[string]packageCandidate)
+		for _, name := range names {
+			candidate, err := res.pick(name, requirements[name])
+			if err != nil {
+				return nil, err
+			}
+			if previous, ok := picked[name]; !ok || previous.repository != candidate.repository || previous.pkg.Version != candidate.pkg.Version {
+				changed = true
+			}
+			next[name] = candidate
+		}
+		picked = next
+
+		if !changed {
+			if err := res.checkLocked(picked); err != nil {
+				return nil, err
+			}
+			return res.download(picked)
+		}
+	}
+
+	return nil, fmt.Errorf("failed to resolve versions of packages required by %s", pkg.Name)
+}
+
+// requirements returns requirements of the package and of the packages picked
+// so far that it requires, grouped by the name of the required package.
+func (res *resolver) requirements(pkg core.Package, picked map[string]packageCandidate) (map[string][]requirementSource, error) {
+	requirements := make(map[string][]requirementSource)
+	visited := make(map[string]bool)
+
+	queue := []core.Package{pkg}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		for _, require := range p.Require {
+			req, err := core.ParseRequirement(require)
+			if err != nil {
+				return nil, err
+			}
+			requirements[req.Name] = append(requirements[req.Name], requirementSource{req, p.Name})
+
+			if candidate, ok := picked[req.Name]; ok && !visited[req.Name] {
+				visited[req.Name] = true
+				queue = append(queue, candidate.pkg)
+			}
+		}
+	}
+	return requirements, nil
+}
+
+// pick returns the package that satisfies all requirements, local one if
+// possible.
+func (res *resolver) pick(name string, sources []requirementSource) (packageCandidate, error) {
+	lockedVersion, isLocked := res.lockedVersion(name)
+	satisfies := func(p core.Package) bool {
+		if isLocked && p.Version != lockedVersion {
+			return false
+		}
+		for _, s := range sources {
+			if !s.requirement.Matches(p.Version) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var available []string
+	if res.repo.PackageExists(name) {
+		local, err := core.ParsePackageManifest(res.repo.PackageManifest(name))
+		if err != nil {
+			return packageCandidate{}, err
+		}
+		if satisfies(local) {
+			return packageCandidate{pkg: local}, nil
+		}
+		available = append(available, fmt.Sprintf("%s (local)", describeVersion(local.Version)))
+	}
+
+	if res.downloadMissing {
+		remote, err := res.remotePackages(name)
+		if err != nil {
+			return packageCandidate{}, err
+		}
+		for _, candidate := range remote {
+			if satisfies(candidate.pkg) {
+				return candidate, nil
+			}
+			available = append(available, fmt.Sprintf("%s (%s)", describeVersion(candidate.pkg.Version), candidate.repository))
+		}
+	}
+
+	if len(available) == 0 {
+		if res.downloadMissing {
+			return packageCandidate{}, fmt.Errorf("package %s is not available in the given repositories (%s)",
+				name, strings.Join(res.repo.RemoteURLs(), ", "))
+		}
+		return packageCandidate{}, fmt.Errorf("Package %s does not exist in your local repository. Pull it manually using "+
+			"'capstan package pull %s' or enable automatic pulling of missing "+
+			"packages by adding --pull-missing flag", name, name)
+	}
+
+	// Report all requirements so that the conflicting ones can be found.
+	msg := fmt.Sprintf("No version of package %s satisfies all requirements:\n", name)
+	for _, s := range sources {
+		requiredBy := s.requiredBy
+		if requiredBy == "" {
+			requiredBy = "package"
+		}
+		msg += fmt.Sprintf("  %s requires %s\n", requiredBy, s.requirement)
+	}
+	msg += fmt.Sprintf("Available versions: %s", strings.Join(available, ", "))
+	if !res.downloadMissing {
+		msg += "\nAdd --pull-missing flag to consider versions in the remote repository as well"
+	}
+	return packageCandidate{}, fmt.Errorf("%s", msg)
+}
+
+// remotePackages returns manifests of the package in remote repositories
+// that provide it.
+func (res *resolver) remotePackages(name string) ([]packageCandidate, error) {
+	if candidates, ok := res.remote[name]; ok {
+		return candidates, nil
+	}
+
+	var candidates []packageCandidate
+	err := res.repo.SearchRemotes(func(url string) (bool, error) {
+		remote, err := IsRemotePackage(url, name)
+		if err != nil || !remote {
+			return false, err
+		}
+		if pkg := RemotePackageInfo(url, fmt.Sprintf("packages/%s.yaml", name)); pkg != nil {
+			candidates = append(candidates, packageCandidate{pkg: *pkg, repository: url})
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.remote[name] = candidates
+	return candidates, nil
+}
+
+// lockedVersion returns the locked version of the package, if it is locked.
+func (res *resolver) lockedVersion(name string) (string, bool) {
+	if res.locked == nil {
+		return "", false
+	}
+	for _, p := range res.locked.Packages {
+		if p.Name == name {
+			return p.Version, true
+		}
+	}
+	return "", false
+}
+
+// checkLocked makes sure that the picked packages are the locked ones. Content
+// of the packages can only be compared once they are downloaded.
+func (res *resolver) checkLocked(picked map[string]packageCandidate) error {
+	if res.locked == nil {
+		return nil
+	}
+
+	hashes := make(map[string]string)
+	for _, p := range res.locked.Packages {
+		hashes[p.Name] = p.Hash
+	}
+	resolved := core.LockFile{}
+	for name, candidate := range picked {
+		resolved.Packages = append(resolved.Packages, core.LockedPackage{Name: name, Version: candidate.pkg.Version, Hash: hashes[name]})
+	}
+	if diff := res.locked.Diff(resolved); len(diff) > 0 {
+		return fmt.Errorf("Resolved packages differ from %s:\n  %s", core.LockFileName, strings.Join(diff, "\n  "))
+	}
+	return nil
+}
+
+// download downloads the picked remote packages into the local repository
+// concurrently, reporting the repository each of them comes from.
+func (res *resolver) download(picked map[string]packageCandidate) (map[string]core.Package, error) {
+	var names []string
+	for name := range picked {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	packages := make(map[string]core.Package)
+	var downloads []packageDownload
+	for _, name := range names {
+		candidate := picked[name]
+		if candidate.remote() {
+			fmt.Printf("Package %s %s resolved from %s\n", name, describeVersion(candidate.pkg.Version), candidate.repository)
+			downloads = append(downloads, packageDownload{candidate.repository, name})
+		}
+		packages[name] = candidate.pkg
+	}
+	if err := res.repo.downloadPackages(downloads); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+func describeVersion(version string) string {
+	if version == "" {
+		return "without version"
+	}
+	return version
+}
@@ -9,6 +9,7 @@ package util
 
 import (
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/xml"
 	"fmt"
 	"github.com/cheggaaa/pb"
@@ -19,6 +20,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -69,7 +71,7 @@ func MakeFileInfo(path, ns, name string) *FileInfo {
 }
 
 func RemoteFileInfo(repo_url string, path string) *FileInfo {
-	resp, err := http.Get(repo_url + path)
+	resp, err := remoteGet(repo_url + path)
 	if err != nil {
 		return nil
 	}
@@ -96,7 +98,7 @@ func RemoteFileInfo(repo_url string, path string) *FileInfo {
 // RemotePackageInfo downloads the given manifest files and tries to parse it.
 // core.Package struct is returned if it succeeds, otherwise nil.
 func RemotePackageInfo(repo_url string, path string) *core.Package {
-	resp, err := http.Get(repo_url + path)
+	resp, err := remoteGet(repo_url + path)
 	if err != nil {
 		return nil
 	}
@@ -114,7 +116,7 @@ func RemotePackageInfo(repo_url string, path string) *core.Package {
 }
 
 func QueryRemote(repo_url string) (*Query, error) {
-	resp, err := http.Get(repo_url)
+	resp, err := remoteGet(repo_url)
 	if err != nil {
 		return nil, err
 	}
@@ -145,58 +147,240 @@ func ListImagesRemote(repo_url string, search string) error {
 }
 
 func ListPackagesRemote(repo_url string, search string) error {
-	q, err := QueryRemote(repo_url)
+	packages, err := SearchPackagesRemote(repo_url, search)
 	if err != nil {
 		return err
 	}
 	fmt.Println(FileInfoHeader())
+	for _, pkg := range packages {
+		fmt.Println(pkg.String())
+	}
+	return nil
+}
+
+// SearchPackagesRemote returns manifests of packages in the remote repository
+// whose names contain the search term.
+func SearchPackagesRemote(repo_url string, search string) ([]core.Package, error) {
+	q, err := QueryRemote(repo_url)
+	if err != nil {
+		return nil, err
+	}
+	var packages []core.Package
 	for _, content := range q.ContentsList {
 		if strings.HasPrefix(content.Key, "packages/") && strings.HasSuffix(content.Key, ".yaml") {
 			if pkg := RemotePackageInfo(repo_url, content.Key); pkg != nil && strings.Contains(pkg.Name, search) {
-				fmt.Println(pkg.String())
+				packages = append(packages, *pkg)
 			}
 		}
 	}
-	return nil
+	return packages, nil
+}
+
+// PartialDownloadSuffix is appended to names of files that are being
+// downloaded. Interrupted downloads are resumed from partial files.
+const PartialDownloadSuffix = ".part"
+
+// partValidatorSuffix is appended to the name of the partial file to name the
+// file holding the entity tag or modification time of the remote file that
+// is being downloaded into it.
+const partValidatorSuffix = ".validator"
+
+// VerifiedDownloadSuffix is appended to names of downloaded files until their
+// content is verified, so that a download never replaces a good copy of the
+// file with corrupted content.
+const VerifiedDownloadSuffix = ".download"
+
+// downloadFile downloads the named file into destPath, decompressing it if
+// its name ends with .gz, and returns checksum of the stored content. The
+// file is first downloaded into a partial file, so that an interrupted
+// download continues where it stopped when the file is downloaded again.
+func (r *Repo) downloadFile(repo_url string, destPath string, name string) (string, error) {
+	return r.downloadFileTo(repo_url, destPath, name, filepath.Join(destPath, strings.TrimSuffix(name, ".gz")))
 }
 
-func (r *Repo) downloadFile(repo_url string, destPath string, name string) error {
-	compressed := strings.HasSuffix(name, ".gz")
-	output, err := os.Create(filepath.Join(destPath, strings.TrimSuffix(name, ".gz")))
+// downloadVerifiedFile downloads the named file just like downloadFile, but
+// only replaces the file in destPath once its content matches the expected
+// checksum.
+func (r *Repo) downloadVerifiedFile(repo_url, destPath, name, expected string) (string, error) {
+	dest := filepath.Join(destPath, strings.TrimSuffix(name, ".gz"))
+	checksum, err := r.downloadFileTo(repo_url, destPath, name, dest+VerifiedDownloadSuffix)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer output.Close()
-	fmt.Printf("Downloading %s...\n", name)
-	tr := &http.Transport{
-		DisableCompression: true,
-		Proxy:              http.ProxyFromEnvironment,
+	if err := verifyDownload(name, expected, checksum); err != nil {
+		os.Remove(dest + VerifiedDownloadSuffix)
+		return "", err
+	}
+	return checksum, os.Rename(dest+VerifiedDownloadSuffix, dest)
+}
+
+// downloadFileTo downloads the named file of the repository into dest, using
+// a partial file in destPath.
+func (r *Repo) downloadFileTo(repo_url, destPath, name, dest string) (string, error) {
+	if r.progress == nil || r.progress.plain() {
+		fmt.Printf("Downloading %s...\n", name)
+	}
+	part := filepath.Join(destPath, name) + PartialDownloadSuffix
+	if err := r.downloadPart(repo_url+name, part, name); err != nil {
+		return "", err
+	}
+
+	checksum, err := finishPart(part, dest, strings.HasSuffix(name, ".gz"))
+	os.Remove(part + partValidatorSuffix)
+	if err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	return checksum, nil
+}
+
+// downloadPart downloads the file at url into the partial file, resuming
+// from its current size. Entity tag (or modification time) of the remote file
+// is recorded next to the partial file before any content is written, so that
+// the download starts over when the remote file changes.
+func (r *Repo) downloadPart(url, part, name string) error {
+	var offset int64
+	var resp *http.Response
+	var err error
+	validator, _ := ioutil.ReadFile(part + partValidatorSuffix)
+	if info, statErr := os.Stat(part); statErr == nil && info.Size() > 0 && len(validator) > 0 {
+		offset = info.Size()
+		resp, err = remoteGetRange(url, fmt.Sprintf("bytes=%d-", offset), string(validator))
+	} else {
+		resp, err = remoteGet(url)
 	}
-	client := &http.Client{Transport: tr}
-	resp, err := client.Get(repo_url + name)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	bar := pb.New64(resp.ContentLength).SetUnits(pb.U_BYTES)
-	bar.Start()
-	proxyReader := bar.NewProxyReader(resp.Body)
-	var reader io.Reader = proxyReader
-	if compressed {
-		gzipReader, err := gzip.NewReader(proxyReader)
-		if err != nil {
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Partial file is complete if it is as large as the remote file.
+		if size, ok := contentRangeSize(resp.Header.Get("Content-Range")); ok && size == offset {
+			return nil
+		}
+		fmt.Printf("Partial download of %s does not match the remote file, downloading it again\n", name)
+		os.Remove(part)
+		os.Remove(part + partValidatorSuffix)
+		return r.downloadPart(url, part, name)
+	case http.StatusPartialContent:
+		fmt.Printf("Resuming download of %s at %d bytes\n", name, offset)
+		flags |= os.O_APPEND
+	default:
+		// Remote file has changed or the server does not support ranges.
+		offset = 0
+		flags |= os.O_TRUNC
+		if err := writePartValidator(part, resp.Header); err != nil {
 			return err
 		}
-		reader = gzipReader
 	}
-	_, err = io.Copy(output, reader)
-	bar.Finish()
+
+	output, err := os.OpenFile(part, flags, 0644)
 	if err != nil {
 		return err
 	}
+
+	// Concurrent downloads show progress of tracked files only.
+	var bar *pb.ProgressBar
+	if r.progress == nil {
+		bar = pb.New64(offset + resp.ContentLength).SetUnits(pb.U_BYTES)
+		bar.Set64(offset)
+		bar.Start()
+	} else if bar = r.progress.bar(name); bar != nil {
+		bar.SetTotal64(offset + resp.ContentLength)
+		bar.Set64(offset)
+	}
+	var reader io.Reader = resp.Body
+	if bar != nil {
+		reader = bar.NewProxyReader(resp.Body)
+	}
+
+	_, err = io.Copy(output, reader)
+	if bar != nil && r.progress == nil {
+		bar.Finish()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("download of %s interrupted (%s), run the command again to resume", name, err)
+	}
 	return nil
 }
 
+// writePartValidator records the entity tag of the remote file or, lacking a
+// strong one, its modification time. Without either the partial file is
+// never resumed.
+func writePartValidator(part string, header http.Header) error {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		if err := os.Remove(part + partValidatorSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(part+partValidatorSuffix, []byte(validator), 0644)
+}
+
+// contentRangeSize returns the size of the remote file from the Content-Range
+// header of 416 Requested Range Not Satisfiable response, e.g. bytes */1024.
+func contentRangeSize(contentRange string) (int64, bool) {
+	if !strings.HasPrefix(contentRange, "bytes */") {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(contentRange, "bytes */"), 10, 64)
+	return size, err == nil
+}
+
+// finishPart moves the complete partial file to its destination,
+// decompressing it if needed, and returns checksum of the stored content.
+func finishPart(part, dest string, compressed bool) (string, error) {
+	if !compressed {
+		if err := os.Rename(part, dest); err != nil {
+			return "", err
+		}
+		return FileChecksum(dest)
+	}
+
+	input, err := os.Open(part)
+	if err != nil {
+		return "", err
+	}
+	defer input.Close()
+	gzipReader, err := gzip.NewReader(input)
+	if err != nil {
+		return "", err
+	}
+	output, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(output, hash), gzipReader); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	os.Remove(part)
+	return formatChecksum(hash.Sum(nil)), nil
+}
+
+// verifyDownload checks the downloaded file against the published checksum.
+// Files without published checksum are accepted with a warning.
+func verifyDownload(name, expected, actual string) error {
+	if expected == "" {
+		fmt.Printf("WARNING: no checksum published for %s, download not verified\n", name)
+		return nil
+	}
+	return VerifyChecksum(name, expected, actual)
+}
+
 func (r *Repo) DownloadImage(repo_url, hypervisor string, path string) error {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
@@ -206,11 +390,27 @@ func (r *Repo) DownloadImage(repo_url, hypervisor string, path string) error {
 	if err != nil {
 		return err
 	}
-	err = r.downloadFile(repo_url, r.RepoPath(), fmt.Sprintf("%s/index.yaml", path))
+	// Index replaces the one of the cached image once the image is verified.
+	index := fmt.Sprintf("%s/index.yaml", path)
+	indexPath := filepath.Join(r.RepoPath(), index)
+	if _, err = r.downloadFileTo(repo_url, r.RepoPath(), index, indexPath+VerifiedDownloadSuffix); err != nil {
+		return err
+	}
+	defer os.Remove(indexPath + VerifiedDownloadSuffix)
+	data, err := ioutil.ReadFile(indexPath + VerifiedDownloadSuffix)
 	if err != nil {
 		return err
 	}
-	return r.downloadFile(repo_url, r.RepoPath(), fmt.Sprintf("%s/%s.%s.gz", path, parts[1], hypervisor))
+	var info ImageInfo
+	if err := yaml.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("%s: %s", index, err)
+	}
+
+	name := fmt.Sprintf("%s/%s.%s.gz", path, parts[1], hypervisor)
+	if _, err := r.fetchFile(repo_url, r.RepoPath(), name, strings.TrimSuffix(name, ".gz"), info.Checksums[hypervisor]); err != nil {
+		return err
+	}
+	return os.Rename(indexPath+VerifiedDownloadSuffix, indexPath)
 }
 
 func IsRemoteImage(repo_url, name string) (bool, error) {
@@ -228,7 +428,7 @@ func IsRemoteImage(repo_url, name string) (bool, error) {
 
 // DownloadPackage downloads a package from the S3 repository into local.
 func (r *Repo) DownloadPackage(repo_url, packageName string) error {
-	remote, err := IsRemotePackage(r.URL, packageName)
+	remote, err := IsRemotePackage(repo_url, packageName)
 	if err != nil {
 		return err
 	}
@@ -246,21 +446,82 @@ func (r *Repo) DownloadPackage(repo_url, packageName string) error {
 		return fmt.Errorf("%s: mkdir failed", packagesRoot)
 	}
 
+	lock, err := r.LockPackage(packageName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	packageManifest := fmt.Sprintf("%s.yaml", packageName)
 	packageFile := fmt.Sprintf("%s.mpm", packageName)
 
-	// Download manifest file.
-	err = r.downloadFile(repo_url+"packages/", packagesRoot, packageManifest)
+	// Download manifest file. It replaces the manifest of the cached package
+	// once the package is verified.
+	manifestPath := r.PackageManifest(packageName)
+	if _, err = r.downloadFileTo(repo_url+"packages/", packagesRoot, packageManifest, manifestPath+VerifiedDownloadSuffix); err != nil {
+		return err
+	}
+	defer os.Remove(manifestPath + VerifiedDownloadSuffix)
+	pkg, err := core.ParsePackageManifest(manifestPath + VerifiedDownloadSuffix)
 	if err != nil {
 		return err
 	}
 
-	// Download package file.
-	err = r.downloadFile(repo_url+"packages/", packagesRoot, packageFile)
-	if err != nil {
+	// Download package file and verify it against the checksum in manifest.
+	if _, err := r.fetchFile(repo_url+"packages/", packagesRoot, packageFile, packageFile, pkg.Checksum); err != nil {
 		return err
 	}
+	return os.Rename(manifestPath+VerifiedDownloadSuffix, manifestPath)
+}
 
+// FindRemotePackage returns URL of the first remote repository that provides
+// the given package or an empty string if none of them does.
+func (r *Repo) FindRemotePackage(name string) (string, error) {
+	var found string
+	err := r.SearchRemotes(func(url string) (bool, error) {
+		remote, err := IsRemotePackage(url, name)
+		if remote {
+			found = url
+		}
+		return remote, err
+	})
+	return found, err
+}
+
+// FindRemoteImage returns URL of the first remote repository that provides
+// the given image or an empty string if none of them does.
+func (r *Repo) FindRemoteImage(name string) (string, error) {
+	var found string
+	err := r.SearchRemotes(func(url string) (bool, error) {
+		remote, err := IsRemoteImage(url, name)
+		if remote {
+			found = url
+		}
+		return remote, err
+	})
+	return found, err
+}
+
+// SearchRemotes calls search with URL of each remote repository in order
+// until it returns true. Repositories that fail to answer are skipped with a
+// warning, an error is only returned when none of them answers.
+func (r *Repo) SearchRemotes(search func(url string) (bool, error)) error {
+	var errs []string
+	urls := r.RemoteURLs()
+	for _, url := range urls {
+		done, err := search(url)
+		if err != nil {
+			fmt.Printf("WARNING: skipping repository %s: %s\n", url, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		if done {
+			return nil
+		}
+	}
+	if len(errs) == len(urls) && len(errs) > 0 {
+		return fmt.Errorf("none of the repositories answered:\n  %s", strings.Join(errs, "\n  "))
+	}
 	return nil
 }
 
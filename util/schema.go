@@ -0,0 +1,258 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SchemaError describes a problem found in a yaml document. Line is zero
+// when the location of the problem is not known.
+type SchemaError struct {
+	Line    int
+	Path    []string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	msg := e.Message
+	if len(e.Path) > 0 {
+		msg = fmt.Sprintf("%s: %s", strings.Join(e.Path, "."), msg)
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	return msg
+}
+
+// FormatVersionKey is the key with which documents declare the version of the
+// schema they are written for.
+const FormatVersionKey = "format_version"
+
+// SchemaVersion returns the format version that the document declares, or the
+// latest of the given versions when it declares none. Versions are ordered
+// from the oldest to the latest.
+func SchemaVersion(doc map[interface{}]interface{}, versions []string, locator *LineLocator) (string, error) {
+	value, ok := doc[FormatVersionKey]
+	if !ok {
+		return versions[len(versions)-1], nil
+	}
+	version := fmt.Sprint(value)
+	for _, v := range versions {
+		if v == version {
+			return version, nil
+		}
+	}
+	path := []string{FormatVersionKey}
+	return "", SchemaError{locator.Line(path), path, fmt.Sprintf("unsupported version %s, use one of %v", version, versions)}
+}
+
+var yamlKeyPattern = regexp.MustCompile(`^(\s*)(- )?(['"]?)([^\s#'":][^#'":]*?)(['"]?)\s*:(\s|$)`)
+
+// LineLocator finds lines of keys in yaml documents written in block style.
+type LineLocator struct {
+	lines map[string]int
+}
+
+func NewLineLocator(data []byte) *LineLocator {
+	type entry struct {
+		indent int
+		key    string
+	}
+
+	l := &LineLocator{lines: make(map[string]int)}
+	var stack []entry
+	for i, line := range strings.Split(string(data), "\n") {
+		match := yamlKeyPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		indent := len(match[1]) + len(match[2])
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, entry{indent, match[4]})
+
+		var path []string
+		for _, e := range stack {
+			path = append(path, e.key)
+		}
+		if _, ok := l.lines[strings.Join(path, "\x00")]; !ok {
+			l.lines[strings.Join(path, "\x00")] = i + 1
+		}
+	}
+	return l
+}
+
+// Line returns the line of the key with the given path or of its closest
+// parent that can be found. List items are not tracked, so the path is
+// only followed up to the first list index.
+func (l *LineLocator) Line(path []string) int {
+	for i, p := range path {
+		if strings.HasPrefix(p, "[") {
+			path = path[:i]
+			break
+		}
+	}
+
+	for ; len(path) > 0; path = path[:len(path)-1] {
+		if line, ok := l.lines[strings.Join(path, "\x00")]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+// CheckSchema compares the parsed yaml value against the given type and
+// returns unknown keys and type mismatches. Values containing ${VAR}
+// references are not type checked since they are only known at compose time.
+func CheckSchema(value interface{}, t reflect.Type, path []string, locator *LineLocator) []error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if value == nil || reflect.PtrTo(t).Implements(reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()) {
+		return nil
+	}
+	if s, ok := value.(string); ok && strings.Contains(s, "${") {
+		return nil
+	}
+
+	mismatch := func(expected string) []error {
+		return []error{SchemaError{locator.Line(path), path, fmt.Sprintf("expected %s, got %v", expected, value)}}
+	}
+
+	var errs []error
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return mismatch("map")
+		}
+		fields := SchemaFields(t)
+		for _, k := range sortedKeys(m) {
+			v := m[k]
+			k := fmt.Sprint(k)
+			keyPath := append(append([]string{}, path...), k)
+			fieldType, ok := fields[k]
+			if !ok {
+				fieldType, ok = fields[""]
+			}
+			if !ok {
+				errs = append(errs, SchemaError{locator.Line(keyPath), keyPath, "unknown key"})
+				continue
+			}
+			errs = append(errs, CheckSchema(v, fieldType, keyPath, locator)...)
+		}
+	case reflect.Map:
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return mismatch("map")
+		}
+		for _, k := range sortedKeys(m) {
+			errs = append(errs, CheckSchema(m[k], t.Elem(), append(append([]string{}, path...), fmt.Sprint(k)), locator)...)
+		}
+	case reflect.Slice:
+		l, ok := value.([]interface{})
+		if !ok {
+			return mismatch("list")
+		}
+		for i, item := range l {
+			errs = append(errs, CheckSchema(item, t.Elem(), append(append([]string{}, path...), fmt.Sprintf("[%d]", i)), locator)...)
+		}
+	case reflect.String:
+		switch value.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return mismatch("string")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch value.(type) {
+		case int, int64, uint64:
+		default:
+			return mismatch("integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		switch value.(type) {
+		case int, int64, uint64, float64:
+		default:
+			return mismatch("number")
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return mismatch("boolean")
+		}
+	}
+	return errs
+}
+
+// SchemaFields returns yaml keys of the struct type, including the keys of
+// inlined structs. Inlined map accepts any other key, its element type is
+// returned for the empty key.
+func SchemaFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		tag := f.Tag.Get("yaml")
+		if tag == "" && !strings.Contains(string(f.Tag), ":") {
+			tag = string(f.Tag)
+		}
+		parts := strings.Split(tag, ",")
+
+		inline := false
+		for _, flag := range parts[1:] {
+			if flag == "inline" {
+				inline = true
+			}
+		}
+		if inline && f.Type.Kind() == reflect.Map {
+			fields[""] = f.Type.Elem()
+			continue
+		}
+		if inline {
+			for k, v := range SchemaFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+
+		name := parts[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// sortedKeys returns keys of the map so that problems are always reported
+// in the same order.
+func sortedKeys(m map[interface{}]interface{}) []interface{} {
+	var keys []interface{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CreateTap creates the tap device owned by the current user unless it exists
+// already, attaches it to the bridge, if one is given, and brings it up. It
+// needs the privileges to configure network devices, e.g. root.
+func CreateTap(name, bridge string) error {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", name)); os.IsNotExist(err) {
+		if err := ipCommand("tuntap", "add", "dev", name, "mode", "tap", "user", strconv.Itoa(os.Getuid())); err != nil {
+			return err
+		}
+	}
+	if bridge != "" {
+		if err := ipCommand("link", "set", "dev", name, "master", bridge); err != nil {
+			return err
+		}
+	}
+	return ipCommand("link", "set", "dev", name, "up")
+}
+
+// DeleteTap deletes the tap device, if it exists.
+func DeleteTap(name string) error {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", name)); os.IsNotExist(err) {
+		return nil
+	}
+	return ipCommand("tuntap", "del", "dev", name, "mode", "tap")
+}
+
+// rateUnits are units of rates understood by tc, in bits per second.
+var rateUnits = map[string]float64{
+	"bit": 1, "kbit": 1e3, "mbit": 1e6, "gbit": 1e9, "tbit": 1e12,
+	"bps": 8, "kbps": 8e3, "mbps": 8e6, "gbps": 8e9, "tbps": 8e12,
+}
+
+var ratePattern = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?)([a-z]+)$`)
+
+// ParseRate parses a rate in units of tc, e.g. 10mbit or 1mbps (bytes per
+// second), and returns it in bits per second.
+func ParseRate(rate string) (uint64, error) {
+	m := ratePattern.FindStringSubmatch(strings.ToLower(rate))
+	if m == nil || rateUnits[m[3]] == 0 {
+		return 0, fmt.Errorf("invalid rate '%s', use e.g. 10mbit or 1mbps", rate)
+	}
+	value, _ := strconv.ParseFloat(m[1], 64)
+	bits := uint64(value * rateUnits[m[3]])
+	if bits < 8000 {
+		return 0, fmt.Errorf("rate '%s' is too low, use at least 8kbit", rate)
+	}
+	return bits, nil
+}
+
+// LimitTapRate limits the rate of traffic through the tap device. Ingress
+// is the traffic towards the guest, which is shaped when the host sends it
+// out of the device, and egress is the traffic sent by the guest, which is
+// policed when it enters the host. Previous limits of the device are
+// replaced, an empty rate removes the limit. It needs the privileges to
+// configure network devices, e.g. root.
+func LimitTapRate(name, ingress, egress string) error {
+	// Limits that are not set may not exist, so failures to remove them are
+	// ignored.
+	tcCommand("qdisc", "del", "dev", name, "root")
+	tcCommand("qdisc", "del", "dev", name, "ingress")
+
+	if ingress != "" {
+		bits, err := ParseRate(ingress)
+		if err != nil {
+			return err
+		}
+		if err := tcCommand("qdisc", "add", "dev", name, "root", "tbf",
+			"rate", fmt.Sprintf("%dbit", bits), "burst", rateBurst(bits), "latency", "50ms"); err != nil {
+			return err
+		}
+	}
+	if egress != "" {
+		bits, err := ParseRate(egress)
+		if err != nil {
+			return err
+		}
+		if err := tcCommand("qdisc", "add", "dev", name, "handle", "ffff:", "ingress"); err != nil {
+			return err
+		}
+		if err := tcCommand("filter", "add", "dev", name, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0",
+			"police", "rate", fmt.Sprintf("%dbit", bits), "burst", rateBurst(bits), "drop", "flowid", ":1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateBurst returns the burst of the rate, the traffic of 10ms but at least
+// 16kb, so that the rate can be reached with common timer frequencies.
+func rateBurst(bits uint64) string {
+	burst := bits / 8 / 100
+	if burst < 16*1024 {
+		burst = 16 * 1024
+	}
+	return fmt.Sprintf("%db", burst)
+}
+
+func tcCommand(args ...string) error {
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func ipCommand(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
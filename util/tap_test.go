@@ -0,0 +1,44 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	valid := map[string]uint64{
+		"10mbit":  10000000,
+		"1.5Gbit": 1500000000,
+		"1mbps":   8000000,
+		"8kbit":   8000,
+	}
+	for rate, expected := range valid {
+		bits, err := ParseRate(rate)
+		if err != nil {
+			t.Errorf("%s: %s", rate, err)
+		} else if bits != expected {
+			t.Errorf("%s: expected %d, got %d", rate, expected, bits)
+		}
+	}
+
+	for _, rate := range []string{"", "10", "10mb", "mbit", "-1mbit", "100bit"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Errorf("%s: expected an error", rate)
+		}
+	}
+}
+
+func TestRateBurst(t *testing.T) {
+	if burst := rateBurst(1000000); burst != "16384b" {
+		t.Errorf("expected the minimal burst, got %s", burst)
+	}
+	if burst := rateBurst(1000000000); burst != "1250000b" {
+		t.Errorf("expected 10ms of traffic, got %s", burst)
+	}
+}
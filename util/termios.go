@@ -10,6 +10,7 @@
 package util
 
 import (
+	"os"
 	"os/exec"
 )
 
@@ -22,3 +23,17 @@ func ResetTerm() {
 	cmd := exec.Command("stty", "cooked")
 	cmd.Run()
 }
+
+// DisableEcho stops the terminal from echoing typed characters.
+func DisableEcho() {
+	cmd := exec.Command("stty", "-echo")
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
+
+// EnableEcho turns the terminal echo back on.
+func EnableEcho() {
+	cmd := exec.Command("stty", "echo")
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
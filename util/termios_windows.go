@@ -13,3 +13,9 @@ func RawTerm() error {
 
 func ResetTerm() {
 }
+
+func DisableEcho() {
+}
+
+func EnableEcho() {
+}
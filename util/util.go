@@ -20,6 +20,9 @@ import (
 	"time"
 )
 
+// CapstanVersion is the version of capstan that is running.
+var CapstanVersion string
+
 func ConfigDir() string {
 	return filepath.Join(HomePath(), ".capstan")
 }
@@ -148,3 +151,34 @@ func RemoveOrphanedInstances(verbose bool) error {
 
 	return nil
 }
+
+// ProcessStats are resource usage statistics of a host process. CPUTime is
+// the total time spent in user and kernel mode, RSS is in bytes.
+type ProcessStats struct {
+	CPUTime time.Duration
+	RSS     int64
+	Threads int
+}
+
+// InstanceMetadata tells when and from which image an instance was created.
+// Created is in RFC 3339 format, ImageChecksum in form of sha256:<hex>.
+type InstanceMetadata struct {
+	Created        string
+	Image          string
+	ImageChecksum  string
+	CapstanVersion string
+}
+
+// NewInstanceMetadata describes an instance created now from the named image
+// stored at the given path. Checksum is only computed for local image files.
+func NewInstanceMetadata(imageName, imagePath string) InstanceMetadata {
+	metadata := InstanceMetadata{
+		Created:        time.Now().Format(time.RFC3339),
+		Image:          imageName,
+		CapstanVersion: CapstanVersion,
+	}
+	if info, err := os.Stat(imagePath); err == nil && info.Mode().IsRegular() {
+		metadata.ImageChecksum, _ = FileChecksum(imagePath)
+	}
+	return metadata
+}
@@ -11,8 +11,19 @@ package util
 
 import (
 	"net"
+	"os"
+	"syscall"
 )
 
 func Connect(network, path string) (net.Conn, error) {
 	return net.Dial(network, path)
 }
+
+// lockFile blocks until an advisory lock on the file is acquired, either an
+// exclusive one or one shared with other shared locks.
+func lockFile(f *os.File, shared bool) error {
+	if shared {
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+	}
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
@@ -12,6 +12,7 @@ package util
 import (
 	"gopkg.in/natefinch/npipe.v2"
 	"net"
+	"os"
 )
 
 func Connect(network, path string) (net.Conn, error) {
@@ -21,3 +22,9 @@ func Connect(network, path string) (net.Conn, error) {
 func IsDirectIOSupported(path string) bool {
 	return false
 }
+
+// lockFile does nothing on Windows, where concurrent invocations are not
+// serialised.
+func lockFile(f *os.File, shared bool) error {
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Volume is storage mounted into the guest at Path, so that data is kept
+// outside of the image. Type is either nfs, where Source is the URL of the
+// export, e.g. nfs://192.168.122.1/export/data, disk, where Source is a
+// disk image on the host attached as a virtio-blk device holding a
+// filesystem of type FS (zfs unless given), or tmpfs, which keeps data in
+// memory of the guest until it exits. A disk of Size (e.g. 1G) is created
+// with ext filesystem when it does not exist yet.
+type Volume struct {
+	Type     string `yaml:"type"`
+	Source   string `yaml:"source,omitempty"`
+	Path     string `yaml:"path"`
+	FS       string `yaml:"fs,omitempty"`
+	ReadOnly bool   `yaml:"readonly,omitempty"`
+	Size     string `yaml:"size,omitempty"`
+}
+
+// mountOption is the OSv option that mounts a filesystem on boot.
+const mountOption = "--mount-fs="
+
+// Validate checks the volume.
+func (v Volume) Validate() error {
+	if !strings.HasPrefix(v.Path, "/") || strings.ContainsAny(v.Path, ", ") {
+		return fmt.Errorf("invalid volume path '%s', it must be absolute", v.Path)
+	}
+	if (v.Type != "tmpfs" && v.Source == "") || strings.ContainsAny(v.Source, ", ") {
+		return fmt.Errorf("invalid source '%s' of volume %s", v.Source, v.Path)
+	}
+	if v.Size != "" && v.Type != "disk" {
+		return fmt.Errorf("size can only be given for disk volumes, not %s", v.Path)
+	}
+	switch v.Type {
+	case "nfs":
+		if !strings.HasPrefix(v.Source, "nfs://") {
+			return fmt.Errorf("source of nfs volume %s must be nfs://<host>/<export>", v.Path)
+		}
+		if v.FS != "" {
+			return fmt.Errorf("filesystem can only be given for disk volumes, not %s", v.Path)
+		}
+	case "disk":
+		switch v.FS {
+		case "", "zfs", "rofs", "ext":
+		default:
+			return fmt.Errorf("unknown filesystem '%s' of volume %s, use one of zfs|rofs|ext", v.FS, v.Path)
+		}
+		if v.Size != "" {
+			if _, err := ParseMemSize(v.Size); err != nil {
+				return fmt.Errorf("invalid size of volume %s: %s", v.Path, err)
+			}
+			if v.FS != "ext" {
+				return fmt.Errorf("disk of volume %s can only be created with fs: ext", v.Path)
+			}
+		}
+	case "tmpfs":
+		if v.Source != "" || v.FS != "" || v.ReadOnly {
+			return fmt.Errorf("tmpfs volume %s only takes a path", v.Path)
+		}
+	default:
+		return fmt.Errorf("unknown type '%s' of volume %s, use one of nfs|disk|tmpfs", v.Type, v.Path)
+	}
+	return nil
+}
+
+// DiskVolumes returns volumes that are attached to the guest as disks, in
+// the order of their devices.
+func DiskVolumes(volumes []Volume) []Volume {
+	var disks []Volume
+	for _, v := range volumes {
+		if v.Type == "disk" {
+			disks = append(disks, v)
+		}
+	}
+	return disks
+}
+
+// ResolveVolumes returns the volumes with sources of disk volumes made
+// absolute, so that the instance can be launched from another directory.
+func ResolveVolumes(volumes []Volume) []Volume {
+	resolved := make([]Volume, len(volumes))
+	for i, v := range volumes {
+		if v.Type == "disk" {
+			if abs, err := filepath.Abs(v.Source); err == nil {
+				v.Source = abs
+			}
+		}
+		resolved[i] = v
+	}
+	return resolved
+}
+
+// CreateVolumeDisks creates disks of the volumes that are given a size and do
+// not exist yet. Disks are sparse raw images formatted with ext, so that the
+// guest can use them right away.
+func CreateVolumeDisks(volumes []Volume) error {
+	for _, v := range DiskVolumes(volumes) {
+		if v.Size == "" {
+			continue
+		}
+		if _, err := os.Stat(v.Source); err == nil {
+			continue
+		}
+		size, err := ParseMemSize(v.Size)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Creating disk of volume %s (%s)\n", v.Path, v.Size)
+		file, err := os.Create(v.Source)
+		if err != nil {
+			return err
+		}
+		err = file.Truncate(size * 1024 * 1024)
+		file.Close()
+		if err == nil {
+			if out, mkfsErr := exec.Command("mkfs.ext4", "-F", "-q", v.Source).CombinedOutput(); mkfsErr != nil {
+				err = fmt.Errorf("mkfs.ext4 failed to format disk of volume %s: %s", v.Path, strings.TrimSpace(string(out)))
+			}
+		}
+		if err != nil {
+			os.Remove(v.Source)
+			return err
+		}
+	}
+	return nil
+}
+
+// VolumeBootOptions returns OSv options that mount the volumes. Disks are
+// expected to be attached after the root disk in the given order, i.e. the
+// first one is /dev/vblk1.
+func VolumeBootOptions(volumes []Volume) string {
+	var options []string
+	disk := 0
+	for _, v := range volumes {
+		switch v.Type {
+		case "nfs":
+			options = append(options, mountOption+"nfs,"+v.Source+","+v.Path)
+		case "disk":
+			disk++
+			fs := v.FS
+			if fs == "" {
+				fs = "zfs"
+			}
+			options = append(options, fmt.Sprintf("%s%s,/dev/vblk%d,%s", mountOption, fs, disk, v.Path))
+		case "tmpfs":
+			options = append(options, mountOption+"ramfs,none,"+v.Path)
+		}
+	}
+	return strings.Join(options, " ")
+}
+
+// ApplyVolumes replaces options that mount volumes at the beginning of the
+// command line with those of the given volumes. Options that configure the
+// guest network, which precede them, are kept in place.
+func ApplyVolumes(cmdLine string, volumes []Volume) string {
+	var kept []string
+	rest := strings.TrimLeft(cmdLine, " ")
+	for strings.HasPrefix(rest, mountOption) || hasGuestNetworkOption(rest) {
+		end := strings.Index(rest, " ")
+		if end < 0 {
+			end = len(rest)
+		}
+		if !strings.HasPrefix(rest, mountOption) {
+			kept = append(kept, rest[:end])
+		}
+		rest = strings.TrimLeft(rest[end:], " ")
+	}
+
+	if options := VolumeBootOptions(volumes); options != "" {
+		kept = append(kept, options)
+	}
+	if rest != "" {
+		kept = append(kept, rest)
+	}
+	return strings.Join(kept, " ")
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"testing"
+)
+
+func TestVolumeValidate(t *testing.T) {
+	valid := []Volume{
+		{Type: "nfs", Source: "nfs://192.168.122.1/export/data", Path: "/data"},
+		{Type: "disk", Source: "db.qcow2", Path: "/var/lib/db"},
+		{Type: "disk", Source: "/srv/static.img", Path: "/static", FS: "rofs", ReadOnly: true},
+		{Type: "disk", Source: "data.img", Path: "/data", FS: "ext", Size: "1G"},
+		{Type: "tmpfs", Path: "/tmp"},
+	}
+	for _, v := range valid {
+		if err := v.Validate(); err != nil {
+			t.Errorf("%+v: %s", v, err)
+		}
+	}
+
+	invalid := []Volume{
+		{Type: "nfs", Source: "nfs://192.168.122.1/export", Path: "data"},
+		{Type: "nfs", Source: "192.168.122.1:/export", Path: "/data"},
+		{Type: "nfs", Source: "nfs://192.168.122.1/export", Path: "/data", FS: "zfs"},
+		{Type: "disk", Source: "", Path: "/data"},
+		{Type: "disk", Source: "db,1.qcow2", Path: "/data"},
+		{Type: "disk", Source: "db.qcow2", Path: "/data", FS: "btrfs"},
+		{Type: "disk", Source: "data.img", Path: "/data", Size: "1G"},
+		{Type: "disk", Source: "data.img", Path: "/data", FS: "ext", Size: "1T"},
+		{Type: "nfs", Source: "nfs://192.168.122.1/export", Path: "/data", Size: "1G"},
+		{Type: "tmpfs", Source: "none", Path: "/tmp"},
+		{Type: "tmpfs", Path: "tmp"},
+		{Type: "ramfs", Path: "/tmp"},
+	}
+	for _, v := range invalid {
+		if err := v.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", v)
+		}
+	}
+}
+
+func TestApplyVolumes(t *testing.T) {
+	volumes := []Volume{
+		{Type: "disk", Source: "/srv/db.qcow2", Path: "/var/lib/db"},
+		{Type: "nfs", Source: "nfs://192.168.122.1/export", Path: "/data"},
+		{Type: "disk", Source: "/srv/static.img", Path: "/static", FS: "rofs"},
+		{Type: "tmpfs", Path: "/tmp"},
+	}
+	options := "--mount-fs=zfs,/dev/vblk1,/var/lib/db --mount-fs=nfs,nfs://192.168.122.1/export,/data --mount-fs=rofs,/dev/vblk2,/static --mount-fs=ramfs,none,/tmp"
+
+	cmdLine := ApplyVolumes("runscript /run/default", volumes)
+	if cmdLine != options+" runscript /run/default" {
+		t.Errorf("unexpected command line: %s", cmdLine)
+	}
+	// Options applied before are replaced, those of the guest network are kept.
+	cmdLine = ApplyGuestNetwork(cmdLine, GuestNetwork{IP: "10.0.0.2/8"})
+	cmdLine = ApplyVolumes(cmdLine, volumes[1:2])
+	if cmdLine != "--ip=eth0,10.0.0.2,255.0.0.0 --mount-fs=nfs,nfs://192.168.122.1/export,/data runscript /run/default" {
+		t.Errorf("unexpected command line: %s", cmdLine)
+	}
+	if cmdLine = ApplyVolumes(ApplyGuestNetwork(cmdLine, GuestNetwork{}), nil); cmdLine != "runscript /run/default" {
+		t.Errorf("unexpected command line: %s", cmdLine)
+	}
+}